@@ -12,6 +12,36 @@ import (
 type Node interface {
 	TokenLiteral() string
 	String() string
+	// Pos returns where the node starts.
+	Pos() token.Pos
+	// EndPos returns the position just past the node's last character, or
+	// the zero Pos if the parser did not record it.
+	EndPos() token.Pos
+}
+
+// Span records where the parser found a node. Nodes embed it after their
+// fields; one the parser did not record starts at its Token.
+type Span struct {
+	start token.Pos
+	end   token.Pos
+}
+
+// SetSpan records where the node starts and the position just past it.
+func (s *Span) SetSpan(start, end token.Pos) {
+	s.start = start
+	s.end = end
+}
+
+// EndPos returns the position just past the node.
+func (s *Span) EndPos() token.Pos { return s.end }
+
+// startPos returns the recorded start, or where tok starts if there is
+// none.
+func (s *Span) startPos(tok token.Token) token.Pos {
+	if s.start.IsValid() {
+		return s.start
+	}
+	return tok.Pos()
 }
 
 // Statement represents a statement node.
@@ -29,6 +59,20 @@ type Expression interface {
 // Program is the root node of every AST.
 type Program struct {
 	Statements []Statement
+	// MagicComments holds the magic comments at the top of the file, such
+	// as frozen_string_literal: true, keyed by name.
+	MagicComments map[string]string
+	// Data is the text after an __END__ line, which the program reads as
+	// DATA. HasData reports whether there is such a line.
+	Data    string
+	HasData bool
+}
+
+// Comment is a comment or embedded document in the source, which the tree
+// does not hold. Text is as written, from the # or =begin on.
+type Comment struct {
+	Pos  token.Pos
+	Text string
 }
 
 func (p *Program) TokenLiteral() string {
@@ -38,6 +82,22 @@ func (p *Program) TokenLiteral() string {
 	return ""
 }
 
+// Pos returns where the first statement starts.
+func (p *Program) Pos() token.Pos {
+	if len(p.Statements) > 0 {
+		return p.Statements[0].Pos()
+	}
+	return token.Pos{}
+}
+
+// EndPos returns where the last statement ends.
+func (p *Program) EndPos() token.Pos {
+	if len(p.Statements) > 0 {
+		return p.Statements[len(p.Statements)-1].EndPos()
+	}
+	return token.Pos{}
+}
+
 func (p *Program) String() string {
 	var out bytes.Buffer
 	for _, s := range p.Statements {
@@ -50,10 +110,12 @@ func (p *Program) String() string {
 type ExpressionStatement struct {
 	Token      token.Token
 	Expression Expression
+	Span
 }
 
 func (es *ExpressionStatement) statementNode()       {}
 func (es *ExpressionStatement) TokenLiteral() string { return es.Token.Literal }
+func (es *ExpressionStatement) Pos() token.Pos       { return es.startPos(es.Token) }
 func (es *ExpressionStatement) String() string {
 	if es.Expression != nil {
 		return es.Expression.String()
@@ -65,40 +127,49 @@ func (es *ExpressionStatement) String() string {
 type IntegerLiteral struct {
 	Token token.Token
 	Value int64
+	Span
 }
 
 func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
+func (il *IntegerLiteral) Pos() token.Pos       { return il.startPos(il.Token) }
 func (il *IntegerLiteral) String() string       { return il.Token.Literal }
 
 // FloatLiteral represents a float value.
 type FloatLiteral struct {
 	Token token.Token
 	Value float64
+	Span
 }
 
 func (fl *FloatLiteral) expressionNode()      {}
 func (fl *FloatLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FloatLiteral) Pos() token.Pos       { return fl.startPos(fl.Token) }
 func (fl *FloatLiteral) String() string       { return fl.Token.Literal }
 
 // StringLiteral represents a string value.
 type StringLiteral struct {
-	Token token.Token
-	Value string
+	Token  token.Token
+	Value  string
+	Frozen bool // set by the frozen_string_literal magic comment
+	Span
 }
 
 func (sl *StringLiteral) expressionNode()      {}
 func (sl *StringLiteral) TokenLiteral() string { return sl.Token.Literal }
+func (sl *StringLiteral) Pos() token.Pos       { return sl.startPos(sl.Token) }
 func (sl *StringLiteral) String() string       { return "\"" + sl.Value + "\"" }
 
 // InterpolatedString represents a string with interpolation.
 type InterpolatedString struct {
 	Token token.Token
 	Parts []Expression // StringLiteral or interpolated expressions
+	Span
 }
 
 func (is *InterpolatedString) expressionNode()      {}
 func (is *InterpolatedString) TokenLiteral() string { return is.Token.Literal }
+func (is *InterpolatedString) Pos() token.Pos       { return is.startPos(is.Token) }
 func (is *InterpolatedString) String() string {
 	var out bytes.Buffer
 	out.WriteString("\"")
@@ -115,14 +186,59 @@ func (is *InterpolatedString) String() string {
 	return out.String()
 }
 
+// InterpolatedSymbol represents a symbol with interpolation, as the words
+// of a %I literal are.
+type InterpolatedSymbol struct {
+	Token token.Token
+	Parts []Expression // StringLiteral or interpolated expressions
+	Span
+}
+
+func (is *InterpolatedSymbol) expressionNode()      {}
+func (is *InterpolatedSymbol) TokenLiteral() string { return is.Token.Literal }
+func (is *InterpolatedSymbol) Pos() token.Pos       { return is.startPos(is.Token) }
+func (is *InterpolatedSymbol) String() string {
+	str := &InterpolatedString{Parts: is.Parts}
+	return ":" + str.String()
+}
+
+// XStringLiteral represents a command string (`cmd` or %x(cmd)), run
+// through the shell when evaluated.
+type XStringLiteral struct {
+	Token token.Token
+	Parts []Expression // StringLiteral or interpolated expressions
+	Span
+}
+
+func (xl *XStringLiteral) expressionNode()      {}
+func (xl *XStringLiteral) TokenLiteral() string { return xl.Token.Literal }
+func (xl *XStringLiteral) Pos() token.Pos       { return xl.startPos(xl.Token) }
+func (xl *XStringLiteral) String() string {
+	var out bytes.Buffer
+	out.WriteString("`")
+	for _, part := range xl.Parts {
+		if sl, ok := part.(*StringLiteral); ok {
+			out.WriteString(sl.Value)
+		} else {
+			out.WriteString("#{")
+			out.WriteString(part.String())
+			out.WriteString("}")
+		}
+	}
+	out.WriteString("`")
+	return out.String()
+}
+
 // SymbolLiteral represents a symbol.
 type SymbolLiteral struct {
 	Token token.Token
 	Value string
+	Span
 }
 
 func (sl *SymbolLiteral) expressionNode()      {}
 func (sl *SymbolLiteral) TokenLiteral() string { return sl.Token.Literal }
+func (sl *SymbolLiteral) Pos() token.Pos       { return sl.startPos(sl.Token) }
 func (sl *SymbolLiteral) String() string       { return ":" + sl.Value }
 
 // RegexpLiteral represents a regular expression.
@@ -130,29 +246,35 @@ type RegexpLiteral struct {
 	Token token.Token
 	Value string
 	Flags string
+	Span
 }
 
 func (rl *RegexpLiteral) expressionNode()      {}
 func (rl *RegexpLiteral) TokenLiteral() string { return rl.Token.Literal }
+func (rl *RegexpLiteral) Pos() token.Pos       { return rl.startPos(rl.Token) }
 func (rl *RegexpLiteral) String() string       { return "/" + rl.Value + "/" + rl.Flags }
 
 // NilLiteral represents nil.
 type NilLiteral struct {
 	Token token.Token
+	Span
 }
 
 func (nl *NilLiteral) expressionNode()      {}
 func (nl *NilLiteral) TokenLiteral() string { return nl.Token.Literal }
+func (nl *NilLiteral) Pos() token.Pos       { return nl.startPos(nl.Token) }
 func (nl *NilLiteral) String() string       { return "nil" }
 
 // BooleanLiteral represents true or false.
 type BooleanLiteral struct {
 	Token token.Token
 	Value bool
+	Span
 }
 
 func (bl *BooleanLiteral) expressionNode()      {}
 func (bl *BooleanLiteral) TokenLiteral() string { return bl.Token.Literal }
+func (bl *BooleanLiteral) Pos() token.Pos       { return bl.startPos(bl.Token) }
 func (bl *BooleanLiteral) String() string {
 	if bl.Value {
 		return "true"
@@ -163,70 +285,84 @@ func (bl *BooleanLiteral) String() string {
 // SelfExpression represents self.
 type SelfExpression struct {
 	Token token.Token
+	Span
 }
 
 func (se *SelfExpression) expressionNode()      {}
 func (se *SelfExpression) TokenLiteral() string { return se.Token.Literal }
+func (se *SelfExpression) Pos() token.Pos       { return se.startPos(se.Token) }
 func (se *SelfExpression) String() string       { return "self" }
 
 // Identifier represents a local variable or method name.
 type Identifier struct {
 	Token token.Token
 	Value string
+	Span
 }
 
 func (i *Identifier) expressionNode()      {}
 func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
+func (i *Identifier) Pos() token.Pos       { return i.startPos(i.Token) }
 func (i *Identifier) String() string       { return i.Value }
 
 // Constant represents a constant.
 type Constant struct {
 	Token token.Token
 	Value string
+	Span
 }
 
 func (c *Constant) expressionNode()      {}
 func (c *Constant) TokenLiteral() string { return c.Token.Literal }
+func (c *Constant) Pos() token.Pos       { return c.startPos(c.Token) }
 func (c *Constant) String() string       { return c.Value }
 
 // InstanceVariable represents an instance variable (@foo).
 type InstanceVariable struct {
 	Token token.Token
 	Name  string
+	Span
 }
 
 func (iv *InstanceVariable) expressionNode()      {}
 func (iv *InstanceVariable) TokenLiteral() string { return iv.Token.Literal }
+func (iv *InstanceVariable) Pos() token.Pos       { return iv.startPos(iv.Token) }
 func (iv *InstanceVariable) String() string       { return iv.Name }
 
 // ClassVariable represents a class variable (@@foo).
 type ClassVariable struct {
 	Token token.Token
 	Name  string
+	Span
 }
 
 func (cv *ClassVariable) expressionNode()      {}
 func (cv *ClassVariable) TokenLiteral() string { return cv.Token.Literal }
+func (cv *ClassVariable) Pos() token.Pos       { return cv.startPos(cv.Token) }
 func (cv *ClassVariable) String() string       { return cv.Name }
 
 // GlobalVariable represents a global variable ($foo).
 type GlobalVariable struct {
 	Token token.Token
 	Name  string
+	Span
 }
 
 func (gv *GlobalVariable) expressionNode()      {}
 func (gv *GlobalVariable) TokenLiteral() string { return gv.Token.Literal }
+func (gv *GlobalVariable) Pos() token.Pos       { return gv.startPos(gv.Token) }
 func (gv *GlobalVariable) String() string       { return gv.Name }
 
 // ArrayLiteral represents an array literal.
 type ArrayLiteral struct {
 	Token    token.Token
 	Elements []Expression
+	Span
 }
 
 func (al *ArrayLiteral) expressionNode()      {}
 func (al *ArrayLiteral) TokenLiteral() string { return al.Token.Literal }
+func (al *ArrayLiteral) Pos() token.Pos       { return al.startPos(al.Token) }
 func (al *ArrayLiteral) String() string {
 	var out bytes.Buffer
 	elements := make([]string, len(al.Elements))
@@ -245,10 +381,12 @@ type HashLiteral struct {
 	Pairs         map[Expression]Expression
 	Order         []Expression // To maintain key order
 	IsKeywordArgs bool         // True if this is an implicit keyword arguments hash
+	Span
 }
 
 func (hl *HashLiteral) expressionNode()      {}
 func (hl *HashLiteral) TokenLiteral() string { return hl.Token.Literal }
+func (hl *HashLiteral) Pos() token.Pos       { return hl.startPos(hl.Token) }
 func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 	pairs := make([]string, 0, len(hl.Pairs))
@@ -268,10 +406,12 @@ type RangeLiteral struct {
 	Start     Expression
 	End       Expression
 	Exclusive bool // true for ..., false for ..
+	Span
 }
 
 func (rl *RangeLiteral) expressionNode()      {}
 func (rl *RangeLiteral) TokenLiteral() string { return rl.Token.Literal }
+func (rl *RangeLiteral) Pos() token.Pos       { return rl.startPos(rl.Token) }
 func (rl *RangeLiteral) String() string {
 	var out bytes.Buffer
 	if rl.Start != nil {
@@ -293,10 +433,12 @@ type PrefixExpression struct {
 	Token    token.Token
 	Operator string
 	Right    Expression
+	Span
 }
 
 func (pe *PrefixExpression) expressionNode()      {}
 func (pe *PrefixExpression) TokenLiteral() string { return pe.Token.Literal }
+func (pe *PrefixExpression) Pos() token.Pos       { return pe.startPos(pe.Token) }
 func (pe *PrefixExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -312,10 +454,12 @@ type InfixExpression struct {
 	Left     Expression
 	Operator string
 	Right    Expression
+	Span
 }
 
 func (ie *InfixExpression) expressionNode()      {}
 func (ie *InfixExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *InfixExpression) Pos() token.Pos       { return ie.startPos(ie.Token) }
 func (ie *InfixExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -331,10 +475,12 @@ type AssignmentExpression struct {
 	Token token.Token
 	Left  Expression
 	Value Expression
+	Span
 }
 
 func (ae *AssignmentExpression) expressionNode()      {}
 func (ae *AssignmentExpression) TokenLiteral() string { return ae.Token.Literal }
+func (ae *AssignmentExpression) Pos() token.Pos       { return ae.startPos(ae.Token) }
 func (ae *AssignmentExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString(ae.Left.String())
@@ -349,10 +495,12 @@ type OpAssignmentExpression struct {
 	Left     Expression
 	Operator string
 	Value    Expression
+	Span
 }
 
 func (oa *OpAssignmentExpression) expressionNode()      {}
 func (oa *OpAssignmentExpression) TokenLiteral() string { return oa.Token.Literal }
+func (oa *OpAssignmentExpression) Pos() token.Pos       { return oa.startPos(oa.Token) }
 func (oa *OpAssignmentExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString(oa.Left.String())
@@ -363,13 +511,15 @@ func (oa *OpAssignmentExpression) String() string {
 
 // MultipleAssignment represents parallel assignment (a, b = 1, 2).
 type MultipleAssignment struct {
-	Token  token.Token
-	Left   []Expression
-	Right  []Expression
+	Token token.Token
+	Left  []Expression
+	Right []Expression
+	Span
 }
 
 func (ma *MultipleAssignment) expressionNode()      {}
 func (ma *MultipleAssignment) TokenLiteral() string { return ma.Token.Literal }
+func (ma *MultipleAssignment) Pos() token.Pos       { return ma.startPos(ma.Token) }
 func (ma *MultipleAssignment) String() string {
 	var out bytes.Buffer
 	lefts := make([]string, len(ma.Left))
@@ -386,6 +536,25 @@ func (ma *MultipleAssignment) String() string {
 	return out.String()
 }
 
+// MultipleTarget represents a parenthesized group of assignment targets
+// that destructures one value, as in (a, b), c = pair, 3.
+type MultipleTarget struct {
+	Token   token.Token
+	Targets []Expression
+	Span
+}
+
+func (mt *MultipleTarget) expressionNode()      {}
+func (mt *MultipleTarget) TokenLiteral() string { return mt.Token.Literal }
+func (mt *MultipleTarget) Pos() token.Pos       { return mt.startPos(mt.Token) }
+func (mt *MultipleTarget) String() string {
+	targets := make([]string, len(mt.Targets))
+	for i, t := range mt.Targets {
+		targets[i] = t.String()
+	}
+	return "(" + strings.Join(targets, ", ") + ")"
+}
+
 // MethodCall represents a method call.
 type MethodCall struct {
 	Token     token.Token
@@ -394,10 +563,12 @@ type MethodCall struct {
 	Arguments []Expression
 	Block     *Block
 	SafeNav   bool // true if using &.
+	Span
 }
 
 func (mc *MethodCall) expressionNode()      {}
 func (mc *MethodCall) TokenLiteral() string { return mc.Token.Literal }
+func (mc *MethodCall) Pos() token.Pos       { return mc.startPos(mc.Token) }
 func (mc *MethodCall) String() string {
 	var out bytes.Buffer
 	if mc.Receiver != nil {
@@ -427,18 +598,24 @@ func (mc *MethodCall) String() string {
 
 // IndexExpression represents array/hash indexing.
 type IndexExpression struct {
-	Token token.Token
-	Left  Expression
-	Index Expression
+	Token     token.Token
+	Left      Expression
+	Arguments []Expression // what the brackets hold, as in arr[start, length]
+	Span
 }
 
 func (ie *IndexExpression) expressionNode()      {}
 func (ie *IndexExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IndexExpression) Pos() token.Pos       { return ie.startPos(ie.Token) }
 func (ie *IndexExpression) String() string {
 	var out bytes.Buffer
+	args := []string{}
+	for _, a := range ie.Arguments {
+		args = append(args, a.String())
+	}
 	out.WriteString(ie.Left.String())
 	out.WriteString("[")
-	out.WriteString(ie.Index.String())
+	out.WriteString(strings.Join(args, ", "))
 	out.WriteString("]")
 	return out.String()
 }
@@ -448,20 +625,26 @@ type Block struct {
 	Token      token.Token
 	Parameters []*BlockParameter
 	Body       *BlockBody
+	Span
 }
 
 func (b *Block) expressionNode()      {}
 func (b *Block) TokenLiteral() string { return b.Token.Literal }
+func (b *Block) Pos() token.Pos       { return b.startPos(b.Token) }
 func (b *Block) String() string {
 	var out bytes.Buffer
 	out.WriteString("{ ")
-	if len(b.Parameters) > 0 {
+	if len(b.Parameters) > 0 || len(b.Body.Locals) > 0 {
 		out.WriteString("|")
 		params := make([]string, len(b.Parameters))
 		for i, p := range b.Parameters {
 			params[i] = p.String()
 		}
 		out.WriteString(strings.Join(params, ", "))
+		if len(b.Body.Locals) > 0 {
+			out.WriteString("; ")
+			out.WriteString(strings.Join(b.Body.Locals, ", "))
+		}
 		out.WriteString("| ")
 	}
 	out.WriteString(b.Body.String())
@@ -501,6 +684,7 @@ func (bp *BlockParameter) String() string {
 // BlockBody represents the body of a block.
 type BlockBody struct {
 	Statements []Statement
+	Locals     []string // block-local variables declared after ; in |x; tmp|
 }
 
 func (bb *BlockBody) String() string {
@@ -519,10 +703,12 @@ type Lambda struct {
 	Token      token.Token
 	Parameters []*BlockParameter
 	Body       *BlockBody
+	Span
 }
 
 func (l *Lambda) expressionNode()      {}
 func (l *Lambda) TokenLiteral() string { return l.Token.Literal }
+func (l *Lambda) Pos() token.Pos       { return l.startPos(l.Token) }
 func (l *Lambda) String() string {
 	var out bytes.Buffer
 	out.WriteString("->")
@@ -549,10 +735,12 @@ type IfExpression struct {
 	Alternative *IfExpression // for elsif chain
 	ElseBody    *BlockBody    // for else
 	Unless      bool          // true if unless
+	Span
 }
 
 func (ie *IfExpression) expressionNode()      {}
 func (ie *IfExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IfExpression) Pos() token.Pos       { return ie.startPos(ie.Token) }
 func (ie *IfExpression) String() string {
 	var out bytes.Buffer
 	if ie.Unless {
@@ -581,10 +769,12 @@ type TernaryExpression struct {
 	Condition   Expression
 	Consequence Expression
 	Alternative Expression
+	Span
 }
 
 func (te *TernaryExpression) expressionNode()      {}
 func (te *TernaryExpression) TokenLiteral() string { return te.Token.Literal }
+func (te *TernaryExpression) Pos() token.Pos       { return te.startPos(te.Token) }
 func (te *TernaryExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString(te.Condition.String())
@@ -601,10 +791,12 @@ type ModifierExpression struct {
 	Body      Expression
 	Condition Expression
 	Modifier  string // "if", "unless", "while", "until"
+	Span
 }
 
 func (me *ModifierExpression) expressionNode()      {}
 func (me *ModifierExpression) TokenLiteral() string { return me.Token.Literal }
+func (me *ModifierExpression) Pos() token.Pos       { return me.startPos(me.Token) }
 func (me *ModifierExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString(me.Body.String())
@@ -615,16 +807,41 @@ func (me *ModifierExpression) String() string {
 	return out.String()
 }
 
+// ModifierStatement represents a return, break or next statement followed
+// by an if/unless/while/until modifier.
+type ModifierStatement struct {
+	Token     token.Token
+	Body      Statement
+	Condition Expression
+	Modifier  string // "if", "unless", "while", "until"
+	Span
+}
+
+func (ms *ModifierStatement) statementNode()       {}
+func (ms *ModifierStatement) TokenLiteral() string { return ms.Token.Literal }
+func (ms *ModifierStatement) Pos() token.Pos       { return ms.startPos(ms.Token) }
+func (ms *ModifierStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString(ms.Body.String())
+	out.WriteString(" ")
+	out.WriteString(ms.Modifier)
+	out.WriteString(" ")
+	out.WriteString(ms.Condition.String())
+	return out.String()
+}
+
 // CaseExpression represents a case/when expression.
 type CaseExpression struct {
 	Token   token.Token
 	Subject Expression // can be nil for case without subject
 	Whens   []*WhenClause
 	Else    *BlockBody
+	Span
 }
 
 func (ce *CaseExpression) expressionNode()      {}
 func (ce *CaseExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CaseExpression) Pos() token.Pos       { return ce.startPos(ce.Token) }
 func (ce *CaseExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("case")
@@ -666,16 +883,259 @@ func (wc *WhenClause) String() string {
 	return out.String()
 }
 
+// CaseInExpression represents pattern matching with case/in, as opposed
+// to the === tests of case/when.
+type CaseInExpression struct {
+	Token   token.Token
+	Subject Expression
+	Clauses []*InClause
+	Else    *BlockBody
+	Span
+}
+
+func (ci *CaseInExpression) expressionNode()      {}
+func (ci *CaseInExpression) TokenLiteral() string { return ci.Token.Literal }
+func (ci *CaseInExpression) Pos() token.Pos       { return ci.startPos(ci.Token) }
+func (ci *CaseInExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("case ")
+	out.WriteString(ci.Subject.String())
+	out.WriteString("\n")
+	for _, c := range ci.Clauses {
+		out.WriteString(c.String())
+		out.WriteString("\n")
+	}
+	if ci.Else != nil {
+		out.WriteString("else\n")
+		out.WriteString(ci.Else.String())
+		out.WriteString("\n")
+	}
+	out.WriteString("end")
+	return out.String()
+}
+
+// InClause represents an in clause of a case/in expression, with an
+// optional if or unless guard.
+type InClause struct {
+	Token   token.Token
+	Pattern Pattern
+	Guard   Expression
+	Unless  bool // true if the guard is unless
+	Body    *BlockBody
+}
+
+func (ic *InClause) String() string {
+	var out bytes.Buffer
+	out.WriteString("in ")
+	out.WriteString(ic.Pattern.String())
+	if ic.Guard != nil {
+		if ic.Unless {
+			out.WriteString(" unless ")
+		} else {
+			out.WriteString(" if ")
+		}
+		out.WriteString(ic.Guard.String())
+	}
+	out.WriteString("\n")
+	out.WriteString(ic.Body.String())
+	return out.String()
+}
+
+// Pattern represents a pattern of a case/in clause.
+type Pattern interface {
+	Node
+	patternNode()
+}
+
+// ValuePattern matches when its value === the subject: literals, ranges,
+// constants and other expressions.
+type ValuePattern struct {
+	Token token.Token
+	Value Expression
+	Span
+}
+
+func (vp *ValuePattern) patternNode()         {}
+func (vp *ValuePattern) TokenLiteral() string { return vp.Token.Literal }
+func (vp *ValuePattern) Pos() token.Pos       { return vp.startPos(vp.Token) }
+func (vp *ValuePattern) String() string       { return vp.Value.String() }
+
+// PinPattern matches against the value of an existing variable or
+// expression (^name, ^(expr)) instead of binding.
+type PinPattern struct {
+	Token token.Token
+	Value Expression
+	Span
+}
+
+func (pp *PinPattern) patternNode()         {}
+func (pp *PinPattern) TokenLiteral() string { return pp.Token.Literal }
+func (pp *PinPattern) Pos() token.Pos       { return pp.startPos(pp.Token) }
+func (pp *PinPattern) String() string       { return "^" + pp.Value.String() }
+
+// BindingPattern matches anything and binds it to a local variable.
+type BindingPattern struct {
+	Token token.Token
+	Name  string
+	Span
+}
+
+func (bp *BindingPattern) patternNode()         {}
+func (bp *BindingPattern) TokenLiteral() string { return bp.Token.Literal }
+func (bp *BindingPattern) Pos() token.Pos       { return bp.startPos(bp.Token) }
+func (bp *BindingPattern) String() string       { return bp.Name }
+
+// CapturePattern binds the subject to a local variable when its pattern
+// matches (pattern => name).
+type CapturePattern struct {
+	Token   token.Token
+	Pattern Pattern
+	Name    string
+	Span
+}
+
+func (cp *CapturePattern) patternNode()         {}
+func (cp *CapturePattern) TokenLiteral() string { return cp.Token.Literal }
+func (cp *CapturePattern) Pos() token.Pos       { return cp.startPos(cp.Token) }
+func (cp *CapturePattern) String() string       { return cp.Pattern.String() + " => " + cp.Name }
+
+// AlternativePattern matches when any of its patterns does (a | b).
+type AlternativePattern struct {
+	Token        token.Token
+	Alternatives []Pattern
+	Span
+}
+
+func (ap *AlternativePattern) patternNode()         {}
+func (ap *AlternativePattern) TokenLiteral() string { return ap.Token.Literal }
+func (ap *AlternativePattern) Pos() token.Pos       { return ap.startPos(ap.Token) }
+func (ap *AlternativePattern) String() string {
+	alts := make([]string, len(ap.Alternatives))
+	for i, a := range ap.Alternatives {
+		alts[i] = a.String()
+	}
+	return strings.Join(alts, " | ")
+}
+
+// RestPattern is the *name (or bare *) collecting the elements an array
+// or find pattern does not match one by one, or the **name of a hash
+// pattern.
+type RestPattern struct {
+	Token token.Token
+	Name  string // empty for an anonymous rest
+	Span
+}
+
+func (rp *RestPattern) patternNode()         {}
+func (rp *RestPattern) TokenLiteral() string { return rp.Token.Literal }
+func (rp *RestPattern) Pos() token.Pos       { return rp.startPos(rp.Token) }
+func (rp *RestPattern) String() string       { return rp.Token.Literal + rp.Name }
+
+// ArrayPattern matches an array, element by element, with an optional
+// rest between the leading and trailing elements. Constant, when set,
+// must === the subject first, as in Point[x, y].
+type ArrayPattern struct {
+	Token    token.Token
+	Constant Expression
+	Pre      []Pattern
+	Rest     *RestPattern
+	Post     []Pattern
+	Span
+}
+
+func (ap *ArrayPattern) patternNode()         {}
+func (ap *ArrayPattern) TokenLiteral() string { return ap.Token.Literal }
+func (ap *ArrayPattern) Pos() token.Pos       { return ap.startPos(ap.Token) }
+func (ap *ArrayPattern) String() string {
+	var elems []string
+	for _, e := range ap.Pre {
+		elems = append(elems, e.String())
+	}
+	if ap.Rest != nil {
+		elems = append(elems, ap.Rest.String())
+	}
+	for _, e := range ap.Post {
+		elems = append(elems, e.String())
+	}
+	return patternConstant(ap.Constant) + "[" + strings.Join(elems, ", ") + "]"
+}
+
+// FindPattern matches an array containing Middle anywhere in it, as in
+// [*, 42, *post].
+type FindPattern struct {
+	Token    token.Token
+	Constant Expression
+	Pre      *RestPattern
+	Middle   []Pattern
+	Post     *RestPattern
+	Span
+}
+
+func (fp *FindPattern) patternNode()         {}
+func (fp *FindPattern) TokenLiteral() string { return fp.Token.Literal }
+func (fp *FindPattern) Pos() token.Pos       { return fp.startPos(fp.Token) }
+func (fp *FindPattern) String() string {
+	elems := []string{fp.Pre.String()}
+	for _, e := range fp.Middle {
+		elems = append(elems, e.String())
+	}
+	elems = append(elems, fp.Post.String())
+	return patternConstant(fp.Constant) + "[" + strings.Join(elems, ", ") + "]"
+}
+
+// HashPattern matches a hash with the given symbol keys. A key without a
+// value pattern binds a local variable of the same name. Rest collects
+// the other keys; NilRest (**nil) forbids any.
+type HashPattern struct {
+	Token    token.Token
+	Constant Expression
+	Keys     []string
+	Values   []Pattern // nil entries for keys that only bind
+	Rest     *RestPattern
+	NilRest  bool
+	Span
+}
+
+func (hp *HashPattern) patternNode()         {}
+func (hp *HashPattern) TokenLiteral() string { return hp.Token.Literal }
+func (hp *HashPattern) Pos() token.Pos       { return hp.startPos(hp.Token) }
+func (hp *HashPattern) String() string {
+	var pairs []string
+	for i, key := range hp.Keys {
+		if hp.Values[i] == nil {
+			pairs = append(pairs, key+":")
+		} else {
+			pairs = append(pairs, key+": "+hp.Values[i].String())
+		}
+	}
+	if hp.Rest != nil {
+		pairs = append(pairs, hp.Rest.String())
+	}
+	if hp.NilRest {
+		pairs = append(pairs, "**nil")
+	}
+	return patternConstant(hp.Constant) + "{" + strings.Join(pairs, ", ") + "}"
+}
+
+func patternConstant(constant Expression) string {
+	if constant == nil {
+		return ""
+	}
+	return constant.String()
+}
+
 // WhileExpression represents a while/until loop.
 type WhileExpression struct {
 	Token     token.Token
 	Condition Expression
 	Body      *BlockBody
 	Until     bool // true if until
+	Span
 }
 
 func (we *WhileExpression) expressionNode()      {}
 func (we *WhileExpression) TokenLiteral() string { return we.Token.Literal }
+func (we *WhileExpression) Pos() token.Pos       { return we.startPos(we.Token) }
 func (we *WhileExpression) String() string {
 	var out bytes.Buffer
 	if we.Until {
@@ -696,10 +1156,12 @@ type ForExpression struct {
 	Variable Expression
 	Iterable Expression
 	Body     *BlockBody
+	Span
 }
 
 func (fe *ForExpression) expressionNode()      {}
 func (fe *ForExpression) TokenLiteral() string { return fe.Token.Literal }
+func (fe *ForExpression) Pos() token.Pos       { return fe.startPos(fe.Token) }
 func (fe *ForExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("for ")
@@ -719,10 +1181,12 @@ type BeginExpression struct {
 	Rescues []*RescueClause
 	Else    *BlockBody
 	Ensure  *BlockBody
+	Span
 }
 
 func (be *BeginExpression) expressionNode()      {}
 func (be *BeginExpression) TokenLiteral() string { return be.Token.Literal }
+func (be *BeginExpression) Pos() token.Pos       { return be.startPos(be.Token) }
 func (be *BeginExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("begin\n")
@@ -778,10 +1242,12 @@ type MethodDefinition struct {
 	Receiver   Expression // for singleton methods (def self.foo)
 	Parameters []*MethodParameter
 	Body       *BlockBody
+	Span
 }
 
 func (md *MethodDefinition) statementNode()       {}
 func (md *MethodDefinition) TokenLiteral() string { return md.Token.Literal }
+func (md *MethodDefinition) Pos() token.Pos       { return md.startPos(md.Token) }
 func (md *MethodDefinition) String() string {
 	var out bytes.Buffer
 	out.WriteString("def ")
@@ -847,10 +1313,12 @@ type ClassDefinition struct {
 	Name       *Constant
 	Superclass Expression
 	Body       *BlockBody
+	Span
 }
 
 func (cd *ClassDefinition) statementNode()       {}
 func (cd *ClassDefinition) TokenLiteral() string { return cd.Token.Literal }
+func (cd *ClassDefinition) Pos() token.Pos       { return cd.startPos(cd.Token) }
 func (cd *ClassDefinition) String() string {
 	var out bytes.Buffer
 	out.WriteString("class ")
@@ -870,10 +1338,12 @@ type SingletonClassDefinition struct {
 	Token  token.Token
 	Object Expression
 	Body   *BlockBody
+	Span
 }
 
 func (scd *SingletonClassDefinition) statementNode()       {}
 func (scd *SingletonClassDefinition) TokenLiteral() string { return scd.Token.Literal }
+func (scd *SingletonClassDefinition) Pos() token.Pos       { return scd.startPos(scd.Token) }
 func (scd *SingletonClassDefinition) String() string {
 	var out bytes.Buffer
 	out.WriteString("class << ")
@@ -889,10 +1359,12 @@ type ModuleDefinition struct {
 	Token token.Token
 	Name  *Constant
 	Body  *BlockBody
+	Span
 }
 
 func (md *ModuleDefinition) statementNode()       {}
 func (md *ModuleDefinition) TokenLiteral() string { return md.Token.Literal }
+func (md *ModuleDefinition) Pos() token.Pos       { return md.startPos(md.Token) }
 func (md *ModuleDefinition) String() string {
 	var out bytes.Buffer
 	out.WriteString("module ")
@@ -907,10 +1379,12 @@ func (md *ModuleDefinition) String() string {
 type ReturnStatement struct {
 	Token token.Token
 	Value Expression
+	Span
 }
 
 func (rs *ReturnStatement) statementNode()       {}
 func (rs *ReturnStatement) TokenLiteral() string { return rs.Token.Literal }
+func (rs *ReturnStatement) Pos() token.Pos       { return rs.startPos(rs.Token) }
 func (rs *ReturnStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString("return")
@@ -925,10 +1399,12 @@ func (rs *ReturnStatement) String() string {
 type BreakStatement struct {
 	Token token.Token
 	Value Expression
+	Span
 }
 
 func (bs *BreakStatement) statementNode()       {}
 func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BreakStatement) Pos() token.Pos       { return bs.startPos(bs.Token) }
 func (bs *BreakStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString("break")
@@ -943,10 +1419,12 @@ func (bs *BreakStatement) String() string {
 type NextStatement struct {
 	Token token.Token
 	Value Expression
+	Span
 }
 
 func (ns *NextStatement) statementNode()       {}
 func (ns *NextStatement) TokenLiteral() string { return ns.Token.Literal }
+func (ns *NextStatement) Pos() token.Pos       { return ns.startPos(ns.Token) }
 func (ns *NextStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString("next")
@@ -960,29 +1438,35 @@ func (ns *NextStatement) String() string {
 // RedoStatement represents a redo statement.
 type RedoStatement struct {
 	Token token.Token
+	Span
 }
 
 func (rs *RedoStatement) statementNode()       {}
 func (rs *RedoStatement) TokenLiteral() string { return rs.Token.Literal }
+func (rs *RedoStatement) Pos() token.Pos       { return rs.startPos(rs.Token) }
 func (rs *RedoStatement) String() string       { return "redo" }
 
 // RetryStatement represents a retry statement.
 type RetryStatement struct {
 	Token token.Token
+	Span
 }
 
 func (rs *RetryStatement) statementNode()       {}
 func (rs *RetryStatement) TokenLiteral() string { return rs.Token.Literal }
+func (rs *RetryStatement) Pos() token.Pos       { return rs.startPos(rs.Token) }
 func (rs *RetryStatement) String() string       { return "retry" }
 
 // YieldExpression represents yield.
 type YieldExpression struct {
 	Token     token.Token
 	Arguments []Expression
+	Span
 }
 
 func (ye *YieldExpression) expressionNode()      {}
 func (ye *YieldExpression) TokenLiteral() string { return ye.Token.Literal }
+func (ye *YieldExpression) Pos() token.Pos       { return ye.startPos(ye.Token) }
 func (ye *YieldExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("yield")
@@ -1003,10 +1487,12 @@ type SuperExpression struct {
 	Token     token.Token
 	Arguments []Expression
 	HasParens bool // true if super() vs super
+	Span
 }
 
 func (se *SuperExpression) expressionNode()      {}
 func (se *SuperExpression) TokenLiteral() string { return se.Token.Literal }
+func (se *SuperExpression) Pos() token.Pos       { return se.startPos(se.Token) }
 func (se *SuperExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("super")
@@ -1026,10 +1512,12 @@ func (se *SuperExpression) String() string {
 type DefinedExpression struct {
 	Token      token.Token
 	Expression Expression
+	Span
 }
 
 func (de *DefinedExpression) expressionNode()      {}
 func (de *DefinedExpression) TokenLiteral() string { return de.Token.Literal }
+func (de *DefinedExpression) Pos() token.Pos       { return de.startPos(de.Token) }
 func (de *DefinedExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("defined?(")
@@ -1043,10 +1531,12 @@ type AliasStatement struct {
 	Token token.Token
 	New   Expression
 	Old   Expression
+	Span
 }
 
 func (as *AliasStatement) statementNode()       {}
 func (as *AliasStatement) TokenLiteral() string { return as.Token.Literal }
+func (as *AliasStatement) Pos() token.Pos       { return as.startPos(as.Token) }
 func (as *AliasStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString("alias ")
@@ -1060,10 +1550,12 @@ func (as *AliasStatement) String() string {
 type UndefStatement struct {
 	Token   token.Token
 	Methods []Expression
+	Span
 }
 
 func (us *UndefStatement) statementNode()       {}
 func (us *UndefStatement) TokenLiteral() string { return us.Token.Literal }
+func (us *UndefStatement) Pos() token.Pos       { return us.startPos(us.Token) }
 func (us *UndefStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString("undef ")
@@ -1080,10 +1572,12 @@ type ScopedConstant struct {
 	Token token.Token
 	Left  Expression
 	Name  string
+	Span
 }
 
 func (sc *ScopedConstant) expressionNode()      {}
 func (sc *ScopedConstant) TokenLiteral() string { return sc.Token.Literal }
+func (sc *ScopedConstant) Pos() token.Pos       { return sc.startPos(sc.Token) }
 func (sc *ScopedConstant) String() string {
 	var out bytes.Buffer
 	if sc.Left != nil {
@@ -1098,14 +1592,18 @@ func (sc *ScopedConstant) String() string {
 type SplatExpression struct {
 	Token      token.Token
 	Expression Expression
+	Span
 }
 
 func (se *SplatExpression) expressionNode()      {}
 func (se *SplatExpression) TokenLiteral() string { return se.Token.Literal }
+func (se *SplatExpression) Pos() token.Pos       { return se.startPos(se.Token) }
 func (se *SplatExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("*")
-	out.WriteString(se.Expression.String())
+	if se.Expression != nil {
+		out.WriteString(se.Expression.String())
+	}
 	return out.String()
 }
 
@@ -1113,10 +1611,12 @@ func (se *SplatExpression) String() string {
 type DoubleSplatExpression struct {
 	Token      token.Token
 	Expression Expression
+	Span
 }
 
 func (dse *DoubleSplatExpression) expressionNode()      {}
 func (dse *DoubleSplatExpression) TokenLiteral() string { return dse.Token.Literal }
+func (dse *DoubleSplatExpression) Pos() token.Pos       { return dse.startPos(dse.Token) }
 func (dse *DoubleSplatExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("**")
@@ -1128,10 +1628,12 @@ func (dse *DoubleSplatExpression) String() string {
 type BlockArgExpression struct {
 	Token      token.Token
 	Expression Expression
+	Span
 }
 
 func (bae *BlockArgExpression) expressionNode()      {}
 func (bae *BlockArgExpression) TokenLiteral() string { return bae.Token.Literal }
+func (bae *BlockArgExpression) Pos() token.Pos       { return bae.startPos(bae.Token) }
 func (bae *BlockArgExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("&")
@@ -1143,10 +1645,12 @@ func (bae *BlockArgExpression) String() string {
 type NotExpression struct {
 	Token      token.Token
 	Expression Expression
+	Span
 }
 
 func (ne *NotExpression) expressionNode()      {}
 func (ne *NotExpression) TokenLiteral() string { return ne.Token.Literal }
+func (ne *NotExpression) Pos() token.Pos       { return ne.startPos(ne.Token) }
 func (ne *NotExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("not ")
@@ -1159,10 +1663,12 @@ type AndExpression struct {
 	Token token.Token
 	Left  Expression
 	Right Expression
+	Span
 }
 
 func (ae *AndExpression) expressionNode()      {}
 func (ae *AndExpression) TokenLiteral() string { return ae.Token.Literal }
+func (ae *AndExpression) Pos() token.Pos       { return ae.startPos(ae.Token) }
 func (ae *AndExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -1178,10 +1684,12 @@ type OrExpression struct {
 	Token token.Token
 	Left  Expression
 	Right Expression
+	Span
 }
 
 func (oe *OrExpression) expressionNode()      {}
 func (oe *OrExpression) TokenLiteral() string { return oe.Token.Literal }
+func (oe *OrExpression) Pos() token.Pos       { return oe.startPos(oe.Token) }
 func (oe *OrExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -1194,13 +1702,15 @@ func (oe *OrExpression) String() string {
 
 // RescueModifier represents expr rescue expr.
 type RescueModifier struct {
-	Token   token.Token
-	Body    Expression
-	Rescue  Expression
+	Token  token.Token
+	Body   Expression
+	Rescue Expression
+	Span
 }
 
 func (rm *RescueModifier) expressionNode()      {}
 func (rm *RescueModifier) TokenLiteral() string { return rm.Token.Literal }
+func (rm *RescueModifier) Pos() token.Pos       { return rm.startPos(rm.Token) }
 func (rm *RescueModifier) String() string {
 	var out bytes.Buffer
 	out.WriteString(rm.Body.String())
@@ -1211,10 +1721,13 @@ func (rm *RescueModifier) String() string {
 
 // MagicComment represents __FILE__, __LINE__, __ENCODING__.
 type MagicComment struct {
-	Token token.Token
-	Kind  string // "FILE", "LINE", "ENCODING"
+	Token    token.Token
+	Kind     string // "FILE", "LINE", "ENCODING"
+	Encoding string // the source encoding, for __ENCODING__
+	Span
 }
 
 func (mc *MagicComment) expressionNode()      {}
 func (mc *MagicComment) TokenLiteral() string { return mc.Token.Literal }
+func (mc *MagicComment) Pos() token.Pos       { return mc.startPos(mc.Token) }
 func (mc *MagicComment) String() string       { return "__" + mc.Kind + "__" }
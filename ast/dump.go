@@ -0,0 +1,239 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/alexisbouchez/rubylexer/token"
+)
+
+// Dump returns node as an s-expression for tests and debugging. Each node
+// is written as (Type :Field value ...): scalar fields on the opening line,
+// then nodes and lists of nodes indented on lines of their own. Empty
+// fields are left out, and so are tokens and positions, so the output
+// only changes when the tree does.
+func Dump(node Node) string {
+	var out bytes.Buffer
+	writeSExpr(&out, dumpValue(reflect.ValueOf(node)), 0)
+	return out.String()
+}
+
+// MarshalJSON returns node as JSON for tooling. Each node is an object
+// with its "type", its "pos" and "end" as "line:column" when known, and
+// its non-empty fields under their Go names, in declaration order.
+func MarshalJSON(node Node) ([]byte, error) {
+	var out bytes.Buffer
+	if err := writeJSON(&out, dumpValue(reflect.ValueOf(node))); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// dumpNode is the format-neutral form of a node both dumps are written
+// from. Field values are *dumpNode, []interface{}, string, bool, int64 or
+// float64; nil means the field is empty.
+type dumpNode struct {
+	typ    string
+	pos    token.Pos
+	end    token.Pos
+	fields []dumpField
+}
+
+type dumpField struct {
+	name  string
+	value interface{}
+}
+
+var (
+	tokenType = reflect.TypeOf(token.Token{})
+	nodeType  = reflect.TypeOf((*Node)(nil)).Elem()
+)
+
+func dumpValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Kind() == reflect.Interface {
+			return dumpValue(v.Elem())
+		}
+		if v.Elem().Kind() == reflect.Struct {
+			return dumpStruct(v)
+		}
+		return dumpValue(v.Elem())
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return nil
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = dumpValue(v.Index(i))
+		}
+		return items
+	case reflect.String:
+		if v.String() == "" {
+			return nil
+		}
+		return v.String()
+	case reflect.Bool:
+		if !v.Bool() {
+			return nil
+		}
+		return true
+	case reflect.Int, reflect.Int64:
+		return v.Int()
+	case reflect.Float64:
+		return v.Float()
+	}
+	return nil
+}
+
+// dumpStruct converts a pointer to a node, or to a struct such as a
+// BlockBody or a WhenClause that only appears inside nodes.
+func dumpStruct(v reflect.Value) *dumpNode {
+	elem := v.Elem()
+	dn := &dumpNode{typ: elem.Type().Name()}
+	if v.Type().Implements(nodeType) {
+		node := v.Interface().(Node)
+		dn.pos, dn.end = node.Pos(), node.EndPos()
+	}
+
+	// A hash literal's pairs live in a map; list them in source order
+	if hash, ok := v.Interface().(*HashLiteral); ok {
+		pairs := make([]interface{}, len(hash.Order))
+		for i, key := range hash.Order {
+			pairs[i] = &dumpNode{typ: "Pair", fields: []dumpField{
+				{"Key", dumpValue(reflect.ValueOf(key))},
+				{"Value", dumpValue(reflect.ValueOf(hash.Pairs[key]))},
+			}}
+		}
+		if len(pairs) > 0 {
+			dn.fields = append(dn.fields, dumpField{"Pairs", pairs})
+		}
+		if hash.IsKeywordArgs {
+			dn.fields = append(dn.fields, dumpField{"IsKeywordArgs", true})
+		}
+		return dn
+	}
+
+	for i := 0; i < elem.NumField(); i++ {
+		field := elem.Type().Field(i)
+		if field.Anonymous || field.PkgPath != "" || field.Type == tokenType {
+			continue
+		}
+		if value := dumpValue(elem.Field(i)); value != nil {
+			dn.fields = append(dn.fields, dumpField{field.Name, value})
+		}
+	}
+	return dn
+}
+
+// isNested reports whether a value is written on a line of its own in an
+// s-expression.
+func isNested(value interface{}) bool {
+	switch value := value.(type) {
+	case *dumpNode:
+		return true
+	case []interface{}:
+		for _, item := range value {
+			if isNested(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeSExpr(out *bytes.Buffer, value interface{}, indent int) {
+	switch value := value.(type) {
+	case nil:
+		out.WriteString("nil")
+	case *dumpNode:
+		out.WriteString("(" + value.typ)
+		for _, field := range value.fields {
+			if !isNested(field.value) {
+				out.WriteString(" :" + field.name + " ")
+				writeSExpr(out, field.value, indent)
+			}
+		}
+		for _, field := range value.fields {
+			if isNested(field.value) {
+				out.WriteString("\n" + strings.Repeat("  ", indent+1) + ":" + field.name + " ")
+				writeSExpr(out, field.value, indent+1)
+			}
+		}
+		out.WriteString(")")
+	case []interface{}:
+		out.WriteString("[")
+		for i, item := range value {
+			if isNested(item) {
+				out.WriteString("\n" + strings.Repeat("  ", indent+1))
+			} else if i > 0 {
+				out.WriteString(" ")
+			}
+			writeSExpr(out, item, indent+1)
+		}
+		out.WriteString("]")
+	case string:
+		out.WriteString(strconv.Quote(value))
+	case bool:
+		out.WriteString(strconv.FormatBool(value))
+	case int64:
+		out.WriteString(strconv.FormatInt(value, 10))
+	case float64:
+		out.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	}
+}
+
+func writeJSON(out *bytes.Buffer, value interface{}) error {
+	switch value := value.(type) {
+	case *dumpNode:
+		out.WriteString(`{"type":`)
+		writeJSONScalar(out, value.typ)
+		if value.pos.IsValid() {
+			out.WriteString(`,"pos":`)
+			writeJSONScalar(out, value.pos.String())
+		}
+		if value.end.IsValid() {
+			out.WriteString(`,"end":`)
+			writeJSONScalar(out, value.end.String())
+		}
+		for _, field := range value.fields {
+			out.WriteString(",")
+			writeJSONScalar(out, field.name)
+			out.WriteString(":")
+			if err := writeJSON(out, field.value); err != nil {
+				return err
+			}
+		}
+		out.WriteString("}")
+	case []interface{}:
+		out.WriteString("[")
+		for i, item := range value {
+			if i > 0 {
+				out.WriteString(",")
+			}
+			if err := writeJSON(out, item); err != nil {
+				return err
+			}
+		}
+		out.WriteString("]")
+	default:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		out.Write(data)
+	}
+	return nil
+}
+
+// writeJSONScalar writes a string that cannot fail to encode.
+func writeJSONScalar(out *bytes.Buffer, s string) {
+	data, _ := json.Marshal(s)
+	out.Write(data)
+}
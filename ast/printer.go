@@ -0,0 +1,1167 @@
+package ast
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/alexisbouchez/rubylexer/token"
+)
+
+// Format returns Ruby source for node, one statement per line and indented
+// two spaces per level. Parsing the result gives the same tree back, with
+// parentheses added wherever the tree needs them. Comments are not part of
+// the tree, so they are lost, except for a program's magic comments.
+func Format(node Node) string {
+	p := &printer{}
+	switch n := node.(type) {
+	case *Program:
+		p.magicComments(n.MagicComments)
+		p.program(n)
+	case Statement:
+		p.statement(n)
+	case Expression:
+		p.expr(n, precLowest)
+	case Pattern:
+		p.pattern(n)
+	}
+	if len(p.heredocs) > 0 {
+		p.endLine()
+	}
+	return p.out.String()
+}
+
+// FormatSource is Format for a program parsed from source that also
+// writes back the source's comments, as the parser's Comments returns
+// them. Each comment goes before the statement that followed it, or after
+// the one whose line it ended, and a blank line is kept wherever the
+// source separated statements or comments with blank lines.
+func FormatSource(program *Program, source string, comments []Comment) string {
+	p := &printer{comments: comments, lines: strings.Split(source, "\n")}
+	p.program(program)
+	if len(p.heredocs) > 0 {
+		p.endLine()
+	}
+	return p.out.String()
+}
+
+func (p *printer) program(n *Program) {
+	p.statements(n.Statements)
+	for len(p.comments) > 0 {
+		if p.out.Len() > 0 {
+			p.newline()
+		}
+		p.blankLineBefore(p.comments[0].Pos.Line)
+		p.comment(p.comments[0])
+	}
+	if n.HasData {
+		p.endLine()
+		p.write("__END__\n" + n.Data)
+	}
+}
+
+// Precedence levels, matching the parser's
+const (
+	precLowest = iota + 1
+	precModifier
+	precRescueMod
+	precAssignment
+	precTernary
+	precRange
+	precOr
+	precAnd
+	precNot
+	precEquals
+	precCompare
+	precBitOr
+	precBitAnd
+	precShift
+	precSum
+	precProduct
+	precUnary
+	precPower
+	precIndex
+	precCall
+)
+
+var infixPrecedences = map[string]int{
+	"||": precOr + 5, "&&": precAnd + 5,
+	"==": precEquals, "!=": precEquals, "===": precEquals, "<=>": precEquals, "=~": precEquals, "!~": precEquals,
+	"<": precCompare, ">": precCompare, "<=": precCompare, ">=": precCompare,
+	"|": precBitOr, "^": precBitOr, "&": precBitAnd,
+	"<<": precShift, ">>": precShift,
+	"+": precSum, "-": precSum,
+	"*": precProduct, "/": precProduct, "%": precProduct,
+	"**": precPower,
+}
+
+type printer struct {
+	out    bytes.Buffer
+	indent int
+	// heredocs holds the bodies of heredocs opened on the current line,
+	// which follow it
+	heredocs []string
+
+	// comments holds the source comments still to write and lines the
+	// source, when formatting with FormatSource
+	comments []Comment
+	lines    []string
+	// lastLine is the source line of what was written last, and enclosing
+	// where the statement being written ends in the source
+	lastLine  int
+	enclosing token.Pos
+}
+
+// magicComments writes magic comments one per line, the encoding first
+// since it only counts on the first lines of a file.
+func (p *printer) magicComments(comments map[string]string) {
+	names := make([]string, 0, len(comments))
+	for name := range comments {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if (names[i] == "encoding") != (names[j] == "encoding") {
+			return names[i] == "encoding"
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		p.write("# " + name + ": " + comments[name] + "\n")
+	}
+}
+
+// newline ends the current line and starts the next at the current
+// indentation, after the bodies of any heredocs the line opened.
+func (p *printer) newline() {
+	p.out.WriteString("\n")
+	p.flushHeredocs()
+	p.out.WriteString(strings.Repeat("  ", p.indent))
+}
+
+// endLine ends the last line, following it with any heredoc bodies.
+func (p *printer) endLine() {
+	p.out.WriteString("\n")
+	p.flushHeredocs()
+}
+
+func (p *printer) flushHeredocs() {
+	for _, body := range p.heredocs {
+		p.out.WriteString(body)
+	}
+	p.heredocs = nil
+}
+
+func (p *printer) write(s string) {
+	p.out.WriteString(s)
+}
+
+func (p *printer) statements(stmts []Statement) {
+	first := true
+	for _, stmt := range stmts {
+		if stmt == nil {
+			continue
+		}
+		if !first {
+			p.newline()
+		}
+		p.leadingComments(stmt.Pos(), !first)
+		first = false
+
+		enclosing := p.enclosing
+		p.enclosing = stmt.EndPos()
+		p.lastLine = stmt.Pos().Line
+		p.statement(stmt)
+		p.enclosing = enclosing
+
+		if end := stmt.EndPos(); end.IsValid() {
+			p.lastLine = end.Line
+		}
+		if len(p.comments) > 0 && p.comments[0].Pos.Line == p.lastLine && !strings.HasPrefix(p.comments[0].Text, "=begin") {
+			p.write(" ")
+			p.comment(p.comments[0])
+		}
+	}
+}
+
+// leadingComments writes the comments before pos in the source, each on
+// its own line, and then a blank line if the source has one before pos.
+// blank is false at the start of a body, where blank lines are dropped.
+func (p *printer) leadingComments(pos token.Pos, blank bool) {
+	for len(p.comments) > 0 && p.comments[0].Pos.Offset < pos.Offset {
+		if blank {
+			p.blankLineBefore(p.comments[0].Pos.Line)
+		}
+		p.comment(p.comments[0])
+		p.newline()
+		blank = true
+	}
+	if blank {
+		p.blankLineBefore(pos.Line)
+	}
+}
+
+// trailingComments writes the comments that end the body of the
+// statement being written: those inside it that only blank lines separate
+// from what was written last.
+func (p *printer) trailingComments() {
+	for len(p.comments) > 0 && p.enclosing.IsValid() && p.comments[0].Pos.Offset < p.enclosing.Offset {
+		c := p.comments[0]
+		for line := p.lastLine + 1; line < c.Pos.Line; line++ {
+			if line <= len(p.lines) && strings.TrimSpace(p.lines[line-1]) != "" {
+				return
+			}
+		}
+		p.newline()
+		p.blankLineBefore(c.Pos.Line)
+		p.comment(c)
+	}
+}
+
+// comment writes c, which it takes off the comments still to write.
+func (p *printer) comment(c Comment) {
+	p.comments = p.comments[1:]
+	if strings.HasPrefix(c.Text, "=begin") {
+		// An embedded document only counts at the start of a line
+		p.out.Truncate(p.out.Len() - 2*p.indent)
+	}
+	p.write(c.Text)
+	p.lastLine = c.Pos.Line + strings.Count(c.Text, "\n")
+}
+
+// blankLineBefore starts the current line over after a blank one if the
+// source has a blank line between what was written last and line.
+func (p *printer) blankLineBefore(line int) {
+	if p.lines == nil || p.out.Len() == 0 {
+		return
+	}
+	for l := p.lastLine + 1; l < line && l <= len(p.lines); l++ {
+		if strings.TrimSpace(p.lines[l-1]) == "" {
+			p.out.Truncate(p.out.Len() - 2*p.indent)
+			p.newline()
+			return
+		}
+	}
+}
+
+// headerComment writes the comment that ends line, the line opening body,
+// after what has been written of it. end is where the construct that body
+// belongs to ends in the source.
+func (p *printer) headerComment(line int, body *BlockBody, end token.Pos) {
+	if len(p.comments) == 0 || strings.HasPrefix(p.comments[0].Text, "=begin") {
+		return
+	}
+	c := p.comments[0]
+	if c.Pos.Line != line || end.IsValid() && c.Pos.Offset >= end.Offset {
+		return
+	}
+	if body != nil && len(body.Statements) > 0 && body.Statements[0] != nil && c.Pos.Offset >= body.Statements[0].Pos().Offset {
+		return
+	}
+	p.write(" ")
+	p.comment(c)
+}
+
+// body writes the statements of a body indented on the lines after the
+// current one, leaving the output at the start of the line that follows.
+func (p *printer) body(body *BlockBody) {
+	p.indent++
+	if body != nil && len(body.Statements) > 0 {
+		p.newline()
+		p.statements(body.Statements)
+	}
+	p.trailingComments()
+	p.indent--
+	p.newline()
+}
+
+func (p *printer) statement(stmt Statement) {
+	switch s := stmt.(type) {
+	case *ExpressionStatement:
+		p.expr(s.Expression, precLowest)
+	case *ModifierStatement:
+		p.statement(s.Body)
+		p.write(" " + s.Modifier + " ")
+		p.expr(s.Condition, precModifier+1)
+	case *ReturnStatement:
+		p.keywordValue("return", s.Value)
+	case *BreakStatement:
+		p.keywordValue("break", s.Value)
+	case *NextStatement:
+		p.keywordValue("next", s.Value)
+	case *RedoStatement:
+		p.write("redo")
+	case *RetryStatement:
+		p.write("retry")
+	case *AliasStatement:
+		p.write("alias ")
+		p.expr(s.New, precCall)
+		p.write(" ")
+		p.expr(s.Old, precCall)
+	case *UndefStatement:
+		p.write("undef ")
+		p.exprList(s.Methods, precCall)
+	case *MethodDefinition:
+		p.methodDefinition(s)
+	case *ClassDefinition:
+		p.write("class ")
+		p.expr(s.Name, precCall)
+		if s.Superclass != nil {
+			p.write(" < ")
+			p.expr(s.Superclass, precCall)
+		}
+		p.headerComment(s.Pos().Line, s.Body, s.EndPos())
+		p.body(s.Body)
+		p.write("end")
+	case *SingletonClassDefinition:
+		p.write("class << ")
+		p.expr(s.Object, precCall)
+		p.headerComment(s.Pos().Line, s.Body, s.EndPos())
+		p.body(s.Body)
+		p.write("end")
+	case *ModuleDefinition:
+		p.write("module ")
+		p.expr(s.Name, precCall)
+		p.headerComment(s.Pos().Line, s.Body, s.EndPos())
+		p.body(s.Body)
+		p.write("end")
+	case Expression:
+		p.expr(s, precLowest)
+	}
+}
+
+func (p *printer) keywordValue(keyword string, value Expression) {
+	p.write(keyword)
+	if value != nil {
+		p.write(" ")
+		p.expr(value, precModifier+1)
+	}
+}
+
+func (p *printer) methodDefinition(def *MethodDefinition) {
+	p.write("def ")
+	switch def.Receiver.(type) {
+	case nil:
+	case *SelfExpression, *Identifier, *Constant, *ScopedConstant,
+		*InstanceVariable, *ClassVariable, *GlobalVariable:
+		p.expr(def.Receiver, precCall)
+		p.write(".")
+	default:
+		p.write("(")
+		p.expr(def.Receiver, precLowest)
+		p.write(").")
+	}
+	p.write(def.Name)
+	if len(def.Parameters) > 0 {
+		p.write("(")
+		for i, param := range def.Parameters {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.methodParameter(param)
+		}
+		p.write(")")
+	}
+	p.headerComment(def.Pos().Line, def.Body, def.EndPos())
+
+	// A body with rescue, else or ensure clauses is parsed into a begin
+	// expression that did not start with begin
+	if def.Body != nil && len(def.Body.Statements) == 1 {
+		if stmt, ok := def.Body.Statements[0].(*ExpressionStatement); ok {
+			if begin, ok := stmt.Expression.(*BeginExpression); ok && begin.Token.Type != token.KEYWORD_BEGIN {
+				p.beginClauses(begin)
+				p.write("end")
+				return
+			}
+		}
+	}
+	p.body(def.Body)
+	p.write("end")
+}
+
+func (p *printer) methodParameter(param *MethodParameter) {
+	switch {
+	case param.Splat:
+		p.write("*")
+	case param.DSplat:
+		p.write("**")
+	case param.Block:
+		p.write("&")
+	}
+	p.write(param.Name)
+	if param.KeywordOnly {
+		p.write(":")
+		if param.Default != nil {
+			p.write(" ")
+			p.expr(param.Default, precAssignment)
+		}
+	} else if param.Default != nil {
+		p.write(" = ")
+		p.expr(param.Default, precAssignment)
+	}
+}
+
+func (p *printer) blockParameters(params []*BlockParameter, locals []string) {
+	for i, param := range params {
+		if i > 0 {
+			p.write(", ")
+		}
+		switch {
+		case param.Splat:
+			p.write("*")
+		case param.DSplat:
+			p.write("**")
+		case param.Block:
+			p.write("&")
+		}
+		p.write(param.Name)
+		// Defaults stop short of the closing |
+		if param.Default != nil {
+			p.write(" = ")
+			p.expr(param.Default, precBitOr+1)
+		}
+	}
+	if len(locals) > 0 {
+		p.write("; " + strings.Join(locals, ", "))
+	}
+}
+
+// beginClauses writes a begin expression's body and clauses, leaving the
+// output at the start of the line for its end.
+func (p *printer) beginClauses(begin *BeginExpression) {
+	p.body(begin.Body)
+	for _, rescue := range begin.Rescues {
+		p.write("rescue")
+		if len(rescue.Exceptions) > 0 {
+			p.write(" ")
+			p.exprList(rescue.Exceptions, precAssignment)
+		}
+		if rescue.Variable != nil {
+			p.write(" => " + rescue.Variable.Value)
+		}
+		p.body(rescue.Body)
+	}
+	if begin.Else != nil {
+		p.write("else")
+		p.body(begin.Else)
+	}
+	if begin.Ensure != nil {
+		p.write("ensure")
+		p.body(begin.Ensure)
+	}
+}
+
+// precedence returns how tightly an expression binds, as the parser
+// reads it.
+func precedence(expr Expression) int {
+	switch e := expr.(type) {
+	case *ModifierExpression:
+		return precModifier
+	case *RescueModifier:
+		return precRescueMod
+	case *MultipleAssignment:
+		return precLowest
+	case *AssignmentExpression, *OpAssignmentExpression:
+		return precAssignment
+	case *TernaryExpression:
+		return precTernary
+	case *RangeLiteral:
+		return precRange
+	case *OrExpression:
+		return precOr
+	case *AndExpression:
+		return precAnd
+	case *NotExpression:
+		return precNot
+	case *InfixExpression:
+		if prec, ok := infixPrecedences[e.Operator]; ok {
+			return prec
+		}
+		return precEquals
+	case *PrefixExpression:
+		return precUnary
+	}
+	return precCall
+}
+
+// needsParens reports whether expr must be parenthesized where an
+// expression binding at least as tightly as min is expected. || and && are
+// parenthesized inside other operators as well, to read the same in Ruby,
+// which binds them tighter than the parser does.
+func needsParens(expr Expression, min int) bool {
+	if precedence(expr) < min {
+		return true
+	}
+	if infix, ok := expr.(*InfixExpression); ok && (infix.Operator == "||" || infix.Operator == "&&") {
+		return min > precAssignment
+	}
+	return false
+}
+
+func (p *printer) expr(expr Expression, min int) {
+	if expr == nil {
+		p.write("nil")
+		return
+	}
+	if needsParens(expr, min) {
+		p.write("(")
+		p.expr(expr, precLowest)
+		p.write(")")
+		return
+	}
+
+	switch e := expr.(type) {
+	case *IntegerLiteral, *FloatLiteral, *NilLiteral, *BooleanLiteral,
+		*SelfExpression, *Identifier, *Constant, *InstanceVariable,
+		*ClassVariable, *GlobalVariable, *MagicComment, *RegexpLiteral:
+		p.write(e.String())
+	case *StringLiteral:
+		p.stringLiteral(e.Token, []Expression{e})
+	case *InterpolatedString:
+		p.stringLiteral(e.Token, e.Parts)
+	case *InterpolatedSymbol:
+		p.write(`:"`)
+		p.stringParts(e.Parts, func(text string) string {
+			return escapeString(text, `"`, `"`)
+		})
+		p.write(`"`)
+	case *XStringLiteral:
+		p.stringLiteral(e.Token, e.Parts)
+	case *SymbolLiteral:
+		if symbolName.MatchString(e.Value) {
+			p.write(":" + e.Value)
+		} else {
+			p.write(`:"` + escapeString(e.Value, `"`, `"`) + `"`)
+		}
+	case *ArrayLiteral:
+		p.write("[")
+		p.exprList(e.Elements, precAssignment)
+		p.write("]")
+	case *HashLiteral:
+		if len(e.Order) == 0 {
+			p.write("{}")
+			return
+		}
+		p.write("{ ")
+		p.hashPairs(e)
+		p.write(" }")
+	case *RangeLiteral:
+		p.rangeLiteral(e)
+
+	case *PrefixExpression:
+		p.write(e.Operator)
+		p.expr(e.Right, precUnary)
+	case *InfixExpression:
+		prec := precedence(e)
+		left, right := prec, prec+1
+		if e.Operator == "**" {
+			left, right = prec+1, prec
+		}
+		// A chain of the same operator needs no parentheses
+		if l, ok := e.Left.(*InfixExpression); ok && l.Operator == e.Operator && e.Operator != "**" {
+			left = precLowest
+		}
+		p.expr(e.Left, left)
+		p.write(" " + e.Operator + " ")
+		p.expr(e.Right, right)
+	case *AndExpression:
+		p.expr(e.Left, precAnd)
+		p.write(" and ")
+		p.expr(e.Right, precAnd+1)
+	case *OrExpression:
+		p.expr(e.Left, precOr)
+		p.write(" or ")
+		p.expr(e.Right, precOr+1)
+	case *NotExpression:
+		p.write("not ")
+		p.expr(e.Expression, precNot)
+	case *DefinedExpression:
+		p.write("defined?(")
+		p.expr(e.Expression, precLowest)
+		p.write(")")
+	case *TernaryExpression:
+		p.expr(e.Condition, precTernary+1)
+		p.write(" ? ")
+		p.expr(e.Consequence, precTernary)
+		p.write(" : ")
+		p.expr(e.Alternative, precTernary)
+	case *ModifierExpression:
+		p.expr(e.Body, precModifier)
+		p.write(" " + e.Modifier + " ")
+		p.expr(e.Condition, precModifier+1)
+	case *RescueModifier:
+		p.expr(e.Body, precRescueMod)
+		p.write(" rescue ")
+		p.expr(e.Rescue, precRescueMod+1)
+
+	case *AssignmentExpression:
+		p.expr(e.Left, precCall)
+		p.write(" = ")
+		p.expr(e.Value, precAssignment)
+	case *OpAssignmentExpression:
+		p.expr(e.Left, precCall)
+		p.write(" " + e.Operator + " ")
+		p.expr(e.Value, precAssignment)
+	case *MultipleAssignment:
+		p.exprList(e.Left, precCall)
+		if len(e.Left) == 1 {
+			p.write(",")
+		}
+		p.write(" = ")
+		p.exprList(e.Right, precAssignment)
+	case *MultipleTarget:
+		p.write("(")
+		p.exprList(e.Targets, precCall)
+		p.write(")")
+	case *SplatExpression:
+		p.write("*")
+		if e.Expression != nil {
+			p.expr(e.Expression, precCall)
+		}
+	case *DoubleSplatExpression:
+		p.write("**")
+		p.expr(e.Expression, precCall)
+	case *BlockArgExpression:
+		p.write("&")
+		if e.Expression != nil {
+			p.expr(e.Expression, precCall)
+		}
+	case *ScopedConstant:
+		if e.Left != nil {
+			p.expr(e.Left, precCall)
+		}
+		p.write("::" + e.Name)
+
+	case *MethodCall:
+		p.methodCall(e)
+	case *IndexExpression:
+		p.expr(e.Left, precCall)
+		p.write("[")
+		p.exprList(e.Arguments, precAssignment)
+		p.write("]")
+	case *Lambda:
+		var locals []string
+		if e.Body != nil {
+			locals = e.Body.Locals
+		}
+		if len(e.Parameters) > 0 || len(locals) > 0 {
+			p.write("->(")
+			p.blockParameters(e.Parameters, locals)
+			p.write(") ")
+		} else {
+			p.write("-> ")
+		}
+		p.blockBody(e.Body, e.EndPos())
+	case *YieldExpression:
+		p.write("yield")
+		if len(e.Arguments) > 0 {
+			p.arguments(e.Arguments)
+		}
+	case *SuperExpression:
+		p.write("super")
+		if e.HasParens || len(e.Arguments) > 0 {
+			p.arguments(e.Arguments)
+		}
+
+	case *IfExpression:
+		p.ifExpression(e)
+	case *CaseExpression:
+		p.write("case")
+		if e.Subject != nil {
+			p.write(" ")
+			p.expr(e.Subject, precLowest)
+		}
+		p.newline()
+		for _, when := range e.Whens {
+			p.write("when ")
+			p.exprList(when.Conditions, precAssignment)
+			p.body(when.Body)
+		}
+		if e.Else != nil {
+			p.write("else")
+			p.body(e.Else)
+		}
+		p.write("end")
+	case *CaseInExpression:
+		p.write("case ")
+		p.expr(e.Subject, precLowest)
+		p.newline()
+		for _, clause := range e.Clauses {
+			p.write("in ")
+			p.pattern(clause.Pattern)
+			if clause.Guard != nil {
+				if clause.Unless {
+					p.write(" unless ")
+				} else {
+					p.write(" if ")
+				}
+				p.expr(clause.Guard, precModifier+1)
+			}
+			p.body(clause.Body)
+		}
+		if e.Else != nil {
+			p.write("else")
+			p.body(e.Else)
+		}
+		p.write("end")
+	case *WhileExpression:
+		if e.Until {
+			p.write("until ")
+		} else {
+			p.write("while ")
+		}
+		p.expr(e.Condition, precLowest)
+		p.body(e.Body)
+		p.write("end")
+	case *ForExpression:
+		p.write("for ")
+		p.expr(e.Variable, precCall)
+		p.write(" in ")
+		p.expr(e.Iterable, precLowest)
+		p.body(e.Body)
+		p.write("end")
+	case *BeginExpression:
+		p.write("begin")
+		p.beginClauses(e)
+		p.write("end")
+
+	case Statement:
+		// Definitions can appear where an expression is expected
+		p.statement(e)
+	default:
+		p.write(expr.String())
+	}
+}
+
+// identName matches an identifier. Non-ASCII characters count as letters,
+// as they do in Ruby.
+const identName = `[A-Za-z_\x{80}-\x{10FFFF}][A-Za-z0-9_\x{80}-\x{10FFFF}]*`
+
+// symbolName matches the symbols that need no quotes after the colon.
+var symbolName = regexp.MustCompile(`^(?:` + identName + `[?!=]?|[@$]` + identName + `|@@` + identName + `|\[\]=?|[-+]@|[-+*/%<>!~^&|]|\*\*|==|===|!=|=~|!~|<=>|<=|>=|<<|>>)$`)
+
+// stringLiteral writes a string, symbol or command literal with the
+// delimiters it was written with. Its text is escaped again as the
+// delimiters require; embedded expressions are written as #{...}.
+func (p *printer) stringLiteral(tok token.Token, parts []Expression) {
+	if tok.Type == token.HEREDOC_BEGIN {
+		p.heredoc(tok, parts)
+		return
+	}
+	open := tok.Literal
+	if open == "" || tok.Type == token.EMBEXPR_BEGIN || tok.Type == token.EMBVAR || tok.Type == token.STRING_CONTENT {
+		open = `"`
+	}
+	close := closingDelimiter(open)
+	p.write(open)
+	p.stringParts(parts, func(text string) string {
+		return escapeString(text, open, close)
+	})
+	p.write(close)
+}
+
+func (p *printer) stringParts(parts []Expression, escape func(string) string) {
+	for _, part := range parts {
+		if str, ok := part.(*StringLiteral); ok {
+			p.write(escape(str.Value))
+			continue
+		}
+		p.write("#{")
+		p.expr(part, precLowest)
+		p.write("}")
+	}
+}
+
+// closingDelimiter returns what closes a literal opened with open.
+func closingDelimiter(open string) string {
+	last := open[len(open)-1:]
+	switch last {
+	case "(":
+		return ")"
+	case "[":
+		return "]"
+	case "{":
+		return "}"
+	case "<":
+		return ">"
+	}
+	return last
+}
+
+// escapeString escapes the text of a literal opened with open and closed
+// with close. Single-quoted literals only escape backslashes and their
+// delimiters; the others also escape interpolation and control characters.
+func escapeString(text, open, close string) string {
+	delimiter := func(ch byte) bool {
+		return ch == close[0] || ch == open[len(open)-1]
+	}
+	single := open == "'" || open == ":'" || strings.HasPrefix(open, "%q") || strings.HasPrefix(open, "%s")
+
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		switch {
+		case delimiter(ch):
+			out.WriteByte('\\')
+			out.WriteByte(ch)
+		case ch == '\\':
+			// A lone backslash stays as it is in a single-quoted literal
+			if !single || i+1 == len(text) || text[i+1] == '\\' || delimiter(text[i+1]) {
+				out.WriteByte('\\')
+			}
+			out.WriteByte(ch)
+		case single:
+			out.WriteByte(ch)
+		default:
+			out.WriteString(escapeByte(text, i))
+		}
+	}
+	return out.String()
+}
+
+// escapeByte returns text[i] as it is written inside a double-quoted
+// literal.
+func escapeByte(text string, i int) string {
+	switch ch := text[i]; ch {
+	case '\n':
+		return `\n`
+	case '\t':
+		return `\t`
+	case '\r':
+		return `\r`
+	case 0x1b:
+		return `\e`
+	case '#':
+		if i+1 < len(text) && (text[i+1] == '{' || text[i+1] == '@' || text[i+1] == '$') {
+			return `\#`
+		}
+		return "#"
+	default:
+		if ch < 0x20 || ch == 0x7f {
+			return fmt.Sprintf(`\x%02X`, ch)
+		}
+		return text[i : i+1]
+	}
+}
+
+// heredoc writes the opener of a heredoc and queues its body to follow the
+// current line. Squiggly heredoc bodies are indented one level past the
+// line they are on.
+func (p *printer) heredoc(tok token.Token, parts []Expression) {
+	p.write(tok.Literal)
+	ident := strings.Trim(strings.TrimLeft(tok.Literal, "<~-"), `'"`)
+
+	body := &printer{}
+	body.stringParts(parts, func(text string) string {
+		if strings.Contains(tok.Literal, "'") {
+			return text
+		}
+		var out strings.Builder
+		for i := 0; i < len(text); i++ {
+			switch ch := text[i]; ch {
+			case '\\':
+				out.WriteString(`\\`)
+			case '\n', '\t':
+				out.WriteByte(ch)
+			default:
+				out.WriteString(escapeByte(text, i))
+			}
+		}
+		return out.String()
+	})
+	text := body.out.String()
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+
+	var out strings.Builder
+	indent := ""
+	switch {
+	case strings.HasPrefix(tok.Literal, "<<~"):
+		indent = strings.Repeat("  ", p.indent+1)
+		for _, line := range strings.SplitAfter(text, "\n") {
+			if strings.TrimSpace(line) != "" {
+				out.WriteString(indent)
+			}
+			out.WriteString(line)
+		}
+		indent = strings.Repeat("  ", p.indent)
+	case strings.HasPrefix(tok.Literal, "<<-"):
+		out.WriteString(text)
+		indent = strings.Repeat("  ", p.indent)
+	default:
+		out.WriteString(text)
+	}
+	out.WriteString(indent + ident + "\n")
+	p.heredocs = append(p.heredocs, out.String())
+}
+
+func (p *printer) rangeLiteral(r *RangeLiteral) {
+	op := ".."
+	if r.Exclusive {
+		op = "..."
+	}
+	// An endless range would run into whatever follows it
+	if r.End == nil {
+		p.write("(")
+	}
+	if r.Start != nil {
+		p.expr(r.Start, precRange+1)
+	}
+	p.write(op)
+	if r.End != nil {
+		p.expr(r.End, precRange+1)
+	} else {
+		p.write(")")
+	}
+}
+
+func (p *printer) hashPairs(hash *HashLiteral) {
+	for i, key := range hash.Order {
+		if i > 0 {
+			p.write(", ")
+		}
+		if sym, ok := key.(*SymbolLiteral); ok && labelName.MatchString(sym.Value) {
+			p.write(sym.Value + ": ")
+		} else {
+			p.expr(key, precAssignment)
+			p.write(" => ")
+		}
+		p.expr(hash.Pairs[key], precAssignment)
+	}
+}
+
+// labelName matches the symbols that can be written as name: hash keys.
+var labelName = regexp.MustCompile(`^` + identName + `[?!]?$`)
+
+func (p *printer) exprList(exprs []Expression, min int) {
+	for i, expr := range exprs {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.expr(expr, min)
+	}
+}
+
+// arguments writes a parenthesized argument list. Keyword arguments are
+// written without braces.
+func (p *printer) arguments(args []Expression) {
+	p.write("(")
+	for i, arg := range args {
+		if i > 0 {
+			p.write(", ")
+		}
+		if hash, ok := arg.(*HashLiteral); ok && hash.IsKeywordArgs && len(hash.Order) > 0 {
+			p.hashPairs(hash)
+			continue
+		}
+		p.expr(arg, precAssignment)
+	}
+	p.write(")")
+}
+
+func (p *printer) methodCall(call *MethodCall) {
+	if call.Receiver != nil {
+		p.expr(call.Receiver, precCall)
+		if call.SafeNav {
+			p.write("&.")
+		} else {
+			p.write(".")
+		}
+	}
+	p.write(call.Method)
+	if len(call.Arguments) > 0 || call.Receiver == nil && call.Block == nil {
+		p.arguments(call.Arguments)
+	}
+	if call.Block != nil {
+		p.write(" ")
+		p.block(call.Block)
+	}
+}
+
+// block writes b in the form the source used: between do and end, or in
+// braces, on one line when it fits and holds no comments. A block the
+// parser did not produce gets braces only when it fits on one line.
+func (p *printer) block(b *Block) {
+	params := ""
+	if len(b.Parameters) > 0 || b.Body != nil && len(b.Body.Locals) > 0 {
+		list := &printer{}
+		list.blockParameters(b.Parameters, b.Body.Locals)
+		params = " |" + list.out.String() + "|"
+	}
+	if b.Token.Type != token.KEYWORD_DO {
+		if line, ok := p.singleLine(b.Body, b.EndPos()); ok {
+			if line != "" {
+				line = " " + line
+			}
+			if params == "" && line == "" {
+				p.write("{}")
+			} else {
+				p.write("{" + params + line + " }")
+			}
+			return
+		}
+	}
+	open, close := "do", "end"
+	if b.Token.Type == token.LBRACE || b.Token.Type == token.LBRACE_BLOCK {
+		open, close = "{", "}"
+	}
+	p.write(open + params)
+	p.headerComment(b.Token.Pos().Line, b.Body, b.EndPos())
+	p.body(b.Body)
+	p.write(close)
+}
+
+// blockBody writes a lambda body in braces when it fits on one line and
+// holds no comments, and between do and end otherwise.
+func (p *printer) blockBody(body *BlockBody, end token.Pos) {
+	if line, ok := p.singleLine(body, end); ok {
+		if line == "" {
+			p.write("{}")
+		} else {
+			p.write("{ " + line + " }")
+		}
+		return
+	}
+	p.write("do")
+	p.body(body)
+	p.write("end")
+}
+
+// singleLine returns body written on one line, if it can be. It cannot
+// when a comment still to write comes before end, where the body ends in
+// the source.
+func (p *printer) singleLine(body *BlockBody, end token.Pos) (string, bool) {
+	if len(p.comments) > 0 && end.IsValid() && p.comments[0].Pos.Offset < end.Offset {
+		return "", false
+	}
+	if body == nil || len(body.Statements) == 0 {
+		return "", true
+	}
+	if len(body.Statements) > 1 {
+		return "", false
+	}
+	line := &printer{indent: p.indent}
+	line.statement(body.Statements[0])
+	text := line.out.String()
+	return text, !strings.Contains(text, "\n") && len(line.heredocs) == 0
+}
+
+func (p *printer) ifExpression(e *IfExpression) {
+	if e.Unless {
+		p.write("unless ")
+	} else {
+		p.write("if ")
+	}
+	p.expr(e.Condition, precLowest)
+	p.body(e.Consequence)
+	elseBody := e.ElseBody
+	for alt := e.Alternative; alt != nil; alt = alt.Alternative {
+		p.write("elsif ")
+		p.expr(alt.Condition, precLowest)
+		p.body(alt.Consequence)
+		if elseBody == nil {
+			elseBody = alt.ElseBody
+		}
+	}
+	if elseBody != nil {
+		p.write("else")
+		p.body(elseBody)
+	}
+	p.write("end")
+}
+
+func (p *printer) pattern(pattern Pattern) {
+	switch pat := pattern.(type) {
+	case *ValuePattern:
+		p.expr(pat.Value, precRange)
+	case *PinPattern:
+		p.write("^")
+		switch pat.Value.(type) {
+		case *Identifier, *InstanceVariable, *ClassVariable, *GlobalVariable:
+			p.expr(pat.Value, precCall)
+		default:
+			p.write("(")
+			p.expr(pat.Value, precLowest)
+			p.write(")")
+		}
+	case *BindingPattern:
+		p.write(pat.Name)
+	case *CapturePattern:
+		p.pattern(pat.Pattern)
+		p.write(" => " + pat.Name)
+	case *AlternativePattern:
+		for i, alt := range pat.Alternatives {
+			if i > 0 {
+				p.write(" | ")
+			}
+			p.pattern(alt)
+		}
+	case *RestPattern:
+		p.write("*" + pat.Name)
+	case *ArrayPattern:
+		p.patternConstant(pat.Constant)
+		p.write("[")
+		elems := append([]Pattern{}, pat.Pre...)
+		if pat.Rest != nil {
+			elems = append(elems, pat.Rest)
+		}
+		elems = append(elems, pat.Post...)
+		p.patternList(elems)
+		p.write("]")
+	case *FindPattern:
+		p.patternConstant(pat.Constant)
+		p.write("[")
+		elems := append([]Pattern{pat.Pre}, pat.Middle...)
+		p.patternList(append(elems, pat.Post))
+		p.write("]")
+	case *HashPattern:
+		p.patternConstant(pat.Constant)
+		if pat.Constant != nil {
+			p.write("(")
+		} else {
+			p.write("{")
+		}
+		for i, key := range pat.Keys {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.write(key + ":")
+			if pat.Values[i] != nil {
+				p.write(" ")
+				p.pattern(pat.Values[i])
+			}
+		}
+		if pat.Rest != nil || pat.NilRest {
+			if len(pat.Keys) > 0 {
+				p.write(", ")
+			}
+			if pat.NilRest {
+				p.write("**nil")
+			} else {
+				p.write("**" + pat.Rest.Name)
+			}
+		}
+		if pat.Constant != nil {
+			p.write(")")
+		} else {
+			p.write("}")
+		}
+	}
+}
+
+func (p *printer) patternConstant(constant Expression) {
+	if constant != nil {
+		p.expr(constant, precCall)
+	}
+}
+
+func (p *printer) patternList(patterns []Pattern) {
+	for i, pat := range patterns {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.pattern(pat)
+	}
+}
@@ -0,0 +1,82 @@
+package ast
+
+import (
+	"reflect"
+
+	"github.com/alexisbouchez/rubylexer/token"
+)
+
+var (
+	posType  = reflect.TypeOf(token.Pos{})
+	spanType = reflect.TypeOf(Span{})
+)
+
+// Shift moves node and everything in it down by lines and along by offset
+// bytes, as when text is inserted or removed before it. Columns are left
+// alone, so the text must not change on the lines the node is on.
+func Shift(node Node, lines, offset int) {
+	shiftValue(reflect.ValueOf(node), lines, offset, make(map[uintptr]bool))
+}
+
+func shiftValue(v reflect.Value, lines, offset int, seen map[uintptr]bool) {
+	switch v.Kind() {
+	case reflect.Interface:
+		if !v.IsNil() {
+			shiftValue(v.Elem(), lines, offset, seen)
+		}
+	case reflect.Ptr:
+		// A node can be shared, as the target of an operator assignment is
+		if v.IsNil() || seen[v.Pointer()] {
+			return
+		}
+		seen[v.Pointer()] = true
+		shiftValue(v.Elem(), lines, offset, seen)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			shiftValue(v.Index(i), lines, offset, seen)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			shiftValue(iter.Key(), lines, offset, seen)
+			shiftValue(iter.Value(), lines, offset, seen)
+		}
+	case reflect.Struct:
+		switch v.Type() {
+		case tokenType:
+			if v.CanSet() {
+				tok := v.Addr().Interface().(*token.Token)
+				tok.Line, tok.Offset = shiftPos(tok.Pos(), lines, offset)
+				tok.EndLine, tok.EndOffset = shiftPos(tok.End(), lines, offset)
+			}
+			return
+		case posType:
+			if v.CanSet() {
+				pos := v.Addr().Interface().(*token.Pos)
+				pos.Line, pos.Offset = shiftPos(*pos, lines, offset)
+			}
+			return
+		case spanType:
+			if v.CanAddr() {
+				span := v.Addr().Interface().(*Span)
+				span.start.Line, span.start.Offset = shiftPos(span.start, lines, offset)
+				span.end.Line, span.end.Offset = shiftPos(span.end, lines, offset)
+			}
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				shiftValue(v.Field(i), lines, offset, seen)
+			}
+		}
+	}
+}
+
+// shiftPos returns the line and offset of pos moved, leaving an unknown
+// position unknown.
+func shiftPos(pos token.Pos, lines, offset int) (int, int) {
+	if !pos.IsValid() {
+		return pos.Line, pos.Offset
+	}
+	return pos.Line + lines, pos.Offset + offset
+}
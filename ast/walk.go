@@ -0,0 +1,287 @@
+package ast
+
+// Visitor's Visit method is called by Walk for each node it reaches. If
+// the visitor w it returns is not nil, Walk visits each of the node's
+// children with w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses the tree rooted at node in depth-first order, children in
+// source order. Parts of nodes that are not nodes themselves, such as the
+// body of a block or the clauses of a case, are walked through: their
+// statements, conditions and default values are visited as children of
+// the enclosing node.
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		walkStatements(v, n.Statements)
+	case *ExpressionStatement:
+		walkExpression(v, n.Expression)
+
+	case *IntegerLiteral, *FloatLiteral, *StringLiteral, *SymbolLiteral,
+		*RegexpLiteral, *NilLiteral, *BooleanLiteral, *SelfExpression,
+		*Identifier, *Constant, *InstanceVariable, *ClassVariable,
+		*GlobalVariable, *RedoStatement, *RetryStatement, *MagicComment,
+		*BindingPattern, *RestPattern:
+		// no children
+
+	case *InterpolatedString:
+		walkExpressions(v, n.Parts)
+	case *InterpolatedSymbol:
+		walkExpressions(v, n.Parts)
+	case *XStringLiteral:
+		walkExpressions(v, n.Parts)
+	case *ArrayLiteral:
+		walkExpressions(v, n.Elements)
+	case *HashLiteral:
+		for _, key := range n.Order {
+			walkExpression(v, key)
+			walkExpression(v, n.Pairs[key])
+		}
+	case *RangeLiteral:
+		walkExpression(v, n.Start)
+		walkExpression(v, n.End)
+
+	case *PrefixExpression:
+		walkExpression(v, n.Right)
+	case *InfixExpression:
+		walkExpression(v, n.Left)
+		walkExpression(v, n.Right)
+	case *AssignmentExpression:
+		walkExpression(v, n.Left)
+		walkExpression(v, n.Value)
+	case *OpAssignmentExpression:
+		walkExpression(v, n.Left)
+		walkExpression(v, n.Value)
+	case *MultipleAssignment:
+		walkExpressions(v, n.Left)
+		walkExpressions(v, n.Right)
+	case *MultipleTarget:
+		walkExpressions(v, n.Targets)
+	case *MethodCall:
+		walkExpression(v, n.Receiver)
+		walkExpressions(v, n.Arguments)
+		if n.Block != nil {
+			Walk(v, n.Block)
+		}
+	case *IndexExpression:
+		walkExpression(v, n.Left)
+		walkExpressions(v, n.Arguments)
+	case *Block:
+		walkBlockParameters(v, n.Parameters)
+		walkBody(v, n.Body)
+	case *Lambda:
+		walkBlockParameters(v, n.Parameters)
+		walkBody(v, n.Body)
+
+	case *IfExpression:
+		walkExpression(v, n.Condition)
+		walkBody(v, n.Consequence)
+		if n.Alternative != nil {
+			Walk(v, n.Alternative)
+		}
+		walkBody(v, n.ElseBody)
+	case *TernaryExpression:
+		walkExpression(v, n.Condition)
+		walkExpression(v, n.Consequence)
+		walkExpression(v, n.Alternative)
+	case *ModifierExpression:
+		walkExpression(v, n.Body)
+		walkExpression(v, n.Condition)
+	case *ModifierStatement:
+		if n.Body != nil {
+			Walk(v, n.Body)
+		}
+		walkExpression(v, n.Condition)
+	case *CaseExpression:
+		walkExpression(v, n.Subject)
+		for _, when := range n.Whens {
+			walkExpressions(v, when.Conditions)
+			walkBody(v, when.Body)
+		}
+		walkBody(v, n.Else)
+	case *CaseInExpression:
+		walkExpression(v, n.Subject)
+		for _, clause := range n.Clauses {
+			walkPattern(v, clause.Pattern)
+			walkExpression(v, clause.Guard)
+			walkBody(v, clause.Body)
+		}
+		walkBody(v, n.Else)
+
+	case *ValuePattern:
+		walkExpression(v, n.Value)
+	case *PinPattern:
+		walkExpression(v, n.Value)
+	case *CapturePattern:
+		walkPattern(v, n.Pattern)
+	case *AlternativePattern:
+		walkPatterns(v, n.Alternatives)
+	case *ArrayPattern:
+		walkExpression(v, n.Constant)
+		walkPatterns(v, n.Pre)
+		if n.Rest != nil {
+			Walk(v, n.Rest)
+		}
+		walkPatterns(v, n.Post)
+	case *FindPattern:
+		walkExpression(v, n.Constant)
+		if n.Pre != nil {
+			Walk(v, n.Pre)
+		}
+		walkPatterns(v, n.Middle)
+		if n.Post != nil {
+			Walk(v, n.Post)
+		}
+	case *HashPattern:
+		walkExpression(v, n.Constant)
+		walkPatterns(v, n.Values)
+		if n.Rest != nil {
+			Walk(v, n.Rest)
+		}
+
+	case *WhileExpression:
+		walkExpression(v, n.Condition)
+		walkBody(v, n.Body)
+	case *ForExpression:
+		walkExpression(v, n.Variable)
+		walkExpression(v, n.Iterable)
+		walkBody(v, n.Body)
+	case *BeginExpression:
+		walkBody(v, n.Body)
+		for _, rescue := range n.Rescues {
+			walkExpressions(v, rescue.Exceptions)
+			if rescue.Variable != nil {
+				Walk(v, rescue.Variable)
+			}
+			walkBody(v, rescue.Body)
+		}
+		walkBody(v, n.Else)
+		walkBody(v, n.Ensure)
+
+	case *MethodDefinition:
+		walkExpression(v, n.Receiver)
+		for _, param := range n.Parameters {
+			walkExpression(v, param.Default)
+		}
+		walkBody(v, n.Body)
+	case *ClassDefinition:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		walkExpression(v, n.Superclass)
+		walkBody(v, n.Body)
+	case *SingletonClassDefinition:
+		walkExpression(v, n.Object)
+		walkBody(v, n.Body)
+	case *ModuleDefinition:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		walkBody(v, n.Body)
+
+	case *ReturnStatement:
+		walkExpression(v, n.Value)
+	case *BreakStatement:
+		walkExpression(v, n.Value)
+	case *NextStatement:
+		walkExpression(v, n.Value)
+	case *YieldExpression:
+		walkExpressions(v, n.Arguments)
+	case *SuperExpression:
+		walkExpressions(v, n.Arguments)
+	case *DefinedExpression:
+		walkExpression(v, n.Expression)
+	case *AliasStatement:
+		walkExpression(v, n.New)
+		walkExpression(v, n.Old)
+	case *UndefStatement:
+		walkExpressions(v, n.Methods)
+	case *ScopedConstant:
+		walkExpression(v, n.Left)
+	case *SplatExpression:
+		walkExpression(v, n.Expression)
+	case *DoubleSplatExpression:
+		walkExpression(v, n.Expression)
+	case *BlockArgExpression:
+		walkExpression(v, n.Expression)
+	case *NotExpression:
+		walkExpression(v, n.Expression)
+	case *AndExpression:
+		walkExpression(v, n.Left)
+		walkExpression(v, n.Right)
+	case *OrExpression:
+		walkExpression(v, n.Left)
+		walkExpression(v, n.Right)
+	case *RescueModifier:
+		walkExpression(v, n.Body)
+		walkExpression(v, n.Rescue)
+	}
+
+	v.Visit(nil)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses the tree rooted at node in depth-first order, calling
+// f(node) for each node and then f(nil) once its children are done. If f
+// returns false, the children of that node are skipped.
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
+
+func walkExpression(v Visitor, expr Expression) {
+	if expr != nil {
+		Walk(v, expr)
+	}
+}
+
+func walkExpressions(v Visitor, exprs []Expression) {
+	for _, expr := range exprs {
+		walkExpression(v, expr)
+	}
+}
+
+func walkStatements(v Visitor, stmts []Statement) {
+	for _, stmt := range stmts {
+		if stmt != nil {
+			Walk(v, stmt)
+		}
+	}
+}
+
+func walkBody(v Visitor, body *BlockBody) {
+	if body != nil {
+		walkStatements(v, body.Statements)
+	}
+}
+
+func walkPattern(v Visitor, pattern Pattern) {
+	if pattern != nil {
+		Walk(v, pattern)
+	}
+}
+
+func walkPatterns(v Visitor, patterns []Pattern) {
+	for _, pattern := range patterns {
+		walkPattern(v, pattern)
+	}
+}
+
+func walkBlockParameters(v Visitor, params []*BlockParameter) {
+	for _, param := range params {
+		walkExpression(v, param.Default)
+	}
+}
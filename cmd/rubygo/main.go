@@ -6,68 +6,444 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/alexisbouchez/rubylexer/ast"
 	"github.com/alexisbouchez/rubylexer/evaluator"
 	"github.com/alexisbouchez/rubylexer/lexer"
 	"github.com/alexisbouchez/rubylexer/object"
 	"github.com/alexisbouchez/rubylexer/parser"
 	"github.com/alexisbouchez/rubylexer/repl"
+	"github.com/alexisbouchez/rubylexer/token"
 )
 
 func main() {
 	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "fmt" {
+		os.Exit(formatFiles(args[1:]))
+	}
+
+	// RUBYGOOPT gives options that apply as if given before those on the
+	// command line
+	options, err := envOptions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rubygo: %s\n", err)
+		os.Exit(1)
+	}
+	args = append(options, args...)
+
+	var includes, requires []string
+	var dump string
+	var inline []string
+	check, version := false, false
+	loop, printLines := false, false
+	var timeout time.Duration
+	var maxSteps int64
+	profile := false
+flags:
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		switch flag := args[0]; {
+		case flag == "--":
+			// The rest are the script and its arguments, even those that
+			// look like options
+			args = args[1:]
+			break flags
+		case flag == "-n" || flag == "-p":
+			// Run the script once for each line of input, printing the
+			// line after each pass for -p
+			loop = true
+			printLines = printLines || flag == "-p"
+		case (strings.HasPrefix(flag, "-n") || strings.HasPrefix(flag, "-p")) && len(flag) > 2:
+			// -ne CODE and the like: take the -n or -p, then the rest of
+			// the cluster as the next flag
+			loop = true
+			printLines = printLines || flag[1] == 'p'
+			args[0] = "-" + flag[2:]
+			continue
+		case flag == "-e" && len(args) > 1:
+			// Each -e gives a line of the script to run instead of a file
+			inline = append(inline, args[1])
+			args = args[1:]
+		case strings.HasPrefix(flag, "-e") && len(flag) > 2:
+			inline = append(inline, flag[2:])
+		case flag == "-e":
+			fmt.Fprintln(os.Stderr, "rubygo: no code specified for -e")
+			os.Exit(1)
+		case flag == "-I" && len(args) > 1:
+			includes = append(includes, args[1])
+			args = args[1:]
+		case strings.HasPrefix(flag, "-I") && len(flag) > 2:
+			includes = append(includes, flag[2:])
+		case flag == "-r" && len(args) > 1:
+			// Require the library before running the script
+			requires = append(requires, args[1])
+			args = args[1:]
+		case strings.HasPrefix(flag, "-r") && len(flag) > 2:
+			requires = append(requires, flag[2:])
+		case flag == "--version":
+			fmt.Println(evaluator.Description())
+			os.Exit(0)
+		case flag == "-v":
+			// Print the version, then run the script, if any, verbosely
+			fmt.Println(evaluator.Description())
+			evaluator.SetWarningLevel(2)
+			version = true
+		case flag == "-c":
+			// Only check the syntax of the script
+			check = true
+		case strings.HasPrefix(flag, "--timeout="):
+			// Stop the script once it has run this long, given in seconds
+			// or as a duration such as 500ms
+			value := strings.TrimPrefix(flag, "--timeout=")
+			d, err := time.ParseDuration(value)
+			if seconds, floatErr := strconv.ParseFloat(value, 64); floatErr == nil {
+				d, err = time.Duration(seconds*float64(time.Second)), nil
+			}
+			if err != nil || d <= 0 {
+				fmt.Fprintf(os.Stderr, "rubygo: invalid timeout %q\n", value)
+				os.Exit(1)
+			}
+			timeout = d
+		case strings.HasPrefix(flag, "--max-steps="):
+			// Stop the script once it has evaluated this many statements,
+			// loop iterations and block calls
+			value := strings.TrimPrefix(flag, "--max-steps=")
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				fmt.Fprintf(os.Stderr, "rubygo: invalid step count %q\n", value)
+				os.Exit(1)
+			}
+			maxSteps = n
+		case flag == "--profile":
+			// Report the time and allocations of each method after the run
+			profile = true
+		case flag == "--track-objects":
+			// Record every allocation so ObjectSpace.each_object sees instances
+			object.SetObjectTracking(true)
+		case flag == "-W" || flag == "-w":
+			evaluator.SetWarningLevel(2)
+		case strings.HasPrefix(flag, "-W:"):
+			// -W:deprecated shows a category of warning, -W:no-deprecated hides it
+			category := strings.TrimPrefix(flag, "-W:")
+			enabled := !strings.HasPrefix(category, "no-")
+			if err := evaluator.SetWarningCategory(strings.TrimPrefix(category, "no-"), enabled); err != nil {
+				fmt.Fprintf(os.Stderr, "rubygo: %s\n", err)
+				os.Exit(1)
+			}
+		case strings.HasPrefix(flag, "-W") && len(flag) == 3 && flag[2] >= '0' && flag[2] <= '2':
+			evaluator.SetWarningLevel(int(flag[2] - '0'))
+		case flag == "--dump=ast" || flag == "--dump=ast-json" || flag == "--dump=tokens":
+			// Print the tokens or parsed tree instead of running the script
+			dump = strings.TrimPrefix(flag, "--dump=")
+		default:
+			fmt.Fprintf(os.Stderr, "rubygo: invalid option %s\n", flag)
+			os.Exit(1)
+		}
+		args = args[1:]
+	}
+	evaluator.InitLoadPath(includes)
+
+	if len(args) == 0 && inline == nil {
+		if version {
+			return
+		}
+		if stdinIsTerminal() {
+			// Start REPL
+			repl.Start(os.Stdin, os.Stdout)
+			return
+		}
+		// Run the script piped in on standard input
+		args = []string{"-"}
+	}
 
-	if len(args) == 0 {
-		// Start REPL
-		repl.Start(os.Stdin, os.Stdout)
+	// Execute the -e code, or else the file; the arguments after either
+	// are the script's ARGV
+	filename, content := "-e", []byte(strings.Join(inline, "\n"))
+	if inline == nil {
+		filename, args = args[0], args[1:]
+		var err error
+		if content, err = readFile(filename); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	evaluator.SetARGV(args)
+	if check {
+		if _, err := parseSource(filename, content); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Syntax OK")
 		return
 	}
+	if dump != "" {
+		if err := dumpSource(filename, content, dump); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := evaluator.LoadVendoredLibraries(filename); err != nil {
+		fmt.Fprintf(os.Stderr, "rubygo: %s\n", err)
+		os.Exit(1)
+	}
+	if timeout > 0 {
+		evaluator.SetTimeout(timeout)
+	}
+	evaluator.SetMaxSteps(maxSteps)
+	os.Exit(runSource(filename, content, requires, loop, printLines, profile))
+}
 
-	// Execute file
-	filename := args[0]
-	if err := runFile(filename); err != nil {
+// envOptions returns the options listed in the RUBYGOOPT environment
+// variable. As with RUBYOPT, the leading dash may be left out, and only
+// the options that set the interpreter up are allowed, not those that say
+// what to run.
+func envOptions() ([]string, error) {
+	fields := strings.Fields(os.Getenv("RUBYGOOPT"))
+	for i := 0; i < len(fields); i++ {
+		if !strings.HasPrefix(fields[i], "-") {
+			fields[i] = "-" + fields[i]
+		}
+		switch opt := fields[i]; {
+		case opt == "-I" || opt == "-r":
+			// The value is the next field
+			if i++; i == len(fields) {
+				return nil, fmt.Errorf("no value given for %s in RUBYGOOPT", opt)
+			}
+		case strings.HasPrefix(opt, "-I"), strings.HasPrefix(opt, "-r"),
+			opt == "-w", strings.HasPrefix(opt, "-W"),
+			strings.HasPrefix(opt, "--timeout="), strings.HasPrefix(opt, "--max-steps="),
+			opt == "--profile", opt == "--track-objects":
+		default:
+			return nil, fmt.Errorf("invalid switch in RUBYGOOPT: %s", opt)
+		}
+	}
+	return fields, nil
+}
+
+// runSource runs content, the script named filename, once the libraries
+// in requires have been required, and returns the status to exit with.
+// With loop set, the script runs once for each line of input, which is
+// printed afterwards if printLines is set. With profile set, the time and
+// allocations of each method are reported once it has run.
+func runSource(filename string, content []byte, requires []string, loop, printLines, profile bool) int {
+	program, err := parseSource(filename, content)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
-		os.Exit(1)
+		return 1
+	}
+
+	// A script that does not parse has nothing to profile
+	if profile {
+		evaluator.StartProfile()
+		defer func() {
+			if err := evaluator.WriteProfile(os.Stderr); err != nil {
+				fmt.Fprintf(os.Stderr, "rubygo: %s\n", err)
+			}
+		}()
 	}
+
+	// Set the current file for require_relative. Code from -e or standard
+	// input has no file and keeps its name everywhere
+	absFilePath := filename
+	if filename != "-e" && filename != "-" {
+		if path, err := filepath.Abs(filename); err == nil {
+			absFilePath = path
+		}
+	}
+	evaluator.SetCurrentFile(absFilePath)
+	evaluator.SetScriptName(filename)
+
+	env := object.NewEnvironment()
+	env.SetSelf(object.ObjectClass)
+
+	var result object.Object
+	for _, lib := range requires {
+		if result = evaluator.RequireFile(lib, env); isError(result) {
+			break
+		}
+	}
+	if !isError(result) {
+		if loop {
+			result = evaluator.EvalLineLoop(program, env, printLines)
+		} else {
+			result = evaluator.Eval(program, env)
+		}
+	}
+	// exit ends the script with its status; anything else uncaught is
+	// reported and fails it
+	ended, _ := result.(*object.Error)
+	return evaluator.RunExitHandlers(ended, func(err *object.Error) {
+		fmt.Fprint(os.Stderr, describeError(err, filename, absFilePath))
+	})
 }
 
-func runFile(filename string) error {
+func isError(obj object.Object) bool {
+	_, ok := obj.(*object.Error)
+	return ok
+}
+
+// dumpSource prints the tokens of content, the script named filename
+// ("tokens"), or the tree parsed from it as an s-expression ("ast") or as
+// JSON ("ast-json").
+func dumpSource(filename string, content []byte, format string) error {
+	if format == "tokens" {
+		return dumpTokens(filename, content)
+	}
+	program, err := parseSource(filename, content)
+	if err != nil {
+		return err
+	}
+	if format == "ast-json" {
+		data, err := ast.MarshalJSON(program)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	fmt.Println(ast.Dump(program))
+	return nil
+}
+
+// dumpTokens prints each token of content with where it starts and ends,
+// then any problems the lexer found.
+func dumpTokens(filename string, content []byte) error {
+	l := lexer.New(string(content))
+	for {
+		tok := l.NextToken()
+		span := tok.Pos().String() + "-" + tok.End().String()
+		fmt.Printf("%-14s %-16s %q\n", span, tok.Type, tok.Literal)
+		if tok.Type == token.EOF {
+			break
+		}
+	}
+	diagnostics := l.Diagnostics()
+	for _, d := range diagnostics {
+		fmt.Fprintln(os.Stderr, parser.FormatError(filename, string(content), d.Pos, "SyntaxError: "+d.Message))
+	}
+	if len(diagnostics) != 0 {
+		return fmt.Errorf("lexing found %d error(s)", len(diagnostics))
+	}
+	return nil
+}
+
+// stdinIsTerminal reports whether standard input is a terminal rather
+// than a pipe or file.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// formatFiles prints each file re-generated from its parsed tree and its
+// comments, returning the exit status.
+func formatFiles(filenames []string) int {
+	if len(filenames) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: rubygo fmt file.rb...")
+		return 2
+	}
+	status := 0
+	for _, filename := range filenames {
+		content, err := readFile(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			status = 1
+			continue
+		}
+		program, comments, err := parseSourceComments(filename, content)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			status = 1
+			continue
+		}
+		out := ast.FormatSource(program, string(content), comments)
+		if !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		fmt.Print(out)
+	}
+	return status
+}
+
+// readFile returns the contents of filename, or of standard input if
+// filename is "-".
+func readFile(filename string) ([]byte, error) {
+	if filename == "-" {
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("could not read standard input: %w", err)
+		}
+		return content, nil
+	}
 	file, err := os.Open(filename)
 	if err != nil {
-		return fmt.Errorf("could not open file: %w", err)
+		return nil, fmt.Errorf("could not open file: %w", err)
 	}
 	defer file.Close()
 
 	content, err := io.ReadAll(file)
 	if err != nil {
-		return fmt.Errorf("could not read file: %w", err)
+		return nil, fmt.Errorf("could not read file: %w", err)
 	}
+	return content, nil
+}
 
+// parseSource parses content, printing any syntax errors against
+// filename.
+func parseSource(filename string, content []byte) (*ast.Program, error) {
+	program, _, err := parseSourceComments(filename, content)
+	return program, err
+}
+
+// parseSourceComments is parseSource that also returns the comments of
+// content, which the tree does not hold.
+func parseSourceComments(filename string, content []byte) (*ast.Program, []ast.Comment, error) {
 	l := lexer.New(string(content))
 	p := parser.New(l)
 	program := p.ParseProgram()
 
 	if len(p.Errors()) != 0 {
-		for _, msg := range p.Errors() {
-			fmt.Fprintf(os.Stderr, "SyntaxError: %s\n", msg)
+		for _, err := range p.SyntaxErrors() {
+			fmt.Fprintln(os.Stderr, parser.FormatError(filename, string(content), err.Pos, "SyntaxError: "+err.Msg))
 		}
-		return fmt.Errorf("parsing failed with %d error(s)", len(p.Errors()))
+		return nil, nil, fmt.Errorf("parsing failed with %d error(s)", len(p.Errors()))
 	}
+	return program, p.Comments(), nil
+}
 
-	// Set the current file for require_relative
-	if absFilePath, pathErr := filepath.Abs(filename); pathErr == nil {
-		evaluator.SetCurrentFile(absFilePath)
-	} else {
-		evaluator.SetCurrentFile(filename)
+// describeError formats an uncaught error the way ruby does: the message
+// and class of the error after the place it was raised, then the calls
+// that led there. The script is named as it was given on the command line.
+func describeError(err *object.Error, filename, absFilePath string) string {
+	frames := err.Backtrace
+	if len(frames) == 0 && err.Pos.IsValid() {
+		frames = []string{fmt.Sprintf("%s:%d", err.File, err.Pos.Line)}
 	}
-
-	env := object.NewEnvironment()
-	env.SetSelf(object.ObjectClass)
-
-	result := evaluator.Eval(program, env)
-	if err, ok := result.(*object.Error); ok {
-		return fmt.Errorf("%s", err.Message)
+	for i, frame := range frames {
+		if strings.HasPrefix(frame, absFilePath+":") {
+			frames[i] = filename + strings.TrimPrefix(frame, absFilePath)
+		}
+	}
+	where := filename
+	if len(frames) > 0 {
+		where = frames[0]
 	}
 
-	return nil
+	message := evaluator.ErrorMessage(err)
+	if message == "" {
+		message = "unhandled exception"
+	}
+	// The class goes after the first line of the message
+	first, rest, multiline := strings.Cut(message, "\n")
+	var out strings.Builder
+	fmt.Fprintf(&out, "%s: %s (%s)\n", where, first, evaluator.ErrorClassName(err))
+	if multiline {
+		out.WriteString(rest + "\n")
+	}
+	for _, frame := range frames[min(1, len(frames)):] {
+		fmt.Fprintf(&out, "\tfrom %s\n", frame)
+	}
+	return out.String()
 }
@@ -0,0 +1,336 @@
+package evaluator
+
+import (
+	"io"
+	"strings"
+
+	"github.com/alexisbouchez/rubylexer/ast"
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// ARGFClass is the class of ARGF, the stream that concatenates the files
+// named in ARGV, or standard input when none are given
+var ARGFClass = &object.RubyClass{
+	Name:         "ARGF.class",
+	Superclass:   object.ObjectClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// ARGF is the single instance of ARGF.class
+var ARGF = &object.Instance{
+	Class_:            ARGFClass,
+	InstanceVariables: make(map[string]object.Object),
+}
+
+// argvArray holds the script arguments exposed as ARGV. ARGF shifts the
+// file names off it as it opens them.
+var argvArray = &object.Array{Elements: []object.Object{}}
+
+// argfState tracks which input ARGF is reading.
+type argfState struct {
+	current  *object.Instance
+	filename string
+	started  bool
+	lineno   int64
+}
+
+var argf = argfState{filename: "-"}
+
+// SetARGV sets the arguments the script sees in ARGV.
+func SetARGV(args []string) {
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+	elements := make([]object.Object, len(args))
+	for i, arg := range args {
+		elements[i] = &object.String{Value: arg}
+	}
+	argvArray.Elements = elements
+}
+
+// EvalLineLoop evaluates program once for each line gets reads, as ruby's
+// -n option does, with the line in $_. When printLines is set, as for -p,
+// $_ is printed after each pass, even one cut short by next.
+func EvalLineLoop(program *ast.Program, env *object.Environment, printLines bool) object.Object {
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+	if err := warnUnusedVariables(program, env); err != nil {
+		return err
+	}
+
+	body := &ast.BlockBody{Statements: program.Statements}
+	gets := ARGFClass.Methods["gets"].(*object.Builtin)
+	for {
+		if err := checkInterrupt(); err != nil {
+			return err
+		}
+		line := gets.Fn(ARGF, env)
+		if isError(line) {
+			return line
+		}
+		if line == object.NIL {
+			return object.NIL
+		}
+
+		switch result := evalBlockBody(body, env).(type) {
+		case *object.ReturnValue:
+			return result.Value
+		case *object.BreakValue:
+			return object.NIL
+		case *object.Error:
+			return result
+		}
+		if printLines {
+			if err := writeStdout(objectToString(globalVariables["$_"])); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func init() {
+	ARGFClass.Methods["gets"] = &object.Builtin{
+		Name: "gets",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			format, err := parseRecordArgs(args)
+			if err != nil {
+				return err
+			}
+			line, err := argf.readRecord(format)
+			if err != nil {
+				return err
+			}
+			setLastLine(line, argf.lineno)
+			return line
+		},
+	}
+
+	ARGFClass.Methods["readline"] = &object.Builtin{
+		Name: "readline",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			line := ARGFClass.Methods["gets"].(*object.Builtin).Fn(receiver, env, args...)
+			if line == object.NIL {
+				return newError("EOFError: end of file reached")
+			}
+			return line
+		},
+	}
+
+	ARGFClass.Methods["readlines"] = &object.Builtin{
+		Name: "readlines",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			format, err := parseRecordArgs(args)
+			if err != nil {
+				return err
+			}
+			lines := []object.Object{}
+			for {
+				line, err := argf.readRecord(format)
+				if err != nil {
+					return err
+				}
+				if line == object.NIL {
+					return &object.Array{Elements: lines}
+				}
+				lines = append(lines, line)
+			}
+		},
+	}
+	ARGFClass.Methods["to_a"] = ARGFClass.Methods["readlines"]
+
+	ARGFClass.Methods["each_line"] = &object.Builtin{
+		Name: "each_line",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			format, err := parseRecordArgs(args)
+			if err != nil {
+				return err
+			}
+			block := env.Block()
+			if block == nil {
+				return newEnumerator(receiver, "each_line", args)
+			}
+			for {
+				line, err := argf.readRecord(format)
+				if err != nil {
+					return err
+				}
+				if line == object.NIL {
+					return receiver
+				}
+				result := callBlock(block, []object.Object{line}, env)
+				if _, ok := result.(*object.BreakValue); ok {
+					return result
+				}
+				if isError(result) {
+					return result
+				}
+			}
+		},
+	}
+	ARGFClass.Methods["each"] = ARGFClass.Methods["each_line"]
+
+	ARGFClass.Methods["read"] = &object.Builtin{
+		Name: "read",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			limit := -1
+			if len(args) > 0 && args[0] != object.NIL {
+				n, ok := args[0].(*object.Integer)
+				if !ok {
+					return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+				}
+				limit = int(n.Value)
+			}
+			var content strings.Builder
+			for limit < 0 || content.Len() < limit {
+				handle, err := argf.nextHandle()
+				if err != nil {
+					return err
+				}
+				if handle == nil {
+					break
+				}
+				var data []byte
+				if limit < 0 {
+					data, _ = io.ReadAll(handle.reader)
+				} else {
+					data, _ = io.ReadAll(io.LimitReader(handle.reader, int64(limit-content.Len())))
+				}
+				content.Write(data)
+				if limit < 0 || content.Len() < limit {
+					argf.finishFile()
+				}
+			}
+			if limit > 0 && content.Len() == 0 {
+				return object.NIL
+			}
+			return &object.String{Value: content.String()}
+		},
+	}
+
+	ARGFClass.Methods["eof?"] = &object.Builtin{
+		Name: "eof?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if argf.current == nil {
+				return object.TRUE
+			}
+			_, peekErr := lookupFileHandle(argf.current).reader.Peek(1)
+			return object.NativeToBool(peekErr != nil)
+		},
+	}
+	ARGFClass.Methods["eof"] = ARGFClass.Methods["eof?"]
+
+	ARGFClass.Methods["filename"] = &object.Builtin{
+		Name: "filename",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if argf.current == nil {
+				if _, err := argf.nextHandle(); err != nil {
+					return err
+				}
+			}
+			return &object.String{Value: argf.filename}
+		},
+	}
+	ARGFClass.Methods["path"] = ARGFClass.Methods["filename"]
+
+	ARGFClass.Methods["file"] = &object.Builtin{
+		Name: "file",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if _, err := argf.nextHandle(); err != nil {
+				return err
+			}
+			if argf.current == nil {
+				return stdinIO
+			}
+			return argf.current
+		},
+	}
+
+	ARGFClass.Methods["skip"] = &object.Builtin{
+		Name: "skip",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			argf.finishFile()
+			return receiver
+		},
+	}
+
+	ARGFClass.Methods["lineno"] = &object.Builtin{
+		Name: "lineno",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: argf.lineno}
+		},
+	}
+
+	ARGFClass.Methods["argv"] = &object.Builtin{
+		Name: "argv",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return argvArray
+		},
+	}
+
+	ARGFClass.Methods["to_s"] = &object.Builtin{
+		Name: "to_s",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.String{Value: "ARGF"}
+		},
+	}
+	ARGFClass.Methods["inspect"] = ARGFClass.Methods["to_s"]
+}
+
+// nextHandle returns the stream ARGF is reading, opening the next file
+// named in ARGV once the current one is used up. Standard input is read
+// when ARGV is empty to begin with. It returns nil once all input is
+// exhausted.
+func (a *argfState) nextHandle() (*fileHandle, object.Object) {
+	if a.current != nil {
+		return lookupFileHandle(a.current), nil
+	}
+	if len(argvArray.Elements) == 0 {
+		if a.started {
+			return nil, nil
+		}
+		a.started = true
+		a.current, a.filename = stdinIO, "-"
+		return lookupFileHandle(stdinIO), nil
+	}
+
+	a.started = true
+	name := objectToString(argvArray.Elements[0])
+	argvArray.Elements = argvArray.Elements[1:]
+	if name == "-" {
+		a.current, a.filename = stdinIO, "-"
+		return lookupFileHandle(stdinIO), nil
+	}
+	file := openFile([]object.Object{&object.String{Value: name}})
+	if isError(file) {
+		return nil, newError("Errno::ENOENT: No such file or directory @ rb_sysopen - %s", name)
+	}
+	a.current, a.filename = file.(*object.Instance), name
+	return lookupFileHandle(a.current), nil
+}
+
+// finishFile closes the current file so the next read moves on.
+func (a *argfState) finishFile() {
+	if a.current != nil && a.current != stdinIO {
+		closeFileHandle(a.current)
+	}
+	a.current = nil
+}
+
+// readRecord reads the next record across ARGF's files, returning nil at
+// the end of the last one.
+func (a *argfState) readRecord(format recordFormat) (object.Object, object.Object) {
+	for {
+		handle, err := a.nextHandle()
+		if err != nil {
+			return nil, err
+		}
+		if handle == nil {
+			return object.NIL, nil
+		}
+		if line, ok := handle.readRecord(format); ok {
+			a.lineno++
+			return &object.String{Value: line}, nil
+		}
+		a.finishFile()
+	}
+}
@@ -0,0 +1,96 @@
+package evaluator
+
+import (
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// atExitHandlers are the blocks registered with Kernel#at_exit
+var atExitHandlers []*object.Proc
+
+// RunExitHandlers runs the at_exit blocks, most recently registered first,
+// followed by the object finalizers. It is called once as the interpreter
+// shuts down, whether the script finished, failed, called exit or ran
+// past its limits, which no longer apply. ended is the exception the script
+// ended with, nil if it finished, and report prints an uncaught exception.
+// It returns the status to exit with: an exception raised by a handler,
+// exit included, takes the place of the one the script ended with.
+func RunExitHandlers(ended *object.Error, report func(*object.Error)) int {
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+	clearLimits()
+
+	status := 0
+	if ended != nil {
+		var isExit bool
+		if status, isExit = ExitStatus(ended); isExit {
+			ended = nil
+		}
+	}
+	for len(atExitHandlers) > 0 {
+		handler := atExitHandlers[len(atExitHandlers)-1]
+		atExitHandlers = atExitHandlers[:len(atExitHandlers)-1]
+		result := callProc(handler, []object.Object{}, object.NewEnvironment())
+		if err, ok := result.(*object.Error); ok {
+			var isExit bool
+			status, isExit = ExitStatus(err)
+			ended = nil
+			if !isExit {
+				report(err)
+			}
+		}
+	}
+	runFinalizers()
+	if ended != nil {
+		report(ended)
+	}
+	return status
+}
+
+// exitStatus converts exit's argument (true, false or an Integer) into a
+// process exit code.
+func exitStatus(args []object.Object, defaultCode int) int {
+	if len(args) == 0 {
+		return defaultCode
+	}
+	switch s := args[0].(type) {
+	case *object.Integer:
+		return int(s.Value)
+	case *object.Boolean:
+		if s.Value {
+			return 0
+		}
+		return 1
+	}
+	return defaultCode
+}
+
+// newSystemExit returns the SystemExit that exit raises to end the script
+// with status, running the ensure clauses on its way out.
+func newSystemExit(status int) *object.Error {
+	return &object.Error{Message: "exit", Class_: object.SystemExitClass, Status: status}
+}
+
+// ExitStatus returns the status to exit with when err ends the script,
+// and whether it is a SystemExit, which ends it without a report.
+func ExitStatus(err *object.Error) (int, bool) {
+	if err.Class_ != nil && isSubclassOf(err.Class_, object.SystemExitClass) {
+		return err.Status, true
+	}
+	return 1, false
+}
+
+func init() {
+	object.SystemExitClass.Methods["status"] = &object.Builtin{
+		Name: "status",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: int64(receiver.(*object.Error).Status)}
+		},
+	}
+
+	object.SystemExitClass.Methods["success?"] = &object.Builtin{
+		Name: "success?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return object.NativeToBool(receiver.(*object.Error).Status == 0)
+		},
+	}
+}
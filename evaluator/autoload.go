@@ -0,0 +1,111 @@
+package evaluator
+
+import (
+	"sync"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// autoloads maps a class or module to the constants registered on it with
+// autoload and the feature to require for each. Top-level registrations
+// are kept under Object.
+var (
+	autoloads      = make(map[object.Object]map[string]string)
+	autoloadsMutex sync.Mutex
+)
+
+// autoloadOwner is the namespace autoload registers constants in when
+// called on self: the class or module itself, or Object otherwise.
+func autoloadOwner(self object.Object) object.Object {
+	switch s := self.(type) {
+	case *object.RubyClass, *object.RubyModule:
+		return s
+	}
+	return object.ObjectClass
+}
+
+// registerAutoload records that name in owner is defined by path.
+func registerAutoload(owner object.Object, name, path string) {
+	autoloadsMutex.Lock()
+	defer autoloadsMutex.Unlock()
+	if autoloads[owner] == nil {
+		autoloads[owner] = make(map[string]string)
+	}
+	autoloads[owner][name] = path
+}
+
+// autoloadPath returns the feature registered for name in owner, if any.
+func autoloadPath(owner object.Object, name string) (string, bool) {
+	autoloadsMutex.Lock()
+	defer autoloadsMutex.Unlock()
+	path, ok := autoloads[owner][name]
+	return path, ok
+}
+
+// autoloadConstant resolves name through any autoload registered on self,
+// its ancestors or Object, requiring the feature and looking the constant
+// up again. The registration is dropped before the require so that the
+// file may reference the constant while defining it.
+func autoloadConstant(self object.Object, name string, env *object.Environment) (object.Object, bool) {
+	for _, owner := range autoloadScopes(self) {
+		autoloadsMutex.Lock()
+		path, ok := autoloads[owner][name]
+		if ok {
+			delete(autoloads[owner], name)
+		}
+		autoloadsMutex.Unlock()
+		if !ok {
+			continue
+		}
+
+		root := env
+		for root.Outer() != nil {
+			root = root.Outer()
+		}
+		if result := RequireFile(path, root); isError(result) {
+			return result, true
+		}
+		if val, ok := definedConstant(owner, name, root); ok {
+			return val, true
+		}
+		return nil, false
+	}
+	return nil, false
+}
+
+// autoloadScopes lists the namespaces searched for an autoload of a
+// constant referenced from self, innermost first.
+func autoloadScopes(self object.Object) []object.Object {
+	var scopes []object.Object
+	switch s := self.(type) {
+	case *object.RubyModule:
+		scopes = append(scopes, s)
+	case *object.RubyClass:
+		for class := s; class != nil; class = class.Superclass {
+			scopes = append(scopes, class)
+		}
+	case *object.Instance:
+		for class := s.Class_; class != nil; class = class.Superclass {
+			scopes = append(scopes, class)
+		}
+	}
+	return append(scopes, object.ObjectClass)
+}
+
+// definedConstant looks name up directly in owner, falling back to the
+// top-level environment for constants owned by Object.
+func definedConstant(owner object.Object, name string, root *object.Environment) (object.Object, bool) {
+	switch o := owner.(type) {
+	case *object.RubyModule:
+		val, ok := o.Constants[name]
+		return val, ok
+	case *object.RubyClass:
+		if val, ok := o.Constants[name]; ok {
+			return val, true
+		}
+		if o != object.ObjectClass {
+			return nil, false
+		}
+	}
+	return root.GetConstant(name)
+}
@@ -0,0 +1,197 @@
+package evaluator
+
+import (
+	"fmt"
+
+	"github.com/alexisbouchez/rubylexer/ast"
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// callFrame is one entry of the Ruby-level call stack: the method being
+// run and the line it is currently executing.
+type callFrame struct {
+	label string
+	file  string
+	line  int
+}
+
+// callStack holds the frames of the methods being run, outermost first.
+// The bottom frame is the main script.
+var callStack = []*callFrame{{label: "<main>"}}
+
+// BacktraceLocationClass represents Thread::Backtrace::Location, the
+// objects returned by caller_locations
+var BacktraceLocationClass = &object.RubyClass{
+	Name:         "Thread::Backtrace::Location",
+	Superclass:   object.ObjectClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+func init() {
+	for _, name := range []string{"path", "lineno", "label"} {
+		ivar := "@" + name
+		BacktraceLocationClass.Methods[name] = &object.Builtin{
+			Name: name,
+			Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+				return receiver.(*object.Instance).GetInstanceVariable(ivar)
+			},
+		}
+	}
+	BacktraceLocationClass.Methods["base_label"] = BacktraceLocationClass.Methods["label"]
+	BacktraceLocationClass.Methods["absolute_path"] = BacktraceLocationClass.Methods["path"]
+
+	BacktraceLocationClass.Methods["to_s"] = &object.Builtin{
+		Name: "to_s",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.String{Value: locationString(receiver.(*object.Instance))}
+		},
+	}
+
+	BacktraceLocationClass.Methods["inspect"] = &object.Builtin{
+		Name: "inspect",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.String{Value: fmt.Sprintf("%q", locationString(receiver.(*object.Instance)))}
+		},
+	}
+}
+
+// pushFrame enters a method; the caller must popFrame when it returns.
+func pushFrame(label string) {
+	callStack = append(callStack, &callFrame{label: label, file: currentFile})
+}
+
+func popFrame() {
+	if len(callStack) > 1 {
+		callStack = callStack[:len(callStack)-1]
+	}
+}
+
+// setCurrentLine records the line the innermost frame is executing.
+func setCurrentLine(stmt ast.Statement) {
+	if line := statementLine(stmt); line > 0 {
+		frame := callStack[len(callStack)-1]
+		frame.line = line
+		if frame.file == "" {
+			frame.file = currentFile
+		}
+	}
+}
+
+// recordErrorPos notes that err was raised in stmt, along with the call
+// stack at that point, unless a statement nested inside it already was.
+func recordErrorPos(err *object.Error, stmt ast.Statement) {
+	if err.Pos.IsValid() {
+		return
+	}
+	err.File = currentFile
+	err.Pos = stmt.Pos()
+	if err.Backtrace == nil {
+		frames := backtraceFrames(0, -1)
+		frames[0].line = err.Pos.Line
+		for _, frame := range frames {
+			err.Backtrace = append(err.Backtrace, frameString(frame))
+		}
+	}
+}
+
+// statementLine returns the source line a statement starts on, or 0 when
+// it is not known.
+func statementLine(stmt ast.Statement) int {
+	switch s := stmt.(type) {
+	case *ast.ExpressionStatement:
+		return s.Token.Line
+	case *ast.ModifierStatement:
+		return s.Token.Line
+	case *ast.ReturnStatement:
+		return s.Token.Line
+	case *ast.MethodDefinition:
+		return s.Token.Line
+	case *ast.ClassDefinition:
+		return s.Token.Line
+	case *ast.ModuleDefinition:
+		return s.Token.Line
+	}
+	return 0
+}
+
+// backtraceFrames returns up to length frames starting start frames out
+// from the innermost one, innermost first. A negative length means all.
+func backtraceFrames(start, length int) []callFrame {
+	var frames []callFrame
+	for i := len(callStack) - 1 - start; i >= 0; i-- {
+		if length >= 0 && len(frames) == length {
+			break
+		}
+		frames = append(frames, *callStack[i])
+	}
+	return frames
+}
+
+// frameString formats a frame the way Ruby prints backtrace lines.
+func frameString(frame callFrame) string {
+	return fmt.Sprintf("%s:%d:in `%s'", frame.file, frame.line, frame.label)
+}
+
+func locationString(loc *object.Instance) string {
+	return frameString(callFrame{
+		label: objectToString(loc.GetInstanceVariable("@label")),
+		file:  objectToString(loc.GetInstanceVariable("@path")),
+		line:  int(loc.GetInstanceVariable("@lineno").(*object.Integer).Value),
+	})
+}
+
+// callerArgs parses the (start = 1, length = nil) or (range) arguments
+// of caller and caller_locations.
+func callerArgs(args []object.Object) (int, int, object.Object) {
+	start, length := 1, -1
+	if len(args) > 0 {
+		switch a := args[0].(type) {
+		case *object.Integer:
+			start = int(a.Value)
+		case *object.Range:
+			first, ok1 := a.Start.(*object.Integer)
+			last, ok2 := a.End.(*object.Integer)
+			if !ok1 {
+				return 0, 0, newError("TypeError: no implicit conversion of Range into Integer")
+			}
+			start = int(first.Value)
+			if ok2 {
+				length = int(last.Value) - start + 1
+				if a.Exclusive {
+					length--
+				}
+			}
+		default:
+			return 0, 0, newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+		}
+	}
+	if len(args) > 1 {
+		if n, ok := args[1].(*object.Integer); ok {
+			length = int(n.Value)
+		}
+	}
+	if start < 0 {
+		return 0, 0, newError("ArgumentError: negative level (%d)", start)
+	}
+	if length < -1 {
+		return 0, 0, newError("ArgumentError: negative size (%d)", length)
+	}
+	return start, length, nil
+}
+
+// callerLocations builds the caller_locations result.
+func callerLocations(frames []callFrame) *object.Array {
+	elements := make([]object.Object, len(frames))
+	for i, frame := range frames {
+		loc := &object.Instance{
+			Class_:            BacktraceLocationClass,
+			InstanceVariables: make(map[string]object.Object),
+		}
+		loc.InstanceVariables["@path"] = &object.String{Value: frame.file}
+		loc.InstanceVariables["@lineno"] = &object.Integer{Value: int64(frame.line)}
+		loc.InstanceVariables["@label"] = &object.String{Value: frame.label}
+		elements[i] = loc
+	}
+	return &object.Array{Elements: elements}
+}
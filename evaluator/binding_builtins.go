@@ -139,9 +139,10 @@ func evalInBinding(code string, binding *object.Binding) object.Object {
 	program := p.ParseProgram()
 
 	if len(p.Errors()) > 0 {
-		return newError("SyntaxError: %s", p.Errors()[0])
+		err := p.SyntaxErrors()[0]
+		return newError("SyntaxError: (eval):%s: %s", err.Pos, err.Msg)
 	}
 
 	// Evaluate in the binding's environment
-	return Eval(program, binding.Env)
+	return evalProgram(program, binding.Env)
 }
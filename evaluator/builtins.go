@@ -2,7 +2,10 @@ package evaluator
 
 import (
 	"fmt"
+	"hash/fnv"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -121,7 +124,11 @@ func getObjectBuiltins() map[string]*object.Builtin {
 			"inspect": {
 				Name: "inspect",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.String{Value: receiver.Inspect()}
+					str, err := inspectValue(receiver)
+					if err != nil {
+						return err
+					}
+					return &object.String{Value: str}
 				},
 			},
 			"to_s": {
@@ -130,6 +137,12 @@ func getObjectBuiltins() map[string]*object.Builtin {
 					return &object.String{Value: receiver.Inspect()}
 				},
 			},
+			"pretty_inspect": {
+				Name: "pretty_inspect",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.String{Value: prettyInspect(receiver, ppDefaultWidth) + "\n"}
+				},
+			},
 			"nil?": {
 				Name: "nil?",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
@@ -137,7 +150,8 @@ func getObjectBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"is_a?": {
-				Name: "is_a?",
+				Name:   "is_a?",
+				Params: []string{"req"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					if len(args) < 1 {
 						return newError("wrong number of arguments (given 0, expected 1)")
@@ -177,7 +191,8 @@ func getObjectBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"respond_to?": {
-				Name: "respond_to?",
+				Name:   "respond_to?",
+				Params: []string{"req", "opt"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					if len(args) < 1 {
 						return newError("wrong number of arguments (given 0, expected 1)")
@@ -197,6 +212,12 @@ func getObjectBuiltins() map[string]*object.Builtin {
 							return object.TRUE
 						}
 					}
+					if class, ok := receiver.(*object.RubyClass); ok {
+						if method, ok := class.LookupClassMethod(methodName); ok {
+							m, isMethod := method.(*object.Method)
+							return object.NativeToBool(!isMethod || m.Visibility != object.VisibilityPrivate)
+						}
+					}
 					if getBuiltinMethod(receiver, methodName) != nil {
 						return object.TRUE
 					}
@@ -204,7 +225,8 @@ func getObjectBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"send": {
-				Name: "send",
+				Name:   "send",
+				Params: []string{"req", "rest"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					if len(args) < 1 {
 						return newError("wrong number of arguments (given 0, expected 1+)")
@@ -224,7 +246,7 @@ func getObjectBuiltins() map[string]*object.Builtin {
 			"object_id": {
 				Name: "object_id",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.Integer{Value: int64(uintptr(fmt.Sprintf("%p", receiver)[2:][0]))}
+					return &object.Integer{Value: object.GetObjectID(receiver)}
 				},
 			},
 			"==": {
@@ -236,6 +258,21 @@ func getObjectBuiltins() map[string]*object.Builtin {
 					return object.NativeToBool(objectsEqual(receiver, args[0]))
 				},
 			},
+			"eql?": {
+				Name: "eql?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+					}
+					return object.NativeToBool(objectsEqual(receiver, args[0]))
+				},
+			},
+			"hash": {
+				Name: "hash",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.Integer{Value: objectHash(receiver)}
+				},
+			},
 			"!=": {
 				Name: "!=",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
@@ -252,6 +289,10 @@ func getObjectBuiltins() map[string]*object.Builtin {
 					if block == nil {
 						return newError("no block given")
 					}
+					// A proc with no Ruby body, like &:sym, gets self as its argument
+					if block.Native != nil {
+						return callBlock(block, []object.Object{receiver}, env)
+					}
 
 					// Create new environment with self set to the receiver
 					evalEnv := object.NewEnclosedEnvironment(block.Env)
@@ -307,7 +348,8 @@ func getObjectBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"instance_variable_get": {
-				Name: "instance_variable_get",
+				Name:   "instance_variable_get",
+				Params: []string{"req"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					if len(args) < 1 {
 						return newError("wrong number of arguments (given 0, expected 1)")
@@ -336,7 +378,8 @@ func getObjectBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"instance_variable_set": {
-				Name: "instance_variable_set",
+				Name:   "instance_variable_set",
+				Params: []string{"req", "req"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					if len(args) < 2 {
 						return newError("wrong number of arguments (given %d, expected 2)", len(args))
@@ -396,14 +439,16 @@ func getObjectBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"freeze": {
-				Name: "freeze",
+				Name:   "freeze",
+				Params: []string{},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					// Simplified freeze - just return self (not enforced)
 					return receiver
 				},
 			},
 			"frozen?": {
-				Name: "frozen?",
+				Name:   "frozen?",
+				Params: []string{},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					return object.FALSE
 				},
@@ -451,16 +496,14 @@ func getObjectBuiltins() map[string]*object.Builtin {
 					}
 
 					// Call block with self
-					blockEnv := object.NewEnclosedEnvironment(block.Env)
-					if len(block.Parameters) > 0 {
-						blockEnv.Set(block.Parameters[0].Name, receiver)
+					if result := callBlock(block, []object.Object{receiver}, env); isError(result) {
+						return result
 					}
-					evalBlockBody(block.Body, blockEnv)
-
 					return receiver
 				},
 			},
 			"to_json": getToJSONBuiltin(),
+			"to_yaml": getToYAMLBuiltin(),
 			"method": {
 				Name: "method",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
@@ -522,31 +565,49 @@ func getKernelBuiltins() map[string]*object.Builtin {
 	kernelBuiltinsOnce.Do(func() {
 		kernelBuiltinsMap = map[string]*object.Builtin{
 			"puts": {
-				Name: "puts",
+				Name:   "puts",
+				Params: []string{"rest"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					for _, arg := range args {
-						fmt.Println(objectToString(arg))
+					text, err := putsText(args)
+					if err != nil {
+						return err
 					}
-					if len(args) == 0 {
-						fmt.Println()
+					if err := writeStdout(text); err != nil {
+						return err
 					}
 					return object.NIL
 				},
 			},
 			"print": {
-				Name: "print",
+				Name:   "print",
+				Params: []string{"rest"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					var sb strings.Builder
 					for _, arg := range args {
-						fmt.Print(objectToString(arg))
+						str, err := convertToString(arg)
+						if err != nil {
+							return err
+						}
+						sb.WriteString(str)
+					}
+					if err := writeStdout(sb.String()); err != nil {
+						return err
 					}
 					return object.NIL
 				},
 			},
 			"p": {
-				Name: "p",
+				Name:   "p",
+				Params: []string{"rest"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					for _, arg := range args {
-						fmt.Println(arg.Inspect())
+						str, err := inspectValue(arg)
+						if err != nil {
+							return err
+						}
+						if err := writeStdout(str + "\n"); err != nil {
+							return err
+						}
 					}
 					if len(args) == 1 {
 						return args[0]
@@ -554,12 +615,40 @@ func getKernelBuiltins() map[string]*object.Builtin {
 					return &object.Array{Elements: args}
 				},
 			},
+			"pp": {
+				Name:   "pp",
+				Params: []string{"rest"},
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					for _, arg := range args {
+						if err := writeStdout(prettyInspect(arg, ppDefaultWidth) + "\n"); err != nil {
+							return err
+						}
+					}
+					switch len(args) {
+					case 0:
+						return object.NIL
+					case 1:
+						return args[0]
+					}
+					return &object.Array{Elements: args}
+				},
+			},
 			"gets": {
 				Name: "gets",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					var input string
-					fmt.Scanln(&input)
-					return &object.String{Value: input}
+					return ARGFClass.Methods["gets"].(*object.Builtin).Fn(ARGF, env, args...)
+				},
+			},
+			"readline": {
+				Name: "readline",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return ARGFClass.Methods["readline"].(*object.Builtin).Fn(ARGF, env, args...)
+				},
+			},
+			"readlines": {
+				Name: "readlines",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return ARGFClass.Methods["readlines"].(*object.Builtin).Fn(ARGF, env, args...)
 				},
 			},
 			"require": {
@@ -575,6 +664,15 @@ func getKernelBuiltins() map[string]*object.Builtin {
 					return RequireFile(filename.Value, env)
 				},
 			},
+			"__dir__": {
+				Name: "__dir__",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if currentFile == "" {
+						return object.NIL
+					}
+					return &object.String{Value: filepath.Dir(currentFile)}
+				},
+			},
 			"require_relative": {
 				Name: "require_relative",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
@@ -601,6 +699,47 @@ func getKernelBuiltins() map[string]*object.Builtin {
 					return LoadFile(filename.Value, env)
 				},
 			},
+			"autoload": {
+				Name: "autoload",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) != 2 {
+						return newError("wrong number of arguments (given %d, expected 2)", len(args))
+					}
+					var name string
+					switch n := args[0].(type) {
+					case *object.Symbol:
+						name = n.Value
+					case *object.String:
+						name = n.Value
+					default:
+						return newError("TypeError: %s is not a symbol nor a string", inspectObject(args[0]))
+					}
+					if name == "" || name[0] < 'A' || name[0] > 'Z' {
+						return newError("NameError: autoload must be constant name: %s", name)
+					}
+					path, ok := args[1].(*object.String)
+					if !ok {
+						return newError("TypeError: no implicit conversion of %s into String", comparisonOperandName(args[1]))
+					}
+					if path.Value == "" {
+						return newError("ArgumentError: empty file name")
+					}
+					registerAutoload(autoloadOwner(receiver), name, path.Value)
+					return object.NIL
+				},
+			},
+			"autoload?": {
+				Name: "autoload?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) != 1 {
+						return newError("wrong number of arguments (given %d, expected 1)", len(args))
+					}
+					if path, ok := autoloadPath(autoloadOwner(receiver), objectToString(args[0])); ok {
+						return &object.String{Value: path}
+					}
+					return object.NIL
+				},
+			},
 			"raise": {
 				Name: "raise",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
@@ -637,26 +776,192 @@ func getKernelBuiltins() map[string]*object.Builtin {
 			"exit": {
 				Name: "exit",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					code := 0
+					return newSystemExit(exitStatus(args, 0))
+				},
+			},
+			"exit!": {
+				Name: "exit!",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					// Skips at_exit handlers and finalizers
+					os.Exit(exitStatus(args, 1))
+					return object.NIL
+				},
+			},
+			"abort": {
+				Name: "abort",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					// Prints the message, then exits with status 1 the way
+					// exit does, so ensure clauses and rescue SystemExit run
+					exit := newSystemExit(1)
+					if len(args) > 0 {
+						msg, ok := args[0].(*object.String)
+						if !ok {
+							return newError("TypeError: no implicit conversion of %s into String", comparisonOperandName(args[0]))
+						}
+						writeStderr(warningText("", []object.Object{msg}))
+						exit.Message = msg.Value
+					}
+					return exit
+				},
+			},
+			"at_exit": {
+				Name: "at_exit",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					block := env.Block()
+					if block == nil {
+						return newError("ArgumentError: called without a block")
+					}
+					atExitHandlers = append(atExitHandlers, block)
+					return block
+				},
+			},
+			"warn": {
+				Name:   "warn",
+				Params: []string{"rest"},
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					prefix, category := "", ""
+					if len(args) > 0 {
+						if opts, ok := args[len(args)-1].(*object.Hash); ok && opts.IsKeywordArgs {
+							args = args[:len(args)-1]
+							if value, ok := hashGet(opts, &object.Symbol{Value: "category"}); ok && value != object.NIL {
+								name, err := warningCategory(value)
+								if err != nil {
+									return err
+								}
+								category = name
+							}
+							if level, ok := hashGet(opts, &object.Symbol{Value: "uplevel"}); ok && level != object.NIL {
+								n, ok := level.(*object.Integer)
+								if !ok {
+									return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(level))
+								}
+								if n.Value < 0 {
+									return newError("ArgumentError: negative level (%d)", n.Value)
+								}
+								// uplevel: 0 is the line calling warn
+								if frames := backtraceFrames(int(n.Value), 1); len(frames) > 0 {
+									prefix = fmt.Sprintf("%s:%d: warning: ", displayPath(frames[0].file), frames[0].line)
+								} else {
+									prefix = "warning: "
+								}
+							}
+						}
+					}
+					// Warning.warn gets the messages as one string
 					if len(args) > 0 {
-						if c, ok := args[0].(*object.Integer); ok {
-							code = int(c.Value)
+						if err := emitWarning(warningText(prefix, args), category, env); err != nil {
+							return err
 						}
 					}
-					os.Exit(code)
 					return object.NIL
 				},
 			},
+			"caller": {
+				Name: "caller",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					start, length, err := callerArgs(args)
+					if err != nil {
+						return err
+					}
+					frames := backtraceFrames(start, length)
+					elements := make([]object.Object, len(frames))
+					for i, frame := range frames {
+						elements[i] = &object.String{Value: frameString(frame)}
+					}
+					return &object.Array{Elements: elements}
+				},
+			},
+			"caller_locations": {
+				Name: "caller_locations",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					start, length, err := callerArgs(args)
+					if err != nil {
+						return err
+					}
+					return callerLocations(backtraceFrames(start, length))
+				},
+			},
+			"fork": {
+				Name: "fork",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return newError("NotImplementedError: fork() function is unimplemented on this machine")
+				},
+			},
+			"exec": {
+				Name:   "exec",
+				Params: []string{"rest"},
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return execCommand(args)
+				},
+			},
+			"system": {
+				Name:   "system",
+				Params: []string{"rest"},
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return runSystem(args)
+				},
+			},
+			"`": {
+				Name:   "`",
+				Params: []string{"req"},
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) != 1 {
+						return newError("wrong number of arguments (given %d, expected 1)", len(args))
+					}
+					command, ok := args[0].(*object.String)
+					if !ok {
+						return newError("TypeError: no implicit conversion of %s into String", comparisonOperandName(args[0]))
+					}
+					return runBacktick(command.Value)
+				},
+			},
+			"spawn": {
+				Name:   "spawn",
+				Params: []string{"rest"},
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return ProcessModule.Methods["spawn"].(*object.Builtin).Fn(receiver, env, args...)
+				},
+			},
 			"sleep": {
 				Name: "sleep",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.Integer{Value: 0}
+					return interruptibleSleep(args)
 				},
 			},
 			"rand": {
 				Name: "rand",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.Float{Value: 0.5}
+					return randomValue(globalRandom, args)
+				},
+			},
+			"Array": {
+				Name: "Array",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+					}
+					switch arg := args[0].(type) {
+					case *object.Nil:
+						return &object.Array{Elements: []object.Object{}}
+					case *object.Array:
+						return arg
+					case *object.Range:
+						return &object.Array{Elements: expandRange(arg)}
+					case *object.Hash:
+						elements := make([]object.Object, 0, len(arg.Order))
+						for _, key := range arg.Order {
+							pair := arg.Pairs[key]
+							elements = append(elements, &object.Array{Elements: []object.Object{pair.Key, pair.Value}})
+						}
+						return &object.Array{Elements: elements}
+					}
+					return &object.Array{Elements: []object.Object{args[0]}}
+				},
+			},
+			"srand": {
+				Name: "srand",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return reseedGlobalRandom(args)
 				},
 			},
 			"lambda": {
@@ -670,6 +975,7 @@ func getKernelBuiltins() map[string]*object.Builtin {
 						Parameters: block.Parameters,
 						Body:       block.Body,
 						Env:        block.Env,
+						Native:     block.Native,
 					}
 				},
 			},
@@ -686,7 +992,9 @@ func getKernelBuiltins() map[string]*object.Builtin {
 			"block_given?": {
 				Name: "block_given?",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return object.NativeToBool(env.Block() != nil)
+					// env is this call's own frame; the block belongs to the caller
+					caller := env.Outer()
+					return object.NativeToBool(caller != nil && caller.Block() != nil)
 				},
 			},
 			"loop": {
@@ -701,7 +1009,11 @@ func getKernelBuiltins() map[string]*object.Builtin {
 						if _, ok := result.(*object.BreakValue); ok {
 							return object.NIL
 						}
-						if isError(result) {
+						if err, ok := result.(*object.Error); ok {
+							// StopIteration, as from an exhausted enumerator, ends the loop
+							if errorIsA(err, StopIterationClass, env) {
+								return object.NIL
+							}
 							return result
 						}
 					}
@@ -802,12 +1114,13 @@ func getIntegerBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"times": {
-				Name: "times",
+				Name:   "times",
+				Params: []string{},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					n := receiver.(*object.Integer).Value
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "times", args)
 					}
 					for i := int64(0); i < n; i++ {
 						result := callBlock(block, []object.Object{&object.Integer{Value: i}}, env)
@@ -834,7 +1147,7 @@ func getIntegerBuiltins() map[string]*object.Builtin {
 					}
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "upto", args)
 					}
 					for i := start; i <= end.Value; i++ {
 						result := callBlock(block, []object.Object{&object.Integer{Value: i}}, env)
@@ -861,7 +1174,7 @@ func getIntegerBuiltins() map[string]*object.Builtin {
 					}
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "downto", args)
 					}
 					for i := start; i >= end.Value; i-- {
 						result := callBlock(block, []object.Object{&object.Integer{Value: i}}, env)
@@ -905,6 +1218,12 @@ func getIntegerBuiltins() map[string]*object.Builtin {
 					return object.NativeToBool(receiver.(*object.Integer).Value < 0)
 				},
 			},
+			"clamp": {
+				Name: "clamp",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return clampNumber(receiver, args)
+				},
+			},
 		}
 	})
 	return integerBuiltinsMap
@@ -982,6 +1301,12 @@ func getFloatBuiltins() map[string]*object.Builtin {
 					return object.NIL
 				},
 			},
+			"clamp": {
+				Name: "clamp",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return clampNumber(receiver, args)
+				},
+			},
 		}
 	})
 	return floatBuiltinsMap
@@ -1076,7 +1401,8 @@ func getStringBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"split": {
-				Name: "split",
+				Name:   "split",
+				Params: []string{"opt", "opt"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					s := receiver.(*object.String).Value
 					sep := " "
@@ -1094,7 +1420,8 @@ func getStringBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"include?": {
-				Name: "include?",
+				Name:   "include?",
+				Params: []string{"req"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					if len(args) < 1 {
 						return newError("wrong number of arguments (given 0, expected 1)")
@@ -1107,7 +1434,8 @@ func getStringBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"start_with?": {
-				Name: "start_with?",
+				Name:   "start_with?",
+				Params: []string{"rest"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					s := receiver.(*object.String).Value
 					for _, arg := range args {
@@ -1121,7 +1449,8 @@ func getStringBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"end_with?": {
-				Name: "end_with?",
+				Name:   "end_with?",
+				Params: []string{"rest"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					s := receiver.(*object.String).Value
 					for _, arg := range args {
@@ -1152,7 +1481,8 @@ func getStringBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"gsub": {
-				Name: "gsub",
+				Name:   "gsub",
+				Params: []string{"req", "opt"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					if len(args) < 2 {
 						return newError("wrong number of arguments (given %d, expected 2)", len(args))
@@ -1179,7 +1509,8 @@ func getStringBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"sub": {
-				Name: "sub",
+				Name:   "sub",
+				Params: []string{"req", "opt"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					if len(args) < 2 {
 						return newError("wrong number of arguments (given %d, expected 2)", len(args))
@@ -1358,7 +1689,8 @@ func getStringBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"chars": {
-				Name: "chars",
+				Name:   "chars",
+				Params: []string{},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					s := receiver.(*object.String).Value
 					chars := make([]object.Object, 0, len(s))
@@ -1385,7 +1717,7 @@ func getStringBuiltins() map[string]*object.Builtin {
 					s := receiver.(*object.String).Value
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "each_char", args)
 					}
 					for _, c := range s {
 						result := callBlock(block, []object.Object{&object.String{Value: string(c)}}, env)
@@ -1399,6 +1731,43 @@ func getStringBuiltins() map[string]*object.Builtin {
 					return receiver
 				},
 			},
+			"succ": {
+				Name: "succ",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.String{Value: stringSucc(receiver.(*object.String).Value)}
+				},
+			},
+			"next": {
+				Name: "next",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.String{Value: stringSucc(receiver.(*object.String).Value)}
+				},
+			},
+			"parse_csv": {
+				Name: "parse_csv",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return CSVClass.ClassMethods["parse_line"].(*object.Builtin).Fn(CSVClass, env, append([]object.Object{receiver}, args...)...)
+				},
+			},
+			"freeze": {
+				Name: "freeze",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					receiver.(*object.String).Frozen = true
+					return receiver
+				},
+			},
+			"frozen?": {
+				Name: "frozen?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return object.NativeToBool(receiver.(*object.String).Frozen)
+				},
+			},
+			"dup": {
+				Name: "dup",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.String{Value: receiver.(*object.String).Value}
+				},
+			},
 		}
 	})
 	return stringBuiltinsMap
@@ -1420,7 +1789,8 @@ func getArrayBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"first": {
-				Name: "first",
+				Name:   "first",
+				Params: []string{"opt"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					arr := receiver.(*object.Array)
 					if len(arr.Elements) == 0 {
@@ -1437,7 +1807,8 @@ func getArrayBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"last": {
-				Name: "last",
+				Name:   "last",
+				Params: []string{"opt"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					arr := receiver.(*object.Array)
 					if len(arr.Elements) == 0 {
@@ -1454,7 +1825,8 @@ func getArrayBuiltins() map[string]*object.Builtin {
 				},
 			},
 			"push": {
-				Name: "push",
+				Name:   "push",
+				Params: []string{"rest"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					arr := receiver.(*object.Array)
 					arr.Elements = append(arr.Elements, args...)
@@ -1511,18 +1883,15 @@ func getArrayBuiltins() map[string]*object.Builtin {
 					arr := receiver.(*object.Array)
 					newElements := make([]object.Object, len(arr.Elements))
 					copy(newElements, arr.Elements)
-					sort.Slice(newElements, func(i, j int) bool {
-						result := evalInfixExpression("<=>", newElements[i], newElements[j])
-						if intResult, ok := result.(*object.Integer); ok {
-							return intResult.Value < 0
-						}
-						return false
-					})
+					if err := sortObjects(newElements, env.Block(), env); err != nil {
+						return err
+					}
 					return &object.Array{Elements: newElements}
 				},
 			},
 			"join": {
-				Name: "join",
+				Name:   "join",
+				Params: []string{"opt"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					arr := receiver.(*object.Array)
 					sep := ""
@@ -1531,15 +1900,12 @@ func getArrayBuiltins() map[string]*object.Builtin {
 							sep = s.Value
 						}
 					}
-					parts := make([]string, len(arr.Elements))
-					for i, elem := range arr.Elements {
-						parts[i] = objectToString(elem)
-					}
-					return &object.String{Value: strings.Join(parts, sep)}
+					return joinArray(arr, sep)
 				},
 			},
 			"include?": {
-				Name: "include?",
+				Name:   "include?",
+				Params: []string{"req"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					if len(args) < 1 {
 						return newError("wrong number of arguments (given 0, expected 1)")
@@ -1556,16 +1922,7 @@ func getArrayBuiltins() map[string]*object.Builtin {
 			"index": {
 				Name: "index",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					if len(args) < 1 {
-						return newError("wrong number of arguments (given 0, expected 1)")
-					}
-					arr := receiver.(*object.Array)
-					for i, elem := range arr.Elements {
-						if objectsEqual(elem, args[0]) {
-							return &object.Integer{Value: int64(i)}
-						}
-					}
-					return object.NIL
+					return findArrayIndex(receiver.(*object.Array), args, env)
 				},
 			},
 			"empty?": {
@@ -1580,7 +1937,7 @@ func getArrayBuiltins() map[string]*object.Builtin {
 					arr := receiver.(*object.Array)
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "each", args)
 					}
 					for _, elem := range arr.Elements {
 						result := callBlock(block, []object.Object{elem}, env)
@@ -1600,7 +1957,7 @@ func getArrayBuiltins() map[string]*object.Builtin {
 					arr := receiver.(*object.Array)
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "each_with_index", args)
 					}
 					for i, elem := range arr.Elements {
 						result := callBlock(block, []object.Object{elem, &object.Integer{Value: int64(i)}}, env)
@@ -1620,7 +1977,7 @@ func getArrayBuiltins() map[string]*object.Builtin {
 					arr := receiver.(*object.Array)
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "map", args)
 					}
 					newElements := make([]object.Object, 0, len(arr.Elements))
 					for _, elem := range arr.Elements {
@@ -1643,7 +2000,7 @@ func getArrayBuiltins() map[string]*object.Builtin {
 					arr := receiver.(*object.Array)
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "collect", args)
 					}
 					newElements := make([]object.Object, 0, len(arr.Elements))
 					for _, elem := range arr.Elements {
@@ -1665,7 +2022,7 @@ func getArrayBuiltins() map[string]*object.Builtin {
 					arr := receiver.(*object.Array)
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "select", args)
 					}
 					newElements := make([]object.Object, 0)
 					for _, elem := range arr.Elements {
@@ -1689,7 +2046,7 @@ func getArrayBuiltins() map[string]*object.Builtin {
 					arr := receiver.(*object.Array)
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "reject", args)
 					}
 					newElements := make([]object.Object, 0)
 					for _, elem := range arr.Elements {
@@ -1746,7 +2103,7 @@ func getArrayBuiltins() map[string]*object.Builtin {
 					arr := receiver.(*object.Array)
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "find", args)
 					}
 					for _, elem := range arr.Elements {
 						result := callBlock(block, []object.Object{elem}, env)
@@ -1851,14 +2208,9 @@ func getArrayBuiltins() map[string]*object.Builtin {
 				Name: "uniq",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					arr := receiver.(*object.Array)
-					seen := make(map[string]bool)
-					newElements := make([]object.Object, 0)
-					for _, elem := range arr.Elements {
-						key := elem.Inspect()
-						if !seen[key] {
-							seen[key] = true
-							newElements = append(newElements, elem)
-						}
+					newElements, stop := uniqObjects(arr.Elements, env.Block(), env)
+					if stop != nil {
+						return stop
 					}
 					return &object.Array{Elements: newElements}
 				},
@@ -1872,7 +2224,12 @@ func getArrayBuiltins() map[string]*object.Builtin {
 			"to_s": {
 				Name: "to_s",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.String{Value: receiver.Inspect()}
+					// Elements are shown with their own inspect methods
+					str, err := inspectValue(receiver)
+					if err != nil {
+						return err
+					}
+					return &object.String{Value: str}
 				},
 			},
 			"to_enum": {
@@ -1929,360 +2286,419 @@ func getArrayBuiltins() map[string]*object.Builtin {
 					}
 				},
 			},
-		}
-	})
-	return arrayBuiltinsMap
-}
-
-func getHashBuiltins() map[string]*object.Builtin {
-	hashBuiltinsOnce.Do(func() {
-		hashBuiltinsMap = map[string]*object.Builtin{
-			"keys": {
-				Name: "keys",
+			"map!": {
+				Name: "map!",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					hash := receiver.(*object.Hash)
-					keys := make([]object.Object, 0, len(hash.Pairs))
-					for _, key := range hash.Order {
-						keys = append(keys, hash.Pairs[key].Key)
+					arr := receiver.(*object.Array)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "map!", args)
 					}
-					return &object.Array{Elements: keys}
+					for i, elem := range arr.Elements {
+						result := callBlock(block, []object.Object{elem}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+						arr.Elements[i] = result
+					}
+					return arr
 				},
 			},
-			"values": {
-				Name: "values",
+			"select!": {
+				Name: "select!",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					hash := receiver.(*object.Hash)
-					values := make([]object.Object, 0, len(hash.Pairs))
-					for _, key := range hash.Order {
-						values = append(values, hash.Pairs[key].Value)
-					}
-					return &object.Array{Elements: values}
+					return filterArrayInPlace(receiver.(*object.Array), env, true)
 				},
 			},
-			"length": {
-				Name: "length",
+			"filter!": {
+				Name: "filter!",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.Integer{Value: int64(len(receiver.(*object.Hash).Pairs))}
+					return filterArrayInPlace(receiver.(*object.Array), env, true)
 				},
 			},
-			"size": {
-				Name: "size",
+			"reject!": {
+				Name: "reject!",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.Integer{Value: int64(len(receiver.(*object.Hash).Pairs))}
+					return filterArrayInPlace(receiver.(*object.Array), env, false)
 				},
 			},
-			"empty?": {
-				Name: "empty?",
+			"sort!": {
+				Name: "sort!",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return object.NativeToBool(len(receiver.(*object.Hash).Pairs) == 0)
+					arr := receiver.(*object.Array)
+					newElements := make([]object.Object, len(arr.Elements))
+					copy(newElements, arr.Elements)
+					if err := sortObjects(newElements, env.Block(), env); err != nil {
+						return err
+					}
+					arr.Elements = newElements
+					return arr
 				},
 			},
-			"has_key?": {
-				Name: "has_key?",
+			"sort_by!": {
+				Name: "sort_by!",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					if len(args) < 1 {
-						return newError("wrong number of arguments (given 0, expected 1)")
+					arr := receiver.(*object.Array)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "sort_by!", args)
 					}
-					hash := receiver.(*object.Hash)
-					key, ok := args[0].(object.Hashable)
-					if !ok {
-						return object.FALSE
+					keys, stop := blockKeys(block, arr.Elements, env)
+					if stop != nil {
+						return stop
 					}
-					_, exists := hash.Pairs[key.HashKey()]
-					return object.NativeToBool(exists)
+					sorted, err := sortObjectsByKeys(arr.Elements, keys)
+					if err != nil {
+						return err
+					}
+					arr.Elements = sorted
+					return arr
 				},
 			},
-			"has_value?": {
-				Name: "has_value?",
+			"uniq!": {
+				Name: "uniq!",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					if len(args) < 1 {
-						return newError("wrong number of arguments (given 0, expected 1)")
+					arr := receiver.(*object.Array)
+					newElements, stop := uniqObjects(arr.Elements, env.Block(), env)
+					if stop != nil {
+						return stop
 					}
-					hash := receiver.(*object.Hash)
-					for _, pair := range hash.Pairs {
-						if objectsEqual(pair.Value, args[0]) {
-							return object.TRUE
+					if len(newElements) == len(arr.Elements) {
+						return object.NIL
+					}
+					arr.Elements = newElements
+					return arr
+				},
+			},
+			"compact!": {
+				Name: "compact!",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					arr := receiver.(*object.Array)
+					newElements := make([]object.Object, 0, len(arr.Elements))
+					for _, elem := range arr.Elements {
+						if elem.Type() != object.NIL_OBJ {
+							newElements = append(newElements, elem)
 						}
 					}
-					return object.FALSE
+					if len(newElements) == len(arr.Elements) {
+						return object.NIL
+					}
+					arr.Elements = newElements
+					return arr
 				},
 			},
-			"each": {
-				Name: "each",
+			"reverse!": {
+				Name: "reverse!",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					hash := receiver.(*object.Hash)
-					block := env.Block()
-					if block == nil {
-						return receiver
+					arr := receiver.(*object.Array)
+					for i, j := 0, len(arr.Elements)-1; i < j; i, j = i+1, j-1 {
+						arr.Elements[i], arr.Elements[j] = arr.Elements[j], arr.Elements[i]
 					}
-					for _, key := range hash.Order {
-						pair := hash.Pairs[key]
-						result := callBlock(block, []object.Object{pair.Key, pair.Value}, env)
-						if bv, ok := result.(*object.BreakValue); ok {
-							return bv.Value
+					return arr
+				},
+			},
+			"flatten!": {
+				Name: "flatten!",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					arr := receiver.(*object.Array)
+					nested := false
+					for _, elem := range arr.Elements {
+						if _, ok := elem.(*object.Array); ok {
+							nested = true
+							break
 						}
-						if isError(result) {
-							return result
+					}
+					if !nested {
+						return object.NIL
+					}
+					arr.Elements = flattenArray(arr.Elements)
+					return arr
+				},
+			},
+			"shuffle!": {
+				Name: "shuffle!",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					arr := receiver.(*object.Array)
+					src, _ := randomOption(args)
+					shuffleObjects(src, arr.Elements)
+					return arr
+				},
+			},
+			"concat": {
+				Name: "concat",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					arr := receiver.(*object.Array)
+					var appended []object.Object
+					for _, arg := range args {
+						other, ok := arg.(*object.Array)
+						if !ok {
+							return newError("TypeError: no implicit conversion of %s into Array", arg.Class().Name)
 						}
+						appended = append(appended, other.Elements...)
 					}
-					return receiver
+					arr.Elements = append(arr.Elements, appended...)
+					return arr
 				},
 			},
-			"each_key": {
-				Name: "each_key",
+			"sort_by": {
+				Name: "sort_by",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					hash := receiver.(*object.Hash)
+					arr := receiver.(*object.Array)
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "sort_by", args)
 					}
-					for _, key := range hash.Order {
-						result := callBlock(block, []object.Object{hash.Pairs[key].Key}, env)
-						if bv, ok := result.(*object.BreakValue); ok {
-							return bv.Value
-						}
-						if isError(result) {
-							return result
-						}
+					keys, stop := blockKeys(block, arr.Elements, env)
+					if stop != nil {
+						return stop
 					}
-					return receiver
+					sorted, err := sortObjectsByKeys(arr.Elements, keys)
+					if err != nil {
+						return err
+					}
+					return &object.Array{Elements: sorted}
 				},
 			},
-			"each_value": {
-				Name: "each_value",
+			"min": {
+				Name: "min",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					hash := receiver.(*object.Hash)
-					block := env.Block()
-					if block == nil {
-						return receiver
+					arr := receiver.(*object.Array)
+					if block := env.Block(); block != nil {
+						return blockExtremes(arr.Elements, -1, args, block, env)
 					}
-					for _, key := range hash.Order {
-						result := callBlock(block, []object.Object{hash.Pairs[key].Value}, env)
-						if bv, ok := result.(*object.BreakValue); ok {
-							return bv.Value
-						}
-						if isError(result) {
-							return result
-						}
+					return arrayExtremes(arr.Elements, nil, -1, args)
+				},
+			},
+			"max": {
+				Name: "max",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					arr := receiver.(*object.Array)
+					if block := env.Block(); block != nil {
+						return blockExtremes(arr.Elements, 1, args, block, env)
 					}
-					return receiver
+					return arrayExtremes(arr.Elements, nil, 1, args)
 				},
 			},
-			"map": {
-				Name: "map",
+			"min_by": {
+				Name: "min_by",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					hash := receiver.(*object.Hash)
+					arr := receiver.(*object.Array)
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "min_by", args)
 					}
-					newElements := make([]object.Object, 0, len(hash.Pairs))
-					for _, key := range hash.Order {
-						pair := hash.Pairs[key]
-						result := callBlock(block, []object.Object{pair.Key, pair.Value}, env)
-						if bv, ok := result.(*object.BreakValue); ok {
-							return bv.Value
-						}
-						if isError(result) {
-							return result
-						}
-						newElements = append(newElements, result)
+					keys, stop := blockKeys(block, arr.Elements, env)
+					if stop != nil {
+						return stop
 					}
-					return &object.Array{Elements: newElements}
+					return arrayExtremes(arr.Elements, keys, -1, args)
 				},
 			},
-			"select": {
-				Name: "select",
+			"max_by": {
+				Name: "max_by",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					hash := receiver.(*object.Hash)
+					arr := receiver.(*object.Array)
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "max_by", args)
 					}
-					newPairs := make(map[object.HashKey]object.HashPair)
-					newOrder := make([]object.HashKey, 0)
-					for _, key := range hash.Order {
-						pair := hash.Pairs[key]
-						result := callBlock(block, []object.Object{pair.Key, pair.Value}, env)
-						if bv, ok := result.(*object.BreakValue); ok {
-							return bv.Value
-						}
-						if isError(result) {
-							return result
-						}
-						if isTruthy(result) {
-							newPairs[key] = pair
-							newOrder = append(newOrder, key)
-						}
+					keys, stop := blockKeys(block, arr.Elements, env)
+					if stop != nil {
+						return stop
 					}
-					return &object.Hash{Pairs: newPairs, Order: newOrder}
+					return arrayExtremes(arr.Elements, keys, 1, args)
 				},
 			},
-			"merge": {
-				Name: "merge",
+			"minmax": {
+				Name: "minmax",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					hash := receiver.(*object.Hash)
-					newPairs := make(map[object.HashKey]object.HashPair)
-					newOrder := make([]object.HashKey, 0, len(hash.Pairs))
-
-					for _, key := range hash.Order {
-						newPairs[key] = hash.Pairs[key]
-						newOrder = append(newOrder, key)
-					}
-
-					for _, arg := range args {
-						if other, ok := arg.(*object.Hash); ok {
-							for _, key := range other.Order {
-								if _, exists := newPairs[key]; !exists {
-									newOrder = append(newOrder, key)
-								}
-								newPairs[key] = other.Pairs[key]
-							}
+					arr := receiver.(*object.Array)
+					var min, max object.Object
+					if block := env.Block(); block != nil {
+						min = blockExtremes(arr.Elements, -1, nil, block, env)
+						if isError(min) {
+							return min
+						}
+						max = blockExtremes(arr.Elements, 1, nil, block, env)
+					} else {
+						min = arrayExtremes(arr.Elements, nil, -1, nil)
+						if isError(min) {
+							return min
 						}
+						max = arrayExtremes(arr.Elements, nil, 1, nil)
 					}
-
-					return &object.Hash{Pairs: newPairs, Order: newOrder}
+					if isError(max) {
+						return max
+					}
+					return &object.Array{Elements: []object.Object{min, max}}
 				},
 			},
-			"to_a": {
-				Name: "to_a",
+			"sum": {
+				Name: "sum",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					hash := receiver.(*object.Hash)
-					elements := make([]object.Object, 0, len(hash.Pairs))
-					for _, key := range hash.Order {
-						pair := hash.Pairs[key]
-						elements = append(elements, &object.Array{Elements: []object.Object{pair.Key, pair.Value}})
+					arr := receiver.(*object.Array)
+					var init object.Object = &object.Integer{Value: 0}
+					if len(args) > 0 {
+						init = args[0]
 					}
-					return &object.Array{Elements: elements}
+					values := arr.Elements
+					if block := env.Block(); block != nil {
+						keys, stop := blockKeys(block, arr.Elements, env)
+						if stop != nil {
+							return stop
+						}
+						values = keys
+					}
+					return sumObjects(init, values)
 				},
 			},
-			"to_h": {
-				Name: "to_h",
+			"zip": {
+				Name: "zip",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return receiver
+					arr := receiver.(*object.Array)
+					lists, err := arrayArguments(args)
+					if err != nil {
+						return err
+					}
+					tuples := make([]object.Object, len(arr.Elements))
+					for i, elem := range arr.Elements {
+						tuple := []object.Object{elem}
+						for _, list := range lists {
+							if i < len(list) {
+								tuple = append(tuple, list[i])
+							} else {
+								tuple = append(tuple, object.NIL)
+							}
+						}
+						tuples[i] = &object.Array{Elements: tuple}
+					}
+					if block := env.Block(); block != nil {
+						if stop := yieldValues(block, tuples, env); stop != nil {
+							return stop
+						}
+						return object.NIL
+					}
+					return &object.Array{Elements: tuples}
 				},
 			},
-			"to_s": {
-				Name: "to_s",
+			"product": {
+				Name: "product",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.String{Value: receiver.Inspect()}
+					arr := receiver.(*object.Array)
+					lists, err := arrayArguments(args)
+					if err != nil {
+						return err
+					}
+					lists = append([][]object.Object{arr.Elements}, lists...)
+					tuples := cartesianProduct(lists)
+					if block := env.Block(); block != nil {
+						if stop := yieldValues(block, tuples, env); stop != nil {
+							return stop
+						}
+						return arr
+					}
+					return &object.Array{Elements: tuples}
 				},
 			},
-			"delete": {
-				Name: "delete",
+			"combination": {
+				Name: "combination",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					if len(args) < 1 {
-						return newError("wrong number of arguments (given 0, expected 1)")
+					arr := receiver.(*object.Array)
+					if len(args) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
 					}
-					hash := receiver.(*object.Hash)
-					key, ok := args[0].(object.Hashable)
+					n, ok := args[0].(*object.Integer)
 					if !ok {
-						return object.NIL
+						return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
 					}
-					hashed := key.HashKey()
-					pair, exists := hash.Pairs[hashed]
-					if !exists {
-						return object.NIL
+					combos := combinations(arr.Elements, int(n.Value))
+					block := env.Block()
+					if block == nil {
+						return &object.Enumerator{Object: receiver, Method: "combination", Args: args, Values: combos}
 					}
-					delete(hash.Pairs, hashed)
-					for i, k := range hash.Order {
-						if k == hashed {
-							hash.Order = append(hash.Order[:i], hash.Order[i+1:]...)
-							break
-						}
+					if stop := yieldValues(block, combos, env); stop != nil {
+						return stop
 					}
-					return pair.Value
+					return arr
 				},
 			},
-			"fetch": {
-				Name: "fetch",
+			"permutation": {
+				Name: "permutation",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					if len(args) < 1 {
-						return newError("wrong number of arguments (given 0, expected 1+)")
-					}
-					hash := receiver.(*object.Hash)
-					key, ok := args[0].(object.Hashable)
-					if !ok {
-						return newError("unusable as hash key: %s", args[0].Type())
+					arr := receiver.(*object.Array)
+					k := len(arr.Elements)
+					if len(args) > 0 {
+						n, ok := args[0].(*object.Integer)
+						if !ok {
+							return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+						}
+						k = int(n.Value)
 					}
-					if pair, exists := hash.Pairs[key.HashKey()]; exists {
-						return pair.Value
+					perms := permutations(arr.Elements, k)
+					block := env.Block()
+					if block == nil {
+						return &object.Enumerator{Object: receiver, Method: "permutation", Args: args, Values: perms}
 					}
-					if len(args) > 1 {
-						return args[1]
+					if stop := yieldValues(block, perms, env); stop != nil {
+						return stop
 					}
-					return newError("KeyError: key not found: %s", args[0].Inspect())
+					return arr
 				},
 			},
-			"to_enum": {
-				Name: "to_enum",
+			"transpose": {
+				Name: "transpose",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					method := "each"
-					var enumArgs []object.Object
-					if len(args) > 0 {
-						if sym, ok := args[0].(*object.Symbol); ok {
-							method = sym.Value
-						} else if str, ok := args[0].(*object.String); ok {
-							method = str.Value
+					arr := receiver.(*object.Array)
+					if len(arr.Elements) == 0 {
+						return &object.Array{Elements: []object.Object{}}
+					}
+					rows := make([][]object.Object, len(arr.Elements))
+					for i, elem := range arr.Elements {
+						row, ok := elem.(*object.Array)
+						if !ok {
+							return newError("TypeError: no implicit conversion of %s into Array", comparisonOperandName(elem))
 						}
-						if len(args) > 1 {
-							enumArgs = args[1:]
+						if i > 0 && len(row.Elements) != len(rows[0]) {
+							return newError("IndexError: element size differs (%d should be %d)", len(row.Elements), len(rows[0]))
 						}
+						rows[i] = row.Elements
 					}
-					return &object.Enumerator{
-						Object: receiver,
-						Method: method,
-						Args:   enumArgs,
+					columns := make([]object.Object, len(rows[0]))
+					for c := range columns {
+						column := make([]object.Object, len(rows))
+						for r, row := range rows {
+							column[r] = row[c]
+						}
+						columns[c] = &object.Array{Elements: column}
 					}
+					return &object.Array{Elements: columns}
 				},
 			},
-			"enum_for": {
-				Name: "enum_for",
+			"flat_map": {
+				Name: "flat_map",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					method := "each"
-					var enumArgs []object.Object
-					if len(args) > 0 {
-						if sym, ok := args[0].(*object.Symbol); ok {
-							method = sym.Value
-						} else if str, ok := args[0].(*object.String); ok {
-							method = str.Value
-						}
-						if len(args) > 1 {
-							enumArgs = args[1:]
-						}
-					}
-					return &object.Enumerator{
-						Object: receiver,
-						Method: method,
-						Args:   enumArgs,
-					}
+					return flatMapArray(receiver.(*object.Array), env)
 				},
 			},
-		}
-	})
-	return hashBuiltinsMap
-}
-
-func getRangeBuiltins() map[string]*object.Builtin {
-	rangeBuiltinsOnce.Do(func() {
-		rangeBuiltinsMap = map[string]*object.Builtin{
-			"to_a": {
-				Name: "to_a",
+			"collect_concat": {
+				Name: "collect_concat",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					r := receiver.(*object.Range)
-					return &object.Array{Elements: expandRange(r)}
+					return flatMapArray(receiver.(*object.Array), env)
 				},
 			},
-			"each": {
-				Name: "each",
+			"filter_map": {
+				Name: "filter_map",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					r := receiver.(*object.Range)
+					arr := receiver.(*object.Array)
 					block := env.Block()
 					if block == nil {
-						return receiver
+						return newEnumerator(receiver, "filter_map", args)
 					}
-					elements := expandRange(r)
-					for _, elem := range elements {
+					newElements := make([]object.Object, 0)
+					for _, elem := range arr.Elements {
 						result := callBlock(block, []object.Object{elem}, env)
 						if bv, ok := result.(*object.BreakValue); ok {
 							return bv.Value
@@ -2290,521 +2706,3778 @@ func getRangeBuiltins() map[string]*object.Builtin {
 						if isError(result) {
 							return result
 						}
+						if isTruthy(result) {
+							newElements = append(newElements, result)
+						}
 					}
-					return receiver
+					return &object.Array{Elements: newElements}
 				},
 			},
-			"include?": {
-				Name: "include?",
+			"group_by": {
+				Name: "group_by",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					if len(args) < 1 {
-						return newError("wrong number of arguments (given 0, expected 1)")
+					arr := receiver.(*object.Array)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "group_by", args)
 					}
-					r := receiver.(*object.Range)
-					return evalRangeIncludes(r, args[0])
-				},
-			},
-			"first": {
-				Name: "first",
-				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					r := receiver.(*object.Range)
-					return r.Start
-				},
-			},
-			"last": {
-				Name: "last",
-				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					r := receiver.(*object.Range)
-					return r.End
+					groups := newHash()
+					for _, elem := range arr.Elements {
+						key := callBlock(block, []object.Object{elem}, env)
+						if bv, ok := key.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(key) {
+							return key
+						}
+						group, ok := hashGet(groups, key)
+						if !ok {
+							group = &object.Array{Elements: []object.Object{}}
+							if err := hashSet(groups, key, group); err != nil {
+								return err
+							}
+						}
+						group.(*object.Array).Elements = append(group.(*object.Array).Elements, elem)
+					}
+					return groups
 				},
 			},
-			"size": {
-				Name: "size",
+			"partition": {
+				Name: "partition",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					r := receiver.(*object.Range)
-					startInt, ok1 := r.Start.(*object.Integer)
-					endInt, ok2 := r.End.(*object.Integer)
-					if !ok1 || !ok2 {
-						return object.NIL
-					}
-					size := endInt.Value - startInt.Value
-					if !r.Exclusive {
-						size++
+					arr := receiver.(*object.Array)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "partition", args)
 					}
-					if size < 0 {
-						size = 0
+					selected := make([]object.Object, 0)
+					rejected := make([]object.Object, 0)
+					for _, elem := range arr.Elements {
+						result := callBlock(block, []object.Object{elem}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+						if isTruthy(result) {
+							selected = append(selected, elem)
+						} else {
+							rejected = append(rejected, elem)
+						}
 					}
-					return &object.Integer{Value: size}
+					return &object.Array{Elements: []object.Object{
+						&object.Array{Elements: selected},
+						&object.Array{Elements: rejected},
+					}}
 				},
 			},
-			"to_enum": {
-				Name: "to_enum",
+			"tally": {
+				Name: "tally",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					method := "each"
-					var enumArgs []object.Object
-					if len(args) > 0 {
-						if sym, ok := args[0].(*object.Symbol); ok {
-							method = sym.Value
-						} else if str, ok := args[0].(*object.String); ok {
-							method = str.Value
+					arr := receiver.(*object.Array)
+					counts := newHash()
+					for _, elem := range arr.Elements {
+						var count int64
+						if existing, ok := hashGet(counts, elem); ok {
+							count = existing.(*object.Integer).Value
 						}
-						if len(args) > 1 {
-							enumArgs = args[1:]
+						if err := hashSet(counts, elem, &object.Integer{Value: count + 1}); err != nil {
+							return err
 						}
 					}
-					return &object.Enumerator{
-						Object: receiver,
-						Method: method,
-						Args:   enumArgs,
-					}
+					return counts
 				},
 			},
-			"enum_for": {
-				Name: "enum_for",
+			"each_with_object": {
+				Name: "each_with_object",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					method := "each"
-					var enumArgs []object.Object
-					if len(args) > 0 {
-						if sym, ok := args[0].(*object.Symbol); ok {
-							method = sym.Value
-						} else if str, ok := args[0].(*object.String); ok {
-							method = str.Value
+					if len(args) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+					}
+					arr := receiver.(*object.Array)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "each_with_object", args)
+					}
+					memo := args[0]
+					for _, elem := range arr.Elements {
+						result := callBlock(block, []object.Object{elem, memo}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
 						}
-						if len(args) > 1 {
-							enumArgs = args[1:]
+						if isError(result) {
+							return result
 						}
 					}
-					return &object.Enumerator{
-						Object: receiver,
-						Method: method,
-						Args:   enumArgs,
-					}
+					return memo
 				},
 			},
-			"lazy": {
-				Name: "lazy",
+			"chunk_while": {
+				Name: "chunk_while",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.Enumerator{
-						Object: receiver,
-						Method: "each",
-						Lazy:   true,
-					}
+					return sliceArrayBetween(receiver.(*object.Array), env, false)
 				},
 			},
-		}
-	})
-	return rangeBuiltinsMap
-}
-
-func getSymbolBuiltins() map[string]*object.Builtin {
-	symbolBuiltinsOnce.Do(func() {
-		symbolBuiltinsMap = map[string]*object.Builtin{
-			"to_s": {
-				Name: "to_s",
+			"slice_when": {
+				Name: "slice_when",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.String{Value: receiver.(*object.Symbol).Value}
+					return sliceArrayBetween(receiver.(*object.Array), env, true)
 				},
 			},
-			"to_sym": {
-				Name: "to_sym",
+			"take": {
+				Name: "take",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return receiver
+					arr := receiver.(*object.Array)
+					n, err := countArgument(args, "take")
+					if err != nil {
+						return err
+					}
+					if n > len(arr.Elements) {
+						n = len(arr.Elements)
+					}
+					newElements := make([]object.Object, n)
+					copy(newElements, arr.Elements[:n])
+					return &object.Array{Elements: newElements}
 				},
 			},
-			"upcase": {
-				Name: "upcase",
+			"drop": {
+				Name: "drop",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.Symbol{Value: strings.ToUpper(receiver.(*object.Symbol).Value)}
+					arr := receiver.(*object.Array)
+					n, err := countArgument(args, "drop")
+					if err != nil {
+						return err
+					}
+					if n > len(arr.Elements) {
+						n = len(arr.Elements)
+					}
+					newElements := make([]object.Object, len(arr.Elements)-n)
+					copy(newElements, arr.Elements[n:])
+					return &object.Array{Elements: newElements}
 				},
 			},
-			"downcase": {
-				Name: "downcase",
+			"take_while": {
+				Name: "take_while",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.Symbol{Value: strings.ToLower(receiver.(*object.Symbol).Value)}
+					arr := receiver.(*object.Array)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "take_while", args)
+					}
+					n, stop := countWhile(block, arr.Elements, env)
+					if stop != nil {
+						return stop
+					}
+					newElements := make([]object.Object, n)
+					copy(newElements, arr.Elements[:n])
+					return &object.Array{Elements: newElements}
 				},
 			},
-			"length": {
-				Name: "length",
+			"drop_while": {
+				Name: "drop_while",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.Integer{Value: int64(len(receiver.(*object.Symbol).Value))}
+					arr := receiver.(*object.Array)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "drop_while", args)
+					}
+					n, stop := countWhile(block, arr.Elements, env)
+					if stop != nil {
+						return stop
+					}
+					newElements := make([]object.Object, len(arr.Elements)-n)
+					copy(newElements, arr.Elements[n:])
+					return &object.Array{Elements: newElements}
 				},
 			},
-			"size": {
-				Name: "size",
+			"rotate": {
+				Name: "rotate",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.Integer{Value: int64(len(receiver.(*object.Symbol).Value))}
+					arr := receiver.(*object.Array)
+					rotated, err := rotateObjects(arr.Elements, args)
+					if err != nil {
+						return err
+					}
+					return &object.Array{Elements: rotated}
 				},
 			},
-			"empty?": {
-				Name: "empty?",
+			"rotate!": {
+				Name: "rotate!",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return object.NativeToBool(len(receiver.(*object.Symbol).Value) == 0)
+					arr := receiver.(*object.Array)
+					rotated, err := rotateObjects(arr.Elements, args)
+					if err != nil {
+						return err
+					}
+					arr.Elements = rotated
+					return arr
 				},
 			},
-		}
-	})
-	return symbolBuiltinsMap
-}
-
-func getNilBuiltins() map[string]*object.Builtin {
-	nilBuiltinsOnce.Do(func() {
-		nilBuiltinsMap = map[string]*object.Builtin{
-			"to_s": {
-				Name: "to_s",
+			"shuffle": {
+				Name: "shuffle",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.String{Value: ""}
+					arr := receiver.(*object.Array)
+					src, _ := randomOption(args)
+					elements := make([]object.Object, len(arr.Elements))
+					copy(elements, arr.Elements)
+					shuffleObjects(src, elements)
+					return &object.Array{Elements: elements}
 				},
 			},
-			"to_a": {
-				Name: "to_a",
+			"sample": {
+				Name: "sample",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.Array{Elements: []object.Object{}}
+					arr := receiver.(*object.Array)
+					src, args := randomOption(args)
+					elements := make([]object.Object, len(arr.Elements))
+					copy(elements, arr.Elements)
+					shuffleObjects(src, elements)
+					if len(args) == 0 {
+						if len(elements) == 0 {
+							return object.NIL
+						}
+						return elements[0]
+					}
+					n, err := countArgument(args, "sample")
+					if err != nil {
+						return err
+					}
+					if n > len(elements) {
+						n = len(elements)
+					}
+					return &object.Array{Elements: elements[:n]}
 				},
 			},
-			"to_h": {
-				Name: "to_h",
+			"cycle": {
+				Name: "cycle",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.Hash{Pairs: make(map[object.HashKey]object.HashPair)}
+					arr := receiver.(*object.Array)
+					times := -1
+					if len(args) > 0 && args[0] != object.NIL {
+						n, ok := args[0].(*object.Integer)
+						if !ok {
+							return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+						}
+						times = int(n.Value)
+						if times < 0 {
+							times = 0
+						}
+					}
+
+					block := env.Block()
+					if block == nil {
+						if times < 0 {
+							enum := newEnumerator(arr, "cycle", nil)
+							enum.Generator = func(yield func(object.Object) bool) {
+								for len(arr.Elements) > 0 {
+									for _, elem := range arr.Elements {
+										if !yield(elem) {
+											return
+										}
+									}
+								}
+							}
+							return enum
+						}
+						var values []object.Object
+						for i := 0; i < times; i++ {
+							values = append(values, arr.Elements...)
+						}
+						return &object.Enumerator{Object: arr, Method: "cycle", Args: args, Values: values}
+					}
+
+					for i := 0; times < 0 || i < times; i++ {
+						if len(arr.Elements) == 0 {
+							break
+						}
+						for _, elem := range arr.Elements {
+							result := callBlock(block, []object.Object{elem}, env)
+							if bv, ok := result.(*object.BreakValue); ok {
+								return bv.Value
+							}
+							if isError(result) {
+								return result
+							}
+						}
+					}
+					return object.NIL
 				},
 			},
-			"nil?": {
-				Name: "nil?",
+			"dig": {
+				Name: "dig",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return object.TRUE
+					return digObject(receiver, args)
 				},
 			},
-			"inspect": {
-				Name: "inspect",
+			"values_at": {
+				Name: "values_at",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return &object.String{Value: "nil"}
-				},
-			},
-		}
-	})
-	return nilBuiltinsMap
-}
-
-func getBooleanBuiltins() map[string]*object.Builtin {
-	booleanBuiltinsOnce.Do(func() {
-		booleanBuiltinsMap = map[string]*object.Builtin{
-			"to_s": {
-				Name: "to_s",
+					arr := receiver.(*object.Array)
+					var values []object.Object
+					for _, arg := range args {
+						switch idx := arg.(type) {
+						case *object.Integer:
+							values = append(values, evalArrayIndex(arr, idx))
+						case *object.Range:
+							start, end, err := rangeBounds(idx, len(arr.Elements))
+							if err != nil {
+								return err
+							}
+							if start < 0 {
+								continue
+							}
+							for i := start; i < end; i++ {
+								values = append(values, evalArrayIndex(arr, &object.Integer{Value: int64(i)}))
+							}
+						default:
+							return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(arg))
+						}
+					}
+					return &object.Array{Elements: values}
+				},
+			},
+			"fill": {
+				Name: "fill",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					if receiver.(*object.Boolean).Value {
-						return &object.String{Value: "true"}
+					arr := receiver.(*object.Array)
+					block := env.Block()
+					var value object.Object
+					if block == nil {
+						if len(args) == 0 {
+							return newError("ArgumentError: wrong number of arguments (given 0, expected 1..3)")
+						}
+						value, args = args[0], args[1:]
 					}
-					return &object.String{Value: "false"}
+					start, end, err := fillBounds(args, len(arr.Elements))
+					if err != nil {
+						return err
+					}
+					for len(arr.Elements) < end {
+						arr.Elements = append(arr.Elements, object.NIL)
+					}
+					for i := start; i < end; i++ {
+						if block == nil {
+							arr.Elements[i] = value
+							continue
+						}
+						result := callBlock(block, []object.Object{&object.Integer{Value: int64(i)}}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+						arr.Elements[i] = result
+					}
+					return arr
 				},
 			},
-		}
-	})
-	return booleanBuiltinsMap
-}
-
-func getProcBuiltins() map[string]*object.Builtin {
-	procBuiltinsOnce.Do(func() {
-		procBuiltinsMap = map[string]*object.Builtin{
-			"call": {
-				Name: "call",
+			"insert": {
+				Name:   "insert",
+				Params: []string{"req", "rest"},
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					switch proc := receiver.(type) {
-					case *object.Proc:
-						return callBlock(proc, args, env)
-					case *object.Lambda:
-						return callBlock(&object.Proc{
-							Parameters: proc.Parameters,
-							Body:       proc.Body,
-							Env:        proc.Env,
-						}, args, env)
-					default:
-						return newError("not a callable object")
+					arr := receiver.(*object.Array)
+					if len(args) == 0 {
+						return newError("ArgumentError: wrong number of arguments (given 0, expected 1+)")
+					}
+					n, ok := args[0].(*object.Integer)
+					if !ok {
+						return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+					}
+					if len(args) == 1 {
+						return arr
+					}
+					idx := int(n.Value)
+					if idx < 0 {
+						idx += len(arr.Elements) + 1
+						if idx < 0 {
+							return newError("IndexError: index %d too small for array; minimum: -%d", n.Value, len(arr.Elements)+1)
+						}
 					}
+					for len(arr.Elements) < idx {
+						arr.Elements = append(arr.Elements, object.NIL)
+					}
+					elements := make([]object.Object, 0, len(arr.Elements)+len(args)-1)
+					elements = append(elements, arr.Elements[:idx]...)
+					elements = append(elements, args[1:]...)
+					elements = append(elements, arr.Elements[idx:]...)
+					arr.Elements = elements
+					return arr
 				},
 			},
-			"arity": {
-				Name: "arity",
+			"delete": {
+				Name: "delete",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					switch proc := receiver.(type) {
-					case *object.Proc:
-						return &object.Integer{Value: int64(len(proc.Parameters))}
-					case *object.Lambda:
-						return &object.Integer{Value: int64(len(proc.Parameters))}
-					default:
-						return &object.Integer{Value: 0}
+					arr := receiver.(*object.Array)
+					if len(args) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
 					}
+					var deleted object.Object
+					kept := make([]object.Object, 0, len(arr.Elements))
+					for _, elem := range arr.Elements {
+						if objectsEqual(elem, args[0]) {
+							deleted = elem
+						} else {
+							kept = append(kept, elem)
+						}
+					}
+					arr.Elements = kept
+					if deleted != nil {
+						return deleted
+					}
+					if block := env.Block(); block != nil {
+						result := callBlock(block, []object.Object{args[0]}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						return result
+					}
+					return object.NIL
 				},
 			},
-			"lambda?": {
-				Name: "lambda?",
+			"delete_at": {
+				Name: "delete_at",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					_, isLambda := receiver.(*object.Lambda)
-					return object.NativeToBool(isLambda)
+					arr := receiver.(*object.Array)
+					if len(args) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+					}
+					n, ok := args[0].(*object.Integer)
+					if !ok {
+						return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+					}
+					idx := int(n.Value)
+					if idx < 0 {
+						idx += len(arr.Elements)
+					}
+					if idx < 0 || idx >= len(arr.Elements) {
+						return object.NIL
+					}
+					deleted := arr.Elements[idx]
+					arr.Elements = append(arr.Elements[:idx:idx], arr.Elements[idx+1:]...)
+					return deleted
 				},
 			},
-			"to_proc": {
-				Name: "to_proc",
+			"delete_if": {
+				Name: "delete_if",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					return receiver
+					arr := receiver.(*object.Array)
+					result := filterArrayInPlace(arr, env, false)
+					if result == object.NIL {
+						return arr
+					}
+					return result
 				},
 			},
-		}
-	})
-	return procBuiltinsMap
-}
-
-func getMethodBuiltins() map[string]*object.Builtin {
-	methodBuiltinsOnce.Do(func() {
-		methodBuiltinsMap = map[string]*object.Builtin{
-			"call": {
-				Name: "call",
+			"find_index": {
+				Name: "find_index",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					switch m := receiver.(type) {
-					case *object.Method:
-						// User-defined method with bound receiver
-						return callUserMethod(m, m.Receiver, args, env)
-					case *object.BoundMethod:
-						if m.Builtin != nil {
-							return m.Builtin.Fn(m.Receiver, env, args...)
+					return findArrayIndex(receiver.(*object.Array), args, env)
+				},
+			},
+			"count": {
+				Name: "count",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					arr := receiver.(*object.Array)
+					if len(args) > 0 {
+						count := 0
+						for _, elem := range arr.Elements {
+							if objectsEqual(elem, args[0]) {
+								count++
+							}
 						}
-						if m.Method != nil {
-							return callUserMethod(m.Method, m.Receiver, args, env)
+						return &object.Integer{Value: int64(count)}
+					}
+					block := env.Block()
+					if block == nil {
+						return &object.Integer{Value: int64(len(arr.Elements))}
+					}
+					count := 0
+					for _, elem := range arr.Elements {
+						result := callBlock(block, []object.Object{elem}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+						if isTruthy(result) {
+							count++
 						}
 					}
-					return newError("not a callable method object")
+					return &object.Integer{Value: int64(count)}
 				},
 			},
-			"name": {
-				Name: "name",
+			"union": {
+				Name: "union",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					switch m := receiver.(type) {
-					case *object.Method:
-						return &object.Symbol{Value: m.Name}
-					case *object.BoundMethod:
-						return &object.Symbol{Value: m.Name}
+					others, err := arrayArguments(args)
+					if err != nil {
+						return err
 					}
-					return object.NIL
+					return arrayUnion(receiver.(*object.Array).Elements, others...)
 				},
 			},
-			"arity": {
-				Name: "arity",
+			"intersection": {
+				Name: "intersection",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					switch m := receiver.(type) {
-					case *object.Method:
-						return &object.Integer{Value: int64(len(m.Parameters))}
-					case *object.BoundMethod:
-						if m.Method != nil {
-							return &object.Integer{Value: int64(len(m.Method.Parameters))}
-						}
-						// For builtins, we can't determine arity easily
-						return &object.Integer{Value: -1}
+					others, err := arrayArguments(args)
+					if err != nil {
+						return err
 					}
-					return &object.Integer{Value: 0}
+					return arrayIntersection(receiver.(*object.Array).Elements, others...)
 				},
 			},
-			"receiver": {
-				Name: "receiver",
+			"difference": {
+				Name: "difference",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					switch m := receiver.(type) {
-					case *object.Method:
-						if m.Receiver != nil {
-							return m.Receiver
-						}
-					case *object.BoundMethod:
-						return m.Receiver
+					others, err := arrayArguments(args)
+					if err != nil {
+						return err
 					}
-					return object.NIL
+					return arrayDifference(receiver.(*object.Array).Elements, others...)
 				},
 			},
-			"owner": {
-				Name: "owner",
+			"intersect?": {
+				Name: "intersect?",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					switch m := receiver.(type) {
-					case *object.Method:
-						if m.Receiver != nil {
-							return m.Receiver.Class()
-						}
-					case *object.BoundMethod:
-						if m.Receiver != nil {
-							return m.Receiver.Class()
-						}
+					others, err := arrayArguments(args)
+					if err != nil {
+						return err
 					}
-					return object.NIL
+					if len(others) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(others))
+					}
+					common := arrayIntersection(receiver.(*object.Array).Elements, others[0]).(*object.Array)
+					return object.NativeToBool(len(common.Elements) > 0)
 				},
 			},
-			"to_proc": {
-				Name: "to_proc",
+			"slice": {
+				Name: "slice",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					switch m := receiver.(type) {
-					case *object.Method:
-						return &object.Proc{
-							Parameters: convertMethodParamsToBlockParams(m.Parameters),
-							Body:       m.Body,
-							Env:        m.Env,
+					return evalIndex(receiver, args...)
+				},
+			},
+			"each_index": {
+				Name: "each_index",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					arr := receiver.(*object.Array)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "each_index", args)
+					}
+					for i := 0; i < len(arr.Elements); i++ {
+						result := callBlock(block, []object.Object{&object.Integer{Value: int64(i)}}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
 						}
-					case *object.BoundMethod:
-						if m.Method != nil {
-							return &object.Proc{
-								Parameters: convertMethodParamsToBlockParams(m.Method.Parameters),
-								Body:       m.Method.Body,
-								Env:        m.Method.Env,
-							}
+						if isError(result) {
+							return result
 						}
 					}
-					return object.NIL
+					return receiver
 				},
 			},
-			"unbind": {
-				Name: "unbind",
+			"each_entry": {
+				Name: "each_entry",
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					// Returns an UnboundMethod - for now just return the method without receiver
-					switch m := receiver.(type) {
-					case *object.Method:
-						return &object.Method{
-							Name:       m.Name,
-							Parameters: m.Parameters,
-							Body:       m.Body,
-							Env:        m.Env,
-							Receiver:   nil,
-						}
-					case *object.BoundMethod:
-						if m.Method != nil {
-							return &object.Method{
-								Name:       m.Method.Name,
-								Parameters: m.Method.Parameters,
-								Body:       m.Method.Body,
-								Env:        m.Method.Env,
-								Receiver:   nil,
-							}
-						}
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "each_entry", args)
 					}
-					return object.NIL
+					if stop := yieldValues(block, receiver.(*object.Array).Elements, env); stop != nil {
+						return stop
+					}
+					return receiver
+				},
+			},
+			"to_h": {
+				Name: "to_h",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return pairsToHash(receiver.(*object.Array).Elements, env)
+				},
+			},
+			"to_csv": {
+				Name: "to_csv",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					_, opts, err := csvOptionArgs(args)
+					if err != nil {
+						return err
+					}
+					return &object.String{Value: csvFormatRow(receiver.(*object.Array).Elements, opts)}
 				},
 			},
 		}
 	})
-	return methodBuiltinsMap
-}
-
-// Helper functions
-
-func formatInt(val int64, base int) string {
-	switch base {
-	case 2:
-		return fmt.Sprintf("%b", val)
-	case 8:
-		return fmt.Sprintf("%o", val)
-	case 16:
-		return fmt.Sprintf("%x", val)
-	default:
-		return fmt.Sprintf("%d", val)
-	}
+	return arrayBuiltinsMap
 }
 
-func flattenArray(elements []object.Object) []object.Object {
-	var result []object.Object
-	for _, elem := range elements {
-		if arr, ok := elem.(*object.Array); ok {
-			result = append(result, flattenArray(arr.Elements)...)
-		} else {
+func getHashBuiltins() map[string]*object.Builtin {
+	hashBuiltinsOnce.Do(func() {
+		hashBuiltinsMap = map[string]*object.Builtin{
+			"keys": {
+				Name: "keys",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					keys := make([]object.Object, 0, len(hash.Pairs))
+					for _, key := range hash.Order {
+						keys = append(keys, hash.Pairs[key].Key)
+					}
+					return &object.Array{Elements: keys}
+				},
+			},
+			"values": {
+				Name: "values",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					values := make([]object.Object, 0, len(hash.Pairs))
+					for _, key := range hash.Order {
+						values = append(values, hash.Pairs[key].Value)
+					}
+					return &object.Array{Elements: values}
+				},
+			},
+			"length": {
+				Name: "length",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.Integer{Value: int64(len(receiver.(*object.Hash).Pairs))}
+				},
+			},
+			"size": {
+				Name: "size",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.Integer{Value: int64(len(receiver.(*object.Hash).Pairs))}
+				},
+			},
+			"empty?": {
+				Name: "empty?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return object.NativeToBool(len(receiver.(*object.Hash).Pairs) == 0)
+				},
+			},
+			"has_key?": {
+				Name: "has_key?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) < 1 {
+						return newError("wrong number of arguments (given 0, expected 1)")
+					}
+					hash := receiver.(*object.Hash)
+					hashed, ok := hash.KeyFor(args[0])
+					if !ok {
+						return object.FALSE
+					}
+					_, exists := hash.Pairs[hashed]
+					return object.NativeToBool(exists)
+				},
+			},
+			"has_value?": {
+				Name: "has_value?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) < 1 {
+						return newError("wrong number of arguments (given 0, expected 1)")
+					}
+					hash := receiver.(*object.Hash)
+					for _, pair := range hash.Pairs {
+						if objectsEqual(pair.Value, args[0]) {
+							return object.TRUE
+						}
+					}
+					return object.FALSE
+				},
+			},
+			"each": {
+				Name: "each",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "each", args)
+					}
+					for _, key := range hash.Order {
+						pair := hash.Pairs[key]
+						result := callBlock(block, []object.Object{&object.Array{Elements: []object.Object{pair.Key, pair.Value}}}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+					}
+					return receiver
+				},
+			},
+			"each_key": {
+				Name: "each_key",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "each_key", args)
+					}
+					for _, key := range hash.Order {
+						result := callBlock(block, []object.Object{hash.Pairs[key].Key}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+					}
+					return receiver
+				},
+			},
+			"each_value": {
+				Name: "each_value",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "each_value", args)
+					}
+					for _, key := range hash.Order {
+						result := callBlock(block, []object.Object{hash.Pairs[key].Value}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+					}
+					return receiver
+				},
+			},
+			"map": {
+				Name: "map",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "map", args)
+					}
+					newElements := make([]object.Object, 0, len(hash.Pairs))
+					for _, key := range hash.Order {
+						pair := hash.Pairs[key]
+						result := callBlock(block, []object.Object{&object.Array{Elements: []object.Object{pair.Key, pair.Value}}}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+						newElements = append(newElements, result)
+					}
+					return &object.Array{Elements: newElements}
+				},
+			},
+			"select": {
+				Name: "select",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "select", args)
+					}
+					newPairs := make(map[object.HashKey]object.HashPair)
+					newOrder := make([]object.HashKey, 0)
+					for _, key := range hash.Order {
+						pair := hash.Pairs[key]
+						result := callBlock(block, []object.Object{&object.Array{Elements: []object.Object{pair.Key, pair.Value}}}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+						if isTruthy(result) {
+							newPairs[key] = pair
+							newOrder = append(newOrder, key)
+						}
+					}
+					return &object.Hash{Pairs: newPairs, Order: newOrder}
+				},
+			},
+			"merge": {
+				Name: "merge",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					newPairs := make(map[object.HashKey]object.HashPair)
+					newOrder := make([]object.HashKey, 0, len(hash.Pairs))
+
+					for _, key := range hash.Order {
+						newPairs[key] = hash.Pairs[key]
+						newOrder = append(newOrder, key)
+					}
+
+					merged := &object.Hash{Pairs: newPairs, Order: newOrder}
+					if err := mergeHashes(merged, args, env); err != nil {
+						return err
+					}
+					return merged
+				},
+			},
+			"merge!": {
+				Name: "merge!",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if err := mergeHashes(receiver.(*object.Hash), args, env); err != nil {
+						return err
+					}
+					return receiver
+				},
+			},
+			"update": {
+				Name: "update",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if err := mergeHashes(receiver.(*object.Hash), args, env); err != nil {
+						return err
+					}
+					return receiver
+				},
+			},
+			"to_a": {
+				Name: "to_a",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					elements := make([]object.Object, 0, len(hash.Pairs))
+					for _, key := range hash.Order {
+						pair := hash.Pairs[key]
+						elements = append(elements, &object.Array{Elements: []object.Object{pair.Key, pair.Value}})
+					}
+					return &object.Array{Elements: elements}
+				},
+			},
+			"to_h": {
+				Name: "to_h",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if env.Block() == nil {
+						return receiver
+					}
+					return pairsToHash(hashPairs(receiver.(*object.Hash)), env)
+				},
+			},
+			"to_proc": {
+				Name: "to_proc",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver
+					return &object.Lambda{
+						Native: func(self object.Object, env *object.Environment, args ...object.Object) object.Object {
+							if len(args) != 1 {
+								return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+							}
+							return evalHashIndex(hash, args[0])
+						},
+					}
+				},
+			},
+			"to_s": {
+				Name: "to_s",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					// Elements are shown with their own inspect methods
+					str, err := inspectValue(receiver)
+					if err != nil {
+						return err
+					}
+					return &object.String{Value: str}
+				},
+			},
+			"delete": {
+				Name: "delete",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) < 1 {
+						return newError("wrong number of arguments (given 0, expected 1)")
+					}
+					hash := receiver.(*object.Hash)
+					hashed, ok := hash.KeyFor(args[0])
+					if !ok {
+						return object.NIL
+					}
+					pair, exists := hash.Pairs[hashed]
+					if !exists {
+						return object.NIL
+					}
+					delete(hash.Pairs, hashed)
+					for i, k := range hash.Order {
+						if k == hashed {
+							hash.Order = append(hash.Order[:i], hash.Order[i+1:]...)
+							break
+						}
+					}
+					return pair.Value
+				},
+			},
+			"fetch": {
+				Name: "fetch",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) < 1 {
+						return newError("wrong number of arguments (given 0, expected 1+)")
+					}
+					hash := receiver.(*object.Hash)
+					if _, ok := hash.KeyFor(args[0]); !ok {
+						return newError("unusable as hash key: %s", args[0].Type())
+					}
+					return hashFetch(hash, args[0], args[1:], env)
+				},
+			},
+			"fetch_values": {
+				Name: "fetch_values",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					values := make([]object.Object, 0, len(args))
+					for _, key := range args {
+						value := hashFetch(hash, key, nil, env)
+						if isError(value) {
+							return value
+						}
+						values = append(values, value)
+					}
+					return &object.Array{Elements: values}
+				},
+			},
+			"values_at": {
+				Name: "values_at",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					values := make([]object.Object, 0, len(args))
+					for _, key := range args {
+						value := evalHashIndex(receiver, key)
+						if isError(value) {
+							return value
+						}
+						values = append(values, value)
+					}
+					return &object.Array{Elements: values}
+				},
+			},
+			"default": {
+				Name: "default",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					if len(args) > 0 && hash.DefaultProc != nil {
+						return hashDefault(hash, args[0])
+					}
+					if hash.Default == nil {
+						return object.NIL
+					}
+					return hash.Default
+				},
+			},
+			"default=": {
+				Name: "default=",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+					}
+					hash := receiver.(*object.Hash)
+					hash.Default = args[0]
+					hash.DefaultProc = nil
+					return args[0]
+				},
+			},
+			"default_proc": {
+				Name: "default_proc",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if proc := receiver.(*object.Hash).DefaultProc; proc != nil {
+						return proc
+					}
+					return object.NIL
+				},
+			},
+			"to_enum": {
+				Name: "to_enum",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					method := "each"
+					var enumArgs []object.Object
+					if len(args) > 0 {
+						if sym, ok := args[0].(*object.Symbol); ok {
+							method = sym.Value
+						} else if str, ok := args[0].(*object.String); ok {
+							method = str.Value
+						}
+						if len(args) > 1 {
+							enumArgs = args[1:]
+						}
+					}
+					return &object.Enumerator{
+						Object: receiver,
+						Method: method,
+						Args:   enumArgs,
+					}
+				},
+			},
+			"enum_for": {
+				Name: "enum_for",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					method := "each"
+					var enumArgs []object.Object
+					if len(args) > 0 {
+						if sym, ok := args[0].(*object.Symbol); ok {
+							method = sym.Value
+						} else if str, ok := args[0].(*object.String); ok {
+							method = str.Value
+						}
+						if len(args) > 1 {
+							enumArgs = args[1:]
+						}
+					}
+					return &object.Enumerator{
+						Object: receiver,
+						Method: method,
+						Args:   enumArgs,
+					}
+				},
+			},
+			"dig": {
+				Name: "dig",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return digObject(receiver, args)
+				},
+			},
+			"transform_keys": {
+				Name: "transform_keys",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return transformHash(receiver.(*object.Hash), true, args, env)
+				},
+			},
+			"transform_keys!": {
+				Name: "transform_keys!",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					result := transformHash(hash, true, args, env)
+					if transformed, ok := result.(*object.Hash); ok {
+						hash.Pairs, hash.Order = transformed.Pairs, transformed.Order
+						return hash
+					}
+					return result
+				},
+			},
+			"transform_values": {
+				Name: "transform_values",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return transformHash(receiver.(*object.Hash), false, args, env)
+				},
+			},
+			"transform_values!": {
+				Name: "transform_values!",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					result := transformHash(hash, false, args, env)
+					if transformed, ok := result.(*object.Hash); ok {
+						hash.Pairs, hash.Order = transformed.Pairs, transformed.Order
+						return hash
+					}
+					return result
+				},
+			},
+			"key": {
+				Name: "key",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+					}
+					hash := receiver.(*object.Hash)
+					for _, key := range hash.Order {
+						pair := hash.Pairs[key]
+						if objectsEqual(pair.Value, args[0]) {
+							return pair.Key
+						}
+					}
+					return object.NIL
+				},
+			},
+			"invert": {
+				Name: "invert",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					inverted := newHash()
+					for _, key := range hash.Order {
+						pair := hash.Pairs[key]
+						if err := hashSet(inverted, pair.Value, pair.Key); err != nil {
+							return err
+						}
+					}
+					return inverted
+				},
+			},
+			"compact": {
+				Name: "compact",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					compacted := newHash()
+					for _, key := range hash.Order {
+						pair := hash.Pairs[key]
+						if pair.Value != object.NIL {
+							compacted.Pairs[key] = pair
+							compacted.Order = append(compacted.Order, key)
+						}
+					}
+					return compacted
+				},
+			},
+			"compact!": {
+				Name: "compact!",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					order := make([]object.HashKey, 0, len(hash.Order))
+					for _, key := range hash.Order {
+						if hash.Pairs[key].Value == object.NIL {
+							delete(hash.Pairs, key)
+						} else {
+							order = append(order, key)
+						}
+					}
+					if len(order) == len(hash.Order) {
+						return object.NIL
+					}
+					hash.Order = order
+					return hash
+				},
+			},
+			"any?": {
+				Name: "any?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					block := env.Block()
+					if block == nil {
+						return object.NativeToBool(len(hash.Pairs) > 0)
+					}
+					for _, pair := range hashPairs(hash) {
+						result := callBlock(block, []object.Object{pair}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+						if isTruthy(result) {
+							return object.TRUE
+						}
+					}
+					return object.FALSE
+				},
+			},
+			"all?": {
+				Name: "all?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					block := env.Block()
+					if block == nil {
+						return object.TRUE
+					}
+					for _, pair := range hashPairs(receiver.(*object.Hash)) {
+						result := callBlock(block, []object.Object{pair}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+						if !isTruthy(result) {
+							return object.FALSE
+						}
+					}
+					return object.TRUE
+				},
+			},
+			"none?": {
+				Name: "none?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					block := env.Block()
+					if block == nil {
+						return object.NativeToBool(len(hash.Pairs) == 0)
+					}
+					for _, pair := range hashPairs(hash) {
+						result := callBlock(block, []object.Object{pair}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+						if isTruthy(result) {
+							return object.FALSE
+						}
+					}
+					return object.TRUE
+				},
+			},
+			"count": {
+				Name: "count",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					block := env.Block()
+					if len(args) == 0 && block == nil {
+						return &object.Integer{Value: int64(len(hash.Pairs))}
+					}
+					count := int64(0)
+					for _, pair := range hashPairs(hash) {
+						if len(args) > 0 {
+							if objectsEqual(pair, args[0]) {
+								count++
+							}
+							continue
+						}
+						result := callBlock(block, []object.Object{pair}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+						if isTruthy(result) {
+							count++
+						}
+					}
+					return &object.Integer{Value: count}
+				},
+			},
+			"filter_map":       hashEnumerable("filter_map"),
+			"sum":              hashEnumerable("sum"),
+			"reduce":           hashEnumerable("reduce"),
+			"each_with_object": hashEnumerable("each_with_object"),
+			"min_by":           hashEnumerable("min_by"),
+			"max_by":           hashEnumerable("max_by"),
+			"sort_by":          hashEnumerable("sort_by"),
+			"group_by":         hashEnumerable("group_by"),
+			"reject": {
+				Name: "reject",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "reject", args)
+					}
+					order, stop := filterHashKeys(hash, block, env, false)
+					if stop != nil {
+						return stop
+					}
+					result := newHash()
+					for _, key := range order {
+						result.Pairs[key] = hash.Pairs[key]
+					}
+					result.Order = order
+					return result
+				},
+			},
+			"delete_if": {
+				Name: "delete_if",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return filterHashInPlace(receiver, "delete_if", false, false, args, env)
+				},
+			},
+			"keep_if": {
+				Name: "keep_if",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return filterHashInPlace(receiver, "keep_if", true, false, args, env)
+				},
+			},
+			"select!": {
+				Name: "select!",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return filterHashInPlace(receiver, "select!", true, true, args, env)
+				},
+			},
+			"reject!": {
+				Name: "reject!",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return filterHashInPlace(receiver, "reject!", false, true, args, env)
+				},
+			},
+			"slice": {
+				Name: "slice",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					result := newHash()
+					for _, key := range args {
+						hashed, ok := hash.KeyFor(key)
+						if !ok {
+							continue
+						}
+						if pair, exists := hash.Pairs[hashed]; exists {
+							hashSet(result, pair.Key, pair.Value)
+						}
+					}
+					return result
+				},
+			},
+			"except": {
+				Name: "except",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					excluded := make(map[object.HashKey]bool, len(args))
+					for _, key := range args {
+						if hashed, ok := hash.KeyFor(key); ok {
+							excluded[hashed] = true
+						}
+					}
+					result := newHash()
+					for _, key := range hash.Order {
+						if !excluded[key] {
+							result.Pairs[key] = hash.Pairs[key]
+							result.Order = append(result.Order, key)
+						}
+					}
+					return result
+				},
+			},
+			"assoc": {
+				Name: "assoc",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+					}
+					hash := receiver.(*object.Hash)
+					hashed, ok := hash.KeyFor(args[0])
+					if !ok {
+						return object.NIL
+					}
+					if pair, exists := hash.Pairs[hashed]; exists {
+						return &object.Array{Elements: []object.Object{pair.Key, pair.Value}}
+					}
+					return object.NIL
+				},
+			},
+			"rassoc": {
+				Name: "rassoc",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+					}
+					hash := receiver.(*object.Hash)
+					for _, key := range hash.Order {
+						pair := hash.Pairs[key]
+						if objectsEqual(pair.Value, args[0]) {
+							return &object.Array{Elements: []object.Object{pair.Key, pair.Value}}
+						}
+					}
+					return object.NIL
+				},
+			},
+			"store": {
+				Name: "store",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) != 2 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 2)", len(args))
+					}
+					if err := hashSet(receiver.(*object.Hash), args[0], args[1]); err != nil {
+						return err
+					}
+					return args[1]
+				},
+			},
+			"compare_by_identity": {
+				Name: "compare_by_identity",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					hash := receiver.(*object.Hash)
+					if hash.CompareByIdentity {
+						return hash
+					}
+					pairs := hashPairs(hash)
+					hash.CompareByIdentity = true
+					hash.Pairs = make(map[object.HashKey]object.HashPair, len(pairs))
+					hash.Order = make([]object.HashKey, 0, len(pairs))
+					for _, pair := range pairs {
+						kv := pair.(*object.Array).Elements
+						hashSet(hash, kv[0], kv[1])
+					}
+					return hash
+				},
+			},
+			"compare_by_identity?": {
+				Name: "compare_by_identity?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return object.NativeToBool(receiver.(*object.Hash).CompareByIdentity)
+				},
+			},
+			"each_pair": {
+				Name: "each_pair",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return getHashBuiltins()["each"].Fn(receiver, env, args...)
+				},
+			},
+		}
+	})
+	return hashBuiltinsMap
+}
+
+func getRangeBuiltins() map[string]*object.Builtin {
+	rangeBuiltinsOnce.Do(func() {
+		rangeBuiltinsMap = map[string]*object.Builtin{
+			"to_a": {
+				Name: "to_a",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					r := receiver.(*object.Range)
+					return &object.Array{Elements: expandRange(r)}
+				},
+			},
+			"each": {
+				Name: "each",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					r := receiver.(*object.Range)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "each", args)
+					}
+					if stop := yieldRange(r, block, env, nil); stop != nil {
+						return stop
+					}
+					return receiver
+				},
+			},
+			"include?": {
+				Name:   "include?",
+				Params: []string{"req"},
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) < 1 {
+						return newError("wrong number of arguments (given 0, expected 1)")
+					}
+					r := receiver.(*object.Range)
+					return evalRangeIncludes(r, args[0])
+				},
+			},
+			"first": {
+				Name:   "first",
+				Params: []string{"opt"},
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					r := receiver.(*object.Range)
+					return r.Start
+				},
+			},
+			"last": {
+				Name:   "last",
+				Params: []string{"opt"},
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					r := receiver.(*object.Range)
+					return r.End
+				},
+			},
+			"size": {
+				Name: "size",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					r := receiver.(*object.Range)
+					startInt, ok1 := r.Start.(*object.Integer)
+					endInt, ok2 := r.End.(*object.Integer)
+					if !ok1 || !ok2 {
+						return object.NIL
+					}
+					size := endInt.Value - startInt.Value
+					if !r.Exclusive {
+						size++
+					}
+					if size < 0 {
+						size = 0
+					}
+					return &object.Integer{Value: size}
+				},
+			},
+			"to_enum": {
+				Name: "to_enum",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					method := "each"
+					var enumArgs []object.Object
+					if len(args) > 0 {
+						if sym, ok := args[0].(*object.Symbol); ok {
+							method = sym.Value
+						} else if str, ok := args[0].(*object.String); ok {
+							method = str.Value
+						}
+						if len(args) > 1 {
+							enumArgs = args[1:]
+						}
+					}
+					return &object.Enumerator{
+						Object: receiver,
+						Method: method,
+						Args:   enumArgs,
+					}
+				},
+			},
+			"enum_for": {
+				Name: "enum_for",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					method := "each"
+					var enumArgs []object.Object
+					if len(args) > 0 {
+						if sym, ok := args[0].(*object.Symbol); ok {
+							method = sym.Value
+						} else if str, ok := args[0].(*object.String); ok {
+							method = str.Value
+						}
+						if len(args) > 1 {
+							enumArgs = args[1:]
+						}
+					}
+					return &object.Enumerator{
+						Object: receiver,
+						Method: method,
+						Args:   enumArgs,
+					}
+				},
+			},
+			"lazy": {
+				Name: "lazy",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.Enumerator{
+						Object: receiver,
+						Method: "each",
+						Lazy:   true,
+					}
+				},
+			},
+			"step": {
+				Name: "step",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+					}
+					return evalRangeStep(receiver.(*object.Range), args[0], env.Block(), env)
+				},
+			},
+			"%": {
+				Name: "%",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+					}
+					return evalRangeStep(receiver.(*object.Range), args[0], env.Block(), env)
+				},
+			},
+			"cover?": {
+				Name: "cover?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if len(args) != 1 {
+						return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+					}
+					r := receiver.(*object.Range)
+					if inner, ok := args[0].(*object.Range); ok {
+						return object.NativeToBool(rangeCovers(r, inner.Start) && (rangeCovers(r, inner.End) ||
+							inner.Exclusive && objectsEqual(r.End, inner.End)))
+					}
+					return object.NativeToBool(rangeCovers(r, args[0]))
+				},
+			},
+			"min": {
+				Name: "min",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					r := receiver.(*object.Range)
+					if env.Block() != nil || len(args) > 0 {
+						return getArrayBuiltins()["min"].Fn(&object.Array{Elements: expandRange(r)}, env, args...)
+					}
+					if c, err := compareObjects(r.Start, r.End); err != nil || c > 0 || (c == 0 && r.Exclusive) {
+						return object.NIL
+					}
+					return r.Start
+				},
+			},
+			"max": {
+				Name: "max",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					r := receiver.(*object.Range)
+					if env.Block() != nil || len(args) > 0 {
+						return getArrayBuiltins()["max"].Fn(&object.Array{Elements: expandRange(r)}, env, args...)
+					}
+					if c, err := compareObjects(r.Start, r.End); err != nil || c > 0 || (c == 0 && r.Exclusive) {
+						return object.NIL
+					}
+					if !r.Exclusive {
+						return r.End
+					}
+					end, ok := r.End.(*object.Integer)
+					if !ok {
+						return newError("TypeError: cannot exclude non Integer end value")
+					}
+					if _, ok := r.Start.(*object.Integer); !ok {
+						return newError("TypeError: cannot exclude end value with non Integer begin value")
+					}
+					return &object.Integer{Value: end.Value - 1}
+				},
+			},
+			"map": {
+				Name: "map",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return mapRange(receiver, "map", env, args)
+				},
+			},
+			"collect": {
+				Name: "collect",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return mapRange(receiver, "collect", env, args)
+				},
+			},
+			"select": {
+				Name: "select",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return filterRange(receiver, "select", true, env, args)
+				},
+			},
+			"filter": {
+				Name: "filter",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return filterRange(receiver, "filter", true, env, args)
+				},
+			},
+			"reject": {
+				Name: "reject",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return filterRange(receiver, "reject", false, env, args)
+				},
+			},
+			"reduce": {
+				Name: "reduce",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return reduceRange(receiver.(*object.Range), env, args)
+				},
+			},
+			"inject": {
+				Name: "inject",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return reduceRange(receiver.(*object.Range), env, args)
+				},
+			},
+			"sum": {
+				Name: "sum",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					r := receiver.(*object.Range)
+					var init object.Object = &object.Integer{Value: 0}
+					if len(args) > 0 {
+						init = args[0]
+					}
+					block := env.Block()
+
+					// Integer ranges sum in constant time
+					first, ok1 := r.Start.(*object.Integer)
+					last, ok2 := r.End.(*object.Integer)
+					if block == nil && ok1 && ok2 {
+						end := last.Value
+						if r.Exclusive {
+							end--
+						}
+						if end < first.Value {
+							return init
+						}
+						// Halving whichever factor is even keeps the product
+						// from overflowing when the sum itself fits
+						n, total := end-first.Value+1, first.Value+end
+						if n%2 == 0 {
+							n /= 2
+						} else {
+							total /= 2
+						}
+						return evalInfixExpression("+", init, &object.Integer{Value: n * total})
+					}
+
+					var values []object.Object
+					var stop object.Object
+					if block != nil {
+						stop = yieldRange(r, block, env, func(val, result object.Object) {
+							values = append(values, result)
+						})
+					} else {
+						stop = iterateRange(r, func(val object.Object) object.Object {
+							values = append(values, val)
+							return nil
+						})
+					}
+					if stop != nil {
+						return stop
+					}
+					return sumObjects(init, values)
+				},
+			},
+			"reverse_each": {
+				Name: "reverse_each",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					r := receiver.(*object.Range)
+					block := env.Block()
+					if block == nil {
+						return newEnumerator(receiver, "reverse_each", args)
+					}
+					first, ok1 := r.Start.(*object.Integer)
+					last, ok2 := r.End.(*object.Integer)
+					if !ok1 || !ok2 {
+						values := expandRange(r)
+						for i := len(values) - 1; i >= 0; i-- {
+							result := callBlock(block, []object.Object{values[i]}, env)
+							if bv, ok := result.(*object.BreakValue); ok {
+								return bv.Value
+							}
+							if isError(result) {
+								return result
+							}
+						}
+						return receiver
+					}
+					end := last.Value
+					if r.Exclusive {
+						end--
+					}
+					for i := end; i >= first.Value; i-- {
+						result := callBlock(block, []object.Object{&object.Integer{Value: i}}, env)
+						if bv, ok := result.(*object.BreakValue); ok {
+							return bv.Value
+						}
+						if isError(result) {
+							return result
+						}
+					}
+					return receiver
+				},
+			},
+		}
+	})
+	return rangeBuiltinsMap
+}
+
+func getSymbolBuiltins() map[string]*object.Builtin {
+	symbolBuiltinsOnce.Do(func() {
+		symbolBuiltinsMap = map[string]*object.Builtin{
+			"to_s": {
+				Name: "to_s",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.String{Value: receiver.(*object.Symbol).Value}
+				},
+			},
+			"to_sym": {
+				Name: "to_sym",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return receiver
+				},
+			},
+			"upcase": {
+				Name: "upcase",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.Symbol{Value: strings.ToUpper(receiver.(*object.Symbol).Value)}
+				},
+			},
+			"downcase": {
+				Name: "downcase",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.Symbol{Value: strings.ToLower(receiver.(*object.Symbol).Value)}
+				},
+			},
+			"length": {
+				Name: "length",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.Integer{Value: int64(len(receiver.(*object.Symbol).Value))}
+				},
+			},
+			"size": {
+				Name: "size",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.Integer{Value: int64(len(receiver.(*object.Symbol).Value))}
+				},
+			},
+			"empty?": {
+				Name: "empty?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return object.NativeToBool(len(receiver.(*object.Symbol).Value) == 0)
+				},
+			},
+			"to_proc": {
+				Name: "to_proc",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					name := receiver.(*object.Symbol).Value
+					return &object.Lambda{
+						Native: func(self object.Object, env *object.Environment, args ...object.Object) object.Object {
+							if len(args) == 0 {
+								return newError("ArgumentError: no receiver given")
+							}
+							return callMethod(args[0], name, args[1:], nil, env)
+						},
+					}
+				},
+			},
+		}
+	})
+	return symbolBuiltinsMap
+}
+
+func getNilBuiltins() map[string]*object.Builtin {
+	nilBuiltinsOnce.Do(func() {
+		nilBuiltinsMap = map[string]*object.Builtin{
+			"to_s": {
+				Name: "to_s",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.String{Value: ""}
+				},
+			},
+			"to_a": {
+				Name: "to_a",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.Array{Elements: []object.Object{}}
+				},
+			},
+			"to_h": {
+				Name: "to_h",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.Hash{Pairs: make(map[object.HashKey]object.HashPair)}
+				},
+			},
+			"nil?": {
+				Name: "nil?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return object.TRUE
+				},
+			},
+			"inspect": {
+				Name: "inspect",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.String{Value: "nil"}
+				},
+			},
+		}
+	})
+	return nilBuiltinsMap
+}
+
+func getBooleanBuiltins() map[string]*object.Builtin {
+	booleanBuiltinsOnce.Do(func() {
+		booleanBuiltinsMap = map[string]*object.Builtin{
+			"to_s": {
+				Name: "to_s",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					if receiver.(*object.Boolean).Value {
+						return &object.String{Value: "true"}
+					}
+					return &object.String{Value: "false"}
+				},
+			},
+		}
+	})
+	return booleanBuiltinsMap
+}
+
+func getProcBuiltins() map[string]*object.Builtin {
+	procBuiltinsOnce.Do(func() {
+		procBuiltinsMap = map[string]*object.Builtin{
+			"call": {
+				Name: "call",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return callProc(receiver, args, env)
+				},
+			},
+			"[]": {
+				Name: "[]",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return callProc(receiver, args, env)
+				},
+			},
+			"yield": {
+				Name: "yield",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return callProc(receiver, args, env)
+				},
+			},
+			"===": {
+				Name: "===",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return callProc(receiver, args, env)
+				},
+			},
+			"arity": {
+				Name: "arity",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.Integer{Value: int64(callableArity(receiver))}
+				},
+			},
+			"parameters": {
+				Name: "parameters",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return parametersArray(callableParams(receiver))
+				},
+			},
+			"lambda?": {
+				Name: "lambda?",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					_, isLambda := receiver.(*object.Lambda)
+					return object.NativeToBool(isLambda)
+				},
+			},
+			"to_proc": {
+				Name: "to_proc",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return receiver
+				},
+			},
+			"curry": {
+				Name: "curry",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return curryCallable(receiver, args)
+				},
+			},
+		}
+	})
+	return procBuiltinsMap
+}
+
+func getMethodBuiltins() map[string]*object.Builtin {
+	methodBuiltinsOnce.Do(func() {
+		methodBuiltinsMap = map[string]*object.Builtin{
+			"call": {
+				Name: "call",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					switch m := receiver.(type) {
+					case *object.Method:
+						// User-defined method with bound receiver
+						return callUserMethod(m, m.Receiver, args, env)
+					case *object.BoundMethod:
+						if m.Builtin != nil {
+							return m.Builtin.Fn(m.Receiver, env, args...)
+						}
+						if m.Method != nil {
+							return callUserMethod(m.Method, m.Receiver, args, env)
+						}
+					}
+					return newError("not a callable method object")
+				},
+			},
+			"[]": {
+				Name: "[]",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return callProc(receiver, args, env)
+				},
+			},
+			"===": {
+				Name: "===",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return callProc(receiver, args, env)
+				},
+			},
+			"name": {
+				Name: "name",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					switch m := receiver.(type) {
+					case *object.Method:
+						return &object.Symbol{Value: m.Name}
+					case *object.BoundMethod:
+						return &object.Symbol{Value: m.Name}
+					}
+					return object.NIL
+				},
+			},
+			"arity": {
+				Name: "arity",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return &object.Integer{Value: int64(callableArity(receiver))}
+				},
+			},
+			"parameters": {
+				Name: "parameters",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return parametersArray(callableParams(receiver))
+				},
+			},
+			"receiver": {
+				Name: "receiver",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					switch m := receiver.(type) {
+					case *object.Method:
+						if m.Receiver != nil {
+							return m.Receiver
+						}
+					case *object.BoundMethod:
+						return m.Receiver
+					}
+					return object.NIL
+				},
+			},
+			"owner": {
+				Name: "owner",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					switch m := receiver.(type) {
+					case *object.Method:
+						if m.Receiver != nil {
+							return m.Receiver.Class()
+						}
+					case *object.BoundMethod:
+						if m.Receiver != nil {
+							return m.Receiver.Class()
+						}
+					}
+					return object.NIL
+				},
+			},
+			"to_proc": {
+				Name: "to_proc",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					switch m := receiver.(type) {
+					case *object.Method:
+						return &object.Proc{
+							Parameters: convertMethodParamsToBlockParams(m.Parameters),
+							Body:       m.Body,
+							Env:        m.Env,
+						}
+					case *object.BoundMethod:
+						if m.Method != nil {
+							return &object.Proc{
+								Parameters: convertMethodParamsToBlockParams(m.Method.Parameters),
+								Body:       m.Method.Body,
+								Env:        m.Method.Env,
+							}
+						}
+					}
+					return object.NIL
+				},
+			},
+			"unbind": {
+				Name: "unbind",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					// Returns an UnboundMethod - for now just return the method without receiver
+					switch m := receiver.(type) {
+					case *object.Method:
+						return &object.Method{
+							Name:       m.Name,
+							Parameters: m.Parameters,
+							Body:       m.Body,
+							Env:        m.Env,
+							Receiver:   nil,
+						}
+					case *object.BoundMethod:
+						if m.Method != nil {
+							return &object.Method{
+								Name:       m.Method.Name,
+								Parameters: m.Method.Parameters,
+								Body:       m.Method.Body,
+								Env:        m.Method.Env,
+								Receiver:   nil,
+							}
+						}
+					}
+					return object.NIL
+				},
+			},
+			"curry": {
+				Name: "curry",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return curryCallable(receiver, args)
+				},
+			},
+		}
+	})
+	return methodBuiltinsMap
+}
+
+// Helper functions
+
+func formatInt(val int64, base int) string {
+	switch base {
+	case 2:
+		return fmt.Sprintf("%b", val)
+	case 8:
+		return fmt.Sprintf("%o", val)
+	case 16:
+		return fmt.Sprintf("%x", val)
+	default:
+		return fmt.Sprintf("%d", val)
+	}
+}
+
+func flattenArray(elements []object.Object) []object.Object {
+	var result []object.Object
+	for _, elem := range elements {
+		if arr, ok := elem.(*object.Array); ok {
+			result = append(result, flattenArray(arr.Elements)...)
+		} else {
 			result = append(result, elem)
 		}
 	}
-	return result
+	return result
+}
+
+func initKernelMethods() {
+	for name, builtin := range getKernelBuiltins() {
+		object.KernelModule.Methods[name] = builtin
+	}
+}
+
+func initArrayClassMethods() {
+	object.ArrayClass.ClassMethods["new"] = &object.Builtin{
+		Name: "new",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) == 0 {
+				return &object.Array{Elements: []object.Object{}}
+			}
+			if src, ok := args[0].(*object.Array); ok && len(args) == 1 {
+				elements := make([]object.Object, len(src.Elements))
+				copy(elements, src.Elements)
+				return &object.Array{Elements: elements}
+			}
+			n, ok := args[0].(*object.Integer)
+			if !ok {
+				return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+			}
+			if n.Value < 0 {
+				return newError("ArgumentError: negative array size")
+			}
+			var fill object.Object = object.NIL
+			if len(args) > 1 {
+				fill = args[1]
+			}
+			block := env.Block()
+			elements := make([]object.Object, n.Value)
+			for i := range elements {
+				if block == nil {
+					elements[i] = fill
+					continue
+				}
+				result := callBlock(block, []object.Object{&object.Integer{Value: int64(i)}}, env)
+				if bv, ok := result.(*object.BreakValue); ok {
+					return bv.Value
+				}
+				if isError(result) {
+					return result
+				}
+				elements[i] = result
+			}
+			return &object.Array{Elements: elements}
+		},
+	}
+}
+
+func init() {
+	initKernelMethods()
+	initArrayClassMethods()
+	initHashClassMethods()
+}
+
+// callUserMethod calls a user-defined method with a specific receiver
+func callUserMethod(method *object.Method, receiver object.Object, args []object.Object, env *object.Environment) object.Object {
+	methodEnv := object.NewEnclosedEnvironment(method.Env)
+	methodEnv.SetSelf(receiver)
+	methodEnv.SetBlock(env.Block())
+
+	// Bind parameters
+	for i, param := range method.Parameters {
+		if i < len(args) {
+			methodEnv.Set(param.Name, args[i])
+		} else if param.Default != nil {
+			// Use default value
+			defaultVal := Eval(param.Default, methodEnv)
+			methodEnv.Set(param.Name, defaultVal)
+		} else {
+			methodEnv.Set(param.Name, object.NIL)
+		}
+	}
+
+	result := evalBlockBody(method.Body, methodEnv)
+	if rv, ok := result.(*object.ReturnValue); ok {
+		return rv.Value
+	}
+	return result
+}
+
+// convertMethodParamsToBlockParams converts method parameters to block parameters
+func convertMethodParamsToBlockParams(params []*ast.MethodParameter) []*ast.BlockParameter {
+	blockParams := make([]*ast.BlockParameter, len(params))
+	for i, p := range params {
+		blockParams[i] = &ast.BlockParameter{
+			Name: p.Name,
+		}
+	}
+	return blockParams
+}
+
+// Error builtins
+
+var errorBuiltinsOnce sync.Once
+var errorBuiltinsMap map[string]*object.Builtin
+
+func getErrorBuiltins() map[string]*object.Builtin {
+	errorBuiltinsOnce.Do(func() {
+		errorBuiltinsMap = map[string]*object.Builtin{
+			"message": {
+				Name: "message",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					err := receiver.(*object.Error)
+					return &object.String{Value: ErrorMessage(err)}
+				},
+			},
+			"to_s": {
+				Name: "to_s",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					err := receiver.(*object.Error)
+					return &object.String{Value: ErrorMessage(err)}
+				},
+			},
+			"backtrace": {
+				Name: "backtrace",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					err := receiver.(*object.Error)
+					elements := make([]object.Object, len(err.Backtrace))
+					for i, line := range err.Backtrace {
+						elements[i] = &object.String{Value: line}
+					}
+					return &object.Array{Elements: elements}
+				},
+			},
+		}
+	})
+	return errorBuiltinsMap
+}
+
+// evalCode evaluates code in the given environment (for Kernel.eval)
+func evalCode(code string, env *object.Environment) object.Object {
+	l := lexer.New(code)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	if len(p.Errors()) > 0 {
+		err := p.SyntaxErrors()[0]
+		return newError("SyntaxError: (eval):%s: %s", err.Pos, err.Msg)
+	}
+
+	return evalProgram(program, env)
+}
+
+// filterArrayInPlace keeps the elements for which the block result matches
+// keep, returning nil when no element was removed.
+func filterArrayInPlace(arr *object.Array, env *object.Environment, keep bool) object.Object {
+	block := env.Block()
+	if block == nil {
+		return arr
+	}
+	newElements := make([]object.Object, 0, len(arr.Elements))
+	for _, elem := range arr.Elements {
+		result := callBlock(block, []object.Object{elem}, env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			return bv.Value
+		}
+		if isError(result) {
+			return result
+		}
+		if isTruthy(result) == keep {
+			newElements = append(newElements, elem)
+		}
+	}
+	if len(newElements) == len(arr.Elements) {
+		return object.NIL
+	}
+	arr.Elements = newElements
+	return arr
+}
+
+// compareObjects compares two objects the way <=> does, returning an
+// ArgumentError when the objects are not comparable.
+func compareObjects(a, b object.Object) (int, object.Object) {
+	var result object.Object
+	switch {
+	case isNumeric(a) && isNumeric(b):
+		result = evalInfixExpression("<=>", a, b)
+	case a.Type() == object.STRING_OBJ && b.Type() == object.STRING_OBJ:
+		result = evalInfixExpression("<=>", a, b)
+	case a.Type() == object.TIME_OBJ && b.Type() == object.TIME_OBJ:
+		result = evalInfixExpression("<=>", a, b)
+	case a.Type() == object.DATE_OBJ && b.Type() == object.DATE_OBJ:
+		return a.(*object.Date).Value.Compare(b.(*object.Date).Value), nil
+	case a.Type() == object.INSTANCE_OBJ:
+		if r, ok := callInstanceMethod(a.(*object.Instance), "<=>", b); ok {
+			if isError(r) {
+				return 0, r
+			}
+			result = r
+		}
+	case a.Type() == object.ARRAY_OBJ && b.Type() == object.ARRAY_OBJ:
+		left := a.(*object.Array).Elements
+		right := b.(*object.Array).Elements
+		for i := 0; i < len(left) && i < len(right); i++ {
+			c, err := compareObjects(left[i], right[i])
+			if err != nil || c != 0 {
+				return c, err
+			}
+		}
+		return len(left) - len(right), nil
+	}
+
+	if i, ok := result.(*object.Integer); ok {
+		return int(i.Value), nil
+	}
+	return 0, newError("ArgumentError: comparison of %s with %s failed",
+		comparisonOperandName(a), comparisonOperandName(b))
+}
+
+// comparisonOperandName names an operand in comparison error messages,
+// using the inspected value for nil, true and false like MRI does.
+func comparisonOperandName(obj object.Object) string {
+	switch obj.Type() {
+	case object.NIL_OBJ, object.BOOLEAN_OBJ:
+		return obj.Inspect()
+	}
+	if class := obj.Class(); class != nil {
+		return class.Name
+	}
+	return string(obj.Type())
+}
+
+func isNumeric(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+// toFloat returns the value of an Integer or Float as a float64.
+func toFloat(obj object.Object) float64 {
+	switch n := obj.(type) {
+	case *object.Integer:
+		return float64(n.Value)
+	case *object.Float:
+		return n.Value
+	}
+	return 0
+}
+
+// sortObjects sorts elements in place using <=>, or the comparison block
+// when one is given. It returns an error object if any pair of elements is
+// not comparable, or the break value if the block breaks.
+func sortObjects(elements []object.Object, block *object.Proc, env *object.Environment) object.Object {
+	var cmpErr object.Object
+	sort.SliceStable(elements, func(i, j int) bool {
+		if cmpErr != nil {
+			return false
+		}
+		var c int
+		var err object.Object
+		if block != nil {
+			c, err = compareWithBlock(block, elements[i], elements[j], env)
+		} else {
+			c, err = compareObjects(elements[i], elements[j])
+		}
+		if err != nil {
+			cmpErr = err
+			return false
+		}
+		return c < 0
+	})
+	return cmpErr
+}
+
+// compareWithBlock calls a sort block with a pair of elements. The block
+// must return an Integer, as with <=>.
+func compareWithBlock(block *object.Proc, a, b object.Object, env *object.Environment) (int, object.Object) {
+	result := callBlock(block, []object.Object{a, b}, env)
+	if bv, ok := result.(*object.BreakValue); ok {
+		return 0, bv.Value
+	}
+	if isError(result) {
+		return 0, result
+	}
+	switch r := result.(type) {
+	case *object.Integer:
+		return int(r.Value), nil
+	case *object.Float:
+		switch {
+		case r.Value < 0:
+			return -1, nil
+		case r.Value > 0:
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, newError("ArgumentError: comparison of %s with %s failed",
+		comparisonOperandName(a), comparisonOperandName(b))
+}
+
+// sortObjectsByKeys returns elements ordered by the corresponding keys.
+func sortObjectsByKeys(elements, keys []object.Object) ([]object.Object, object.Object) {
+	indices := make([]int, len(elements))
+	for i := range indices {
+		indices[i] = i
+	}
+	var cmpErr object.Object
+	sort.SliceStable(indices, func(i, j int) bool {
+		if cmpErr != nil {
+			return false
+		}
+		c, err := compareObjects(keys[indices[i]], keys[indices[j]])
+		if err != nil {
+			cmpErr = err
+			return false
+		}
+		return c < 0
+	})
+	if cmpErr != nil {
+		return nil, cmpErr
+	}
+	sorted := make([]object.Object, len(elements))
+	for i, idx := range indices {
+		sorted[i] = elements[idx]
+	}
+	return sorted, nil
+}
+
+// blockKeys calls the block for every element and collects the results.
+// A break or error from the block is returned as the second value.
+func blockKeys(block *object.Proc, elements []object.Object, env *object.Environment) ([]object.Object, object.Object) {
+	keys := make([]object.Object, len(elements))
+	for i, elem := range elements {
+		result := callBlock(block, []object.Object{elem}, env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			return nil, bv.Value
+		}
+		if isError(result) {
+			return nil, result
+		}
+		keys[i] = result
+	}
+	return keys, nil
+}
+
+// arrayExtremes implements min/max/min_by/max_by. When keys is nil the
+// elements themselves are compared. sign is -1 for minimum and 1 for maximum.
+func arrayExtremes(elements, keys []object.Object, sign int, args []object.Object) object.Object {
+	if keys == nil {
+		keys = elements
+	}
+	if len(args) > 0 {
+		n, ok := args[0].(*object.Integer)
+		if !ok {
+			return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+		}
+		if n.Value < 0 {
+			return newError("ArgumentError: negative size (%d)", n.Value)
+		}
+		sorted, err := sortObjectsByKeys(elements, keys)
+		if err != nil {
+			return err
+		}
+		if sign > 0 {
+			for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+				sorted[i], sorted[j] = sorted[j], sorted[i]
+			}
+		}
+		if int(n.Value) < len(sorted) {
+			sorted = sorted[:n.Value]
+		}
+		return &object.Array{Elements: sorted}
+	}
+
+	if len(elements) == 0 {
+		return object.NIL
+	}
+	best := 0
+	for i := 1; i < len(elements); i++ {
+		c, err := compareObjects(keys[i], keys[best])
+		if err != nil {
+			return err
+		}
+		if c*sign > 0 {
+			best = i
+		}
+	}
+	return elements[best]
+}
+
+// sumObjects adds values to init with +, mirroring Array#sum. Once a
+// Float is involved, each run of numbers is added with compensated
+// summation, as Ruby does, so [0.1, 0.2, 0.3].sum is 0.6.
+func sumObjects(init object.Object, values []object.Object) object.Object {
+	acc := init
+	for i := 0; i < len(values); i++ {
+		val := values[i]
+		_, accFloat := acc.(*object.Float)
+		_, valFloat := val.(*object.Float)
+		if isNumeric(acc) && isNumeric(val) && (accFloat || valFloat) {
+			sum, n := kahanBabuskaSum(toFloat(acc), values[i:])
+			acc = &object.Float{Value: sum}
+			i += n - 1
+			continue
+		}
+		if isNumeric(acc) && !isNumeric(val) {
+			return newError("TypeError: %s can't be coerced into %s",
+				comparisonOperandName(val), comparisonOperandName(acc))
+		}
+		acc = evalInfixExpression("+", acc, val)
+		if isError(acc) {
+			return acc
+		}
+	}
+	return acc
+}
+
+// kahanBabuskaSum adds the numbers that values starts with to sum,
+// carrying the rounding error of each addition along separately. It
+// returns the total and how many values it added.
+func kahanBabuskaSum(sum float64, values []object.Object) (float64, int) {
+	compensation := 0.0
+	n := 0
+	for ; n < len(values) && isNumeric(values[n]); n++ {
+		x := toFloat(values[n])
+		switch {
+		case math.IsNaN(sum):
+			continue
+		case math.IsNaN(x):
+			sum = x
+			continue
+		case math.IsInf(x, 0):
+			if math.IsInf(sum, 0) && math.Signbit(x) != math.Signbit(sum) {
+				sum = math.NaN()
+			} else {
+				sum = x
+			}
+			continue
+		case math.IsInf(sum, 0):
+			continue
+		}
+		t := sum + x
+		if math.Abs(sum) >= math.Abs(x) {
+			compensation += (sum - t) + x
+		} else {
+			compensation += (x - t) + sum
+		}
+		sum = t
+	}
+	return sum + compensation, n
+}
+
+// yieldValues calls the block once per value. It returns nil when every call
+// completed, or the break value or error that stopped the iteration.
+func yieldValues(block *object.Proc, values []object.Object, env *object.Environment) object.Object {
+	for _, val := range values {
+		result := callBlock(block, []object.Object{val}, env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			return bv.Value
+		}
+		if isError(result) {
+			return result
+		}
+	}
+	return nil
+}
+
+// combinations returns the k-element combinations of elements in order.
+func combinations(elements []object.Object, k int) []object.Object {
+	var result []object.Object
+	if k < 0 || k > len(elements) {
+		return result
+	}
+	indices := make([]int, k)
+	var build func(start, depth int)
+	build = func(start, depth int) {
+		if depth == k {
+			combo := make([]object.Object, k)
+			for i, idx := range indices {
+				combo[i] = elements[idx]
+			}
+			result = append(result, &object.Array{Elements: combo})
+			return
+		}
+		for i := start; i < len(elements); i++ {
+			indices[depth] = i
+			build(i+1, depth+1)
+		}
+	}
+	build(0, 0)
+	return result
+}
+
+// permutations returns the k-element permutations of elements in order.
+func permutations(elements []object.Object, k int) []object.Object {
+	var result []object.Object
+	if k < 0 || k > len(elements) {
+		return result
+	}
+	used := make([]bool, len(elements))
+	current := make([]object.Object, 0, k)
+	var build func()
+	build = func() {
+		if len(current) == k {
+			perm := make([]object.Object, k)
+			copy(perm, current)
+			result = append(result, &object.Array{Elements: perm})
+			return
+		}
+		for i, elem := range elements {
+			if used[i] {
+				continue
+			}
+			used[i] = true
+			current = append(current, elem)
+			build()
+			current = current[:len(current)-1]
+			used[i] = false
+		}
+	}
+	build()
+	return result
+}
+
+// cartesianProduct returns every combination taking one element from each list.
+func cartesianProduct(lists [][]object.Object) []object.Object {
+	result := []object.Object{&object.Array{Elements: []object.Object{}}}
+	for _, list := range lists {
+		var next []object.Object
+		for _, prefix := range result {
+			for _, elem := range list {
+				tuple := make([]object.Object, 0, len(prefix.(*object.Array).Elements)+1)
+				tuple = append(tuple, prefix.(*object.Array).Elements...)
+				tuple = append(tuple, elem)
+				next = append(next, &object.Array{Elements: tuple})
+			}
+		}
+		result = next
+	}
+	return result
+}
+
+// arrayArguments converts method arguments to arrays, as Array#zip and
+// Array#product require.
+func arrayArguments(args []object.Object) ([][]object.Object, object.Object) {
+	lists := make([][]object.Object, len(args))
+	for i, arg := range args {
+		switch a := arg.(type) {
+		case *object.Array:
+			lists[i] = a.Elements
+		case *object.Range:
+			lists[i] = expandRange(a)
+		default:
+			return nil, newError("TypeError: wrong argument type %s (must respond to :each)", comparisonOperandName(arg))
+		}
+	}
+	return lists, nil
+}
+
+// flatMapArray maps each element through the block and flattens array
+// results by one level, as Array#flat_map does.
+func flatMapArray(arr *object.Array, env *object.Environment) object.Object {
+	block := env.Block()
+	if block == nil {
+		return arr
+	}
+	newElements := make([]object.Object, 0, len(arr.Elements))
+	for _, elem := range arr.Elements {
+		result := callBlock(block, []object.Object{elem}, env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			return bv.Value
+		}
+		if isError(result) {
+			return result
+		}
+		if inner, ok := result.(*object.Array); ok {
+			newElements = append(newElements, inner.Elements...)
+		} else {
+			newElements = append(newElements, result)
+		}
+	}
+	return &object.Array{Elements: newElements}
+}
+
+// hashSet stores value under key, keeping insertion order for new keys.
+func hashSet(hash *object.Hash, key, value object.Object) object.Object {
+	hashed, ok := hash.KeyFor(key)
+	if !ok {
+		return newError("unusable as hash key: %s", key.Type())
+	}
+	if _, exists := hash.Pairs[hashed]; !exists {
+		hash.Order = append(hash.Order, hashed)
+	}
+	hash.Pairs[hashed] = object.HashPair{Key: key, Value: value}
+	return nil
+}
+
+// hashGet returns the value stored under key, if any.
+func hashGet(hash *object.Hash, key object.Object) (object.Object, bool) {
+	hashed, ok := hash.KeyFor(key)
+	if !ok {
+		return nil, false
+	}
+	pair, exists := hash.Pairs[hashed]
+	if !exists {
+		return nil, false
+	}
+	return pair.Value, true
+}
+
+func newHash() *object.Hash {
+	return &object.Hash{Pairs: make(map[object.HashKey]object.HashPair), Order: []object.HashKey{}}
+}
+
+// sliceArrayBetween implements chunk_while and slice_when. The block is called
+// with each pair of adjacent elements and a new chunk starts whenever its
+// truthiness equals splitOn.
+func sliceArrayBetween(arr *object.Array, env *object.Environment, splitOn bool) object.Object {
+	block := env.Block()
+	if block == nil {
+		return newError("ArgumentError: tried to create Proc object without a block")
+	}
+	chunks := make([]object.Object, 0)
+	if len(arr.Elements) == 0 {
+		return &object.Enumerator{Object: arr, Method: "each", Values: chunks}
+	}
+	current := []object.Object{arr.Elements[0]}
+	for i := 1; i < len(arr.Elements); i++ {
+		result := callBlock(block, []object.Object{arr.Elements[i-1], arr.Elements[i]}, env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			return bv.Value
+		}
+		if isError(result) {
+			return result
+		}
+		if isTruthy(result) == splitOn {
+			chunks = append(chunks, &object.Array{Elements: current})
+			current = []object.Object{}
+		}
+		current = append(current, arr.Elements[i])
+	}
+	chunks = append(chunks, &object.Array{Elements: current})
+	return &object.Enumerator{Object: arr, Method: "each", Values: chunks}
+}
+
+// countArgument reads the single non-negative count taken by take and drop.
+func countArgument(args []object.Object, verb string) (int, object.Object) {
+	if len(args) != 1 {
+		return 0, newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+	}
+	n, ok := args[0].(*object.Integer)
+	if !ok {
+		return 0, newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+	}
+	if n.Value < 0 {
+		return 0, newError("ArgumentError: attempt to %s negative size", verb)
+	}
+	return int(n.Value), nil
+}
+
+// countWhile returns the length of the leading run of elements for which
+// the block is truthy.
+func countWhile(block *object.Proc, elements []object.Object, env *object.Environment) (int, object.Object) {
+	for i, elem := range elements {
+		result := callBlock(block, []object.Object{elem}, env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			return 0, bv.Value
+		}
+		if isError(result) {
+			return 0, result
+		}
+		if !isTruthy(result) {
+			return i, nil
+		}
+	}
+	return len(elements), nil
+}
+
+// rotateObjects returns elements rotated left by the optional count argument
+// (default 1); negative counts rotate right.
+func rotateObjects(elements []object.Object, args []object.Object) ([]object.Object, object.Object) {
+	count := int64(1)
+	if len(args) > 0 {
+		n, ok := args[0].(*object.Integer)
+		if !ok {
+			return nil, newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+		}
+		count = n.Value
+	}
+	rotated := make([]object.Object, len(elements))
+	if len(elements) == 0 {
+		return rotated, nil
+	}
+	shift := int(((count % int64(len(elements))) + int64(len(elements))) % int64(len(elements)))
+	copy(rotated, elements[shift:])
+	copy(rotated[len(elements)-shift:], elements[:shift])
+	return rotated, nil
+}
+
+// digObject follows keys through nested arrays, hashes and objects that
+// respond to dig, stopping at the first nil.
+func digObject(obj object.Object, keys []object.Object) object.Object {
+	if len(keys) == 0 {
+		return newError("ArgumentError: wrong number of arguments (given 0, expected 1+)")
+	}
+	current := obj
+	for i, key := range keys {
+		switch c := current.(type) {
+		case *object.Array:
+			idx, ok := key.(*object.Integer)
+			if !ok {
+				return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(key))
+			}
+			current = evalArrayIndex(c, idx)
+		case *object.Hash:
+			current = evalHashIndex(c, key)
+		case *object.Instance:
+			if result, ok := callInstanceMethod(c, "dig", keys[i:]...); ok {
+				return result
+			}
+			current = evalIndex(c, key)
+		default:
+			return newError("TypeError: %s does not have #dig method", c.Class().Name)
+		}
+		if isError(current) || current == object.NIL {
+			return current
+		}
+	}
+	return current
+}
+
+// rangeBounds resolves an integer range against a sequence of the given
+// length, returning a half-open [start, end) span. start is -1 when the
+// range begins outside the sequence.
+func rangeBounds(r *object.Range, length int) (int, int, object.Object) {
+	first, ok := r.Start.(*object.Integer)
+	if !ok {
+		return 0, 0, newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(r.Start))
+	}
+	start := int(first.Value)
+	end := length
+	if last, ok := r.End.(*object.Integer); ok {
+		end = int(last.Value)
+		if end < 0 {
+			end += length
+		}
+		if !r.Exclusive {
+			end++
+		}
+	} else if r.End != object.NIL {
+		return 0, 0, newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(r.End))
+	}
+	if start < 0 {
+		start += length
+		if start < 0 {
+			return -1, 0, nil
+		}
+	}
+	if end < start {
+		end = start
+	}
+	return start, end, nil
+}
+
+// fillBounds resolves the start/length or range arguments of Array#fill.
+func fillBounds(args []object.Object, length int) (int, int, object.Object) {
+	if len(args) == 0 || args[0] == object.NIL {
+		if len(args) > 1 {
+			if n, ok := args[1].(*object.Integer); ok {
+				return 0, int(n.Value), nil
+			}
+		}
+		return 0, length, nil
+	}
+	if r, ok := args[0].(*object.Range); ok {
+		start, end, err := rangeBounds(r, length)
+		if err != nil {
+			return 0, 0, err
+		}
+		if start < 0 {
+			return 0, 0, newError("RangeError: %s out of range", r.Inspect())
+		}
+		return start, end, nil
+	}
+	first, ok := args[0].(*object.Integer)
+	if !ok {
+		return 0, 0, newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+	}
+	start := int(first.Value)
+	if start < 0 {
+		start += length
+		if start < 0 {
+			start = 0
+		}
+	}
+	end := length
+	if len(args) > 1 && args[1] != object.NIL {
+		n, ok := args[1].(*object.Integer)
+		if !ok {
+			return 0, 0, newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[1]))
+		}
+		end = start + int(n.Value)
+	}
+	if end < start {
+		end = start
+	}
+	return start, end, nil
+}
+
+// blockExtremes is arrayExtremes for min/max/minmax called with a
+// comparison block.
+func blockExtremes(elements []object.Object, sign int, args []object.Object, block *object.Proc, env *object.Environment) object.Object {
+	if len(args) > 0 {
+		n, ok := args[0].(*object.Integer)
+		if !ok {
+			return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+		}
+		if n.Value < 0 {
+			return newError("ArgumentError: negative size (%d)", n.Value)
+		}
+		sorted := make([]object.Object, len(elements))
+		copy(sorted, elements)
+		if err := sortObjects(sorted, block, env); err != nil {
+			return err
+		}
+		if sign > 0 {
+			for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+				sorted[i], sorted[j] = sorted[j], sorted[i]
+			}
+		}
+		if int(n.Value) < len(sorted) {
+			sorted = sorted[:n.Value]
+		}
+		return &object.Array{Elements: sorted}
+	}
+
+	if len(elements) == 0 {
+		return object.NIL
+	}
+	best := elements[0]
+	for _, elem := range elements[1:] {
+		c, err := compareWithBlock(block, elem, best, env)
+		if err != nil {
+			return err
+		}
+		if c*sign > 0 {
+			best = elem
+		}
+	}
+	return best
+}
+
+// uniqObjects removes duplicates from elements, comparing the block's
+// result for each element when a block is given.
+func uniqObjects(elements []object.Object, block *object.Proc, env *object.Environment) ([]object.Object, object.Object) {
+	keys := elements
+	if block != nil {
+		var stop object.Object
+		keys, stop = blockKeys(block, elements, env)
+		if stop != nil {
+			return nil, stop
+		}
+	}
+	seen := make(map[string]bool)
+	unique := make([]object.Object, 0, len(elements))
+	for i, elem := range elements {
+		key := eqlKey(keys[i])
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, elem)
+		}
+	}
+	return unique, nil
 }
 
-func initKernelMethods() {
-	for name, builtin := range getKernelBuiltins() {
-		object.KernelModule.Methods[name] = builtin
+// findArrayIndex returns the index of the first element equal to args[0],
+// or of the first element for which the block is truthy.
+func findArrayIndex(arr *object.Array, args []object.Object, env *object.Environment) object.Object {
+	block := env.Block()
+	if len(args) == 0 && block == nil {
+		return &object.Enumerator{Object: arr, Method: "find_index", Values: arr.Elements}
+	}
+	for i, elem := range arr.Elements {
+		var found bool
+		if len(args) > 0 {
+			found = objectsEqual(elem, args[0])
+		} else {
+			result := callBlock(block, []object.Object{elem}, env)
+			if bv, ok := result.(*object.BreakValue); ok {
+				return bv.Value
+			}
+			if isError(result) {
+				return result
+			}
+			found = isTruthy(result)
+		}
+		if found {
+			return &object.Integer{Value: int64(i)}
+		}
 	}
+	return object.NIL
 }
 
-func init() {
-	initKernelMethods()
+// joinArray converts each element to a string and joins them with sep.
+func joinArray(arr *object.Array, sep string) object.Object {
+	parts := make([]string, len(arr.Elements))
+	for i, elem := range arr.Elements {
+		str, err := convertToString(elem)
+		if err != nil {
+			return err
+		}
+		parts[i] = str
+	}
+	return &object.String{Value: strings.Join(parts, sep)}
 }
 
-// callUserMethod calls a user-defined method with a specific receiver
-func callUserMethod(method *object.Method, receiver object.Object, args []object.Object, env *object.Environment) object.Object {
-	methodEnv := object.NewEnclosedEnvironment(method.Env)
-	methodEnv.SetSelf(receiver)
+// eqlKey returns a key under which objects that are eql? collide, using a
+// user-defined hash method when the object has one.
+func eqlKey(obj object.Object) string {
+	if inst, ok := obj.(*object.Instance); ok {
+		if result, ok := callInstanceMethod(inst, "hash"); ok && !isError(result) {
+			return "hash:" + result.Inspect()
+		}
+	}
+	return string(obj.Type()) + ":" + obj.Inspect()
+}
 
-	// Bind parameters
-	for i, param := range method.Parameters {
-		if i < len(args) {
-			methodEnv.Set(param.Name, args[i])
-		} else if param.Default != nil {
-			// Use default value
-			defaultVal := Eval(param.Default, methodEnv)
-			methodEnv.Set(param.Name, defaultVal)
-		} else {
-			methodEnv.Set(param.Name, object.NIL)
+// eqlKeySet returns the set of eqlKey values of the given lists.
+func eqlKeySet(lists ...[]object.Object) map[string]bool {
+	set := make(map[string]bool)
+	for _, list := range lists {
+		for _, elem := range list {
+			set[eqlKey(elem)] = true
+		}
+	}
+	return set
+}
+
+// arrayUnion returns the unique elements of elements followed by those of
+// others, in order of first appearance.
+func arrayUnion(elements []object.Object, others ...[]object.Object) object.Object {
+	all := append([]object.Object{}, elements...)
+	for _, other := range others {
+		all = append(all, other...)
+	}
+	unique, _ := uniqObjects(all, nil, nil)
+	return &object.Array{Elements: unique}
+}
+
+// arrayIntersection returns the unique elements present in every array.
+func arrayIntersection(elements []object.Object, others ...[]object.Object) object.Object {
+	unique, _ := uniqObjects(elements, nil, nil)
+	for _, other := range others {
+		set := eqlKeySet(other)
+		kept := make([]object.Object, 0, len(unique))
+		for _, elem := range unique {
+			if set[eqlKey(elem)] {
+				kept = append(kept, elem)
+			}
 		}
+		unique = kept
 	}
+	return &object.Array{Elements: unique}
+}
 
-	result := evalBlockBody(method.Body, methodEnv)
-	if rv, ok := result.(*object.ReturnValue); ok {
-		return rv.Value
+// arrayDifference returns elements not present in any of the other arrays,
+// keeping duplicates.
+func arrayDifference(elements []object.Object, others ...[]object.Object) object.Object {
+	set := eqlKeySet(others...)
+	kept := make([]object.Object, 0, len(elements))
+	for _, elem := range elements {
+		if !set[eqlKey(elem)] {
+			kept = append(kept, elem)
+		}
+	}
+	return &object.Array{Elements: kept}
+}
+
+// objectHash implements Object#hash: equal values hash alike, and other
+// objects hash by identity.
+func objectHash(obj object.Object) int64 {
+	h := fnv.New64a()
+	if hashable, ok := obj.(object.Hashable); ok {
+		key := hashable.HashKey()
+		fmt.Fprintf(h, "%s:%d", key.Type, key.Value)
+	} else {
+		fmt.Fprintf(h, "%p", obj)
+	}
+	return int64(h.Sum64() >> 1)
+}
+
+// transformHash implements transform_keys and transform_values, returning a
+// new hash. Keys may also be renamed through a mapping hash argument, with
+// the block (if any) applied to keys the mapping does not cover.
+func transformHash(hash *object.Hash, keys bool, args []object.Object, env *object.Environment) object.Object {
+	block := env.Block()
+	var mapping *object.Hash
+	if keys && len(args) > 0 {
+		m, ok := args[0].(*object.Hash)
+		if !ok {
+			return newError("TypeError: no implicit conversion of %s into Hash", comparisonOperandName(args[0]))
+		}
+		mapping = m
+	}
+	if block == nil && mapping == nil {
+		method := "transform_values"
+		if keys {
+			method = "transform_keys"
+		}
+		return newEnumerator(hash, method, args)
+	}
+
+	result := newHash()
+	for _, hk := range hash.Order {
+		pair := hash.Pairs[hk]
+		key, value := pair.Key, pair.Value
+		var target *object.Object
+		if keys {
+			target = &key
+		} else {
+			target = &value
+		}
+		if renamed, ok := lookupMapping(mapping, key); ok {
+			*target = renamed
+		} else if block != nil {
+			transformed := callBlock(block, []object.Object{*target}, env)
+			if bv, ok := transformed.(*object.BreakValue); ok {
+				return bv.Value
+			}
+			if isError(transformed) {
+				return transformed
+			}
+			*target = transformed
+		}
+		if err := hashSet(result, key, value); err != nil {
+			return err
+		}
 	}
 	return result
 }
 
-// convertMethodParamsToBlockParams converts method parameters to block parameters
-func convertMethodParamsToBlockParams(params []*ast.MethodParameter) []*ast.BlockParameter {
-	blockParams := make([]*ast.BlockParameter, len(params))
-	for i, p := range params {
-		blockParams[i] = &ast.BlockParameter{
-			Name: p.Name,
+// lookupMapping returns the value for key in mapping, which may be nil.
+func lookupMapping(mapping *object.Hash, key object.Object) (object.Object, bool) {
+	if mapping == nil {
+		return nil, false
+	}
+	return hashGet(mapping, key)
+}
+
+// hashPairs returns the hash's entries as [key, value] arrays in order.
+func hashPairs(hash *object.Hash) []object.Object {
+	pairs := make([]object.Object, 0, len(hash.Order))
+	for _, key := range hash.Order {
+		pair := hash.Pairs[key]
+		pairs = append(pairs, &object.Array{Elements: []object.Object{pair.Key, pair.Value}})
+	}
+	return pairs
+}
+
+// hashEnumerable returns a Hash builtin that runs the Array method of the
+// same name over the hash's [key, value] pairs.
+func hashEnumerable(name string) *object.Builtin {
+	return &object.Builtin{
+		Name: name,
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			pairs := &object.Array{Elements: hashPairs(receiver.(*object.Hash))}
+			return getArrayBuiltins()[name].Fn(pairs, env, args...)
+		},
+	}
+}
+
+// filterHashKeys calls the block with each pair and returns, in order, the
+// keys whose result has the truthiness of keep. A break or error from the
+// block is returned as the second value.
+func filterHashKeys(hash *object.Hash, block *object.Proc, env *object.Environment, keep bool) ([]object.HashKey, object.Object) {
+	order := make([]object.HashKey, 0, len(hash.Order))
+	for _, key := range hash.Order {
+		pair := hash.Pairs[key]
+		result := callBlock(block, []object.Object{&object.Array{Elements: []object.Object{pair.Key, pair.Value}}}, env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			return nil, bv.Value
+		}
+		if isError(result) {
+			return nil, result
+		}
+		if isTruthy(result) == keep {
+			order = append(order, key)
 		}
 	}
-	return blockParams
+	return order, nil
 }
 
-// Error builtins
+// filterHashInPlace implements keep_if, delete_if, select! and reject!,
+// removing the pairs filterHashKeys drops from both Pairs and Order. The
+// bang forms return nil when nothing was removed.
+func filterHashInPlace(receiver object.Object, method string, keep, nilIfUnchanged bool, args []object.Object, env *object.Environment) object.Object {
+	hash := receiver.(*object.Hash)
+	block := env.Block()
+	if block == nil {
+		return newEnumerator(receiver, method, args)
+	}
+	order, stop := filterHashKeys(hash, block, env, keep)
+	if stop != nil {
+		return stop
+	}
+	if len(order) == len(hash.Order) {
+		if nilIfUnchanged {
+			return object.NIL
+		}
+		return hash
+	}
+	kept := make(map[object.HashKey]bool, len(order))
+	for _, key := range order {
+		kept[key] = true
+	}
+	for _, key := range hash.Order {
+		if !kept[key] {
+			delete(hash.Pairs, key)
+		}
+	}
+	hash.Order = order
+	return hash
+}
 
-var errorBuiltinsOnce sync.Once
-var errorBuiltinsMap map[string]*object.Builtin
+// mergeHashes copies the pairs of each hash in others into target. When a
+// block is given, a key present in both is resolved by calling it with the
+// key, the old value and the new value.
+func mergeHashes(target *object.Hash, others []object.Object, env *object.Environment) object.Object {
+	block := env.Block()
+	for _, arg := range others {
+		other, ok := arg.(*object.Hash)
+		if !ok {
+			return newError("TypeError: no implicit conversion of %s into Hash", comparisonOperandName(arg))
+		}
+		for _, key := range other.Order {
+			pair := other.Pairs[key]
+			existing, exists := target.Pairs[key]
+			if !exists {
+				target.Order = append(target.Order, key)
+			} else if block != nil {
+				resolved := callBlock(block, []object.Object{pair.Key, existing.Value, pair.Value}, env)
+				if bv, ok := resolved.(*object.BreakValue); ok {
+					return bv.Value
+				}
+				if isError(resolved) {
+					return resolved
+				}
+				pair.Value = resolved
+			}
+			target.Pairs[key] = pair
+		}
+	}
+	return nil
+}
 
-func getErrorBuiltins() map[string]*object.Builtin {
-	errorBuiltinsOnce.Do(func() {
-		errorBuiltinsMap = map[string]*object.Builtin{
-			"message": {
-				Name: "message",
-				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					err := receiver.(*object.Error)
-					return &object.String{Value: err.Message}
-				},
-			},
-			"to_s": {
-				Name: "to_s",
-				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					err := receiver.(*object.Error)
-					return &object.String{Value: err.Message}
-				},
-			},
-			"backtrace": {
-				Name: "backtrace",
-				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-					err := receiver.(*object.Error)
-					elements := make([]object.Object, len(err.Backtrace))
-					for i, line := range err.Backtrace {
-						elements[i] = &object.String{Value: line}
-					}
-					return &object.Array{Elements: elements}
-				},
-			},
+func initHashClassMethods() {
+	object.HashClass.ClassMethods["[]"] = &object.Builtin{
+		Name: "[]",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) == 1 {
+				switch src := args[0].(type) {
+				case *object.Hash:
+					return pairsToHash(hashPairs(src), env)
+				case *object.Array:
+					return pairsToHash(src.Elements, env)
+				}
+			}
+			if len(args)%2 != 0 {
+				return newError("ArgumentError: odd number of arguments for Hash")
+			}
+			hash := newHash()
+			for i := 0; i < len(args); i += 2 {
+				if err := hashSet(hash, args[i], args[i+1]); err != nil {
+					return err
+				}
+			}
+			return hash
+		},
+	}
+
+	object.HashClass.ClassMethods["new"] = &object.Builtin{
+		Name: "new",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			hash := newHash()
+			if block := env.Block(); block != nil {
+				if len(args) > 0 {
+					return newError("ArgumentError: wrong number of arguments (given %d, expected 0)", len(args))
+				}
+				hash.DefaultProc = block
+			} else if len(args) > 0 {
+				hash.Default = args[0]
+			}
+			return hash
+		},
+	}
+}
+
+// hashFetch implements Hash#fetch. A missing key yields the block's result
+// for that key, then the fallback argument, and otherwise raises KeyError;
+// the hash's own default is never consulted.
+func hashFetch(hash *object.Hash, key object.Object, fallback []object.Object, env *object.Environment) object.Object {
+	if value, ok := hashGet(hash, key); ok {
+		return value
+	}
+	if block := env.Block(); block != nil {
+		result := callBlock(block, []object.Object{key}, env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			return bv.Value
+		}
+		return result
+	}
+	if len(fallback) > 0 {
+		return fallback[0]
+	}
+	return &object.Error{Message: fmt.Sprintf("key not found: %s", key.Inspect()), Class_: object.KeyErrorClass}
+}
+
+// pairsToHash builds a hash from [key, value] arrays, as Array#to_h does.
+// With a block, each element is first mapped to its pair by the block.
+func pairsToHash(elements []object.Object, env *object.Environment) object.Object {
+	block := env.Block()
+	hash := newHash()
+	for i, elem := range elements {
+		if block != nil {
+			elem = callBlock(block, []object.Object{elem}, env)
+			if bv, ok := elem.(*object.BreakValue); ok {
+				return bv.Value
+			}
+			if isError(elem) {
+				return elem
+			}
+		}
+		pair, ok := elem.(*object.Array)
+		if !ok {
+			return newError("TypeError: wrong element type %s at %d (expected array)", comparisonOperandName(elem), i)
+		}
+		if len(pair.Elements) != 2 {
+			return newError("ArgumentError: wrong array length at %d (expected 2, was %d)", i, len(pair.Elements))
+		}
+		if err := hashSet(hash, pair.Elements[0], pair.Elements[1]); err != nil {
+			return err
+		}
+	}
+	return hash
+}
+
+// stringSucc implements String#succ: the rightmost alphanumeric is
+// incremented, carrying leftwards over alphanumerics ("az" -> "ba",
+// "zz" -> "aaa", "a9" -> "b0"). Strings without alphanumerics increment
+// their last character.
+func stringSucc(s string) string {
+	runes := []rune(s)
+	if len(runes) == 0 {
+		return ""
+	}
+
+	isAlnum := func(r rune) bool {
+		return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+	}
+
+	i := len(runes) - 1
+	for i >= 0 && !isAlnum(runes[i]) {
+		i--
+	}
+	if i < 0 {
+		runes[len(runes)-1]++
+		return string(runes)
+	}
+
+	for {
+		var carry rune
+		switch r := runes[i]; {
+		case r == 'z':
+			runes[i], carry = 'a', 'a'
+		case r == 'Z':
+			runes[i], carry = 'A', 'A'
+		case r == '9':
+			runes[i], carry = '0', '1'
+		default:
+			runes[i]++
+			return string(runes)
+		}
+
+		// Carry into the next alphanumeric to the left, or prepend one
+		j := i - 1
+		for j >= 0 && !isAlnum(runes[j]) {
+			j--
+		}
+		if j < 0 {
+			runes = append(runes[:i], append([]rune{carry}, runes[i:]...)...)
+			return string(runes)
+		}
+		i = j
+	}
+}
+
+// clampNumber implements Comparable#clamp for numbers, taking either min
+// and max arguments or an inclusive Range.
+func clampNumber(receiver object.Object, args []object.Object) object.Object {
+	var min, max object.Object
+	switch len(args) {
+	case 1:
+		r, ok := args[0].(*object.Range)
+		if !ok {
+			return newError("TypeError: wrong argument type %s (expected Range)", comparisonOperandName(args[0]))
+		}
+		if r.Exclusive && r.End != object.NIL {
+			return newError("ArgumentError: cannot clamp with an exclusive range")
+		}
+		min, max = r.Start, r.End
+	case 2:
+		min, max = args[0], args[1]
+	default:
+		return newError("ArgumentError: wrong number of arguments (given %d, expected 1..2)", len(args))
+	}
+
+	if min != object.NIL && max != object.NIL {
+		c, err := compareObjects(min, max)
+		if err != nil {
+			return err
+		}
+		if c > 0 {
+			return newError("ArgumentError: min argument must be less than or equal to max argument")
+		}
+	}
+	if min != object.NIL {
+		c, err := compareObjects(receiver, min)
+		if err != nil {
+			return err
+		}
+		if c < 0 {
+			return min
 		}
+	}
+	if max != object.NIL {
+		c, err := compareObjects(receiver, max)
+		if err != nil {
+			return err
+		}
+		if c > 0 {
+			return max
+		}
+	}
+	return receiver
+}
+
+// yieldRange calls the block with each value of r, passing each result to
+// collect when it is non-nil. It returns nil when the range was exhausted,
+// or the break value or error that stopped it.
+func yieldRange(r *object.Range, block *object.Proc, env *object.Environment, collect func(val, result object.Object)) object.Object {
+	stop := iterateRange(r, func(val object.Object) object.Object {
+		result := callBlock(block, []object.Object{val}, env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			return bv
+		}
+		if isError(result) {
+			return result
+		}
+		if collect != nil {
+			collect(val, result)
+		}
+		return nil
 	})
-	return errorBuiltinsMap
+	if bv, ok := stop.(*object.BreakValue); ok {
+		return bv.Value
+	}
+	return stop
 }
 
-// evalCode evaluates code in the given environment (for Kernel.eval)
-func evalCode(code string, env *object.Environment) object.Object {
-	l := lexer.New(code)
-	p := parser.New(l)
-	program := p.ParseProgram()
+// mapRange implements Range#map and collect.
+func mapRange(receiver object.Object, method string, env *object.Environment, args []object.Object) object.Object {
+	block := env.Block()
+	if block == nil {
+		return newEnumerator(receiver, method, args)
+	}
+	results := []object.Object{}
+	if stop := yieldRange(receiver.(*object.Range), block, env, func(val, result object.Object) {
+		results = append(results, result)
+	}); stop != nil {
+		return stop
+	}
+	return &object.Array{Elements: results}
+}
 
-	if len(p.Errors()) > 0 {
-		return newError("SyntaxError: %s", p.Errors()[0])
+// filterRange implements Range#select, filter and reject, keeping the values
+// whose block result has the truthiness of keep.
+func filterRange(receiver object.Object, method string, keep bool, env *object.Environment, args []object.Object) object.Object {
+	block := env.Block()
+	if block == nil {
+		return newEnumerator(receiver, method, args)
+	}
+	kept := []object.Object{}
+	if stop := yieldRange(receiver.(*object.Range), block, env, func(val, result object.Object) {
+		if isTruthy(result) == keep {
+			kept = append(kept, val)
+		}
+	}); stop != nil {
+		return stop
+	}
+	return &object.Array{Elements: kept}
+}
+
+// reduceRange implements Range#reduce and inject with an optional initial
+// value; without one the first value of the range seeds the accumulator.
+// A Symbol as the last argument names the method that combines the values
+// in place of a block.
+func reduceRange(r *object.Range, env *object.Environment, args []object.Object) object.Object {
+	block := env.Block()
+	var op *object.Symbol
+	if len(args) > 0 && (len(args) == 2 || block == nil) {
+		sym, ok := args[len(args)-1].(*object.Symbol)
+		if !ok {
+			return newError("TypeError: %s is not a symbol nor a string", args[len(args)-1].Inspect())
+		}
+		op = sym
+		args = args[:len(args)-1]
+	}
+	if block == nil && op == nil {
+		return newError("no block given")
+	}
+	var acc object.Object
+	if len(args) > 0 {
+		acc = args[0]
+	}
+	stop := iterateRange(r, func(val object.Object) object.Object {
+		if acc == nil {
+			acc = val
+			return nil
+		}
+		var result object.Object
+		if op != nil {
+			result = callMethod(acc, op.Value, []object.Object{val}, nil, env)
+		} else {
+			result = callBlock(block, []object.Object{acc, val}, env)
+		}
+		if bv, ok := result.(*object.BreakValue); ok {
+			return bv
+		}
+		if isError(result) {
+			return result
+		}
+		acc = result
+		return nil
+	})
+	if bv, ok := stop.(*object.BreakValue); ok {
+		return bv.Value
+	}
+	if stop != nil {
+		return stop
+	}
+	if acc == nil {
+		return object.NIL
+	}
+	return acc
+}
+
+// requiredArity returns the number of mandatory positional parameters of a
+// proc, lambda or method and whether it also accepts optional or rest ones.
+func requiredArity(fn object.Object) (int, bool) {
+	params := callableParams(fn)
+	if proc, ok := fn.(*object.Proc); ok && proc.Native == nil {
+		// curry waits for every positional parameter of a proc
+		params = blockParamInfo(proc.Parameters, true)
+	}
+	required := 0
+	variadic := false
+	for _, param := range params {
+		switch param.kind {
+		case "req":
+			required++
+		case "opt", "rest":
+			variadic = true
+		}
+	}
+	return required, variadic
+}
+
+// curryCallable implements Proc#curry and Method#curry. The optional
+// argument overrides the arity; lambdas and methods reject one they could
+// never be called with.
+func curryCallable(fn object.Object, args []object.Object) object.Object {
+	arity, variadic := requiredArity(fn)
+	if len(args) > 0 {
+		n, ok := args[0].(*object.Integer)
+		if !ok {
+			return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+		}
+		_, isProc := fn.(*object.Proc)
+		if !isProc && (int(n.Value) < arity || (!variadic && int(n.Value) != arity)) {
+			return newError("ArgumentError: wrong number of arguments (given %d, expected %d)", n.Value, arity)
+		}
+		arity = int(n.Value)
+	}
+	return curried(fn, arity, nil)
+}
+
+// curried returns a lambda that collects arguments until arity of them have
+// been given and then calls fn with all of them.
+func curried(fn object.Object, arity int, collected []object.Object) *object.Lambda {
+	return &object.Lambda{
+		Native: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			all := append(append([]object.Object{}, collected...), args...)
+			if len(all) >= arity {
+				return callMethod(fn, "call", all, nil, env)
+			}
+			return curried(fn, arity, all)
+		},
+	}
+}
+
+// isCallable reports whether obj is a proc, lambda or method object.
+func isCallable(obj object.Object) bool {
+	switch obj.Type() {
+	case object.PROC_OBJ, object.LAMBDA_OBJ, object.METHOD_OBJ, object.BOUND_METHOD_OBJ:
+		return true
+	}
+	return false
+}
+
+// composeCallables implements >> and << on procs and methods. f >> g calls
+// f first and passes its result to g; f << g does the reverse. The result is
+// a lambda unless f is a plain proc.
+func composeCallables(operator string, f, g object.Object) object.Object {
+	if !isCallable(g) && getBuiltinMethod(g, "call") == nil {
+		class := g.Class()
+		if class == nil {
+			return newError("TypeError: callable object is expected")
+		}
+		if _, ok := class.LookupMethod("call"); !ok {
+			return newError("TypeError: callable object is expected")
+		}
+	}
+	first, second := f, g
+	if operator == "<<" {
+		first, second = g, f
+	}
+	compose := func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+		result := callMethod(first, "call", args, nil, env)
+		if isError(result) {
+			return result
+		}
+		return callMethod(second, "call", []object.Object{result}, nil, env)
+	}
+	if _, ok := f.(*object.Proc); ok {
+		return &object.Proc{Native: compose}
+	}
+	return &object.Lambda{Native: compose}
+}
+
+// callProc implements Proc#call and its aliases, and calls method objects
+// the same way.
+func callProc(fn object.Object, args []object.Object, env *object.Environment) object.Object {
+	var result object.Object
+	switch proc := fn.(type) {
+	case *object.Proc:
+		result = callBlock(proc, args, env)
+	case *object.Lambda:
+		result = callBlock(&object.Proc{
+			Parameters: proc.Parameters,
+			Body:       proc.Body,
+			Env:        proc.Env,
+			Native:     proc.Native,
+		}, args, env)
+	case *object.Method, *object.BoundMethod:
+		return getMethodBuiltins()["call"].Fn(fn, env, args...)
+	default:
+		return newError("not a callable object")
+	}
+	if bv, ok := result.(*object.BreakValue); ok {
+		return bv.Value
+	}
+	return result
+}
+
+// paramInfo describes one parameter as reported by Method#parameters.
+type paramInfo struct {
+	kind string // req, opt, rest, keyreq, key, keyrest or block
+	name string // empty for builtins
+}
+
+// callableParams lists the parameters of a proc, lambda or method object.
+// Parameters of a plain proc are all optional, as in Ruby. Builtins without
+// a Params annotation and native lambdas report a single rest parameter.
+func callableParams(fn object.Object) []paramInfo {
+	unknown := []paramInfo{{kind: "rest"}}
+	switch f := fn.(type) {
+	case *object.Proc:
+		if f.Native != nil {
+			return unknown
+		}
+		return blockParamInfo(f.Parameters, false)
+	case *object.Lambda:
+		if f.Native != nil {
+			return unknown
+		}
+		return blockParamInfo(f.Parameters, true)
+	case *object.Method:
+		return methodParamInfo(f.Parameters)
+	case *object.BoundMethod:
+		if f.Method != nil {
+			return methodParamInfo(f.Method.Parameters)
+		}
+		if f.Builtin != nil && f.Builtin.Params != nil {
+			params := make([]paramInfo, len(f.Builtin.Params))
+			for i, kind := range f.Builtin.Params {
+				params[i] = paramInfo{kind: kind}
+			}
+			return params
+		}
+		return unknown
+	}
+	return nil
+}
+
+func blockParamInfo(params []*ast.BlockParameter, lambda bool) []paramInfo {
+	info := make([]paramInfo, 0, len(params))
+	for _, param := range params {
+		kind := "req"
+		switch {
+		case param.Splat:
+			kind = "rest"
+		case param.DSplat:
+			kind = "keyrest"
+		case param.Block:
+			kind = "block"
+		case param.Default != nil || !lambda:
+			kind = "opt"
+		}
+		info = append(info, paramInfo{kind: kind, name: param.Name})
+	}
+	return info
+}
+
+func methodParamInfo(params []*ast.MethodParameter) []paramInfo {
+	info := make([]paramInfo, 0, len(params))
+	for _, param := range params {
+		kind := "req"
+		switch {
+		case param.Splat:
+			kind = "rest"
+		case param.DSplat:
+			kind = "keyrest"
+		case param.Block:
+			kind = "block"
+		case param.KeywordOnly && param.Default != nil:
+			kind = "key"
+		case param.KeywordOnly:
+			kind = "keyreq"
+		case param.Default != nil:
+			kind = "opt"
+		}
+		info = append(info, paramInfo{kind: kind, name: param.Name})
+	}
+	return info
+}
+
+// callableArity implements Proc#arity and Method#arity: the number of
+// required arguments, or -(required + 1) when optional or rest parameters
+// are accepted. Required keywords count as one extra argument.
+func callableArity(fn object.Object) int {
+	params := callableParams(fn)
+	proc, isProc := fn.(*object.Proc)
+	if isProc && proc.Native == nil {
+		params = blockParamInfo(proc.Parameters, true)
 	}
+	required, keyRequired := 0, false
+	optional, keyOptional, rest := false, false, false
+	for _, param := range params {
+		switch param.kind {
+		case "req":
+			required++
+		case "opt":
+			optional = true
+		case "rest":
+			optional, rest = true, true
+		case "keyreq":
+			keyRequired = true
+		case "key", "keyrest":
+			keyOptional = true
+		}
+	}
+	if keyRequired {
+		required++
+	} else if keyOptional {
+		optional = true
+	}
+	if !optional {
+		return required
+	}
+	if isProc && required == 0 && !rest {
+		// A proc taking only optional parameters has arity 0, not -1
+		return 0
+	}
+	return -(required + 1)
+}
 
-	return Eval(program, env)
+// parametersArray builds the [[:req, :a], [:opt, :b]] array returned by
+// Proc#parameters and Method#parameters.
+func parametersArray(params []paramInfo) *object.Array {
+	elements := make([]object.Object, len(params))
+	for i, param := range params {
+		pair := []object.Object{&object.Symbol{Value: param.kind}}
+		if param.name != "" {
+			pair = append(pair, &object.Symbol{Value: param.name})
+		}
+		elements[i] = &object.Array{Elements: pair}
+	}
+	return &object.Array{Elements: elements}
 }
@@ -197,6 +197,10 @@ func classEvalFn(receiver object.Object, env *object.Environment, args ...object
 	if block == nil {
 		return newError("no block given")
 	}
+	// A proc with no Ruby body, like &:sym, gets the class as its argument
+	if block.Native != nil {
+		return callBlock(block, []object.Object{receiver}, env)
+	}
 
 	// Create new environment with self set to the class/module
 	evalEnv := object.NewEnclosedEnvironment(block.Env)
@@ -226,19 +230,8 @@ func getMethodName(arg object.Object) string {
 }
 
 func attrReaderFn(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-	class, ok := receiver.(*object.RubyClass)
-	if !ok {
-		if mod, ok := receiver.(*object.RubyModule); ok {
-			for _, arg := range args {
-				name := getMethodName(arg)
-				if name == "" {
-					return newError("no implicit conversion of %s into Symbol", arg.Type())
-				}
-				// Create getter method
-				mod.Methods[name] = createGetterMethod(name)
-			}
-			return object.NIL
-		}
+	methods := methodTable(receiver, env)
+	if methods == nil {
 		return newError("attr_reader called on non-class/module")
 	}
 
@@ -248,25 +241,14 @@ func attrReaderFn(receiver object.Object, env *object.Environment, args ...objec
 			return newError("no implicit conversion of %s into Symbol", arg.Type())
 		}
 		// Create getter method
-		class.Methods[name] = createGetterMethod(name)
+		methods[name] = createGetterMethod(name)
 	}
 	return object.NIL
 }
 
 func attrWriterFn(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-	class, ok := receiver.(*object.RubyClass)
-	if !ok {
-		if mod, ok := receiver.(*object.RubyModule); ok {
-			for _, arg := range args {
-				name := getMethodName(arg)
-				if name == "" {
-					return newError("no implicit conversion of %s into Symbol", arg.Type())
-				}
-				// Create setter method
-				mod.Methods[name+"="] = createSetterMethod(name)
-			}
-			return object.NIL
-		}
+	methods := methodTable(receiver, env)
+	if methods == nil {
 		return newError("attr_writer called on non-class/module")
 	}
 
@@ -276,7 +258,7 @@ func attrWriterFn(receiver object.Object, env *object.Environment, args ...objec
 			return newError("no implicit conversion of %s into Symbol", arg.Type())
 		}
 		// Create setter method
-		class.Methods[name+"="] = createSetterMethod(name)
+		methods[name+"="] = createSetterMethod(name)
 	}
 	return object.NIL
 }
@@ -287,13 +269,37 @@ func attrAccessorFn(receiver object.Object, env *object.Environment, args ...obj
 	return object.NIL
 }
 
+// methodTable returns the methods that attr_accessor, define_method and
+// the like add to on receiver: its instance methods, or inside
+// class << self its class methods. It returns nil for other objects.
+func methodTable(receiver object.Object, env *object.Environment) map[string]object.Object {
+	singleton := env.SingletonTarget() == receiver
+	switch recv := receiver.(type) {
+	case *object.RubyClass:
+		if singleton {
+			return recv.ClassMethods
+		}
+		return recv.Methods
+	case *object.RubyModule:
+		return recv.Methods
+	case *object.Instance:
+		if singleton {
+			if recv.SingletonMethods == nil {
+				recv.SingletonMethods = make(map[string]object.Object)
+			}
+			return recv.SingletonMethods
+		}
+	}
+	return nil
+}
+
 func createGetterMethod(name string) *object.Builtin {
 	ivarName := "@" + name
 	return &object.Builtin{
 		Name: name,
 		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-			if instance, ok := receiver.(*object.Instance); ok {
-				return instance.GetInstanceVariable(ivarName)
+			if holder, ok := receiver.(object.IvarHolder); ok {
+				return holder.GetInstanceVariable(ivarName)
 			}
 			return object.NIL
 		},
@@ -308,8 +314,8 @@ func createSetterMethod(name string) *object.Builtin {
 			if len(args) < 1 {
 				return newError("wrong number of arguments (given 0, expected 1)")
 			}
-			if instance, ok := receiver.(*object.Instance); ok {
-				instance.SetInstanceVariable(ivarName, args[0])
+			if holder, ok := receiver.(object.IvarHolder); ok {
+				holder.SetInstanceVariable(ivarName, args[0])
 				return args[0]
 			}
 			return newError("can't set instance variable on %s", receiver.Type())
@@ -410,6 +416,7 @@ func defineMethodFn(receiver object.Object, env *object.Environment, args ...obj
 				Parameters: p.Parameters,
 				Body:       p.Body,
 				Env:        p.Env,
+				Native:     p.Native,
 			}
 		default:
 			return newError("wrong argument type %s (expected Proc)", args[1].Type())
@@ -422,22 +429,28 @@ func defineMethodFn(receiver object.Object, env *object.Environment, args ...obj
 		}
 	}
 
-	// Convert proc to method
-	method := &object.Method{
+	// Convert proc to method. A proc with no Ruby body, like &:sym, is
+	// called with the receiver as its first argument
+	var method object.Object = &object.Method{
 		Name:       name,
 		Parameters: convertBlockParamsToMethodParams(proc.Parameters),
 		Body:       proc.Body,
 		Env:        proc.Env,
 	}
+	if proc.Native != nil {
+		method = &object.Builtin{
+			Name: name,
+			Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+				return callBlock(proc, append([]object.Object{receiver}, args...), env)
+			},
+		}
+	}
 
-	switch recv := receiver.(type) {
-	case *object.RubyClass:
-		recv.Methods[name] = method
-	case *object.RubyModule:
-		recv.Methods[name] = method
-	default:
+	methods := methodTable(receiver, env)
+	if methods == nil {
 		return newError("define_method called on non-class/module")
 	}
+	methods[name] = method
 
 	return &object.Symbol{Value: name}
 }
@@ -464,13 +477,8 @@ func aliasMethodFn(receiver object.Object, env *object.Environment, args ...obje
 		return newError("no implicit conversion into Symbol")
 	}
 
-	var methods map[string]object.Object
-	switch recv := receiver.(type) {
-	case *object.RubyClass:
-		methods = recv.Methods
-	case *object.RubyModule:
-		methods = recv.Methods
-	default:
+	methods := methodTable(receiver, env)
+	if methods == nil {
 		return newError("alias_method called on non-class/module")
 	}
 
@@ -490,13 +498,8 @@ func setVisibility(receiver object.Object, env *object.Environment, visibility o
 	}
 
 	// With args, change visibility of specific methods
-	var methods map[string]object.Object
-	switch recv := receiver.(type) {
-	case *object.RubyClass:
-		methods = recv.Methods
-	case *object.RubyModule:
-		methods = recv.Methods
-	default:
+	methods := methodTable(receiver, env)
+	if methods == nil {
 		return object.NIL
 	}
 
@@ -0,0 +1,1078 @@
+package evaluator
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// CSVClass represents Ruby's CSV class; instances are the writers yielded
+// by CSV.generate
+var CSVClass = &object.RubyClass{
+	Name:         "CSV",
+	Superclass:   object.ObjectClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+	Constants:    make(map[string]object.Object),
+}
+
+// CSVRowClass represents CSV::Row, a row of fields paired with headers
+var CSVRowClass = &object.RubyClass{
+	Name:         "CSV::Row",
+	Superclass:   object.ObjectClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// CSVTableClass represents CSV::Table, the rows parsed with headers: true
+var CSVTableClass = &object.RubyClass{
+	Name:         "CSV::Table",
+	Superclass:   object.ObjectClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// CSVMalformedErrorClass is raised for input that violates RFC 4180
+var CSVMalformedErrorClass = &object.RubyClass{
+	Name:         "CSV::MalformedCSVError",
+	Superclass:   object.RuntimeErrorClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// csvOptions holds the keyword options shared by the CSV entry points.
+type csvOptions struct {
+	colSep          string
+	rowSep          string
+	headers         object.Object // nil, TRUE for a header line, or an Array
+	headerConverter string
+	converters      []string
+	skipBlanks      bool
+	writeHeaders    bool
+}
+
+var (
+	csvIntegerPattern    = regexp.MustCompile(`^[-+]?\d+$`)
+	csvHeaderPunctuation = regexp.MustCompile(`[^\s\w]+`)
+	csvHeaderSpaces      = regexp.MustCompile(`\s+`)
+)
+
+func init() {
+	CSVClass.Constants["Row"] = CSVRowClass
+	CSVClass.Constants["Table"] = CSVTableClass
+	CSVClass.Constants["MalformedCSVError"] = CSVMalformedErrorClass
+
+	initCSVClassMethods()
+	initCSVWriterMethods()
+	initCSVRowMethods()
+	initCSVTableMethods()
+}
+
+func initCSVClassMethods() {
+	CSVClass.ClassMethods["parse"] = &object.Builtin{
+		Name: "parse",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			str, opts, err := csvSourceArgs(args)
+			if err != nil {
+				return err
+			}
+			return csvEachOrCollect(str, opts, env)
+		},
+	}
+
+	CSVClass.ClassMethods["parse_line"] = &object.Builtin{
+		Name: "parse_line",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			str, opts, err := csvSourceArgs(args)
+			if err != nil {
+				return err
+			}
+			rows, err := csvParse(str, opts)
+			if err != nil {
+				return err
+			}
+			if len(rows) == 0 {
+				return object.NIL
+			}
+			return rows[0]
+		},
+	}
+
+	CSVClass.ClassMethods["read"] = &object.Builtin{
+		Name: "read",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			str, opts, err := csvFileArgs(args)
+			if err != nil {
+				return err
+			}
+			rows, err := csvParse(str, opts)
+			if err != nil {
+				return err
+			}
+			return csvResult(rows, opts)
+		},
+	}
+
+	CSVClass.ClassMethods["readlines"] = CSVClass.ClassMethods["read"]
+
+	CSVClass.ClassMethods["table"] = &object.Builtin{
+		Name: "table",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			str, opts, err := csvFileArgs(args)
+			if err != nil {
+				return err
+			}
+			if opts.headers == nil {
+				opts.headers = object.TRUE
+			}
+			if opts.converters == nil {
+				opts.converters = []string{"numeric"}
+			}
+			if opts.headerConverter == "" {
+				opts.headerConverter = "symbol"
+			}
+			rows, err := csvParse(str, opts)
+			if err != nil {
+				return err
+			}
+			return csvResult(rows, opts)
+		},
+	}
+
+	CSVClass.ClassMethods["foreach"] = &object.Builtin{
+		Name: "foreach",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			str, opts, err := csvFileArgs(args)
+			if err != nil {
+				return err
+			}
+			if env.Block() == nil {
+				rows, err := csvParse(str, opts)
+				if err != nil {
+					return err
+				}
+				return &object.Enumerator{Object: receiver, Method: "foreach", Args: args, Values: rows}
+			}
+			return csvEachOrCollect(str, opts, env)
+		},
+	}
+
+	CSVClass.ClassMethods["generate"] = &object.Builtin{
+		Name: "generate",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			args, opts, err := csvOptionArgs(args)
+			if err != nil {
+				return err
+			}
+			output := &object.String{Value: ""}
+			if len(args) > 0 {
+				str, ok := args[0].(*object.String)
+				if !ok {
+					return newError("TypeError: no implicit conversion of %s into String", comparisonOperandName(args[0]))
+				}
+				output.Value = str.Value
+			}
+
+			block := env.Block()
+			if block == nil {
+				return newError("LocalJumpError: no block given (yield)")
+			}
+			writer := newCSVWriter(output, opts)
+			if headers, ok := opts.headers.(*object.Array); ok && opts.writeHeaders {
+				output.Value += csvFormatRow(headers.Elements, opts)
+			}
+			result := callBlock(block, []object.Object{writer}, env)
+			if _, ok := result.(*object.BreakValue); ok {
+				return result
+			}
+			if isError(result) {
+				return result
+			}
+			return output
+		},
+	}
+
+	CSVClass.ClassMethods["generate_line"] = &object.Builtin{
+		Name: "generate_line",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			args, opts, err := csvOptionArgs(args)
+			if err != nil {
+				return err
+			}
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			fields, err := csvRowFields(args[0], opts)
+			if err != nil {
+				return err
+			}
+			return &object.String{Value: csvFormatRow(fields, opts)}
+		},
+	}
+}
+
+// initCSVWriterMethods defines the methods of the writer yielded by
+// CSV.generate.
+func initCSVWriterMethods() {
+	CSVClass.Methods["<<"] = &object.Builtin{
+		Name: "<<",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			inst := receiver.(*object.Instance)
+			opts := csvWriterOptions(inst)
+			fields, err := csvRowFields(args[0], opts)
+			if err != nil {
+				return err
+			}
+			output := inst.InstanceVariables["@string"].(*object.String)
+			output.Value += csvFormatRow(fields, opts)
+			return receiver
+		},
+	}
+
+	CSVClass.Methods["add_row"] = CSVClass.Methods["<<"]
+	CSVClass.Methods["puts"] = CSVClass.Methods["<<"]
+
+	CSVClass.Methods["string"] = &object.Builtin{
+		Name: "string",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return receiver.(*object.Instance).InstanceVariables["@string"]
+		},
+	}
+
+	CSVClass.Methods["headers"] = &object.Builtin{
+		Name: "headers",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if headers, ok := receiver.(*object.Instance).InstanceVariables["@headers"]; ok {
+				return headers
+			}
+			return object.NIL
+		},
+	}
+}
+
+func initCSVRowMethods() {
+	CSVRowClass.ClassMethods["new"] = &object.Builtin{
+		Name: "new",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 2 {
+				return newError("wrong number of arguments (given %d, expected 2..3)", len(args))
+			}
+			headers, ok1 := args[0].(*object.Array)
+			fields, ok2 := args[1].(*object.Array)
+			if !ok1 || !ok2 {
+				return newError("TypeError: no implicit conversion into Array")
+			}
+			return newCSVRow(headers.Elements, fields.Elements)
+		},
+	}
+
+	CSVRowClass.Methods["[]"] = &object.Builtin{
+		Name: "[]",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 1 {
+				return newError("wrong number of arguments (given 0, expected 1..2)")
+			}
+			headers, fields := csvRowParts(receiver)
+			if i, ok := csvRowIndex(headers, fields, args[0]); ok {
+				return fields.Elements[i]
+			}
+			return object.NIL
+		},
+	}
+
+	CSVRowClass.Methods["field"] = CSVRowClass.Methods["[]"]
+
+	CSVRowClass.Methods["fetch"] = &object.Builtin{
+		Name: "fetch",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 1 {
+				return newError("wrong number of arguments (given 0, expected 1..2)")
+			}
+			headers, fields := csvRowParts(receiver)
+			if i, ok := csvRowIndex(headers, fields, args[0]); ok {
+				return fields.Elements[i]
+			}
+			if len(args) > 1 {
+				return args[1]
+			}
+			if block := env.Block(); block != nil {
+				return callBlock(block, []object.Object{args[0]}, env)
+			}
+			return newError("KeyError: key not found: %s", args[0].Inspect())
+		},
+	}
+
+	CSVRowClass.Methods["[]="] = &object.Builtin{
+		Name: "[]=",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 2 {
+				return newError("wrong number of arguments (given %d, expected 2)", len(args))
+			}
+			headers, fields := csvRowParts(receiver)
+			if i, ok := csvRowIndex(headers, fields, args[0]); ok {
+				fields.Elements[i] = args[1]
+				return args[1]
+			}
+			if _, ok := args[0].(*object.Integer); ok {
+				return newError("IndexError: index %s out of row", args[0].Inspect())
+			}
+			headers.Elements = append(headers.Elements, args[0])
+			fields.Elements = append(fields.Elements, args[1])
+			return args[1]
+		},
+	}
+
+	CSVRowClass.Methods["headers"] = &object.Builtin{
+		Name: "headers",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			headers, _ := csvRowParts(receiver)
+			return &object.Array{Elements: append([]object.Object{}, headers.Elements...)}
+		},
+	}
+
+	CSVRowClass.Methods["fields"] = &object.Builtin{
+		Name: "fields",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			headers, fields := csvRowParts(receiver)
+			if len(args) == 0 {
+				return &object.Array{Elements: append([]object.Object{}, fields.Elements...)}
+			}
+			values := make([]object.Object, len(args))
+			for i, key := range args {
+				values[i] = object.NIL
+				if j, ok := csvRowIndex(headers, fields, key); ok {
+					values[i] = fields.Elements[j]
+				}
+			}
+			return &object.Array{Elements: values}
+		},
+	}
+
+	CSVRowClass.Methods["values_at"] = CSVRowClass.Methods["fields"]
+
+	CSVRowClass.Methods["has_key?"] = &object.Builtin{
+		Name: "has_key?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			headers, _ := csvRowParts(receiver)
+			for _, header := range headers.Elements {
+				if objectsEqual(header, args[0]) {
+					return object.TRUE
+				}
+			}
+			return object.FALSE
+		},
+	}
+
+	CSVRowClass.Methods["header?"] = CSVRowClass.Methods["has_key?"]
+	CSVRowClass.Methods["include?"] = CSVRowClass.Methods["has_key?"]
+	CSVRowClass.Methods["key?"] = CSVRowClass.Methods["has_key?"]
+
+	CSVRowClass.Methods["each"] = &object.Builtin{
+		Name: "each",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			block := env.Block()
+			if block == nil {
+				return newEnumerator(receiver, "each", args)
+			}
+			headers, fields := csvRowParts(receiver)
+			for i, field := range fields.Elements {
+				pair := &object.Array{Elements: []object.Object{csvHeaderAt(headers, i), field}}
+				result := callBlock(block, []object.Object{pair}, env)
+				if _, ok := result.(*object.BreakValue); ok {
+					return result
+				}
+				if isError(result) {
+					return result
+				}
+			}
+			return receiver
+		},
+	}
+
+	CSVRowClass.Methods["to_h"] = &object.Builtin{
+		Name: "to_h",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			headers, fields := csvRowParts(receiver)
+			hash := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair)}
+			for i, field := range fields.Elements {
+				key := csvHeaderAt(headers, i)
+				hashable, ok := key.(object.Hashable)
+				if !ok {
+					continue
+				}
+				hk := hashable.HashKey()
+				// The first of several equal headers wins, as in Ruby
+				if _, exists := hash.Pairs[hk]; exists {
+					continue
+				}
+				hash.Pairs[hk] = object.HashPair{Key: key, Value: field}
+				hash.Order = append(hash.Order, hk)
+			}
+			return hash
+		},
+	}
+
+	CSVRowClass.Methods["to_hash"] = CSVRowClass.Methods["to_h"]
+
+	CSVRowClass.Methods["to_a"] = &object.Builtin{
+		Name: "to_a",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			headers, fields := csvRowParts(receiver)
+			pairs := make([]object.Object, len(fields.Elements))
+			for i, field := range fields.Elements {
+				pairs[i] = &object.Array{Elements: []object.Object{csvHeaderAt(headers, i), field}}
+			}
+			return &object.Array{Elements: pairs}
+		},
+	}
+
+	CSVRowClass.Methods["size"] = &object.Builtin{
+		Name: "size",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			_, fields := csvRowParts(receiver)
+			return &object.Integer{Value: int64(len(fields.Elements))}
+		},
+	}
+
+	CSVRowClass.Methods["length"] = CSVRowClass.Methods["size"]
+
+	CSVRowClass.Methods["to_csv"] = &object.Builtin{
+		Name: "to_csv",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			_, opts, err := csvOptionArgs(args)
+			if err != nil {
+				return err
+			}
+			_, fields := csvRowParts(receiver)
+			return &object.String{Value: csvFormatRow(fields.Elements, opts)}
+		},
+	}
+
+	CSVRowClass.Methods["to_s"] = CSVRowClass.Methods["to_csv"]
+
+	CSVRowClass.Methods["=="] = &object.Builtin{
+		Name: "==",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			other, ok := args[0].(*object.Instance)
+			if !ok || other.Class_ != CSVRowClass {
+				return object.FALSE
+			}
+			headers, fields := csvRowParts(receiver)
+			otherHeaders, otherFields := csvRowParts(other)
+			return object.NativeToBool(objectsEqual(headers, otherHeaders) && objectsEqual(fields, otherFields))
+		},
+	}
+
+	CSVRowClass.Methods["inspect"] = &object.Builtin{
+		Name: "inspect",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			headers, fields := csvRowParts(receiver)
+			var sb strings.Builder
+			sb.WriteString("#<CSV::Row")
+			for i, field := range fields.Elements {
+				sb.WriteString(" ")
+				header := csvHeaderAt(headers, i)
+				if str, ok := header.(*object.String); ok {
+					sb.WriteString(str.Value)
+				} else {
+					sb.WriteString(inspectObject(header))
+				}
+				sb.WriteString(":")
+				sb.WriteString(inspectObject(field))
+			}
+			sb.WriteString(">")
+			return &object.String{Value: sb.String()}
+		},
+	}
+}
+
+func initCSVTableMethods() {
+	CSVTableClass.Methods["each"] = &object.Builtin{
+		Name: "each",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			block := env.Block()
+			if block == nil {
+				return newEnumerator(receiver, "each", args)
+			}
+			for _, row := range csvTableRows(receiver).Elements {
+				result := callBlock(block, []object.Object{row}, env)
+				if _, ok := result.(*object.BreakValue); ok {
+					return result
+				}
+				if isError(result) {
+					return result
+				}
+			}
+			return receiver
+		},
+	}
+
+	CSVTableClass.Methods["[]"] = &object.Builtin{
+		Name: "[]",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			rows := csvTableRows(receiver)
+			// An Integer selects a row, anything else a column by header
+			if idx, ok := args[0].(*object.Integer); ok {
+				return evalArrayIndex(rows, idx)
+			}
+			column := make([]object.Object, len(rows.Elements))
+			for i, row := range rows.Elements {
+				column[i] = object.NIL
+				headers, fields := csvRowParts(row)
+				if j, ok := csvRowIndex(headers, fields, args[0]); ok {
+					column[i] = fields.Elements[j]
+				}
+			}
+			return &object.Array{Elements: column}
+		},
+	}
+
+	CSVTableClass.Methods["headers"] = &object.Builtin{
+		Name: "headers",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			headers := receiver.(*object.Instance).InstanceVariables["@headers"].(*object.Array)
+			return &object.Array{Elements: append([]object.Object{}, headers.Elements...)}
+		},
+	}
+
+	CSVTableClass.Methods["to_a"] = &object.Builtin{
+		Name: "to_a",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			headers := receiver.(*object.Instance).InstanceVariables["@headers"].(*object.Array)
+			result := []object.Object{&object.Array{Elements: append([]object.Object{}, headers.Elements...)}}
+			for _, row := range csvTableRows(receiver).Elements {
+				_, fields := csvRowParts(row)
+				result = append(result, &object.Array{Elements: append([]object.Object{}, fields.Elements...)})
+			}
+			return &object.Array{Elements: result}
+		},
+	}
+
+	CSVTableClass.Methods["size"] = &object.Builtin{
+		Name: "size",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: int64(len(csvTableRows(receiver).Elements))}
+		},
+	}
+
+	CSVTableClass.Methods["length"] = CSVTableClass.Methods["size"]
+
+	CSVTableClass.Methods["to_csv"] = &object.Builtin{
+		Name: "to_csv",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			_, opts, err := csvOptionArgs(args)
+			if err != nil {
+				return err
+			}
+			headers := receiver.(*object.Instance).InstanceVariables["@headers"].(*object.Array)
+			out := csvFormatRow(headers.Elements, opts)
+			for _, row := range csvTableRows(receiver).Elements {
+				_, fields := csvRowParts(row)
+				out += csvFormatRow(fields.Elements, opts)
+			}
+			return &object.String{Value: out}
+		},
+	}
+
+	CSVTableClass.Methods["to_s"] = CSVTableClass.Methods["to_csv"]
+
+	CSVTableClass.Methods["inspect"] = &object.Builtin{
+		Name: "inspect",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			// Ruby counts the header row too
+			count := len(csvTableRows(receiver).Elements) + 1
+			return &object.String{Value: fmt.Sprintf("#<CSV::Table mode:col_or_row row_count:%d>", count)}
+		},
+	}
+
+	// Enumerable methods run over the rows
+	for _, name := range []string{"map", "collect", "select", "filter", "reject", "find", "detect",
+		"each_with_index", "each_with_object", "count", "sort_by", "group_by", "sum", "min_by",
+		"max_by", "first", "partition", "reduce", "inject", "any?", "all?", "none?", "flat_map"} {
+		name := name
+		CSVTableClass.Methods[name] = &object.Builtin{
+			Name: name,
+			Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+				builtin, ok := getArrayBuiltins()[name]
+				if !ok {
+					return newError("undefined method `%s' for CSV::Table", name)
+				}
+				return builtin.Fn(csvTableRows(receiver), env, args...)
+			},
+		}
+	}
+}
+
+// newCSVWriter creates the writer yielded by CSV.generate, appending to output.
+func newCSVWriter(output *object.String, opts csvOptions) *object.Instance {
+	writer := &object.Instance{
+		Class_:            CSVClass,
+		InstanceVariables: make(map[string]object.Object),
+	}
+	writer.InstanceVariables["@string"] = output
+	writer.InstanceVariables["@col_sep"] = &object.String{Value: opts.colSep}
+	writer.InstanceVariables["@row_sep"] = &object.String{Value: opts.rowSep}
+	if headers, ok := opts.headers.(*object.Array); ok {
+		writer.InstanceVariables["@headers"] = headers
+	}
+	return writer
+}
+
+// csvWriterOptions recovers the options a writer was created with.
+func csvWriterOptions(writer *object.Instance) csvOptions {
+	opts := csvOptions{colSep: ",", rowSep: "\n"}
+	if sep, ok := writer.InstanceVariables["@col_sep"].(*object.String); ok {
+		opts.colSep = sep.Value
+	}
+	if sep, ok := writer.InstanceVariables["@row_sep"].(*object.String); ok {
+		opts.rowSep = sep.Value
+	}
+	if headers, ok := writer.InstanceVariables["@headers"]; ok {
+		opts.headers = headers
+	}
+	return opts
+}
+
+func newCSVRow(headers, fields []object.Object) *object.Instance {
+	row := &object.Instance{
+		Class_:            CSVRowClass,
+		InstanceVariables: make(map[string]object.Object),
+	}
+	row.InstanceVariables["@headers"] = &object.Array{Elements: headers}
+	row.InstanceVariables["@fields"] = &object.Array{Elements: fields}
+	return row
+}
+
+func csvRowParts(row object.Object) (*object.Array, *object.Array) {
+	inst := row.(*object.Instance)
+	return inst.InstanceVariables["@headers"].(*object.Array), inst.InstanceVariables["@fields"].(*object.Array)
+}
+
+func csvTableRows(table object.Object) *object.Array {
+	return table.(*object.Instance).InstanceVariables["@rows"].(*object.Array)
+}
+
+// csvHeaderAt returns the header of column i, or nil past the last header.
+func csvHeaderAt(headers *object.Array, i int) object.Object {
+	if i < len(headers.Elements) {
+		return headers.Elements[i]
+	}
+	return object.NIL
+}
+
+// csvRowIndex resolves a field index from an Integer position (negative
+// counts from the end) or a header, matching the first equal header.
+func csvRowIndex(headers, fields *object.Array, key object.Object) (int, bool) {
+	if idx, ok := key.(*object.Integer); ok {
+		i := int(idx.Value)
+		if i < 0 {
+			i += len(fields.Elements)
+		}
+		return i, i >= 0 && i < len(fields.Elements)
+	}
+	for i, header := range headers.Elements {
+		if objectsEqual(header, key) {
+			return i, i < len(fields.Elements)
+		}
+	}
+	return 0, false
+}
+
+// csvOptionArgs splits trailing keyword options off args.
+func csvOptionArgs(args []object.Object) ([]object.Object, csvOptions, object.Object) {
+	opts := csvOptions{colSep: ",", rowSep: "\n"}
+	if len(args) == 0 {
+		return args, opts, nil
+	}
+	kwargs, ok := args[len(args)-1].(*object.Hash)
+	if !ok || !kwargs.IsKeywordArgs {
+		return args, opts, nil
+	}
+	args = args[:len(args)-1]
+
+	for _, hk := range kwargs.Order {
+		pair := kwargs.Pairs[hk]
+		key, ok := pair.Key.(*object.Symbol)
+		if !ok {
+			continue
+		}
+		switch key.Value {
+		case "col_sep", "row_sep":
+			sep, ok := pair.Value.(*object.String)
+			if !ok || sep.Value == "" {
+				return nil, opts, newError("ArgumentError: :%s must be a non-empty String", key.Value)
+			}
+			if key.Value == "col_sep" {
+				opts.colSep = sep.Value
+			} else {
+				opts.rowSep = sep.Value
+			}
+		case "headers":
+			switch val := pair.Value.(type) {
+			case *object.Array:
+				opts.headers = val
+			case *object.String:
+				// A header line given as a String is parsed with the same options
+				rows, err := csvParseRecords(val.Value, opts.colSep)
+				if err != nil {
+					return nil, opts, err
+				}
+				if len(rows) > 0 {
+					opts.headers = &object.Array{Elements: rows[0]}
+				}
+			default:
+				if isTruthy(val) {
+					opts.headers = object.TRUE
+				}
+			}
+		case "header_converters":
+			if sym, ok := pair.Value.(*object.Symbol); ok {
+				opts.headerConverter = sym.Value
+			}
+		case "converters":
+			switch val := pair.Value.(type) {
+			case *object.Symbol:
+				opts.converters = []string{val.Value}
+			case *object.Array:
+				for _, elem := range val.Elements {
+					if sym, ok := elem.(*object.Symbol); ok {
+						opts.converters = append(opts.converters, sym.Value)
+					}
+				}
+			}
+		case "skip_blanks":
+			opts.skipBlanks = isTruthy(pair.Value)
+		case "write_headers":
+			opts.writeHeaders = isTruthy(pair.Value)
+		}
+	}
+	return args, opts, nil
+}
+
+// csvSourceArgs extracts the CSV text and options for parse and parse_line.
+func csvSourceArgs(args []object.Object) (string, csvOptions, object.Object) {
+	args, opts, err := csvOptionArgs(args)
+	if err != nil {
+		return "", opts, err
+	}
+	if len(args) != 1 {
+		return "", opts, newError("wrong number of arguments (given %d, expected 1)", len(args))
+	}
+	str, ok := args[0].(*object.String)
+	if !ok {
+		return "", opts, newError("TypeError: no implicit conversion of %s into String", comparisonOperandName(args[0]))
+	}
+	return str.Value, opts, nil
+}
+
+// csvFileArgs reads the file named by args[0] for read and foreach.
+func csvFileArgs(args []object.Object) (string, csvOptions, object.Object) {
+	args, opts, err := csvOptionArgs(args)
+	if err != nil {
+		return "", opts, err
+	}
+	if len(args) < 1 {
+		return "", opts, newError("wrong number of arguments (given 0, expected 1)")
+	}
+	path, ok := args[0].(*object.String)
+	if !ok {
+		return "", opts, newError("TypeError: no implicit conversion of %s into String", comparisonOperandName(args[0]))
+	}
+	content, readErr := os.ReadFile(path.Value)
+	if readErr != nil {
+		return "", opts, newError("Errno::ENOENT: No such file or directory @ rb_sysopen - %s", path.Value)
+	}
+	return string(content), opts, nil
+}
+
+// csvEachOrCollect yields each parsed row to the block, or returns all of
+// them (as a CSV::Table when headers are in use) when there is none.
+func csvEachOrCollect(str string, opts csvOptions, env *object.Environment) object.Object {
+	rows, err := csvParse(str, opts)
+	if err != nil {
+		return err
+	}
+	block := env.Block()
+	if block == nil {
+		return csvResult(rows, opts)
+	}
+	for _, row := range rows {
+		result := callBlock(block, []object.Object{row}, env)
+		if _, ok := result.(*object.BreakValue); ok {
+			return result
+		}
+		if isError(result) {
+			return result
+		}
+	}
+	return object.NIL
+}
+
+// csvResult wraps parsed rows in a CSV::Table when headers are in use.
+func csvResult(rows []object.Object, opts csvOptions) object.Object {
+	if opts.headers == nil {
+		return &object.Array{Elements: rows}
+	}
+	headers := &object.Array{Elements: []object.Object{}}
+	if len(rows) > 0 {
+		first, _ := csvRowParts(rows[0])
+		headers.Elements = first.Elements
+	} else if given, ok := opts.headers.(*object.Array); ok {
+		headers.Elements = given.Elements
+	}
+	table := &object.Instance{
+		Class_:            CSVTableClass,
+		InstanceVariables: make(map[string]object.Object),
+	}
+	table.InstanceVariables["@headers"] = headers
+	table.InstanceVariables["@rows"] = &object.Array{Elements: rows}
+	return table
+}
+
+// csvParse parses str into rows: Arrays of fields, or CSV::Row objects when
+// headers are in use. Unquoted empty fields are nil, quoted ones "".
+func csvParse(str string, opts csvOptions) ([]object.Object, object.Object) {
+	records, err := csvParseRecords(str, opts.colSep)
+	if err != nil {
+		return nil, err
+	}
+
+	var headers []object.Object
+	switch given := opts.headers.(type) {
+	case *object.Array:
+		headers = given.Elements
+	case *object.Boolean:
+		if len(records) == 0 {
+			return []object.Object{}, nil
+		}
+		headers = records[0]
+		records = records[1:]
+	}
+	if headers != nil {
+		converted := make([]object.Object, len(headers))
+		for i, header := range headers {
+			converted[i] = csvConvertHeader(header, opts.headerConverter)
+		}
+		headers = converted
+	}
+
+	rows := []object.Object{}
+	for _, record := range records {
+		if len(record) == 0 && (opts.skipBlanks || headers != nil) {
+			continue
+		}
+		for i, field := range record {
+			record[i] = csvConvertField(field, opts.converters)
+		}
+		if headers != nil {
+			rows = append(rows, newCSVRow(headers, record))
+		} else {
+			rows = append(rows, &object.Array{Elements: record})
+		}
+	}
+	return rows, nil
+}
+
+// csvParseRecords splits str into records per RFC 4180: fields are
+// separated by sep, records end at LF or CRLF, and quoted fields may hold
+// separators, line breaks and doubled quotes. A blank line is an empty record.
+func csvParseRecords(str, sep string) ([][]object.Object, object.Object) {
+	var records [][]object.Object
+	var record []object.Object
+	var field strings.Builder
+	quoted := false
+	fieldStart := true
+	lineStart := true
+	line := 1
+
+	endField := func() {
+		if quoted {
+			record = append(record, &object.String{Value: field.String()})
+		} else if field.Len() == 0 {
+			record = append(record, object.NIL)
+		} else {
+			record = append(record, &object.String{Value: field.String()})
+		}
+		field.Reset()
+		quoted = false
+		fieldStart = true
+	}
+	endRecord := func() {
+		endField()
+		if len(record) == 1 && record[0] == object.NIL {
+			record = []object.Object{}
+		}
+		records = append(records, record)
+		record = nil
+		lineStart = true
+	}
+
+	for i := 0; i < len(str); {
+		c := str[i]
+		switch {
+		case fieldStart && c == '"':
+			start := line
+			i++
+			for {
+				if i >= len(str) {
+					return nil, &object.Error{Message: fmt.Sprintf("Unclosed quoted field in line %d.", start), Class_: CSVMalformedErrorClass}
+				}
+				if str[i] == '"' {
+					if i+1 < len(str) && str[i+1] == '"' {
+						field.WriteByte('"')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				if str[i] == '\n' {
+					line++
+				}
+				field.WriteByte(str[i])
+				i++
+			}
+			quoted = true
+			fieldStart = false
+			lineStart = false
+			if i < len(str) && !strings.HasPrefix(str[i:], sep) && str[i] != '\n' && !strings.HasPrefix(str[i:], "\r\n") {
+				return nil, &object.Error{Message: fmt.Sprintf("Any value after quoted field isn't allowed in line %d.", line), Class_: CSVMalformedErrorClass}
+			}
+		case strings.HasPrefix(str[i:], sep):
+			endField()
+			lineStart = false
+			i += len(sep)
+		case c == '\n' || strings.HasPrefix(str[i:], "\r\n"):
+			endRecord()
+			if c == '\r' {
+				i++
+			}
+			i++
+			line++
+		case c == '"':
+			return nil, &object.Error{Message: fmt.Sprintf("Illegal quoting in line %d.", line), Class_: CSVMalformedErrorClass}
+		case c == '\r':
+			return nil, &object.Error{Message: fmt.Sprintf("Unquoted fields do not allow new line <\"\\r\"> in line %d.", line), Class_: CSVMalformedErrorClass}
+		default:
+			field.WriteByte(c)
+			fieldStart = false
+			lineStart = false
+			i++
+		}
+	}
+	if !lineStart {
+		endRecord()
+	}
+	return records, nil
+}
+
+// csvConvertHeader applies a header_converters: option to a header.
+func csvConvertHeader(header object.Object, converter string) object.Object {
+	str, ok := header.(*object.String)
+	if !ok {
+		return header
+	}
+	switch converter {
+	case "downcase":
+		return &object.String{Value: strings.ToLower(str.Value)}
+	case "symbol":
+		name := strings.ToLower(str.Value)
+		name = csvHeaderPunctuation.ReplaceAllString(name, "")
+		name = csvHeaderSpaces.ReplaceAllString(strings.TrimSpace(name), "_")
+		return &object.Symbol{Value: name}
+	}
+	return header
+}
+
+// csvConvertField applies the converters: option (:integer, :float,
+// :numeric or :all) to a field.
+func csvConvertField(field object.Object, converters []string) object.Object {
+	str, ok := field.(*object.String)
+	if !ok {
+		return field
+	}
+	for _, converter := range converters {
+		switch converter {
+		case "integer", "numeric", "all":
+			if csvIntegerPattern.MatchString(str.Value) {
+				if n, err := strconv.ParseInt(str.Value, 10, 64); err == nil {
+					return &object.Integer{Value: n}
+				}
+			}
+		}
+		switch converter {
+		case "float", "numeric", "all":
+			if strings.TrimSpace(str.Value) == str.Value {
+				if f, err := strconv.ParseFloat(str.Value, 64); err == nil {
+					return &object.Float{Value: f}
+				}
+			}
+		}
+	}
+	return field
+}
+
+// csvRowFields returns the fields to write for an Array, a CSV::Row, or a
+// Hash ordered by the writer's headers.
+func csvRowFields(row object.Object, opts csvOptions) ([]object.Object, object.Object) {
+	switch r := row.(type) {
+	case *object.Array:
+		return r.Elements, nil
+	case *object.Instance:
+		if r.Class_ == CSVRowClass {
+			_, fields := csvRowParts(r)
+			return fields.Elements, nil
+		}
+	case *object.Hash:
+		headers, ok := opts.headers.(*object.Array)
+		if !ok {
+			fields := make([]object.Object, 0, len(r.Order))
+			for _, hk := range r.Order {
+				fields = append(fields, r.Pairs[hk].Value)
+			}
+			return fields, nil
+		}
+		fields := make([]object.Object, len(headers.Elements))
+		for i, header := range headers.Elements {
+			fields[i] = object.NIL
+			if val, ok := hashGet(r, header); ok {
+				fields[i] = val
+			}
+		}
+		return fields, nil
+	}
+	return nil, newError("NoMethodError: undefined method `collect' for %s", inspectObject(row))
+}
+
+// csvFormatRow joins fields with the column separator, quoting those that
+// contain the separator, a quote or a line break, and ends the row.
+func csvFormatRow(fields []object.Object, opts csvOptions) string {
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		if field == object.NIL {
+			continue
+		}
+		value := objectToString(field)
+		if value == "" || strings.Contains(value, opts.colSep) || strings.ContainsAny(value, "\"\r\n") {
+			value = `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+		}
+		parts[i] = value
+	}
+	return strings.Join(parts, opts.colSep) + opts.rowSep
+}
@@ -0,0 +1,83 @@
+package evaluator
+
+import (
+	"strings"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// EncodingClass represents Ruby's Encoding class. Its instances only carry
+// a name: strings are always handled as the bytes they hold.
+var EncodingClass = &object.RubyClass{
+	Name:         "Encoding",
+	Superclass:   object.ObjectClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+	Constants:    make(map[string]object.Object),
+}
+
+// encodings holds the Encoding instance for each canonical name
+var encodings = make(map[string]*object.Instance)
+
+// encodingAliases maps the names an encoding may be given by to the name
+// Ruby reports for it
+var encodingAliases = map[string]string{
+	"UTF8":   "UTF-8",
+	"BINARY": "ASCII-8BIT",
+	"ASCII":  "US-ASCII",
+}
+
+func init() {
+	for _, name := range []string{"UTF-8", "ASCII-8BIT", "US-ASCII"} {
+		EncodingClass.Constants[strings.ReplaceAll(name, "-", "_")] = encodingFor(name)
+	}
+	EncodingClass.Constants["BINARY"] = encodingFor("BINARY")
+
+	EncodingClass.Methods["name"] = &object.Builtin{
+		Name: "name",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return receiver.(*object.Instance).GetInstanceVariable("@name")
+		},
+	}
+	EncodingClass.Methods["to_s"] = EncodingClass.Methods["name"]
+
+	EncodingClass.Methods["inspect"] = &object.Builtin{
+		Name: "inspect",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			name := receiver.(*object.Instance).GetInstanceVariable("@name").(*object.String).Value
+			return &object.String{Value: "#<Encoding:" + name + ">"}
+		},
+	}
+
+	EncodingClass.ClassMethods["find"] = &object.Builtin{
+		Name: "find",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			name, ok := args[0].(*object.String)
+			if !ok {
+				return newError("TypeError: no implicit conversion of %s into String", comparisonOperandName(args[0]))
+			}
+			return encodingFor(name.Value)
+		},
+	}
+}
+
+// encodingFor returns the Encoding named name, in any case and by any of
+// its aliases.
+func encodingFor(name string) *object.Instance {
+	name = strings.ToUpper(name)
+	if canonical, ok := encodingAliases[name]; ok {
+		name = canonical
+	}
+	if enc, ok := encodings[name]; ok {
+		return enc
+	}
+	enc := &object.Instance{
+		Class_:            EncodingClass,
+		InstanceVariables: map[string]object.Object{"@name": &object.String{Value: name}},
+	}
+	encodings[name] = enc
+	return enc
+}
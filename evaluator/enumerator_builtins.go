@@ -1,6 +1,7 @@
 package evaluator
 
 import (
+	"strings"
 	"sync"
 
 	"github.com/alexisbouchez/rubylexer/object"
@@ -22,23 +23,22 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 						return enum
 					}
 
+					// An enumerator for a blockless call runs that call with the block
+					if source := enumeratorSource(enum); source != nil {
+						return callMethod(source, enum.Method, enum.Args, block, env)
+					}
+
 					// Materialize values if needed
 					if enum.Values == nil {
-						materializeEnumerator(enum, env)
+						if err := materializeEnumerator(enum, env); err != nil {
+							return err
+						}
 					}
 
-					var result object.Object = object.NIL
-					for _, val := range enum.Values {
-						blockEnv := object.NewEnclosedEnvironment(env)
-						if block.Parameters != nil && len(block.Parameters) > 0 {
-							blockEnv.Set(block.Parameters[0].Name, val)
-						}
-						result = evalBlockBody(block.Body, blockEnv)
-						if isControlFlow(result) {
-							break
-						}
+					if stop := yieldValues(block, enum.Values, env); stop != nil {
+						return stop
 					}
-					return result
+					return enum
 				},
 			},
 			"next": {
@@ -46,16 +46,10 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					enum := receiver.(*object.Enumerator)
 
-					// Materialize values if needed
-					if enum.Values == nil {
-						materializeEnumerator(enum, env)
-					}
-
-					if enum.Index >= len(enum.Values) {
-						return newError("StopIteration: iteration reached an end")
+					val := enumeratorValueAt(enum, env)
+					if isError(val) {
+						return val
 					}
-
-					val := enum.Values[enum.Index]
 					enum.Index++
 					enum.Started = true
 					return val
@@ -66,16 +60,7 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					enum := receiver.(*object.Enumerator)
 
-					// Materialize values if needed
-					if enum.Values == nil {
-						materializeEnumerator(enum, env)
-					}
-
-					if enum.Index >= len(enum.Values) {
-						return newError("StopIteration: iteration reached an end")
-					}
-
-					return enum.Values[enum.Index]
+					return enumeratorValueAt(enum, env)
 				},
 			},
 			"rewind": {
@@ -94,7 +79,9 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 
 					// Materialize values if needed
 					if enum.Values == nil {
-						materializeEnumerator(enum, env)
+						if err := materializeEnumerator(enum, env); err != nil {
+							return err
+						}
 					}
 
 					return &object.Array{Elements: enum.Values}
@@ -105,16 +92,15 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 					enum := receiver.(*object.Enumerator)
 
-					// Materialize values if needed
-					if enum.Values == nil {
-						materializeEnumerator(enum, env)
-					}
-
 					if len(args) == 0 {
-						if len(enum.Values) == 0 {
+						values, err := enumeratorTake(enum, 1, env)
+						if err != nil {
+							return err
+						}
+						if len(values) == 0 {
 							return object.NIL
 						}
-						return enum.Values[0]
+						return values[0]
 					}
 
 					n, ok := args[0].(*object.Integer)
@@ -122,11 +108,11 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 						return newError("no implicit conversion to Integer")
 					}
 
-					count := int(n.Value)
-					if count > len(enum.Values) {
-						count = len(enum.Values)
+					values, err := enumeratorTake(enum, int(n.Value), env)
+					if err != nil {
+						return err
 					}
-					return &object.Array{Elements: enum.Values[:count]}
+					return &object.Array{Elements: values}
 				},
 			},
 			"count": {
@@ -136,7 +122,9 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 
 					// Materialize values if needed
 					if enum.Values == nil {
-						materializeEnumerator(enum, env)
+						if err := materializeEnumerator(enum, env); err != nil {
+							return err
+						}
 					}
 
 					return &object.Integer{Value: int64(len(enum.Values))}
@@ -154,42 +142,13 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 							offset = n.Value
 						}
 					}
-
-					// Materialize values if needed
-					if enum.Values == nil {
-						materializeEnumerator(enum, env)
-					}
-
-					if block == nil {
-						// Return new enumerator with indexed values
-						indexedValues := make([]object.Object, len(enum.Values))
-						for i, val := range enum.Values {
-							indexedValues[i] = &object.Array{Elements: []object.Object{val, &object.Integer{Value: int64(i) + offset}}}
-						}
-						return &object.Enumerator{
-							Object: enum.Object,
-							Method: enum.Method + ".with_index",
-							Values: indexedValues,
-						}
-					}
-
-					var result object.Object = object.NIL
-					for i, val := range enum.Values {
-						blockEnv := object.NewEnclosedEnvironment(env)
-						if block.Parameters != nil {
-							if len(block.Parameters) >= 1 {
-								blockEnv.Set(block.Parameters[0].Name, val)
-							}
-							if len(block.Parameters) >= 2 {
-								blockEnv.Set(block.Parameters[1].Name, &object.Integer{Value: int64(i) + offset})
-							}
-						}
-						result = evalBlockBody(block.Body, blockEnv)
-						if isControlFlow(result) {
-							break
-						}
-					}
-					return result
+					return enumerateWithIndex(enum, offset, block, env)
+				},
+			},
+			"each_with_index": {
+				Name: "each_with_index",
+				Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+					return enumerateWithIndex(receiver.(*object.Enumerator), 0, env.Block(), env)
 				},
 			},
 			"map": {
@@ -209,20 +168,14 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 
 					// Materialize values if needed
 					if enum.Values == nil {
-						materializeEnumerator(enum, env)
+						if err := materializeEnumerator(enum, env); err != nil {
+							return err
+						}
 					}
 
-					results := make([]object.Object, 0, len(enum.Values))
-					for _, val := range enum.Values {
-						blockEnv := object.NewEnclosedEnvironment(env)
-						if block.Parameters != nil && len(block.Parameters) > 0 {
-							blockEnv.Set(block.Parameters[0].Name, val)
-						}
-						result := evalBlockBody(block.Body, blockEnv)
-						if isControlFlow(result) {
-							break
-						}
-						results = append(results, result)
+					results, stop := blockKeys(block, enum.Values, env)
+					if stop != nil {
+						return stop
 					}
 					return &object.Array{Elements: results}
 				},
@@ -244,20 +197,18 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 
 					// Materialize values if needed
 					if enum.Values == nil {
-						materializeEnumerator(enum, env)
+						if err := materializeEnumerator(enum, env); err != nil {
+							return err
+						}
 					}
 
+					keys, stop := blockKeys(block, enum.Values, env)
+					if stop != nil {
+						return stop
+					}
 					results := make([]object.Object, 0)
-					for _, val := range enum.Values {
-						blockEnv := object.NewEnclosedEnvironment(env)
-						if block.Parameters != nil && len(block.Parameters) > 0 {
-							blockEnv.Set(block.Parameters[0].Name, val)
-						}
-						result := evalBlockBody(block.Body, blockEnv)
-						if isControlFlow(result) {
-							break
-						}
-						if isTruthy(result) {
+					for i, val := range enum.Values {
+						if isTruthy(keys[i]) {
 							results = append(results, val)
 						}
 					}
@@ -287,7 +238,9 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 
 					// Materialize values if needed
 					if enum.Values == nil {
-						materializeEnumerator(enum, env)
+						if err := materializeEnumerator(enum, env); err != nil {
+							return err
+						}
 					}
 
 					// Apply lazy operations
@@ -308,11 +261,7 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 							if op.Block != nil {
 								newValues := make([]object.Object, 0, len(values))
 								for _, val := range values {
-									blockEnv := object.NewEnclosedEnvironment(env)
-									if op.Block.Parameters != nil && len(op.Block.Parameters) > 0 {
-										blockEnv.Set(op.Block.Parameters[0].Name, val)
-									}
-									result := evalBlockBody(op.Block.Body, blockEnv)
+									result := callBlock(op.Block, []object.Object{val}, env)
 									newValues = append(newValues, result)
 								}
 								values = newValues
@@ -321,11 +270,7 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 							if op.Block != nil {
 								newValues := make([]object.Object, 0)
 								for _, val := range values {
-									blockEnv := object.NewEnclosedEnvironment(env)
-									if op.Block.Parameters != nil && len(op.Block.Parameters) > 0 {
-										blockEnv.Set(op.Block.Parameters[0].Name, val)
-									}
-									result := evalBlockBody(op.Block.Body, blockEnv)
+									result := callBlock(op.Block, []object.Object{val}, env)
 									if isTruthy(result) {
 										newValues = append(newValues, val)
 									}
@@ -364,16 +309,11 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 						return newEnum
 					}
 
-					// Materialize values if needed
-					if enum.Values == nil {
-						materializeEnumerator(enum, env)
+					values, err := enumeratorTake(enum, int(n.Value), env)
+					if err != nil {
+						return err
 					}
-
-					count := int(n.Value)
-					if count > len(enum.Values) {
-						count = len(enum.Values)
-					}
-					return &object.Array{Elements: enum.Values[:count]}
+					return &object.Array{Elements: values}
 				},
 			},
 			"drop": {
@@ -404,7 +344,9 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 
 					// Materialize values if needed
 					if enum.Values == nil {
-						materializeEnumerator(enum, env)
+						if err := materializeEnumerator(enum, env); err != nil {
+							return err
+						}
 					}
 
 					count := int(n.Value)
@@ -419,19 +361,72 @@ func getEnumeratorBuiltins() map[string]*object.Builtin {
 	return enumeratorBuiltinsMap
 }
 
-// materializeEnumerator collects all values from the enumerator's source
-func materializeEnumerator(enum *object.Enumerator, env *object.Environment) {
+// materializeEnumerator collects all values from the enumerator's source.
+// It returns an error rather than looping forever on an endless source.
+func materializeEnumerator(enum *object.Enumerator, env *object.Environment) object.Object {
+	if isEndless(enum) {
+		return newError("RangeError: cannot convert an endless enumerator to an array")
+	}
 	enum.Values = []object.Object{}
+	if enum.Generator != nil {
+		enum.Generator(func(val object.Object) bool {
+			enum.Values = append(enum.Values, val)
+			return true
+		})
+		return nil
+	}
 
 	switch obj := enum.Object.(type) {
 	case *object.Array:
-		enum.Values = obj.Elements
+		switch enum.Method {
+		case "each_with_index":
+			enum.Values = indexedPairs(obj.Elements, 0)
+		case "each_index":
+			for i := range obj.Elements {
+				enum.Values = append(enum.Values, &object.Integer{Value: int64(i)})
+			}
+		default:
+			enum.Values = obj.Elements
+		}
 	case *object.Range:
 		enum.Values = expandRange(obj)
+		switch enum.Method {
+		case "each_with_index":
+			enum.Values = indexedPairs(enum.Values, 0)
+		case "reverse_each":
+			for i, j := 0, len(enum.Values)-1; i < j; i, j = i+1, j-1 {
+				enum.Values[i], enum.Values[j] = enum.Values[j], enum.Values[i]
+			}
+		}
 	case *object.Hash:
 		for _, key := range obj.Order {
 			pair := obj.Pairs[key]
-			enum.Values = append(enum.Values, &object.Array{Elements: []object.Object{pair.Key, pair.Value}})
+			switch enum.Method {
+			case "each_key":
+				enum.Values = append(enum.Values, pair.Key)
+			case "each_value":
+				enum.Values = append(enum.Values, pair.Value)
+			default:
+				enum.Values = append(enum.Values, &object.Array{Elements: []object.Object{pair.Key, pair.Value}})
+			}
+		}
+		if enum.Method == "each_with_index" {
+			enum.Values = indexedPairs(enum.Values, 0)
+		}
+	case *object.Integer:
+		from, to, step := int64(0), obj.Value-1, int64(1)
+		if len(enum.Args) > 0 {
+			if limit, ok := enum.Args[0].(*object.Integer); ok {
+				switch enum.Method {
+				case "upto":
+					from, to = obj.Value, limit.Value
+				case "downto":
+					from, to, step = obj.Value, limit.Value, -1
+				}
+			}
+		}
+		for i := from; (step > 0 && i <= to) || (step < 0 && i >= to); i += step {
+			enum.Values = append(enum.Values, &object.Integer{Value: i})
 		}
 	case *object.String:
 		switch enum.Method {
@@ -456,10 +451,14 @@ func materializeEnumerator(enum *object.Enumerator, env *object.Environment) {
 	case *object.Enumerator:
 		// Nested enumerator - materialize the inner one first
 		if obj.Values == nil {
-			materializeEnumerator(obj, env)
+			if err := materializeEnumerator(obj, env); err != nil {
+				enum.Values = nil
+				return err
+			}
 		}
 		enum.Values = obj.Values
 	}
+	return nil
 }
 
 // splitLines splits a string by newlines
@@ -493,3 +492,180 @@ func isControlFlow(result object.Object) bool {
 	}
 	return false
 }
+
+// newEnumerator returns an Enumerator for a blockless call to method on
+// receiver. Its values are materialized on first use, except for range
+// iteration, which a Generator produces one value at a time.
+func newEnumerator(receiver object.Object, method string, args []object.Object) *object.Enumerator {
+	enum := &object.Enumerator{Object: receiver, Method: method, Args: args}
+	if r, ok := receiver.(*object.Range); ok {
+		switch {
+		case method == "each":
+			enum.Generator = func(yield func(object.Object) bool) {
+				iterateRange(r, func(val object.Object) object.Object {
+					if !yield(val) {
+						return object.NIL
+					}
+					return nil
+				})
+			}
+		case method == "step" && len(args) > 0:
+			enum.Generator = func(yield func(object.Object) bool) {
+				rangeStep(r, args[0], func(val object.Object) object.Object {
+					if !yield(val) {
+						return object.NIL
+					}
+					return nil
+				})
+			}
+		}
+	}
+	return enum
+}
+
+// isEndless reports whether enum's generator never runs out of values:
+// an endless range, or a blockless Array#cycle without a count.
+func isEndless(enum *object.Enumerator) bool {
+	if enum.Generator == nil {
+		return false
+	}
+	switch obj := enum.Object.(type) {
+	case *object.Range:
+		return obj.End == object.NIL
+	case *object.Array:
+		return enum.Method == "cycle" && len(obj.Elements) > 0
+	}
+	return false
+}
+
+// enumeratorValueAt returns the value at enum's current position for
+// next and peek, or a StopIteration error past the last one.
+func enumeratorValueAt(enum *object.Enumerator, env *object.Environment) object.Object {
+	values, err := enumeratorTake(enum, enum.Index+1, env)
+	if err != nil {
+		return err
+	}
+	if enum.Index >= len(values) {
+		return newError("StopIteration: iteration reached an end")
+	}
+	return values[enum.Index]
+}
+
+// enumeratorTake returns at most the first n values of enum. A generator
+// is run only until it has produced n values, so this is safe on endless
+// enumerators.
+func enumeratorTake(enum *object.Enumerator, n int, env *object.Environment) ([]object.Object, object.Object) {
+	if enum.Values == nil && enum.Generator != nil {
+		values := []object.Object{}
+		if n <= 0 {
+			return values, nil
+		}
+		enum.Generator(func(val object.Object) bool {
+			values = append(values, val)
+			return len(values) < n
+		})
+		return values, nil
+	}
+	if enum.Values == nil {
+		if err := materializeEnumerator(enum, env); err != nil {
+			return nil, err
+		}
+	}
+	if n > len(enum.Values) {
+		n = len(enum.Values)
+	}
+	if n < 0 {
+		n = 0
+	}
+	return enum.Values[:n], nil
+}
+
+// enumeratorSource returns the receiver whose method enum wraps, or nil
+// when enum iterates precomputed or derived values.
+func enumeratorSource(enum *object.Enumerator) object.Object {
+	if enum.Values != nil || enum.Lazy || strings.Contains(enum.Method, ".") {
+		return nil
+	}
+	if _, nested := enum.Object.(*object.Enumerator); nested {
+		return nil
+	}
+	return enum.Object
+}
+
+// indexedPairs pairs each value with its index, as each_with_index yields.
+func indexedPairs(values []object.Object, offset int64) []object.Object {
+	pairs := make([]object.Object, len(values))
+	for i, val := range values {
+		pairs[i] = &object.Array{Elements: []object.Object{val, &object.Integer{Value: int64(i) + offset}}}
+	}
+	return pairs
+}
+
+// enumerateWithIndex implements Enumerator#with_index. With a block, the
+// result follows the wrapped method, so map.with_index returns the mapped
+// values and select.with_index the selected ones.
+func enumerateWithIndex(enum *object.Enumerator, offset int64, block *object.Proc, env *object.Environment) object.Object {
+	if enum.Values == nil {
+		if err := materializeEnumerator(enum, env); err != nil {
+			return err
+		}
+	}
+
+	if block == nil {
+		return &object.Enumerator{
+			Object: enum.Object,
+			Method: enum.Method + ".with_index",
+			Values: indexedPairs(enum.Values, offset),
+		}
+	}
+
+	results := make([]object.Object, len(enum.Values))
+	for i, val := range enum.Values {
+		result := callBlock(block, []object.Object{val, &object.Integer{Value: int64(i) + offset}}, env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			return bv.Value
+		}
+		if isError(result) {
+			return result
+		}
+		results[i] = result
+	}
+
+	switch enum.Method {
+	case "map", "collect", "map!", "collect!":
+		if arr, ok := enum.Object.(*object.Array); ok && strings.HasSuffix(enum.Method, "!") {
+			arr.Elements = results
+			return arr
+		}
+		return &object.Array{Elements: results}
+	case "flat_map", "collect_concat":
+		return &object.Array{Elements: flattenOnce(results)}
+	case "select", "filter", "reject", "filter_map":
+		var kept []object.Object
+		for i, val := range enum.Values {
+			switch {
+			case enum.Method == "filter_map":
+				if isTruthy(results[i]) {
+					kept = append(kept, results[i])
+				}
+			case isTruthy(results[i]) == (enum.Method != "reject"):
+				kept = append(kept, val)
+			}
+		}
+		return &object.Array{Elements: kept}
+	}
+	return enum.Object
+}
+
+// flattenOnce concatenates array values and keeps other values as-is.
+func flattenOnce(values []object.Object) []object.Object {
+	var flat []object.Object
+	for _, val := range values {
+		if arr, ok := val.(*object.Array); ok {
+			flat = append(flat, arr.Elements...)
+		} else {
+			flat = append(flat, val)
+		}
+	}
+	return flat
+}
@@ -4,17 +4,28 @@ package evaluator
 import (
 	"fmt"
 	"math"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/alexisbouchez/rubylexer/ast"
 	"github.com/alexisbouchez/rubylexer/object"
+	"github.com/alexisbouchez/rubylexer/token"
 )
 
-// Eval evaluates an AST node.
+// Eval evaluates an AST node. A whole program is evaluated holding the
+// interpreter lock, so programs run from different goroutines take turns;
+// embedders should pass Eval a *ast.Program rather than a bare node.
 func Eval(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 	// Program
 	case *ast.Program:
+		interpreterLock.Lock()
+		defer interpreterLock.Unlock()
+		if node.HasData {
+			// The main script reads the text after __END__ through DATA
+			object.ObjectClass.Constants["DATA"] = newStringIO(&object.String{Value: node.Data})
+		}
 		return evalProgram(node, env)
 
 	// Statements
@@ -40,6 +51,9 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		}
 		return &object.ReturnValue{Value: val}
 
+	case *ast.ModifierStatement:
+		return evalModifierStatement(node, env)
+
 	case *ast.BreakStatement:
 		var val object.Object = object.NIL
 		if node.Value != nil {
@@ -74,11 +88,31 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return &object.Float{Value: node.Value}
 
 	case *ast.StringLiteral:
-		return &object.String{Value: node.Value}
+		return &object.String{Value: node.Value, Frozen: node.Frozen}
+
+	case *ast.MagicComment:
+		if node.Kind == "ENCODING" {
+			return encodingFor(node.Encoding)
+		}
+		return newError("NotImplementedError: __%s__ is not supported", node.Kind)
 
 	case *ast.InterpolatedString:
 		return evalInterpolatedString(node, env)
 
+	case *ast.InterpolatedSymbol:
+		name := evalInterpolatedString(&ast.InterpolatedString{Token: node.Token, Parts: node.Parts}, env)
+		if isError(name) {
+			return name
+		}
+		return &object.Symbol{Value: name.(*object.String).Value}
+
+	case *ast.XStringLiteral:
+		command := evalInterpolatedString(&ast.InterpolatedString{Token: node.Token, Parts: node.Parts}, env)
+		if isError(command) {
+			return command
+		}
+		return runBacktick(command.(*object.String).Value)
+
 	case *ast.SymbolLiteral:
 		return &object.Symbol{Value: node.Value}
 
@@ -143,6 +177,9 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return evalPrefixExpression(node.Operator, right)
 
 	case *ast.InfixExpression:
+		if err := warnAmbiguousArgument(node, env); err != nil {
+			return err
+		}
 		left := Eval(node.Left, env)
 		if isError(left) {
 			return left
@@ -177,6 +214,8 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 
 	case *ast.CaseExpression:
 		return evalCaseExpression(node, env)
+	case *ast.CaseInExpression:
+		return evalCaseInExpression(node, env)
 
 	case *ast.WhileExpression:
 		return evalWhileExpression(node, env)
@@ -226,11 +265,14 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 
 	case *ast.RescueModifier:
 		result := Eval(node.Body, env)
-		if isError(result) {
+		if err, ok := result.(*object.Error); ok && errorIsA(err, object.StandardErrorClass, env) {
 			return Eval(node.Rescue, env)
 		}
 		return result
 
+	case *ast.MultipleAssignment:
+		return evalMultipleAssignment(node, env)
+
 	case *ast.SplatExpression:
 		return evalSplatExpression(node, env)
 
@@ -247,14 +289,22 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 
 func evalProgram(program *ast.Program, env *object.Environment) object.Object {
 	var result object.Object = object.NIL
+	if err := warnUnusedVariables(program, env); err != nil {
+		return err
+	}
 
 	for _, statement := range program.Statements {
+		if err := checkInterrupt(); err != nil {
+			return err
+		}
+		setCurrentLine(statement)
 		result = Eval(statement, env)
 
 		switch result := result.(type) {
 		case *object.ReturnValue:
 			return result.Value
 		case *object.Error:
+			recordErrorPos(result, statement)
 			return result
 		}
 	}
@@ -266,6 +316,10 @@ func evalBlockBody(body *ast.BlockBody, env *object.Environment) object.Object {
 	var result object.Object = object.NIL
 
 	for _, statement := range body.Statements {
+		if err := checkInterrupt(); err != nil {
+			return err
+		}
+		setCurrentLine(statement)
 		result = Eval(statement, env)
 
 		if result != nil {
@@ -275,6 +329,9 @@ func evalBlockBody(body *ast.BlockBody, env *object.Environment) object.Object {
 				rt == object.NEXT_VALUE_OBJ ||
 				rt == object.RETRY_VALUE_OBJ ||
 				rt == object.ERROR_OBJ {
+				if err, ok := result.(*object.Error); ok {
+					recordErrorPos(err, statement)
+				}
 				return result
 			}
 		}
@@ -307,7 +364,11 @@ func evalInterpolatedString(node *ast.InterpolatedString, env *object.Environmen
 		if isError(val) {
 			return val
 		}
-		result += objectToString(val)
+		str, err := convertToString(val)
+		if err != nil {
+			return err
+		}
+		result += str
 	}
 
 	return &object.String{Value: result}
@@ -336,8 +397,10 @@ func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Obje
 		}
 
 		hashed := hashKey.HashKey()
+		if _, exists := pairs[hashed]; !exists {
+			order = append(order, hashed)
+		}
 		pairs[hashed] = object.HashPair{Key: key, Value: value}
-		order = append(order, hashed)
 	}
 
 	return &object.Hash{Pairs: pairs, Order: order, IsKeywordArgs: node.IsKeywordArgs}
@@ -349,9 +412,12 @@ func evalRangeLiteral(node *ast.RangeLiteral, env *object.Environment) object.Ob
 		return start
 	}
 
-	end := Eval(node.End, env)
-	if isError(end) {
-		return end
+	var end object.Object = object.NIL
+	if node.End != nil {
+		end = Eval(node.End, env)
+		if isError(end) {
+			return end
+		}
 	}
 
 	return &object.Range{Start: start, End: end, Exclusive: node.Exclusive}
@@ -369,12 +435,18 @@ func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object
 	if self != nil {
 		// Check if self is a class/module and look up module methods (like private, attr_reader)
 		if class, ok := self.(*object.RubyClass); ok {
-			if builtin := getBuiltinMethod(class, node.Value); builtin != nil {
+			if method, ok := class.LookupClassMethod(node.Value); ok {
+				return applyMethod(method, class, []object.Object{}, nil, env)
+			}
+			if builtin := getBuiltinMethod(class, node.Value); builtin != nil && builtin != getKernelBuiltins()[node.Value] {
 				return builtin.Fn(class, env)
 			}
 		}
 		if mod, ok := self.(*object.RubyModule); ok {
-			if builtin := getBuiltinMethod(mod, node.Value); builtin != nil {
+			if method, ok := mod.Methods[node.Value]; ok {
+				return applyMethod(method, mod, []object.Object{}, nil, env)
+			}
+			if builtin := getBuiltinMethod(mod, node.Value); builtin != nil && builtin != getKernelBuiltins()[node.Value] {
 				return builtin.Fn(mod, env)
 			}
 		}
@@ -396,85 +468,174 @@ func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object
 }
 
 func evalConstant(node *ast.Constant, env *object.Environment) object.Object {
-	if val, ok := env.GetConstant(node.Value); ok {
+	if val, ok := lookupConstant(node.Value, env); ok {
 		return val
 	}
+	return newError("uninitialized constant %s", node.Value)
+}
+
+// lookupConstant finds the constant name as written bare in env, reporting
+// whether it is defined. A constant whose autoload fails is found as the
+// error the require gave.
+func lookupConstant(name string, env *object.Environment) (object.Object, bool) {
+	if val, ok := env.GetConstant(name); ok {
+		return val, true
+	}
 
 	// Check built-in classes
-	switch node.Value {
+	switch name {
 	case "Object":
-		return object.ObjectClass
+		return object.ObjectClass, true
 	case "Class":
-		return object.ClassClass
+		return object.ClassClass, true
 	case "Module":
-		return object.ModuleClass
+		return object.ModuleClass, true
 	case "Integer":
-		return object.IntegerClass
+		return object.IntegerClass, true
 	case "Float":
-		return object.FloatClass
+		return object.FloatClass, true
 	case "String":
-		return object.StringClass
+		return object.StringClass, true
 	case "Symbol":
-		return object.SymbolClass
+		return object.SymbolClass, true
 	case "Array":
-		return object.ArrayClass
+		return object.ArrayClass, true
 	case "Hash":
-		return object.HashClass
+		return object.HashClass, true
 	case "Range":
-		return object.RangeClass
+		return object.RangeClass, true
 	case "Regexp":
-		return object.RegexpClass
+		return object.RegexpClass, true
 	case "Proc":
-		return object.ProcClass
+		return object.ProcClass, true
 	case "TrueClass":
-		return object.TrueClass
+		return object.TrueClass, true
 	case "FalseClass":
-		return object.FalseClass
+		return object.FalseClass, true
 	case "NilClass":
-		return object.NilClass
+		return object.NilClass, true
 	case "Exception":
-		return object.ExceptionClass
+		return object.ExceptionClass, true
 	case "StandardError":
-		return object.StandardErrorClass
+		return object.StandardErrorClass, true
 	case "RuntimeError":
-		return object.RuntimeErrorClass
+		return object.RuntimeErrorClass, true
 	case "ArgumentError":
-		return object.ArgumentErrorClass
+		return object.ArgumentErrorClass, true
+	case "IndexError":
+		return object.IndexErrorClass, true
+	case "KeyError":
+		return object.KeyErrorClass, true
 	case "TypeError":
-		return object.TypeError
+		return object.TypeError, true
 	case "NameError":
-		return object.NameErrorClass
+		return object.NameErrorClass, true
 	case "NoMethodError":
-		return object.NoMethodErrorClass
+		return object.NoMethodErrorClass, true
+	case "SystemExit":
+		return object.SystemExitClass, true
 	case "Kernel":
-		return object.KernelModule
+		return object.KernelModule, true
 	case "Comparable":
-		return object.ComparableModule
+		return object.ComparableModule, true
 	case "Enumerable":
-		return object.EnumerableModule
+		return object.EnumerableModule, true
 	case "File":
-		return FileClass
+		return FileClass, true
 	case "Dir":
-		return DirClass
+		return DirClass, true
 	case "Time":
-		return TimeClass
+		return TimeClass, true
 	case "Date":
-		return DateClass
+		return DateClass, true
+	case "DateTime":
+		return DateTimeClass, true
 	case "JSON":
-		return JSONModule
+		return JSONModule, true
 	case "Struct":
-		return StructClass
-	case "YAML":
-		return YAMLModule
+		return StructClass, true
+	case "YAML", "Psych":
+		return YAMLModule, true
 	case "OpenStruct":
-		return OpenStructClass
+		return OpenStructClass, true
+	case "CSV":
+		return CSVClass, true
+	case "Process":
+		return ProcessModule, true
+	case "Open3":
+		return Open3Module, true
+	case "Timeout":
+		return TimeoutModule, true
+	case "GC":
+		return GCModule, true
+	case "PP":
+		return PPModule, true
+	case "ARGV":
+		return argvArray, true
+	case "STDIN":
+		return stdinIO, true
+	case "STDOUT":
+		return stdoutIO, true
+	case "STDERR":
+		return stderrIO, true
+	case "StringIO":
+		return StringIOClass, true
+	case "Queue":
+		return QueueClass, true
+	case "SizedQueue":
+		return SizedQueueClass, true
+	case "Ractor":
+		return RactorClass, true
+	case "ARGF":
+		return ARGF, true
+	case "IO":
+		return object.IOClass, true
+	case "Random":
+		return RandomClass, true
+	case "Encoding":
+		return EncodingClass, true
 	case "TracePoint":
-		return object.TracePointClass
+		return object.TracePointClass, true
 	case "ObjectSpace":
-		return GetObjectSpaceModule()
+		return GetObjectSpaceModule(), true
+	}
+	if val, ok := versionConstant(name); ok {
+		return val, true
 	}
 
-	return newError("uninitialized constant %s", node.Value)
+	if val, ok := lookupScopedConstant(env.Self(), name); ok {
+		return val, true
+	}
+
+	if val, ok := autoloadConstant(env.Self(), name, env); ok {
+		return val, true
+	}
+
+	return nil, false
+}
+
+// lookupScopedConstant finds a constant assigned inside a class or module
+// body: on self (or self's class for an instance) and its ancestors, then
+// on Object, where top-level constants live.
+func lookupScopedConstant(self object.Object, name string) (object.Object, bool) {
+	var class *object.RubyClass
+	switch s := self.(type) {
+	case *object.RubyModule:
+		if val, ok := s.Constants[name]; ok {
+			return val, true
+		}
+	case *object.RubyClass:
+		class = s
+	case *object.Instance:
+		class = s.Class_
+	}
+	for ; class != nil; class = class.Superclass {
+		if val, ok := class.Constants[name]; ok {
+			return val, true
+		}
+	}
+	val, ok := object.ObjectClass.Constants[name]
+	return val, ok
 }
 
 func evalInstanceVariable(node *ast.InstanceVariable, env *object.Environment) object.Object {
@@ -483,8 +644,8 @@ func evalInstanceVariable(node *ast.InstanceVariable, env *object.Environment) o
 		return object.NIL
 	}
 
-	if instance, ok := self.(*object.Instance); ok {
-		return instance.GetInstanceVariable(node.Name)
+	if holder, ok := self.(object.IvarHolder); ok {
+		return holder.GetInstanceVariable(node.Name)
 	}
 
 	return object.NIL
@@ -500,6 +661,16 @@ func evalClassVariable(node *ast.ClassVariable, env *object.Environment) object.
 
 var globalVariables = make(map[string]object.Object)
 
+// readOnlyGlobals may be read and mutated in place but not reassigned
+var readOnlyGlobals = map[string]bool{
+	"$LOAD_PATH":       true,
+	"$:":               true,
+	"$-I":              true,
+	"$$":               true,
+	"$LOADED_FEATURES": true,
+	"$\"":              true,
+}
+
 func evalGlobalVariable(node *ast.GlobalVariable, env *object.Environment) object.Object {
 	if val, ok := globalVariables[node.Name]; ok {
 		return val
@@ -518,23 +689,42 @@ func evalScopedConstant(node *ast.ScopedConstant, env *object.Environment) objec
 		return left
 	}
 
-	switch obj := left.(type) {
+	if val, ok := constantIn(left, node.Name, env); ok {
+		return val
+	}
+	return newError("uninitialized constant %s::%s", left.Inspect(), node.Name)
+}
+
+// constantIn finds the constant name defined on scope, a class or module,
+// reporting whether it is defined.
+func constantIn(scope object.Object, name string, env *object.Environment) (object.Object, bool) {
+	switch obj := scope.(type) {
 	case *object.RubyClass:
-		if val, ok := obj.Constants[node.Name]; ok {
-			return val
+		if val, ok := obj.Constants[name]; ok {
+			return val, true
 		}
 	case *object.RubyModule:
-		if val, ok := obj.Constants[node.Name]; ok {
-			return val
+		if val, ok := obj.Constants[name]; ok {
+			return val, true
 		}
 	}
-
-	return newError("uninitialized constant %s::%s", left.Inspect(), node.Name)
+	return autoloadConstant(scope, name, env)
 }
 
 // Prefix expression
 
 func evalPrefixExpression(operator string, right object.Object) object.Object {
+	// Instances may define the operator; unary minus and plus are -@ and +@
+	if inst, ok := right.(*object.Instance); ok {
+		name := operator
+		if operator == "-" || operator == "+" {
+			name += "@"
+		}
+		if method, ok := inst.Class_.LookupMethod(name); ok {
+			return applyMethod(method, right, nil, nil, nil)
+		}
+	}
+
 	switch operator {
 	case "!":
 		return evalBangOperator(right)
@@ -559,6 +749,12 @@ func evalMinusPrefixOperator(right object.Object) object.Object {
 		return &object.Integer{Value: -obj.Value}
 	case *object.Float:
 		return &object.Float{Value: -obj.Value}
+	case *object.String:
+		// -str is a frozen copy of an unfrozen string
+		if obj.Frozen {
+			return obj
+		}
+		return &object.String{Value: obj.Value, Frozen: true}
 	default:
 		return newError("undefined method `-@' for %s", right.Type())
 	}
@@ -570,6 +766,12 @@ func evalPlusPrefixOperator(right object.Object) object.Object {
 		return obj
 	case *object.Float:
 		return obj
+	case *object.String:
+		// +str is an unfrozen copy of a frozen string
+		if obj.Frozen {
+			return &object.String{Value: obj.Value}
+		}
+		return obj
 	default:
 		return newError("undefined method `+@' for %s", right.Type())
 	}
@@ -586,6 +788,22 @@ func evalTildeOperator(right object.Object) object.Object {
 
 func evalInfixExpression(operator string, left, right object.Object) object.Object {
 	switch {
+	case operator == "===" && definesCaseEquality(left):
+		// Ranges, classes, procs and regexps match whatever the right
+		// operand is, so they go before the numeric fast paths
+		return evalCaseEquality(left, right)
+	case operator == "===" && !(left.Type() == object.INSTANCE_OBJ && instanceResponds(left, "===")):
+		// Everything else matches by equality
+		return evalInfixExpression("==", left, right)
+	case left.Type() == object.RANGE_OBJ && operator == "%":
+		// Range#% is an alias of step
+		return evalRangeStep(left.(*object.Range), right, nil, nil)
+	case isCallable(left) && (operator == ">>" || operator == "<<"):
+		return composeCallables(operator, left, right)
+	case left.Type() == object.TIME_OBJ:
+		return evalTimeInfixExpression(operator, left, right)
+	case left.Type() == object.DATE_OBJ:
+		return evalDateInfixExpression(operator, left, right)
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
 		return evalIntegerInfixExpression(operator, left, right)
 	case left.Type() == object.FLOAT_OBJ || right.Type() == object.FLOAT_OBJ:
@@ -600,16 +818,29 @@ func evalInfixExpression(operator string, left, right object.Object) object.Obje
 		return evalRegexpStringInfixExpression(operator, left, right)
 	case left.Type() == object.ARRAY_OBJ:
 		return evalArrayInfixExpression(operator, left, right)
-	case left.Type() == object.TIME_OBJ:
-		return evalTimeInfixExpression(operator, left, right)
-	case left.Type() == object.DATE_OBJ:
-		return evalDateInfixExpression(operator, left, right)
+	case left.Type() == object.INSTANCE_OBJ && instanceResponds(left, operator):
+		method, _ := left.(*object.Instance).Class_.LookupMethod(operator)
+		return applyMethod(method, left, []object.Object{right}, nil, nil)
+	case left.Type() == object.INSTANCE_OBJ && operator == "!=" && instanceResponds(left, "=="):
+		// != is the negation of a user-defined ==
+		method, _ := left.(*object.Instance).Class_.LookupMethod("==")
+		result := applyMethod(method, left, []object.Object{right}, nil, nil)
+		if isError(result) {
+			return result
+		}
+		return object.NativeToBool(!isTruthy(result))
 	case operator == "==":
 		return object.NativeToBool(objectsEqual(left, right))
 	case operator == "!=":
 		return object.NativeToBool(!objectsEqual(left, right))
 	case operator == "===":
 		return evalCaseEquality(left, right)
+	case operator == "<=>":
+		c, err := compareObjects(left, right)
+		if err != nil {
+			return object.NIL
+		}
+		return &object.Integer{Value: int64(c)}
 	case operator == "&&":
 		if !isTruthy(left) {
 			return left
@@ -625,6 +856,12 @@ func evalInfixExpression(operator string, left, right object.Object) object.Obje
 	}
 }
 
+// instanceResponds reports whether obj's class defines the named method.
+func instanceResponds(obj object.Object, name string) bool {
+	_, ok := obj.(*object.Instance).Class_.LookupMethod(name)
+	return ok
+}
+
 func evalStringRegexpInfixExpression(operator string, left, right object.Object) object.Object {
 	str := left.(*object.String).Value
 	re := right.(*object.Regexp)
@@ -854,7 +1091,13 @@ func evalArrayInfixExpression(operator string, left, right object.Object) object
 			return &object.Array{Elements: elements}
 		}
 	case "*":
+		if sep, ok := right.(*object.String); ok {
+			return joinArray(leftArr, sep.Value)
+		}
 		if n, ok := right.(*object.Integer); ok {
+			if n.Value < 0 {
+				return newError("ArgumentError: negative argument")
+			}
 			elements := make([]object.Object, 0, len(leftArr.Elements)*int(n.Value))
 			for i := int64(0); i < n.Value; i++ {
 				elements = append(elements, leftArr.Elements...)
@@ -864,6 +1107,29 @@ func evalArrayInfixExpression(operator string, left, right object.Object) object
 	case "<<":
 		leftArr.Elements = append(leftArr.Elements, right)
 		return leftArr
+	case "&", "|", "-":
+		rightArr, ok := right.(*object.Array)
+		if !ok {
+			return newError("TypeError: no implicit conversion of %s into Array", comparisonOperandName(right))
+		}
+		switch operator {
+		case "&":
+			return arrayIntersection(leftArr.Elements, rightArr.Elements)
+		case "|":
+			return arrayUnion(leftArr.Elements, rightArr.Elements)
+		default:
+			return arrayDifference(leftArr.Elements, rightArr.Elements)
+		}
+	case "==":
+		return object.NativeToBool(objectsEqual(left, right))
+	case "!=":
+		return object.NativeToBool(!objectsEqual(left, right))
+	case "<=>":
+		c, err := compareObjects(left, right)
+		if err != nil {
+			return object.NIL
+		}
+		return &object.Integer{Value: int64(c)}
 	}
 
 	return newError("undefined method `%s' for Array", operator)
@@ -931,35 +1197,81 @@ func evalDateInfixExpression(operator string, left, right object.Object) object.
 
 	switch operator {
 	case "+":
-		if r, ok := right.(*object.Integer); ok {
-			return &object.Date{Value: leftDate.Value.AddDate(0, 0, int(r.Value))}
+		switch r := right.(type) {
+		case *object.Integer:
+			return &object.Date{Value: leftDate.Value.AddDate(0, 0, int(r.Value)), DateTime: leftDate.DateTime}
+		case *object.Float:
+			// Fractions of a day only survive on a DateTime
+			t := leftDate.Value.Add(time.Duration(r.Value * float64(24*time.Hour)))
+			if !leftDate.DateTime {
+				t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+			}
+			return &object.Date{Value: t, DateTime: leftDate.DateTime}
 		}
 	case "-":
 		switch r := right.(type) {
 		case *object.Integer:
-			return &object.Date{Value: leftDate.Value.AddDate(0, 0, -int(r.Value))}
+			return &object.Date{Value: leftDate.Value.AddDate(0, 0, -int(r.Value)), DateTime: leftDate.DateTime}
 		case *object.Date:
 			diff := leftDate.Value.Sub(r.Value)
+			if leftDate.DateTime || r.DateTime {
+				return &object.Float{Value: diff.Hours() / 24}
+			}
 			return &object.Integer{Value: int64(diff.Hours() / 24)}
 		}
-	case "<":
-		if r, ok := right.(*object.Date); ok {
-			return object.NativeToBool(leftDate.Value.Before(r.Value))
-		}
-	case ">":
-		if r, ok := right.(*object.Date); ok {
-			return object.NativeToBool(leftDate.Value.After(r.Value))
+	case ">>", "<<":
+		if r, ok := right.(*object.Integer); ok {
+			n := int(r.Value)
+			if operator == "<<" {
+				n = -n
+			}
+			return &object.Date{Value: addMonths(leftDate.Value, n), DateTime: leftDate.DateTime}
 		}
-	case "==":
+	case "<", ">", "<=", ">=", "<=>":
+		r, ok := right.(*object.Date)
+		if !ok {
+			if operator == "<=>" {
+				return object.NIL
+			}
+			return newError("ArgumentError: comparison of Date with %s failed", comparisonOperandName(right))
+		}
+		c := leftDate.Value.Compare(r.Value)
+		switch operator {
+		case "<":
+			return object.NativeToBool(c < 0)
+		case ">":
+			return object.NativeToBool(c > 0)
+		case "<=":
+			return object.NativeToBool(c <= 0)
+		case ">=":
+			return object.NativeToBool(c >= 0)
+		}
+		return &object.Integer{Value: int64(c)}
+	case "==", "===":
 		if r, ok := right.(*object.Date); ok {
 			return object.NativeToBool(leftDate.Value.Equal(r.Value))
 		}
 		return object.FALSE
+	case "!=":
+		if r, ok := right.(*object.Date); ok {
+			return object.NativeToBool(!leftDate.Value.Equal(r.Value))
+		}
+		return object.TRUE
 	}
 
 	return newError("undefined method `%s' for Date", operator)
 }
 
+// definesCaseEquality reports whether left has a === of its own rather
+// than the equality every object gets.
+func definesCaseEquality(left object.Object) bool {
+	switch left.(type) {
+	case *object.RubyClass, *object.Range, *object.Proc, *object.Lambda, *object.Method, *object.BoundMethod, *object.Regexp:
+		return true
+	}
+	return false
+}
+
 func evalCaseEquality(left, right object.Object) object.Object {
 	// === operator behavior depends on the left operand
 	switch l := left.(type) {
@@ -979,6 +1291,9 @@ func evalCaseEquality(left, right object.Object) object.Object {
 		return object.FALSE
 	case *object.Range:
 		return evalRangeIncludes(l, right)
+	case *object.Proc, *object.Lambda, *object.Method, *object.BoundMethod:
+		// Calling the proc lets lambdas serve as when conditions
+		return object.NativeToBool(isTruthy(callProc(left, []object.Object{right}, object.NewEnvironment())))
 	case *object.Regexp:
 		if str, ok := right.(*object.String); ok {
 			// Simplified regex matching
@@ -996,29 +1311,61 @@ func evalAssignment(node *ast.AssignmentExpression, env *object.Environment) obj
 	if isError(val) {
 		return val
 	}
+	return assignValue(node.Left, val, env)
+}
 
-	switch target := node.Left.(type) {
+// assignValue stores val in an assignment target.
+func assignValue(left ast.Expression, val object.Object, env *object.Environment) object.Object {
+	switch target := left.(type) {
 	case *ast.Identifier:
-		return env.Set(target.Value, val)
+		return env.Assign(target.Value, val)
 	case *ast.InstanceVariable:
 		return setInstanceVariable(target.Name, val, env)
 	case *ast.ClassVariable:
 		return env.Set(target.Name, val)
 	case *ast.GlobalVariable:
+		if readOnlyGlobals[target.Name] {
+			return newError("NameError: %s is a read-only variable", target.Name)
+		}
+		if err := checkStreamAssignment(target.Name, val); err != nil {
+			return err
+		}
+		if deprecatedGlobals[target.Name] && val != object.NIL {
+			if err := warnAt(target.Token.Pos(), "`"+target.Name+"' is deprecated", "deprecated", env); err != nil {
+				return err
+			}
+		}
 		globalVariables[target.Name] = val
 		return val
 	case *ast.Constant:
+		// A struct class takes the name of the first constant it is assigned to
+		if class, ok := val.(*object.RubyClass); ok && class.StructMembers != nil && class.Name == "Struct" {
+			class.Name = target.Value
+		}
 		// Store constant in current class/module if inside one
 		self := env.Self()
 		if class, ok := self.(*object.RubyClass); ok {
+			if err := warnConstantReassigned(class, class.Constants, target.Value, target.Token.Pos(), env); err != nil {
+				return err
+			}
 			class.Constants[target.Value] = val
 			return val
 		}
 		if mod, ok := self.(*object.RubyModule); ok {
+			if err := warnConstantReassigned(mod, mod.Constants, target.Value, target.Token.Pos(), env); err != nil {
+				return err
+			}
 			mod.Constants[target.Value] = val
 			return val
 		}
+		if _, ok := env.GetConstant(target.Value); ok {
+			if err := warnAt(target.Token.Pos(), "already initialized constant "+target.Value, "", env); err != nil {
+				return err
+			}
+		}
 		return env.SetConstant(target.Value, val)
+	case *ast.ScopedConstant:
+		return setScopedConstant(target, val, env)
 	case *ast.IndexExpression:
 		return evalIndexAssignment(target, val, env)
 	case *ast.MethodCall:
@@ -1029,9 +1376,129 @@ func evalAssignment(node *ast.AssignmentExpression, env *object.Environment) obj
 		}
 		setterName := target.Method + "="
 		return callMethod(receiver, setterName, []object.Object{val}, nil, env)
+	case *ast.MultipleTarget:
+		if err := destructure(target.Targets, val, env); err != nil {
+			return err
+		}
+		return val
 	default:
-		return newError("invalid assignment target: %T", node.Left)
+		return newError("invalid assignment target: %T", left)
+	}
+}
+
+// setScopedConstant assigns Scope::NAME, or ::NAME at the top level.
+func setScopedConstant(target *ast.ScopedConstant, val object.Object, env *object.Environment) object.Object {
+	var scope object.Object = object.ObjectClass
+	if target.Left != nil {
+		scope = Eval(target.Left, env)
+		if isError(scope) {
+			return scope
+		}
+	}
+	switch s := scope.(type) {
+	case *object.RubyClass:
+		if err := warnConstantReassigned(s, s.Constants, target.Name, target.Token.Pos(), env); err != nil {
+			return err
+		}
+		s.Constants[target.Name] = val
+	case *object.RubyModule:
+		if err := warnConstantReassigned(s, s.Constants, target.Name, target.Token.Pos(), env); err != nil {
+			return err
+		}
+		s.Constants[target.Name] = val
+	default:
+		return newError("TypeError: %s is not a class/module", scope.Inspect())
+	}
+	return val
+}
+
+// evalMultipleAssignment evaluates every value on the right before
+// assigning any target, so a, b = b, a swaps. A single value is spread
+// across the targets if it is an array.
+func evalMultipleAssignment(node *ast.MultipleAssignment, env *object.Environment) object.Object {
+	var val object.Object
+	if _, splat := node.Right[0].(*ast.SplatExpression); len(node.Right) == 1 && !splat {
+		val = Eval(node.Right[0], env)
+		if isError(val) {
+			return val
+		}
+	} else {
+		values := []object.Object{}
+		for _, exp := range node.Right {
+			v := Eval(exp, env)
+			if isError(v) {
+				return v
+			}
+			if _, splat := exp.(*ast.SplatExpression); splat {
+				values = append(values, v.(*object.Array).Elements...)
+			} else {
+				values = append(values, v)
+			}
+		}
+		val = &object.Array{Elements: values}
+	}
+
+	if err := destructure(node.Left, val, env); err != nil {
+		return err
+	}
+	return val
+}
+
+// destructure assigns the elements of val to targets, one each, with a
+// splat target taking whatever the targets after it leave over. A value
+// that is not an array is treated as a one-element array.
+func destructure(targets []ast.Expression, val object.Object, env *object.Environment) object.Object {
+	elements := []object.Object{val}
+	if arr, ok := val.(*object.Array); ok {
+		elements = arr.Elements
+	}
+
+	splat := -1
+	for i, target := range targets {
+		if _, ok := target.(*ast.SplatExpression); ok {
+			splat = i
+			break
+		}
 	}
+
+	element := func(i int) object.Object {
+		if i < len(elements) {
+			return elements[i]
+		}
+		return object.NIL
+	}
+
+	// Targets after the splat take elements from the end, but never ones
+	// the targets before it already took
+	after := len(targets) - splat - 1
+	tail := len(elements) - after
+	if tail < splat {
+		tail = splat
+	}
+
+	for i, target := range targets {
+		var value object.Object
+		switch {
+		case splat < 0 || i < splat:
+			value = element(i)
+		case i == splat:
+			rest := []object.Object{}
+			if tail > splat {
+				rest = append(rest, elements[splat:tail]...)
+			}
+			value = &object.Array{Elements: rest}
+			target = target.(*ast.SplatExpression).Expression
+			if target == nil {
+				continue
+			}
+		default:
+			value = element(tail + i - splat - 1)
+		}
+		if result := assignValue(target, value, env); isError(result) {
+			return result
+		}
+	}
+	return nil
 }
 
 func evalOpAssignment(node *ast.OpAssignmentExpression, env *object.Environment) object.Object {
@@ -1042,12 +1509,38 @@ func evalOpAssignment(node *ast.OpAssignmentExpression, env *object.Environment)
 		currentVal, _ = env.Get(target.Value)
 	case *ast.InstanceVariable:
 		currentVal = evalInstanceVariable(target, env)
+	case *ast.ClassVariable:
+		currentVal = evalClassVariable(target, env)
+	case *ast.GlobalVariable:
+		currentVal = evalGlobalVariable(target, env)
 	case *ast.IndexExpression:
 		currentVal = evalIndexExpression(target, env)
+	case *ast.MethodCall:
+		currentVal = Eval(target, env)
+	case *ast.Constant:
+		// CONST ||= value defines the constant if it is missing
+		if node.Operator == "||=" {
+			currentVal, _ = lookupConstant(target.Value, env)
+		} else {
+			currentVal = evalConstant(target, env)
+		}
+	case *ast.ScopedConstant:
+		if node.Operator != "||=" {
+			currentVal = evalScopedConstant(target, env)
+		} else if target.Left == nil {
+			currentVal, _ = lookupConstant(target.Name, env)
+		} else if scope := Eval(target.Left, env); isError(scope) {
+			return scope
+		} else {
+			currentVal, _ = constantIn(scope, target.Name, env)
+		}
 	default:
 		return newError("invalid assignment target: %T", node.Left)
 	}
 
+	if isError(currentVal) {
+		return currentVal
+	}
 	if currentVal == nil {
 		currentVal = object.NIL
 	}
@@ -1062,11 +1555,7 @@ func evalOpAssignment(node *ast.OpAssignmentExpression, env *object.Environment)
 		if isError(val) {
 			return val
 		}
-		return evalAssignment(&ast.AssignmentExpression{
-			Token: node.Token,
-			Left:  node.Left,
-			Value: node.Value,
-		}, env)
+		return assignValue(node.Left, val, env)
 	case "&&=":
 		if !isTruthy(currentVal) {
 			return currentVal
@@ -1075,11 +1564,7 @@ func evalOpAssignment(node *ast.OpAssignmentExpression, env *object.Environment)
 		if isError(val) {
 			return val
 		}
-		return evalAssignment(&ast.AssignmentExpression{
-			Token: node.Token,
-			Left:  node.Left,
-			Value: node.Value,
-		}, env)
+		return assignValue(node.Left, val, env)
 	}
 
 	// Evaluate right side
@@ -1120,17 +1605,7 @@ func evalOpAssignment(node *ast.OpAssignmentExpression, env *object.Environment)
 		return result
 	}
 
-	// Assign result
-	switch target := node.Left.(type) {
-	case *ast.Identifier:
-		return env.Set(target.Value, result)
-	case *ast.InstanceVariable:
-		return setInstanceVariable(target.Name, result, env)
-	case *ast.IndexExpression:
-		return evalIndexAssignment(target, result, env)
-	}
-
-	return result
+	return assignValue(node.Left, result, env)
 }
 
 func setInstanceVariable(name string, val object.Object, env *object.Environment) object.Object {
@@ -1139,8 +1614,8 @@ func setInstanceVariable(name string, val object.Object, env *object.Environment
 		return newError("cannot set instance variable outside of object")
 	}
 
-	if instance, ok := self.(*object.Instance); ok {
-		instance.SetInstanceVariable(name, val)
+	if holder, ok := self.(object.IvarHolder); ok {
+		holder.SetInstanceVariable(name, val)
 		return val
 	}
 
@@ -1153,31 +1628,60 @@ func evalIndexExpression(node *ast.IndexExpression, env *object.Environment) obj
 		return left
 	}
 
-	index := Eval(node.Index, env)
-	if isError(index) {
-		return index
+	args := evalExpressions(node.Arguments, env)
+	if len(args) == 1 && isError(args[0]) {
+		return args[0]
 	}
 
-	return evalIndex(left, index)
+	if isCallable(left) {
+		// proc[args] is an alias of proc.call(args)
+		return callProc(left, args, env)
+	}
+	return evalIndex(left, args...)
 }
 
-func evalIndex(left, index object.Object) object.Object {
+// evalIndex evaluates left[args]. A user-defined [] gets every argument;
+// the builtin collections take an index, or a start and a length.
+func evalIndex(left object.Object, args ...object.Object) object.Object {
+	switch obj := left.(type) {
+	case *object.Instance:
+		if method, ok := obj.Class_.LookupMethod("[]"); ok {
+			return applyMethod(method, left, args, nil, nil)
+		}
+		return newError("undefined method `[]' for %s", obj.Class_.Name)
+	case *object.RubyClass:
+		// Class-level [] such as Hash[pairs]
+		if method, ok := obj.LookupClassMethod("[]"); ok {
+			return applyMethod(method, left, args, nil, nil)
+		}
+		return newError("undefined method `[]' for %s:Class", obj.Name)
+	case *object.RubyModule:
+		// Module-level [] such as Warning[:deprecated]
+		if method, ok := obj.Methods["[]"]; ok {
+			return applyMethod(method, left, args, nil, nil)
+		}
+		return newError("undefined method `[]' for %s:Module", obj.Name)
+	}
+
+	switch len(args) {
+	case 1:
+	case 2:
+		return evalIndexWithLength(left, args[0], args[1])
+	default:
+		return newError("ArgumentError: wrong number of arguments (given %d, expected 1..2)", len(args))
+	}
+	index := args[0]
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalArrayIndex(left, index)
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.RANGE_OBJ:
+		return evalArrayRangeIndex(left.(*object.Array), index.(*object.Range))
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndex(left, index)
 	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalStringIndex(left, index)
 	case left.Type() == object.STRING_OBJ && index.Type() == object.RANGE_OBJ:
 		return evalStringRangeIndex(left, index)
-	case left.Type() == object.INSTANCE_OBJ:
-		// Check if instance's class has a [] method
-		inst := left.(*object.Instance)
-		if method, ok := inst.Class_.LookupMethod("[]"); ok {
-			return applyMethod(method, left, []object.Object{index}, nil, nil)
-		}
-		return newError("undefined method `[]' for %s", inst.Class_.Name)
 	default:
 		return newError("index operator not supported: %s", left.Type())
 	}
@@ -1199,22 +1703,132 @@ func evalArrayIndex(array, index object.Object) object.Object {
 	return arr.Elements[idx]
 }
 
+// evalIndexWithLength evaluates the two-argument form receiver[start, length].
+func evalIndexWithLength(left, index, length object.Object) object.Object {
+	start, ok := index.(*object.Integer)
+	if !ok {
+		return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(index))
+	}
+	count, ok := length.(*object.Integer)
+	if !ok {
+		return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(length))
+	}
+
+	switch obj := left.(type) {
+	case *object.Array:
+		return arraySlice(obj, int(start.Value), int(count.Value))
+	case *object.String:
+		runes := []rune(obj.Value)
+		from := int(start.Value)
+		if from < 0 {
+			from += len(runes)
+		}
+		if from < 0 || from > len(runes) || count.Value < 0 {
+			return object.NIL
+		}
+		to := from + int(count.Value)
+		if to > len(runes) {
+			to = len(runes)
+		}
+		return &object.String{Value: string(runes[from:to])}
+	}
+	return newError("index operator not supported: %s", left.Type())
+}
+
+// arraySlice returns up to length elements starting at start, or nil when
+// start lies outside the array.
+func arraySlice(arr *object.Array, start, length int) object.Object {
+	n := len(arr.Elements)
+	if start < 0 {
+		start += n
+	}
+	if start < 0 || start > n || length < 0 {
+		return object.NIL
+	}
+	end := start + length
+	if end > n {
+		end = n
+	}
+	elements := make([]object.Object, end-start)
+	copy(elements, arr.Elements[start:end])
+	return &object.Array{Elements: elements}
+}
+
+func evalArrayRangeIndex(arr *object.Array, r *object.Range) object.Object {
+	start, end, err := rangeBounds(r, len(arr.Elements))
+	if err != nil {
+		return err
+	}
+	if start < 0 {
+		return object.NIL
+	}
+	return arraySlice(arr, start, end-start)
+}
+
+// spliceArray replaces length elements starting at start with val (or
+// with val's elements when it is an Array), growing or shrinking arr.
+func spliceArray(arr *object.Array, start, length int, val object.Object) object.Object {
+	n := len(arr.Elements)
+	if start < 0 {
+		start += n
+		if start < 0 {
+			return newError("IndexError: index %d too small for array; minimum: -%d", start-n, n)
+		}
+	}
+	if length < 0 {
+		return newError("IndexError: negative length (%d)", length)
+	}
+	for len(arr.Elements) < start {
+		arr.Elements = append(arr.Elements, object.NIL)
+	}
+	end := start + length
+	if end > len(arr.Elements) {
+		end = len(arr.Elements)
+	}
+	replacement := []object.Object{val}
+	if a, ok := val.(*object.Array); ok {
+		replacement = a.Elements
+	}
+	elements := make([]object.Object, 0, len(arr.Elements)-(end-start)+len(replacement))
+	elements = append(elements, arr.Elements[:start]...)
+	elements = append(elements, replacement...)
+	elements = append(elements, arr.Elements[end:]...)
+	arr.Elements = elements
+	return val
+}
+
 func evalHashIndex(hash, index object.Object) object.Object {
 	hashObject := hash.(*object.Hash)
 
-	key, ok := index.(object.Hashable)
+	key, ok := hashObject.KeyFor(index)
 	if !ok {
 		return newError("unusable as hash key: %s", index.Type())
 	}
 
-	pair, ok := hashObject.Pairs[key.HashKey()]
+	pair, ok := hashObject.Pairs[key]
 	if !ok {
-		return object.NIL
+		return hashDefault(hashObject, index)
 	}
 
 	return pair.Value
 }
 
+// hashDefault returns the value for a key missing from hash: the result of
+// its default proc, its default value, or nil.
+func hashDefault(hash *object.Hash, key object.Object) object.Object {
+	if hash.DefaultProc != nil {
+		result := callBlock(hash.DefaultProc, []object.Object{hash, key}, hash.DefaultProc.Env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			return bv.Value
+		}
+		return result
+	}
+	if hash.Default != nil {
+		return hash.Default
+	}
+	return object.NIL
+}
+
 func evalStringIndex(str, index object.Object) object.Object {
 	s := str.(*object.String)
 	idx := index.(*object.Integer).Value
@@ -1277,16 +1891,77 @@ func evalIndexAssignment(node *ast.IndexExpression, val object.Object, env *obje
 		return left
 	}
 
-	index := Eval(node.Index, env)
-	if isError(index) {
-		return index
+	args := evalExpressions(node.Arguments, env)
+	if len(args) == 1 && isError(args[0]) {
+		return args[0]
 	}
 
+	// A user-defined []= gets every argument and the value; the
+	// assignment evaluates to the value, whatever []= returns
 	switch obj := left.(type) {
-	case *object.Array:
-		idx := index.(*object.Integer).Value
-		if idx < 0 {
-			idx = int64(len(obj.Elements)) + idx
+	case *object.Instance:
+		method, ok := obj.Class_.LookupMethod("[]=")
+		if !ok {
+			return newError("undefined method `[]=' for %s", obj.Class_.Name)
+		}
+		if result := applyMethod(method, left, append(args, val), nil, nil); isError(result) {
+			return result
+		}
+		return val
+	case *object.RubyModule:
+		method, ok := obj.Methods["[]="]
+		if !ok {
+			return newError("undefined method `[]=' for %s:Module", obj.Name)
+		}
+		if result := applyMethod(method, left, append(args, val), nil, env); isError(result) {
+			return result
+		}
+		return val
+	}
+
+	if len(args) == 2 {
+		index, length := args[0], args[1]
+		arr, ok := left.(*object.Array)
+		if !ok {
+			return newError("index assignment not supported: %s", left.Type())
+		}
+		start, ok := index.(*object.Integer)
+		if !ok {
+			return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(index))
+		}
+		count, ok := length.(*object.Integer)
+		if !ok {
+			return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(length))
+		}
+		return spliceArray(arr, int(start.Value), int(count.Value), val)
+	}
+	if len(args) != 1 {
+		return newError("ArgumentError: wrong number of arguments (given %d, expected 2..3)", len(args)+1)
+	}
+
+	index := args[0]
+	switch obj := left.(type) {
+	case *object.Array:
+		if r, ok := index.(*object.Range); ok {
+			start, end, err := rangeBounds(r, len(obj.Elements))
+			if err != nil {
+				return err
+			}
+			if start < 0 {
+				return newError("RangeError: %s out of range", r.Inspect())
+			}
+			return spliceArray(obj, start, end-start, val)
+		}
+		n, ok := index.(*object.Integer)
+		if !ok {
+			return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(index))
+		}
+		idx := n.Value
+		if idx < 0 {
+			idx = int64(len(obj.Elements)) + idx
+			if idx < 0 {
+				return newError("IndexError: index %d too small for array; minimum: -%d", n.Value, len(obj.Elements))
+			}
 		}
 		if idx >= 0 && idx < int64(len(obj.Elements)) {
 			obj.Elements[idx] = val
@@ -1301,13 +1976,9 @@ func evalIndexAssignment(node *ast.IndexExpression, val object.Object, env *obje
 		}
 		return val
 	case *object.Hash:
-		key, ok := index.(object.Hashable)
-		if !ok {
-			return newError("unusable as hash key: %s", index.Type())
+		if err := hashSet(obj, index, val); err != nil {
+			return err
 		}
-		hashed := key.HashKey()
-		obj.Pairs[hashed] = object.HashPair{Key: index, Value: val}
-		obj.Order = append(obj.Order, hashed)
 		return val
 	default:
 		return newError("index assignment not supported: %s", left.Type())
@@ -1335,8 +2006,10 @@ func evalMethodCall(node *ast.MethodCall, env *object.Environment) object.Object
 		}
 	}
 
+	argNodes, blockArg := splitBlockArg(node.Arguments)
+
 	// Evaluate arguments
-	args := evalExpressions(node.Arguments, env)
+	args := evalExpressions(argNodes, env)
 	if len(args) == 1 && isError(args[0]) {
 		return args[0]
 	}
@@ -1367,15 +2040,74 @@ func evalMethodCall(node *ast.MethodCall, env *object.Environment) object.Object
 			Body:       node.Block.Body,
 			Env:        env,
 		}
+	} else if blockArg != nil {
+		val := Eval(blockArg.Expression, env)
+		if isError(val) {
+			return val
+		}
+		converted, err := toBlock(val, env)
+		if err != nil {
+			return err
+		}
+		block = converted
 	}
 
 	return callMethod(receiver, node.Method, args, block, env)
 }
 
+// splitBlockArg separates a trailing &expr argument, which is passed as
+// the block, from the other arguments.
+func splitBlockArg(argNodes []ast.Expression) ([]ast.Expression, *ast.BlockArgExpression) {
+	if n := len(argNodes); n > 0 {
+		if ba, ok := argNodes[n-1].(*ast.BlockArgExpression); ok {
+			return argNodes[:n-1], ba
+		}
+	}
+	return argNodes, nil
+}
+
+// toBlock converts the value of a &expr argument into a block: procs and
+// lambdas are used as-is, nil passes no block, and anything else is
+// converted with to_proc.
+func toBlock(val object.Object, env *object.Environment) (*object.Proc, object.Object) {
+	switch v := val.(type) {
+	case *object.Nil:
+		return nil, nil
+	case *object.Proc:
+		return v, nil
+	case *object.Lambda:
+		return &object.Proc{Parameters: v.Parameters, Body: v.Body, Env: v.Env, Native: v.Native}, nil
+	}
+	converted := callMethod(val, "to_proc", nil, nil, env)
+	if isError(converted) {
+		return nil, newError("TypeError: wrong argument type %s (expected Proc)", comparisonOperandName(val))
+	}
+	switch v := converted.(type) {
+	case *object.Proc:
+		return v, nil
+	case *object.Lambda:
+		return &object.Proc{Parameters: v.Parameters, Body: v.Body, Env: v.Env, Native: v.Native}, nil
+	}
+	return nil, newError("TypeError: can't convert %s to Proc (%s#to_proc gives %s)",
+		comparisonOperandName(val), comparisonOperandName(val), comparisonOperandName(converted))
+}
+
+// binaryOperators are the operator method names evalInfixExpression
+// implements for built-in values.
+var binaryOperators = map[string]bool{
+	"+": true, "-": true, "*": true, "/": true, "%": true, "**": true,
+	"==": true, "!=": true, "<": true, ">": true, "<=": true, ">=": true,
+	"<=>": true, "===": true, "<<": true, ">>": true, "&": true, "|": true, "^": true,
+}
+
 func callMethod(receiver object.Object, methodName string, args []object.Object, block *object.Proc, env *object.Environment) object.Object {
 	// Check if receiver is a class (class method call)
 	if class, ok := receiver.(*object.RubyClass); ok {
 		if method, ok := class.LookupClassMethod(methodName); ok {
+			// Private class methods can only be called on self
+			if m, ok := method.(*object.Method); ok && m.Visibility == object.VisibilityPrivate && env.Self() != receiver {
+				return newError("private method `%s' called for %s", methodName, receiver.Inspect())
+			}
 			return applyMethod(method, receiver, args, block, env)
 		}
 		// Check for 'new' method
@@ -1442,10 +2174,16 @@ func callMethod(receiver object.Object, methodName string, args []object.Object,
 		// Create a new environment with the block set
 		callEnv := object.NewEnclosedEnvironment(env)
 		callEnv.SetSelf(receiver)
-		if block != nil {
-			callEnv.SetBlock(block)
-		}
-		return builtin.Fn(receiver, callEnv, args...)
+		callEnv.SetBlock(block)
+		done := startProfiledCall(receiver, methodName, nil)
+		result := builtin.Fn(receiver, callEnv, args...)
+		done()
+		return result
+	}
+
+	// Operators on built-in values, as in 1.send(:+, 2) or reduce(&:+)
+	if _, isInstance := receiver.(*object.Instance); !isInstance && len(args) == 1 && binaryOperators[methodName] {
+		return evalInfixExpression(methodName, receiver, args[0])
 	}
 
 	// Check for method_missing (but not if we're already calling method_missing)
@@ -1473,9 +2211,7 @@ func applyMethodWithContext(method object.Object, receiver object.Object, args [
 	case *object.Method:
 		extendedEnv := object.NewEnclosedEnvironment(m.Env)
 		extendedEnv.SetSelf(receiver)
-		if block != nil {
-			extendedEnv.SetBlock(block)
-		}
+		extendedEnv.SetBlock(block)
 
 		// Set method context for super calls
 		extendedEnv.SetCurrentMethod(m.Name)
@@ -1484,12 +2220,20 @@ func applyMethodWithContext(method object.Object, receiver object.Object, args [
 			extendedEnv.SetDefiningClass(definingClass)
 		}
 
-		// Separate positional and keyword arguments
+		// Separate positional and keyword arguments. A method without
+		// keyword parameters receives a trailing hash positionally.
 		var positionalArgs []object.Object
 		var kwArgs *object.Hash
 
+		acceptsKeywords := false
+		for _, param := range m.Parameters {
+			if param.KeywordOnly || param.DSplat {
+				acceptsKeywords = true
+			}
+		}
+
 		for _, arg := range args {
-			if hash, ok := arg.(*object.Hash); ok && hash.IsKeywordArgs {
+			if hash, ok := arg.(*object.Hash); ok && hash.IsKeywordArgs && acceptsKeywords {
 				kwArgs = hash
 			} else {
 				positionalArgs = append(positionalArgs, arg)
@@ -1517,7 +2261,12 @@ func applyMethodWithContext(method object.Object, receiver object.Object, args [
 					})
 				}
 			} else if param.Block {
-				// Block parameter handled separately
+				// &blk receives the passed block as a Proc, or nil
+				if block != nil {
+					extendedEnv.Set(param.Name, block)
+				} else {
+					extendedEnv.Set(param.Name, object.NIL)
+				}
 			} else if param.KeywordOnly {
 				// Keyword-only parameter
 				if kwArgs != nil {
@@ -1553,7 +2302,11 @@ func applyMethodWithContext(method object.Object, receiver object.Object, args [
 		// Fire :call trace event
 		FireTraceEvent(object.TraceEventCall, m.Name, "", 0, receiver, nil, nil, extendedEnv)
 
+		pushFrame(m.Name)
+		done := startProfiledCall(receiver, m.Name, definingClass)
 		result := evalBlockBody(m.Body, extendedEnv)
+		done()
+		popFrame()
 		returnVal := unwrapReturnValue(result)
 
 		// Fire :return trace event
@@ -1564,10 +2317,11 @@ func applyMethodWithContext(method object.Object, receiver object.Object, args [
 	case *object.Builtin:
 		callEnv := object.NewEnclosedEnvironment(env)
 		callEnv.SetSelf(receiver)
-		if block != nil {
-			callEnv.SetBlock(block)
-		}
-		return m.Fn(receiver, callEnv, args...)
+		callEnv.SetBlock(block)
+		done := startProfiledCall(receiver, m.Name, definingClass)
+		result := m.Fn(receiver, callEnv, args...)
+		done()
+		return result
 
 	default:
 		return newError("not a method: %s", method.Type())
@@ -1632,15 +2386,30 @@ func evalSuperExpression(node *ast.SuperExpression, env *object.Environment) obj
 		return newError("super called without receiver")
 	}
 
+	// super(&blk) passes blk instead of the current block
+	argNodes, blockArg := splitBlockArg(node.Arguments)
+	block := env.Block()
+	if blockArg != nil {
+		val := Eval(blockArg.Expression, env)
+		if isError(val) {
+			return val
+		}
+		converted, err := toBlock(val, env)
+		if err != nil {
+			return err
+		}
+		block = converted
+	}
+
 	// Determine arguments to use
 	var args []object.Object
-	if node.HasParens && len(node.Arguments) == 0 {
+	if (node.HasParens || blockArg != nil) && len(argNodes) == 0 {
 		// super() - call with no arguments
 		args = []object.Object{}
-	} else if len(node.Arguments) > 0 {
+	} else if len(argNodes) > 0 {
 		// super(args) - call with specified arguments
-		args = make([]object.Object, len(node.Arguments))
-		for i, argExpr := range node.Arguments {
+		args = make([]object.Object, len(argNodes))
+		for i, argExpr := range argNodes {
 			arg := Eval(argExpr, env)
 			if isError(arg) {
 				return arg
@@ -1672,7 +2441,7 @@ func evalSuperExpression(node *ast.SuperExpression, env *object.Environment) obj
 		return newError("super: no superclass method `%s'", methodName)
 	}
 
-	return applyMethodWithContext(method, receiver, args, env.Block(), env, superDefClass)
+	return applyMethodWithContext(method, receiver, args, block, env, superDefClass)
 }
 
 // Control flow
@@ -1730,6 +2499,25 @@ func evalModifierExpression(node *ast.ModifierExpression, env *object.Environmen
 	return object.NIL
 }
 
+func evalModifierStatement(node *ast.ModifierStatement, env *object.Environment) object.Object {
+	condition := Eval(node.Condition, env)
+	if isError(condition) {
+		return condition
+	}
+
+	conditionMet := isTruthy(condition)
+	switch node.Modifier {
+	case "unless", "until":
+		conditionMet = !conditionMet
+	}
+
+	if conditionMet {
+		return Eval(node.Body, env)
+	}
+
+	return object.NIL
+}
+
 func evalCaseExpression(node *ast.CaseExpression, env *object.Environment) object.Object {
 	var subject object.Object
 	if node.Subject != nil {
@@ -1772,6 +2560,9 @@ func evalWhileExpression(node *ast.WhileExpression, env *object.Environment) obj
 	var result object.Object = object.NIL
 
 	for {
+		if err := checkInterrupt(); err != nil {
+			return err
+		}
 		condition := Eval(node.Condition, env)
 		if isError(condition) {
 			return condition
@@ -1865,7 +2656,12 @@ retry:
 		exceptionRaised = true
 		// Try to match rescue clauses
 		for _, rescue := range node.Rescues {
-			if matchesRescue(err, rescue) {
+			matched, matchErr := matchesRescue(err, rescue, env)
+			if matchErr != nil {
+				result = matchErr
+				break
+			}
+			if matched {
 				rescueEnv := object.NewEnclosedEnvironment(env)
 				if rescue.Variable != nil {
 					// Mark error as caught so it won't propagate when accessed
@@ -1895,19 +2691,130 @@ retry:
 	return result
 }
 
-func matchesRescue(err *object.Error, rescue *ast.RescueClause) bool {
+// matchesRescue evaluates the exception classes of a rescue clause and
+// reports whether err is an instance of one of them. A splatted array
+// contributes each of its classes.
+func matchesRescue(err *object.Error, rescue *ast.RescueClause, env *object.Environment) (bool, *object.Error) {
 	if len(rescue.Exceptions) == 0 {
-		return true // Bare rescue matches all
+		// A bare rescue lets exceptions such as SystemExit through
+		return errorIsA(err, object.StandardErrorClass, env), nil
 	}
 
-	// Check if error class matches any exception type
-	// Simplified - just check by name
-	for range rescue.Exceptions {
-		// In a full implementation, we'd check class hierarchy
-		return true
+	for _, expr := range rescue.Exceptions {
+		var classes []object.Object
+		if splat, ok := expr.(*ast.SplatExpression); ok {
+			val := Eval(splat.Expression, env)
+			if isError(val) {
+				return false, val.(*object.Error)
+			}
+			if arr, ok := val.(*object.Array); ok {
+				classes = arr.Elements
+			} else {
+				classes = []object.Object{val}
+			}
+		} else {
+			val := Eval(expr, env)
+			if isError(val) {
+				// Most builtin exception classes are not defined as
+				// constants, so match those by name
+				if constant, ok := expr.(*ast.Constant); ok {
+					if errorClassName(err) == constant.Value {
+						return true, nil
+					}
+					continue
+				}
+				return false, val.(*object.Error)
+			}
+			classes = []object.Object{val}
+		}
+
+		for _, class := range classes {
+			switch class := class.(type) {
+			case *object.RubyClass:
+				if errorIsA(err, class, env) {
+					return true, nil
+				}
+			case *object.RubyModule:
+				for c := err.Class_; c != nil; c = c.Superclass {
+					for _, mod := range c.IncludedModules {
+						if mod == class {
+							return true, nil
+						}
+					}
+				}
+			default:
+				return false, newError("TypeError: class or module required for rescue clause")
+			}
+		}
 	}
 
-	return false
+	return false, nil
+}
+
+// ErrorClassName returns the name of err's class.
+func ErrorClassName(err *object.Error) string {
+	return errorClassName(err)
+}
+
+// ErrorMessage returns err's message without the class name the messages
+// of builtin errors start with.
+func ErrorMessage(err *object.Error) string {
+	if err.Class_ == nil {
+		return strings.TrimPrefix(err.Message, errorClassName(err)+": ")
+	}
+	return err.Message
+}
+
+// errorClassName returns the name of err's class. Errors raised by
+// builtins carry no class; their messages start with the class name, or
+// are recognised by their wording.
+func errorClassName(err *object.Error) string {
+	if err.Class_ != nil {
+		return err.Class_.Name
+	}
+	if i := strings.Index(err.Message, ": "); i > 0 {
+		if name := err.Message[:i]; isConstantName(name) {
+			return name
+		}
+	}
+	switch {
+	case strings.HasPrefix(err.Message, "undefined method "),
+		strings.HasPrefix(err.Message, "private method "),
+		strings.HasPrefix(err.Message, "protected method "):
+		return "NoMethodError"
+	case strings.HasPrefix(err.Message, "undefined local variable or method "),
+		strings.HasPrefix(err.Message, "uninitialized constant "):
+		return "NameError"
+	case strings.HasPrefix(err.Message, "wrong number of arguments"):
+		return "ArgumentError"
+	}
+	return "RuntimeError"
+}
+
+// errorIsA reports whether err is an instance of class or one of its
+// subclasses. The builtin errors whose classes are not defined all count
+// as StandardErrors.
+func errorIsA(err *object.Error, class *object.RubyClass, env *object.Environment) bool {
+	if err.Class_ != nil {
+		return isSubclassOf(err.Class_, class)
+	}
+	name := errorClassName(err)
+	if errClass, ok := evalConstant(&ast.Constant{Value: name}, env).(*object.RubyClass); ok {
+		return isSubclassOf(errClass, class)
+	}
+	return class.Name == name || class == object.StandardErrorClass || class == object.ExceptionClass
+}
+
+func isConstantName(name string) bool {
+	if !token.IsConstant(name) {
+		return false
+	}
+	for _, c := range name {
+		if !(c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= utf8.RuneSelf) {
+			return false
+		}
+	}
+	return true
 }
 
 // Other
@@ -1923,15 +2830,48 @@ func evalYieldExpression(node *ast.YieldExpression, env *object.Environment) obj
 		return args[0]
 	}
 
-	return callBlock(block, args, env)
+	result := callBlock(block, args, env)
+	if bv, ok := result.(*object.BreakValue); ok {
+		return bv.Value
+	}
+	return result
 }
 
 func callBlock(block *object.Proc, args []object.Object, env *object.Environment) object.Object {
+	if err := checkInterrupt(); err != nil {
+		return err
+	}
+	if block.Native != nil {
+		return block.Native(block, env, args...)
+	}
+
 	blockEnv := object.NewEnclosedEnvironment(block.Env)
 
+	// Block-local variables start out nil and shadow any outer variable of
+	// the same name, so assignments to them stay inside the block
+	for _, name := range block.Body.Locals {
+		blockEnv.SetLocal(name, object.NIL)
+	}
+
+	// A single Array argument is spread across multiple block parameters
+	if len(args) == 1 && len(block.Parameters) > 1 {
+		if arr, ok := args[0].(*object.Array); ok {
+			args = arr.Elements
+		}
+	}
+
 	for i, param := range block.Parameters {
-		if i < len(args) {
+		if param.Splat {
+			rest := []object.Object{}
+			if after := len(block.Parameters) - i - 1; i < len(args)-after {
+				rest = append(rest, args[i:len(args)-after]...)
+				args = append(args[:i+1:i+1], args[len(args)-after:]...)
+			}
+			blockEnv.Set(param.Name, &object.Array{Elements: rest})
+		} else if i < len(args) {
 			blockEnv.Set(param.Name, args[i])
+		} else if param.Default != nil {
+			blockEnv.Set(param.Name, Eval(param.Default, blockEnv))
 		} else {
 			blockEnv.Set(param.Name, object.NIL)
 		}
@@ -1939,13 +2879,10 @@ func callBlock(block *object.Proc, args []object.Object, env *object.Environment
 
 	result := evalBlockBody(block.Body, blockEnv)
 
-	// Unwrap next/break
+	// Unwrap next; break is left for the iterating method to handle
 	if nv, ok := result.(*object.NextValue); ok {
 		return nv.Value
 	}
-	if bv, ok := result.(*object.BreakValue); ok {
-		return bv.Value
-	}
 
 	return result
 }
@@ -1965,43 +2902,39 @@ func evalMethodDefinition(node *ast.MethodDefinition, env *object.Environment) o
 		Body:       node.Body,
 		Env:        env,
 		Visibility: env.CurrentVisibility(),
+		File:       currentFile,
+		Line:       node.Pos().Line,
+	}
+
+	// def self.foo, def Foo.foo and def obj.foo define a singleton
+	// method on whatever the receiver evaluates to
+	if node.Receiver != nil {
+		receiver := Eval(node.Receiver, env)
+		if isError(receiver) {
+			return receiver
+		}
+		methods := singletonMethodTable(receiver)
+		if methods == nil {
+			return newError("TypeError: can't define singleton method \"%s\" for %s", node.Name, receiver.Class().Name)
+		}
+		return defineMethod(methods, method, node, env)
 	}
 
 	// Check for singleton class context (class << obj)
 	if singletonTarget := env.SingletonTarget(); singletonTarget != nil {
-		switch target := singletonTarget.(type) {
-		case *object.RubyClass:
-			// class << SomeClass adds class methods
-			target.ClassMethods[node.Name] = method
-			return &object.Symbol{Value: node.Name}
-		case *object.RubyModule:
-			// class << SomeModule adds module methods
-			target.Methods[node.Name] = method
-			return &object.Symbol{Value: node.Name}
-		case *object.Instance:
-			// class << instance adds singleton methods to that instance
-			if target.SingletonMethods == nil {
-				target.SingletonMethods = make(map[string]object.Object)
-			}
-			target.SingletonMethods[node.Name] = method
-			return &object.Symbol{Value: node.Name}
+		if methods := singletonMethodTable(singletonTarget); methods != nil {
+			return defineMethod(methods, method, node, env)
 		}
 	}
 
 	// Check for current class context (for class_eval)
 	if currentClass := env.CurrentClass(); currentClass != nil {
-		if node.Receiver != nil {
-			currentClass.ClassMethods[node.Name] = method
-		} else {
-			currentClass.Methods[node.Name] = method
-		}
-		return &object.Symbol{Value: node.Name}
+		return defineMethod(currentClass.Methods, method, node, env)
 	}
 
 	// Check for current module context (for module_eval)
 	if currentModule := env.CurrentModule(); currentModule != nil {
-		currentModule.Methods[node.Name] = method
-		return &object.Symbol{Value: node.Name}
+		return defineMethod(currentModule.Methods, method, node, env)
 	}
 
 	// Add to current class or module based on self
@@ -2009,24 +2942,56 @@ func evalMethodDefinition(node *ast.MethodDefinition, env *object.Environment) o
 	if self != nil {
 		// Check for refinement context
 		if refinement, ok := self.(*object.Refinement); ok {
-			refinement.Methods[node.Name] = method
-			return &object.Symbol{Value: node.Name}
+			return defineMethod(refinement.Methods, method, node, env)
 		}
 
 		if class, ok := self.(*object.RubyClass); ok {
-			if node.Receiver != nil {
-				// Class method
-				class.ClassMethods[node.Name] = method
-			} else {
-				class.Methods[node.Name] = method
-			}
-			return &object.Symbol{Value: node.Name}
+			return defineMethod(class.Methods, method, node, env)
 		}
 	}
 
 	// Top-level method goes to Object
-	object.ObjectClass.Methods[node.Name] = method
-	return &object.Symbol{Value: node.Name}
+	return defineMethod(object.ObjectClass.Methods, method, node, env)
+}
+
+// defineMethod adds method to methods for def, which returns the method's
+// name. In verbose mode it warns if that replaces a method.
+func defineMethod(methods map[string]object.Object, method *object.Method, node *ast.MethodDefinition, env *object.Environment) object.Object {
+	if err := warnRedefinition(methods[method.Name], method, node.Pos(), env); err != nil {
+		return err
+	}
+	methods[method.Name] = method
+	return &object.Symbol{Value: method.Name}
+}
+
+// defineSingletonMethod adds method to target alone: as a class method of
+// a class, a module method of a module, or a singleton method of an
+// instance. It reports false for objects that cannot have singleton
+// methods.
+func defineSingletonMethod(target object.Object, name string, method *object.Method) bool {
+	methods := singletonMethodTable(target)
+	if methods == nil {
+		return false
+	}
+	methods[name] = method
+	return true
+}
+
+// singletonMethodTable returns the methods of target alone, or nil for
+// objects that cannot have singleton methods.
+func singletonMethodTable(target object.Object) map[string]object.Object {
+	switch target := target.(type) {
+	case *object.RubyClass:
+		return target.ClassMethods
+	case *object.RubyModule:
+		return target.Methods
+	case *object.Instance:
+		if target.SingletonMethods == nil {
+			target.SingletonMethods = make(map[string]object.Object)
+		}
+		return target.SingletonMethods
+	}
+	return nil
 }
 
 func evalClassDefinition(node *ast.ClassDefinition, env *object.Environment) object.Object {
@@ -2044,6 +3009,21 @@ func evalClassDefinition(node *ast.ClassDefinition, env *object.Environment) obj
 		}
 	}
 
+	// Reopen an existing class of the same name
+	if existing := existingNamespace(node.Name.Value, env); existing != nil {
+		class, ok := existing.(*object.RubyClass)
+		if !ok {
+			return newError("TypeError: %s is not a class", node.Name.Value)
+		}
+		if node.Superclass != nil && class.Superclass != superclass {
+			return newError("TypeError: superclass mismatch for class %s", node.Name.Value)
+		}
+		classEnv := object.NewEnclosedEnvironment(env)
+		classEnv.SetSelf(class)
+		evalBlockBody(node.Body, classEnv)
+		return class
+	}
+
 	class := &object.RubyClass{
 		Name:         node.Name.Value,
 		Superclass:   superclass,
@@ -2051,6 +3031,7 @@ func evalClassDefinition(node *ast.ClassDefinition, env *object.Environment) obj
 		ClassMethods: make(map[string]object.Object),
 		Constants:    make(map[string]object.Object),
 	}
+	object.RegisterModule(class)
 
 	// Always store in environment for lookup
 	env.SetConstant(node.Name.Value, class)
@@ -2072,11 +3053,24 @@ func evalClassDefinition(node *ast.ClassDefinition, env *object.Environment) obj
 }
 
 func evalModuleDefinition(node *ast.ModuleDefinition, env *object.Environment) object.Object {
+	// Reopen an existing module of the same name
+	if existing := existingNamespace(node.Name.Value, env); existing != nil {
+		module, ok := existing.(*object.RubyModule)
+		if !ok {
+			return newError("TypeError: %s is not a module", node.Name.Value)
+		}
+		moduleEnv := object.NewEnclosedEnvironment(env)
+		moduleEnv.SetSelf(module)
+		evalBlockBody(node.Body, moduleEnv)
+		return module
+	}
+
 	module := &object.RubyModule{
 		Name:      node.Name.Value,
 		Methods:   make(map[string]object.Object),
 		Constants: make(map[string]object.Object),
 	}
+	object.RegisterModule(module)
 
 	// Always store in environment for lookup
 	env.SetConstant(node.Name.Value, module)
@@ -2096,6 +3090,22 @@ func evalModuleDefinition(node *ast.ModuleDefinition, env *object.Environment) o
 	return module
 }
 
+// existingNamespace returns the constant a class or module definition
+// named name would reopen: one already defined in the enclosing class or
+// module, or at top level. It returns nil when there is none.
+func existingNamespace(name string, env *object.Environment) object.Object {
+	switch parent := env.Self().(type) {
+	case *object.RubyClass:
+		return parent.Constants[name]
+	case *object.RubyModule:
+		return parent.Constants[name]
+	}
+	if val, ok := env.GetConstant(name); ok {
+		return val
+	}
+	return nil
+}
+
 func evalSingletonClassDefinition(node *ast.SingletonClassDefinition, env *object.Environment) object.Object {
 	// Evaluate the object to get the singleton class target
 	obj := Eval(node.Object, env)
@@ -2117,6 +3127,9 @@ func evalSingletonClassDefinition(node *ast.SingletonClassDefinition, env *objec
 }
 
 func evalSplatExpression(node *ast.SplatExpression, env *object.Environment) object.Object {
+	if node.Expression == nil {
+		return newError("no anonymous rest parameter")
+	}
 	val := Eval(node.Expression, env)
 	if isError(val) {
 		return val
@@ -2163,7 +3176,7 @@ func evalDefinedExpression(node *ast.DefinedExpression, env *object.Environment)
 		}
 		return object.NIL
 	case *ast.Constant:
-		if _, ok := env.GetConstant(expr.Value); ok {
+		if !isError(evalConstant(expr, env)) {
 			return &object.String{Value: "constant"}
 		}
 		return object.NIL
@@ -2195,7 +3208,12 @@ func isError(obj object.Object) bool {
 }
 
 func newError(format string, a ...interface{}) *object.Error {
-	return &object.Error{Message: fmt.Sprintf(format, a...)}
+	err := &object.Error{Message: fmt.Sprintf(format, a...)}
+	if class := builtinErrorClass(errorClassName(err)); class != nil {
+		err.Message = ErrorMessage(err)
+		err.Class_ = class
+	}
+	return err
 }
 
 func unwrapReturnValue(obj object.Object) object.Object {
@@ -2223,33 +3241,185 @@ func objectsEqual(a, b object.Object) bool {
 		return a.Value == b.(*object.Boolean).Value
 	case *object.Nil:
 		return true
+	case *object.Date:
+		return a.Value.Equal(b.(*object.Date).Value)
+	case *object.Array:
+		other := b.(*object.Array)
+		if len(a.Elements) != len(other.Elements) {
+			return false
+		}
+		for i, elem := range a.Elements {
+			if !objectsEqual(elem, other.Elements[i]) {
+				return false
+			}
+		}
+		return true
+	case *object.Hash:
+		// Hashes are equal when they hold equal values under the same keys
+		other := b.(*object.Hash)
+		if len(a.Pairs) != len(other.Pairs) {
+			return false
+		}
+		for hk, pair := range a.Pairs {
+			otherPair, ok := other.Pairs[hk]
+			if !ok || !objectsEqual(pair.Value, otherPair.Value) {
+				return false
+			}
+		}
+		return true
 	default:
 		return a == b
 	}
 }
 
 func objectToString(obj object.Object) string {
+	str, _ := convertToString(obj)
+	return str
+}
+
+// convertToString is objectToString for callers that report errors: it
+// also returns an error raised by a user-defined to_s.
+func convertToString(obj object.Object) (string, *object.Error) {
 	switch o := obj.(type) {
 	case *object.String:
-		return o.Value
+		return o.Value, nil
 	case *object.Integer:
-		return fmt.Sprintf("%d", o.Value)
+		return fmt.Sprintf("%d", o.Value), nil
 	case *object.Float:
-		return fmt.Sprintf("%g", o.Value)
+		return fmt.Sprintf("%g", o.Value), nil
 	case *object.Boolean:
-		return fmt.Sprintf("%t", o.Value)
+		return fmt.Sprintf("%t", o.Value), nil
 	case *object.Nil:
-		return ""
+		return "", nil
 	case *object.Symbol:
-		return o.Value
+		return o.Value, nil
+	case *object.Date:
+		return o.String(), nil
+	case *object.Array, *object.Hash:
+		return inspectValue(o)
+	case *object.Instance:
+		str, ok, err := callConversionMethod(o, "to_s")
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return str, nil
+		}
+		return o.Inspect(), nil
+	default:
+		return obj.Inspect(), nil
+	}
+}
+
+// inspectObject returns the inspect representation of obj, honoring
+// user-defined inspect methods on instances, including nested ones.
+func inspectObject(obj object.Object) string {
+	str, _ := inspectValue(obj)
+	return str
+}
+
+// inspectValue is inspectObject for callers that report errors: it also
+// returns an error raised by a user-defined inspect.
+func inspectValue(obj object.Object) (string, *object.Error) {
+	switch o := obj.(type) {
+	case *object.Instance:
+		str, ok, err := callConversionMethod(o, "inspect")
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return str, nil
+		}
+		return o.Inspect(), nil
+	case *object.Array:
+		elements := make([]string, len(o.Elements))
+		for i, e := range o.Elements {
+			str, err := inspectValue(e)
+			if err != nil {
+				return "", err
+			}
+			elements[i] = str
+		}
+		return "[" + strings.Join(elements, ", ") + "]", nil
+	case *object.Hash:
+		pairs := make([]string, 0, len(o.Order))
+		for _, key := range o.Order {
+			pair := o.Pairs[key]
+			k, err := inspectValue(pair.Key)
+			if err != nil {
+				return "", err
+			}
+			v, err := inspectValue(pair.Value)
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, fmt.Sprintf("%s => %s", k, v))
+		}
+		return "{" + strings.Join(pairs, ", ") + "}", nil
 	default:
-		return obj.Inspect()
+		return obj.Inspect(), nil
+	}
+}
+
+// callConversionMethod invokes a conversion method such as to_s or inspect
+// defined on an instance's class. It reports false when there is none or
+// it does not return a String, and returns any error the method raises.
+func callConversionMethod(inst *object.Instance, name string) (string, bool, *object.Error) {
+	result, ok := callInstanceMethod(inst, name)
+	if !ok {
+		return "", false, nil
+	}
+	if err, isErr := result.(*object.Error); isErr {
+		return "", false, err
+	}
+	if str, ok := result.(*object.String); ok {
+		return str.Value, true, nil
 	}
+	return "", false, nil
+}
+
+// callInstanceMethod invokes a method defined on an instance's class,
+// reporting false when the instance does not define one with that name.
+func callInstanceMethod(inst *object.Instance, name string, args ...object.Object) (object.Object, bool) {
+	method, ok := inst.SingletonMethods[name]
+	if !ok {
+		method, ok = inst.Class_.LookupMethod(name)
+	}
+	if !ok {
+		return nil, false
+	}
+	if args == nil {
+		args = []object.Object{}
+	}
+	switch m := method.(type) {
+	case *object.Method:
+		return applyMethod(m, inst, args, nil, m.Env), true
+	case *object.Builtin:
+		// Library classes such as CSV::Row define their methods natively
+		return applyMethod(m, inst, args, nil, nil), true
+	}
+	return nil, false
 }
 
 func expandRange(r *object.Range) []object.Object {
 	var elements []object.Object
 
+	if first, ok := r.Start.(*object.String); ok {
+		eachStringInRange(r, first, func(s string) bool {
+			elements = append(elements, &object.String{Value: s})
+			return true
+		})
+		return elements
+	}
+
+	if _, ok := r.Start.(*object.Date); ok && r.End != object.NIL {
+		iterateRange(r, func(val object.Object) object.Object {
+			elements = append(elements, val)
+			return nil
+		})
+		return elements
+	}
+
 	startInt, ok := r.Start.(*object.Integer)
 	if !ok {
 		return elements
@@ -2272,7 +3442,203 @@ func expandRange(r *object.Range) []object.Object {
 	return elements
 }
 
+// evalRangeStep implements Range#step. Without a block it returns an
+// Enumerator over the stepped values.
+func evalRangeStep(r *object.Range, step object.Object, block *object.Proc, env *object.Environment) object.Object {
+	if block == nil {
+		if err := rangeStep(r, step, nil); err != nil {
+			return err
+		}
+		return newEnumerator(r, "step", []object.Object{step})
+	}
+	err := rangeStep(r, step, func(val object.Object) object.Object {
+		result := callBlock(block, []object.Object{val}, env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			return bv
+		}
+		if isError(result) {
+			return result
+		}
+		return nil
+	})
+	if bv, ok := err.(*object.BreakValue); ok {
+		return bv.Value
+	}
+	if err != nil {
+		return err
+	}
+	return r
+}
+
+// rangeStep calls yield with every step-th value of the numeric range r,
+// stopping early when yield returns non-nil. A nil yield only validates the
+// arguments. Integer steps over an Integer range produce Integers; a Float
+// anywhere produces Floats.
+func rangeStep(r *object.Range, step object.Object, yield func(object.Object) object.Object) object.Object {
+	if !isNumeric(step) {
+		return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(step))
+	}
+	if !isNumeric(r.Start) || (r.End != object.NIL && !isNumeric(r.End)) {
+		return newError("TypeError: can't iterate from %s", comparisonOperandName(r.Start))
+	}
+	stepValue := toFloat(step)
+	if stepValue == 0 {
+		return newError("ArgumentError: step can't be 0")
+	}
+	if yield == nil {
+		return nil
+	}
+
+	endless := r.End == object.NIL
+	start, isInt := r.Start.(*object.Integer)
+	n, stepIsInt := step.(*object.Integer)
+	end, endIsInt := r.End.(*object.Integer)
+	// A negative step counts down, so a range that ascends gives nothing
+	down := stepValue < 0
+	if isInt && stepIsInt && (endless || endIsInt) {
+		for i := start.Value; ; i += n.Value {
+			if !endless && (!down && i > end.Value || down && i < end.Value || i == end.Value && r.Exclusive) {
+				return nil
+			}
+			if stop := yield(&object.Integer{Value: i}); stop != nil {
+				return stop
+			}
+		}
+	}
+
+	first := toFloat(r.Start)
+	// Multiply rather than accumulate so rounding errors don't build up
+	for i := 0; ; i++ {
+		val := first + float64(i)*stepValue
+		if !endless {
+			last := toFloat(r.End)
+			// Allow for rounding error past the end
+			past := val > last+stepValue*1e-9 || (r.Exclusive && val >= last)
+			if down {
+				past = val < last+stepValue*1e-9 || (r.Exclusive && val <= last)
+			}
+			if past {
+				return nil
+			}
+		}
+		if stop := yield(&object.Float{Value: val}); stop != nil {
+			return stop
+		}
+	}
+}
+
+// eachStringInRange calls fn with each String in r, from first through
+// successive String#succ values. Iteration ends at the range's end, once
+// values grow longer than it, or when fn returns false.
+func eachStringInRange(r *object.Range, first *object.String, fn func(string) bool) {
+	last, ok := r.End.(*object.String)
+	if !ok || first.Value > last.Value && len(first.Value) >= len(last.Value) {
+		return
+	}
+	for s := first.Value; len(s) <= len(last.Value); s = stringSucc(s) {
+		if s == last.Value {
+			if !r.Exclusive {
+				fn(s)
+			}
+			return
+		}
+		if !fn(s) {
+			return
+		}
+	}
+}
+
+// rangeCovers reports whether val lies between the range's endpoints by
+// comparison, without iterating. A nil endpoint leaves that side open.
+func rangeCovers(r *object.Range, val object.Object) bool {
+	if r.Start != object.NIL {
+		if c, err := compareObjects(r.Start, val); err != nil || c > 0 {
+			return false
+		}
+	}
+	if r.End != object.NIL {
+		c, err := compareObjects(val, r.End)
+		if err != nil || c > 0 || (c == 0 && r.Exclusive) {
+			return false
+		}
+	}
+	return true
+}
+
+// iterateRange calls yield with each value of r in order without building
+// the whole range, stopping early when yield returns non-nil. Endless
+// Integer ranges run until yield stops them.
+func iterateRange(r *object.Range, yield func(object.Object) object.Object) object.Object {
+	switch first := r.Start.(type) {
+	case *object.Integer:
+		if r.End == object.NIL {
+			for i := first.Value; ; i++ {
+				if stop := yield(&object.Integer{Value: i}); stop != nil {
+					return stop
+				}
+			}
+		}
+		last, ok := r.End.(*object.Integer)
+		if !ok {
+			return newError("TypeError: can't iterate from %s", comparisonOperandName(r.End))
+		}
+		end := last.Value
+		if r.Exclusive {
+			end--
+		}
+		for i := first.Value; i <= end; i++ {
+			if stop := yield(&object.Integer{Value: i}); stop != nil {
+				return stop
+			}
+		}
+		return nil
+	case *object.String:
+		var stop object.Object
+		eachStringInRange(r, first, func(s string) bool {
+			stop = yield(&object.String{Value: s})
+			return stop == nil
+		})
+		return stop
+	case *object.Date:
+		// Dates step a day at a time, like Date#succ
+		last, ok := r.End.(*object.Date)
+		if !ok && r.End != object.NIL {
+			return newError("ArgumentError: bad value for range")
+		}
+		for t := first.Value; ; t = t.AddDate(0, 0, 1) {
+			if ok {
+				if c := t.Compare(last.Value); c > 0 || (c == 0 && r.Exclusive) {
+					return nil
+				}
+			}
+			if stop := yield(&object.Date{Value: t, DateTime: first.DateTime}); stop != nil {
+				return stop
+			}
+		}
+	}
+	return newError("TypeError: can't iterate from %s", comparisonOperandName(r.Start))
+}
+
 func evalRangeIncludes(r *object.Range, val object.Object) object.Object {
+	// Numeric membership is by comparison rather than iteration
+	if isNumeric(r.Start) || isNumeric(r.End) {
+		return object.NativeToBool(isNumeric(val) && rangeCovers(r, val))
+	}
+	if r.Start.Type() == object.DATE_OBJ || r.End.Type() == object.DATE_OBJ {
+		return object.NativeToBool(val.Type() == object.DATE_OBJ && rangeCovers(r, val))
+	}
+	if first, ok := r.Start.(*object.String); ok {
+		str, ok := val.(*object.String)
+		if !ok {
+			return object.FALSE
+		}
+		found := false
+		eachStringInRange(r, first, func(s string) bool {
+			found = s == str.Value
+			return !found
+		})
+		return object.NativeToBool(found)
+	}
 	elements := expandRange(r)
 	for _, elem := range elements {
 		if objectsEqual(elem, val) {
@@ -0,0 +1,628 @@
+package evaluator
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alexisbouchez/rubylexer/lexer"
+	"github.com/alexisbouchez/rubylexer/object"
+	"github.com/alexisbouchez/rubylexer/parser"
+)
+
+func testEval(t *testing.T, input string) object.Object {
+	t.Helper()
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		t.Fatalf("parser errors for %q: %v", input, errs)
+	}
+	env := object.NewEnvironment()
+	env.SetSelf(object.ObjectClass)
+	return Eval(program, env)
+}
+
+func checkInspect(t *testing.T, input, expected string) {
+	t.Helper()
+	result := testEval(t, input)
+	if result == nil {
+		t.Fatalf("%q: got nil result", input)
+	}
+	if got := result.Inspect(); got != expected {
+		t.Errorf("%q: expected %s, got %s", input, expected, got)
+	}
+}
+
+func TestRangeEnumeratorIsLazy(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(1..).step(2).first(3)", "[1, 3, 5]"},
+		{"(1..10**12).step(3).first(2)", "[1, 4]"},
+		{"(1..).step(5).take(2)", "[1, 6]"},
+		{"(1..).step(2).first", "1"},
+		{"(1..10).step(3).to_a", "[1, 4, 7, 10]"},
+		{"(1..).each.next", "1"},
+		{"e = (1..).each\ne.next\ne.next\ne.peek", "3"},
+		{"(1..3).each.to_a", "[1, 2, 3]"},
+		{"begin\n  (1..).each.to_a\nrescue RangeError\n  :endless\nend", ":endless"},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestArrayCycleEnumerator(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1, 2, 3].cycle.first(7)", "[1, 2, 3, 1, 2, 3, 1]"},
+		{"[1, 2].cycle.take(5)", "[1, 2, 1, 2, 1]"},
+		{"[1, 2].cycle(2).to_a", "[1, 2, 1, 2]"},
+		{"[].cycle.first(3)", "[]"},
+		{"e = [1, 2].cycle\ne.next\ne.next\ne.next", "1"},
+		{"e = [:a].cycle\ne.next\ne.peek", ":a"},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestConversionMethodErrorsPropagate(t *testing.T) {
+	class := "class Bad\n  def to_s\n    raise ArgumentError, \"bad to_s\"\n  end\n  def inspect\n    raise ArgumentError, \"bad inspect\"\n  end\nend\n"
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"\"x#{Bad.new}\"", "bad to_s"},
+		{"puts Bad.new", "bad to_s"},
+		{"print Bad.new", "bad to_s"},
+		{"[Bad.new].join(\",\")", "bad to_s"},
+		{"p(Bad.new)", "bad inspect"},
+		{"[[Bad.new]].inspect", "bad inspect"},
+	}
+
+	for _, tt := range tests {
+		input := class + "begin\n  " + tt.input + "\n  :no_error\nrescue ArgumentError => e\n  e.message\nend"
+		checkInspect(t, input, `"`+tt.expected+`"`)
+	}
+}
+
+func TestStringIOOverFrozenString(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"StringIO.new(\"abc\".freeze).read", `"abc"`},
+		{"io = StringIO.new(\"abc\".freeze)\nbegin\n  io.write(\"x\")\nrescue IOError\n  :refused\nend", ":refused"},
+		{"io = StringIO.new(\"abc\".freeze)\nbegin\n  io.puts(\"x\")\nrescue IOError\n  :refused\nend", ":refused"},
+		{"io = StringIO.new(\"abc\".freeze)\nbegin\n  io.truncate(0)\nrescue IOError\n  :refused\nend", ":refused"},
+		{"begin\n  StringIO.new(\"abc\".freeze, \"w\")\nrescue IOError\n  :refused\nend", ":refused"},
+		{"s = \"abc\".freeze\nio = StringIO.new(s)\nbegin\n  io << \"x\"\nrescue IOError\nend\ns", `"abc"`},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestCompareByIdentityInstanceKeys(t *testing.T) {
+	setup := "class K\n  def hash\n    1\n  end\n  def eql?(other)\n    true\n  end\nend\na = K.new\nb = K.new\nh = {}.compare_by_identity\nh[a] = :a\nh[b] = :b\n"
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"h.size", "2"},
+		{"[h[a], h[b]]", "[:a, :b]"},
+		{"h.fetch(a)", ":a"},
+		{"h.has_key?(K.new)", "false"},
+		{"h.delete(a)\nh.size", "1"},
+		{"o = Object.new\nh[o] = 1\nh[Object.new] = 2\n[h.size, h[o]]", "[4, 1]"},
+		{"s = \"x\"\ng = {}.compare_by_identity\ng[s] = 1\ng[\"x\".dup] = 2\n[g.size, g[s]]", "[2, 1]"},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, setup+tt.input, tt.expected)
+	}
+}
+
+func TestIndexPassesEveryArgument(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"pr = proc { |a, b, c| [a, b, c] }\npr[1, 2, 3]", "[1, 2, 3]"},
+		{"add = ->(a, b, c) { a + b + c }\nadd.curry[1, 2, 3]", "6"},
+		{"Hash[:a, 1, :b, 2]", "{:a => 1, :b => 2}"},
+		{"class M\n  def [](a, b, c)\n    a + b + c\n  end\nend\nM.new[1, 2, 3]", "6"},
+		{"class M\n  def []=(a, b, v)\n    @s = [a, b, v]\n  end\n  def s\n    @s\n  end\nend\nm = M.new\nm[1, 2] = 3\nm.s", "[1, 2, 3]"},
+		{"[1, 2, 3, 4][1, 2]", "[2, 3]"},
+		{"a = [1, 2, 3]\na[0, 2] = [:x]\na", "[:x, 3]"},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestBuiltinErrorClasses(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1, 2].combination", `[ArgumentError, "wrong number of arguments (given 0, expected 1)"]`},
+		{"[1, 2].combination(\"x\")", `[TypeError, "no implicit conversion of String into Integer"]`},
+		{"{a: 1}.fetch(:b)", `[KeyError, "key not found: :b"]`},
+		{"nil.upcase", "[NoMethodError, \"undefined method `upcase' for nil\"]"},
+	}
+
+	for _, tt := range tests {
+		input := "begin\n  " + tt.input + "\nrescue StandardError => e\n  [e.class, e.message]\nend"
+		checkInspect(t, input, tt.expected)
+	}
+
+	checkInspect(t, "begin\n  (1..).each.to_a\nrescue RangeError => e\n  e.message\nend", `"cannot convert an endless enumerator to an array"`)
+	checkInspect(t, "begin\n  [1].combination\nrescue TypeError\n  :type\nrescue ArgumentError\n  :argument\nend", ":argument")
+}
+
+func TestTimeoutInterruptsQueueWait(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"begin\n  Timeout.timeout(0.05) { Queue.new.pop }\nrescue Timeout::Error => e\n  e.message\nend", `"execution expired"`},
+		{"q = SizedQueue.new(1)\nq.push(1)\nbegin\n  Timeout.timeout(0.05) { q.push(2) }\nrescue Timeout::Error\n  q.size\nend", "1"},
+		{"q = Queue.new\nbegin\n  Timeout.timeout(1) { Timeout.timeout(0.05) { q.pop } }\nrescue Timeout::Error\n  :inner\nend", ":inner"},
+		{"q = Queue.new\nbegin\n  Timeout.timeout(0.05) do\n    begin\n      q.pop\n    rescue Exception\n    end\n    q.pop\n  end\nrescue Exception => e\n  e.message\nend", `"fatal: No live threads left. Deadlock?"`},
+		{"r = Ractor.new do\n  begin\n    Timeout.timeout(0.05) { Ractor.receive }\n  rescue Timeout::Error\n    :ractor\n  end\nend\n[Queue.new.pop(timeout: 0.2), r.take]", "[nil, :ractor]"},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestDateParseMonthNames(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`Date.parse("Jan 5 2020").to_s`, `"2020-01-05"`},
+		{`Date.parse("March 3 2021").to_s`, `"2021-03-03"`},
+		{`Date.parse("Jan 5, 2020").to_s`, `"2020-01-05"`},
+		{`Date.parse("March 3, 2021").to_s`, `"2021-03-03"`},
+		{`Date.parse("5 Jan 2020").to_s`, `"2020-01-05"`},
+		{`Date.parse("3 March 2021").to_s`, `"2021-03-03"`},
+		{`Date.parse("3 March, 2021").to_s`, `"2021-03-03"`},
+		{`Date.parse("2020-01-05").to_s`, `"2020-01-05"`},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestNativeProcBlocks(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1].tap(&:size)", "[1]"},
+		{"1.tap(&(->(x) { x + 1 } >> ->(x) { x * 2 }))", "1"},
+		{"\"x\".instance_eval(&:upcase)", `"X"`},
+		{"class A\nend\nA.class_eval(&:name)", `"A"`},
+		{"module NativeEval\nend\nNativeEval.module_eval(&:to_s)", `"NativeEval"`},
+		{"class C\n  def label\n    :c\n  end\n  define_method(:l, &:label)\nend\nC.new.l", ":c"},
+		{"class C\n  define_method(:up, &:upcase)\nend\nbegin\n  C.new.up\nrescue NoMethodError\n  :no_method\nend", ":no_method"},
+		{"class C\n  define_method(:twice, ->(x) { x * 2 })\nend\nC.new.twice(4)", "8"},
+		{"(1..3).lazy.map(&:to_s).to_a", `["1", "2", "3"]`},
+		{"(1..4).lazy.select(&:even?).to_a", "[2, 4]"},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestCaseEqualityWithFloats(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(1.0..2.0) === 1.2", "true"},
+		{"(1..3) === 2.5", "true"},
+		{"(1..3) === 3.5", "false"},
+		{"(1.0..2.0).===(1.5)", "true"},
+		{"->(x) { x > 1 } === 1.5", "true"},
+		{"Float === 1.5", "true"},
+		{"Integer === 1.5", "false"},
+		{"1 === 1.0", "true"},
+		{"2.5 === 2.5", "true"},
+		{"\"a\" === \"a\"", "true"},
+		{"case 1.5\nwhen 1..2 then :in\nelse :out\nend", ":in"},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestAbortRaisesSystemExit(t *testing.T) {
+	checkInspect(t, "begin\n  abort\nrescue SystemExit => e\n  [e.status, e.success?]\nend", "[1, false]")
+	checkInspect(t, "x = []\nbegin\n  begin\n    abort\n  ensure\n    x << :ensured\n  end\nrescue SystemExit\nend\nx", "[:ensured]")
+}
+
+func TestExitHandlerStatus(t *testing.T) {
+	tests := []struct {
+		input    string
+		status   int
+		reported []string
+	}{
+		{"at_exit { exit 7 }", 7, nil},
+		{"at_exit { raise \"boom\" }", 1, []string{"boom"}},
+		{"at_exit { :ok }\nraise \"main\"", 1, []string{"main"}},
+		{"at_exit { exit 3 }\nraise \"main\"", 3, nil},
+		{"at_exit { raise \"late\" }\nexit 2", 1, []string{"late"}},
+		{"at_exit { :ok }\nexit 4", 4, nil},
+	}
+
+	for _, tt := range tests {
+		ended, _ := testEval(t, tt.input).(*object.Error)
+		var reported []string
+		status := RunExitHandlers(ended, func(err *object.Error) {
+			reported = append(reported, ErrorMessage(err))
+		})
+		if status != tt.status {
+			t.Errorf("%q: expected status %d, got %d", tt.input, tt.status, status)
+		}
+		if fmt.Sprint(reported) != fmt.Sprint(tt.reported) {
+			t.Errorf("%q: expected %v reported, got %v", tt.input, tt.reported, reported)
+		}
+	}
+}
+
+func TestBuiltinExceptionHierarchy(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"begin\n  case 5\n  in String then 1\n  end\nrescue NoMatchingPatternError => e\n  [e.class, e.message]\nend", `[NoMatchingPatternError, "5"]`},
+		{"begin\n  File.read(\"/nonexistent/x\")\nrescue Errno::ENOENT => e\n  [e.class, e.is_a?(SystemCallError)]\nend", "[Errno::ENOENT, true]"},
+		{"begin\n  Dir.rmdir(\"/nonexistent/y\")\nrescue Errno::ENOENT => e\n  e.class\nend", "Errno::ENOENT"},
+		{"begin\n  require \"no_such_library\"\nrescue LoadError => e\n  [e.class, e.is_a?(ScriptError), e.is_a?(StandardError)]\nend", "[LoadError, true, false]"},
+		{"begin\n  fork\nrescue NotImplementedError => e\n  e.class\nend", "NotImplementedError"},
+		{"e = [1].each\nbegin\n  e.next\n  e.next\nrescue StopIteration => x\n  [x.class, x.is_a?(IndexError)]\nend", "[StopIteration, true]"},
+		{"e = [1, 2].each\nr = []\nloop { r << e.next }\nr", "[1, 2]"},
+		{"begin\n  1 / 0\nrescue ZeroDivisionError => e\n  e.class.superclass\nend", "StandardError"},
+		{"RangeError.superclass", "StandardError"},
+		{"FrozenError.superclass", "RuntimeError"},
+		{"Ractor::ClosedError.superclass", "StopIteration"},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestRangeSumAndReduce(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(1..4_000_000_000).sum", "8000000002000000000"},
+		{"(1...11).sum", "55"},
+		{"(1..3).sum(0.5)", "6.5"},
+		{"(5..1).sum", "0"},
+		{"(1..4).reduce(:+)", "10"},
+		{"(1..4).inject(2, :*)", "48"},
+		{"(1..3).reduce(10) { |acc, v| acc - v }", "4"},
+		{"(1...1).reduce(:+)", "nil"},
+		{"begin\n  (1.0..3.0).sum\nrescue TypeError => e\n  e.message\nend", `"can't iterate from Float"`},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestYAMLBlockScalarsAndErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`YAML.dump("multi\nline\n")`, `"--- |\n  multi\n  line\n"`},
+		{`YAML.load(YAML.dump("multi\nline\n"))`, `"multi\nline\n"`},
+		{`YAML.load(YAML.dump("a\nb"))`, `"a\nb"`},
+		{"begin\n  YAML.safe_load(\":sym\")\nrescue Psych::DisallowedClass => e\n  e.message\nend", `"Tried to load unspecified class: Symbol"`},
+		{"begin\n  YAML.load(\"a: [\")\nrescue Psych::SyntaxError => e\n  e.is_a?(Psych::Exception)\nend", "true"},
+		{"begin\n  YAML.load(\"a: [\")\nrescue StandardError => e\n  e.class\nend", "Psych::SyntaxError"},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestTimeoutSkipsBareRescue(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"begin\n  Timeout.timeout(0.05) do\n    begin\n      sleep 1\n    rescue\n      :swallowed\n    end\n  end\nrescue Timeout::Error => e\n  [e.class, e.message]\nend", `[Timeout::Error, "execution expired"]`},
+		{"def nap\n  sleep 1\nrescue => e\n  e\nend\nbegin\n  Timeout.timeout(0.05) { nap }\nrescue => e\n  e.class\nend", "Timeout::Error"},
+		{"Timeout.timeout(0.05, ArgumentError) do\n  begin\n    sleep 1\n  rescue ArgumentError\n    :custom\n  end\nend", ":custom"},
+		{"Timeout::ExitException.ancestors.include?(StandardError)", "false"},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestConstantReassignment(t *testing.T) {
+	warned := "def warned\n  $stderr = StringIO.new\n  yield\n  $stderr.string.split(\"warning: \").drop(1)\nensure\n  $stderr = STDERR\nend\n"
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{warned + "warned { Reassigned = 1; Reassigned = 2 }", `["already initialized constant Reassigned\n"]`},
+		{warned + "module Settings\n  TIMEOUT = 5\nend\nwarned { Settings::TIMEOUT += 1 }", `["already initialized constant Settings::TIMEOUT\n"]`},
+		{warned + "class Limits\n  $limits = warned { MAX = 1; MAX = 2 }\nend\n$limits", `["already initialized constant Limits::MAX\n"]`},
+		{warned + "warned { Once ||= 1; Once ||= 2 }", "[]"},
+		{"Defaulted ||= 1\nDefaulted ||= 2\nDefaulted", "1"},
+		{"module Opts\nend\nOpts::RETRIES ||= 3\nOpts::RETRIES", "3"},
+		{"begin\n  Missing += 1\nrescue NameError => e\n  e.message\nend", `"uninitialized constant Missing"`},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+// TestConcurrentEvals runs programs from several goroutines at once, each
+// starting ractors and all of them pushing to the same queues. Run it with
+// -race.
+func TestConcurrentEvals(t *testing.T) {
+	testEval(t, "$shared_jobs = Queue.new\n$shared_done = Queue.new")
+
+	const evals = 4
+	errs := make(chan string, evals)
+	for i := 0; i < evals; i++ {
+		go func(i int) {
+			input := fmt.Sprintf("ractors = 3.times.map { |n| Ractor.new(n) { |k| %d * 10 + k } }\nractors.each { |r| $shared_jobs.push(r.take) }\n$shared_done.push(:ok)", i)
+			l := lexer.New(input)
+			p := parser.New(l)
+			program := p.ParseProgram()
+			env := object.NewEnvironment()
+			env.SetSelf(object.ObjectClass)
+			if result := Eval(program, env); isError(result) {
+				errs <- result.Inspect()
+				return
+			}
+			errs <- ""
+		}(i)
+	}
+	for i := 0; i < evals; i++ {
+		if err := <-errs; err != "" {
+			t.Fatalf("concurrent eval: %s", err)
+		}
+	}
+
+	checkInspect(t, "[$shared_jobs.size, $shared_done.size]", "[12, 4]")
+	checkInspect(t, "Array.new($shared_jobs.size) { $shared_jobs.pop }.sort", "[0, 1, 2, 10, 11, 12, 20, 21, 22, 30, 31, 32]")
+}
+
+func TestClosedQueue(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"q = Queue.new\nq.close\nq.closed?", "true"},
+		{"q = Queue.new([1, 2])\nq.close\n[q.pop, q.pop, q.pop]", "[1, 2, nil]"},
+		{"q = Queue.new\nq.close\nbegin\n  q.push(1)\nrescue ClosedQueueError => e\n  [e.message, q.size]\nend", `["queue closed", 0]`},
+		{"q = SizedQueue.new(1)\nq.close\nbegin\n  q.push(1)\nrescue StopIteration => e\n  e.class\nend", "ClosedQueueError"},
+		{"q = Queue.new\nq.close\nloop { q.push(1) }", "nil"},
+		{"ClosedQueueError.ancestors.take(3)", "[ClosedQueueError, StopIteration, IndexError]"},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestRangeStepDirections(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(1..5).step(-1).to_a", "[]"},
+		{"(5..1).step(-1).to_a", "[5, 4, 3, 2, 1]"},
+		{"(5...1).step(-2).to_a", "[5, 3]"},
+		{"(1..).step(-2).first(3)", "[1, -1, -3]"},
+		{"(1.0...0.0).step(-0.25).to_a.size", "4"},
+		{"a = []\n(3..1).step(-1) { |v| a << v }\na", "[3, 2, 1]"},
+		{"begin\n  (1..).step(2).to_a\nrescue RangeError => e\n  e.message\nend", `"cannot convert an endless enumerator to an array"`},
+		{"begin\n  (1..5).step(0).to_a\nrescue ArgumentError => e\n  e.message\nend", `"step can't be 0"`},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestDateInspectAndHashKeys(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"Date.new(2024, 2, 28).inspect", `"#<Date: 2024-02-28 ((2460369j,0s,0n),+0s,2299161j)>"`},
+		{"Date.new(1969, 12, 31)", "#<Date: 1969-12-31 ((2440587j,0s,0n),+0s,2299161j)>"},
+		{"DateTime.new(2024, 2, 28, 10, 0, 0).inspect", `"#<DateTime: 2024-02-28T10:00:00+00:00 ((2460369j,36000s,0n),+0s,2299161j)>"`},
+		{"d = Date.new(2024, 2, 28)\n[d.to_s, \"#{d}\", d.iso8601]", `["2024-02-28", "2024-02-28", "2024-02-28"]`},
+		{"h = { Date.new(2024, 2, 28) => :leap }\nh[Date.new(2024, 2, 28)]", ":leap"},
+		{"{ Date.new(2024, 2, 28) => 1 }.has_key?(Date.new(2024, 2, 29))", "false"},
+		{"Date.new(2024, 2, 28).eql?(Date.new(2024, 2, 28))", "true"},
+		{"Date.new(2024, 2, 28).hash == Date.new(2024, 2, 28).hash", "true"},
+		{"[Date.new(2024, 2, 28), Date.new(2024, 2, 28)].uniq.size", "1"},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestArrayToSAndPuts(t *testing.T) {
+	point := "class Pt\n  def initialize(x)\n    @x = x\n  end\n  def inspect\n    \"P(#{@x})\"\n  end\n  def to_s\n    \"pt#{@x}\"\n  end\nend\n"
+	printed := "def printed\n  $stdout = StringIO.new\n  yield\n  $stdout.string\nensure\n  $stdout = STDOUT\nend\n"
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{point + "[Pt.new(1), [Pt.new(2)]].to_s", `"[P(1), [P(2)]]"`},
+		{point + "a = [Pt.new(1)]\n\"#{a}\"", `"[P(1)]"`},
+		{point + "{ a: Pt.new(1) }.to_s", `"{:a => P(1)}"`},
+		{point + printed + "printed { puts([Pt.new(1), [Pt.new(2)]]) }", `"pt1\npt2\n"`},
+		{printed + "printed { puts([1, [2, [nil, 3]]]) }", `"1\n2\n\n3\n"`},
+		{printed + "printed { puts([]) }", `"\n"`},
+		{printed + "printed { puts([[], 1]) }", `"\n1\n"`},
+		{printed + "printed { $stdout.puts([:a, [:b]]) }", `"a\nb\n"`},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestFloatSumCompensates(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[0.1, 0.2, 0.3].sum", "0.6"},
+		{"[0.1, 0.2, 0.3].sum == 0.6", "true"},
+		{"[3.0, 1e100, -1e100].sum", "3"},
+		{"[1, 2, 0.1, 0.2, 0.3].sum == 3.6", "true"},
+		{"(1..3).sum(0.1) == 6.1", "true"},
+		{"[0.1, 0.2, 0.3].map { |x| x }.sum(0)", "0.6"},
+		{"begin\n  [0.1, \"a\"].sum\nrescue TypeError => e\n  e.message\nend", `"String can't be coerced into Float"`},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestProfileCountsAllocations(t *testing.T) {
+	StartProfile()
+	defer func() {
+		profiling = false
+		profileEntries = map[profileKey]*profileEntry{}
+		profileOverhead = 0
+	}()
+	testEval(t, "def noop\nend\ndef build\n  Array.new(100) { |i| i.to_s }\nend\n3.times { noop; build }")
+	profiling = false
+
+	var out bytes.Buffer
+	if err := WriteProfile(&out); err != nil {
+		t.Fatalf("WriteProfile: %v", err)
+	}
+	rows := map[string][]string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 6 {
+			rows[fields[5]] = fields
+		}
+	}
+	if header := rows["method"]; header == nil || header[4] != "allocs" {
+		t.Fatalf("profile has no allocs column:\n%s", out.String())
+	}
+	for _, method := range []string{"Object#noop", "Object#build"} {
+		if row := rows[method]; row == nil || row[3] != "3" {
+			t.Fatalf("profile does not show 3 calls of %s:\n%s", method, out.String())
+		}
+	}
+	var noop, build int
+	fmt.Sscan(rows["Object#noop"][4], &noop)
+	fmt.Sscan(rows["Array.new"][4], &build)
+	if build < 300 || noop >= build {
+		t.Errorf("allocations not attributed to the allocating method:\n%s", out.String())
+	}
+}
+
+func TestWarningsNameScriptAsGiven(t *testing.T) {
+	SetCurrentFile("/work/scripts/run.rb")
+	SetScriptName("scripts/run.rb")
+	defer func() {
+		SetCurrentFile("")
+		SetScriptName("")
+	}()
+
+	warned := "def warned\n  $stderr = StringIO.new\n  yield\n  $stderr.string\nensure\n  $stderr = STDERR\nend\n"
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{warned + "warned { GivenPath = 1; GivenPath = 2 }", `"scripts/run.rb:8: warning: already initialized constant GivenPath\n"`},
+		{warned + "warned { warn(\"careful\", uplevel: 0) }", `"scripts/run.rb:8: warning: careful\n"`},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
+
+func TestDirGlobTrailingSlash(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"d/a/b", "d/c"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "d", "f.txt"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{"d/**/", `["d/", "d/a/", "d/a/b/", "d/c/"]`},
+		{"**/", `["d/", "d/a/", "d/a/b/", "d/c/"]`},
+		{"d/*/", `["d/a/", "d/c/"]`},
+		{"d/**", `["d/a", "d/c", "d/f.txt"]`},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, fmt.Sprintf("Dir.glob(%q, base: %q).sort", tt.pattern, root), tt.expected)
+	}
+}
+
+func TestBlocklessEachLineReadsOn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lines.txt")
+	if err := os.WriteFile(path, []byte("one\ntwo\nthree\nfour\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	open := fmt.Sprintf("f = File.open(%q)\n", path)
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{open + "f.gets\nf.each_line.to_a", `["two\n", "three\n", "four\n"]`},
+		{open + "e = f.each_line(chomp: true)\n[e.next, e.next, e.peek]", `["one", "two", "three"]`},
+		{open + "f.gets\ne = f.each_line\n4.times.map { e.next rescue :done }", `["two\n", "three\n", "four\n", :done]`},
+		{open + "f.each_line.map(&:size)\nf.each_line.to_a", "[]"},
+	}
+
+	for _, tt := range tests {
+		checkInspect(t, tt.input, tt.expected)
+	}
+}
@@ -0,0 +1,80 @@
+package evaluator
+
+import (
+	"strings"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// builtinErrorClasses maps the full name of every builtin exception class
+// to its class object. Errors raised by builtins start their messages with
+// one of these names, which newError turns into the error's class.
+var builtinErrorClasses = map[string]*object.RubyClass{
+	"ArgumentError": object.ArgumentErrorClass,
+	"IndexError":    object.IndexErrorClass,
+	"KeyError":      object.KeyErrorClass,
+	"TypeError":     object.TypeError,
+	"NameError":     object.NameErrorClass,
+	"NoMethodError": object.NoMethodErrorClass,
+}
+
+// ErrnoModule holds the SystemCallError subclasses named after C errno
+// values, such as Errno::ENOENT.
+var ErrnoModule = &object.RubyModule{
+	Name:      "Errno",
+	Methods:   make(map[string]object.Object),
+	Constants: make(map[string]object.Object),
+}
+
+// The exception classes below the ones the object package defines
+var (
+	ScriptErrorClass               = defineErrorClass("ScriptError", object.ExceptionClass)
+	LoadErrorClass                 = defineErrorClass("LoadError", ScriptErrorClass)
+	NotImplementedErrorClass       = defineErrorClass("NotImplementedError", ScriptErrorClass)
+	SyntaxErrorClass               = defineErrorClass("SyntaxError", ScriptErrorClass)
+	SecurityErrorClass             = defineErrorClass("SecurityError", object.ExceptionClass)
+	IOErrorClass                   = defineErrorClass("IOError", object.StandardErrorClass)
+	EOFErrorClass                  = defineErrorClass("EOFError", IOErrorClass)
+	LocalJumpErrorClass            = defineErrorClass("LocalJumpError", object.StandardErrorClass)
+	RangeErrorClass                = defineErrorClass("RangeError", object.StandardErrorClass)
+	FloatDomainErrorClass          = defineErrorClass("FloatDomainError", RangeErrorClass)
+	ThreadErrorClass               = defineErrorClass("ThreadError", object.StandardErrorClass)
+	ZeroDivisionErrorClass         = defineErrorClass("ZeroDivisionError", object.StandardErrorClass)
+	FrozenErrorClass               = defineErrorClass("FrozenError", object.RuntimeErrorClass)
+	StopIterationClass             = defineErrorClass("StopIteration", object.IndexErrorClass)
+	NoMatchingPatternErrorClass    = defineErrorClass("NoMatchingPatternError", object.StandardErrorClass)
+	NoMatchingPatternKeyErrorClass = defineErrorClass("NoMatchingPatternKeyError", NoMatchingPatternErrorClass)
+	SystemCallErrorClass           = defineErrorClass("SystemCallError", object.StandardErrorClass)
+)
+
+func init() {
+	object.ObjectClass.Constants["Errno"] = ErrnoModule
+	for _, name := range []string{"ENOENT", "EACCES", "EEXIST", "EINVAL", "EISDIR", "ENOTDIR", "ENOTEMPTY", "ESRCH", "ECHILD", "EMFILE", "EPIPE"} {
+		ErrnoModule.Constants[name] = defineErrorClass("Errno::"+name, SystemCallErrorClass)
+	}
+}
+
+// defineErrorClass creates the builtin exception class named name. A
+// top-level class becomes a constant on Object; a namespaced one is left
+// for its namespace to hold.
+func defineErrorClass(name string, superclass *object.RubyClass) *object.RubyClass {
+	class := &object.RubyClass{
+		Name:         name,
+		Superclass:   superclass,
+		Methods:      make(map[string]object.Object),
+		ClassMethods: make(map[string]object.Object),
+		Constants:    make(map[string]object.Object),
+	}
+	builtinErrorClasses[name] = class
+	if !strings.Contains(name, "::") {
+		object.ObjectClass.Constants[name] = class
+	}
+	return class
+}
+
+// builtinErrorClass returns the class object of the builtin error named
+// name, or nil when that error has no class object and is only known by
+// the name its messages start with.
+func builtinErrorClass(name string) *object.RubyClass {
+	return builtinErrorClasses[name]
+}
@@ -1,8 +1,11 @@
 package evaluator
 
 import (
+	"bufio"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/user"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -21,9 +24,10 @@ var (
 // FileClass represents Ruby's File class
 var FileClass = &object.RubyClass{
 	Name:         "File",
-	Superclass:   object.ObjectClass,
+	Superclass:   object.IOClass,
 	Methods:      make(map[string]object.Object),
 	ClassMethods: make(map[string]object.Object),
+	Constants:    make(map[string]object.Object),
 }
 
 // DirClass represents Ruby's Dir class
@@ -34,9 +38,26 @@ var DirClass = &object.RubyClass{
 	ClassMethods: make(map[string]object.Object),
 }
 
+// fileHandle is the open file or pipe behind an IO instance
+type fileHandle struct {
+	path   string
+	file   *os.File
+	reader *bufio.Reader
+	lineno int64
+	closed bool
+	sync   bool
+}
+
 func init() {
+	FileClass.Constants["SEPARATOR"] = &object.String{Value: "/"}
+	FileClass.Constants["Separator"] = FileClass.Constants["SEPARATOR"]
+	FileClass.Constants["ALT_SEPARATOR"] = object.NIL
+	FileClass.Constants["PATH_SEPARATOR"] = &object.String{Value: string(os.PathListSeparator)}
+	FileClass.Constants["FNM_DOTMATCH"] = &object.Integer{Value: fnmDotMatch}
+
 	// Initialize File class methods
 	initFileClassMethods()
+	initFileInstanceMethods()
 	// Initialize Dir class methods
 	initDirClassMethods()
 }
@@ -54,7 +75,7 @@ func initFileClassMethods() {
 			}
 			content, err := ioutil.ReadFile(filename.Value)
 			if err != nil {
-				return newError("No such file or directory @ rb_sysopen - %s", filename.Value)
+				return newError("Errno::ENOENT: No such file or directory @ rb_sysopen - %s", filename.Value)
 			}
 			return &object.String{Value: string(content)}
 		},
@@ -76,7 +97,7 @@ func initFileClassMethods() {
 			}
 			err := ioutil.WriteFile(filename.Value, []byte(content.Value), 0644)
 			if err != nil {
-				return newError("Permission denied @ rb_sysopen - %s", filename.Value)
+				return newError("Errno::EACCES: Permission denied @ rb_sysopen - %s", filename.Value)
 			}
 			return &object.Integer{Value: int64(len(content.Value))}
 		},
@@ -255,7 +276,7 @@ func initFileClassMethods() {
 				}
 				err := os.Remove(filename.Value)
 				if err != nil {
-					return newError("No such file or directory @ unlink_internal - %s", filename.Value)
+					return newError("Errno::ENOENT: No such file or directory @ unlink_internal - %s", filename.Value)
 				}
 				count++
 			}
@@ -275,11 +296,723 @@ func initFileClassMethods() {
 			}
 			info, err := os.Stat(filename.Value)
 			if err != nil {
-				return newError("No such file or directory @ rb_file_s_size - %s", filename.Value)
+				return newError("Errno::ENOENT: No such file or directory @ rb_file_s_size - %s", filename.Value)
 			}
 			return &object.Integer{Value: info.Size()}
 		},
 	}
+
+	FileClass.ClassMethods["unlink"] = FileClass.ClassMethods["delete"]
+
+	FileClass.ClassMethods["open"] = &object.Builtin{
+		Name: "open",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			file := openFile(args)
+			if isError(file) {
+				return file
+			}
+			block := env.Block()
+			if block == nil {
+				return file
+			}
+			// The file is closed when the block exits, however it exits
+			defer closeFileHandle(file.(*object.Instance))
+			return callBlock(block, []object.Object{file}, env)
+		},
+	}
+
+	FileClass.ClassMethods["new"] = &object.Builtin{
+		Name: "new",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return openFile(args)
+		},
+	}
+
+	FileClass.ClassMethods["readlines"] = &object.Builtin{
+		Name: "readlines",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			args, chomp := chompOption(args)
+			content := readWholeFile(args)
+			if isError(content) {
+				return content
+			}
+			lines := []object.Object{}
+			for _, line := range splitLines(content.(*object.String).Value) {
+				if chomp {
+					line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+				}
+				lines = append(lines, &object.String{Value: line})
+			}
+			return &object.Array{Elements: lines}
+		},
+	}
+
+	FileClass.ClassMethods["foreach"] = &object.Builtin{
+		Name: "foreach",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			lines := FileClass.ClassMethods["readlines"].(*object.Builtin).Fn(receiver, env, args...)
+			if isError(lines) {
+				return lines
+			}
+			block := env.Block()
+			if block == nil {
+				return &object.Enumerator{Object: receiver, Method: "foreach", Args: args, Values: lines.(*object.Array).Elements}
+			}
+			for _, line := range lines.(*object.Array).Elements {
+				result := callBlock(block, []object.Object{line}, env)
+				if _, ok := result.(*object.BreakValue); ok {
+					return result
+				}
+				if isError(result) {
+					return result
+				}
+			}
+			return object.NIL
+		},
+	}
+
+	FileClass.ClassMethods["mtime"] = &object.Builtin{
+		Name: "mtime",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 1 {
+				return newError("wrong number of arguments (given 0, expected 1)")
+			}
+			filename, ok := args[0].(*object.String)
+			if !ok {
+				return newError("no implicit conversion of %s into String", args[0].Type())
+			}
+			info, err := os.Stat(filename.Value)
+			if err != nil {
+				return newError("Errno::ENOENT: No such file or directory @ rb_file_s_mtime - %s", filename.Value)
+			}
+			return &object.Time{Value: info.ModTime()}
+		},
+	}
+
+	FileClass.ClassMethods["absolute_path"] = &object.Builtin{
+		Name: "absolute_path",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 1 {
+				return newError("wrong number of arguments (given 0, expected 1..2)")
+			}
+			path, ok := args[0].(*object.String)
+			if !ok {
+				return newError("no implicit conversion of %s into String", args[0].Type())
+			}
+			// Unlike expand_path, a leading ~ is left alone
+			result := path.Value
+			if len(args) > 1 {
+				if base, ok := args[1].(*object.String); ok && !filepath.IsAbs(result) {
+					result = filepath.Join(base.Value, result)
+				}
+			}
+			absPath, err := filepath.Abs(result)
+			if err != nil {
+				return &object.String{Value: result}
+			}
+			return &object.String{Value: absPath}
+		},
+	}
+
+	FileClass.ClassMethods["absolute_path?"] = &object.Builtin{
+		Name: "absolute_path?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 1 {
+				return newError("wrong number of arguments (given 0, expected 1)")
+			}
+			path, ok := args[0].(*object.String)
+			if !ok {
+				return newError("no implicit conversion of %s into String", args[0].Type())
+			}
+			return object.NativeToBool(filepath.IsAbs(path.Value))
+		},
+	}
+
+	FileClass.ClassMethods["rename"] = &object.Builtin{
+		Name: "rename",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 2 {
+				return newError("wrong number of arguments (given %d, expected 2)", len(args))
+			}
+			from, ok1 := args[0].(*object.String)
+			to, ok2 := args[1].(*object.String)
+			if !ok1 || !ok2 {
+				return newError("no implicit conversion into String")
+			}
+			if err := os.Rename(from.Value, to.Value); err != nil {
+				return newError("Errno::ENOENT: No such file or directory @ rb_file_s_rename - (%s, %s)", from.Value, to.Value)
+			}
+			return &object.Integer{Value: 0}
+		},
+	}
+
+	FileClass.ClassMethods["zero?"] = &object.Builtin{
+		Name: "zero?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 1 {
+				return newError("wrong number of arguments (given 0, expected 1)")
+			}
+			filename, ok := args[0].(*object.String)
+			if !ok {
+				return newError("no implicit conversion of %s into String", args[0].Type())
+			}
+			info, err := os.Stat(filename.Value)
+			return object.NativeToBool(err == nil && info.Size() == 0)
+		},
+	}
+
+	FileClass.ClassMethods["empty?"] = FileClass.ClassMethods["zero?"]
+}
+
+// initFileInstanceMethods defines the stream methods on IO, which File and
+// the pipes of Open3 inherit, and the path-based ones on File.
+func initFileInstanceMethods() {
+	object.IOClass.Methods["read"] = &object.Builtin{
+		Name: "read",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			if len(args) > 0 {
+				if n, ok := args[0].(*object.Integer); ok {
+					buf := make([]byte, n.Value)
+					read, _ := io.ReadFull(handle.reader, buf)
+					if read == 0 && n.Value > 0 {
+						return object.NIL
+					}
+					return &object.String{Value: string(buf[:read])}
+				}
+			}
+			content, _ := io.ReadAll(handle.reader)
+			return &object.String{Value: string(content)}
+		},
+	}
+
+	object.IOClass.Methods["gets"] = &object.Builtin{
+		Name: "gets",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			format, err := parseRecordArgs(args)
+			if err != nil {
+				return err
+			}
+			var result object.Object = object.NIL
+			if line, ok := handle.readRecord(format); ok {
+				result = &object.String{Value: line}
+			}
+			setLastLine(result, handle.lineno)
+			return result
+		},
+	}
+
+	object.IOClass.Methods["readline"] = &object.Builtin{
+		Name: "readline",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			line := object.IOClass.Methods["gets"].(*object.Builtin).Fn(receiver, env, args...)
+			if line == object.NIL {
+				return newError("EOFError: end of file reached")
+			}
+			return line
+		},
+	}
+
+	object.IOClass.Methods["each_line"] = &object.Builtin{
+		Name: "each_line",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			format, err := parseRecordArgs(args)
+			if err != nil {
+				return err
+			}
+			block := env.Block()
+			if block == nil {
+				return ioLineEnumerator(receiver, handle, format, args)
+			}
+			for {
+				line, ok := handle.readRecord(format)
+				if !ok {
+					return receiver
+				}
+				result := callBlock(block, []object.Object{&object.String{Value: line}}, env)
+				if _, ok := result.(*object.BreakValue); ok {
+					return result
+				}
+				if isError(result) {
+					return result
+				}
+			}
+		},
+	}
+
+	object.IOClass.Methods["each"] = object.IOClass.Methods["each_line"]
+
+	object.IOClass.Methods["readlines"] = &object.Builtin{
+		Name: "readlines",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			format, err := parseRecordArgs(args)
+			if err != nil {
+				return err
+			}
+			lines := []object.Object{}
+			for {
+				line, ok := handle.readRecord(format)
+				if !ok {
+					return &object.Array{Elements: lines}
+				}
+				lines = append(lines, &object.String{Value: line})
+			}
+		},
+	}
+
+	object.IOClass.Methods["write"] = &object.Builtin{
+		Name: "write",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			written := 0
+			for _, arg := range args {
+				n, writeErr := handle.file.WriteString(objectToString(arg))
+				if writeErr != nil {
+					return newError("IOError: not opened for writing")
+				}
+				written += n
+			}
+			return &object.Integer{Value: int64(written)}
+		},
+	}
+
+	object.IOClass.Methods["print"] = &object.Builtin{
+		Name: "print",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if result := object.IOClass.Methods["write"].(*object.Builtin).Fn(receiver, env, args...); isError(result) {
+				return result
+			}
+			return object.NIL
+		},
+	}
+
+	object.IOClass.Methods["puts"] = &object.Builtin{
+		Name: "puts",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			text, err := putsText(args)
+			if err != nil {
+				return err
+			}
+			return object.IOClass.Methods["print"].(*object.Builtin).Fn(receiver, env, &object.String{Value: text})
+		},
+	}
+
+	object.IOClass.Methods["<<"] = &object.Builtin{
+		Name: "<<",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if result := object.IOClass.Methods["write"].(*object.Builtin).Fn(receiver, env, args...); isError(result) {
+				return result
+			}
+			return receiver
+		},
+	}
+
+	object.IOClass.Methods["flush"] = &object.Builtin{
+		Name: "flush",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if _, err := openHandle(receiver); err != nil {
+				return err
+			}
+			return receiver
+		},
+	}
+
+	object.IOClass.Methods["rewind"] = &object.Builtin{
+		Name: "rewind",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			handle.file.Seek(0, io.SeekStart)
+			handle.reader.Reset(handle.file)
+			handle.lineno = 0
+			return &object.Integer{Value: 0}
+		},
+	}
+
+	object.IOClass.Methods["eof?"] = &object.Builtin{
+		Name: "eof?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			_, peekErr := handle.reader.Peek(1)
+			return object.NativeToBool(peekErr != nil)
+		},
+	}
+
+	object.IOClass.Methods["eof"] = object.IOClass.Methods["eof?"]
+
+	object.IOClass.Methods["lineno"] = &object.Builtin{
+		Name: "lineno",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			return &object.Integer{Value: handle.lineno}
+		},
+	}
+
+	FileClass.Methods["size"] = &object.Builtin{
+		Name: "size",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			info, statErr := handle.file.Stat()
+			if statErr != nil {
+				return newError("IOError: %s", statErr)
+			}
+			return &object.Integer{Value: info.Size()}
+		},
+	}
+
+	FileClass.Methods["mtime"] = &object.Builtin{
+		Name: "mtime",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			info, statErr := handle.file.Stat()
+			if statErr != nil {
+				return newError("IOError: %s", statErr)
+			}
+			return &object.Time{Value: info.ModTime()}
+		},
+	}
+
+	FileClass.Methods["path"] = &object.Builtin{
+		Name: "path",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.String{Value: lookupFileHandle(receiver).path}
+		},
+	}
+
+	FileClass.Methods["to_path"] = FileClass.Methods["path"]
+
+	object.IOClass.Methods["close"] = &object.Builtin{
+		Name: "close",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			closeFileHandle(receiver.(*object.Instance))
+			return object.NIL
+		},
+	}
+
+	object.IOClass.Methods["closed?"] = &object.Builtin{
+		Name: "closed?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return object.NativeToBool(lookupFileHandle(receiver).closed)
+		},
+	}
+
+	object.IOClass.Methods["inspect"] = &object.Builtin{
+		Name: "inspect",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle := lookupFileHandle(receiver)
+			if handle.closed {
+				return &object.String{Value: "#<IO:" + handle.path + " (closed)>"}
+			}
+			return &object.String{Value: "#<IO:" + handle.path + ">"}
+		},
+	}
+
+	FileClass.Methods["inspect"] = &object.Builtin{
+		Name: "inspect",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle := lookupFileHandle(receiver)
+			if handle.closed {
+				return &object.String{Value: "#<File:" + handle.path + " (closed)>"}
+			}
+			return &object.String{Value: "#<File:" + handle.path + ">"}
+		},
+	}
+}
+
+// newIO wraps an open file or pipe end as an IO instance.
+func newIO(file *os.File, name string) *object.Instance {
+	return &object.Instance{
+		Class_:            object.IOClass,
+		InstanceVariables: make(map[string]object.Object),
+		Data:              &fileHandle{path: name, file: file, reader: bufio.NewReader(file)},
+	}
+}
+
+// fileOpenFlags maps a Ruby open mode such as "r", "w+" or "ab" to os flags.
+var fileOpenFlags = map[string]int{
+	"r":  os.O_RDONLY,
+	"r+": os.O_RDWR,
+	"w":  os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	"w+": os.O_RDWR | os.O_CREATE | os.O_TRUNC,
+	"a":  os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+	"a+": os.O_RDWR | os.O_CREATE | os.O_APPEND,
+}
+
+// openFile implements File.new and File.open: a path and an optional mode.
+func openFile(args []object.Object) object.Object {
+	if len(args) < 1 {
+		return newError("wrong number of arguments (given 0, expected 1..3)")
+	}
+	filename, ok := args[0].(*object.String)
+	if !ok {
+		return newError("no implicit conversion of %s into String", args[0].Type())
+	}
+	mode := "r"
+	if len(args) > 1 {
+		if m, ok := args[1].(*object.String); ok {
+			mode = m.Value
+		}
+	}
+	flags, ok := fileOpenFlags[strings.NewReplacer("b", "", "t", "").Replace(mode)]
+	if !ok {
+		return newError("ArgumentError: invalid access mode %s", mode)
+	}
+	file, err := os.OpenFile(filename.Value, flags, 0644)
+	if err != nil {
+		if os.IsPermission(err) {
+			return newError("Errno::EACCES: Permission denied @ rb_sysopen - %s", filename.Value)
+		}
+		return newError("Errno::ENOENT: No such file or directory @ rb_sysopen - %s", filename.Value)
+	}
+
+	return &object.Instance{
+		Class_:            FileClass,
+		InstanceVariables: make(map[string]object.Object),
+		Data:              &fileHandle{path: filename.Value, file: file, reader: bufio.NewReader(file)},
+	}
+}
+
+func lookupFileHandle(obj object.Object) *fileHandle {
+	if inst, ok := obj.(*object.Instance); ok {
+		if handle, ok := inst.Data.(*fileHandle); ok {
+			return handle
+		}
+	}
+	return &fileHandle{closed: true}
+}
+
+// openHandle returns the handle of an open File, or an IOError once closed.
+func openHandle(obj object.Object) (*fileHandle, object.Object) {
+	handle := lookupFileHandle(obj)
+	if handle.closed {
+		return nil, newError("IOError: closed stream")
+	}
+	return handle, nil
+}
+
+func closeFileHandle(inst *object.Instance) {
+	if handle, ok := inst.Data.(*fileHandle); ok && !handle.closed {
+		handle.file.Close()
+		handle.closed = true
+	}
+}
+
+// readLine returns the next line including its newline, reporting false at
+// end of file.
+func (h *fileHandle) readLine() (string, bool) {
+	line, err := h.reader.ReadString('\n')
+	if line == "" && err != nil {
+		return "", false
+	}
+	h.lineno++
+	return line, true
+}
+
+// readWholeFile reads the file named by args[0] for File.readlines.
+func readWholeFile(args []object.Object) object.Object {
+	if len(args) < 1 {
+		return newError("wrong number of arguments (given 0, expected 1)")
+	}
+	filename, ok := args[0].(*object.String)
+	if !ok {
+		return newError("no implicit conversion of %s into String", args[0].Type())
+	}
+	content, err := ioutil.ReadFile(filename.Value)
+	if err != nil {
+		return newError("Errno::ENOENT: No such file or directory @ rb_sysopen - %s", filename.Value)
+	}
+	return &object.String{Value: string(content)}
+}
+
+// recordFormat describes how gets and its relatives split a stream into
+// records: at sep (nil reads everything, "" reads paragraphs), after at
+// most limit bytes when limit is positive, optionally chomping sep.
+type recordFormat struct {
+	sep   *string
+	limit int
+	chomp bool
+}
+
+// parseRecordArgs parses the (sep = $/, limit = nil, chomp: false)
+// arguments shared by gets, readline, readlines and each_line.
+func parseRecordArgs(args []object.Object) (recordFormat, object.Object) {
+	newline := "\n"
+	format := recordFormat{sep: &newline}
+	args, format.chomp = chompOption(args)
+	if len(args) > 2 {
+		return format, newError("wrong number of arguments (given %d, expected 0..2)", len(args))
+	}
+	for i, arg := range args {
+		switch a := arg.(type) {
+		case *object.String:
+			if i > 0 {
+				return format, newError("TypeError: no implicit conversion of String into Integer")
+			}
+			sep := a.Value
+			format.sep = &sep
+		case *object.Nil:
+			if i == 0 {
+				format.sep = nil
+			}
+		case *object.Integer:
+			format.limit = int(a.Value)
+		default:
+			return format, newError("TypeError: no implicit conversion of %s into String", comparisonOperandName(arg))
+		}
+	}
+	return format, nil
+}
+
+// readRecord returns the next record in the given format, reporting false
+// at end of file.
+func (h *fileHandle) readRecord(format recordFormat) (string, bool) {
+	line, ok := scanRecord(h.reader, format)
+	if ok {
+		h.lineno++
+	}
+	return line, ok
+}
+
+// ioLineEnumerator returns the enumerator a blockless each_line on io
+// gives, over the records left in handle. Records are read as they are
+// needed and kept, so that next and to_a see the same ones however many
+// times the enumerator is run.
+func ioLineEnumerator(io object.Object, handle *fileHandle, format recordFormat, args []object.Object) *object.Enumerator {
+	enum := newEnumerator(io, "each_line", args)
+	var lines []object.Object
+	atEnd := false
+	enum.Generator = func(yield func(object.Object) bool) {
+		for i := 0; ; i++ {
+			if i == len(lines) {
+				if atEnd {
+					return
+				}
+				line, ok := handle.readRecord(format)
+				if !ok {
+					atEnd = true
+					return
+				}
+				lines = append(lines, &object.String{Value: line})
+			}
+			if !yield(lines[i]) {
+				return
+			}
+		}
+	}
+	return enum
+}
+
+// recordReader is the input scanRecord reads from: a bufio.Reader for
+// files and a stringCursor for StringIO.
+type recordReader interface {
+	ReadByte() (byte, error)
+	Peek(n int) ([]byte, error)
+}
+
+// scanRecord reads the next record in the given format from r, reporting
+// false at end of input.
+func scanRecord(r recordReader, format recordFormat) (string, bool) {
+	sep := ""
+	paragraph := false
+	if format.sep != nil {
+		sep = *format.sep
+		if sep == "" {
+			sep, paragraph = "\n\n", true
+		}
+	}
+	if paragraph {
+		skipNewlines(r)
+	}
+
+	var record strings.Builder
+	for format.limit <= 0 || record.Len() < format.limit {
+		c, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		record.WriteByte(c)
+		if sep != "" && strings.HasSuffix(record.String(), sep) {
+			break
+		}
+	}
+	if paragraph {
+		skipNewlines(r)
+	}
+	if record.Len() == 0 {
+		return "", false
+	}
+
+	line := record.String()
+	if format.chomp {
+		switch {
+		case paragraph:
+			line = strings.TrimRight(line, "\n")
+		case sep == "\n":
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		case sep != "":
+			line = strings.TrimSuffix(line, sep)
+		}
+	}
+	return line, true
+}
+
+func skipNewlines(r recordReader) {
+	for {
+		next, err := r.Peek(1)
+		if err != nil || next[0] != '\n' {
+			return
+		}
+		r.ReadByte()
+	}
+}
+
+// setLastLine records what gets returned in $_ and the line number in $.
+func setLastLine(line object.Object, lineno int64) {
+	globalVariables["$_"] = line
+	globalVariables["$."] = &object.Integer{Value: lineno}
+}
+
+// chompOption extracts the chomp: keyword accepted by the line readers.
+func chompOption(args []object.Object) ([]object.Object, bool) {
+	if len(args) > 0 {
+		if hash, ok := args[len(args)-1].(*object.Hash); ok && hash.IsKeywordArgs {
+			chomp, _ := hashGet(hash, &object.Symbol{Value: "chomp"})
+			return args[:len(args)-1], chomp != nil && isTruthy(chomp)
+		}
+	}
+	return args, false
 }
 
 func initDirClassMethods() {
@@ -305,18 +1038,30 @@ func initDirClassMethods() {
 				if err != nil {
 					return newError("couldn't find HOME directory")
 				}
-				os.Chdir(home)
-				return &object.Integer{Value: 0}
+				args = []object.Object{&object.String{Value: home}}
 			}
 			path, ok := args[0].(*object.String)
 			if !ok {
 				return newError("no implicit conversion of %s into String", args[0].Type())
 			}
-			err := os.Chdir(path.Value)
+			block := env.Block()
+			if block == nil {
+				if err := os.Chdir(path.Value); err != nil {
+					return newError("Errno::ENOENT: No such file or directory @ dir_chdir - %s", path.Value)
+				}
+				return &object.Integer{Value: 0}
+			}
+
+			// With a block the previous directory is restored afterwards
+			previous, err := os.Getwd()
 			if err != nil {
-				return newError("No such file or directory @ dir_chdir - %s", path.Value)
+				return newError("couldn't get current directory")
 			}
-			return &object.Integer{Value: 0}
+			if err := os.Chdir(path.Value); err != nil {
+				return newError("Errno::ENOENT: No such file or directory @ dir_chdir - %s", path.Value)
+			}
+			defer os.Chdir(previous)
+			return callBlock(block, []object.Object{path}, env)
 		},
 	}
 
@@ -332,7 +1077,7 @@ func initDirClassMethods() {
 			}
 			files, err := ioutil.ReadDir(path.Value)
 			if err != nil {
-				return newError("No such file or directory @ dir_initialize - %s", path.Value)
+				return newError("Errno::ENOENT: No such file or directory @ dir_initialize - %s", path.Value)
 			}
 			entries := make([]object.Object, 0, len(files)+2)
 			entries = append(entries, &object.String{Value: "."})
@@ -348,21 +1093,161 @@ func initDirClassMethods() {
 		Name: "glob",
 		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 			if len(args) < 1 {
-				return newError("wrong number of arguments (given 0, expected 1+)")
+				return newError("wrong number of arguments (given 0, expected 1..2)")
 			}
-			pattern, ok := args[0].(*object.String)
-			if !ok {
-				return newError("no implicit conversion of %s into String", args[0].Type())
+			root := "."
+			dotMatch := false
+			rest := args[1:]
+			if len(rest) > 0 {
+				if kwargs, ok := rest[len(rest)-1].(*object.Hash); ok && kwargs.IsKeywordArgs {
+					if base, ok := hashGet(kwargs, &object.Symbol{Value: "base"}); ok {
+						if str, ok := base.(*object.String); ok && str.Value != "" {
+							root = str.Value
+						}
+					}
+					if flags, ok := hashGet(kwargs, &object.Symbol{Value: "flags"}); ok {
+						rest = []object.Object{flags}
+					} else {
+						rest = rest[:len(rest)-1]
+					}
+				}
 			}
-			matches, err := filepath.Glob(pattern.Value)
-			if err != nil {
-				return &object.Array{Elements: []object.Object{}}
+			if len(rest) > 0 {
+				if flags, ok := rest[0].(*object.Integer); ok {
+					dotMatch = flags.Value&fnmDotMatch != 0
+				}
+			}
+
+			var patterns []object.Object
+			if arr, ok := args[0].(*object.Array); ok {
+				patterns = arr.Elements
+			} else {
+				patterns = []object.Object{args[0]}
+			}
+			var matches []string
+			seen := make(map[string]bool)
+			for _, p := range patterns {
+				pattern, ok := p.(*object.String)
+				if !ok {
+					return newError("no implicit conversion of %s into String", p.Type())
+				}
+				for _, m := range globFiles(pattern.Value, root, dotMatch) {
+					if !seen[m] {
+						seen[m] = true
+						matches = append(matches, m)
+					}
+				}
 			}
+
 			elements := make([]object.Object, len(matches))
 			for i, m := range matches {
 				elements[i] = &object.String{Value: m}
 			}
-			return &object.Array{Elements: elements}
+			block := env.Block()
+			if block == nil {
+				return &object.Array{Elements: elements}
+			}
+			for _, elem := range elements {
+				result := callBlock(block, []object.Object{elem}, env)
+				if _, ok := result.(*object.BreakValue); ok {
+					return result
+				}
+				if isError(result) {
+					return result
+				}
+			}
+			return object.NIL
+		},
+	}
+
+	DirClass.ClassMethods["[]"] = &object.Builtin{
+		Name: "[]",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			// Dir[] never takes a block
+			return DirClass.ClassMethods["glob"].(*object.Builtin).Fn(receiver, object.NewEnvironment(), &object.Array{Elements: args})
+		},
+	}
+
+	DirClass.ClassMethods["children"] = &object.Builtin{
+		Name: "children",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 1 {
+				return newError("wrong number of arguments (given 0, expected 1)")
+			}
+			path, ok := args[0].(*object.String)
+			if !ok {
+				return newError("no implicit conversion of %s into String", args[0].Type())
+			}
+			files, err := os.ReadDir(path.Value)
+			if err != nil {
+				return newError("Errno::ENOENT: No such file or directory @ dir_initialize - %s", path.Value)
+			}
+			children := make([]object.Object, len(files))
+			for i, f := range files {
+				children[i] = &object.String{Value: f.Name()}
+			}
+			return &object.Array{Elements: children}
+		},
+	}
+
+	DirClass.ClassMethods["each_child"] = &object.Builtin{
+		Name: "each_child",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			children := DirClass.ClassMethods["children"].(*object.Builtin).Fn(receiver, env, args...)
+			if isError(children) {
+				return children
+			}
+			block := env.Block()
+			if block == nil {
+				return &object.Enumerator{Object: receiver, Method: "each_child", Args: args, Values: children.(*object.Array).Elements}
+			}
+			for _, child := range children.(*object.Array).Elements {
+				result := callBlock(block, []object.Object{child}, env)
+				if _, ok := result.(*object.BreakValue); ok {
+					return result
+				}
+				if isError(result) {
+					return result
+				}
+			}
+			return object.NIL
+		},
+	}
+
+	DirClass.ClassMethods["empty?"] = &object.Builtin{
+		Name: "empty?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 1 {
+				return newError("wrong number of arguments (given 0, expected 1)")
+			}
+			path, ok := args[0].(*object.String)
+			if !ok {
+				return newError("no implicit conversion of %s into String", args[0].Type())
+			}
+			files, err := os.ReadDir(path.Value)
+			return object.NativeToBool(err == nil && len(files) == 0)
+		},
+	}
+
+	DirClass.ClassMethods["home"] = &object.Builtin{
+		Name: "home",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) > 0 {
+				name, ok := args[0].(*object.String)
+				if !ok {
+					return newError("no implicit conversion of %s into String", args[0].Type())
+				}
+				u, err := user.Lookup(name.Value)
+				if err != nil {
+					return newError("ArgumentError: user %s doesn't exist", name.Value)
+				}
+				return &object.String{Value: u.HomeDir}
+			}
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return newError("couldn't find HOME directory")
+			}
+			return &object.String{Value: home}
 		},
 	}
 
@@ -384,7 +1269,7 @@ func initDirClassMethods() {
 			}
 			err := os.Mkdir(path.Value, perm)
 			if err != nil {
-				return newError("File exists @ dir_s_mkdir - %s", path.Value)
+				return newError("Errno::EEXIST: File exists @ dir_s_mkdir - %s", path.Value)
 			}
 			return &object.Integer{Value: 0}
 		},
@@ -421,8 +1306,11 @@ func initDirClassMethods() {
 				return newError("no implicit conversion of %s into String", args[0].Type())
 			}
 			err := os.Remove(path.Value)
+			if os.IsNotExist(err) {
+				return newError("Errno::ENOENT: No such file or directory @ dir_s_rmdir - %s", path.Value)
+			}
 			if err != nil {
-				return newError("Directory not empty @ dir_s_rmdir - %s", path.Value)
+				return newError("Errno::ENOTEMPTY: Directory not empty @ dir_s_rmdir - %s", path.Value)
 			}
 			return &object.Integer{Value: 0}
 		},
@@ -432,6 +1320,167 @@ func initDirClassMethods() {
 	DirClass.ClassMethods["unlink"] = DirClass.ClassMethods["rmdir"]
 }
 
+// fnmDotMatch is File::FNM_DOTMATCH, letting wildcards match dotfiles
+const fnmDotMatch = 4
+
+// globFiles expands a Dir.glob pattern relative to root. Braces are
+// expanded first; "**" matches any number of directories, and wildcards
+// skip dotfiles unless dotMatch is set or the pattern segment starts
+// with a dot.
+func globFiles(pattern, root string, dotMatch bool) []string {
+	var matches []string
+	for _, p := range expandBraces(pattern) {
+		dirOnly := strings.HasSuffix(p, "/")
+		prefix := ""
+		if strings.HasPrefix(p, "/") {
+			prefix = "/"
+		}
+		var segments []string
+		for _, seg := range strings.Split(p, "/") {
+			if seg != "" {
+				segments = append(segments, strings.ReplaceAll(seg, "[!", "[^"))
+			}
+		}
+		var found []string
+		globWalk(root, prefix, segments, dotMatch, dirOnly, &found)
+		for _, m := range found {
+			if dirOnly {
+				// "**/" matches no directories at all as well, which names
+				// nothing when the pattern is all it is
+				if m == "" {
+					continue
+				}
+				if info, err := os.Stat(globPath(root, m)); err != nil || !info.IsDir() {
+					continue
+				}
+				if !strings.HasSuffix(m, "/") {
+					m += "/"
+				}
+			}
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// globWalk matches segments against the directory at prefix, collecting
+// complete matches into out. dirOnly is set when the pattern ends in a
+// slash, so that a trailing ** still matches any number of directories.
+func globWalk(root, prefix string, segments []string, dotMatch, dirOnly bool, out *[]string) {
+	if len(segments) == 0 {
+		*out = append(*out, prefix)
+		return
+	}
+	seg := segments[0]
+	if seg == "**" && len(segments) == 1 && !dirOnly {
+		// A trailing ** behaves like *, unless followed by a slash
+		seg = "*"
+	}
+
+	if seg == "**" {
+		globWalk(root, prefix, segments[1:], dotMatch, dirOnly, out)
+		files, err := os.ReadDir(globPath(root, prefix))
+		if err != nil {
+			return
+		}
+		for _, f := range files {
+			if f.IsDir() && (dotMatch || !strings.HasPrefix(f.Name(), ".")) {
+				globWalk(root, globJoin(prefix, f.Name()), segments, dotMatch, dirOnly, out)
+			}
+		}
+		return
+	}
+
+	if !strings.ContainsAny(seg, "*?[") {
+		next := globJoin(prefix, seg)
+		if _, err := os.Lstat(globPath(root, next)); err == nil {
+			globWalk(root, next, segments[1:], dotMatch, dirOnly, out)
+		}
+		return
+	}
+
+	files, err := os.ReadDir(globPath(root, prefix))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, ".") && !dotMatch && !strings.HasPrefix(seg, ".") {
+			continue
+		}
+		if ok, _ := filepath.Match(seg, name); ok {
+			globWalk(root, globJoin(prefix, name), segments[1:], dotMatch, dirOnly, out)
+		}
+	}
+}
+
+// globJoin appends name to a glob result path.
+func globJoin(prefix, name string) string {
+	switch prefix {
+	case "":
+		return name
+	case "/":
+		return "/" + name
+	}
+	return prefix + "/" + name
+}
+
+// globPath returns the filesystem path of a glob result relative to root.
+func globPath(root, path string) string {
+	if path == "" {
+		return root
+	}
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(root, path)
+}
+
+// expandBraces expands the first {a,b} group in pattern, recursively, so
+// "{lib,test}/*.{rb,txt}" yields four patterns.
+func expandBraces(pattern string) []string {
+	depth, open := 0, -1
+	for i, c := range pattern {
+		switch c {
+		case '{':
+			if depth == 0 {
+				open = i
+			}
+			depth++
+		case '}':
+			if depth == 0 {
+				continue
+			}
+			depth--
+			if depth > 0 {
+				continue
+			}
+			var alternatives []string
+			level, start := 0, open+1
+			for j := open + 1; j < i; j++ {
+				switch pattern[j] {
+				case '{':
+					level++
+				case '}':
+					level--
+				case ',':
+					if level == 0 {
+						alternatives = append(alternatives, pattern[start:j])
+						start = j + 1
+					}
+				}
+			}
+			alternatives = append(alternatives, pattern[start:i])
+			var expanded []string
+			for _, alt := range alternatives {
+				expanded = append(expanded, expandBraces(pattern[:open]+alt+pattern[i+1:])...)
+			}
+			return expanded
+		}
+	}
+	return []string{pattern}
+}
+
 // getFileBuiltins returns class methods for File
 func getFileBuiltins() map[string]*object.Builtin {
 	fileBuiltinsOnce.Do(func() {
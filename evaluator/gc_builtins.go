@@ -0,0 +1,123 @@
+package evaluator
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// GCModule represents Ruby's GC module, backed by the Go runtime
+var GCModule = &object.RubyModule{
+	Name:      "GC",
+	Methods:   make(map[string]object.Object),
+	Constants: make(map[string]object.Object),
+}
+
+// gcDisabled remembers GC.disable so enable/disable return the previous
+// state; Go's collector itself keeps running either way.
+var gcDisabled int32
+
+// gcStatKeys lists the GC.stat keys in the order MRI reports them.
+var gcStatKeys = []string{
+	"count",
+	"time",
+	"heap_allocated_pages",
+	"heap_live_slots",
+	"total_allocated_objects",
+	"total_freed_objects",
+	"malloc_increase_bytes",
+	"minor_gc_count",
+	"major_gc_count",
+}
+
+// gcPageSize is the size of an MRI heap page, used to express Go's heap in
+// pages.
+const gcPageSize = 64 * 1024
+
+func init() {
+	GCModule.Methods["start"] = &object.Builtin{
+		Name: "start",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			runtime.GC()
+			return object.NIL
+		},
+	}
+	GCModule.Methods["garbage_collect"] = GCModule.Methods["start"]
+
+	GCModule.Methods["count"] = &object.Builtin{
+		Name: "count",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			return &object.Integer{Value: int64(stats.NumGC)}
+		},
+	}
+
+	GCModule.Methods["stat"] = &object.Builtin{
+		Name: "stat",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			stats := gcStats()
+			if len(args) > 0 {
+				switch arg := args[0].(type) {
+				case *object.Symbol:
+					value, ok := stats[arg.Value]
+					if !ok {
+						return newError("ArgumentError: unknown key: %s", arg.Value)
+					}
+					return &object.Integer{Value: value}
+				case *object.Hash:
+					for _, key := range gcStatKeys {
+						hashSet(arg, &object.Symbol{Value: key}, &object.Integer{Value: stats[key]})
+					}
+					return arg
+				default:
+					return newError("TypeError: non-hash or symbol given")
+				}
+			}
+
+			hash := newHash()
+			for _, key := range gcStatKeys {
+				hashSet(hash, &object.Symbol{Value: key}, &object.Integer{Value: stats[key]})
+			}
+			return hash
+		},
+	}
+
+	GCModule.Methods["disable"] = &object.Builtin{
+		Name: "disable",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			fmt.Fprintln(os.Stderr, "warning: GC.disable has no effect; the Go collector cannot be paused")
+			return object.NativeToBool(atomic.SwapInt32(&gcDisabled, 1) == 1)
+		},
+	}
+
+	GCModule.Methods["enable"] = &object.Builtin{
+		Name: "enable",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			fmt.Fprintln(os.Stderr, "warning: GC.enable has no effect; the Go collector is never paused")
+			return object.NativeToBool(atomic.SwapInt32(&gcDisabled, 0) == 1)
+		},
+	}
+}
+
+// gcStats reads the Go runtime's memory statistics under MRI's GC.stat
+// names. Go's collector is not generational, so forced collections count
+// as major and the rest as minor.
+func gcStats() map[string]int64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return map[string]int64{
+		"count":                   int64(stats.NumGC),
+		"time":                    int64(stats.PauseTotalNs / 1e6),
+		"heap_allocated_pages":    int64(stats.HeapSys / gcPageSize),
+		"heap_live_slots":         int64(stats.HeapObjects),
+		"total_allocated_objects": int64(stats.Mallocs),
+		"total_freed_objects":     int64(stats.Frees),
+		"malloc_increase_bytes":   int64(stats.HeapAlloc),
+		"minor_gc_count":          int64(stats.NumGC - stats.NumForcedGC),
+		"major_gc_count":          int64(stats.NumForcedGC),
+	}
+}
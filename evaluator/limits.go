@@ -0,0 +1,79 @@
+package evaluator
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// LimitErrorClass is raised when a script runs past the limits set with
+// SetTimeout or SetMaxSteps. It is not a StandardError, so a bare rescue
+// lets it through, and once raised it is raised again at every statement,
+// so no rescue can keep the script going.
+var LimitErrorClass = &object.RubyClass{
+	Name:         "LimitError",
+	Superclass:   object.ExceptionClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// The step limit: steps counts the statements, loop iterations and block
+// calls evaluated, failing evaluation once it passes maxSteps.
+var (
+	steps    int64
+	maxSteps int64
+)
+
+// limitErr is the limit that was exceeded, if any. Unlike an interrupt it
+// is not cleared once delivered. It is guarded by interruptMutex.
+var limitErr *object.Error
+
+// SetTimeout makes evaluation fail once d has passed. It is meant to stop
+// runaway scripts, so it is set once, before the script is run.
+func SetTimeout(d time.Duration) {
+	time.AfterFunc(d, func() {
+		exceedLimit(fmt.Sprintf("execution expired after %s", d))
+	})
+}
+
+// SetMaxSteps makes evaluation fail once more than n steps, statements,
+// loop iterations and block calls, have been evaluated. Zero means no
+// limit.
+func SetMaxSteps(n int64) {
+	atomic.StoreInt64(&steps, 0)
+	atomic.StoreInt64(&maxSteps, n)
+}
+
+// countStep counts a step against the step limit.
+func countStep() {
+	limit := atomic.LoadInt64(&maxSteps)
+	if limit > 0 && atomic.AddInt64(&steps, 1) == limit+1 {
+		exceedLimit(fmt.Sprintf("execution exceeded %d steps", limit))
+	}
+}
+
+// exceedLimit makes the running evaluation raise a LimitError with msg,
+// now and at every statement after.
+func exceedLimit(msg string) {
+	interruptMutex.Lock()
+	if limitErr == nil {
+		limitErr = &object.Error{Message: msg, Class_: LimitErrorClass}
+		signalInterrupt()
+	}
+	interruptMutex.Unlock()
+	atomic.StoreInt32(&interruptPending, 1)
+}
+
+// clearLimits lifts the limits, so that the at_exit handlers can run once
+// the script has been stopped.
+func clearLimits() {
+	atomic.StoreInt64(&maxSteps, 0)
+	interruptMutex.Lock()
+	defer interruptMutex.Unlock()
+	if limitErr != nil {
+		limitErr = nil
+		updateInterruptPending()
+	}
+}
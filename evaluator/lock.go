@@ -0,0 +1,11 @@
+package evaluator
+
+import "sync"
+
+// interpreterLock serializes evaluation. The evaluator keeps its state in
+// package variables (global variables, the class and constant tables, the
+// current file and the call stack), so only one goroutine may evaluate at
+// a time. Eval takes the lock for each program it runs and the exported
+// setters take it too, so embedders may use the interpreter from several
+// goroutines. Ractors hand it over while they wait for a message.
+var interpreterLock sync.Mutex
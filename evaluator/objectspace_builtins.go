@@ -1,6 +1,9 @@
 package evaluator
 
 import (
+	"fmt"
+	"os"
+	"sort"
 	"sync"
 
 	"github.com/alexisbouchez/rubylexer/object"
@@ -9,6 +12,29 @@ import (
 var objectSpaceModuleOnce sync.Once
 var objectSpaceModule *object.RubyModule
 
+// finalizer is a proc registered with ObjectSpace.define_finalizer
+type finalizer struct {
+	obj  object.Object
+	proc object.Object
+}
+
+var (
+	finalizersMutex sync.Mutex
+	finalizers      []finalizer
+)
+
+// countObjectsTypes maps object types to the T_ names count_objects reports
+var countObjectsTypes = map[object.Type]string{
+	object.INSTANCE_OBJ: "T_OBJECT",
+	object.CLASS_OBJ:    "T_CLASS",
+	object.MODULE_OBJ:   "T_MODULE",
+	object.STRING_OBJ:   "T_STRING",
+	object.ARRAY_OBJ:    "T_ARRAY",
+	object.HASH_OBJ:     "T_HASH",
+	object.FLOAT_OBJ:    "T_FLOAT",
+	object.PROC_OBJ:     "T_DATA",
+}
+
 // GetObjectSpaceModule returns the ObjectSpace module.
 func GetObjectSpaceModule() *object.RubyModule {
 	objectSpaceModuleOnce.Do(func() {
@@ -18,84 +44,133 @@ func GetObjectSpaceModule() *object.RubyModule {
 			Constants: make(map[string]object.Object),
 		}
 
-		// each_object - iterate over all objects of a given type
+		// each_object - iterate over recorded objects, optionally only those
+		// that are kind_of? the given class or module
 		objectSpaceModule.Methods["each_object"] = &object.Builtin{
 			Name: "each_object",
 			Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-				block := env.Block()
-				if block == nil {
-					return newError("no block given")
-				}
-
-				var filterClass *object.RubyClass
-
-				// If a class is given, filter by it
+				var filter object.Object
 				if len(args) > 0 {
-					if class, ok := args[0].(*object.RubyClass); ok {
-						filterClass = class
-					} else {
-						return newError("class or module required")
+					switch args[0].(type) {
+					case *object.RubyClass, *object.RubyModule:
+						filter = args[0]
+					default:
+						return newError("TypeError: class or module required")
 					}
 				}
 
-				count := int64(0)
-				objects := object.GetTrackedObjects()
-
-				for _, obj := range objects {
-					// Filter by class if specified
-					if filterClass != nil {
-						objClass := obj.Class()
-						if objClass == nil || objClass != filterClass {
-							// Check if it's an instance of the class
-							if inst, ok := obj.(*object.Instance); ok {
-								if inst.Class_ != filterClass {
-									continue
-								}
-							} else {
-								continue
-							}
-						}
+				var matched []object.Object
+				for _, obj := range object.GetTrackedObjects() {
+					if filter == nil || objectKindOf(obj, filter) {
+						matched = append(matched, obj)
 					}
+				}
 
-					// Call the block with the object
-					blockEnv := object.NewEnclosedEnvironment(block.Env)
-					if len(block.Parameters) > 0 {
-						blockEnv.Set(block.Parameters[0].Name, obj)
+				block := env.Block()
+				if block == nil {
+					return &object.Enumerator{Object: receiver, Method: "each_object", Values: matched}
+				}
+				for _, obj := range matched {
+					result := callBlock(block, []object.Object{obj}, env)
+					if brk, ok := result.(*object.BreakValue); ok {
+						return brk.Value
+					}
+					if isError(result) {
+						return result
 					}
-					evalBlockBody(block.Body, blockEnv)
-					count++
 				}
-
-				return &object.Integer{Value: count}
+				return &object.Integer{Value: int64(len(matched))}
 			},
 		}
 
-		// count_objects - count objects by type
+		// count_objects - count recorded objects by internal type
 		objectSpaceModule.Methods["count_objects"] = &object.Builtin{
 			Name: "count_objects",
 			Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-				counts := object.CountObjectsByType()
+				counts := make(map[string]int64)
+				total := int64(0)
+				for typ, count := range object.CountObjectsByType() {
+					name, ok := countObjectsTypes[typ]
+					if !ok {
+						name = "T_DATA"
+					}
+					counts[name] += int64(count)
+					total += int64(count)
+				}
 
-				hash := &object.Hash{
-					Pairs: make(map[object.HashKey]object.HashPair),
-					Order: make([]object.HashKey, 0),
+				names := make([]string, 0, len(counts))
+				for name := range counts {
+					names = append(names, name)
 				}
+				sort.Strings(names)
 
-				for typ, count := range counts {
-					key := &object.Symbol{Value: string(typ)}
-					hashKey := key.HashKey()
-					hash.Pairs[hashKey] = object.HashPair{
-						Key:   key,
-						Value: &object.Integer{Value: int64(count)},
+				hash := newHash()
+				if len(args) > 0 {
+					if given, ok := args[0].(*object.Hash); ok {
+						hash = given
 					}
-					hash.Order = append(hash.Order, hashKey)
 				}
-
+				hashSet(hash, &object.Symbol{Value: "TOTAL"}, &object.Integer{Value: total})
+				hashSet(hash, &object.Symbol{Value: "FREE"}, &object.Integer{Value: 0})
+				for _, name := range names {
+					hashSet(hash, &object.Symbol{Value: name}, &object.Integer{Value: counts[name]})
+				}
 				return hash
 			},
 		}
 
-		// _id2ref - get object by ID (not fully implemented since Go doesn't support this directly)
+		// define_finalizer - register a proc to call with the object's id
+		// when the interpreter exits
+		objectSpaceModule.Methods["define_finalizer"] = &object.Builtin{
+			Name: "define_finalizer",
+			Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+				if len(args) < 1 || len(args) > 2 {
+					return newError("wrong number of arguments (given %d, expected 1..2)", len(args))
+				}
+				var proc object.Object
+				if len(args) == 2 {
+					proc = args[1]
+					if !respondsToCall(proc) {
+						return newError("ArgumentError: wrong type argument %s (should be callable)", comparisonOperandName(proc))
+					}
+				} else if block := env.Block(); block != nil {
+					proc = block
+				} else {
+					return newError("ArgumentError: tried to create Proc object without a block")
+				}
+				switch args[0].(type) {
+				case *object.Integer, *object.Float, *object.Symbol, *object.Nil, *object.Boolean:
+					return newError("ArgumentError: cannot define finalizer for %s", comparisonOperandName(args[0]))
+				}
+
+				finalizersMutex.Lock()
+				finalizers = append(finalizers, finalizer{obj: args[0], proc: proc})
+				finalizersMutex.Unlock()
+				return &object.Array{Elements: []object.Object{&object.Integer{Value: 0}, proc}}
+			},
+		}
+
+		// undefine_finalizer - drop every finalizer registered for an object
+		objectSpaceModule.Methods["undefine_finalizer"] = &object.Builtin{
+			Name: "undefine_finalizer",
+			Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments (given %d, expected 1)", len(args))
+				}
+				finalizersMutex.Lock()
+				kept := finalizers[:0]
+				for _, f := range finalizers {
+					if f.obj != args[0] {
+						kept = append(kept, f)
+					}
+				}
+				finalizers = kept
+				finalizersMutex.Unlock()
+				return args[0]
+			},
+		}
+
+		// _id2ref - get an object back from its object_id
 		objectSpaceModule.Methods["_id2ref"] = &object.Builtin{
 			Name: "_id2ref",
 			Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
@@ -105,31 +180,77 @@ func GetObjectSpaceModule() *object.RubyModule {
 
 				id, ok := args[0].(*object.Integer)
 				if !ok {
-					return newError("not a valid object id")
+					return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
 				}
-
-				// Search for object with this ID
-				objects := object.GetTrackedObjects()
-				for _, obj := range objects {
-					if object.GetObjectID(obj) == id.Value {
-						return obj
-					}
+				if obj, found := object.ObjectForID(id.Value); found {
+					return obj
 				}
-
-				return newError("RangeError: object not found for object id %d", id.Value)
+				return newError("RangeError: %#x is not id value", id.Value)
 			},
 		}
 
-		// garbage_collect - trigger GC (no-op in this implementation, Go handles GC)
+		// garbage_collect - Go owns the heap; there is nothing to collect
 		objectSpaceModule.Methods["garbage_collect"] = &object.Builtin{
 			Name: "garbage_collect",
 			Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-				// In Ruby, this triggers GC. In Go, we can't force GC explicitly in a meaningful way
-				// but we can suggest it
-				// runtime.GC() - we could call this but it's not usually needed
 				return object.NIL
 			},
 		}
 	})
 	return objectSpaceModule
 }
+
+// objectKindOf reports whether obj.kind_of?(mod) holds.
+func objectKindOf(obj object.Object, mod object.Object) bool {
+	for class := obj.Class(); class != nil; class = class.Superclass {
+		if class == mod {
+			return true
+		}
+		for _, included := range class.IncludedModules {
+			if included == mod {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// respondsToCall reports whether obj can stand in for a proc.
+func respondsToCall(obj object.Object) bool {
+	switch o := obj.(type) {
+	case *object.Proc, *object.Lambda, *object.Method, *object.BoundMethod:
+		return true
+	case *object.Instance:
+		return instanceResponds(o, "call")
+	}
+	return false
+}
+
+// RunFinalizers calls the procs registered with ObjectSpace.define_finalizer,
+// in registration order, as the interpreter exits. Errors raised by a
+// finalizer are reported to stderr and do not stop the rest.
+func RunFinalizers() {
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+	runFinalizers()
+}
+
+func runFinalizers() {
+	finalizersMutex.Lock()
+	pending := finalizers
+	finalizers = nil
+	finalizersMutex.Unlock()
+
+	for _, f := range pending {
+		id := &object.Integer{Value: object.GetObjectID(f.obj)}
+		var result object.Object
+		if inst, ok := f.proc.(*object.Instance); ok {
+			result, _ = callInstanceMethod(inst, "call", id)
+		} else {
+			result = callProc(f.proc, []object.Object{id}, object.NewEnvironment())
+		}
+		if err, ok := result.(*object.Error); ok {
+			fmt.Fprintf(os.Stderr, "warning: Exception in finalizer: %s\n", err.Message)
+		}
+	}
+}
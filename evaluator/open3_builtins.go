@@ -0,0 +1,274 @@
+package evaluator
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// Open3Module represents Ruby's Open3 module
+var Open3Module = &object.RubyModule{
+	Name:      "Open3",
+	Methods:   make(map[string]object.Object),
+	Constants: make(map[string]object.Object),
+}
+
+// ProcessWaiterClass represents Process::Waiter, the wait thread yielded
+// by Open3.popen3 whose value is the child's Process::Status
+var ProcessWaiterClass = &object.RubyClass{
+	Name:         "Process::Waiter",
+	Superclass:   object.ObjectClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// processWaiter reaps a child in the background
+type processWaiter struct {
+	pid    int
+	done   chan struct{}
+	status *object.Instance
+}
+
+func init() {
+	ProcessModule.Constants["Waiter"] = ProcessWaiterClass
+
+	initOpen3Methods()
+	initProcessWaiterMethods()
+}
+
+func initOpen3Methods() {
+	Open3Module.Methods["capture3"] = &object.Builtin{
+		Name: "capture3",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			var stdout, stderr strings.Builder
+			status := captureCommand(args, &stdout, &stderr)
+			if isError(status) {
+				return status
+			}
+			return &object.Array{Elements: []object.Object{
+				&object.String{Value: stdout.String()},
+				&object.String{Value: stderr.String()},
+				status,
+			}}
+		},
+	}
+
+	Open3Module.Methods["capture2"] = &object.Builtin{
+		Name: "capture2",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			var stdout strings.Builder
+			status := captureCommand(args, &stdout, nil)
+			if isError(status) {
+				return status
+			}
+			return &object.Array{Elements: []object.Object{&object.String{Value: stdout.String()}, status}}
+		},
+	}
+
+	Open3Module.Methods["capture2e"] = &object.Builtin{
+		Name: "capture2e",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			var output strings.Builder
+			status := captureCommand(args, &output, &output)
+			if isError(status) {
+				return status
+			}
+			return &object.Array{Elements: []object.Object{&object.String{Value: output.String()}, status}}
+		},
+	}
+
+	Open3Module.Methods["popen3"] = &object.Builtin{
+		Name: "popen3",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return popenCommand(args, true, false, env)
+		},
+	}
+
+	Open3Module.Methods["popen2"] = &object.Builtin{
+		Name: "popen2",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return popenCommand(args, false, false, env)
+		},
+	}
+
+	Open3Module.Methods["popen2e"] = &object.Builtin{
+		Name: "popen2e",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return popenCommand(args, false, true, env)
+		},
+	}
+}
+
+func initProcessWaiterMethods() {
+	ProcessWaiterClass.Methods["pid"] = &object.Builtin{
+		Name: "pid",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: int64(lookupWaiter(receiver).pid)}
+		},
+	}
+
+	ProcessWaiterClass.Methods["[]"] = &object.Builtin{
+		Name: "[]",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) == 1 {
+				if key, ok := args[0].(*object.Symbol); ok && key.Value == "pid" {
+					return &object.Integer{Value: int64(lookupWaiter(receiver).pid)}
+				}
+			}
+			return object.NIL
+		},
+	}
+
+	ProcessWaiterClass.Methods["value"] = &object.Builtin{
+		Name: "value",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			waiter := lookupWaiter(receiver)
+			<-waiter.done
+			return waiter.status
+		},
+	}
+
+	ProcessWaiterClass.Methods["join"] = &object.Builtin{
+		Name: "join",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			<-lookupWaiter(receiver).done
+			return receiver
+		},
+	}
+
+	ProcessWaiterClass.Methods["alive?"] = &object.Builtin{
+		Name: "alive?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			select {
+			case <-lookupWaiter(receiver).done:
+				return object.FALSE
+			default:
+				return object.TRUE
+			}
+		},
+	}
+}
+
+func lookupWaiter(obj object.Object) *processWaiter {
+	waiter, _ := obj.(*object.Instance).Data.(*processWaiter)
+	return waiter
+}
+
+// captureCommand runs a command to completion, feeding it the stdin_data:
+// option and collecting its output into stdout and stderr; a nil stderr is
+// left connected to the interpreter's. It returns the Process::Status.
+func captureCommand(args []object.Object, stdout, stderr *strings.Builder) object.Object {
+	stdin := ""
+	if len(args) > 0 {
+		if opts, ok := args[len(args)-1].(*object.Hash); ok && opts.IsKeywordArgs {
+			if data, ok := hashGet(opts, &object.Symbol{Value: "stdin_data"}); ok {
+				stdin = objectToString(data)
+			}
+		}
+	}
+	cmd, err := buildCommand(args)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = stdout
+	if stderr != nil {
+		cmd.Stderr = stderr
+	}
+	if runErr := cmd.Start(); runErr != nil {
+		return newError("Errno::ENOENT: No such file or directory - %s", cmd.Args[0])
+	}
+	cmd.Wait()
+	return newProcessStatus(cmd.Process.Pid, cmd.ProcessState)
+}
+
+// popenCommand starts a command connected to pipes and returns [stdin,
+// stdout, stderr, wait_thr] (or [stdin, stdout, wait_thr] when withStderr is
+// false, stderr joining stdout if merge is set). With a block those are
+// yielded instead, and the pipes are closed and the child reaped when it
+// returns.
+func popenCommand(args []object.Object, withStderr, merge bool, env *object.Environment) object.Object {
+	cmd, err := buildCommand(args)
+	if err != nil {
+		return err
+	}
+
+	var parentEnds, childEnds []*os.File
+	pipe := func() (*os.File, *os.File) {
+		r, w, pipeErr := os.Pipe()
+		if pipeErr != nil {
+			return nil, nil
+		}
+		parentEnds = append(parentEnds, r, w)
+		return r, w
+	}
+	inR, inW := pipe()
+	outR, outW := pipe()
+	errR, errW := outR, outW
+	if withStderr {
+		errR, errW = pipe()
+	}
+	if inR == nil || outR == nil || errR == nil {
+		return newError("Errno::EMFILE: Too many open files")
+	}
+	cmd.Stdin, cmd.Stdout = inR, outW
+	switch {
+	case withStderr:
+		cmd.Stderr = errW
+	case merge:
+		cmd.Stderr = outW
+	default:
+		cmd.Stderr = os.Stderr
+	}
+	childEnds = []*os.File{inR, outW}
+	if withStderr {
+		childEnds = append(childEnds, errW)
+	}
+
+	if startErr := cmd.Start(); startErr != nil {
+		for _, f := range parentEnds {
+			f.Close()
+		}
+		return newError("Errno::ENOENT: No such file or directory - %s", cmd.Args[0])
+	}
+	// The child holds its own copies of these ends
+	for _, f := range childEnds {
+		f.Close()
+	}
+
+	streams := []object.Object{newIO(inW, "stdin"), newIO(outR, "stdout")}
+	if withStderr {
+		streams = append(streams, newIO(errR, "stderr"))
+	}
+	streams = append(streams, startWaiter(cmd))
+
+	block := env.Block()
+	if block == nil {
+		return &object.Array{Elements: streams}
+	}
+	result := callBlock(block, streams, env)
+	for _, stream := range streams[:len(streams)-1] {
+		closeFileHandle(stream.(*object.Instance))
+	}
+	<-lookupWaiter(streams[len(streams)-1]).done
+	return result
+}
+
+// startWaiter reaps cmd in the background, returning its Process::Waiter.
+func startWaiter(cmd *exec.Cmd) *object.Instance {
+	waiter := &processWaiter{pid: cmd.Process.Pid, done: make(chan struct{})}
+	instance := &object.Instance{
+		Class_:            ProcessWaiterClass,
+		InstanceVariables: make(map[string]object.Object),
+		Data:              waiter,
+	}
+
+	go func() {
+		cmd.Wait()
+		waiter.status = newProcessStatus(waiter.pid, cmd.ProcessState)
+		close(waiter.done)
+	}()
+	return instance
+}
@@ -0,0 +1,258 @@
+package evaluator
+
+import (
+	"github.com/alexisbouchez/rubylexer/ast"
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+func evalCaseInExpression(node *ast.CaseInExpression, env *object.Environment) object.Object {
+	subject := Eval(node.Subject, env)
+	if isError(subject) {
+		return subject
+	}
+
+	for _, clause := range node.Clauses {
+		matched, err := matchPattern(clause.Pattern, subject, env)
+		if err != nil {
+			return err
+		}
+		if matched && clause.Guard != nil {
+			guard := Eval(clause.Guard, env)
+			if isError(guard) {
+				return guard
+			}
+			matched = isTruthy(guard) != clause.Unless
+		}
+		if matched {
+			return evalBlockBody(clause.Body, env)
+		}
+	}
+
+	if node.Else != nil {
+		return evalBlockBody(node.Else, env)
+	}
+	return newError("NoMatchingPatternError: %s", inspectObject(subject))
+}
+
+// matchPattern reports whether value matches pattern, binding the
+// pattern's variables in env as it goes. Bindings made before a match
+// fails are kept, as in Ruby.
+func matchPattern(pattern ast.Pattern, value object.Object, env *object.Environment) (bool, object.Object) {
+	switch pat := pattern.(type) {
+	case *ast.ValuePattern:
+		expected := Eval(pat.Value, env)
+		if isError(expected) {
+			return false, expected
+		}
+		return isTruthy(evalCaseEquality(expected, value)), nil
+
+	case *ast.PinPattern:
+		expected := Eval(pat.Value, env)
+		if isError(expected) {
+			return false, expected
+		}
+		return isTruthy(evalCaseEquality(expected, value)), nil
+
+	case *ast.BindingPattern:
+		env.Assign(pat.Name, value)
+		return true, nil
+
+	case *ast.CapturePattern:
+		matched, err := matchPattern(pat.Pattern, value, env)
+		if matched {
+			env.Assign(pat.Name, value)
+		}
+		return matched, err
+
+	case *ast.AlternativePattern:
+		for _, alt := range pat.Alternatives {
+			matched, err := matchPattern(alt, value, env)
+			if err != nil || matched {
+				return matched, err
+			}
+		}
+		return false, nil
+
+	case *ast.ArrayPattern:
+		if ok, err := matchPatternConstant(pat.Constant, value, env); !ok {
+			return false, err
+		}
+		elements, ok, err := deconstruct(value)
+		if !ok {
+			return false, err
+		}
+		if len(elements) < len(pat.Pre)+len(pat.Post) || pat.Rest == nil && len(elements) != len(pat.Pre) {
+			return false, nil
+		}
+		if ok, err := matchElements(pat.Pre, elements[:len(pat.Pre)], env); !ok {
+			return false, err
+		}
+		rest := elements[len(pat.Pre) : len(elements)-len(pat.Post)]
+		if ok, err := matchElements(pat.Post, elements[len(elements)-len(pat.Post):], env); !ok {
+			return false, err
+		}
+		if pat.Rest != nil && pat.Rest.Name != "" {
+			env.Assign(pat.Rest.Name, &object.Array{Elements: append([]object.Object{}, rest...)})
+		}
+		return true, nil
+
+	case *ast.FindPattern:
+		if ok, err := matchPatternConstant(pat.Constant, value, env); !ok {
+			return false, err
+		}
+		elements, ok, err := deconstruct(value)
+		if !ok {
+			return false, err
+		}
+		for start := 0; start+len(pat.Middle) <= len(elements); start++ {
+			end := start + len(pat.Middle)
+			matched, err := matchElements(pat.Middle, elements[start:end], env)
+			if err != nil {
+				return false, err
+			}
+			if matched {
+				if pat.Pre.Name != "" {
+					env.Assign(pat.Pre.Name, &object.Array{Elements: append([]object.Object{}, elements[:start]...)})
+				}
+				if pat.Post.Name != "" {
+					env.Assign(pat.Post.Name, &object.Array{Elements: append([]object.Object{}, elements[end:]...)})
+				}
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case *ast.HashPattern:
+		return matchHashPattern(pat, value, env)
+	}
+
+	return false, newError("unsupported pattern %T", pattern)
+}
+
+// matchElements matches each element against the pattern at its index.
+func matchElements(patterns []ast.Pattern, elements []object.Object, env *object.Environment) (bool, object.Object) {
+	for i, pat := range patterns {
+		if ok, err := matchPattern(pat, elements[i], env); !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchPatternConstant checks value against the constant of a
+// Const(...) pattern with ===; a nil constant always matches.
+func matchPatternConstant(constant ast.Expression, value object.Object, env *object.Environment) (bool, object.Object) {
+	if constant == nil {
+		return true, nil
+	}
+	expected := Eval(constant, env)
+	if isError(expected) {
+		return false, expected
+	}
+	return isTruthy(evalCaseEquality(expected, value)), nil
+}
+
+// deconstruct returns the elements an array pattern matches against: an
+// Array's own, or what an object's deconstruct method returns. It reports
+// false for values that cannot be deconstructed.
+func deconstruct(value object.Object) ([]object.Object, bool, object.Object) {
+	switch v := value.(type) {
+	case *object.Array:
+		return v.Elements, true, nil
+	case *object.Instance:
+		if !instanceResponds(v, "deconstruct") {
+			return nil, false, nil
+		}
+		result := callMethod(v, "deconstruct", nil, nil, object.NewEnvironment())
+		if isError(result) {
+			return nil, false, result
+		}
+		arr, ok := result.(*object.Array)
+		if !ok {
+			return nil, false, newError("TypeError: deconstruct must return Array")
+		}
+		return arr.Elements, true, nil
+	}
+	return nil, false, nil
+}
+
+// deconstructKeys returns the hash a hash pattern matches against: a
+// Hash itself, or what an object's deconstruct_keys method returns when
+// passed the pattern's keys (nil if the pattern captures the rest).
+func deconstructKeys(pat *ast.HashPattern, value object.Object) (*object.Hash, object.Object) {
+	switch v := value.(type) {
+	case *object.Hash:
+		return v, nil
+	case *object.Instance:
+		if !instanceResponds(v, "deconstruct_keys") {
+			return nil, nil
+		}
+		var keys object.Object = object.NIL
+		if pat.Rest == nil || pat.Rest.Name == "" {
+			arr := &object.Array{Elements: make([]object.Object, len(pat.Keys))}
+			for i, key := range pat.Keys {
+				arr.Elements[i] = &object.Symbol{Value: key}
+			}
+			keys = arr
+		}
+		result := callMethod(v, "deconstruct_keys", []object.Object{keys}, nil, object.NewEnvironment())
+		if isError(result) {
+			return nil, result
+		}
+		hash, ok := result.(*object.Hash)
+		if !ok {
+			return nil, newError("TypeError: deconstruct_keys must return Hash")
+		}
+		return hash, nil
+	}
+	return nil, nil
+}
+
+// matchHashPattern matches the listed symbol keys, each against its value
+// pattern or by binding a local variable of the same name. Other keys are
+// allowed unless the pattern ends in **nil; in {} matches only an empty
+// hash.
+func matchHashPattern(pat *ast.HashPattern, value object.Object, env *object.Environment) (bool, object.Object) {
+	if ok, err := matchPatternConstant(pat.Constant, value, env); !ok {
+		return false, err
+	}
+	hash, err := deconstructKeys(pat, value)
+	if hash == nil {
+		return false, err
+	}
+	if len(pat.Keys) == 0 && pat.Rest == nil && pat.Constant == nil && len(hash.Order) > 0 {
+		return false, nil
+	}
+
+	matched := make(map[object.HashKey]bool, len(pat.Keys))
+	for i, name := range pat.Keys {
+		key := &object.Symbol{Value: name}
+		val, ok := hashGet(hash, key)
+		if !ok {
+			return false, nil
+		}
+		matched[key.HashKey()] = true
+		if pat.Values[i] == nil {
+			env.Assign(name, val)
+			continue
+		}
+		if ok, err := matchPattern(pat.Values[i], val, env); !ok {
+			return false, err
+		}
+	}
+
+	if pat.NilRest && len(hash.Order) > len(pat.Keys) {
+		return false, nil
+	}
+	if pat.Rest != nil && pat.Rest.Name != "" {
+		rest := newHash()
+		for _, hk := range hash.Order {
+			if !matched[hk] {
+				pair := hash.Pairs[hk]
+				hashSet(rest, pair.Key, pair.Value)
+			}
+		}
+		env.Assign(pat.Rest.Name, rest)
+	}
+	return true, nil
+}
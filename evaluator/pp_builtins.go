@@ -0,0 +1,151 @@
+package evaluator
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// ppDefaultWidth is the line width pp wraps at unless told otherwise
+const ppDefaultWidth = 80
+
+// PPModule represents Ruby's PP module
+var PPModule = &object.RubyModule{
+	Name:      "PP",
+	Methods:   make(map[string]object.Object),
+	Constants: make(map[string]object.Object),
+}
+
+func init() {
+	// PP.pp(obj, out = $stdout, width = 80)
+	PPModule.Methods["pp"] = &object.Builtin{
+		Name: "pp",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 1 || len(args) > 3 {
+				return newError("wrong number of arguments (given %d, expected 1..3)", len(args))
+			}
+			width := ppDefaultWidth
+			if len(args) > 2 {
+				w, ok := args[2].(*object.Integer)
+				if !ok {
+					return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[2]))
+				}
+				width = int(w.Value)
+			}
+			var out object.Object = object.NIL
+			if len(args) > 1 {
+				out = args[1]
+			}
+			text := prettyInspect(args[0], width) + "\n"
+			if err := ppWrite(out, text); err != nil {
+				return err
+			}
+			return out
+		},
+	}
+}
+
+// prettyInspect is inspect laid out over several lines: any Array, Hash or
+// Struct whose one-line form would run past width is broken up with one
+// element per line, aligned under its opening bracket.
+func prettyInspect(obj object.Object, width int) string {
+	return ppFormat(obj, 0, 0, width)
+}
+
+// ppFormat formats obj starting at column col, leaving room for trail
+// closing characters that will follow it on its last line.
+func ppFormat(obj object.Object, col, trail, width int) string {
+	flat := inspectObject(obj)
+	if col+utf8.RuneCountInString(flat)+trail <= width {
+		return flat
+	}
+
+	switch o := obj.(type) {
+	case *object.Array:
+		if len(o.Elements) == 0 {
+			return flat
+		}
+		items := make([]string, len(o.Elements))
+		for i, e := range o.Elements {
+			items[i] = ppFormat(e, col+1, ppTrail(i, len(o.Elements), trail), width)
+		}
+		return "[" + strings.Join(items, ",\n"+strings.Repeat(" ", col+1)) + "]"
+	case *object.Hash:
+		if len(o.Order) == 0 {
+			return flat
+		}
+		items := make([]string, len(o.Order))
+		for i, key := range o.Order {
+			pair := o.Pairs[key]
+			prefix := inspectObject(pair.Key) + " => "
+			valueCol := col + 1 + utf8.RuneCountInString(prefix)
+			items[i] = prefix + ppFormat(pair.Value, valueCol, ppTrail(i, len(o.Order), trail), width)
+		}
+		return "{" + strings.Join(items, ",\n"+strings.Repeat(" ", col+1)) + "}"
+	case *object.Instance:
+		members := o.Class_.StructMembers
+		if members == nil || !ppDefaultInspect(o) {
+			return flat
+		}
+		items := make([]string, len(members))
+		for i, m := range members {
+			var value object.Object = object.NIL
+			if v, ok := o.InstanceVariables["@"+m]; ok {
+				value = v
+			}
+			prefix := m + "="
+			valueCol := col + 1 + utf8.RuneCountInString(prefix)
+			items[i] = prefix + ppFormat(value, valueCol, ppTrail(i, len(members), trail), width)
+		}
+		indent := "\n" + strings.Repeat(" ", col+1)
+		return fmt.Sprintf("#<struct %s%s%s>", o.Class_.Name, indent, strings.Join(items, ","+indent))
+	}
+	return flat
+}
+
+// ppTrail is the room the i-th of n elements must leave: a comma, or the
+// closing bracket plus whatever follows the collection.
+func ppTrail(i, n, trail int) int {
+	if i == n-1 {
+		return trail + 1
+	}
+	return 1
+}
+
+// ppDefaultInspect reports whether a struct still uses the built-in
+// inspect, so a user-defined one is left alone.
+func ppDefaultInspect(inst *object.Instance) bool {
+	if _, ok := inst.SingletonMethods["inspect"]; ok {
+		return false
+	}
+	method, ok := inst.Class_.LookupMethod("inspect")
+	if !ok {
+		return true
+	}
+	_, builtin := method.(*object.Builtin)
+	return builtin
+}
+
+// ppWrite sends pp output to out: nil means $stdout, a String is
+// appended to, and anything else must respond to <<.
+func ppWrite(out object.Object, text string) object.Object {
+	switch o := out.(type) {
+	case *object.Nil:
+		return writeStdout(text)
+	case *object.String:
+		o.Value += text
+	case *object.Instance:
+		result, ok := callInstanceMethod(o, "<<", &object.String{Value: text})
+		if !ok {
+			return newError("NoMethodError: undefined method `<<' for %s", o.Inspect())
+		}
+		if isError(result) {
+			return result
+		}
+	default:
+		return newError("NoMethodError: undefined method `<<' for %s", comparisonOperandName(out))
+	}
+	return nil
+}
@@ -0,0 +1,586 @@
+package evaluator
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// ProcessModule represents Ruby's Process module
+var ProcessModule = &object.RubyModule{
+	Name:      "Process",
+	Methods:   make(map[string]object.Object),
+	Constants: make(map[string]object.Object),
+}
+
+// ProcessStatusClass represents Process::Status, the value of $?
+var ProcessStatusClass = &object.RubyClass{
+	Name:         "Process::Status",
+	Superclass:   object.ObjectClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+var (
+	childrenMutex sync.Mutex
+	children      = make(map[int]*exec.Cmd)
+	processStart  = time.Now()
+
+	subprocessesEnabled = true
+)
+
+// SetSubprocessesEnabled controls whether scripts may run external commands
+// through backticks, %x, system, spawn and exec. Embedders sandboxing
+// untrusted scripts can switch it off.
+func SetSubprocessesEnabled(enabled bool) {
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+	subprocessesEnabled = enabled
+}
+
+// processSignals maps signal names, without the SIG prefix, to signals
+var processSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"ILL":  syscall.SIGILL,
+	"TRAP": syscall.SIGTRAP,
+	"ABRT": syscall.SIGABRT,
+	"BUS":  syscall.SIGBUS,
+	"FPE":  syscall.SIGFPE,
+	"KILL": syscall.SIGKILL,
+	"SEGV": syscall.SIGSEGV,
+	"PIPE": syscall.SIGPIPE,
+	"ALRM": syscall.SIGALRM,
+	"TERM": syscall.SIGTERM,
+}
+
+const (
+	clockRealtime  = 0
+	clockMonotonic = 1
+)
+
+func init() {
+	ProcessModule.Constants["Status"] = ProcessStatusClass
+	ProcessModule.Constants["CLOCK_REALTIME"] = &object.Integer{Value: clockRealtime}
+	ProcessModule.Constants["CLOCK_MONOTONIC"] = &object.Integer{Value: clockMonotonic}
+	globalVariables["$$"] = &object.Integer{Value: int64(os.Getpid())}
+
+	initProcessMethods()
+	initProcessStatusMethods()
+}
+
+func initProcessMethods() {
+	ProcessModule.Methods["pid"] = &object.Builtin{
+		Name: "pid",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: int64(os.Getpid())}
+		},
+	}
+
+	ProcessModule.Methods["ppid"] = &object.Builtin{
+		Name: "ppid",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: int64(os.Getppid())}
+		},
+	}
+
+	ProcessModule.Methods["spawn"] = &object.Builtin{
+		Name: "spawn",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			cmd, err := buildCommand(args)
+			if err != nil {
+				return err
+			}
+			if startErr := cmd.Start(); startErr != nil {
+				return newError("Errno::ENOENT: No such file or directory - %s", cmd.Args[0])
+			}
+			childrenMutex.Lock()
+			children[cmd.Process.Pid] = cmd
+			childrenMutex.Unlock()
+			return &object.Integer{Value: int64(cmd.Process.Pid)}
+		},
+	}
+
+	ProcessModule.Methods["wait"] = &object.Builtin{
+		Name: "wait",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			status := waitChild(args)
+			if isError(status) {
+				return status
+			}
+			return status.(*object.Instance).InstanceVariables["@pid"]
+		},
+	}
+
+	ProcessModule.Methods["waitpid"] = ProcessModule.Methods["wait"]
+
+	ProcessModule.Methods["wait2"] = &object.Builtin{
+		Name: "wait2",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			status := waitChild(args)
+			if isError(status) {
+				return status
+			}
+			pid := status.(*object.Instance).InstanceVariables["@pid"]
+			return &object.Array{Elements: []object.Object{pid, status}}
+		},
+	}
+
+	ProcessModule.Methods["waitpid2"] = ProcessModule.Methods["wait2"]
+
+	ProcessModule.Methods["waitall"] = &object.Builtin{
+		Name: "waitall",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			results := []object.Object{}
+			for {
+				status := waitChild(nil)
+				if isError(status) {
+					return &object.Array{Elements: results}
+				}
+				pid := status.(*object.Instance).InstanceVariables["@pid"]
+				results = append(results, &object.Array{Elements: []object.Object{pid, status}})
+			}
+		},
+	}
+
+	ProcessModule.Methods["kill"] = &object.Builtin{
+		Name: "kill",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 2 {
+				return newError("wrong number of arguments (given %d, expected 2+)", len(args))
+			}
+			sig, err := parseSignal(args[0])
+			if err != nil {
+				return err
+			}
+			for _, arg := range args[1:] {
+				pid, ok := arg.(*object.Integer)
+				if !ok {
+					return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(arg))
+				}
+				proc, findErr := os.FindProcess(int(pid.Value))
+				if findErr != nil {
+					return newError("Errno::ESRCH: No such process")
+				}
+				if sigErr := proc.Signal(sig); sigErr != nil {
+					return newError("Errno::ESRCH: No such process")
+				}
+			}
+			return &object.Integer{Value: int64(len(args) - 1)}
+		},
+	}
+
+	ProcessModule.Methods["clock_gettime"] = &object.Builtin{
+		Name: "clock_gettime",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 1 {
+				return newError("wrong number of arguments (given 0, expected 1..2)")
+			}
+			clock, ok := args[0].(*object.Integer)
+			if !ok {
+				return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+			}
+			var nanos int64
+			switch clock.Value {
+			case clockRealtime:
+				nanos = time.Now().UnixNano()
+			case clockMonotonic:
+				nanos = int64(time.Since(processStart))
+			default:
+				return newError("Errno::EINVAL: Invalid argument - clock_gettime")
+			}
+			unit := "float_second"
+			if len(args) > 1 {
+				if sym, ok := args[1].(*object.Symbol); ok {
+					unit = sym.Value
+				}
+			}
+			switch unit {
+			case "float_second":
+				return &object.Float{Value: float64(nanos) / 1e9}
+			case "float_millisecond":
+				return &object.Float{Value: float64(nanos) / 1e6}
+			case "float_microsecond":
+				return &object.Float{Value: float64(nanos) / 1e3}
+			case "second":
+				return &object.Integer{Value: nanos / 1e9}
+			case "millisecond":
+				return &object.Integer{Value: nanos / 1e6}
+			case "microsecond":
+				return &object.Integer{Value: nanos / 1e3}
+			case "nanosecond":
+				return &object.Integer{Value: nanos}
+			}
+			return newError("ArgumentError: unexpected unit: %s", unit)
+		},
+	}
+
+	ProcessModule.Methods["fork"] = &object.Builtin{
+		Name: "fork",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return newError("NotImplementedError: fork() function is unimplemented on this machine")
+		},
+	}
+
+	ProcessModule.Methods["exec"] = &object.Builtin{
+		Name: "exec",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return execCommand(args)
+		},
+	}
+
+	ProcessModule.Methods["exit"] = &object.Builtin{
+		Name: "exit",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return getKernelBuiltins()["exit"].Fn(receiver, env, args...)
+		},
+	}
+
+	ProcessModule.Methods["last_status"] = &object.Builtin{
+		Name: "last_status",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if status, ok := globalVariables["$?"]; ok {
+				return status
+			}
+			return object.NIL
+		},
+	}
+}
+
+func initProcessStatusMethods() {
+	ivarReader := func(name, ivar string) {
+		ProcessStatusClass.Methods[name] = &object.Builtin{
+			Name: name,
+			Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+				return receiver.(*object.Instance).InstanceVariables[ivar]
+			},
+		}
+	}
+	ivarReader("pid", "@pid")
+	ivarReader("exitstatus", "@exitstatus")
+	ivarReader("termsig", "@termsig")
+
+	ProcessStatusClass.Methods["success?"] = &object.Builtin{
+		Name: "success?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			code, ok := receiver.(*object.Instance).InstanceVariables["@exitstatus"].(*object.Integer)
+			if !ok {
+				return object.NIL
+			}
+			return object.NativeToBool(code.Value == 0)
+		},
+	}
+
+	ProcessStatusClass.Methods["exited?"] = &object.Builtin{
+		Name: "exited?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return object.NativeToBool(receiver.(*object.Instance).InstanceVariables["@exitstatus"] != object.NIL)
+		},
+	}
+
+	ProcessStatusClass.Methods["signaled?"] = &object.Builtin{
+		Name: "signaled?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return object.NativeToBool(receiver.(*object.Instance).InstanceVariables["@termsig"] != object.NIL)
+		},
+	}
+
+	ProcessStatusClass.Methods["to_i"] = &object.Builtin{
+		Name: "to_i",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: processStatusBits(receiver.(*object.Instance))}
+		},
+	}
+
+	ProcessStatusClass.Methods["=="] = &object.Builtin{
+		Name: "==",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			if n, ok := args[0].(*object.Integer); ok {
+				return object.NativeToBool(n.Value == processStatusBits(receiver.(*object.Instance)))
+			}
+			return object.NativeToBool(receiver == args[0])
+		},
+	}
+
+	ProcessStatusClass.Methods["to_s"] = &object.Builtin{
+		Name: "to_s",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.String{Value: processStatusString(receiver.(*object.Instance))}
+		},
+	}
+
+	ProcessStatusClass.Methods["inspect"] = &object.Builtin{
+		Name: "inspect",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.String{Value: "#<Process::Status: " + processStatusString(receiver.(*object.Instance)) + ">"}
+		},
+	}
+}
+
+// newProcessStatus builds a Process::Status for a finished child.
+func newProcessStatus(pid int, state *os.ProcessState) *object.Instance {
+	status := &object.Instance{
+		Class_:            ProcessStatusClass,
+		InstanceVariables: make(map[string]object.Object),
+	}
+	status.InstanceVariables["@pid"] = &object.Integer{Value: int64(pid)}
+	status.InstanceVariables["@exitstatus"] = object.NIL
+	status.InstanceVariables["@termsig"] = object.NIL
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		status.InstanceVariables["@termsig"] = &object.Integer{Value: int64(ws.Signal())}
+	} else {
+		status.InstanceVariables["@exitstatus"] = &object.Integer{Value: int64(state.ExitCode())}
+	}
+	return status
+}
+
+// setLastStatus records status as $? and returns it.
+func setLastStatus(status *object.Instance) *object.Instance {
+	globalVariables["$?"] = status
+	return status
+}
+
+// processStatusBits packs a status the way wait(2) does, as Ruby's to_i.
+func processStatusBits(status *object.Instance) int64 {
+	if sig, ok := status.InstanceVariables["@termsig"].(*object.Integer); ok {
+		return sig.Value
+	}
+	if code, ok := status.InstanceVariables["@exitstatus"].(*object.Integer); ok {
+		return code.Value << 8
+	}
+	return 0
+}
+
+func processStatusString(status *object.Instance) string {
+	pid := status.InstanceVariables["@pid"].Inspect()
+	if sig, ok := status.InstanceVariables["@termsig"].(*object.Integer); ok {
+		name := fmt.Sprintf("%d", sig.Value)
+		for n, s := range processSignals {
+			if int64(s) == sig.Value {
+				name = "SIG" + n
+			}
+		}
+		return fmt.Sprintf("pid %s %s (signal %d)", pid, name, sig.Value)
+	}
+	return fmt.Sprintf("pid %s exit %s", pid, status.InstanceVariables["@exitstatus"].Inspect())
+}
+
+// waitChild waits for the child given by args[0], or the oldest spawned
+// child when there is none or it is -1, and sets $?.
+func waitChild(args []object.Object) object.Object {
+	pid := -1
+	if len(args) > 0 {
+		n, ok := args[0].(*object.Integer)
+		if !ok {
+			return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+		}
+		pid = int(n.Value)
+	}
+
+	childrenMutex.Lock()
+	if pid == -1 {
+		pids := make([]int, 0, len(children))
+		for p := range children {
+			pids = append(pids, p)
+		}
+		sort.Ints(pids)
+		if len(pids) > 0 {
+			pid = pids[0]
+		}
+	}
+	cmd, ok := children[pid]
+	delete(children, pid)
+	childrenMutex.Unlock()
+	if !ok {
+		return newError("Errno::ECHILD: No child processes")
+	}
+
+	cmd.Wait()
+	return setLastStatus(newProcessStatus(pid, cmd.ProcessState))
+}
+
+// parseSignal accepts a signal number or a name such as "TERM", "SIGTERM"
+// or :TERM.
+func parseSignal(obj object.Object) (os.Signal, object.Object) {
+	var name string
+	switch s := obj.(type) {
+	case *object.Integer:
+		return syscall.Signal(s.Value), nil
+	case *object.String:
+		name = s.Value
+	case *object.Symbol:
+		name = s.Value
+	default:
+		return nil, newError("ArgumentError: bad signal type %s", obj.Type())
+	}
+	if sig, ok := processSignals[strings.TrimPrefix(name, "SIG")]; ok {
+		return sig, nil
+	}
+	return nil, newError("ArgumentError: unsupported signal 'SIG%s'", strings.TrimPrefix(name, "SIG"))
+}
+
+// buildCommand turns spawn-style arguments into a command: an optional
+// environment Hash, then either a single shell command line or a program
+// and its arguments, then options (chdir:, out:, err:, in:). Output is
+// inherited from the interpreter unless redirected to a file.
+func buildCommand(args []object.Object) (*exec.Cmd, object.Object) {
+	if !subprocessesEnabled {
+		return nil, newError("SecurityError: running external commands is disabled")
+	}
+
+	var extraEnv []string
+	if len(args) > 0 {
+		if hash, ok := args[0].(*object.Hash); ok && !hash.IsKeywordArgs {
+			for _, hk := range hash.Order {
+				pair := hash.Pairs[hk]
+				extraEnv = append(extraEnv, objectToString(pair.Key)+"="+objectToString(pair.Value))
+			}
+			args = args[1:]
+		}
+	}
+	var opts *object.Hash
+	if len(args) > 0 {
+		if hash, ok := args[len(args)-1].(*object.Hash); ok && hash.IsKeywordArgs {
+			opts = hash
+			args = args[:len(args)-1]
+		}
+	}
+	if len(args) == 0 {
+		return nil, newError("wrong number of arguments (given 0, expected 1+)")
+	}
+
+	argv := make([]string, len(args))
+	for i, arg := range args {
+		str, ok := arg.(*object.String)
+		if !ok {
+			return nil, newError("TypeError: no implicit conversion of %s into String", comparisonOperandName(arg))
+		}
+		argv[i] = str.Value
+	}
+
+	var cmd *exec.Cmd
+	if len(argv) == 1 && strings.ContainsAny(argv[0], "*?{}[]<>()~&|\\$;'`\"\n#= ") {
+		cmd = exec.Command("/bin/sh", "-c", argv[0])
+	} else {
+		cmd = exec.Command(argv[0], argv[1:]...)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if extraEnv != nil {
+		cmd.Env = append(os.Environ(), extraEnv...)
+	}
+
+	if opts != nil {
+		for _, hk := range opts.Order {
+			pair := opts.Pairs[hk]
+			key, ok := pair.Key.(*object.Symbol)
+			if !ok {
+				continue
+			}
+			switch key.Value {
+			case "chdir":
+				cmd.Dir = objectToString(pair.Value)
+			case "in":
+				f, err := os.Open(objectToString(pair.Value))
+				if err != nil {
+					return nil, newError("Errno::ENOENT: No such file or directory - %s", objectToString(pair.Value))
+				}
+				cmd.Stdin = f
+			case "out", "err":
+				var w io.Writer
+				// :close leaves the stream unconnected
+				if sym, ok := pair.Value.(*object.Symbol); !ok || sym.Value != "close" {
+					f, err := os.OpenFile(objectToString(pair.Value), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+					if err != nil {
+						return nil, newError("Errno::ENOENT: No such file or directory - %s", objectToString(pair.Value))
+					}
+					w = f
+				}
+				if key.Value == "out" {
+					cmd.Stdout = w
+				} else {
+					cmd.Stderr = w
+				}
+			}
+		}
+	}
+	return cmd, nil
+}
+
+// execCommand implements Kernel#exec: the command runs with the
+// interpreter's standard streams and its exit status ends the interpreter.
+func execCommand(args []object.Object) object.Object {
+	cmd, err := buildCommand(args)
+	if err != nil {
+		return err
+	}
+	if runErr := cmd.Start(); runErr != nil {
+		return newError("Errno::ENOENT: No such file or directory - %s", cmd.Args[0])
+	}
+	cmd.Wait()
+	os.Exit(cmd.ProcessState.ExitCode())
+	return object.NIL
+}
+
+// runBacktick implements `cmd` and %x(cmd): the command's standard output
+// is returned as a String and its status stored in $?.
+func runBacktick(command string) object.Object {
+	cmd, err := buildCommand([]object.Object{&object.String{Value: command}})
+	if err != nil {
+		return err
+	}
+	var out strings.Builder
+	cmd.Stdout = &out
+	if runErr := cmd.Start(); runErr != nil {
+		return newError("Errno::ENOENT: No such file or directory - %s", cmd.Args[0])
+	}
+	cmd.Wait()
+	setLastStatus(newProcessStatus(cmd.Process.Pid, cmd.ProcessState))
+	return &object.String{Value: out.String()}
+}
+
+// runSystem implements Kernel#system: true when the command exits with
+// status 0, false for any other status and nil when it cannot be run. With
+// exception: true failures raise instead.
+func runSystem(args []object.Object) object.Object {
+	raise := false
+	if len(args) > 0 {
+		if opts, ok := args[len(args)-1].(*object.Hash); ok && opts.IsKeywordArgs {
+			if val, ok := hashGet(opts, &object.Symbol{Value: "exception"}); ok {
+				raise = isTruthy(val)
+			}
+		}
+	}
+	cmd, err := buildCommand(args)
+	if err != nil {
+		return err
+	}
+	if runErr := cmd.Start(); runErr != nil {
+		if raise {
+			return newError("Errno::ENOENT: No such file or directory - %s", cmd.Args[0])
+		}
+		return object.NIL
+	}
+	cmd.Wait()
+	setLastStatus(newProcessStatus(cmd.Process.Pid, cmd.ProcessState))
+	if code := cmd.ProcessState.ExitCode(); code != 0 {
+		if raise {
+			return newError("RuntimeError: Command failed with exit %d: %s", code, strings.Join(cmd.Args, " "))
+		}
+		return object.FALSE
+	}
+	return object.TRUE
+}
@@ -0,0 +1,216 @@
+package evaluator
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// profileEntry is what the profiler records for one method.
+type profileEntry struct {
+	label string
+	calls int
+	// self is the time spent in the method itself, total that spent in it
+	// and the methods it called
+	self, total time.Duration
+	// allocs counts the heap allocations made in the method itself
+	allocs uint64
+	// active counts the calls under way, so that the time of a recursive
+	// call is only added to total once
+	active int
+}
+
+// profileKey identifies a method without building its label, so that
+// looking an entry up allocates nothing that would be counted.
+type profileKey struct {
+	owner     object.Object
+	singleton bool
+	name      string
+}
+
+// profileCall is a call the profiler is timing. Calls are kept for reuse,
+// one for each depth of the call stack, along with the function that
+// stops them.
+type profileCall struct {
+	entry *profileEntry
+	start time.Duration
+	stop  func()
+}
+
+// The profiler keeps a clock that leaves out its own bookkeeping. At each
+// call and return, the time and allocations since the one before go to
+// the method that was running.
+var (
+	profiling      bool
+	profileStart   time.Time
+	profileEntries = map[profileKey]*profileEntry{}
+	profileStack   []*profileCall
+	profileCalls   []*profileCall
+	// profileOverhead is the time spent reading the allocation count, and
+	// profileLast and profileAllocs the clock and count when last read
+	profileOverhead time.Duration
+	profileLast     time.Duration
+	profileAllocs   uint64
+)
+
+// StartProfile makes the evaluator time every call of a Ruby method or
+// builtin from now on, and count its allocations, for WriteProfile to
+// report.
+func StartProfile() {
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+	profiling = true
+	profileStart = time.Now()
+	profileAllocs = heapAllocations()
+}
+
+// noProfile is what startProfiledCall returns when not profiling.
+func noProfile() {}
+
+// startProfiledCall starts timing a call of the method name on receiver,
+// defined in definingClass if known, and returns the function that stops
+// it.
+func startProfiledCall(receiver object.Object, name string, definingClass *object.RubyClass) func() {
+	if !profiling {
+		return noProfile
+	}
+	key := methodKey(receiver, name, definingClass)
+	entry := profileEntries[key]
+	if entry == nil {
+		entry = &profileEntry{label: methodLabel(key)}
+		profileEntries[key] = entry
+	}
+	now := profileTick()
+	entry.calls++
+	entry.active++
+
+	depth := len(profileStack)
+	if depth == len(profileCalls) {
+		call := &profileCall{}
+		call.stop = func() { stopProfiledCall(call) }
+		profileCalls = append(profileCalls, call)
+	}
+	call := profileCalls[depth]
+	call.entry = entry
+	call.start = now
+	profileStack = append(profileStack, call)
+	return call.stop
+}
+
+// stopProfiledCall ends call, the innermost call being timed.
+func stopProfiledCall(call *profileCall) {
+	now := profileTick()
+	profileStack = profileStack[:len(profileStack)-1]
+	call.entry.active--
+	if call.entry.active == 0 {
+		call.entry.total += now - call.start
+	}
+}
+
+// profileTick gives the method running, the innermost one being timed,
+// the time and allocations since the last tick, and returns the time on
+// the profiler's clock.
+func profileTick() time.Duration {
+	read := time.Now()
+	allocs := heapAllocations()
+	now := read.Sub(profileStart) - profileOverhead
+	if len(profileStack) > 0 {
+		entry := profileStack[len(profileStack)-1].entry
+		entry.self += now - profileLast
+		entry.allocs += allocs - profileAllocs
+	}
+	profileLast, profileAllocs = now, allocs
+	profileOverhead += time.Since(read)
+	return now
+}
+
+// heapAllocations returns how many heap allocations the program has made
+// so far.
+func heapAllocations() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.Mallocs
+}
+
+// methodKey identifies the method name called on receiver and defined in
+// definingClass, if known.
+func methodKey(receiver object.Object, name string, definingClass *object.RubyClass) profileKey {
+	if definingClass != nil {
+		return profileKey{owner: definingClass, name: name}
+	}
+	switch r := receiver.(type) {
+	case *object.RubyClass:
+		// Methods defined at the top level are called on Object
+		return profileKey{owner: r, singleton: r != object.ObjectClass, name: name}
+	case *object.RubyModule:
+		return profileKey{owner: r, singleton: true, name: name}
+	}
+	if class := receiver.Class(); class != nil {
+		return profileKey{owner: class, name: name}
+	}
+	return profileKey{name: name}
+}
+
+// methodLabel names a method the way Ruby does: Class#method for an
+// instance method and Class.method for a class or module method.
+func methodLabel(key profileKey) string {
+	var owner string
+	switch o := key.owner.(type) {
+	case *object.RubyClass:
+		owner = o.Name
+	case *object.RubyModule:
+		owner = o.Name
+	default:
+		return key.name
+	}
+	if key.singleton {
+		return owner + "." + key.name
+	}
+	return owner + "#" + key.name
+}
+
+// WriteProfile writes the times, calls and allocations recorded since
+// StartProfile to w, as a table with the methods that took the most time
+// of their own first. Allocations are those of the Go heap, made by the
+// method itself and not the methods it called.
+func WriteProfile(w io.Writer) error {
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+	elapsed := time.Since(profileStart) - profileOverhead
+
+	entries := make([]*profileEntry, 0, len(profileEntries))
+	for _, entry := range profileEntries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.self != b.self {
+			return a.self > b.self
+		}
+		return a.label < b.label
+	})
+
+	if _, err := fmt.Fprintf(w, "%7s %10s %10s %8s %10s  %s\n", "%self", "self(ms)", "total(ms)", "calls", "allocs", "method"); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		percent := 0.0
+		if elapsed > 0 {
+			percent = 100 * float64(entry.self) / float64(elapsed)
+		}
+		_, err := fmt.Fprintf(w, "%7.2f %10.3f %10.3f %8d %10d  %s\n", percent, milliseconds(entry.self), milliseconds(entry.total), entry.calls, entry.allocs, entry.label)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "total: %.3fms\n", milliseconds(elapsed))
+	return err
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
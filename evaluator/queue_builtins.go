@@ -0,0 +1,409 @@
+package evaluator
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// QueueClass represents Ruby's Queue, a FIFO safe to share between
+// threads
+var QueueClass = &object.RubyClass{
+	Name:         "Queue",
+	Superclass:   object.ObjectClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// SizedQueueClass represents Ruby's SizedQueue, a Queue whose push blocks
+// while it holds max items
+var SizedQueueClass = &object.RubyClass{
+	Name:         "SizedQueue",
+	Superclass:   QueueClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// ClosedQueueErrorClass is raised by pushing to a closed queue. As a
+// StopIteration it ends a loop that pushes.
+var ClosedQueueErrorClass = defineErrorClass("ClosedQueueError", StopIterationClass)
+
+// queue is the state behind a Queue or SizedQueue. Waiters block on the
+// changed channel, which is closed and replaced whenever items are added
+// or removed or the queue is closed.
+type queue struct {
+	mu      sync.Mutex
+	items   []object.Object
+	max     int // 0 for an unbounded Queue
+	closed  bool
+	waiting int
+	// sleepers counts the waiters on changed, which notify hands back to
+	// liveThreads when it wakes them
+	sleepers int
+	changed  chan struct{}
+}
+
+// liveThreads counts the interpreter threads not blocked on a queue, and
+// the armed timeouts that will interrupt one. When the last one would
+// block, nothing could ever wake it, so the wait fails as a deadlock
+// instead.
+var liveThreads int32 = 1
+
+func init() {
+	QueueClass.ClassMethods["new"] = &object.Builtin{
+		Name: "new",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) > 1 {
+				return newError("wrong number of arguments (given %d, expected 0..1)", len(args))
+			}
+			q := newQueue(0)
+			if len(args) == 1 {
+				items, ok := args[0].(*object.Array)
+				if !ok {
+					return newError("TypeError: can't convert %s into Array", comparisonOperandName(args[0]))
+				}
+				q.items = append(q.items, items.Elements...)
+			}
+			return registerQueue(receiver.(*object.RubyClass), q)
+		},
+	}
+
+	SizedQueueClass.ClassMethods["new"] = &object.Builtin{
+		Name: "new",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			max, err := queueMax(args[0])
+			if err != nil {
+				return err
+			}
+			return registerQueue(receiver.(*object.RubyClass), newQueue(max))
+		},
+	}
+
+	QueueClass.Methods["push"] = &object.Builtin{
+		Name: "push",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			args, timeout, err := queueTimeout(args)
+			if err != nil {
+				return err
+			}
+			if len(args) < 1 || len(args) > 2 {
+				return newError("wrong number of arguments (given %d, expected 1..2)", len(args))
+			}
+			nonBlock := len(args) > 1 && isTruthy(args[1])
+			if result := lookupQueue(receiver).push(args[0], nonBlock, timeout); result != nil {
+				return result
+			}
+			return receiver
+		},
+	}
+	QueueClass.Methods["<<"] = QueueClass.Methods["push"]
+	QueueClass.Methods["enq"] = QueueClass.Methods["push"]
+
+	QueueClass.Methods["pop"] = &object.Builtin{
+		Name: "pop",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			args, timeout, err := queueTimeout(args)
+			if err != nil {
+				return err
+			}
+			if len(args) > 1 {
+				return newError("wrong number of arguments (given %d, expected 0..1)", len(args))
+			}
+			nonBlock := len(args) > 0 && isTruthy(args[0])
+			return lookupQueue(receiver).pop(nonBlock, timeout)
+		},
+	}
+	QueueClass.Methods["shift"] = QueueClass.Methods["pop"]
+	QueueClass.Methods["deq"] = QueueClass.Methods["pop"]
+
+	QueueClass.Methods["close"] = &object.Builtin{
+		Name: "close",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			lookupQueue(receiver).close()
+			return receiver
+		},
+	}
+
+	QueueClass.Methods["closed?"] = &object.Builtin{
+		Name: "closed?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			q := lookupQueue(receiver)
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return object.NativeToBool(q.closed)
+		},
+	}
+
+	QueueClass.Methods["empty?"] = &object.Builtin{
+		Name: "empty?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			q := lookupQueue(receiver)
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return object.NativeToBool(len(q.items) == 0)
+		},
+	}
+
+	QueueClass.Methods["size"] = &object.Builtin{
+		Name: "size",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			q := lookupQueue(receiver)
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return &object.Integer{Value: int64(len(q.items))}
+		},
+	}
+	QueueClass.Methods["length"] = QueueClass.Methods["size"]
+
+	QueueClass.Methods["clear"] = &object.Builtin{
+		Name: "clear",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			q := lookupQueue(receiver)
+			q.mu.Lock()
+			q.items = nil
+			q.notify()
+			q.mu.Unlock()
+			return receiver
+		},
+	}
+
+	QueueClass.Methods["num_waiting"] = &object.Builtin{
+		Name: "num_waiting",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			q := lookupQueue(receiver)
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return &object.Integer{Value: int64(q.waiting)}
+		},
+	}
+
+	SizedQueueClass.Methods["max"] = &object.Builtin{
+		Name: "max",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			q := lookupQueue(receiver)
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return &object.Integer{Value: int64(q.max)}
+		},
+	}
+
+	SizedQueueClass.Methods["max="] = &object.Builtin{
+		Name: "max=",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			max, err := queueMax(args[0])
+			if err != nil {
+				return err
+			}
+			q := lookupQueue(receiver)
+			q.mu.Lock()
+			q.max = max
+			q.notify()
+			q.mu.Unlock()
+			return args[0]
+		},
+	}
+}
+
+func newQueue(max int) *queue {
+	return &queue{max: max, changed: make(chan struct{})}
+}
+
+func registerQueue(class *object.RubyClass, q *queue) *object.Instance {
+	return &object.Instance{
+		Class_:            class,
+		InstanceVariables: make(map[string]object.Object),
+		Data:              q,
+	}
+}
+
+func lookupQueue(obj object.Object) *queue {
+	if inst, ok := obj.(*object.Instance); ok {
+		if q, ok := inst.Data.(*queue); ok {
+			return q
+		}
+	}
+	return newQueue(0)
+}
+
+// queueMax validates a SizedQueue capacity.
+func queueMax(arg object.Object) (int, object.Object) {
+	n, ok := arg.(*object.Integer)
+	if !ok {
+		return 0, newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(arg))
+	}
+	if n.Value <= 0 {
+		return 0, newError("ArgumentError: queue size must be positive")
+	}
+	return int(n.Value), nil
+}
+
+// queueTimeout strips a trailing timeout: keyword from args. A negative
+// duration means no timeout was given.
+func queueTimeout(args []object.Object) ([]object.Object, time.Duration, object.Object) {
+	if len(args) > 0 {
+		if hash, ok := args[len(args)-1].(*object.Hash); ok && hash.IsKeywordArgs {
+			args = args[:len(args)-1]
+			value, _ := hashGet(hash, &object.Symbol{Value: "timeout"})
+			switch v := value.(type) {
+			case nil, *object.Nil:
+			case *object.Integer:
+				return args, time.Duration(v.Value) * time.Second, nil
+			case *object.Float:
+				return args, time.Duration(v.Value * float64(time.Second)), nil
+			default:
+				return nil, 0, newError("TypeError: can't convert %s into time interval", comparisonOperandName(value))
+			}
+		}
+	}
+	return args, -1, nil
+}
+
+// notify wakes every waiter. The caller must hold q.mu.
+func (q *queue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+	// The woken waiters are runnable again
+	atomic.AddInt32(&liveThreads, int32(q.sleepers))
+	q.sleepers = 0
+}
+
+// close stops further pushes and wakes every waiter.
+func (q *queue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.notify()
+	q.mu.Unlock()
+}
+
+// drained reports whether the queue is closed with nothing left to pop.
+func (q *queue) drained() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed && len(q.items) == 0
+}
+
+// wait blocks until the queue changes or the timeout passes, reporting
+// false on timeout, or until the evaluation is interrupted, returning the
+// interrupt. It is entered and left holding q.mu, and lets other ractors
+// run meanwhile.
+func (q *queue) wait(timeout time.Duration) (bool, object.Object) {
+	if timeout == 0 {
+		return false, nil
+	}
+	if atomic.AddInt32(&liveThreads, -1) == 0 && timeout < 0 {
+		atomic.AddInt32(&liveThreads, 1)
+		return false, newError("fatal: No live threads left. Deadlock?")
+	}
+	changed := q.changed
+	q.waiting++
+	q.sleepers++
+	q.mu.Unlock()
+	evaluation := currentRactor
+	resume := releaseInterpreter()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	woken := true
+	for waiting := true; waiting; {
+		interrupted := interruptSignal()
+		if hasInterrupt(evaluation) {
+			break
+		}
+		select {
+		case <-changed:
+			waiting = false
+		case <-expired:
+			woken, waiting = false, false
+		case <-interrupted:
+			// Another evaluation's interrupt wakes this one too; the loop
+			// checks whose it is
+		}
+	}
+
+	resume()
+	q.mu.Lock()
+	q.waiting--
+	if changed == q.changed {
+		// Timed out or interrupted with no notify to count this waiter as
+		// live again
+		q.sleepers--
+		atomic.AddInt32(&liveThreads, 1)
+	}
+	if err := pendingInterrupt(); err != nil {
+		return false, err
+	}
+	return woken, nil
+}
+
+// push appends obj, blocking while a SizedQueue is full unless nonBlock
+// is set. It returns nil on success, or the error or timeout result.
+func (q *queue) push(obj object.Object, nonBlock bool, timeout time.Duration) object.Object {
+	if nonBlock && timeout >= 0 {
+		return newError("ArgumentError: can't set a timeout if non_block is enabled")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.closed {
+			return newError("ClosedQueueError: queue closed")
+		}
+		if q.max == 0 || len(q.items) < q.max {
+			q.items = append(q.items, obj)
+			q.notify()
+			return nil
+		}
+		if nonBlock {
+			return newError("ThreadError: queue full")
+		}
+		woken, err := q.wait(timeout)
+		if err != nil {
+			return err
+		}
+		if !woken {
+			return object.NIL
+		}
+	}
+}
+
+// pop removes the oldest item, blocking while the queue is empty unless
+// nonBlock is set. A closed, empty queue and a timeout both give nil.
+func (q *queue) pop(nonBlock bool, timeout time.Duration) object.Object {
+	if nonBlock && timeout >= 0 {
+		return newError("ArgumentError: can't set a timeout if non_block is enabled")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if len(q.items) > 0 {
+			item := q.items[0]
+			q.items = q.items[1:]
+			q.notify()
+			return item
+		}
+		if nonBlock {
+			return newError("ThreadError: queue empty")
+		}
+		if q.closed {
+			return object.NIL
+		}
+		woken, err := q.wait(timeout)
+		if err != nil {
+			return err
+		}
+		if !woken {
+			return object.NIL
+		}
+	}
+}
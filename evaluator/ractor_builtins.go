@@ -0,0 +1,321 @@
+package evaluator
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// RactorClass represents Ruby's Ractor. Each ractor runs its block on its
+// own goroutine against a fresh top-level environment and exchanges
+// deep-copied messages with the others.
+var RactorClass = &object.RubyClass{
+	Name:         "Ractor",
+	Superclass:   object.ObjectClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// ractor is the state behind a Ractor object. Messages sent to it wait in
+// inbox; values it yields wait in outbox until taken, one at a time.
+type ractor struct {
+	id     int
+	name   object.Object
+	inbox  *queue
+	outbox *queue
+	done   bool
+	err    *object.Error // what the block raised, if it failed
+}
+
+var (
+	ractorsMutex sync.Mutex
+	lastRactorID int
+	mainRactor   *object.Instance
+)
+
+// Ractors take turns rather than running in parallel: whichever goroutine
+// holds interpreterLock evaluates, and hands it over only while blocked on
+// a message.
+var (
+	runningRactors int32
+	currentRactor  *object.Instance
+)
+
+func init() {
+	ractorError := defineErrorClass("Ractor::Error", object.StandardErrorClass)
+	RactorClass.Constants = map[string]object.Object{
+		"Error":       ractorError,
+		"RemoteError": defineErrorClass("Ractor::RemoteError", ractorError),
+		"ClosedError": defineErrorClass("Ractor::ClosedError", StopIterationClass),
+	}
+
+	// Ractor.new(*args, name: nil) { |*args| ... }
+	RactorClass.ClassMethods["new"] = &object.Builtin{
+		Name: "new",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			block := env.Block()
+			if block == nil {
+				return newError("ArgumentError: must be called with a block")
+			}
+			var name object.Object = object.NIL
+			if len(args) > 0 {
+				if hash, ok := args[len(args)-1].(*object.Hash); ok && hash.IsKeywordArgs {
+					args = args[:len(args)-1]
+					if n, ok := hashGet(hash, &object.Symbol{Value: "name"}); ok && n != object.NIL {
+						str, ok := n.(*object.String)
+						if !ok {
+							return newError("TypeError: no implicit conversion of %s into String", comparisonOperandName(n))
+						}
+						name = &object.String{Value: str.Value}
+					}
+				}
+			}
+			copied := make([]object.Object, len(args))
+			for i, arg := range args {
+				copied[i] = ractorCopy(arg, make(map[object.Object]object.Object))
+			}
+			instance, r := newRactor(name)
+			startRactor(instance, r, block, copied)
+			return instance
+		},
+	}
+
+	RactorClass.ClassMethods["current"] = &object.Builtin{
+		Name: "current",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return thisRactor()
+		},
+	}
+
+	RactorClass.ClassMethods["main"] = &object.Builtin{
+		Name: "main",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			thisRactor()
+			return mainRactor
+		},
+	}
+
+	RactorClass.ClassMethods["count"] = &object.Builtin{
+		Name: "count",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: int64(1 + atomic.LoadInt32(&runningRactors))}
+		},
+	}
+
+	// Ractor.receive waits for a message sent to the current ractor
+	RactorClass.ClassMethods["receive"] = &object.Builtin{
+		Name: "receive",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return lookupRactor(thisRactor()).inbox.pop(false, -1)
+		},
+	}
+	RactorClass.ClassMethods["recv"] = RactorClass.ClassMethods["receive"]
+
+	// Ractor.yield(obj) waits until another ractor takes obj
+	RactorClass.ClassMethods["yield"] = &object.Builtin{
+		Name: "yield",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			msg := ractorCopy(args[0], make(map[object.Object]object.Object))
+			if err := lookupRactor(thisRactor()).outbox.push(msg, false, -1); err != nil {
+				return err
+			}
+			return object.NIL
+		},
+	}
+
+	RactorClass.Methods["send"] = &object.Builtin{
+		Name: "send",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			msg := ractorCopy(args[0], make(map[object.Object]object.Object))
+			if err := lookupRactor(receiver).inbox.push(msg, false, -1); err != nil {
+				return newError("Ractor::ClosedError: The incoming-port is already closed")
+			}
+			return receiver
+		},
+	}
+	RactorClass.Methods["<<"] = RactorClass.Methods["send"]
+
+	// take returns the next value the ractor yields, and finally the value
+	// of its block
+	RactorClass.Methods["take"] = &object.Builtin{
+		Name: "take",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			r := lookupRactor(receiver)
+			msg := r.outbox.pop(false, -1)
+			if msg == object.NIL && r.outbox.drained() {
+				return newError("Ractor::ClosedError: The outgoing-port is already closed")
+			}
+			if err, ok := msg.(*object.Error); ok {
+				if err == r.err {
+					return newError("Ractor::RemoteError: thrown by remote Ractor: %s", err.Message)
+				}
+				return err
+			}
+			return msg
+		},
+	}
+
+	RactorClass.Methods["name"] = &object.Builtin{
+		Name: "name",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return lookupRactor(receiver).name
+		},
+	}
+
+	RactorClass.Methods["inspect"] = &object.Builtin{
+		Name: "inspect",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			r := lookupRactor(receiver)
+			desc := fmt.Sprintf("#<Ractor:#%d", r.id)
+			if r.name != object.NIL {
+				desc += " " + objectToString(r.name)
+			}
+			if r.done {
+				return &object.String{Value: desc + " terminated>"}
+			}
+			return &object.String{Value: desc + " running>"}
+		},
+	}
+	RactorClass.Methods["to_s"] = RactorClass.Methods["inspect"]
+}
+
+func newRactor(name object.Object) (*object.Instance, *ractor) {
+	ractorsMutex.Lock()
+	defer ractorsMutex.Unlock()
+	lastRactorID++
+	r := &ractor{id: lastRactorID, name: name, inbox: newQueue(0), outbox: newQueue(1)}
+	instance := &object.Instance{
+		Class_:            RactorClass,
+		InstanceVariables: make(map[string]object.Object),
+		Data:              r,
+	}
+	return instance, r
+}
+
+func lookupRactor(obj object.Object) *ractor {
+	if inst, ok := obj.(*object.Instance); ok {
+		if r, ok := inst.Data.(*ractor); ok {
+			return r
+		}
+	}
+	return &ractor{name: object.NIL, inbox: newQueue(0), outbox: newQueue(1)}
+}
+
+// thisRactor returns the ractor evaluating the caller, creating the main
+// ractor's object the first time it is asked for.
+func thisRactor() *object.Instance {
+	if currentRactor != nil {
+		return currentRactor
+	}
+	if mainRactor == nil {
+		mainRactor, _ = newRactor(object.NIL)
+	}
+	return mainRactor
+}
+
+// startRactor runs block with args on a new goroutine, isolated from the
+// caller's local variables.
+func startRactor(instance *object.Instance, r *ractor, block *object.Proc, args []object.Object) {
+	thisRactor()
+	atomic.AddInt32(&liveThreads, 1)
+	atomic.AddInt32(&runningRactors, 1)
+	file := currentFile
+
+	go func() {
+		interpreterLock.Lock()
+		callStack = []*callFrame{{label: "block in <main>", file: file}}
+		currentFile = file
+		currentRactor = instance
+
+		env := object.NewEnvironment()
+		env.SetSelf(object.ObjectClass)
+		isolated := &object.Proc{Parameters: block.Parameters, Body: block.Body, Env: env}
+		result := callBlock(isolated, args, env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			result = bv.Value
+		}
+
+		r.inbox.close()
+		if err, ok := result.(*object.Error); ok {
+			r.err = err
+			r.outbox.push(err, false, -1)
+		} else {
+			r.outbox.push(ractorCopy(result, make(map[object.Object]object.Object)), false, -1)
+		}
+		r.outbox.close()
+		r.done = true
+
+		atomic.AddInt32(&runningRactors, -1)
+		atomic.AddInt32(&liveThreads, -1)
+		interpreterLock.Unlock()
+	}()
+}
+
+// releaseInterpreter lets another ractor evaluate while the caller blocks,
+// returning the function that waits for the interpreter back and restores
+// the caller's state.
+func releaseInterpreter() func() {
+	stack, file, self := callStack, currentFile, currentRactor
+	interpreterLock.Unlock()
+	return func() {
+		interpreterLock.Lock()
+		callStack, currentFile, currentRactor = stack, file, self
+	}
+}
+
+// ractorCopy deep-copies a message so the receiving ractor shares no
+// mutable objects with the sender. Immutable values, classes and modules
+// are passed as they are; seen preserves shared and cyclic references.
+func ractorCopy(obj object.Object, seen map[object.Object]object.Object) object.Object {
+	if copied, ok := seen[obj]; ok {
+		return copied
+	}
+	switch o := obj.(type) {
+	case *object.String:
+		copied := &object.String{Value: o.Value}
+		seen[obj] = copied
+		return copied
+	case *object.Array:
+		copied := &object.Array{Elements: make([]object.Object, len(o.Elements))}
+		seen[obj] = copied
+		for i, el := range o.Elements {
+			copied.Elements[i] = ractorCopy(el, seen)
+		}
+		return copied
+	case *object.Hash:
+		copied := newHash()
+		copied.CompareByIdentity = o.CompareByIdentity
+		seen[obj] = copied
+		for _, key := range o.Order {
+			pair := o.Pairs[key]
+			hashSet(copied, ractorCopy(pair.Key, seen), ractorCopy(pair.Value, seen))
+		}
+		if o.Default != nil {
+			copied.Default = ractorCopy(o.Default, seen)
+		}
+		return copied
+	case *object.Instance:
+		if o.Class_ == RactorClass {
+			return o
+		}
+		copied := &object.Instance{
+			Class_:            o.Class_,
+			InstanceVariables: make(map[string]object.Object, len(o.InstanceVariables)),
+			SingletonMethods:  o.SingletonMethods,
+		}
+		seen[obj] = copied
+		for name, value := range o.InstanceVariables {
+			copied.InstanceVariables[name] = ractorCopy(value, seen)
+		}
+		return copied
+	}
+	return obj
+}
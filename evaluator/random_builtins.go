@@ -0,0 +1,186 @@
+package evaluator
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// RandomClass represents Ruby's Random class
+var RandomClass = &object.RubyClass{
+	Name:         "Random",
+	Superclass:   object.ObjectClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// randomSource is the generator behind a Random instance
+type randomSource struct {
+	rng  *rand.Rand
+	seed int64
+}
+
+var (
+	randomMutex  sync.Mutex
+	globalRandom = newRandomSource(time.Now().UnixNano())
+)
+
+func init() {
+	initRandomMethods()
+}
+
+func newRandomSource(seed int64) *randomSource {
+	return &randomSource{rng: rand.New(rand.NewSource(seed)), seed: seed}
+}
+
+func initRandomMethods() {
+	RandomClass.ClassMethods["new"] = &object.Builtin{
+		Name: "new",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			seed := time.Now().UnixNano()
+			if len(args) > 0 {
+				n, ok := args[0].(*object.Integer)
+				if !ok {
+					return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+				}
+				seed = n.Value
+			}
+			return &object.Instance{
+				Class_:            RandomClass,
+				InstanceVariables: make(map[string]object.Object),
+				Data:              newRandomSource(seed),
+			}
+		},
+	}
+
+	RandomClass.ClassMethods["rand"] = &object.Builtin{
+		Name: "rand",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return randomValue(globalRandom, args)
+		},
+	}
+
+	RandomClass.ClassMethods["srand"] = &object.Builtin{
+		Name: "srand",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return reseedGlobalRandom(args)
+		},
+	}
+
+	RandomClass.ClassMethods["new_seed"] = &object.Builtin{
+		Name: "new_seed",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: time.Now().UnixNano()}
+		},
+	}
+
+	RandomClass.Methods["rand"] = &object.Builtin{
+		Name: "rand",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return randomValue(lookupRandomSource(receiver), args)
+		},
+	}
+
+	RandomClass.Methods["seed"] = &object.Builtin{
+		Name: "seed",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: lookupRandomSource(receiver).seed}
+		},
+	}
+}
+
+// lookupRandomSource returns the generator for a Random instance, falling
+// back to the global generator for anything else.
+func lookupRandomSource(obj object.Object) *randomSource {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	if inst, ok := obj.(*object.Instance); ok {
+		if src, ok := inst.Data.(*randomSource); ok {
+			return src
+		}
+	}
+	return globalRandom
+}
+
+// reseedGlobalRandom implements Kernel#srand, returning the previous seed.
+func reseedGlobalRandom(args []object.Object) object.Object {
+	seed := time.Now().UnixNano()
+	if len(args) > 0 {
+		n, ok := args[0].(*object.Integer)
+		if !ok {
+			return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+		}
+		seed = n.Value
+	}
+	randomMutex.Lock()
+	previous := globalRandom.seed
+	globalRandom = newRandomSource(seed)
+	randomMutex.Unlock()
+	return &object.Integer{Value: previous}
+}
+
+// randomValue implements rand: no argument (or 0) yields a Float in [0, 1),
+// an Integer or Float yields a number below it and a Range a member of it.
+func randomValue(src *randomSource, args []object.Object) object.Object {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+
+	if len(args) == 0 {
+		return &object.Float{Value: src.rng.Float64()}
+	}
+
+	switch max := args[0].(type) {
+	case *object.Nil:
+		return &object.Float{Value: src.rng.Float64()}
+	case *object.Integer:
+		if max.Value == 0 {
+			return &object.Float{Value: src.rng.Float64()}
+		}
+		n := max.Value
+		if n < 0 {
+			n = -n
+		}
+		return &object.Integer{Value: src.rng.Int63n(n)}
+	case *object.Float:
+		return &object.Float{Value: src.rng.Float64() * max.Value}
+	case *object.Range:
+		start, ok1 := max.Start.(*object.Integer)
+		end, ok2 := max.End.(*object.Integer)
+		if !ok1 || !ok2 {
+			return newError("ArgumentError: invalid argument - %s", max.Inspect())
+		}
+		span := end.Value - start.Value
+		if !max.Exclusive {
+			span++
+		}
+		if span <= 0 {
+			return object.NIL
+		}
+		return &object.Integer{Value: start.Value + src.rng.Int63n(span)}
+	}
+	return newError("ArgumentError: invalid argument - %s", args[0].Inspect())
+}
+
+// randomOption extracts the random: keyword argument accepted by
+// Array#shuffle and Array#sample, returning the remaining arguments.
+func randomOption(args []object.Object) (*randomSource, []object.Object) {
+	if len(args) > 0 {
+		if hash, ok := args[len(args)-1].(*object.Hash); ok && hash.IsKeywordArgs {
+			if rng, ok := hashGet(hash, &object.Symbol{Value: "random"}); ok {
+				return lookupRandomSource(rng), args[:len(args)-1]
+			}
+		}
+	}
+	return globalRandom, args
+}
+
+// shuffleObjects shuffles elements in place using src.
+func shuffleObjects(src *randomSource, elements []object.Object) {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	src.rng.Shuffle(len(elements), func(i, j int) {
+		elements[i], elements[j] = elements[j], elements[i]
+	})
+}
@@ -12,72 +12,163 @@ import (
 )
 
 var (
-	loadedFiles      = make(map[string]bool)
 	loadedFilesMutex sync.Mutex
-	loadPath         = []string{"."}
 	currentFile      = ""
+	// scriptFile is the absolute path of the script being run and
+	// scriptName the path it was given as
+	scriptFile, scriptName string
 )
 
+// loadedFeatures backs $LOADED_FEATURES and $", the files require has
+// loaded. A feature removed from it will be loaded again by the next
+// require.
+var loadedFeatures = &object.Array{Elements: []object.Object{}}
+
+// loadingFeatures holds the files whose require is still running, so a
+// circular require is caught instead of recursing forever.
+var loadingFeatures = make(map[string]bool)
+
+// loadPath backs $LOAD_PATH and $:, the directories require searches in
+// order. Scripts may modify it in place.
+var loadPath = &object.Array{Elements: []object.Object{}}
+
+// builtinFeatures are libraries implemented natively; requiring them only
+// records the feature.
+var builtinFeatures = map[string]bool{
+	"csv":      true,
+	"date":     true,
+	"json":     true,
+	"open3":    true,
+	"ostruct":  true,
+	"psych":    true,
+	"stringio": true,
+	"time":     true,
+	"timeout":  true,
+	"yaml":     true,
+}
+
+func init() {
+	globalVariables["$LOAD_PATH"] = loadPath
+	globalVariables["$:"] = loadPath
+	globalVariables["$-I"] = loadPath
+	globalVariables["$LOADED_FEATURES"] = loadedFeatures
+	globalVariables["$\""] = loadedFeatures
+}
+
 // SetLoadPath sets the load path for require
 func SetLoadPath(paths []string) {
-	loadPath = paths
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+	setLoadPath(paths)
+}
+
+func setLoadPath(paths []string) {
+	elements := make([]object.Object, len(paths))
+	for i, path := range paths {
+		elements[i] = &object.String{Value: path}
+	}
+	loadPath.Elements = elements
 }
 
 // AddToLoadPath adds a path to the load path
 func AddToLoadPath(path string) {
-	loadPath = append(loadPath, path)
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+	addToLoadPath(path)
+}
+
+func addToLoadPath(path string) {
+	loadPath.Elements = append(loadPath.Elements, &object.String{Value: path})
+}
+
+// InitLoadPath seeds the load path with the given directories (from -I
+// flags, made absolute) followed by those listed in the RUBYGOLIB
+// environment variable.
+func InitLoadPath(includes []string) {
+	var paths []string
+	for _, dir := range includes {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		paths = append(paths, dir)
+	}
+	for _, dir := range filepath.SplitList(os.Getenv("RUBYGOLIB")) {
+		if dir != "" {
+			paths = append(paths, dir)
+		}
+	}
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+	setLoadPath(paths)
 }
 
 // SetCurrentFile sets the current file being executed
 func SetCurrentFile(path string) {
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
 	currentFile = path
 }
 
+// SetScriptName records name as the path the current file, the script
+// being run, was given as. Warnings name the script that way, the path in
+// currentFile being made absolute for require_relative.
+func SetScriptName(name string) {
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+	scriptFile, scriptName = currentFile, name
+}
+
+// displayPath returns path as warnings name it: the path given for the
+// script being run, and path itself for any other file.
+func displayPath(path string) string {
+	if path != "" && path == scriptFile {
+		return scriptName
+	}
+	return path
+}
+
 // GetCurrentFile returns the current file being executed
 func GetCurrentFile() string {
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
 	return currentFile
 }
 
 // RequireFile loads and evaluates a Ruby file
 func RequireFile(filename string, env *object.Environment) object.Object {
-	loadedFilesMutex.Lock()
-	defer loadedFilesMutex.Unlock()
+	if builtinFeatures[filename] {
+		return requireFeature(filename+".rb", nil, env)
+	}
 
 	// Add .rb extension if not present
+	feature := filename
 	if !strings.HasSuffix(filename, ".rb") {
 		filename = filename + ".rb"
 	}
 
-	// Find the file in load path
-	fullPath, err := findFile(filename)
-	if err != nil {
-		return newError("cannot load such file -- %s", filename)
+	// Find the file in the manifest, then in the load path
+	fullPath, ok := manifestEntries[feature]
+	if ok {
+		if _, err := os.Stat(fullPath); err != nil {
+			return newError("LoadError: cannot load such file -- %s", fullPath)
+		}
+	} else {
+		var err error
+		fullPath, err = findFile(filename)
+		if err != nil {
+			return newError("LoadError: cannot load such file -- %s", feature)
+		}
 	}
 
-	// Check if already loaded
 	absPath, err := filepath.Abs(fullPath)
 	if err != nil {
 		absPath = fullPath
 	}
-	if loadedFiles[absPath] {
-		return object.FALSE
-	}
-
-	// Load and evaluate
-	result := loadAndEval(fullPath, env)
-	if isError(result) {
-		return result
-	}
-
-	loadedFiles[absPath] = true
-	return object.TRUE
+	return requireFeature(absPath, func() object.Object { return loadAndEval(fullPath, env) }, env)
 }
 
 // RequireRelativeFile loads a file relative to the current file
 func RequireRelativeFile(filename string, env *object.Environment) object.Object {
-	loadedFilesMutex.Lock()
-	defer loadedFilesMutex.Unlock()
-
 	// Add .rb extension if not present
 	if !strings.HasSuffix(filename, ".rb") {
 		filename = filename + ".rb"
@@ -94,28 +185,67 @@ func RequireRelativeFile(filename string, env *object.Environment) object.Object
 
 	// Check if file exists
 	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		return newError("cannot load such file -- %s", filename)
+		return newError("LoadError: cannot load such file -- %s", fullPath)
 	}
 
-	// Check if already loaded
 	absPath, err := filepath.Abs(fullPath)
 	if err != nil {
 		absPath = fullPath
 	}
-	if loadedFiles[absPath] {
+	return requireFeature(absPath, func() object.Object { return loadAndEval(fullPath, env) }, env)
+}
+
+// requireFeature runs load unless feature is already in $LOADED_FEATURES
+// or is still being loaded further up the stack, and records it once load
+// succeeds. A nil load marks a builtin library. It returns true if the
+// feature was loaded by this call.
+func requireFeature(feature string, load func() object.Object, env *object.Environment) object.Object {
+	loadedFilesMutex.Lock()
+	if featureLoaded(feature) {
+		loadedFilesMutex.Unlock()
 		return object.FALSE
 	}
-
-	// Load and evaluate
-	result := loadAndEval(fullPath, env)
-	if isError(result) {
-		return result
+	if loadingFeatures[feature] {
+		loadedFilesMutex.Unlock()
+		// Ruby only reports this in verbose mode
+		if verbose() {
+			if err := emitWarning("warning: loading in progress, circular require considered harmful - "+feature+"\n", "", env); err != nil {
+				return err
+			}
+		}
+		return object.FALSE
+	}
+	loadingFeatures[feature] = true
+	loadedFilesMutex.Unlock()
+
+	defer func() {
+		loadedFilesMutex.Lock()
+		delete(loadingFeatures, feature)
+		loadedFilesMutex.Unlock()
+	}()
+
+	if load != nil {
+		if result := load(); isError(result) {
+			return result
+		}
 	}
 
-	loadedFiles[absPath] = true
+	loadedFilesMutex.Lock()
+	loadedFeatures.Elements = append(loadedFeatures.Elements, &object.String{Value: feature})
+	loadedFilesMutex.Unlock()
 	return object.TRUE
 }
 
+// featureLoaded reports whether feature is listed in $LOADED_FEATURES.
+func featureLoaded(feature string) bool {
+	for _, el := range loadedFeatures.Elements {
+		if objectToString(el) == feature {
+			return true
+		}
+	}
+	return false
+}
+
 // LoadFile loads and evaluates a file (always reloads, unlike require)
 func LoadFile(filename string, env *object.Environment) object.Object {
 	// Add .rb extension if not present
@@ -141,14 +271,14 @@ func findFile(filename string) (string, error) {
 	}
 
 	// Search in load path
-	for _, path := range loadPath {
-		fullPath := filepath.Join(path, filename)
+	for _, dir := range loadPath.Elements {
+		fullPath := filepath.Join(objectToString(dir), filename)
 		if _, err := os.Stat(fullPath); err == nil {
 			return fullPath, nil
 		}
 	}
 
-	// Try current directory
+	// Fall back to the current directory
 	if _, err := os.Stat(filename); err == nil {
 		return filename, nil
 	}
@@ -173,10 +303,11 @@ func loadAndEval(filename string, env *object.Environment) object.Object {
 	program := p.ParseProgram()
 
 	if len(p.Errors()) > 0 {
-		return newError("parse error in %s: %s", filename, p.Errors()[0])
+		err := p.SyntaxErrors()[0]
+		return newError("parse error in %s:%s: %s", filename, err.Pos, err.Msg)
 	}
 
-	return Eval(program, env)
+	return evalProgram(program, env)
 }
 
 func init() {
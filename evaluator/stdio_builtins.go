@@ -0,0 +1,157 @@
+package evaluator
+
+import (
+	"os"
+	"strings"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// The standard streams, also bound to STDIN, STDOUT and STDERR. The $stdin,
+// $stdout and $stderr globals start out pointing at them but may be
+// reassigned to any object with the right methods.
+var (
+	stdinIO  = newIO(os.Stdin, "<STDIN>")
+	stdoutIO = newIO(os.Stdout, "<STDOUT>")
+	stderrIO = newIO(os.Stderr, "<STDERR>")
+)
+
+func init() {
+	lookupFileHandle(stderrIO).sync = true
+
+	globalVariables["$stdin"] = stdinIO
+	globalVariables["$stdout"] = stdoutIO
+	globalVariables["$stderr"] = stderrIO
+
+	object.IOClass.Methods["sync"] = &object.Builtin{
+		Name: "sync",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			return object.NativeToBool(handle.sync)
+		},
+	}
+
+	// Writes go straight to the file descriptor, so sync only records the
+	// setting for scripts that read it back.
+	object.IOClass.Methods["sync="] = &object.Builtin{
+		Name: "sync=",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			handle.sync = isTruthy(args[0])
+			return args[0]
+		},
+	}
+
+	object.IOClass.Methods["fileno"] = &object.Builtin{
+		Name: "fileno",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			return &object.Integer{Value: int64(handle.file.Fd())}
+		},
+	}
+	object.IOClass.Methods["to_i"] = object.IOClass.Methods["fileno"]
+
+	object.IOClass.Methods["tty?"] = &object.Builtin{
+		Name: "tty?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			handle, err := openHandle(receiver)
+			if err != nil {
+				return err
+			}
+			info, statErr := handle.file.Stat()
+			return object.NativeToBool(statErr == nil && info.Mode()&os.ModeCharDevice != 0)
+		},
+	}
+	object.IOClass.Methods["isatty"] = object.IOClass.Methods["tty?"]
+}
+
+// putsText formats arguments the way puts prints them: each on its own
+// line, adding a newline only where one is missing. An array is printed
+// as its elements, nested arrays included.
+func putsText(args []object.Object) (string, *object.Error) {
+	if len(args) == 0 {
+		return "\n", nil
+	}
+	var sb strings.Builder
+	for _, arg := range args {
+		if arr, ok := arg.(*object.Array); ok {
+			text, err := putsText(arr.Elements)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(text)
+			continue
+		}
+		str, err := convertToString(arg)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(str)
+		if !strings.HasSuffix(str, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String(), nil
+}
+
+// writeStdout writes text to $stdout.
+func writeStdout(text string) object.Object {
+	return writeStream("$stdout", text)
+}
+
+// writeStderr writes text to $stderr.
+func writeStderr(text string) object.Object {
+	return writeStream("$stderr", text)
+}
+
+// writeStream writes text to the object held in the named global by
+// calling its write method, short-circuiting for plain IO objects.
+func writeStream(global, text string) object.Object {
+	out := globalVariables[global]
+	inst, ok := out.(*object.Instance)
+	if !ok {
+		return newError("NoMethodError: undefined method `write' for %s", comparisonOperandName(out))
+	}
+	if inst.Class_ == object.IOClass || inst.Class_ == FileClass {
+		handle, err := openHandle(inst)
+		if err != nil {
+			return err
+		}
+		if _, writeErr := handle.file.WriteString(text); writeErr != nil {
+			return newError("IOError: not opened for writing")
+		}
+		return nil
+	}
+	result, ok := callInstanceMethod(inst, "write", &object.String{Value: text})
+	if !ok {
+		return newError("NoMethodError: undefined method `write' for %s", inspectObject(inst))
+	}
+	if isError(result) {
+		return result
+	}
+	return nil
+}
+
+// checkStreamAssignment validates a new value for $stdout or $stderr,
+// which must respond to write.
+func checkStreamAssignment(global string, val object.Object) object.Object {
+	if global != "$stdout" && global != "$stderr" {
+		return nil
+	}
+	if inst, ok := val.(*object.Instance); ok && instanceResponds(inst, "write") {
+		return nil
+	}
+	return newError("TypeError: %s must have write method, %s given", global, val.Class().Name)
+}
@@ -0,0 +1,517 @@
+package evaluator
+
+import (
+	"io"
+	"strings"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// StringIOClass represents Ruby's StringIO, an in-memory stream over a
+// String
+var StringIOClass = &object.RubyClass{
+	Name:         "StringIO",
+	Superclass:   object.ObjectClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// stringIO is the state behind a StringIO: the String it reads and writes,
+// shared with the caller, and the current position in it.
+type stringIO struct {
+	buf    *object.String
+	pos    int
+	lineno int64
+	closed bool
+}
+
+// ReadByte and Peek let scanRecord read lines from a StringIO.
+func (s *stringIO) ReadByte() (byte, error) {
+	if s.pos >= len(s.buf.Value) {
+		return 0, io.EOF
+	}
+	s.pos++
+	return s.buf.Value[s.pos-1], nil
+}
+
+func (s *stringIO) Peek(n int) ([]byte, error) {
+	if s.pos+n > len(s.buf.Value) {
+		return []byte(s.buf.Value[min(s.pos, len(s.buf.Value)):]), io.EOF
+	}
+	return []byte(s.buf.Value[s.pos : s.pos+n]), nil
+}
+
+// write stores text at the current position, overwriting what is there
+// and padding with NULs if the position is past the end.
+func (s *stringIO) write(text string) {
+	value := s.buf.Value
+	if s.pos > len(value) {
+		value += strings.Repeat("\x00", s.pos-len(value))
+	}
+	end := s.pos + len(text)
+	if end < len(value) {
+		value = value[:s.pos] + text + value[end:]
+	} else {
+		value = value[:s.pos] + text
+	}
+	s.buf.Value = value
+	s.pos = end
+}
+
+// newStringIO returns a StringIO reading buf from the start.
+func newStringIO(buf *object.String) *object.Instance {
+	return registerStringIO(StringIOClass, &stringIO{buf: buf})
+}
+
+// registerStringIO makes an instance of class backed by state.
+func registerStringIO(class *object.RubyClass, state *stringIO) *object.Instance {
+	return &object.Instance{
+		Class_:            class,
+		InstanceVariables: make(map[string]object.Object),
+		Data:              state,
+	}
+}
+
+func init() {
+	StringIOClass.ClassMethods["new"] = &object.Builtin{
+		Name: "new",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			buf := &object.String{Value: ""}
+			if len(args) > 0 {
+				str, ok := args[0].(*object.String)
+				if !ok {
+					return newError("TypeError: no implicit conversion of %s into String", comparisonOperandName(args[0]))
+				}
+				buf = str
+			}
+			state := &stringIO{buf: buf}
+			if len(args) > 1 {
+				if mode, ok := args[1].(*object.String); ok {
+					switch {
+					case strings.HasPrefix(mode.Value, "w"):
+						if buf.Frozen {
+							return newError("IOError: not opened for writing")
+						}
+						buf.Value = ""
+					case strings.HasPrefix(mode.Value, "a"):
+						state.pos = len(buf.Value)
+					}
+				}
+			}
+			return registerStringIO(receiver.(*object.RubyClass), state)
+		},
+	}
+
+	StringIOClass.Methods["string"] = &object.Builtin{
+		Name: "string",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return lookupStringIO(receiver).buf
+		},
+	}
+
+	StringIOClass.Methods["string="] = &object.Builtin{
+		Name: "string=",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			str, ok := args[0].(*object.String)
+			if !ok {
+				return newError("TypeError: no implicit conversion of %s into String", comparisonOperandName(args[0]))
+			}
+			state := lookupStringIO(receiver)
+			state.buf, state.pos, state.lineno = str, 0, 0
+			return str
+		},
+	}
+
+	StringIOClass.Methods["write"] = &object.Builtin{
+		Name: "write",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			state, err := writableStringIO(receiver)
+			if err != nil {
+				return err
+			}
+			written := 0
+			for _, arg := range args {
+				text := objectToString(arg)
+				state.write(text)
+				written += len(text)
+			}
+			return &object.Integer{Value: int64(written)}
+		},
+	}
+	StringIOClass.Methods["syswrite"] = StringIOClass.Methods["write"]
+
+	StringIOClass.Methods["print"] = &object.Builtin{
+		Name: "print",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if result := StringIOClass.Methods["write"].(*object.Builtin).Fn(receiver, env, args...); isError(result) {
+				return result
+			}
+			return object.NIL
+		},
+	}
+
+	StringIOClass.Methods["puts"] = &object.Builtin{
+		Name: "puts",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			text, err := putsText(args)
+			if err != nil {
+				return err
+			}
+			return StringIOClass.Methods["print"].(*object.Builtin).Fn(receiver, env, &object.String{Value: text})
+		},
+	}
+
+	StringIOClass.Methods["<<"] = &object.Builtin{
+		Name: "<<",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if result := StringIOClass.Methods["write"].(*object.Builtin).Fn(receiver, env, args...); isError(result) {
+				return result
+			}
+			return receiver
+		},
+	}
+
+	StringIOClass.Methods["read"] = &object.Builtin{
+		Name: "read",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			state, err := openStringIO(receiver)
+			if err != nil {
+				return err
+			}
+			start := min(state.pos, len(state.buf.Value))
+			if len(args) > 0 && args[0] != object.NIL {
+				n, ok := args[0].(*object.Integer)
+				if !ok {
+					return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+				}
+				if n.Value < 0 {
+					return newError("ArgumentError: negative length %d given", n.Value)
+				}
+				if start >= len(state.buf.Value) && n.Value > 0 {
+					return object.NIL
+				}
+				end := min(start+int(n.Value), len(state.buf.Value))
+				state.pos = end
+				return &object.String{Value: state.buf.Value[start:end]}
+			}
+			state.pos = len(state.buf.Value)
+			return &object.String{Value: state.buf.Value[start:]}
+		},
+	}
+
+	StringIOClass.Methods["gets"] = &object.Builtin{
+		Name: "gets",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			state, err := openStringIO(receiver)
+			if err != nil {
+				return err
+			}
+			format, err := parseRecordArgs(args)
+			if err != nil {
+				return err
+			}
+			var result object.Object = object.NIL
+			if line, ok := scanRecord(state, format); ok {
+				state.lineno++
+				result = &object.String{Value: line}
+			}
+			setLastLine(result, state.lineno)
+			return result
+		},
+	}
+
+	StringIOClass.Methods["readline"] = &object.Builtin{
+		Name: "readline",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			line := StringIOClass.Methods["gets"].(*object.Builtin).Fn(receiver, env, args...)
+			if line == object.NIL {
+				return newError("EOFError: end of file reached")
+			}
+			return line
+		},
+	}
+
+	StringIOClass.Methods["each_line"] = &object.Builtin{
+		Name: "each_line",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			state, err := openStringIO(receiver)
+			if err != nil {
+				return err
+			}
+			format, err := parseRecordArgs(args)
+			if err != nil {
+				return err
+			}
+			block := env.Block()
+			if block == nil {
+				return newEnumerator(receiver, "each_line", args)
+			}
+			for {
+				line, ok := scanRecord(state, format)
+				if !ok {
+					return receiver
+				}
+				state.lineno++
+				result := callBlock(block, []object.Object{&object.String{Value: line}}, env)
+				if _, ok := result.(*object.BreakValue); ok {
+					return result
+				}
+				if isError(result) {
+					return result
+				}
+			}
+		},
+	}
+	StringIOClass.Methods["each"] = StringIOClass.Methods["each_line"]
+
+	StringIOClass.Methods["readlines"] = &object.Builtin{
+		Name: "readlines",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			state, err := openStringIO(receiver)
+			if err != nil {
+				return err
+			}
+			format, err := parseRecordArgs(args)
+			if err != nil {
+				return err
+			}
+			lines := []object.Object{}
+			for {
+				line, ok := scanRecord(state, format)
+				if !ok {
+					return &object.Array{Elements: lines}
+				}
+				state.lineno++
+				lines = append(lines, &object.String{Value: line})
+			}
+		},
+	}
+
+	StringIOClass.Methods["getc"] = &object.Builtin{
+		Name: "getc",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			state, err := openStringIO(receiver)
+			if err != nil {
+				return err
+			}
+			if state.pos >= len(state.buf.Value) {
+				return object.NIL
+			}
+			rest := []rune(state.buf.Value[state.pos:])
+			char := string(rest[0])
+			state.pos += len(char)
+			return &object.String{Value: char}
+		},
+	}
+
+	StringIOClass.Methods["rewind"] = &object.Builtin{
+		Name: "rewind",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			state := lookupStringIO(receiver)
+			state.pos, state.lineno = 0, 0
+			return &object.Integer{Value: 0}
+		},
+	}
+
+	StringIOClass.Methods["pos"] = &object.Builtin{
+		Name: "pos",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: int64(lookupStringIO(receiver).pos)}
+		},
+	}
+	StringIOClass.Methods["tell"] = StringIOClass.Methods["pos"]
+
+	StringIOClass.Methods["pos="] = &object.Builtin{
+		Name: "pos=",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			n, ok := args[0].(*object.Integer)
+			if !ok {
+				return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+			}
+			if n.Value < 0 {
+				return newError("Errno::EINVAL: Invalid argument")
+			}
+			lookupStringIO(receiver).pos = int(n.Value)
+			return n
+		},
+	}
+
+	StringIOClass.Methods["seek"] = &object.Builtin{
+		Name: "seek",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 1 {
+				return newError("wrong number of arguments (given 0, expected 1..2)")
+			}
+			n, ok := args[0].(*object.Integer)
+			if !ok {
+				return newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(args[0]))
+			}
+			state := lookupStringIO(receiver)
+			offset := int(n.Value)
+			if len(args) > 1 {
+				switch whence := objectToString(args[1]); whence {
+				case "1", "CUR":
+					offset += state.pos
+				case "2", "END":
+					offset += len(state.buf.Value)
+				}
+			}
+			if offset < 0 {
+				return newError("Errno::EINVAL: Invalid argument")
+			}
+			state.pos = offset
+			return &object.Integer{Value: 0}
+		},
+	}
+
+	StringIOClass.Methods["eof?"] = &object.Builtin{
+		Name: "eof?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			state, err := openStringIO(receiver)
+			if err != nil {
+				return err
+			}
+			return object.NativeToBool(state.pos >= len(state.buf.Value))
+		},
+	}
+	StringIOClass.Methods["eof"] = StringIOClass.Methods["eof?"]
+
+	StringIOClass.Methods["size"] = &object.Builtin{
+		Name: "size",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: int64(len(lookupStringIO(receiver).buf.Value))}
+		},
+	}
+	StringIOClass.Methods["length"] = StringIOClass.Methods["size"]
+
+	StringIOClass.Methods["truncate"] = &object.Builtin{
+		Name: "truncate",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			n, ok := args[0].(*object.Integer)
+			if !ok || n.Value < 0 {
+				return newError("Errno::EINVAL: Invalid argument - negative length")
+			}
+			state, err := writableStringIO(receiver)
+			if err != nil {
+				return err
+			}
+			if int(n.Value) <= len(state.buf.Value) {
+				state.buf.Value = state.buf.Value[:n.Value]
+			} else {
+				state.buf.Value += strings.Repeat("\x00", int(n.Value)-len(state.buf.Value))
+			}
+			return &object.Integer{Value: 0}
+		},
+	}
+
+	StringIOClass.Methods["lineno"] = &object.Builtin{
+		Name: "lineno",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: lookupStringIO(receiver).lineno}
+		},
+	}
+
+	StringIOClass.Methods["close"] = &object.Builtin{
+		Name: "close",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			lookupStringIO(receiver).closed = true
+			return object.NIL
+		},
+	}
+
+	StringIOClass.Methods["closed?"] = &object.Builtin{
+		Name: "closed?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return object.NativeToBool(lookupStringIO(receiver).closed)
+		},
+	}
+
+	// A StringIO has nothing to flush, is always in sync and is not backed
+	// by a file descriptor.
+	StringIOClass.Methods["sync"] = &object.Builtin{
+		Name: "sync",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return object.TRUE
+		},
+	}
+
+	StringIOClass.Methods["sync="] = &object.Builtin{
+		Name: "sync=",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			return args[0]
+		},
+	}
+
+	StringIOClass.Methods["flush"] = &object.Builtin{
+		Name: "flush",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return receiver
+		},
+	}
+
+	StringIOClass.Methods["fileno"] = &object.Builtin{
+		Name: "fileno",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return object.NIL
+		},
+	}
+
+	StringIOClass.Methods["tty?"] = &object.Builtin{
+		Name: "tty?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return object.FALSE
+		},
+	}
+	StringIOClass.Methods["isatty"] = StringIOClass.Methods["tty?"]
+
+	StringIOClass.Methods["inspect"] = &object.Builtin{
+		Name: "inspect",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.String{Value: "#<StringIO>"}
+		},
+	}
+}
+
+func lookupStringIO(obj object.Object) *stringIO {
+	if inst, ok := obj.(*object.Instance); ok {
+		if state, ok := inst.Data.(*stringIO); ok {
+			return state
+		}
+	}
+	return &stringIO{buf: &object.String{}, closed: true}
+}
+
+// openStringIO returns the state of an open StringIO, or an IOError once
+// it has been closed.
+func openStringIO(obj object.Object) (*stringIO, object.Object) {
+	state := lookupStringIO(obj)
+	if state.closed {
+		return nil, newError("IOError: closed stream")
+	}
+	return state, nil
+}
+
+// writableStringIO is openStringIO for writes, which a StringIO over a
+// frozen String refuses.
+func writableStringIO(obj object.Object) (*stringIO, object.Object) {
+	state, err := openStringIO(obj)
+	if err != nil {
+		return nil, err
+	}
+	if state.buf.Frozen {
+		return nil, newError("IOError: not opened for writing")
+	}
+	return state, nil
+}
@@ -1,6 +1,9 @@
 package evaluator
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/alexisbouchez/rubylexer/object"
 )
 
@@ -46,6 +49,7 @@ func createStructClass(members []string) *object.RubyClass {
 		ClassMethods: make(map[string]object.Object),
 		StructMembers: members,
 	}
+	object.RegisterModule(structClass)
 
 	// Add 'new' class method to create instances
 	structClass.ClassMethods["new"] = &object.Builtin{
@@ -168,6 +172,27 @@ func createStructClass(members []string) *object.RubyClass {
 		},
 	}
 
+	// Pattern matching destructures a struct by its members
+	structClass.Methods["deconstruct"] = structClass.Methods["to_a"]
+	structClass.Methods["deconstruct_keys"] = structClass.Methods["to_h"]
+
+	structClass.Methods["inspect"] = &object.Builtin{
+		Name: "inspect",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			inst := receiver.(*object.Instance)
+			fields := make([]string, len(inst.Class_.StructMembers))
+			for i, m := range inst.Class_.StructMembers {
+				var val object.Object = object.NIL
+				if v, exists := inst.InstanceVariables["@"+m]; exists {
+					val = v
+				}
+				fields[i] = m + "=" + inspectObject(val)
+			}
+			return &object.String{Value: fmt.Sprintf("#<struct %s %s>", inst.Class_.Name, strings.Join(fields, ", "))}
+		},
+	}
+	structClass.Methods["to_s"] = structClass.Methods["inspect"]
+
 	structClass.Methods["[]"] = &object.Builtin{
 		Name: "[]",
 		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
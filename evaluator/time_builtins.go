@@ -58,13 +58,39 @@ var DateClass = &object.RubyClass{
 	Superclass:   object.ObjectClass,
 	Methods:      make(map[string]object.Object),
 	ClassMethods: make(map[string]object.Object),
+	Constants:    make(map[string]object.Object),
 }
 
+// DateTimeClass represents Ruby's DateTime class, a Date with a time of day
+var DateTimeClass = &object.RubyClass{
+	Name:         "DateTime",
+	Superclass:   DateClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// DateErrorClass is raised for invalid dates (Date::Error)
+var DateErrorClass = &object.RubyClass{
+	Name:         "Date::Error",
+	Superclass:   object.ArgumentErrorClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// unixEpochJD is the Julian Day Number of 1970-01-01
+const unixEpochJD = 2440588
+
 func init() {
+	object.TimeClass = TimeClass
+	object.DateClass = DateClass
+	object.DateTimeClass = DateTimeClass
+	DateClass.Constants["Error"] = DateErrorClass
+
 	initTimeClassMethods()
 	initTimeInstanceMethods()
 	initDateClassMethods()
 	initDateInstanceMethods()
+	initDateTimeMethods()
 }
 
 func initTimeClassMethods() {
@@ -576,7 +602,7 @@ func initDateClassMethods() {
 		Name: "today",
 		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 			now := time.Now()
-			t := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+			t := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 			return &object.Date{Value: t}
 		},
 	}
@@ -584,57 +610,67 @@ func initDateClassMethods() {
 	DateClass.ClassMethods["new"] = &object.Builtin{
 		Name: "new",
 		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-			year, month, day := -4712, 1, 1 // Ruby Date default
-
-			if len(args) > 0 {
-				if i, ok := args[0].(*object.Integer); ok {
-					year = int(i.Value)
-				}
-			}
-			if len(args) > 1 {
-				if i, ok := args[1].(*object.Integer); ok {
-					month = int(i.Value)
-				}
+			fields, err := dateFields(args, []int{-4712, 1, 1}) // Ruby Date default
+			if err != nil {
+				return err
 			}
-			if len(args) > 2 {
-				if i, ok := args[2].(*object.Integer); ok {
-					day = int(i.Value)
-				}
+			t, ok := civilDate(fields[0], fields[1], fields[2])
+			if !ok {
+				return &object.Error{Message: "invalid date", Class_: DateErrorClass}
 			}
-
-			t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.Local)
 			return &object.Date{Value: t}
 		},
 	}
 
-	DateClass.ClassMethods["parse"] = &object.Builtin{
-		Name: "parse",
+	DateClass.ClassMethods["civil"] = DateClass.ClassMethods["new"]
+
+	DateClass.ClassMethods["jd"] = &object.Builtin{
+		Name: "jd",
 		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-			if len(args) < 1 {
-				return newError("wrong number of arguments (given 0, expected 1)")
-			}
-			str, ok := args[0].(*object.String)
-			if !ok {
-				return newError("no implicit conversion of %s into String", args[0].Type())
+			fields, err := dateFields(args, []int{0})
+			if err != nil {
+				return err
 			}
+			return &object.Date{Value: dateFromJD(int64(fields[0]))}
+		},
+	}
 
-			formats := []string{
-				"2006-01-02",
-				"01/02/2006",
-				"02/01/2006",
-				"Jan 2, 2006",
-				"January 2, 2006",
-				"2 Jan 2006",
-				"2006/01/02",
+	DateClass.ClassMethods["valid_date?"] = &object.Builtin{
+		Name: "valid_date?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 3 {
+				return newError("wrong number of arguments (given %d, expected 3)", len(args))
 			}
+			fields, err := dateFields(args, nil)
+			if err != nil {
+				return err
+			}
+			_, ok := civilDate(fields[0], fields[1], fields[2])
+			return object.NativeToBool(ok)
+		},
+	}
 
-			for _, format := range formats {
-				if t, err := time.Parse(format, str.Value); err == nil {
-					return &object.Date{Value: t}
-				}
+	DateClass.ClassMethods["valid_civil?"] = DateClass.ClassMethods["valid_date?"]
+
+	DateClass.ClassMethods["leap?"] = &object.Builtin{
+		Name: "leap?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			fields, err := dateFields(args, []int{0})
+			if err != nil {
+				return err
 			}
+			return object.NativeToBool(isLeapYear(fields[0]))
+		},
+	}
 
-			return newError("invalid date: %q", str.Value)
+	DateClass.ClassMethods["parse"] = &object.Builtin{
+		Name: "parse",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			t, err := parseDateArg(args)
+			if err != nil {
+				return err
+			}
+			return &object.Date{Value: time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)}
 		},
 	}
 }
@@ -692,7 +728,12 @@ func initDateInstanceMethods() {
 		},
 	}
 
-	DateClass.Methods["inspect"] = DateClass.Methods["to_s"]
+	DateClass.Methods["inspect"] = &object.Builtin{
+		Name: "inspect",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.String{Value: receiver.Inspect()}
+		},
+	}
 
 	DateClass.Methods["strftime"] = &object.Builtin{
 		Name: "strftime",
@@ -788,37 +829,354 @@ func initDateInstanceMethods() {
 		},
 	}
 
-	DateClass.Methods["sunday?"] = &object.Builtin{
-		Name: "sunday?",
+	DateClass.Methods["to_time"] = &object.Builtin{
+		Name: "to_time",
 		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 			d := receiver.(*object.Date)
-			return object.NativeToBool(d.Value.Weekday() == time.Sunday)
+			if d.DateTime {
+				return &object.Time{Value: d.Value}
+			}
+			// A Date becomes local midnight of the same day
+			y, m, day := d.Value.Date()
+			return &object.Time{Value: time.Date(y, m, day, 0, 0, 0, 0, time.Local)}
 		},
 	}
 
-	DateClass.Methods["monday?"] = &object.Builtin{
-		Name: "monday?",
+	DateClass.Methods["to_date"] = &object.Builtin{
+		Name: "to_date",
 		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 			d := receiver.(*object.Date)
-			return object.NativeToBool(d.Value.Weekday() == time.Monday)
+			y, m, day := d.Value.Date()
+			return &object.Date{Value: time.Date(y, m, day, 0, 0, 0, 0, time.UTC)}
 		},
 	}
 
-	DateClass.Methods["saturday?"] = &object.Builtin{
-		Name: "saturday?",
+	DateClass.Methods["to_datetime"] = &object.Builtin{
+		Name: "to_datetime",
 		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 			d := receiver.(*object.Date)
-			return object.NativeToBool(d.Value.Weekday() == time.Saturday)
+			return &object.Date{Value: d.Value, DateTime: true}
 		},
 	}
 
-	DateClass.Methods["to_time"] = &object.Builtin{
-		Name: "to_time",
+	DateClass.Methods["jd"] = &object.Builtin{
+		Name: "jd",
 		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
 			d := receiver.(*object.Date)
-			return &object.Time{Value: d.Value}
+			return &object.Integer{Value: julianDay(d.Value)}
 		},
 	}
+
+	DateClass.Methods["leap?"] = &object.Builtin{
+		Name: "leap?",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			d := receiver.(*object.Date)
+			return object.NativeToBool(isLeapYear(d.Value.Year()))
+		},
+	}
+
+	DateClass.Methods["cwday"] = &object.Builtin{
+		Name: "cwday",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			d := receiver.(*object.Date)
+			wday := int64(d.Value.Weekday())
+			if wday == 0 {
+				wday = 7
+			}
+			return &object.Integer{Value: wday}
+		},
+	}
+
+	DateClass.Methods["cweek"] = &object.Builtin{
+		Name: "cweek",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			d := receiver.(*object.Date)
+			_, week := d.Value.ISOWeek()
+			return &object.Integer{Value: int64(week)}
+		},
+	}
+
+	for i, name := range []string{"sunday?", "monday?", "tuesday?", "wednesday?", "thursday?", "friday?", "saturday?"} {
+		weekday := time.Weekday(i)
+		DateClass.Methods[name] = &object.Builtin{
+			Name: name,
+			Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+				d := receiver.(*object.Date)
+				return object.NativeToBool(d.Value.Weekday() == weekday)
+			},
+		}
+	}
+
+	DateClass.Methods["iso8601"] = &object.Builtin{
+		Name: "iso8601",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.String{Value: receiver.(*object.Date).String()}
+		},
+	}
+
+	// Day, month and year arithmetic, each taking an optional count
+	shifts := map[string]func(t time.Time, n int) time.Time{
+		"next_day":   func(t time.Time, n int) time.Time { return t.AddDate(0, 0, n) },
+		"prev_day":   func(t time.Time, n int) time.Time { return t.AddDate(0, 0, -n) },
+		"next_month": func(t time.Time, n int) time.Time { return addMonths(t, n) },
+		"prev_month": func(t time.Time, n int) time.Time { return addMonths(t, -n) },
+		"next_year":  func(t time.Time, n int) time.Time { return addMonths(t, 12*n) },
+		"prev_year":  func(t time.Time, n int) time.Time { return addMonths(t, -12*n) },
+	}
+	for name, shift := range shifts {
+		name, shift := name, shift
+		DateClass.Methods[name] = &object.Builtin{
+			Name: name,
+			Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+				fields, err := dateFields(args, []int{1})
+				if err != nil {
+					return err
+				}
+				d := receiver.(*object.Date)
+				return &object.Date{Value: shift(d.Value, fields[0]), DateTime: d.DateTime}
+			},
+		}
+	}
+
+	DateClass.Methods["succ"] = DateClass.Methods["next_day"]
+	DateClass.Methods["next"] = DateClass.Methods["next_day"]
+
+	DateClass.Methods["upto"] = &object.Builtin{
+		Name: "upto",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return eachDateBetween(receiver, args, 1, "upto", env)
+		},
+	}
+
+	DateClass.Methods["downto"] = &object.Builtin{
+		Name: "downto",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return eachDateBetween(receiver, args, -1, "downto", env)
+		},
+	}
+}
+
+func initDateTimeMethods() {
+	DateTimeClass.ClassMethods["now"] = &object.Builtin{
+		Name: "now",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Date{Value: time.Now().Truncate(time.Second), DateTime: true}
+		},
+	}
+
+	DateTimeClass.ClassMethods["new"] = &object.Builtin{
+		Name: "new",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			fields, err := dateFields(args, []int{-4712, 1, 1, 0, 0, 0})
+			if err != nil {
+				return err
+			}
+			t, ok := civilDate(fields[0], fields[1], fields[2])
+			if !ok || fields[3] < 0 || fields[3] > 23 || fields[4] < 0 || fields[4] > 59 || fields[5] < 0 || fields[5] > 59 {
+				return &object.Error{Message: "invalid date", Class_: DateErrorClass}
+			}
+			t = t.Add(time.Duration(fields[3])*time.Hour + time.Duration(fields[4])*time.Minute + time.Duration(fields[5])*time.Second)
+			return &object.Date{Value: t, DateTime: true}
+		},
+	}
+
+	DateTimeClass.ClassMethods["civil"] = DateTimeClass.ClassMethods["new"]
+
+	DateTimeClass.ClassMethods["parse"] = &object.Builtin{
+		Name: "parse",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			t, err := parseDateArg(args)
+			if err != nil {
+				return err
+			}
+			return &object.Date{Value: t, DateTime: true}
+		},
+	}
+
+	DateTimeClass.Methods["hour"] = &object.Builtin{
+		Name: "hour",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: int64(receiver.(*object.Date).Value.Hour())}
+		},
+	}
+
+	DateTimeClass.Methods["minute"] = &object.Builtin{
+		Name: "minute",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: int64(receiver.(*object.Date).Value.Minute())}
+		},
+	}
+
+	DateTimeClass.Methods["min"] = DateTimeClass.Methods["minute"]
+
+	DateTimeClass.Methods["second"] = &object.Builtin{
+		Name: "second",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Integer{Value: int64(receiver.(*object.Date).Value.Second())}
+		},
+	}
+
+	DateTimeClass.Methods["sec"] = DateTimeClass.Methods["second"]
+
+	DateTimeClass.Methods["to_s"] = &object.Builtin{
+		Name: "to_s",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.String{Value: receiver.(*object.Date).String()}
+		},
+	}
+
+	DateTimeClass.Methods["inspect"] = DateClass.Methods["inspect"]
+
+	TimeClass.Methods["to_date"] = &object.Builtin{
+		Name: "to_date",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			y, m, d := receiver.(*object.Time).Value.Date()
+			return &object.Date{Value: time.Date(y, m, d, 0, 0, 0, 0, time.UTC)}
+		},
+	}
+
+	TimeClass.Methods["to_datetime"] = &object.Builtin{
+		Name: "to_datetime",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return &object.Date{Value: receiver.(*object.Time).Value, DateTime: true}
+		},
+	}
+}
+
+// dateFields reads Integer arguments, filling missing trailing ones from
+// defaults. With nil defaults every argument is required.
+func dateFields(args []object.Object, defaults []int) ([]int, object.Object) {
+	if defaults != nil && len(args) > len(defaults) {
+		return nil, newError("wrong number of arguments (given %d, expected 0..%d)", len(args), len(defaults))
+	}
+	fields := make([]int, len(defaults))
+	copy(fields, defaults)
+	if defaults == nil {
+		fields = make([]int, len(args))
+	}
+	for i, arg := range args {
+		n, ok := arg.(*object.Integer)
+		if !ok {
+			return nil, newError("TypeError: no implicit conversion of %s into Integer", comparisonOperandName(arg))
+		}
+		fields[i] = int(n.Value)
+	}
+	return fields, nil
+}
+
+// civilDate builds a UTC date, reporting false for dates that do not exist.
+// A negative day counts back from the end of the month, as in Ruby.
+func civilDate(year, month, day int) (time.Time, bool) {
+	if month < 0 {
+		month += 13
+	}
+	if month < 1 || month > 12 {
+		return time.Time{}, false
+	}
+	if day < 0 {
+		day += daysInMonth(year, time.Month(month)) + 1
+	}
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if t.Month() != time.Month(month) || day < 1 {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func daysInMonth(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func isLeapYear(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+// addMonths moves t by n months, clamping the day to the end of the target
+// month like Date#>> (Jan 31 >> 1 is the last day of February).
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	day := t.Day()
+	if last := daysInMonth(first.Year(), first.Month()); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+func julianDay(t time.Time) int64 {
+	y, m, d := t.Date()
+	days := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+	return days + unixEpochJD
+}
+
+func dateFromJD(jd int64) time.Time {
+	return time.Unix((jd-unixEpochJD)*86400, 0).UTC()
+}
+
+// parseDateArg parses the string argument of Date.parse and DateTime.parse.
+func parseDateArg(args []object.Object) (time.Time, object.Object) {
+	if len(args) < 1 {
+		return time.Time{}, newError("wrong number of arguments (given 0, expected 1)")
+	}
+	str, ok := args[0].(*object.String)
+	if !ok {
+		return time.Time{}, newError("no implicit conversion of %s into String", args[0].Type())
+	}
+
+	formats := []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05",
+		"2006-01-02 15:04:05 -0700",
+		"2006-01-02 15:04:05",
+		"2006-01-02",
+		"20060102",
+		"01/02/2006",
+		"02/01/2006",
+		"Jan 2, 2006",
+		"January 2, 2006",
+		"Jan 2 2006",
+		"January 2 2006",
+		"2 Jan 2006",
+		"2 January 2006",
+		"2 Jan, 2006",
+		"2 January, 2006",
+		"Mon, 2 Jan 2006",
+		"2006/01/02",
+	}
+
+	value := strings.TrimSpace(str.Value)
+	for _, format := range formats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, &object.Error{Message: "invalid date", Class_: DateErrorClass}
+}
+
+// eachDateBetween implements Date#upto and Date#downto.
+func eachDateBetween(receiver object.Object, args []object.Object, dir int, name string, env *object.Environment) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments (given %d, expected 1)", len(args))
+	}
+	from := receiver.(*object.Date)
+	to, ok := args[0].(*object.Date)
+	if !ok {
+		return newError("ArgumentError: comparison of Date with %s failed", comparisonOperandName(args[0]))
+	}
+	block := env.Block()
+	if block == nil {
+		return newEnumerator(receiver, name, args)
+	}
+	for t := from.Value; t.Compare(to.Value)*dir <= 0; t = t.AddDate(0, 0, dir) {
+		result := callBlock(block, []object.Object{&object.Date{Value: t, DateTime: from.DateTime}}, env)
+		if bv, ok := result.(*object.BreakValue); ok {
+			return bv.Value
+		}
+		if isError(result) {
+			return result
+		}
+	}
+	return receiver
 }
 
 // rubyStrftime converts Ruby strftime format to Go time
@@ -0,0 +1,247 @@
+package evaluator
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// TimeoutModule represents Ruby's Timeout module
+var TimeoutModule = &object.RubyModule{
+	Name:      "Timeout",
+	Methods:   make(map[string]object.Object),
+	Constants: make(map[string]object.Object),
+}
+
+// TimeoutErrorClass is raised when a Timeout.timeout block runs too long
+var TimeoutErrorClass = &object.RubyClass{
+	Name:         "Timeout::Error",
+	Superclass:   object.RuntimeErrorClass,
+	Methods:      make(map[string]object.Object),
+	ClassMethods: make(map[string]object.Object),
+}
+
+// timeoutExitClass is what a Timeout.timeout block is interrupted with.
+// It is not a StandardError, so a bare rescue in the block lets it through
+// to timeout, which raises it on as a Timeout::Error.
+var timeoutExitClass = defineErrorClass("Timeout::ExitException", object.ExceptionClass)
+
+// An interrupt is an exception delivered asynchronously to an evaluation,
+// the main script or a ractor: the evaluation checks for one between
+// statements and raises it there. interruptPending is set while any
+// interrupt or the exceeded limit is waiting to be delivered; the rest is
+// guarded by interruptMutex.
+var (
+	interruptPending int32
+	interruptMutex   sync.Mutex
+	// interrupts holds each evaluation's pending interrupts, oldest
+	// first, keyed by its ractor (nil for the main script)
+	interrupts = make(map[*object.Instance][]*object.Error)
+	// interrupted is closed and replaced whenever an interrupt is sent,
+	// waking the blocked waiters to look for theirs
+	interrupted = make(chan struct{})
+)
+
+func init() {
+	TimeoutModule.Constants["Error"] = TimeoutErrorClass
+	TimeoutModule.Constants["ExitException"] = timeoutExitClass
+
+	TimeoutModule.Methods["timeout"] = &object.Builtin{
+		Name: "timeout",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 1 {
+				return newError("wrong number of arguments (given 0, expected 1..3)")
+			}
+			block := env.Block()
+			if block == nil {
+				return newError("LocalJumpError: no block given (yield)")
+			}
+
+			var seconds float64
+			switch n := args[0].(type) {
+			case *object.Integer:
+				seconds = float64(n.Value)
+			case *object.Float:
+				seconds = n.Value
+			case *object.Nil:
+			default:
+				return newError("TypeError: can't convert %s into time interval", comparisonOperandName(args[0]))
+			}
+			// nil or zero runs the block without a limit
+			if seconds <= 0 {
+				return callBlock(block, []object.Object{args[0]}, env)
+			}
+
+			// An exception class of the caller's own is raised in the block as is
+			err := &object.Error{Message: "execution expired", Class_: timeoutExitClass}
+			if len(args) > 1 {
+				if class, ok := args[1].(*object.RubyClass); ok {
+					err.Class_ = class
+				}
+			}
+			if len(args) > 2 {
+				err.Message = objectToString(args[2])
+			}
+
+			// The armed timer counts as a live thread: it will wake the
+			// block even out of a wait on a queue
+			evaluation := currentRactor
+			atomic.AddInt32(&liveThreads, 1)
+			timer := time.AfterFunc(time.Duration(seconds*float64(time.Second)), func() {
+				interruptEvaluation(evaluation, err)
+				atomic.AddInt32(&liveThreads, -1)
+			})
+			result := callBlock(block, []object.Object{args[0]}, env)
+			if timer.Stop() {
+				atomic.AddInt32(&liveThreads, -1)
+			} else {
+				// The timer fired; drop the interrupt if it was never delivered
+				cancelInterrupt(evaluation, err)
+			}
+			if result == err && err.Class_ == timeoutExitClass {
+				timedOut := *err
+				timedOut.Class_ = TimeoutErrorClass
+				return &timedOut
+			}
+			return result
+		},
+	}
+}
+
+// Interrupt makes the main script raise err at its next statement, or
+// out of a wait on a queue. It is safe to call from any goroutine, so
+// embedders can use it to stop runaway scripts.
+func Interrupt(err *object.Error) {
+	interruptEvaluation(nil, err)
+}
+
+// interruptEvaluation makes the evaluation of the ractor evaluation, nil
+// for the main script, raise err.
+func interruptEvaluation(evaluation *object.Instance, err *object.Error) {
+	interruptMutex.Lock()
+	defer interruptMutex.Unlock()
+	interrupts[evaluation] = append(interrupts[evaluation], err)
+	atomic.StoreInt32(&interruptPending, 1)
+	signalInterrupt()
+}
+
+// signalInterrupt wakes the blocked waiters. The caller must hold
+// interruptMutex.
+func signalInterrupt() {
+	close(interrupted)
+	interrupted = make(chan struct{})
+}
+
+// interruptSignal returns the channel closed when the next interrupt is
+// sent.
+func interruptSignal() <-chan struct{} {
+	interruptMutex.Lock()
+	defer interruptMutex.Unlock()
+	return interrupted
+}
+
+// hasInterrupt reports whether an interrupt awaits the evaluation of the
+// ractor evaluation, without clearing it.
+func hasInterrupt(evaluation *object.Instance) bool {
+	interruptMutex.Lock()
+	defer interruptMutex.Unlock()
+	return limitErr != nil || len(interrupts[evaluation]) > 0
+}
+
+// checkInterrupt counts an evaluation step and returns the pending
+// interrupt, if any, clearing it.
+func checkInterrupt() object.Object {
+	countStep()
+	return pendingInterrupt()
+}
+
+// pendingInterrupt returns the running evaluation's oldest pending
+// interrupt, if any, clearing it. An exceeded limit stays pending.
+func pendingInterrupt() object.Object {
+	if atomic.LoadInt32(&interruptPending) == 0 {
+		return nil
+	}
+	interruptMutex.Lock()
+	defer interruptMutex.Unlock()
+	if limitErr != nil {
+		return &object.Error{Message: limitErr.Message, Class_: limitErr.Class_}
+	}
+	pending := interrupts[currentRactor]
+	if len(pending) == 0 {
+		return nil
+	}
+	if len(pending) == 1 {
+		delete(interrupts, currentRactor)
+	} else {
+		interrupts[currentRactor] = pending[1:]
+	}
+	updateInterruptPending()
+	return pending[0]
+}
+
+// cancelInterrupt withdraws err if it is still pending for the evaluation
+// of the ractor evaluation.
+func cancelInterrupt(evaluation *object.Instance, err *object.Error) {
+	interruptMutex.Lock()
+	defer interruptMutex.Unlock()
+	pending := interrupts[evaluation]
+	for i, e := range pending {
+		if e == err {
+			pending = append(pending[:i:i], pending[i+1:]...)
+			break
+		}
+	}
+	if len(pending) == 0 {
+		delete(interrupts, evaluation)
+	} else {
+		interrupts[evaluation] = pending
+	}
+	updateInterruptPending()
+}
+
+// updateInterruptPending clears interruptPending once nothing is left to
+// deliver. The caller must hold interruptMutex.
+func updateInterruptPending() {
+	if len(interrupts) == 0 && limitErr == nil {
+		atomic.StoreInt32(&interruptPending, 0)
+	}
+}
+
+// interruptibleSleep implements Kernel#sleep, waking early to raise a
+// pending interrupt. With no argument it sleeps until interrupted.
+func interruptibleSleep(args []object.Object) object.Object {
+	duration := time.Duration(math.MaxInt64)
+	if len(args) > 0 {
+		switch n := args[0].(type) {
+		case *object.Integer:
+			duration = time.Duration(n.Value) * time.Second
+		case *object.Float:
+			duration = time.Duration(n.Value * float64(time.Second))
+		default:
+			return newError("TypeError: can't convert %s into time interval", comparisonOperandName(args[0]))
+		}
+		if duration < 0 {
+			return newError("ArgumentError: time interval must not be negative")
+		}
+	}
+
+	start := time.Now()
+	const slice = 10 * time.Millisecond
+	for {
+		if err := pendingInterrupt(); err != nil {
+			return err
+		}
+		remaining := duration - time.Since(start)
+		if remaining <= 0 {
+			break
+		}
+		if remaining > slice {
+			remaining = slice
+		}
+		time.Sleep(remaining)
+	}
+	return &object.Integer{Value: int64(math.Round(time.Since(start).Seconds()))}
+}
@@ -24,7 +24,7 @@ func getTracePointBuiltins() map[string]*object.Builtin {
 					// If block given, enable only for the block
 					block := env.Block()
 					if block != nil {
-						result := evalBlockBody(block.Body, block.Env)
+						result := callBlock(block, nil, env)
 						tp.Enabled = false
 						object.RemoveActiveTracePoint(tp)
 						return result
@@ -46,7 +46,7 @@ func getTracePointBuiltins() map[string]*object.Builtin {
 					// If block given, disable only for the block
 					block := env.Block()
 					if block != nil {
-						result := evalBlockBody(block.Body, block.Env)
+						result := callBlock(block, nil, env)
 						if wasEnabled {
 							tp.Enabled = true
 							object.AddActiveTracePoint(tp)
@@ -218,11 +218,7 @@ func FireTraceEvent(event object.TracePointEvent, methodID, path string, lineno
 
 		// Call the block with the trace point as argument
 		if tp.Block != nil {
-			blockEnv := object.NewEnclosedEnvironment(tp.Block.Env)
-			if len(tp.Block.Parameters) > 0 {
-				blockEnv.Set(tp.Block.Parameters[0].Name, tp)
-			}
-			evalBlockBody(tp.Block.Body, blockEnv)
+			callBlock(tp.Block, []object.Object{tp}, env)
 		}
 	}
 }
@@ -0,0 +1,94 @@
+package evaluator
+
+import (
+	"sort"
+
+	"github.com/alexisbouchez/rubylexer/ast"
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// warnUnusedVariables warns, in verbose mode, about each local variable of
+// program that is assigned but never read, as ruby -w does before running
+// a file. Names starting with an underscore are left out, as are
+// parameters given a new value.
+func warnUnusedVariables(program *ast.Program, env *object.Environment) object.Object {
+	if !verbose() {
+		return nil
+	}
+	var unused []*ast.Identifier
+	scopes := []ast.Node{program}
+	for len(scopes) > 0 {
+		scope := scopes[0]
+		scopes = scopes[1:]
+		found, nested := unusedVariables(scope)
+		unused = append(unused, found...)
+		scopes = append(scopes, nested...)
+	}
+	sort.SliceStable(unused, func(i, j int) bool {
+		return unused[i].Pos().Offset < unused[j].Pos().Offset
+	})
+	for _, ident := range unused {
+		if err := warnAt(ident.Pos(), "assigned but unused variable - "+ident.Value, "", env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unusedVariables returns the variables assigned but never read in scope,
+// along with the scopes nested in it: the method, class and module
+// definitions, each of which has variables of its own. Blocks share the
+// variables of the scope they are in.
+func unusedVariables(scope ast.Node) ([]*ast.Identifier, []ast.Node) {
+	var nested []ast.Node
+	assigned := make(map[string]*ast.Identifier)
+	var order []string
+	targets := make(map[*ast.Identifier]bool)
+	read := make(map[string]bool)
+	params := make(map[string]bool)
+
+	if def, ok := scope.(*ast.MethodDefinition); ok {
+		for _, param := range def.Parameters {
+			params[param.Name] = true
+		}
+	}
+
+	ast.Inspect(scope, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.MethodDefinition, *ast.ClassDefinition, *ast.ModuleDefinition, *ast.SingletonClassDefinition:
+			if node != scope {
+				nested = append(nested, node)
+				return false
+			}
+		case *ast.Block:
+			for _, param := range n.Parameters {
+				params[param.Name] = true
+			}
+		case *ast.Lambda:
+			for _, param := range n.Parameters {
+				params[param.Name] = true
+			}
+		case *ast.AssignmentExpression:
+			if ident, ok := n.Left.(*ast.Identifier); ok {
+				targets[ident] = true
+				if _, seen := assigned[ident.Value]; !seen {
+					assigned[ident.Value] = ident
+					order = append(order, ident.Value)
+				}
+			}
+		case *ast.Identifier:
+			if !targets[n] {
+				read[n.Value] = true
+			}
+		}
+		return true
+	})
+
+	var unused []*ast.Identifier
+	for _, name := range order {
+		if !read[name] && !params[name] && name[0] != '_' {
+			unused = append(unused, assigned[name])
+		}
+	}
+	return unused, nested
+}
@@ -0,0 +1,117 @@
+package evaluator
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// vendorDirs are the project-local directories vendored libraries are
+// looked for in, in load path order.
+var vendorDirs = []string{"vendor", "rubygo_modules"}
+
+// ManifestFile names the file at a project's root that lists the entry
+// points of its libraries.
+const ManifestFile = "rubygo.manifest"
+
+// manifestEntries maps a feature name from the manifest to the file
+// require loads for it.
+var manifestEntries = make(map[string]string)
+
+// LoadVendoredLibraries sets up the libraries of the project the script
+// belongs to. The project root is the nearest directory, starting from the
+// script's own, holding a vendor/ or rubygo_modules/ directory or a
+// manifest. Each vendor directory, and the lib/ directory (or, lacking one,
+// the top directory) of every library inside it, is appended to the load
+// path. Each manifest line reads "name path", naming a feature and the
+// file, relative to the root, that require loads for it.
+func LoadVendoredLibraries(script string) error {
+	dir, err := filepath.Abs(filepath.Dir(script))
+	if err != nil {
+		return err
+	}
+	root := findProjectRoot(dir)
+	if root == "" {
+		return nil
+	}
+
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+
+	for _, name := range vendorDirs {
+		vendor := filepath.Join(root, name)
+		entries, err := os.ReadDir(vendor)
+		if err != nil {
+			continue
+		}
+		addToLoadPath(vendor)
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			lib := filepath.Join(vendor, entry.Name())
+			if info, err := os.Stat(filepath.Join(lib, "lib")); err == nil && info.IsDir() {
+				lib = filepath.Join(lib, "lib")
+			}
+			addToLoadPath(lib)
+		}
+	}
+
+	return readManifest(root)
+}
+
+// findProjectRoot walks up from dir looking for a directory that holds a
+// vendor directory or a manifest, returning "" if none does.
+func findProjectRoot(dir string) string {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ManifestFile)); err == nil {
+			return dir
+		}
+		for _, name := range vendorDirs {
+			if info, err := os.Stat(filepath.Join(dir, name)); err == nil && info.IsDir() {
+				return dir
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readManifest loads the manifest in root, if there is one. Blank lines
+// and lines starting with # are ignored. The directory of each entry point
+// is added to the load path so the library can require its own files.
+func readManifest(root string) error {
+	path := filepath.Join(root, ManifestFile)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected \"name path\", got %q", path, lineno, line)
+		}
+		entry := fields[1]
+		if !filepath.IsAbs(entry) {
+			entry = filepath.Join(root, entry)
+		}
+		manifestEntries[fields[0]] = entry
+		addToLoadPath(filepath.Dir(entry))
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,63 @@
+package evaluator
+
+import (
+	"runtime"
+
+	"github.com/alexisbouchez/rubylexer/object"
+)
+
+// Version is the version of rubygo, which scripts see as
+// RUBY_ENGINE_VERSION.
+const Version = "0.1.0"
+
+// RubyVersion is the version of Ruby that rubygo follows, which scripts see
+// as RUBY_VERSION.
+const RubyVersion = "3.3.0"
+
+// Engine is the name scripts see as RUBY_ENGINE, so that they can tell
+// rubygo from other Rubies.
+const Engine = "rubygo"
+
+// Platform returns the platform rubygo runs on, named the way ruby's
+// RUBY_PLATFORM names it, as in x86_64-linux.
+func Platform() string {
+	arch := runtime.GOARCH
+	switch arch {
+	case "amd64":
+		arch = "x86_64"
+	case "386":
+		arch = "i386"
+	case "arm64":
+		if runtime.GOOS != "darwin" {
+			arch = "aarch64"
+		}
+	}
+	return arch + "-" + runtime.GOOS
+}
+
+// Description returns the line rubygo -v prints, which scripts see as
+// RUBY_DESCRIPTION.
+func Description() string {
+	return Engine + " " + Version + " (ruby " + RubyVersion + ") [" + Platform() + "]"
+}
+
+// versionConstant returns the value of the RUBY_ constant name, if it is
+// one.
+func versionConstant(name string) (object.Object, bool) {
+	var value string
+	switch name {
+	case "RUBY_VERSION":
+		value = RubyVersion
+	case "RUBY_ENGINE":
+		value = Engine
+	case "RUBY_ENGINE_VERSION":
+		value = Version
+	case "RUBY_PLATFORM":
+		value = Platform()
+	case "RUBY_DESCRIPTION":
+		value = Description()
+	default:
+		return nil, false
+	}
+	return &object.String{Value: value, Frozen: true}, true
+}
@@ -0,0 +1,258 @@
+package evaluator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alexisbouchez/rubylexer/ast"
+	"github.com/alexisbouchez/rubylexer/object"
+	"github.com/alexisbouchez/rubylexer/token"
+)
+
+// WarningModule is Ruby's Warning module. Every warning, whether from warn
+// or from the interpreter itself, is passed to Warning.warn, so a script
+// can redefine it to filter, collect or raise on warnings.
+var WarningModule = &object.RubyModule{
+	Name:      "Warning",
+	Methods:   make(map[string]object.Object),
+	Constants: make(map[string]object.Object),
+}
+
+// warningCategories says which categories of warning are shown, as
+// Warning[] reads and Warning[]= sets it.
+var warningCategories = map[string]bool{
+	"deprecated":   false,
+	"experimental": true,
+	"performance":  false,
+}
+
+func init() {
+	globalVariables["$VERBOSE"] = object.FALSE
+
+	// Kept with the top-level constants so that a script can reopen it
+	object.ObjectClass.Constants["Warning"] = WarningModule
+
+	WarningModule.Methods["warn"] = &object.Builtin{
+		Name: "warn",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			category := ""
+			if len(args) > 0 {
+				if opts, ok := args[len(args)-1].(*object.Hash); ok && opts.IsKeywordArgs {
+					args = args[:len(args)-1]
+					if value, ok := hashGet(opts, &object.Symbol{Value: "category"}); ok && value != object.NIL {
+						name, err := warningCategory(value)
+						if err != nil {
+							return err
+						}
+						category = name
+					}
+				}
+			}
+			if len(args) != 1 {
+				return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			msg, ok := args[0].(*object.String)
+			if !ok {
+				return newError("TypeError: no implicit conversion of %s into String", comparisonOperandName(args[0]))
+			}
+			if category != "" && !warningCategories[category] {
+				return object.NIL
+			}
+			if err := writeStderr(msg.Value); err != nil {
+				return err
+			}
+			return object.NIL
+		},
+	}
+
+	WarningModule.Methods["[]"] = &object.Builtin{
+		Name: "[]",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("ArgumentError: wrong number of arguments (given %d, expected 1)", len(args))
+			}
+			category, err := warningCategory(args[0])
+			if err != nil {
+				return err
+			}
+			if warningCategories[category] {
+				return object.TRUE
+			}
+			return object.FALSE
+		},
+	}
+
+	WarningModule.Methods["[]="] = &object.Builtin{
+		Name: "[]=",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) != 2 {
+				return newError("ArgumentError: wrong number of arguments (given %d, expected 2)", len(args))
+			}
+			category, err := warningCategory(args[0])
+			if err != nil {
+				return err
+			}
+			warningCategories[category] = args[1].IsTruthy()
+			return args[1]
+		},
+	}
+}
+
+// warningCategory returns the name of the category sym names, or an error
+// if it is not a known one.
+func warningCategory(sym object.Object) (string, *object.Error) {
+	s, ok := sym.(*object.Symbol)
+	if !ok {
+		return "", newError("TypeError: %s is not a symbol", sym.Inspect())
+	}
+	if _, ok := warningCategories[s.Value]; !ok {
+		return "", newError("ArgumentError: unknown category: %s", s.Value)
+	}
+	return s.Value, nil
+}
+
+// SetWarningLevel sets $VERBOSE the way ruby's -W option does: 0 silences
+// warnings (nil), 1 is the default (false) and 2 enables verbose ones
+// (true), deprecation warnings among them.
+func SetWarningLevel(level int) {
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+	switch {
+	case level <= 0:
+		globalVariables["$VERBOSE"] = object.NIL
+	case level == 1:
+		globalVariables["$VERBOSE"] = object.FALSE
+	default:
+		globalVariables["$VERBOSE"] = object.TRUE
+	}
+	warningCategories["deprecated"] = level >= 2
+}
+
+// SetWarningCategory shows or hides a category of warning, as ruby's
+// -W:deprecated and -W:no-deprecated options do.
+func SetWarningCategory(category string, enabled bool) error {
+	interpreterLock.Lock()
+	defer interpreterLock.Unlock()
+	if _, ok := warningCategories[category]; !ok {
+		return fmt.Errorf("unknown warning category: '%s'", category)
+	}
+	warningCategories[category] = enabled
+	return nil
+}
+
+// warningsEnabled reports whether warn should print anything; a nil
+// $VERBOSE silences it.
+func warningsEnabled() bool {
+	verbose, ok := globalVariables["$VERBOSE"]
+	return !ok || verbose != object.NIL
+}
+
+// verbose reports whether $VERBOSE is true, as -w makes it, so that the
+// interpreter gives the warnings ruby only gives then.
+func verbose() bool {
+	return globalVariables["$VERBOSE"] == object.TRUE
+}
+
+// emitWarning passes text to Warning.warn unless warnings are silenced.
+// category, if not empty, is the category of warning text is, which
+// Warning.warn leaves out while Warning[category] is false.
+func emitWarning(text, category string, env *object.Environment) object.Object {
+	if !warningsEnabled() {
+		return nil
+	}
+	args := []object.Object{&object.String{Value: text}}
+	if category != "" {
+		opts := newHash()
+		opts.IsKeywordArgs = true
+		hashSet(opts, &object.Symbol{Value: "category"}, &object.Symbol{Value: category})
+		args = append(args, opts)
+	}
+	if result := callMethod(WarningModule, "warn", args, nil, env); isError(result) {
+		return result
+	}
+	return nil
+}
+
+// warnAt gives msg as a warning about the line pos is on in the file being
+// run, the way ruby words its own warnings.
+func warnAt(pos token.Pos, msg, category string, env *object.Environment) object.Object {
+	return emitWarning(fmt.Sprintf("%s:%d: warning: %s\n", displayPath(currentFile), pos.Line, msg), category, env)
+}
+
+// warnRedefinition warns, in verbose mode, that defining method discards
+// old, a method also defined in Ruby.
+func warnRedefinition(old object.Object, method *object.Method, pos token.Pos, env *object.Environment) object.Object {
+	previous, ok := old.(*object.Method)
+	if !ok || !verbose() {
+		return nil
+	}
+	if err := warnAt(pos, "method redefined; discarding old "+method.Name, "", env); err != nil {
+		return err
+	}
+	if previous.File == "" {
+		return nil
+	}
+	text := fmt.Sprintf("%s:%d: warning: previous definition of %s was here\n", displayPath(previous.File), previous.Line, previous.Name)
+	return emitWarning(text, "", env)
+}
+
+// warnConstantReassigned warns that assigning the constant name on scope,
+// a class or module whose constants are constants, replaces the value it
+// already has.
+func warnConstantReassigned(scope object.Object, constants map[string]object.Object, name string, pos token.Pos, env *object.Environment) object.Object {
+	if _, ok := constants[name]; !ok {
+		return nil
+	}
+	if scope != object.ObjectClass {
+		name = scope.Inspect() + "::" + name
+	}
+	return warnAt(pos, "already initialized constant "+name, "", env)
+}
+
+// warnAmbiguousArgument warns, in verbose mode, about a call written like
+// p -1, which is read as a subtraction from the result of p. Ruby would
+// read it as passing -1 to p.
+func warnAmbiguousArgument(node *ast.InfixExpression, env *object.Environment) object.Object {
+	if node.Operator != "-" && node.Operator != "+" || !verbose() {
+		return nil
+	}
+	left, ok := node.Left.(*ast.Identifier)
+	if !ok || node.Right == nil {
+		return nil
+	}
+	spaceBefore := node.Token.Offset > left.Token.EndOffset
+	spaceAfter := node.Right.Pos().Offset > node.Token.EndOffset
+	if !spaceBefore || spaceAfter {
+		return nil
+	}
+	if _, isLocal := env.Get(left.Value); isLocal {
+		return nil
+	}
+	msg := fmt.Sprintf("ambiguous first argument; put parentheses or a space even after `%s' operator", node.Operator)
+	return warnAt(node.Token.Pos(), msg, "", env)
+}
+
+// deprecatedGlobals are the global variables that warn when given a value.
+var deprecatedGlobals = map[string]bool{"$,": true, "$;": true}
+
+// warningText gives each message on its own line, flattening arrays, and
+// prefixing them with prefix.
+func warningText(prefix string, messages []object.Object) string {
+	var out strings.Builder
+	var write func(objs []object.Object)
+	write = func(objs []object.Object) {
+		for _, msg := range objs {
+			if arr, ok := msg.(*object.Array); ok {
+				write(arr.Elements)
+				continue
+			}
+			text := prefix + objectToString(msg)
+			out.WriteString(text)
+			if !strings.HasSuffix(text, "\n") {
+				out.WriteString("\n")
+			}
+		}
+	}
+	write(messages)
+	return out.String()
+}
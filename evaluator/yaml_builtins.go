@@ -1,6 +1,11 @@
 package evaluator
 
 import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/alexisbouchez/rubylexer/object"
 	"gopkg.in/yaml.v3"
 )
@@ -12,32 +17,50 @@ var YAMLModule = &object.RubyModule{
 	Constants: make(map[string]object.Object),
 }
 
+// yamlLoadOptions holds the keyword options of YAML.load and safe_load.
+type yamlLoadOptions struct {
+	symbolizeNames bool
+	aliases        bool
+	permitSymbols  bool
+	permitDates    bool
+}
+
 func init() {
 	initYAMLMethods()
+
+	// Psych names its errors under its own name, which YAML is an alias of
+	psychError := defineErrorClass("Psych::Exception", object.RuntimeErrorClass)
+	badAlias := defineErrorClass("Psych::BadAlias", psychError)
+	YAMLModule.Constants["Exception"] = psychError
+	YAMLModule.Constants["BadAlias"] = badAlias
+	YAMLModule.Constants["AliasesNotEnabled"] = defineErrorClass("Psych::AliasesNotEnabled", badAlias)
+	YAMLModule.Constants["DisallowedClass"] = defineErrorClass("Psych::DisallowedClass", psychError)
+	YAMLModule.Constants["SyntaxError"] = defineErrorClass("Psych::SyntaxError", psychError)
 }
 
 func initYAMLMethods() {
+	// YAML.load is safe_load with Symbol permitted, as in Psych 4
 	YAMLModule.Methods["load"] = &object.Builtin{
 		Name: "load",
 		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
-			if len(args) < 1 {
-				return newError("wrong number of arguments (given 0, expected 1)")
-			}
-			str, ok := args[0].(*object.String)
-			if !ok {
-				return newError("no implicit conversion of %s into String", args[0].Type())
-			}
+			return yamlLoad(args, yamlLoadOptions{permitSymbols: true})
+		},
+	}
 
-			var data interface{}
-			if err := yaml.Unmarshal([]byte(str.Value), &data); err != nil {
-				return newError("YAML parse error: %s", err.Error())
-			}
+	YAMLModule.Methods["safe_load"] = &object.Builtin{
+		Name: "safe_load",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return yamlLoad(args, yamlLoadOptions{})
+		},
+	}
 
-			return yamlToRuby(data)
+	YAMLModule.Methods["unsafe_load"] = &object.Builtin{
+		Name: "unsafe_load",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return yamlLoad(args, yamlLoadOptions{aliases: true, permitSymbols: true, permitDates: true})
 		},
 	}
 
-	YAMLModule.Methods["safe_load"] = YAMLModule.Methods["load"]
 	YAMLModule.Methods["parse"] = YAMLModule.Methods["load"]
 
 	YAMLModule.Methods["dump"] = &object.Builtin{
@@ -68,68 +91,358 @@ func initYAMLMethods() {
 			}
 
 			// Parse YAML
-			return YAMLModule.Methods["load"].(*object.Builtin).Fn(nil, env, content)
+			loadArgs := append([]object.Object{content}, args[1:]...)
+			return YAMLModule.Methods["load"].(*object.Builtin).Fn(nil, env, loadArgs...)
+		},
+	}
+
+	YAMLModule.Methods["safe_load_file"] = &object.Builtin{
+		Name: "safe_load_file",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			if len(args) < 1 {
+				return newError("wrong number of arguments (given 0, expected 1)")
+			}
+			content := FileClass.ClassMethods["read"].(*object.Builtin).Fn(nil, env, args[0])
+			if err, isErr := content.(*object.Error); isErr {
+				return err
+			}
+			loadArgs := append([]object.Object{content}, args[1:]...)
+			return YAMLModule.Methods["safe_load"].(*object.Builtin).Fn(nil, env, loadArgs...)
 		},
 	}
 }
 
-// yamlToRuby converts a Go value from YAML to a Ruby object
-func yamlToRuby(data interface{}) object.Object {
-	switch v := data.(type) {
-	case nil:
-		return object.NIL
-	case bool:
-		return object.NativeToBool(v)
-	case int:
-		return &object.Integer{Value: int64(v)}
-	case int64:
-		return &object.Integer{Value: v}
-	case float64:
-		if v == float64(int64(v)) {
-			return &object.Integer{Value: int64(v)}
-		}
-		return &object.Float{Value: v}
-	case string:
-		return &object.String{Value: v}
-	case []interface{}:
-		elements := make([]object.Object, len(v))
-		for i, elem := range v {
-			elements[i] = yamlToRuby(elem)
+// yamlLoad parses the YAML string in args[0], applying the symbolize_names:,
+// aliases: and permitted_classes: options on top of defaults.
+func yamlLoad(args []object.Object, opts yamlLoadOptions) object.Object {
+	if len(args) < 1 {
+		return newError("wrong number of arguments (given 0, expected 1)")
+	}
+	str, ok := args[0].(*object.String)
+	if !ok {
+		return newError("no implicit conversion of %s into String", args[0].Type())
+	}
+
+	if len(args) > 1 {
+		if kwargs, ok := args[len(args)-1].(*object.Hash); ok {
+			if val, ok := hashGet(kwargs, &object.Symbol{Value: "symbolize_names"}); ok {
+				opts.symbolizeNames = isTruthy(val)
+			}
+			if val, ok := hashGet(kwargs, &object.Symbol{Value: "aliases"}); ok {
+				opts.aliases = isTruthy(val)
+			}
+			if val, ok := hashGet(kwargs, &object.Symbol{Value: "permitted_classes"}); ok {
+				if classes, ok := val.(*object.Array); ok {
+					for _, class := range classes.Elements {
+						switch class {
+						case object.SymbolClass:
+							opts.permitSymbols = true
+						case DateClass, TimeClass:
+							opts.permitDates = true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(str.Value), &doc); err != nil {
+		return newError("Psych::SyntaxError: %s", strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	// An empty document loads as false, like Psych
+	if len(doc.Content) == 0 {
+		return object.FALSE
+	}
+	return yamlNodeToRuby(doc.Content[0], opts)
+}
+
+// yamlNodeToRuby converts a parsed YAML node to a Ruby object, keeping
+// mapping order and resolving scalars with YAML 1.1 rules as Psych does.
+func yamlNodeToRuby(node *yaml.Node, opts yamlLoadOptions) object.Object {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return object.NIL
+		}
+		return yamlNodeToRuby(node.Content[0], opts)
+	case yaml.AliasNode:
+		if !opts.aliases {
+			return newError("Psych::AliasesNotEnabled: Alias parsing was not enabled. To enable it, pass `aliases: true` to `Psych::load` or `Psych::safe_load`.")
+		}
+		return yamlNodeToRuby(node.Alias, opts)
+	case yaml.SequenceNode:
+		elements := make([]object.Object, len(node.Content))
+		for i, child := range node.Content {
+			elem := yamlNodeToRuby(child, opts)
+			if isError(elem) {
+				return elem
+			}
+			elements[i] = elem
 		}
 		return &object.Array{Elements: elements}
-	case map[string]interface{}:
-		pairs := make(map[object.HashKey]object.HashPair)
-		order := make([]object.HashKey, 0, len(v))
-		for key, val := range v {
-			keyObj := &object.String{Value: key}
-			hashed := keyObj.HashKey()
-			pairs[hashed] = object.HashPair{Key: keyObj, Value: yamlToRuby(val)}
-			order = append(order, hashed)
-		}
-		return &object.Hash{Pairs: pairs, Order: order}
-	case map[interface{}]interface{}:
-		pairs := make(map[object.HashKey]object.HashPair)
-		order := make([]object.HashKey, 0, len(v))
-		for key, val := range v {
-			keyObj := yamlToRuby(key)
-			if hashable, ok := keyObj.(object.Hashable); ok {
-				hashed := hashable.HashKey()
-				pairs[hashed] = object.HashPair{Key: keyObj, Value: yamlToRuby(val)}
-				order = append(order, hashed)
-			}
-		}
-		return &object.Hash{Pairs: pairs, Order: order}
-	default:
-		return &object.String{Value: ""}
+	case yaml.MappingNode:
+		hash := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair)}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode, valNode := node.Content[i], node.Content[i+1]
+			val := yamlNodeToRuby(valNode, opts)
+			if isError(val) {
+				return val
+			}
+			// << merges the keys of another mapping
+			if keyNode.ShortTag() == "!!merge" {
+				if merged, ok := val.(*object.Hash); ok {
+					for _, hk := range merged.Order {
+						if _, exists := hash.Pairs[hk]; !exists {
+							pair := merged.Pairs[hk]
+							hashSet(hash, pair.Key, pair.Value)
+						}
+					}
+				}
+				continue
+			}
+			key := yamlNodeToRuby(keyNode, opts)
+			if isError(key) {
+				return key
+			}
+			if s, ok := key.(*object.String); ok && opts.symbolizeNames {
+				key = &object.Symbol{Value: s.Value}
+			}
+			hashSet(hash, key, val)
+		}
+		return hash
 	}
+	return yamlScalarToRuby(node, opts)
 }
 
-// rubyToYAML converts a Ruby object to YAML string
+func yamlScalarToRuby(node *yaml.Node, opts yamlLoadOptions) object.Object {
+	value := node.Value
+	switch node.ShortTag() {
+	case "!!null":
+		return object.NIL
+	case "!!bool":
+		return object.NativeToBool(strings.EqualFold(value, "true"))
+	case "!!int":
+		clean := strings.ReplaceAll(value, "_", "")
+		if n, err := strconv.ParseInt(clean, 0, 64); err == nil {
+			return &object.Integer{Value: n}
+		}
+	case "!!float":
+		switch strings.ToLower(value) {
+		case ".inf", "+.inf":
+			return &object.Float{Value: math.Inf(1)}
+		case "-.inf":
+			return &object.Float{Value: math.Inf(-1)}
+		case ".nan":
+			return &object.Float{Value: math.NaN()}
+		}
+		if f, err := strconv.ParseFloat(strings.ReplaceAll(value, "_", ""), 64); err == nil {
+			return &object.Float{Value: f}
+		}
+	case "!!timestamp":
+		if !opts.permitDates {
+			return newError("Psych::DisallowedClass: Tried to load unspecified class: Date")
+		}
+		if t, err := time.Parse("2006-01-02", value); err == nil {
+			return &object.Date{Value: t}
+		}
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return &object.Time{Value: t}
+		}
+	}
+
+	if node.Style == 0 {
+		// YAML 1.1 booleans that YAML 1.2 reads as strings
+		switch strings.ToLower(value) {
+		case "yes", "on":
+			return object.TRUE
+		case "no", "off":
+			return object.FALSE
+		}
+		if len(value) > 1 && value[0] == ':' {
+			if !opts.permitSymbols {
+				return newError("Psych::DisallowedClass: Tried to load unspecified class: Symbol")
+			}
+			return &object.Symbol{Value: strings.Trim(value[1:], `"'`)}
+		}
+	}
+	return &object.String{Value: value}
+}
+
+// getToYAMLBuiltin returns the to_yaml method shared by all objects
+func getToYAMLBuiltin() *object.Builtin {
+	return &object.Builtin{
+		Name: "to_yaml",
+		Fn: func(receiver object.Object, env *object.Environment, args ...object.Object) object.Object {
+			return rubyToYAML(receiver)
+		},
+	}
+}
+
+// rubyToYAML converts a Ruby object to a YAML document in Psych's layout
 func rubyToYAML(obj object.Object) object.Object {
-	data := rubyToGo(obj)
-	bytes, err := yaml.Marshal(data)
-	if err != nil {
-		return newError("YAML dump error: %s", err.Error())
+	var out strings.Builder
+	out.WriteString("---")
+	switch o := obj.(type) {
+	case *object.Array:
+		if len(o.Elements) == 0 {
+			out.WriteString(" []\n")
+		} else {
+			out.WriteString("\n")
+			writeYAML(&out, obj, 0)
+		}
+	case *object.Hash:
+		if len(o.Order) == 0 {
+			out.WriteString(" {}\n")
+		} else {
+			out.WriteString("\n")
+			writeYAML(&out, obj, 0)
+		}
+	default:
+		// A block scalar's lines are indented under the document marker
+		out.WriteString(" " + yamlScalar(obj, 2) + "\n")
+	}
+	return &object.String{Value: out.String()}
+}
+
+// writeYAML writes a non-empty collection in block style at the given
+// indentation. Sequences nested in a mapping share the key's indentation.
+func writeYAML(out *strings.Builder, obj object.Object, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch o := obj.(type) {
+	case *object.Array:
+		for _, elem := range o.Elements {
+			out.WriteString(pad + "-")
+			writeYAMLValue(out, elem, indent+2, true)
+		}
+	case *object.Hash:
+		for _, hk := range o.Order {
+			pair := o.Pairs[hk]
+			out.WriteString(pad + yamlScalar(pair.Key, indent) + ":")
+			writeYAMLValue(out, pair.Value, indent, false)
+		}
+	}
+}
+
+// writeYAMLValue writes the value that follows "-" or "key:".
+func writeYAMLValue(out *strings.Builder, val object.Object, indent int, inSequence bool) {
+	switch v := val.(type) {
+	case *object.Array:
+		if len(v.Elements) == 0 {
+			out.WriteString(" []\n")
+			return
+		}
+		if inSequence {
+			// - - a
+			//   - b
+			var nested strings.Builder
+			writeYAML(&nested, v, indent)
+			out.WriteString(" " + strings.TrimPrefix(nested.String(), strings.Repeat(" ", indent)))
+			return
+		}
+		out.WriteString("\n")
+		writeYAML(out, v, indent)
+	case *object.Hash:
+		if len(v.Order) == 0 {
+			out.WriteString(" {}\n")
+			return
+		}
+		if inSequence {
+			var nested strings.Builder
+			writeYAML(&nested, v, indent)
+			out.WriteString(" " + strings.TrimPrefix(nested.String(), strings.Repeat(" ", indent)))
+			return
+		}
+		out.WriteString("\n")
+		writeYAML(out, v, indent+2)
+	default:
+		if !inSequence {
+			indent += 2
+		}
+		out.WriteString(" " + yamlScalar(val, indent) + "\n")
+	}
+}
+
+// yamlScalar formats a scalar, quoting strings that would otherwise load
+// as another type. Multi-line strings use a literal block at indent.
+func yamlScalar(obj object.Object, indent int) string {
+	switch o := obj.(type) {
+	case *object.Nil:
+		return ""
+	case *object.Boolean, *object.Integer:
+		return o.Inspect()
+	case *object.Float:
+		switch {
+		case math.IsInf(o.Value, 1):
+			return ".inf"
+		case math.IsInf(o.Value, -1):
+			return "-.inf"
+		case math.IsNaN(o.Value):
+			return ".nan"
+		}
+		s := strconv.FormatFloat(o.Value, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eE") {
+			s += ".0"
+		}
+		return s
+	case *object.Symbol:
+		return ":" + o.Value
+	case *object.String:
+		return yamlString(o.Value, indent)
+	case *object.Date:
+		if o.DateTime {
+			return o.Value.Format("2006-01-02 15:04:05.000000000 -07:00")
+		}
+		return o.Value.Format("2006-01-02")
+	case *object.Time:
+		return o.Value.Format("2006-01-02 15:04:05.000000000 -07:00")
+	}
+	return yamlString(obj.Inspect(), indent)
+}
+
+func yamlString(s string, indent int) string {
+	if strings.Contains(s, "\n") {
+		header := "|"
+		body := s
+		if strings.HasSuffix(s, "\n") {
+			body = strings.TrimSuffix(s, "\n")
+		} else {
+			header = "|-"
+		}
+		pad := strings.Repeat(" ", indent)
+		lines := strings.Split(body, "\n")
+		for i, line := range lines {
+			if line != "" {
+				lines[i] = pad + line
+			}
+		}
+		return header + "\n" + strings.Join(lines, "\n")
+	}
+	if yamlNeedsQuotes(s) {
+		if strings.ContainsFunc(s, func(r rune) bool { return !strconv.IsPrint(r) }) {
+			return strconv.Quote(s)
+		}
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	}
+	return s
+}
+
+// yamlNeedsQuotes reports whether a plain string would be read back as
+// something else, such as a number, boolean, null, symbol or syntax.
+func yamlNeedsQuotes(s string) bool {
+	if s == "" || strings.TrimSpace(s) != s {
+		return true
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "~", "y", "n":
+		return true
+	}
+	if _, err := strconv.ParseFloat(strings.ReplaceAll(s, "_", ""), 64); err == nil {
+		return true
+	}
+	if strings.ContainsRune("-?:,[]{}#&*!|>'\"%@`", rune(s[0])) {
+		return true
 	}
-	return &object.String{Value: string(bytes)}
+	return strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") ||
+		strings.ContainsFunc(s, func(r rune) bool { return !strconv.IsPrint(r) })
 }
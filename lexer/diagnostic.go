@@ -0,0 +1,80 @@
+package lexer
+
+import "github.com/alexisbouchez/rubylexer/token"
+
+// DiagnosticKind says what kind of problem a Diagnostic reports.
+type DiagnosticKind int
+
+const (
+	UnterminatedString DiagnosticKind = iota
+	UnterminatedRegexp
+	UnterminatedList
+	UnterminatedHeredoc
+	UnterminatedEmbdoc
+)
+
+var diagnosticKindNames = map[DiagnosticKind]string{
+	UnterminatedString:  "UnterminatedString",
+	UnterminatedRegexp:  "UnterminatedRegexp",
+	UnterminatedList:    "UnterminatedList",
+	UnterminatedHeredoc: "UnterminatedHeredoc",
+	UnterminatedEmbdoc:  "UnterminatedEmbdoc",
+}
+
+func (k DiagnosticKind) String() string {
+	if name, ok := diagnosticKindNames[k]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// Diagnostic is a problem the lexer found in its input and recovered from.
+// Pos is where the construct at fault starts, which is where the mistake
+// usually is, rather than the end of the input where it came to light.
+type Diagnostic struct {
+	Kind    DiagnosticKind
+	Message string
+	Pos     token.Pos
+}
+
+func (d Diagnostic) Error() string {
+	return d.Pos.String() + ": " + d.Message
+}
+
+// Diagnostics returns the problems found in the input lexed so far. A
+// string, regexp, word list, heredoc or embedded document left open at the
+// end of the input is reported here and closed by a terminator token with
+// an empty literal, so that a parser can carry on.
+func (l *Lexer) Diagnostics() []Diagnostic {
+	return l.diagnostics
+}
+
+// unterminated reports that state is still open at the end of the input
+// and returns the token that closes it in its place.
+func (l *Lexer) unterminated(state *stringState) token.Token {
+	var d Diagnostic
+	tokenType := token.STRING_END
+	switch state.mode {
+	case modeRegexp, modePercentR:
+		d = Diagnostic{Kind: UnterminatedRegexp, Message: "unterminated regexp meets end of file"}
+		tokenType = token.REGEXP_END
+	case modePercentW, modePercentWUpper, modePercentI, modePercentIUpper:
+		d = Diagnostic{Kind: UnterminatedList, Message: "unterminated list meets end of file"}
+	case modeHeredoc:
+		d = Diagnostic{Kind: UnterminatedHeredoc, Message: "can't find string \"" + state.heredocIdent + "\" anywhere before EOF"}
+		tokenType = token.HEREDOC_END
+	case modeNone:
+		d = Diagnostic{Kind: UnterminatedEmbdoc, Message: "embedded document meets end of file"}
+		tokenType = token.EMBDOC_END
+	default:
+		d = Diagnostic{Kind: UnterminatedString, Message: "unterminated string meets end of file"}
+	}
+	d.Pos = state.start
+	l.diagnostics = append(l.diagnostics, d)
+	if state.mode == modeHeredoc {
+		l.endHeredoc(state)
+	} else {
+		l.popStringState()
+	}
+	return l.newToken(tokenType, "")
+}
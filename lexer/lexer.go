@@ -2,7 +2,14 @@
 package lexer
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/alexisbouchez/rubylexer/token"
 )
@@ -42,7 +49,27 @@ type stringState struct {
 	heredocIndented bool
 	heredocSquiggle bool
 	heredocQuoted   bool
-	savedBraceDepth int // Saved brace depth when entering string during interpolation
+	heredocDedent   int       // indentation stripped from squiggly heredoc lines
+	atLineStart     bool      // the next character starts a line of the body
+	savedBraceDepth int       // Saved brace depth when entering string during interpolation
+	start           token.Pos // where the literal starts, for diagnostics
+	resume          *cursor   // where lexing goes back to once a heredoc body ends
+	lineEnd         int       // offset of the newline ending the line a heredoc starts on
+}
+
+// cursor is a position in the input the lexer can return to.
+type cursor struct {
+	position, readPosition   int
+	ch                       byte
+	line, column, prevColumn int
+}
+
+// heredocSkip says that once the newline at lineEnd has been lexed,
+// lexing goes on at bodyEnd, past the bodies of the heredocs started on
+// that line.
+type heredocSkip struct {
+	lineEnd int
+	bodyEnd cursor
 }
 
 // Lexer represents a lexer for Ruby source code.
@@ -72,10 +99,33 @@ type Lexer struct {
 	sawNewline         bool
 	startOfLine        bool
 	afterDot           bool
+	afterIn            bool // a bare hash pattern may follow the in of case/in
+	afterDef           bool // the next token names the method a def defines
+	defReceiver        bool // the def names a receiver, as in def self.+
 
 	// Heredoc queue for deferred processing
 	heredocQueue []stringState
 	heredocPos   int
+	heredocSkip  *heredocSkip
+
+	// Magic comments from the comments at the top of the file
+	magicComments map[string]string
+	pastHeader    bool // code has been seen, so comments are plain again
+
+	data *string // the text after __END__
+
+	tokenStart  token.Pos // where the token being lexed starts
+	diagnostics []Diagnostic
+
+	// Trivia between tokens, kept when preserveTrivia is set
+	preserveTrivia bool
+	triviaStart    int // offset where the trivia before the next token begins
+
+	// Input still to be read, for a Lexer made by NewReader. The input is
+	// buffered a line at a time, so the current line is always complete.
+	reader  *bufio.Reader
+	source  strings.Builder
+	readErr error
 }
 
 // New creates a new Lexer instance.
@@ -91,8 +141,45 @@ func New(input string) *Lexer {
 	return l
 }
 
+// NewReader creates a Lexer that reads its input from r as tokens need
+// it, instead of all up front.
+func NewReader(r io.Reader) *Lexer {
+	l := &Lexer{
+		line:        1,
+		column:      0,
+		stringStack: make([]stringState, 0),
+		startOfLine: true,
+		reader:      bufio.NewReader(r),
+	}
+	l.readChar()
+	return l
+}
+
+// Err returns the error, if any, that stopped reading the input of a Lexer
+// made by NewReader. The end of the input is not an error.
+func (l *Lexer) Err() error {
+	return l.readErr
+}
+
+// fill buffers input until it holds pos or there is no more.
+func (l *Lexer) fill(pos int) {
+	for l.reader != nil && pos >= len(l.input) {
+		line, err := l.reader.ReadString('\n')
+		l.source.WriteString(line)
+		// The builder only ever appends, so this does not copy the input
+		l.input = l.source.String()
+		if err != nil {
+			if err != io.EOF {
+				l.readErr = err
+			}
+			l.reader = nil
+		}
+	}
+}
+
 func (l *Lexer) readChar() {
 	l.prevColumn = l.column
+	l.fill(l.readPosition)
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -108,7 +195,22 @@ func (l *Lexer) readChar() {
 	}
 }
 
+// mark returns the current position, for seek to return to.
+func (l *Lexer) mark() cursor {
+	return cursor{l.position, l.readPosition, l.ch, l.line, l.column, l.prevColumn}
+}
+
+// seek moves the lexer to c, where it was when mark returned it.
+func (l *Lexer) seek(c cursor) {
+	l.position, l.readPosition, l.ch = c.position, c.readPosition, c.ch
+	l.line, l.column, l.prevColumn = c.line, c.column, c.prevColumn
+	if l.triviaStart > c.position {
+		l.triviaStart = c.position
+	}
+}
+
 func (l *Lexer) peekChar() byte {
+	l.fill(l.readPosition)
 	if l.readPosition >= len(l.input) {
 		return 0
 	}
@@ -117,14 +219,68 @@ func (l *Lexer) peekChar() byte {
 
 func (l *Lexer) peekCharN(n int) byte {
 	pos := l.readPosition + n - 1
+	l.fill(pos)
 	if pos >= len(l.input) {
 		return 0
 	}
 	return l.input[pos]
 }
 
-// NextToken returns the next token from the input.
+// SpaceFollows reports whether the most recently returned token is
+// followed by whitespace or the end of input.
+func (l *Lexer) SpaceFollows() bool {
+	return l.ch == ' ' || l.ch == '\t' || l.ch == '\r' || l.ch == '\n' || l.ch == 0
+}
+
+// Pos returns the position of the character after the most recently
+// returned token, which is where that token ends.
+func (l *Lexer) Pos() token.Pos {
+	if l.ch == '\n' {
+		// readChar has already moved line and column past the newline
+		return token.Pos{Line: l.line - 1, Column: l.prevColumn + 1, Offset: l.position}
+	}
+	return token.Pos{Line: l.line, Column: l.column, Offset: l.position}
+}
+
+// NextToken returns the next token from the input. Every token carries
+// where it starts and ends; when trivia is preserved, comments are not
+// returned but kept, along with any whitespace, as the Trivia of the token
+// that follows them.
 func (l *Lexer) NextToken() token.Token {
+	for {
+		start := l.Pos()
+		tok := l.lexToken()
+		if !tok.Pos().IsValid() {
+			tok = l.setTokenPosition(tok, start)
+		}
+		if !tok.End().IsValid() {
+			tok = l.setTokenEnd(tok, l.Pos())
+		}
+		if !l.preserveTrivia {
+			return tok
+		}
+		switch tok.Type {
+		case token.COMMENT, token.EMBDOC_BEGIN, token.EMBDOC_LINE, token.EMBDOC_END:
+			continue
+		}
+		if tok.Offset >= l.triviaStart {
+			tok.Trivia = l.input[l.triviaStart:tok.Offset]
+		}
+		if tok.EndOffset > l.triviaStart {
+			l.triviaStart = tok.EndOffset
+		}
+		return tok
+	}
+}
+
+// PreserveTrivia sets whether the lexer keeps the whitespace and comments
+// between tokens. Concatenating the Trivia and source text of every token
+// then gives back the input, which is what a formatter needs.
+func (l *Lexer) PreserveTrivia(preserve bool) {
+	l.preserveTrivia = preserve
+}
+
+func (l *Lexer) lexToken() token.Token {
 	var tok token.Token
 
 	// If we're inside a string, handle string content
@@ -139,9 +295,19 @@ func (l *Lexer) NextToken() token.Token {
 
 	l.skipWhitespace()
 
-	startLine := l.line
-	startColumn := l.column
-	startOffset := l.position
+	start := l.Pos()
+	l.tokenStart = start
+
+	if l.afterDef {
+		l.afterDef = false
+		if name := l.readOperatorMethodName(); name != "" {
+			l.afterIdent = true
+			l.afterOperator = false
+			tok = l.newToken(token.METHOD_NAME, name)
+			return l.setTokenPosition(tok, start)
+		}
+		l.defReceiver = l.receiverFollows()
+	}
 
 	switch l.ch {
 	case '\n':
@@ -155,12 +321,23 @@ func (l *Lexer) NextToken() token.Token {
 		l.afterRightParen = false
 		l.afterRightBracket = false
 		l.afterDot = false
-		// If we have pending heredocs, start processing them
-		if len(l.heredocQueue) > 0 {
-			// Return the newline first, heredoc will be processed on next call
+		l.afterIn = false
+		if skip := l.heredocSkip; skip != nil && start.Offset == skip.lineEnd {
+			// The line's heredoc bodies have been lexed already
+			tok = l.setTokenEnd(tok, l.Pos())
+			l.heredocSkip = nil
+			l.seek(skip.bodyEnd)
+			l.triviaStart = skip.bodyEnd.position
 		}
-		return l.setTokenPosition(tok, startLine, startColumn, startOffset)
+		return l.setTokenPosition(tok, start)
 	case 0:
+		// Close an interpolation left open, so the string it is in can
+		// report that it is unterminated
+		if l.braceDepth > 0 && len(l.stringStack) > 0 {
+			l.braceDepth = 0
+			l.currentState = &l.stringStack[len(l.stringStack)-1]
+			return l.setTokenPosition(l.newToken(token.EMBEXPR_END, ""), start)
+		}
 		tok.Type = token.EOF
 		tok.Literal = ""
 	case '+':
@@ -327,7 +504,7 @@ func (l *Lexer) NextToken() token.Token {
 			tok = l.newToken(token.EQUAL_GREATER, "=>")
 		} else if l.startOfLine && l.peekChar() == 'b' {
 			// Check for =begin
-			if l.readPosition+4 <= len(l.input) && l.input[l.readPosition:l.readPosition+5] == "begin" {
+			if l.readPosition+5 <= len(l.input) && l.input[l.readPosition:l.readPosition+5] == "begin" {
 				return l.lexEmbeddedDoc()
 			}
 			tok = l.newToken(token.EQUAL, "=")
@@ -363,7 +540,9 @@ func (l *Lexer) NextToken() token.Token {
 		} else {
 			tok = l.newToken(token.DOT, ".")
 			l.afterDot = true
+			l.afterDef = l.defReceiver
 		}
+		l.defReceiver = false
 		l.readChar()
 	case ':':
 		if l.peekChar() == ':' {
@@ -380,7 +559,7 @@ func (l *Lexer) NextToken() token.Token {
 			l.readChar()
 			tok = l.newToken(token.SYMBOL_BEGIN, ":'")
 			l.pushStringState(modeSymbolSingleQuote, '\'', 0, false)
-		} else if isLetter(l.peekChar()) || l.peekChar() == '_' {
+		} else if isIdentStart(l.peekChar()) {
 			tok = l.newToken(token.SYMBOL_BEGIN, ":")
 		} else {
 			tok = l.newToken(token.COLON, ":")
@@ -390,6 +569,8 @@ func (l *Lexer) NextToken() token.Token {
 		tok = l.newToken(token.COMMA, ",")
 		l.afterOperator = true
 		l.afterIdent = false // Reset to allow regex after ,
+		l.afterRightParen = false
+		l.afterRightBracket = false
 		l.readChar()
 	case ';':
 		tok = l.newToken(token.SEMICOLON, ";")
@@ -434,7 +615,7 @@ func (l *Lexer) NextToken() token.Token {
 				l.readChar()
 				// Pop the interpolation state and restore string state
 				l.currentState = &l.stringStack[len(l.stringStack)-1]
-				return l.setTokenPosition(tok, startLine, startColumn, startOffset)
+				return l.setTokenPosition(tok, start)
 			}
 		}
 		tok = l.newToken(token.RBRACE, "}")
@@ -468,29 +649,29 @@ func (l *Lexer) NextToken() token.Token {
 			// Line continuation
 			l.readChar() // consume backslash
 			l.readChar() // consume newline
-			return l.NextToken()
+			return l.lexToken()
 		}
 		tok = l.newToken(token.BACKSLASH, "\\")
 		l.readChar()
 	case '@':
 		tok = l.lexInstanceOrClassVariable()
 		// If we were in variable interpolation mode, restore string state
-		if len(l.stringStack) > 0 && l.currentState == nil {
+		if len(l.stringStack) > 0 && l.currentState == nil && l.braceDepth == 0 {
 			l.currentState = &l.stringStack[len(l.stringStack)-1]
 		}
 	case '$':
 		tok = l.lexGlobalVariable()
 		// If we were in variable interpolation mode, restore string state
-		if len(l.stringStack) > 0 && l.currentState == nil {
+		if len(l.stringStack) > 0 && l.currentState == nil && l.braceDepth == 0 {
 			l.currentState = &l.stringStack[len(l.stringStack)-1]
 		}
 	default:
-		if isLetter(l.ch) || l.ch == '_' {
+		if isIdentStart(l.ch) {
 			tok = l.lexIdentifier()
-			return l.setTokenPosition(tok, startLine, startColumn, startOffset)
+			return l.setTokenPosition(tok, start)
 		} else if isDigit(l.ch) {
 			tok = l.lexNumber()
-			return l.setTokenPosition(tok, startLine, startColumn, startOffset)
+			return l.setTokenPosition(tok, start)
 		} else {
 			tok = l.newToken(token.ILLEGAL, string(l.ch))
 			l.readChar()
@@ -501,13 +682,20 @@ func (l *Lexer) NextToken() token.Token {
 	if tok.Type != token.NEWLINE && tok.Type != token.EOF {
 		l.startOfLine = false
 	}
-	return l.setTokenPosition(tok, startLine, startColumn, startOffset)
+	return l.setTokenPosition(tok, start)
 }
 
-func (l *Lexer) setTokenPosition(tok token.Token, line, column, offset int) token.Token {
-	tok.Line = line
-	tok.Column = column
-	tok.Offset = offset
+func (l *Lexer) setTokenPosition(tok token.Token, start token.Pos) token.Token {
+	tok.Line = start.Line
+	tok.Column = start.Column
+	tok.Offset = start.Offset
+	return tok
+}
+
+func (l *Lexer) setTokenEnd(tok token.Token, end token.Pos) token.Token {
+	tok.EndLine = end.Line
+	tok.EndColumn = end.Column
+	tok.EndOffset = end.Offset
 	return tok
 }
 
@@ -515,6 +703,40 @@ func (l *Lexer) newToken(tokenType token.Type, literal string) token.Token {
 	return token.Token{Type: tokenType, Literal: literal}
 }
 
+// operatorMethodNames are the operators a class can define, longest
+// first so that each matches whole.
+var operatorMethodNames = []string{
+	"[]=", "[]", "===", "==", "=~", "!=", "!~", "!", "<=>", "<=", "<<", "<",
+	">=", ">>", ">", "+@", "-@", "+", "-", "**", "*", "/", "%", "&", "|", "^",
+	"~", "`",
+}
+
+// readOperatorMethodName consumes an operator used as a method name after
+// def, as in def +(other) or def []=(key, value), returning "" if the input
+// does not start with one. This keeps /, % and ` from starting literals.
+func (l *Lexer) readOperatorMethodName() string {
+	rest := l.input[l.position:]
+	for _, name := range operatorMethodNames {
+		if strings.HasPrefix(rest, name) {
+			for range name {
+				l.readChar()
+			}
+			return name
+		}
+	}
+	return ""
+}
+
+// receiverFollows reports whether the input starts with an identifier and
+// a single dot, the receiver of a singleton method definition.
+func (l *Lexer) receiverFollows() bool {
+	i := l.position
+	for i < len(l.input) && isIdentChar(l.input[i]) {
+		i++
+	}
+	return i > l.position && i+1 < len(l.input) && l.input[i] == '.' && l.input[i+1] != '.'
+}
+
 func (l *Lexer) skipWhitespace() {
 	for l.ch == ' ' || l.ch == '\t' || l.ch == '\r' {
 		l.readChar()
@@ -523,7 +745,7 @@ func (l *Lexer) skipWhitespace() {
 
 func (l *Lexer) lexIdentifier() token.Token {
 	startPos := l.position
-	for isLetter(l.ch) || isDigit(l.ch) || l.ch == '_' {
+	for isIdentChar(l.ch) {
 		l.readChar()
 	}
 
@@ -565,7 +787,7 @@ func (l *Lexer) lexIdentifier() token.Token {
 	// Labels are allowed at start of line, after operators, after {, after (, after [, after ,
 	if l.ch == ':' && l.peekChar() != ':' {
 		// Check if this could be a label context
-		if l.inLabelContext || l.afterOperator || l.startOfLine {
+		if l.inLabelContext || l.afterOperator || l.startOfLine || l.afterIn {
 			literal += ":"
 			l.readChar()
 			l.afterIdent = false
@@ -576,10 +798,14 @@ func (l *Lexer) lexIdentifier() token.Token {
 	// Check if it's a keyword
 	tokType := token.LookupIdent(literal)
 
-	// Handle special __END__ case
-	if literal == "__END__" && l.startOfLine {
+	// Handle special __END__ case: a line of its own ends the program and
+	// the rest of the input is its data
+	if literal == "__END__" && l.startOfLine && l.atEndOfLine() {
 		l.afterKeyword = false
 		l.afterIdent = false
+		l.fill(math.MaxInt)
+		data := strings.TrimPrefix(strings.TrimPrefix(l.input[l.position:], "\r"), "\n")
+		l.data = &data
 		// Skip all remaining content
 		l.position = len(l.input)
 		l.readPosition = len(l.input)
@@ -587,6 +813,8 @@ func (l *Lexer) lexIdentifier() token.Token {
 		return l.newToken(token.END_MARKER, literal)
 	}
 
+	l.afterIn = tokType == token.KEYWORD_IN
+	l.afterDef = tokType == token.KEYWORD_DEF
 	if tokType.IsKeyword() {
 		l.afterKeyword = true
 		l.afterIdent = false
@@ -727,7 +955,7 @@ func (l *Lexer) lexInstanceOrClassVariable() token.Token {
 	if l.ch == '@' {
 		// Class variable
 		l.readChar()
-		for isLetter(l.ch) || isDigit(l.ch) || l.ch == '_' {
+		for isIdentChar(l.ch) {
 			l.readChar()
 		}
 		l.afterIdent = true
@@ -735,7 +963,7 @@ func (l *Lexer) lexInstanceOrClassVariable() token.Token {
 	}
 
 	// Instance variable
-	for isLetter(l.ch) || isDigit(l.ch) || l.ch == '_' {
+	for isIdentChar(l.ch) {
 		l.readChar()
 	}
 	l.afterIdent = true
@@ -774,7 +1002,7 @@ func (l *Lexer) lexGlobalVariable() token.Token {
 	}
 
 	// Regular global variable
-	for isLetter(l.ch) || isDigit(l.ch) || l.ch == '_' {
+	for isIdentChar(l.ch) {
 		l.readChar()
 	}
 	l.afterIdent = true
@@ -783,10 +1011,94 @@ func (l *Lexer) lexGlobalVariable() token.Token {
 
 func (l *Lexer) lexComment() token.Token {
 	startPos := l.position
+	startLine := l.line
 	for l.ch != '\n' && l.ch != 0 {
 		l.readChar()
 	}
-	return l.newToken(token.COMMENT, l.input[startPos:l.position])
+	text := l.input[startPos:l.position]
+	if l.inHeader(startPos) {
+		l.recordMagicComment(text, startLine)
+	}
+	return l.newToken(token.COMMENT, text)
+}
+
+// Data returns the text after the __END__ line, and whether the input
+// has one.
+func (l *Lexer) Data() (string, bool) {
+	if l.data == nil {
+		return "", false
+	}
+	return *l.data, true
+}
+
+// atEndOfLine reports whether only a line break or the end of input
+// follows.
+func (l *Lexer) atEndOfLine() bool {
+	return l.ch == 0 || l.ch == '\n' || (l.ch == '\r' && l.peekChar() == '\n')
+}
+
+// MagicComments returns the magic comments found at the top of the input,
+// such as frozen_string_literal or encoding, keyed by their lower-case
+// name with dashes as underscores. "coding" is recorded as "encoding".
+func (l *Lexer) MagicComments() map[string]string {
+	return l.magicComments
+}
+
+// magicCommentNames lists the magic comments Ruby knows; other comments
+// that look like name: value are plain comments.
+var magicCommentNames = map[string]bool{
+	"encoding":                 true,
+	"frozen_string_literal":    true,
+	"warn_indent":              true,
+	"shareable_constant_value": true,
+}
+
+// inHeader reports whether only blank lines and comments come before pos.
+func (l *Lexer) inHeader(pos int) bool {
+	if l.pastHeader {
+		return false
+	}
+	for _, line := range strings.Split(l.input[:pos], "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			l.pastHeader = true
+			return false
+		}
+	}
+	return true
+}
+
+// recordMagicComment records the name: value pairs of a magic comment,
+// written either as "# name: value" or Emacs style as
+// "# -*- name: value; other: value -*-". An encoding only counts on the
+// first two lines, where it may follow a shebang.
+func (l *Lexer) recordMagicComment(comment string, line int) {
+	text := strings.TrimSpace(strings.TrimPrefix(comment, "#"))
+	pairs := []string{text}
+	if start := strings.Index(text, "-*-"); start >= 0 {
+		if end := strings.LastIndex(text, "-*-"); end > start {
+			pairs = strings.Split(text[start+3:end], ";")
+		}
+	}
+
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, ":")
+		name = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), "-", "_"))
+		value = strings.TrimSpace(value)
+		if name == "coding" {
+			name = "encoding"
+		}
+		if !ok || !magicCommentNames[name] || value == "" || strings.ContainsAny(value, " \t") {
+			continue
+		}
+		if name == "encoding" && line > 2 {
+			continue
+		}
+		if l.magicComments == nil {
+			l.magicComments = make(map[string]string)
+		}
+		l.magicComments[name] = value
+	}
 }
 
 func (l *Lexer) lexEmbeddedDoc() token.Token {
@@ -800,12 +1112,13 @@ func (l *Lexer) lexEmbeddedDoc() token.Token {
 	for l.ch != '\n' && l.ch != 0 {
 		l.readChar()
 	}
+	end := l.Pos()
 	if l.ch == '\n' {
 		l.readChar()
 	}
 
 	// Store the =begin token position
-	tok := l.newToken(token.EMBDOC_BEGIN, "=begin")
+	tok := l.setTokenEnd(l.newToken(token.EMBDOC_BEGIN, "=begin"), end)
 	tok.Line = l.line - 1
 	tok.Column = 1
 	tok.Offset = startPos
@@ -826,6 +1139,9 @@ func (l *Lexer) lexCharLiteral() token.Token {
 		l.readChar() // consume escaped char
 	} else {
 		l.readChar() // consume char
+		for !utf8.RuneStart(l.ch) {
+			l.readChar()
+		}
 	}
 
 	return l.newToken(token.CHAR, l.input[startPos:l.position])
@@ -885,7 +1201,7 @@ func (l *Lexer) isHeredocStart() bool {
 	// Check for identifier, quoted identifier, or backtick
 	if pos < len(l.input) {
 		ch := l.input[pos]
-		return isLetter(ch) || ch == '_' || ch == '"' || ch == '\'' || ch == '`'
+		return isIdentStart(ch) || ch == '"' || ch == '\'' || ch == '`'
 	}
 	return false
 }
@@ -917,7 +1233,7 @@ func (l *Lexer) lexHeredocBegin() token.Token {
 	// Read identifier
 	l.readChar()
 	identStart := l.position
-	for isLetter(l.ch) || isDigit(l.ch) || l.ch == '_' {
+	for isIdentChar(l.ch) {
 		l.readChar()
 	}
 	ident := l.input[identStart:l.position]
@@ -928,10 +1244,36 @@ func (l *Lexer) lexHeredocBegin() token.Token {
 	}
 
 	literal := l.input[startPos:l.position]
-
-	// Consume the newline that follows the heredoc declaration
-	if l.ch == '\n' {
+	end := l.Pos()
+
+	// The body starts on the next line, after the bodies of any heredocs
+	// started earlier on this one. When code follows the declaration, as
+	// in foo(<<~EOS, 1), lexing comes back to it once the body ends.
+	lineEnd := l.position
+	for l.ch != '\n' && l.ch != 0 && lineEnd < len(l.input) && l.input[lineEnd] != '\n' {
+		lineEnd++
+	}
+	rest := strings.TrimSpace(l.input[l.position:lineEnd])
+	var resume *cursor
+	if skip := l.heredocSkip; skip != nil && skip.lineEnd == lineEnd {
+		c := l.mark()
+		resume = &c
+		l.seek(skip.bodyEnd)
+	} else if rest != "" && !strings.HasPrefix(rest, "#") {
+		c := l.mark()
+		resume = &c
+		for l.ch != '\n' && l.ch != 0 {
+			l.readChar()
+		}
 		l.readChar()
+	} else {
+		// Skip anything else on the line, such as a comment
+		for l.ch != '\n' && l.ch != 0 {
+			l.readChar()
+		}
+		if l.ch == '\n' {
+			l.readChar()
+		}
 	}
 
 	// Push heredoc state for immediate processing
@@ -942,13 +1284,24 @@ func (l *Lexer) lexHeredocBegin() token.Token {
 		heredocSquiggle: squiggle,
 		heredocQuoted:   quoted,
 		interpolating:   !quoted || quoteChar != '\'',
+		atLineStart:     true,
+		start:           l.tokenStart,
+		resume:          resume,
+		lineEnd:         lineEnd,
+	}
+	if squiggle {
+		state.heredocDedent = l.heredocIndentation(ident)
 	}
 	l.stringStack = append(l.stringStack, state)
 	l.currentState = &l.stringStack[len(l.stringStack)-1]
 
-	return l.newToken(token.HEREDOC_BEGIN, literal)
+	return l.setTokenEnd(l.newToken(token.HEREDOC_BEGIN, literal), end)
 }
 
+// lexHeredocContent lexes a heredoc body line by line up to its
+// terminator. Bodies that interpolate are split into STRING_CONTENT and
+// embedded expression tokens and have their escapes decoded, just like
+// double-quoted strings; squiggly heredocs lose their common indentation.
 func (l *Lexer) lexHeredocContent() token.Token {
 	state := l.currentState
 	ident := state.heredocIdent
@@ -959,45 +1312,152 @@ func (l *Lexer) lexHeredocContent() token.Token {
 		return l.newToken(token.HEREDOC_END, ident)
 	}
 
-	// Read heredoc content
 	var content strings.Builder
+	start := l.Pos()
+	contentToken := func() token.Token {
+		tok := l.newToken(token.STRING_CONTENT, content.String())
+		return l.setTokenPosition(tok, start)
+	}
 
-	for {
-		lineStart := l.position
+	for l.ch != 0 {
+		if state.atLineStart {
+			if l.atHeredocTerminator(state) {
+				if content.Len() > 0 {
+					return contentToken()
+				}
+				for l.ch == ' ' || l.ch == '\t' {
+					l.readChar()
+				}
+				tok := l.setTokenPosition(l.newToken(token.HEREDOC_END, ident), l.Pos())
+				for l.ch != '\n' && l.ch != 0 {
+					l.readChar()
+				}
+				tok = l.setTokenEnd(tok, l.Pos())
+				l.endHeredoc(state)
+				return tok
+			}
+			state.atLineStart = false
+			for n := 0; n < state.heredocDedent && (l.ch == ' ' || l.ch == '\t'); n++ {
+				l.readChar()
+			}
+			continue
+		}
 
-		// Read the line
-		for l.ch != '\n' && l.ch != 0 {
+		if l.ch == '\n' {
+			content.WriteByte(l.ch)
 			l.readChar()
+			state.atLineStart = true
+			continue
 		}
 
-		line := l.input[lineStart:l.position]
-		trimmedLine := strings.TrimLeft(line, " \t")
-
-		// Check if this is the terminator
-		if (state.heredocIndented && trimmedLine == ident) || (!state.heredocIndented && line == ident) {
-			// Found terminator - set flag and return content
-			state.terminator = 1 // Flag that content has been read
-			return l.newToken(token.STRING_CONTENT, content.String())
+		if !state.interpolating {
+			content.WriteByte(l.ch)
+			l.readChar()
+			continue
 		}
 
-		content.WriteString(line)
-		if l.ch == '\n' {
-			content.WriteByte('\n')
-			l.readChar()
+		if l.ch == '\\' {
+			l.readEscape(&content, state)
+			continue
 		}
 
-		if l.ch == 0 {
-			break
+		if l.ch == '#' {
+			next := l.peekChar()
+			if next == '{' || next == '@' || next == '$' {
+				if content.Len() > 0 {
+					return contentToken()
+				}
+				l.readChar() // consume #
+				l.currentState = nil
+				if next == '@' || next == '$' {
+					return l.newToken(token.EMBVAR, "#")
+				}
+				l.readChar() // consume {
+				l.braceDepth = 1
+				return l.newToken(token.EMBEXPR_BEGIN, "#{")
+			}
 		}
+
+		content.WriteByte(l.ch)
+		l.readChar()
+	}
+
+	if content.Len() > 0 {
+		return contentToken()
 	}
 
+	return l.unterminated(state)
+}
+
+// endHeredoc pops state, a heredoc whose body has been lexed. If code
+// follows its declaration, lexing goes back to it, to skip the body once
+// the line it is on ends.
+func (l *Lexer) endHeredoc(state *stringState) {
+	resume, lineEnd := state.resume, state.lineEnd
 	l.popStringState()
-	return l.newToken(token.STRING_CONTENT, content.String())
+	if resume == nil {
+		return
+	}
+	if l.ch == '\n' {
+		l.readChar()
+	}
+	l.heredocSkip = &heredocSkip{lineEnd: lineEnd, bodyEnd: l.mark()}
+	l.seek(*resume)
+	l.afterIdent = false
+	l.afterOperator = false
+}
+
+// atHeredocTerminator reports whether the line starting at the current
+// position ends the heredoc.
+func (l *Lexer) atHeredocTerminator(state *stringState) bool {
+	line := l.input[l.position:]
+	if end := strings.IndexByte(line, '\n'); end >= 0 {
+		line = line[:end]
+	}
+	line = strings.TrimSuffix(line, "\r")
+	if state.heredocIndented {
+		line = strings.TrimLeft(line, " \t")
+	}
+	return line == state.heredocIdent
+}
+
+// heredocIndentation returns the indentation common to the lines of the
+// squiggly heredoc body starting at the current position. Lines that are
+// blank do not count.
+func (l *Lexer) heredocIndentation(ident string) int {
+	indent := -1
+	pos := l.position
+	for {
+		l.fill(pos)
+		if pos >= len(l.input) {
+			break
+		}
+		line := l.input[pos:]
+		if end := strings.IndexByte(line, '\n'); end >= 0 {
+			line = line[:end+1]
+		}
+		pos += len(line)
+		trimmed := strings.TrimSpace(line)
+		if trimmed == ident {
+			break
+		}
+		if trimmed == "" {
+			continue
+		}
+		width := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent == -1 || width < indent {
+			indent = width
+		}
+	}
+	if indent < 0 {
+		return 0
+	}
+	return indent
 }
 
 func (l *Lexer) lexHeredocBody() token.Token {
 	if len(l.heredocQueue) == 0 {
-		return l.NextToken()
+		return l.lexToken()
 	}
 
 	state := l.heredocQueue[0]
@@ -1148,6 +1608,7 @@ func (l *Lexer) pushStringState(mode stringMode, terminator byte, openDelim byte
 		openDelimiter: openDelim,
 		nestingLevel:  1,
 		interpolating: interpolating,
+		start:         l.tokenStart,
 	}
 	l.stringStack = append(l.stringStack, state)
 	l.currentState = &l.stringStack[len(l.stringStack)-1]
@@ -1161,6 +1622,7 @@ func (l *Lexer) pushStringStateWithBraceDepth(mode stringMode, terminator byte,
 		nestingLevel:    1,
 		interpolating:   interpolating,
 		savedBraceDepth: l.braceDepth, // Save current brace depth
+		start:           l.tokenStart,
 	}
 	l.braceDepth = 0 // Reset for the new string context
 	l.stringStack = append(l.stringStack, state)
@@ -1186,7 +1648,7 @@ func (l *Lexer) popStringState() {
 
 func (l *Lexer) lexStringContent() token.Token {
 	if l.currentState == nil {
-		return l.NextToken()
+		return l.lexToken()
 	}
 
 	// Handle heredoc mode
@@ -1209,9 +1671,7 @@ func (l *Lexer) lexStringContent() token.Token {
 	}
 
 	var content strings.Builder
-	startLine := l.line
-	startColumn := l.column
-	startOffset := l.position
+	start := l.Pos()
 
 	for {
 		if l.ch == 0 {
@@ -1224,7 +1684,7 @@ func (l *Lexer) lexStringContent() token.Token {
 				// End of string
 				if content.Len() > 0 {
 					tok := l.newToken(token.STRING_CONTENT, content.String())
-					return l.setTokenPosition(tok, startLine, startColumn, startOffset)
+					return l.setTokenPosition(tok, start)
 				}
 
 				// Return end token
@@ -1265,12 +1725,7 @@ func (l *Lexer) lexStringContent() token.Token {
 
 		// Check for escape sequences
 		if l.ch == '\\' {
-			content.WriteByte(l.ch)
-			l.readChar()
-			if l.ch != 0 {
-				content.WriteByte(l.ch)
-				l.readChar()
-			}
+			l.readEscape(&content, state)
 			continue
 		}
 
@@ -1281,7 +1736,7 @@ func (l *Lexer) lexStringContent() token.Token {
 				// Expression interpolation
 				if content.Len() > 0 {
 					tok := l.newToken(token.STRING_CONTENT, content.String())
-					return l.setTokenPosition(tok, startLine, startColumn, startOffset)
+					return l.setTokenPosition(tok, start)
 				}
 				l.readChar() // consume #
 				l.readChar() // consume {
@@ -1293,7 +1748,7 @@ func (l *Lexer) lexStringContent() token.Token {
 				// Variable interpolation
 				if content.Len() > 0 {
 					tok := l.newToken(token.STRING_CONTENT, content.String())
-					return l.setTokenPosition(tok, startLine, startColumn, startOffset)
+					return l.setTokenPosition(tok, start)
 				}
 				l.readChar() // consume #
 				l.currentState = nil
@@ -1307,24 +1762,171 @@ func (l *Lexer) lexStringContent() token.Token {
 
 	if content.Len() > 0 {
 		tok := l.newToken(token.STRING_CONTENT, content.String())
-		return l.setTokenPosition(tok, startLine, startColumn, startOffset)
+		return l.setTokenPosition(tok, start)
 	}
 
-	l.popStringState()
-	return l.newToken(token.EOF, "")
+	return l.unterminated(state)
+}
+
+// readEscape consumes a backslash sequence inside a string and writes what
+// it stands for. Double-quoted strings decode the sequence, single-quoted
+// ones only unescape a backslash or the delimiters, and regexps keep it for
+// the regexp engine, rewriting only \u escapes it does not know.
+func (l *Lexer) readEscape(content *strings.Builder, state *stringState) {
+	l.readChar() // consume \
+	if l.ch == 0 {
+		content.WriteByte('\\')
+		return
+	}
+
+	var text string
+	n := 1
+	switch {
+	case state.mode == modeRegexp || state.mode == modePercentR:
+		text, n = regexpEscape(l.input[l.position:])
+	case state.interpolating:
+		text, n = decodeEscape(l.input[l.position:])
+	case l.ch == '\\' || l.ch == state.terminator || (state.openDelimiter != 0 && l.ch == state.openDelimiter):
+		text = string(l.ch)
+	default:
+		text = "\\" + string(l.ch)
+	}
+
+	content.WriteString(text)
+	for i := 0; i < n; i++ {
+		l.readChar()
+	}
+}
+
+// Unescape decodes the backslash escapes of double-quoted string content,
+// such as \n, \x41 or \u{1F600}. A backslash before any other character
+// stands for that character, and one before a newline joins the lines.
+func Unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+		text, n := decodeEscape(s[i+1:])
+		out.WriteString(text)
+		i += n
+	}
+	return out.String()
+}
+
+// decodeEscape decodes the escape sequence at the start of s, which follows
+// a backslash, returning its text and how many bytes of s it used.
+func decodeEscape(s string) (string, int) {
+	switch ch := s[0]; ch {
+	case 'n':
+		return "\n", 1
+	case 't':
+		return "\t", 1
+	case 'r':
+		return "\r", 1
+	case 's':
+		return " ", 1
+	case 'e':
+		return "\x1b", 1
+	case 'a':
+		return "\a", 1
+	case 'b':
+		return "\b", 1
+	case 'f':
+		return "\f", 1
+	case 'v':
+		return "\v", 1
+	case '\n':
+		return "", 1
+	case 'x':
+		n := 1
+		for n < 3 && n < len(s) && isHexDigit(s[n]) {
+			n++
+		}
+		if n == 1 {
+			return "x", 1
+		}
+		value, _ := strconv.ParseUint(s[1:n], 16, 8)
+		return string([]byte{byte(value)}), n
+	case 'u':
+		codepoints, n := readUnicodeEscape(s)
+		if n == 0 {
+			return "u", 1
+		}
+		return string(codepoints), n
+	default:
+		if isOctalDigit(ch) {
+			n := 1
+			for n < 3 && n < len(s) && isOctalDigit(s[n]) {
+				n++
+			}
+			value, _ := strconv.ParseUint(s[:n], 8, 16)
+			return string([]byte{byte(value)}), n
+		}
+		return string(ch), 1
+	}
+}
+
+// regexpEscape returns the escape sequence at the start of s as the regexp
+// engine should see it, again with the bytes of s it used.
+func regexpEscape(s string) (string, int) {
+	switch s[0] {
+	case 'u':
+		codepoints, n := readUnicodeEscape(s)
+		if n == 0 {
+			return "\\u", 1
+		}
+		var out strings.Builder
+		for _, r := range codepoints {
+			fmt.Fprintf(&out, "\\x{%X}", r)
+		}
+		return out.String(), n
+	case 'e':
+		return "\\x1B", 1
+	}
+	return "\\" + s[:1], 1
+}
+
+// readUnicodeEscape reads the codepoints of a \uXXXX or \u{X Y ...} escape
+// at the start of s, returning 0 bytes used if it is malformed.
+func readUnicodeEscape(s string) ([]rune, int) {
+	if len(s) > 1 && s[1] == '{' {
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return nil, 0
+		}
+		var codepoints []rune
+		for _, field := range strings.Fields(s[2:end]) {
+			value, err := strconv.ParseUint(field, 16, 32)
+			if err != nil || value > unicode.MaxRune {
+				return nil, 0
+			}
+			codepoints = append(codepoints, rune(value))
+		}
+		return codepoints, end + 1
+	}
+	if len(s) < 5 {
+		return nil, 0
+	}
+	value, err := strconv.ParseUint(s[1:5], 16, 32)
+	if err != nil {
+		return nil, 0
+	}
+	return []rune{rune(value)}, 5
 }
 
 func (l *Lexer) lexWordArrayContent() token.Token {
 	state := l.currentState
 
-	// Check for terminator first
-	if l.ch == state.terminator {
-		if state.nestingLevel == 1 || state.openDelimiter == 0 {
-			l.readChar()
-			l.popStringState()
-			return l.newToken(token.STRING_END, string(state.terminator))
-		}
-		state.nestingLevel--
+	// Check for terminator first; a nested one is read as part of a word
+	if l.ch == state.terminator && (state.nestingLevel == 1 || state.openDelimiter == 0) {
+		l.readChar()
+		l.popStringState()
+		return l.newToken(token.STRING_END, string(state.terminator))
 	}
 
 	// Skip leading whitespace and return separator if we're between words
@@ -1339,9 +1941,10 @@ func (l *Lexer) lexWordArrayContent() token.Token {
 		// Check for terminator after whitespace
 		if l.ch == state.terminator {
 			if state.nestingLevel == 1 || state.openDelimiter == 0 {
+				tok := l.setTokenPosition(l.newToken(token.STRING_END, string(state.terminator)), l.Pos())
 				l.readChar()
 				l.popStringState()
-				return l.newToken(token.STRING_END, string(state.terminator))
+				return tok
 			}
 		}
 		// Return separator if more content follows
@@ -1350,11 +1953,6 @@ func (l *Lexer) lexWordArrayContent() token.Token {
 		}
 	}
 
-	// Check for nested delimiter
-	if state.openDelimiter != 0 && l.ch == state.openDelimiter {
-		state.nestingLevel++
-	}
-
 	// Read word content
 	var content strings.Builder
 	for {
@@ -1378,13 +1976,31 @@ func (l *Lexer) lexWordArrayContent() token.Token {
 			state.nestingLevel++
 		}
 		if l.ch == '\\' {
-			l.readChar()
-			if l.ch != 0 {
+			// An escaped space is part of the word, not a separator
+			if next := l.peekChar(); next == ' ' || next == '\t' || next == '\n' || next == '\r' {
+				l.readChar()
 				content.WriteByte(l.ch)
 				l.readChar()
+				continue
 			}
+			l.readEscape(&content, state)
 			continue
 		}
+		if state.interpolating && l.ch == '#' {
+			if next := l.peekChar(); next == '{' || next == '@' || next == '$' {
+				if content.Len() > 0 {
+					return l.newToken(token.STRING_CONTENT, content.String())
+				}
+				l.readChar() // consume #
+				l.currentState = nil
+				if next == '@' || next == '$' {
+					return l.newToken(token.EMBVAR, "#")
+				}
+				l.readChar() // consume {
+				l.braceDepth = 1
+				return l.newToken(token.EMBEXPR_BEGIN, "#{")
+			}
+		}
 		content.WriteByte(l.ch)
 		l.readChar()
 	}
@@ -1400,13 +2016,17 @@ func (l *Lexer) lexWordArrayContent() token.Token {
 		return l.newToken(token.STRING_END, string(state.terminator))
 	}
 
-	l.popStringState()
-	return l.newToken(token.EOF, "")
+	return l.unterminated(state)
 }
 
 func (l *Lexer) lexEmbdocContent() token.Token {
 	startPos := l.position
-	startLine := l.line
+	start := l.Pos()
+
+	// An unterminated comment runs to the end of the input
+	if l.ch == 0 {
+		return l.unterminated(l.currentState)
+	}
 
 	// Check for =end
 	if l.ch == '=' && l.readPosition+2 < len(l.input) && l.input[l.readPosition:l.readPosition+3] == "end" {
@@ -1419,8 +2039,7 @@ func (l *Lexer) lexEmbdocContent() token.Token {
 		}
 		l.popStringState()
 		tok := l.newToken(token.EMBDOC_END, "=end")
-		tok.Line = startLine
-		return tok
+		return l.setTokenPosition(tok, start)
 	}
 
 	// Read line
@@ -1459,6 +2078,18 @@ func isLetter(ch byte) bool {
 	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
 }
 
+// isIdentStart reports whether ch can start an identifier. As in Ruby, the
+// bytes of any non-ASCII character count as letters, so names can be
+// written in any script.
+func isIdentStart(ch byte) bool {
+	return isLetter(ch) || ch == '_' || ch >= utf8.RuneSelf
+}
+
+// isIdentChar reports whether ch can continue an identifier.
+func isIdentChar(ch byte) bool {
+	return isIdentStart(ch) || isDigit(ch)
+}
+
 func isDigit(ch byte) bool {
 	return ch >= '0' && ch <= '9'
 }
@@ -1,7 +1,10 @@
 package lexer
 
 import (
+	"io"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/alexisbouchez/rubylexer/token"
 )
@@ -641,13 +644,13 @@ func TestNextToken_StringEscapes(t *testing.T) {
 		expectedLiteral string
 	}{
 		{token.STRING_BEGIN, "\""},
-		{token.STRING_CONTENT, "hello\\nworld"},
+		{token.STRING_CONTENT, "hello\nworld"},
 		{token.STRING_END, "\""},
 		{token.STRING_BEGIN, "\""},
-		{token.STRING_CONTENT, "tab\\there"},
+		{token.STRING_CONTENT, "tab\there"},
 		{token.STRING_END, "\""},
 		{token.STRING_BEGIN, "\""},
-		{token.STRING_CONTENT, "quote\\\"here"},
+		{token.STRING_CONTENT, "quote\"here"},
 		{token.STRING_END, "\""},
 		{token.EOF, ""},
 	}
@@ -662,6 +665,457 @@ func TestNextToken_StringEscapes(t *testing.T) {
 	}
 }
 
+func TestNextToken_RegexpEscapes(t *testing.T) {
+	input := `/a\/b\d\u00e9\u{41 42}\e/`
+	l := New(input)
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.REGEXP_BEGIN, "/"},
+		{token.STRING_CONTENT, `a\/b\d\x{E9}\x{41}\x{42}\x1B`},
+		{token.REGEXP_END, "/"},
+		{token.EOF, ""},
+	}
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("test[%d]: expected type %v, got %v (literal=%q)", i, tt.expectedType, tok.Type, tok.Literal)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("test[%d]: expected literal %q, got %q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestMagicComments(t *testing.T) {
+	input := "#!/usr/bin/env ruby\n# -*- coding: binary -*-\n# frozen_string_literal: true\n# author: someone\nx = 1\n# warn_indent: true\n"
+	l := New(input)
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+	}
+
+	comments := l.MagicComments()
+	expected := map[string]string{"encoding": "binary", "frozen_string_literal": "true"}
+	if len(comments) != len(expected) {
+		t.Fatalf("expected %d magic comments, got %v", len(expected), comments)
+	}
+	for name, value := range expected {
+		if comments[name] != value {
+			t.Errorf("expected %s to be %q, got %q", name, value, comments[name])
+		}
+	}
+
+	// An encoding past the second line is a plain comment
+	l = New("# one\n# two\n# encoding: ascii\n")
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+	}
+	if enc, ok := l.MagicComments()["encoding"]; ok {
+		t.Errorf("expected no encoding, got %q", enc)
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	input := `# frozen_string_literal: true
+class Greeter
+  def greet(name) = "Hi #{name}\t!"
+end
+text = <<~EOS
+  one #{x}
+    two
+EOS
+p %w[a b], /re\/x/i, :sym, 1_000, ?c
+=begin
+docs
+=end
+puts DATA.read
+__END__
+data
+`
+	for name, r := range map[string]io.Reader{
+		"whole":    strings.NewReader(input),
+		"one byte": iotest.OneByteReader(strings.NewReader(input)),
+	} {
+		l := NewReader(r)
+		want := New(input)
+		for i := 0; ; i++ {
+			got, exp := l.NextToken(), want.NextToken()
+			if got != exp {
+				t.Fatalf("%s: token %d: expected %+v, got %+v", name, i, exp, got)
+			}
+			if exp.Type == token.EOF {
+				break
+			}
+		}
+		if data, _ := l.Data(); data != "data\n" {
+			t.Errorf("%s: expected the data after __END__, got %q", name, data)
+		}
+		if l.Err() != nil {
+			t.Errorf("%s: unexpected error %v", name, l.Err())
+		}
+	}
+
+	// Only what the tokens so far need is read
+	r := &countingReader{r: strings.NewReader("a = 1\nb = 2\nc = 3\n")}
+	l := NewReader(r)
+	if tok := l.NextToken(); tok.Literal != "a" {
+		t.Fatalf("expected a, got %q", tok.Literal)
+	}
+	if r.read >= 12 {
+		t.Errorf("expected only the first line to be read, read %d bytes", r.read)
+	}
+}
+
+type countingReader struct {
+	r    io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	// Hand out one line at most so buffering cannot read ahead
+	if len(p) > 6 {
+		p = p[:6]
+	}
+	n, err := c.r.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestTokenPositions(t *testing.T) {
+	input := "x = \"a#{b}\" # note\ny = <<~E\n  t\nE\n"
+	tests := []struct {
+		expectedType token.Type
+		start, end   string
+		startOffset  int
+		endOffset    int
+	}{
+		{token.IDENT, "1:1", "1:2", 0, 1},
+		{token.EQUAL, "1:3", "1:4", 2, 3},
+		{token.STRING_BEGIN, "1:5", "1:6", 4, 5},
+		{token.STRING_CONTENT, "1:6", "1:7", 5, 6},
+		{token.EMBEXPR_BEGIN, "1:7", "1:9", 6, 8},
+		{token.IDENT, "1:9", "1:10", 8, 9},
+		{token.EMBEXPR_END, "1:10", "1:11", 9, 10},
+		{token.STRING_END, "1:11", "1:12", 10, 11},
+		{token.COMMENT, "1:13", "1:19", 12, 18},
+		{token.NEWLINE, "1:19", "2:1", 18, 19},
+		{token.IDENT, "2:1", "2:2", 19, 20},
+		{token.EQUAL, "2:3", "2:4", 21, 22},
+		{token.HEREDOC_BEGIN, "2:5", "2:9", 23, 27},
+		{token.STRING_CONTENT, "3:1", "4:1", 28, 32},
+		{token.HEREDOC_END, "4:1", "4:2", 32, 33},
+		{token.NEWLINE, "4:2", "5:1", 33, 34},
+		{token.EOF, "5:1", "5:1", 34, 34},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Pos().String() != tt.start || tok.End().String() != tt.end {
+			t.Errorf("tests[%d] - expected %s-%s, got %s-%s", i, tt.start, tt.end, tok.Pos(), tok.End())
+		}
+		if tok.Offset != tt.startOffset || tok.EndOffset != tt.endOffset {
+			t.Errorf("tests[%d] - expected offsets %d-%d, got %d-%d", i, tt.startOffset, tt.endOffset, tok.Offset, tok.EndOffset)
+		}
+	}
+}
+
+func TestPreserveTrivia(t *testing.T) {
+	input := `# frozen_string_literal: true
+x = %w[ a  b ] \
+  + [1] # trailing
+=begin
+docs
+=end
+s = <<-T
+  #{x}
+  T
+`
+	l := New(input)
+	l.PreserveTrivia(true)
+	var source strings.Builder
+	var trivia []string
+	for {
+		tok := l.NextToken()
+		if tok.Type == token.COMMENT || tok.Type == token.EMBDOC_BEGIN {
+			t.Errorf("expected comments to be trivia, got %s", tok.Type)
+		}
+		if tok.Trivia != "" && tok.Trivia != " " {
+			trivia = append(trivia, tok.Trivia)
+		}
+		source.WriteString(tok.Trivia)
+		source.WriteString(input[tok.Offset:tok.EndOffset])
+		if tok.Type == token.EOF {
+			break
+		}
+	}
+	if source.String() != input {
+		t.Errorf("expected the tokens to give back the input, got %q", source.String())
+	}
+	expected := []string{
+		"# frozen_string_literal: true",
+		" \\\n  ",
+		" # trailing",
+		"=begin\ndocs\n=end",
+		"\n",
+		"  ",
+	}
+	if strings.Join(trivia, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected trivia %q, got %q", expected, trivia)
+	}
+	if l.MagicComments()["frozen_string_literal"] != "true" {
+		t.Errorf("expected magic comments to still be recorded, got %v", l.MagicComments())
+	}
+
+	// Without it, tokens have no trivia
+	l = New("x  # c\n")
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		if tok.Trivia != "" {
+			t.Errorf("expected no trivia on %s, got %q", tok.Type, tok.Trivia)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		input string
+		kind  DiagnosticKind
+		pos   string
+		end   token.Type
+	}{
+		{"x = \"abc\nputs 1", UnterminatedString, "1:5", token.STRING_END},
+		{"p :'sym", UnterminatedString, "1:3", token.STRING_END},
+		{"x = 1\ny = /ab+", UnterminatedRegexp, "2:5", token.REGEXP_END},
+		{"a = %w[a b", UnterminatedList, "1:5", token.STRING_END},
+		{"s = <<~EOS\n  hi\n", UnterminatedHeredoc, "1:5", token.HEREDOC_END},
+		{"p 1\n=begin\ndocs", UnterminatedEmbdoc, "2:1", token.EMBDOC_END},
+		{"puts \"a#{1 + 2", UnterminatedString, "1:6", token.STRING_END},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		var types []token.Type
+		for {
+			tok := l.NextToken()
+			if tok.Type == token.EOF {
+				break
+			}
+			types = append(types, tok.Type)
+		}
+		if last := types[len(types)-1]; last != tt.end {
+			t.Errorf("%q: expected a closing %s, got %s", tt.input, tt.end, last)
+		}
+
+		diagnostics := l.Diagnostics()
+		if len(diagnostics) != 1 {
+			t.Fatalf("%q: expected 1 diagnostic, got %v", tt.input, diagnostics)
+		}
+		d := diagnostics[0]
+		if d.Kind != tt.kind {
+			t.Errorf("%q: expected %s, got %s", tt.input, tt.kind, d.Kind)
+		}
+		if d.Pos.String() != tt.pos {
+			t.Errorf("%q: diagnostic at %s, want %s", tt.input, d.Pos, tt.pos)
+		}
+	}
+
+	l := New(`x = "closed" + %w[a b] + <<~E
+  body
+E
+`)
+	for l.NextToken().Type != token.EOF {
+	}
+	if len(l.Diagnostics()) != 0 {
+		t.Errorf("expected no diagnostics, got %v", l.Diagnostics())
+	}
+}
+
+func TestTruncatedEmbeddedDocStart(t *testing.T) {
+	for _, input := range []string{"=b", "=begi", "x\n=begi"} {
+		l := New(input)
+		var last token.Token
+		for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+			last = tok
+		}
+		if last.Type != token.IDENT {
+			t.Errorf("%q: expected the input to end with an identifier, got %s", input, last.Type)
+		}
+	}
+}
+
+func TestRelex(t *testing.T) {
+	input := `# frozen_string_literal: true
+class Greeter
+  def greet(name)
+    "Hi #{name}"
+  end
+end
+
+text = <<~EOS
+  one #{x}
+EOS
+opts = { a: 1,
+  b: [2, 3] }
+p %w[a b], /re/i # done
+__END__
+data
+`
+	tests := []struct {
+		name string
+		edit Edit
+	}{
+		{"insert a line", Edit{Start: strings.Index(input, "text"), End: strings.Index(input, "text"), Text: "x = 1\n"}},
+		{"change a string", Edit{Start: strings.Index(input, "Hi"), End: strings.Index(input, "Hi") + 2, Text: "Hello"}},
+		{"open a string", Edit{Start: strings.Index(input, "opts"), End: strings.Index(input, "opts"), Text: "\""}},
+		{"edit inside brackets", Edit{Start: strings.Index(input, "b:"), End: strings.Index(input, "b:") + 1, Text: "c"}},
+		{"edit a heredoc", Edit{Start: strings.Index(input, "one"), End: strings.Index(input, "one") + 3, Text: "two\n  three"}},
+		{"delete lines", Edit{Start: strings.Index(input, "class"), End: strings.Index(input, "text")}},
+		{"edit the data", Edit{Start: strings.Index(input, "data"), End: len(input), Text: "more"}},
+		{"edit the magic comment", Edit{Start: strings.Index(input, "true"), End: strings.Index(input, "true") + 4, Text: "false"}},
+	}
+
+	for _, tt := range tests {
+		for _, trivia := range []bool{false, true} {
+			old := New(input)
+			old.PreserveTrivia(trivia)
+			var tokens []token.Token
+			for tok := old.NextToken(); ; tok = old.NextToken() {
+				tokens = append(tokens, tok)
+				if tok.Type == token.EOF {
+					break
+				}
+			}
+			// Mark the first and last tokens to see whether they are reused
+			tokens[0].Literal = "reused"
+			tokens[len(tokens)-2].Literal = "reused"
+
+			edited := tt.edit.Apply(input)
+			l := New(edited)
+			l.PreserveTrivia(trivia)
+			got := l.Relex(tokens, tt.edit)
+
+			want := New(edited)
+			want.PreserveTrivia(trivia)
+			for i := 0; ; i++ {
+				exp := want.NextToken()
+				if i >= len(got) {
+					t.Fatalf("%s: expected %d tokens, got %d", tt.name, i+1, len(got))
+				}
+				if got[i].Literal == "reused" {
+					got[i].Literal = exp.Literal
+				}
+				if got[i] != exp {
+					t.Fatalf("%s: token %d: expected %+v, got %+v", tt.name, i, exp, got[i])
+				}
+				if exp.Type == token.EOF {
+					break
+				}
+			}
+			gotData, _ := l.Data()
+			wantData, _ := want.Data()
+			if gotData != wantData {
+				t.Errorf("%s: expected data %q, got %q", tt.name, wantData, gotData)
+			}
+			if l.MagicComments()["frozen_string_literal"] != want.MagicComments()["frozen_string_literal"] {
+				t.Errorf("%s: expected magic comments %v, got %v", tt.name, want.MagicComments(), l.MagicComments())
+			}
+		}
+	}
+}
+
+func TestRelexReuse(t *testing.T) {
+	input := "a = 1\nb = 2\nc = 3\nd = 4\n"
+	var tokens []token.Token
+	l := New(input)
+	for tok := l.NextToken(); ; tok = l.NextToken() {
+		tokens = append(tokens, tok)
+		if tok.Type == token.EOF {
+			break
+		}
+	}
+	for i := range tokens {
+		tokens[i].Literal = "reused"
+	}
+
+	// Only the edited lines are lexed again, and the end of the input
+	edit := Edit{Start: 6, End: 6, Text: "x\n"}
+	got := New(edit.Apply(input)).Relex(tokens, edit)
+	var relexed []string
+	for _, tok := range got {
+		if tok.Literal != "reused" {
+			relexed = append(relexed, tok.Literal)
+		}
+	}
+	expected := []string{"x", "\n", "b", "=", "2", "\n", ""}
+	if strings.Join(relexed, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected only %q to be lexed again, got %q", expected, relexed)
+	}
+	if tok := got[len(got)-5]; tok.Line != 5 || tok.Offset != 20 {
+		t.Errorf("expected reused tokens to move, got %+v", tok)
+	}
+}
+
+func TestNextToken_UnicodeIdentifiers(t *testing.T) {
+	input := `日本語 = 1
+def grüß?(wört) = :größe
+Ünïcode::Λ
+@ß + @@ñ + $ü
+{ключ: ?é}
+<<~ÉOF
+ÉOF
+`
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "日本語"},
+		{token.EQUAL, "="},
+		{token.INTEGER, "1"},
+		{token.NEWLINE, "\n"},
+		{token.KEYWORD_DEF, "def"},
+		{token.METHOD_NAME, "grüß?"},
+		{token.LPAREN, "("},
+		{token.IDENT, "wört"},
+		{token.RPAREN, ")"},
+		{token.EQUAL, "="},
+		{token.SYMBOL_BEGIN, ":"},
+		{token.IDENT, "größe"},
+		{token.NEWLINE, "\n"},
+		{token.CONSTANT, "Ünïcode"},
+		{token.COLON_COLON, "::"},
+		{token.CONSTANT, "Λ"},
+		{token.NEWLINE, "\n"},
+		{token.IVAR, "@ß"},
+		{token.PLUS, "+"},
+		{token.CVAR, "@@ñ"},
+		{token.PLUS, "+"},
+		{token.GVAR, "$ü"},
+		{token.NEWLINE, "\n"},
+		{token.LBRACE, "{"},
+		{token.LABEL, "ключ:"},
+		{token.CHAR, "?é"},
+		{token.RBRACE, "}"},
+		{token.NEWLINE, "\n"},
+		{token.HEREDOC_BEGIN, "<<~ÉOF"},
+		{token.HEREDOC_END, "ÉOF"},
+		{token.NEWLINE, "\n"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q (literal %q)", i, tt.expectedType, tok.Type, tok.Literal)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
 func TestNextToken_StringInterpolation(t *testing.T) {
 	input := `"hello #{name}"`
 	l := New(input)
@@ -752,6 +1206,37 @@ func TestNextToken_VarInterpolation(t *testing.T) {
 	}
 }
 
+func TestNextToken_IvarInInterpolation(t *testing.T) {
+	input := `"(#{@x}, #{$y})"`
+	l := New(input)
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.STRING_BEGIN, "\""},
+		{token.STRING_CONTENT, "("},
+		{token.EMBEXPR_BEGIN, "#{"},
+		{token.IVAR, "@x"},
+		{token.EMBEXPR_END, "}"},
+		{token.STRING_CONTENT, ", "},
+		{token.EMBEXPR_BEGIN, "#{"},
+		{token.GVAR, "$y"},
+		{token.EMBEXPR_END, "}"},
+		{token.STRING_CONTENT, ")"},
+		{token.STRING_END, "\""},
+		{token.EOF, ""},
+	}
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("test[%d]: expected type %v, got %v (literal=%q)", i, tt.expectedType, tok.Type, tok.Literal)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("test[%d]: expected literal %q, got %q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
 func TestNextToken_Symbols(t *testing.T) {
 	input := `:foo :Bar :foo_bar :"with spaces" :'single quote'`
 	l := New(input)
@@ -988,6 +1473,45 @@ func TestNextToken_SymbolArrays(t *testing.T) {
 	}
 }
 
+func TestNextToken_WordArrayInterpolation(t *testing.T) {
+	input := `%W[x#{1}y #@a a\ b (c) \n] %w[\n]`
+	l := New(input)
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.WORDS_BEGIN, "%W["},
+		{token.STRING_CONTENT, "x"},
+		{token.EMBEXPR_BEGIN, "#{"},
+		{token.INTEGER, "1"},
+		{token.EMBEXPR_END, "}"},
+		{token.STRING_CONTENT, "y"},
+		{token.WORDS_SEP, " "},
+		{token.EMBVAR, "#"},
+		{token.IVAR, "@a"},
+		{token.WORDS_SEP, " "},
+		{token.STRING_CONTENT, "a b"},
+		{token.WORDS_SEP, " "},
+		{token.STRING_CONTENT, "(c)"},
+		{token.WORDS_SEP, " "},
+		{token.STRING_CONTENT, "\n"},
+		{token.STRING_END, "]"},
+		{token.WORDS_BEGIN, "%w["},
+		{token.STRING_CONTENT, `\n`},
+		{token.STRING_END, "]"},
+		{token.EOF, ""},
+	}
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("test[%d]: expected type %v, got %v (literal=%q)", i, tt.expectedType, tok.Type, tok.Literal)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("test[%d]: expected literal %q, got %q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
 func TestNextToken_PercentRegexp(t *testing.T) {
 	input := `%r{foo/bar}i`
 	l := New(input)
@@ -1115,6 +1639,44 @@ done`
 	}
 }
 
+func TestNextToken_HeredocRestOfLine(t *testing.T) {
+	input := "foo(<<-A, <<~B, 1)\n  a\n  A\n  b\nB\ndone"
+	l := New(input)
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+		line            int
+	}{
+		{token.IDENT, "foo", 1},
+		{token.LPAREN, "(", 1},
+		{token.HEREDOC_BEGIN, "<<-A", 1},
+		{token.STRING_CONTENT, "  a\n", 2},
+		{token.HEREDOC_END, "A", 3},
+		{token.COMMA, ",", 1},
+		{token.HEREDOC_BEGIN, "<<~B", 1},
+		{token.STRING_CONTENT, "b\n", 4},
+		{token.HEREDOC_END, "B", 5},
+		{token.COMMA, ",", 1},
+		{token.INTEGER, "1", 1},
+		{token.RPAREN, ")", 1},
+		{token.NEWLINE, "\n", 1},
+		{token.IDENT, "done", 6},
+		{token.EOF, "", 6},
+	}
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("test[%d]: expected type %v, got %v (literal=%q)", i, tt.expectedType, tok.Type, tok.Literal)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("test[%d]: expected literal %q, got %q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Line != tt.line {
+			t.Fatalf("test[%d]: expected line %d, got %d", i, tt.line, tok.Line)
+		}
+	}
+}
+
 func TestNextToken_HeredocSquiggle(t *testing.T) {
 	input := `<<~EOF
   hello
@@ -1127,7 +1689,7 @@ done`
 		expectedLiteral string
 	}{
 		{token.HEREDOC_BEGIN, "<<~EOF"},
-		{token.STRING_CONTENT, "  hello\n  world\n"},
+		{token.STRING_CONTENT, "hello\nworld\n"},
 		{token.HEREDOC_END, "EOF"},
 		{token.NEWLINE, "\n"},
 		{token.IDENT, "done"},
@@ -1173,6 +1735,46 @@ done`
 	}
 }
 
+func TestNextToken_HeredocInterpolation(t *testing.T) {
+	input := `<<~MSG
+  Hi #{name},
+    \#{not} #@count\tx
+MSG
+<<~'RAW'
+  #{kept}\t
+RAW`
+	l := New(input)
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.HEREDOC_BEGIN, "<<~MSG"},
+		{token.STRING_CONTENT, "Hi "},
+		{token.EMBEXPR_BEGIN, "#{"},
+		{token.IDENT, "name"},
+		{token.EMBEXPR_END, "}"},
+		{token.STRING_CONTENT, ",\n  #{not} "},
+		{token.EMBVAR, "#"},
+		{token.IVAR, "@count"},
+		{token.STRING_CONTENT, "\tx\n"},
+		{token.HEREDOC_END, "MSG"},
+		{token.NEWLINE, "\n"},
+		{token.HEREDOC_BEGIN, "<<~'RAW'"},
+		{token.STRING_CONTENT, "#{kept}\\t\n"},
+		{token.HEREDOC_END, "RAW"},
+		{token.EOF, ""},
+	}
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("test[%d]: expected type %v, got %v (literal=%q)", i, tt.expectedType, tok.Type, tok.Literal)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("test[%d]: expected literal %q, got %q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
 func TestNextToken_Label(t *testing.T) {
 	input := `foo: bar:`
 	l := New(input)
@@ -1608,3 +2210,78 @@ end`
 		}
 	}
 }
+
+func TestNextToken_BareHashPattern(t *testing.T) {
+	input := `case person
+in name:, age: Integer
+end`
+	l := New(input)
+	tests := []struct {
+		expectedType token.Type
+	}{
+		{token.KEYWORD_CASE},
+		{token.IDENT},
+		{token.NEWLINE},
+		{token.KEYWORD_IN},
+		{token.LABEL},
+		{token.COMMA},
+		{token.LABEL},
+		{token.CONSTANT},
+		{token.NEWLINE},
+		{token.KEYWORD_END},
+		{token.EOF},
+	}
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("test[%d]: expected type %v, got %v (literal=%q)", i, tt.expectedType, tok.Type, tok.Literal)
+		}
+	}
+}
+
+func TestNextToken_OperatorMethodNames(t *testing.T) {
+	input := "def /(o)\ndef %(o)\ndef []=(k, v)\ndef -@\ndef self.`(c)"
+	l := New(input)
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.KEYWORD_DEF, "def"},
+		{token.METHOD_NAME, "/"},
+		{token.LPAREN, "("},
+		{token.IDENT, "o"},
+		{token.RPAREN, ")"},
+		{token.NEWLINE, "\n"},
+		{token.KEYWORD_DEF, "def"},
+		{token.METHOD_NAME, "%"},
+		{token.LPAREN, "("},
+		{token.IDENT, "o"},
+		{token.RPAREN, ")"},
+		{token.NEWLINE, "\n"},
+		{token.KEYWORD_DEF, "def"},
+		{token.METHOD_NAME, "[]="},
+		{token.LPAREN, "("},
+		{token.IDENT, "k"},
+		{token.COMMA, ","},
+		{token.IDENT, "v"},
+		{token.RPAREN, ")"},
+		{token.NEWLINE, "\n"},
+		{token.KEYWORD_DEF, "def"},
+		{token.METHOD_NAME, "-@"},
+		{token.NEWLINE, "\n"},
+		{token.KEYWORD_DEF, "def"},
+		{token.KEYWORD_SELF, "self"},
+		{token.DOT, "."},
+		{token.METHOD_NAME, "`"},
+		{token.LPAREN, "("},
+		{token.IDENT, "c"},
+		{token.RPAREN, ")"},
+		{token.EOF, ""},
+	}
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Fatalf("test[%d]: expected %v %q, got %v %q", i, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package lexer
+
+import (
+	"strings"
+
+	"github.com/alexisbouchez/rubylexer/token"
+)
+
+// Edit is a change to an input: the bytes from Start up to End are
+// replaced by Text.
+type Edit struct {
+	Start int
+	End   int
+	Text  string
+}
+
+// Apply returns input with the edit made.
+func (e Edit) Apply(input string) string {
+	return input[:e.Start] + e.Text + input[e.End:]
+}
+
+// delta returns how much the edit moves the text after it.
+func (e Edit) delta() int {
+	return len(e.Text) - (e.End - e.Start)
+}
+
+// ResumeAt moves the lexer to pos, which must be the start of a line
+// outside of any string, heredoc or brackets, such as just after a newline
+// at the top level. Lexing then carries on as if the input before pos had
+// been lexed, so an editor can lex or parse again from a line it knows is
+// unchanged.
+func (l *Lexer) ResumeAt(pos token.Pos) {
+	l.fill(pos.Offset)
+	l.recordHeader(pos.Offset)
+
+	l.stringStack = l.stringStack[:0]
+	l.currentState = nil
+	l.braceDepth = 0
+	l.heredocQueue = nil
+	l.afterOperator = false
+	l.afterKeyword = false
+	l.afterIdent = false
+	l.afterRightParen = false
+	l.afterRightBracket = false
+	l.inLabelContext = false
+	l.afterDot = false
+	l.afterIn = false
+	l.afterDef = false
+	l.defReceiver = false
+	l.sawNewline = pos.Offset > 0
+	l.startOfLine = true
+	l.data = nil
+
+	l.readPosition = pos.Offset
+	l.line = pos.Line
+	l.column = 0
+	l.triviaStart = pos.Offset
+	l.readChar()
+}
+
+// recordHeader records the magic comments in the comments that start the
+// input before end, as lexing them would have.
+func (l *Lexer) recordHeader(end int) {
+	if end > len(l.input) {
+		end = len(l.input)
+	}
+	for i, line := range strings.Split(l.input[:end], "\n") {
+		text := strings.TrimSpace(line)
+		if !strings.HasPrefix(text, "#") {
+			if text != "" {
+				return
+			}
+			continue
+		}
+		l.recordMagicComment(text, i+1)
+	}
+}
+
+// Relex returns the tokens of the lexer's input, given tokens, which are
+// those of the input before edit was made to it, through to EOF. Only the
+// lines around the edit are lexed again: the tokens before them are reused
+// as they are, and once lexing is back in step after the edit the rest are
+// reused at their new positions. The lexer should be set up the way the
+// one that returned tokens was, as to whether it preserves trivia.
+func (l *Lexer) Relex(tokens []token.Token, edit Edit) []token.Token {
+	lines := topLevelLines(tokens)
+
+	// Resume after the last line break before the edit
+	resume := -1
+	for _, i := range lines {
+		if tokens[i].EndOffset > edit.Start {
+			break
+		}
+		resume = i
+	}
+	relexed := make([]token.Token, 0, len(tokens))
+	if resume >= 0 {
+		relexed = append(relexed, tokens[:resume+1]...)
+		l.ResumeAt(tokens[resume].End())
+	} else {
+		l.ResumeAt(token.Pos{Line: 1, Column: 1})
+	}
+
+	// The line breaks after the edit, by where they were
+	after := make(map[int]int)
+	for _, i := range lines {
+		if tokens[i].Offset >= edit.End {
+			after[tokens[i].Offset] = i
+		}
+	}
+
+	delta := edit.delta()
+	var b brackets
+	for {
+		tok := l.NextToken()
+		relexed = append(relexed, tok)
+		if tok.Type == token.EOF {
+			return relexed
+		}
+		b.add(tok.Type)
+		if tok.Type != token.NEWLINE || !b.topLevel() || tok.Offset < edit.Start+len(edit.Text) {
+			continue
+		}
+		i, ok := after[tok.Offset-delta]
+		if !ok {
+			continue
+		}
+
+		// Back in step: reuse the tokens up to the last line break and
+		// lex only the last line again, so the lexer ends where it would
+		lineDelta := tok.Line - tokens[i].Line
+		last := lines[len(lines)-1]
+		for _, old := range tokens[i+1 : last+1] {
+			relexed = append(relexed, shiftToken(old, lineDelta, delta))
+		}
+		l.ResumeAt(relexed[len(relexed)-1].End())
+		for {
+			tok := l.NextToken()
+			relexed = append(relexed, tok)
+			if tok.Type == token.EOF {
+				return relexed
+			}
+		}
+	}
+}
+
+// topLevelLines returns the indexes of the NEWLINE tokens outside of any
+// brackets or interpolation, after which a lexer can resume.
+func topLevelLines(tokens []token.Token) []int {
+	var lines []int
+	var b brackets
+	for i, tok := range tokens {
+		b.add(tok.Type)
+		if tok.Type == token.NEWLINE && b.topLevel() {
+			lines = append(lines, i)
+		}
+	}
+	return lines
+}
+
+// brackets tracks the brackets and interpolation open in a stream of
+// tokens. A closing token that does not match leaves the stream unbalanced
+// for good, since the lexer may not agree about what it closed.
+type brackets struct {
+	open       []token.Type
+	unbalanced bool
+}
+
+var closingBrackets = map[token.Type]token.Type{
+	token.RPAREN:      token.LPAREN,
+	token.RBRACKET:    token.LBRACKET,
+	token.RBRACE:      token.LBRACE,
+	token.EMBEXPR_END: token.EMBEXPR_BEGIN,
+}
+
+func (b *brackets) add(t token.Type) {
+	switch t {
+	case token.LPAREN, token.LBRACKET, token.LBRACE, token.EMBEXPR_BEGIN:
+		b.open = append(b.open, t)
+	case token.RPAREN, token.RBRACKET, token.RBRACE, token.EMBEXPR_END:
+		if n := len(b.open); n > 0 && b.open[n-1] == closingBrackets[t] {
+			b.open = b.open[:n-1]
+		} else {
+			b.unbalanced = true
+		}
+	}
+}
+
+// topLevel reports whether the tokens so far leave nothing open.
+func (b *brackets) topLevel() bool {
+	return len(b.open) == 0 && !b.unbalanced
+}
+
+// shiftToken moves a token down by lines and along by offset bytes.
+func shiftToken(tok token.Token, lines, offset int) token.Token {
+	tok.Line += lines
+	tok.Offset += offset
+	tok.EndLine += lines
+	tok.EndOffset += offset
+	return tok
+}
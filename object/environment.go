@@ -8,66 +8,6 @@ var (
 	tracePointsMutex    sync.RWMutex
 )
 
-// ObjectSpace tracking
-var (
-	trackedObjects   []Object
-	objectsMutex     sync.RWMutex
-	nextObjectID     int64
-	objectIDMap      map[Object]int64
-)
-
-func init() {
-	objectIDMap = make(map[Object]int64)
-}
-
-// TrackObject adds an object to the ObjectSpace tracking.
-func TrackObject(obj Object) int64 {
-	objectsMutex.Lock()
-	defer objectsMutex.Unlock()
-
-	// Check if already tracked
-	if id, exists := objectIDMap[obj]; exists {
-		return id
-	}
-
-	nextObjectID++
-	objectIDMap[obj] = nextObjectID
-	trackedObjects = append(trackedObjects, obj)
-	return nextObjectID
-}
-
-// GetObjectID returns the object ID.
-func GetObjectID(obj Object) int64 {
-	objectsMutex.RLock()
-	defer objectsMutex.RUnlock()
-
-	if id, exists := objectIDMap[obj]; exists {
-		return id
-	}
-	return 0
-}
-
-// GetTrackedObjects returns all tracked objects.
-func GetTrackedObjects() []Object {
-	objectsMutex.RLock()
-	defer objectsMutex.RUnlock()
-	result := make([]Object, len(trackedObjects))
-	copy(result, trackedObjects)
-	return result
-}
-
-// CountObjectsByType counts objects by type.
-func CountObjectsByType() map[Type]int {
-	objectsMutex.RLock()
-	defer objectsMutex.RUnlock()
-
-	counts := make(map[Type]int)
-	for _, obj := range trackedObjects {
-		counts[obj.Type()]++
-	}
-	return counts
-}
-
 // AddActiveTracePoint adds a trace point to the active list.
 func AddActiveTracePoint(tp *TracePoint) {
 	tracePointsMutex.Lock()
@@ -103,6 +43,7 @@ type Environment struct {
 	constants         map[string]Object
 	self              Object
 	block             *Proc
+	blockBound        bool             // Whether this frame owns a block, even a nil one
 	currentClass      *RubyClass
 	currentModule     *RubyModule
 	singletonTarget   Object           // Target object for singleton class (class << obj)
@@ -163,6 +104,23 @@ func (e *Environment) Update(name string, val Object) Object {
 	return val
 }
 
+// Assign sets a local variable, updating the enclosing binding when a block
+// assigns to a variable it closes over. The search stops at the nearest
+// method frame, so methods never overwrite their caller's locals.
+func (e *Environment) Assign(name string, val Object) Object {
+	for scope := e; scope != nil; scope = scope.outer {
+		if _, ok := scope.store[name]; ok {
+			scope.store[name] = val
+			return val
+		}
+		if scope.currentMethod != "" {
+			break
+		}
+	}
+	e.store[name] = val
+	return val
+}
+
 // GetConstant retrieves a constant.
 func (e *Environment) GetConstant(name string) (Object, bool) {
 	obj, ok := e.constants[name]
@@ -194,9 +152,11 @@ func (e *Environment) SetSelf(self Object) {
 	e.self = self
 }
 
-// Block returns the current block.
+// Block returns the current block. The lookup stops at the nearest method
+// or builtin call frame, so a block only sees the block of the method it
+// was written in and a method called without a block has none.
 func (e *Environment) Block() *Proc {
-	if e.block != nil {
+	if e.blockBound {
 		return e.block
 	}
 	if e.outer != nil {
@@ -205,9 +165,10 @@ func (e *Environment) Block() *Proc {
 	return nil
 }
 
-// SetBlock sets the current block.
+// SetBlock sets the block of a call frame; nil records that none was given.
 func (e *Environment) SetBlock(block *Proc) {
 	e.block = block
+	e.blockBound = true
 }
 
 // Outer returns the outer environment.
@@ -5,11 +5,13 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"math"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/alexisbouchez/rubylexer/ast"
+	"github.com/alexisbouchez/rubylexer/token"
 )
 
 // Type represents the type of an object.
@@ -89,10 +91,14 @@ func (f *Float) Type() Type      { return FLOAT_OBJ }
 func (f *Float) Inspect() string { return fmt.Sprintf("%g", f.Value) }
 func (f *Float) Class() *RubyClass { return FloatClass }
 func (f *Float) IsTruthy() bool  { return true }
+func (f *Float) HashKey() HashKey {
+	return HashKey{Type: f.Type(), Value: math.Float64bits(f.Value)}
+}
 
 // String represents a Ruby String.
 type String struct {
-	Value string
+	Value  string
+	Frozen bool
 }
 
 func (s *String) Type() Type      { return STRING_OBJ }
@@ -149,6 +155,7 @@ func (n *Nil) Type() Type      { return NIL_OBJ }
 func (n *Nil) Inspect() string { return "nil" }
 func (n *Nil) Class() *RubyClass { return NilClass }
 func (n *Nil) IsTruthy() bool  { return false }
+func (n *Nil) HashKey() HashKey { return HashKey{Type: n.Type()} }
 
 // Array represents a Ruby Array.
 type Array struct {
@@ -169,6 +176,11 @@ func (a *Array) Inspect() string {
 }
 func (a *Array) Class() *RubyClass { return ArrayClass }
 func (a *Array) IsTruthy() bool  { return true }
+func (a *Array) HashKey() HashKey {
+	h := fnv.New64a()
+	h.Write([]byte(a.Inspect()))
+	return HashKey{Type: a.Type(), Value: h.Sum64()}
+}
 
 // HashPair represents a key-value pair in a Hash.
 type HashPair struct {
@@ -181,6 +193,29 @@ type Hash struct {
 	Pairs        map[HashKey]HashPair
 	Order        []HashKey // Maintain insertion order
 	IsKeywordArgs bool      // True when this hash represents keyword arguments
+	CompareByIdentity bool  // True when keys are compared by object identity
+	Default       Object    // Value returned for missing keys (Hash.new(obj))
+	DefaultProc   *Proc     // Called with the hash and key for missing keys
+}
+
+// KeyFor returns the map key for key, reporting false when key cannot be
+// one. Under compare_by_identity, keys other than immediates (Integer,
+// Symbol, true, false, nil) are keyed by identity, so any object can be one.
+func (h *Hash) KeyFor(key Object) (HashKey, bool) {
+	switch key.(type) {
+	case *Integer, *Symbol, *Boolean, *Nil:
+		return key.(Hashable).HashKey(), true
+	}
+	if !h.CompareByIdentity {
+		hashable, ok := key.(Hashable)
+		if !ok {
+			return HashKey{}, false
+		}
+		return hashable.HashKey(), true
+	}
+	f := fnv.New64a()
+	fmt.Fprintf(f, "%p", key)
+	return HashKey{Type: key.Type(), Value: f.Sum64()}, true
 }
 
 func (h *Hash) Type() Type { return HASH_OBJ }
@@ -212,6 +247,9 @@ func (r *Range) Inspect() string {
 	if r.Exclusive {
 		op = "..."
 	}
+	if _, endless := r.End.(*Nil); endless {
+		return r.Start.Inspect() + op
+	}
 	return fmt.Sprintf("%s%s%s", r.Start.Inspect(), op, r.End.Inspect())
 }
 func (r *Range) Class() *RubyClass { return RangeClass }
@@ -298,18 +336,57 @@ type Time struct {
 
 func (t *Time) Type() Type         { return TIME_OBJ }
 func (t *Time) Inspect() string    { return t.Value.Format("2006-01-02 15:04:05 -0700") }
-func (t *Time) Class() *RubyClass  { return nil } // Set dynamically
+func (t *Time) Class() *RubyClass  { return TimeClass }
 func (t *Time) IsTruthy() bool     { return true }
 
-// Date represents a Ruby Date object.
+// Date represents a Ruby Date object, or a DateTime when it carries a
+// time of day.
 type Date struct {
-	Value time.Time
+	Value    time.Time
+	DateTime bool
+}
+
+func (d *Date) Type() Type { return DATE_OBJ }
+
+// String returns the date in ISO 8601 form, as Date#to_s gives it.
+func (d *Date) String() string {
+	if d.DateTime {
+		return d.Value.Format("2006-01-02T15:04:05-07:00")
+	}
+	return d.Value.Format("2006-01-02")
 }
 
-func (d *Date) Type() Type         { return DATE_OBJ }
-func (d *Date) Inspect() string    { return d.Value.Format("2006-01-02") }
-func (d *Date) Class() *RubyClass  { return nil } // Set dynamically
+// Inspect gives the date with its Julian day, the seconds and nanoseconds
+// into that day in UTC and its offset, as Ruby's Date#inspect does. 2299161
+// is the day of calendar reform the dates are kept with.
+func (d *Date) Inspect() string {
+	name := "Date"
+	utc := time.Date(d.Value.Year(), d.Value.Month(), d.Value.Day(), 0, 0, 0, 0, time.UTC)
+	if d.DateTime {
+		name = "DateTime"
+		utc = d.Value.UTC()
+	}
+	days, secs := utc.Unix()/86400, utc.Unix()%86400
+	if secs < 0 {
+		days, secs = days-1, secs+86400
+	}
+	_, offset := d.Value.Zone()
+	if !d.DateTime {
+		offset = 0
+	}
+	return fmt.Sprintf("#<%s: %s ((%dj,%ds,%dn),%+ds,2299161j)>", name, d.String(), days+2440588, secs, utc.Nanosecond(), offset)
+}
+func (d *Date) Class() *RubyClass {
+	if d.DateTime {
+		return DateTimeClass
+	}
+	return DateClass
+}
 func (d *Date) IsTruthy() bool     { return true }
+func (d *Date) HashKey() HashKey {
+	// Dates for the same moment are equal, whatever their offsets
+	return HashKey{Type: d.Type(), Value: uint64(d.Value.Unix())*1e9 + uint64(d.Value.Nanosecond())}
+}
 
 // ReturnValue wraps a return value.
 type ReturnValue struct {
@@ -355,6 +432,11 @@ type Error struct {
 	Class_    *RubyClass
 	Backtrace []string
 	Caught    bool // true when caught by rescue, prevents re-propagation
+	// File and Pos locate the statement the error was raised in
+	File string
+	Pos  token.Pos
+	// Status is the exit status a SystemExit carries
+	Status int
 }
 
 func (e *Error) Type() Type      { return ERROR_OBJ }
@@ -384,6 +466,7 @@ type Proc struct {
 	Parameters []*ast.BlockParameter
 	Body       *ast.BlockBody
 	Env        *Environment
+	Native     BuiltinFunction // Go implementation used instead of Body when set
 }
 
 func (p *Proc) Type() Type      { return PROC_OBJ }
@@ -396,6 +479,7 @@ type Lambda struct {
 	Parameters []*ast.BlockParameter
 	Body       *ast.BlockBody
 	Env        *Environment
+	Native     BuiltinFunction // Go implementation used instead of Body when set
 }
 
 func (l *Lambda) Type() Type      { return LAMBDA_OBJ }
@@ -420,6 +504,8 @@ type Method struct {
 	Env        *Environment
 	Receiver   Object
 	Visibility MethodVisibility
+	File       string // the file the def is in, when it was made by one
+	Line       int
 }
 
 func (m *Method) Type() Type      { return METHOD_OBJ }
@@ -432,8 +518,9 @@ type BuiltinFunction func(receiver Object, env *Environment, args ...Object) Obj
 
 // Builtin represents a built-in method.
 type Builtin struct {
-	Name string
-	Fn   BuiltinFunction
+	Name   string
+	Params []string // parameter kinds (req, opt, rest) for Method#parameters; nil if unknown
+	Fn     BuiltinFunction
 }
 
 func (b *Builtin) Type() Type      { return BUILTIN_OBJ }
@@ -544,7 +631,8 @@ type RubyClass struct {
 	ClassMethods    map[string]Object // Class methods
 	Constants       map[string]Object
 	IncludedModules []*RubyModule
-	StructMembers   []string // For Struct subclasses
+	StructMembers   []string          // For Struct subclasses
+	Ivars           map[string]Object // Class-level instance variables
 }
 
 func (c *RubyClass) Type() Type      { return CLASS_OBJ }
@@ -552,6 +640,22 @@ func (c *RubyClass) Inspect() string { return c.Name }
 func (c *RubyClass) Class() *RubyClass { return ClassClass }
 func (c *RubyClass) IsTruthy() bool  { return true }
 
+// GetInstanceVariable gets a class-level instance variable.
+func (c *RubyClass) GetInstanceVariable(name string) Object {
+	if val, ok := c.Ivars[name]; ok {
+		return val
+	}
+	return NIL
+}
+
+// SetInstanceVariable sets a class-level instance variable.
+func (c *RubyClass) SetInstanceVariable(name string, val Object) {
+	if c.Ivars == nil {
+		c.Ivars = make(map[string]Object)
+	}
+	c.Ivars[name] = val
+}
+
 // LookupMethod looks up a method in the class hierarchy.
 func (c *RubyClass) LookupMethod(name string) (Object, bool) {
 	// Check this class
@@ -588,6 +692,7 @@ type RubyModule struct {
 	Methods     map[string]Object
 	Constants   map[string]Object
 	Refinements map[*RubyClass]*Refinement // Refinements defined in this module
+	Ivars       map[string]Object          // Module-level instance variables
 }
 
 func (m *RubyModule) Type() Type         { return MODULE_OBJ }
@@ -595,6 +700,22 @@ func (m *RubyModule) Inspect() string    { return m.Name }
 func (m *RubyModule) Class() *RubyClass  { return ModuleClass }
 func (m *RubyModule) IsTruthy() bool     { return true }
 
+// GetInstanceVariable gets a module-level instance variable.
+func (m *RubyModule) GetInstanceVariable(name string) Object {
+	if val, ok := m.Ivars[name]; ok {
+		return val
+	}
+	return NIL
+}
+
+// SetInstanceVariable sets a module-level instance variable.
+func (m *RubyModule) SetInstanceVariable(name string, val Object) {
+	if m.Ivars == nil {
+		m.Ivars = make(map[string]Object)
+	}
+	m.Ivars[name] = val
+}
+
 // Refinement represents a refinement for a specific class.
 type Refinement struct {
 	TargetClass *RubyClass        // The class being refined
@@ -606,11 +727,20 @@ func (r *Refinement) Inspect() string    { return fmt.Sprintf("#<refinement:%s>"
 func (r *Refinement) Class() *RubyClass  { return nil }
 func (r *Refinement) IsTruthy() bool     { return true }
 
+// IvarHolder is implemented by the objects that have instance variables:
+// instances, and classes and modules for their class-level variables.
+type IvarHolder interface {
+	Object
+	GetInstanceVariable(name string) Object
+	SetInstanceVariable(name string, val Object)
+}
+
 // Instance represents an instance of a Ruby class.
 type Instance struct {
 	Class_            *RubyClass
 	InstanceVariables map[string]Object
 	SingletonMethods  map[string]Object // Singleton methods for this specific instance
+	Data              any               // Go state behind an instance of a builtin class, like a StringIO's buffer
 }
 
 func (i *Instance) Type() Type      { return INSTANCE_OBJ }
@@ -669,14 +799,20 @@ var (
 	StandardErrorClass *RubyClass
 	RuntimeErrorClass *RubyClass
 	ArgumentErrorClass *RubyClass
+	IndexErrorClass    *RubyClass
+	KeyErrorClass      *RubyClass
 	TypeError         *RubyClass
 	NameErrorClass    *RubyClass
 	NoMethodErrorClass *RubyClass
+	SystemExitClass    *RubyClass
 	IOClass              *RubyClass
 	EnumeratorClass      *RubyClass
 	LazyEnumeratorClass  *RubyClass
 	BindingClass         *RubyClass
 	TracePointClass      *RubyClass
+	TimeClass            *RubyClass // set by the evaluator, which defines Time
+	DateClass            *RubyClass // set by the evaluator, which defines Date
+	DateTimeClass        *RubyClass // set by the evaluator, which defines DateTime
 	KernelModule         *RubyModule
 	ComparableModule     *RubyModule
 	EnumerableModule     *RubyModule
@@ -857,6 +993,22 @@ func init() {
 		Constants:    make(map[string]Object),
 	}
 
+	IndexErrorClass = &RubyClass{
+		Name:         "IndexError",
+		Superclass:   StandardErrorClass,
+		Methods:      make(map[string]Object),
+		ClassMethods: make(map[string]Object),
+		Constants:    make(map[string]Object),
+	}
+
+	KeyErrorClass = &RubyClass{
+		Name:         "KeyError",
+		Superclass:   IndexErrorClass,
+		Methods:      make(map[string]Object),
+		ClassMethods: make(map[string]Object),
+		Constants:    make(map[string]Object),
+	}
+
 	TypeError = &RubyClass{
 		Name:         "TypeError",
 		Superclass:   StandardErrorClass,
@@ -881,6 +1033,14 @@ func init() {
 		Constants:    make(map[string]Object),
 	}
 
+	SystemExitClass = &RubyClass{
+		Name:         "SystemExit",
+		Superclass:   ExceptionClass,
+		Methods:      make(map[string]Object),
+		ClassMethods: make(map[string]Object),
+		Constants:    make(map[string]Object),
+	}
+
 	IOClass = &RubyClass{
 		Name:         "IO",
 		Superclass:   ObjectClass,
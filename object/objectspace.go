@@ -0,0 +1,125 @@
+package object
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ObjectSpace keeps a registry of allocated objects so ObjectSpace.each_object
+// can enumerate them. Recording every instance costs memory and a lock per
+// allocation, so it is off unless SetObjectTracking enables it; classes and
+// modules defined by the program are always recorded, being few and
+// long-lived.
+var (
+	objectTracking int32
+	objectsMutex   sync.RWMutex
+	trackedObjects []Object
+	trackedSet           = make(map[Object]bool)
+	nextObjectID   int64 = 8
+	objectIDMap          = make(map[Object]int64)
+	objectsByID          = make(map[int64]Object)
+)
+
+// SetObjectTracking turns the allocation registry on or off.
+func SetObjectTracking(enabled bool) {
+	var flag int32
+	if enabled {
+		flag = 1
+	}
+	atomic.StoreInt32(&objectTracking, flag)
+}
+
+// ObjectTrackingEnabled reports whether allocations are being recorded.
+func ObjectTrackingEnabled() bool {
+	return atomic.LoadInt32(&objectTracking) == 1
+}
+
+// TrackObject records an allocation when tracking is enabled.
+func TrackObject(obj Object) {
+	if !ObjectTrackingEnabled() {
+		return
+	}
+	register(obj)
+}
+
+// RegisterModule records a class or module regardless of the tracking flag.
+func RegisterModule(obj Object) {
+	register(obj)
+}
+
+func register(obj Object) {
+	objectsMutex.Lock()
+	defer objectsMutex.Unlock()
+	if trackedSet[obj] {
+		return
+	}
+	trackedSet[obj] = true
+	trackedObjects = append(trackedObjects, obj)
+}
+
+// GetTrackedObjects returns all recorded objects in allocation order.
+func GetTrackedObjects() []Object {
+	objectsMutex.RLock()
+	defer objectsMutex.RUnlock()
+	result := make([]Object, len(trackedObjects))
+	copy(result, trackedObjects)
+	return result
+}
+
+// CountObjectsByType counts recorded objects by type.
+func CountObjectsByType() map[Type]int {
+	objectsMutex.RLock()
+	defer objectsMutex.RUnlock()
+
+	counts := make(map[Type]int)
+	for _, obj := range trackedObjects {
+		counts[obj.Type()]++
+	}
+	return counts
+}
+
+// GetObjectID returns the object's id, assigning one on first use. Like
+// MRI, integers, nil, true and false have fixed ids; other ids are
+// multiples of 8 so they never collide with those.
+func GetObjectID(obj Object) int64 {
+	switch o := obj.(type) {
+	case *Integer:
+		return 2*o.Value + 1
+	case *Nil:
+		return 8
+	case *Boolean:
+		if o.Value {
+			return 20
+		}
+		return 0
+	}
+
+	objectsMutex.Lock()
+	defer objectsMutex.Unlock()
+	if id, exists := objectIDMap[obj]; exists {
+		return id
+	}
+	nextObjectID += 8
+	objectIDMap[obj] = nextObjectID
+	objectsByID[nextObjectID] = obj
+	return nextObjectID
+}
+
+// ObjectForID returns the object with the given id, if one was handed out.
+func ObjectForID(id int64) (Object, bool) {
+	switch {
+	case id&1 == 1:
+		return &Integer{Value: (id - 1) / 2}, true
+	case id == 8:
+		return NIL, true
+	case id == 20:
+		return TRUE, true
+	case id == 0:
+		return FALSE, true
+	}
+
+	objectsMutex.RLock()
+	defer objectsMutex.RUnlock()
+	obj, ok := objectsByID[id]
+	return obj, ok
+}
@@ -3,6 +3,7 @@ package parser
 
 import (
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
 
@@ -127,14 +128,25 @@ type (
 // Parser holds the state of the parser
 type Parser struct {
 	l      *lexer.Lexer
-	errors []string
+	errors []Error
+	// diagnostics counts the lexer diagnostics already reported as errors
+	diagnostics int
 
 	curToken  token.Token
 	peekToken token.Token
+	// curEnd and peekEnd are where curToken and peekToken end
+	curEnd  token.Pos
+	peekEnd token.Pos
 
 	// sawNewline indicates that we skipped a newline while getting to peekToken
 	// This is used to properly terminate statements at newlines
 	sawNewline bool
+	// sawSemicolon indicates that the skipped separator was a semicolon,
+	// which block parameters use to start their block-local variables
+	sawSemicolon bool
+
+	// comments holds the comments and embedded documents skipped so far
+	comments []ast.Comment
 
 	prefixParseFns map[token.Type]prefixParseFn
 	infixParseFns  map[token.Type]infixParseFn
@@ -144,7 +156,7 @@ type Parser struct {
 func New(l *lexer.Lexer) *Parser {
 	p := &Parser{
 		l:      l,
-		errors: []string{},
+		errors: []Error{},
 	}
 
 	p.prefixParseFns = make(map[token.Type]prefixParseFn)
@@ -155,13 +167,18 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.STRING_BEGIN, p.parseStringLiteral)
 	p.registerPrefix(token.STRING_CONTENT, p.parseSimpleStringLiteral)
+	p.registerPrefix(token.XSTRING_BEGIN, p.parseXStringLiteral)
+	p.registerPrefix(token.WORDS_BEGIN, p.parseWordArray)
+	p.registerPrefix(token.SYMBOLS_BEGIN, p.parseWordArray)
 	p.registerPrefix(token.SYMBOL_BEGIN, p.parseSymbolLiteral)
 	p.registerPrefix(token.COLON, p.parseSymbolLiteral)
 	p.registerPrefix(token.KEYWORD_TRUE, p.parseBooleanLiteral)
 	p.registerPrefix(token.KEYWORD_FALSE, p.parseBooleanLiteral)
 	p.registerPrefix(token.KEYWORD_NIL, p.parseNilLiteral)
 	p.registerPrefix(token.KEYWORD_SELF, p.parseSelfExpression)
+	p.registerPrefix(token.KEYWORD___ENCODING__, p.parseEncodingKeyword)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
+	p.registerPrefix(token.METHOD_NAME, p.parseIdentifier)
 	p.registerPrefix(token.CONSTANT, p.parseConstant)
 	p.registerPrefix(token.IVAR, p.parseInstanceVariable)
 	p.registerPrefix(token.CVAR, p.parseClassVariable)
@@ -189,10 +206,12 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.MINUS_GREATER, p.parseLambda)
 	p.registerPrefix(token.REGEXP_BEGIN, p.parseRegexpLiteral)
 	p.registerPrefix(token.UCOLON_COLON, p.parseTopLevelConstant)
+	p.registerPrefix(token.COLON_COLON, p.parseTopLevelConstant)
 	p.registerPrefix(token.LABEL, p.parseLabelAsSymbol)
 	p.registerPrefix(token.STAR, p.parseSplatExpression)
 	p.registerPrefix(token.STAR_STAR, p.parseDoubleSplatExpression)
-	p.registerPrefix(token.HEREDOC_BEGIN, p.parseHeredoc)
+	p.registerPrefix(token.AMPERSAND, p.parseBlockArgExpression)
+	p.registerPrefix(token.HEREDOC_BEGIN, p.parseStringLiteral)
 
 	// Register infix parse functions
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
@@ -267,39 +286,144 @@ func (p *Parser) registerInfix(tokenType token.Type, fn infixParseFn) {
 	p.infixParseFns[tokenType] = fn
 }
 
+// Error is a syntax error and the position it was found at.
+type Error struct {
+	Pos token.Pos
+	Msg string
+}
+
+func (e Error) Error() string {
+	return e.Pos.String() + ": " + e.Msg
+}
+
+// FormatError formats msg as "file:line:col: msg" followed by the source
+// line pos is on and a caret under its column. Without a known position
+// it gives just "file: msg".
+func FormatError(filename, source string, pos token.Pos, msg string) string {
+	if !pos.IsValid() {
+		return fmt.Sprintf("%s: %s", filename, msg)
+	}
+	out := fmt.Sprintf("%s:%s: %s", filename, pos, msg)
+
+	lines := strings.Split(source, "\n")
+	if pos.Line > len(lines) {
+		return out
+	}
+	line := strings.TrimRight(lines[pos.Line-1], "\r")
+	// Keep tabs in the indent so the caret lines up with the source
+	var indent strings.Builder
+	for i := 0; i < pos.Column-1 && i < len(line); i++ {
+		if line[i] == '\t' {
+			indent.WriteByte('\t')
+		} else {
+			indent.WriteByte(' ')
+		}
+	}
+	return out + "\n" + line + "\n" + indent.String() + "^"
+}
+
 // Errors returns the parser errors
 func (p *Parser) Errors() []string {
+	msgs := make([]string, len(p.errors))
+	for i, err := range p.errors {
+		msgs[i] = err.Msg
+	}
+	return msgs
+}
+
+// SyntaxErrors returns the parser errors with their positions
+func (p *Parser) SyntaxErrors() []Error {
 	return p.errors
 }
 
+// Comments returns the comments and embedded documents of the source in
+// order, which the tree does not hold. The lexer returns none when it
+// preserves trivia.
+func (p *Parser) Comments() []ast.Comment {
+	return p.comments
+}
+
+// recordComment keeps tok if it is part of a comment or embedded document.
+func (p *Parser) recordComment(tok token.Token) {
+	switch tok.Type {
+	case token.COMMENT:
+		p.comments = append(p.comments, ast.Comment{Pos: tok.Pos(), Text: tok.Literal})
+	case token.EMBDOC_BEGIN:
+		p.comments = append(p.comments, ast.Comment{Pos: tok.Pos(), Text: tok.Literal + "\n"})
+	case token.EMBDOC_LINE, token.EMBDOC_END:
+		if len(p.comments) > 0 {
+			p.comments[len(p.comments)-1].Text += tok.Literal
+		}
+	}
+}
+
+func (p *Parser) addError(pos token.Pos, msg string) {
+	p.errors = append(p.errors, Error{Pos: pos, Msg: msg})
+}
+
 func (p *Parser) peekError(t token.Type) {
 	msg := fmt.Sprintf("expected next token to be %s, got %s instead (literal: %q)",
 		t.String(), p.peekToken.Type.String(), p.peekToken.Literal)
-	p.errors = append(p.errors, msg)
+	p.addError(p.peekToken.Pos(), msg)
 }
 
 func (p *Parser) noPrefixParseFnError(t token.Type) {
 	msg := fmt.Sprintf("no prefix parse function for %s found (literal: %q)",
 		t.String(), p.curToken.Literal)
-	p.errors = append(p.errors, msg)
+	p.addError(p.curToken.Pos(), msg)
+}
+
+// setSpan records that node starts at start and ends with the current
+// token.
+func (p *Parser) setSpan(node ast.Node, start token.Pos) {
+	spanned, ok := node.(interface{ SetSpan(start, end token.Pos) })
+	if !ok || reflect.ValueOf(node).IsNil() {
+		return
+	}
+	spanned.SetSpan(start, p.curEnd)
 }
 
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
-	p.peekToken = p.l.NextToken()
-	// Skip newlines, comments and ignored newlines in most cases
-	// Track if we skipped a newline so we can use it for statement separation
+	p.curEnd = p.peekEnd
+	p.peekToken = p.readToken()
+	p.peekEnd = p.l.Pos()
+	// Skip newlines, semicolons, comments, embedded documents and ignored
+	// newlines in most cases
+	// Track if we skipped a newline so we can use it for statement separation;
+	// a semicolon separates statements the same way
 	p.sawNewline = false
+	p.sawSemicolon = false
 	for p.peekToken.Type == token.NEWLINE ||
+		p.peekToken.Type == token.SEMICOLON ||
 		p.peekToken.Type == token.IGNORED_NEWLINE ||
-		p.peekToken.Type == token.COMMENT {
-		if p.peekToken.Type == token.NEWLINE {
+		p.peekToken.Type == token.COMMENT ||
+		p.peekToken.Type == token.EMBDOC_BEGIN ||
+		p.peekToken.Type == token.EMBDOC_LINE ||
+		p.peekToken.Type == token.EMBDOC_END {
+		if p.peekToken.Type == token.NEWLINE || p.peekToken.Type == token.SEMICOLON {
 			p.sawNewline = true
 		}
-		p.peekToken = p.l.NextToken()
+		if p.peekToken.Type == token.SEMICOLON {
+			p.sawSemicolon = true
+		}
+		p.recordComment(p.peekToken)
+		p.peekToken = p.readToken()
+		p.peekEnd = p.l.Pos()
 	}
 }
 
+// readToken returns the next token from the lexer, reporting any problem
+// the lexer recovered from on the way as a syntax error.
+func (p *Parser) readToken() token.Token {
+	tok := p.l.NextToken()
+	for diagnostics := p.l.Diagnostics(); p.diagnostics < len(diagnostics); p.diagnostics++ {
+		d := diagnostics[p.diagnostics]
+		p.addError(d.Pos, d.Message)
+	}
+	return tok
+}
+
 
 func (p *Parser) curTokenIs(t token.Type) bool {
 	return p.curToken.Type == t
@@ -319,6 +443,16 @@ func (p *Parser) expectPeek(t token.Type) bool {
 }
 
 func (p *Parser) peekPrecedence() int {
+	// A keyword starting a new line begins a statement rather than
+	// modifying the previous one
+	if p.sawNewline && p.peekIsModifier() {
+		return LOWEST
+	}
+	// So does any operator other than a leading-dot method call; a line
+	// starting with * is a splat
+	if p.sawNewline && !p.peekTokenIs(token.DOT) && !p.peekTokenIs(token.AMPERSAND_DOT) {
+		return LOWEST
+	}
 	if prec, ok := precedences[p.peekToken.Type]; ok {
 		return prec
 	}
@@ -337,57 +471,136 @@ func (p *Parser) ParseProgram() *ast.Program {
 	program := &ast.Program{}
 	program.Statements = []ast.Statement{}
 
-	for !p.curTokenIs(token.EOF) {
+	for !p.curTokenIs(token.EOF) && !p.curTokenIs(token.END_MARKER) {
 		stmt := p.parseStatement()
 		if stmt != nil {
 			program.Statements = append(program.Statements, stmt)
 		}
 		p.nextToken()
 	}
+	program.MagicComments = p.l.MagicComments()
+	program.Data, program.HasData = p.l.Data()
 
 	return program
 }
 
 func (p *Parser) parseStatement() ast.Statement {
+	start := p.curToken.Pos()
+	var stmt ast.Statement
 	switch p.curToken.Type {
 	case token.KEYWORD_DEF:
-		return p.parseMethodDefinition()
+		stmt = p.parseMethodDefinition()
 	case token.KEYWORD_CLASS:
-		return p.parseClassDefinition()
+		stmt = p.parseClassDefinition()
 	case token.KEYWORD_MODULE:
-		return p.parseModuleDefinition()
+		stmt = p.parseModuleDefinition()
 	case token.KEYWORD_RETURN:
-		return p.parseReturnStatement()
+		stmt = p.parseStatementModifier(p.parseReturnStatement())
 	case token.KEYWORD_BREAK:
-		return p.parseBreakStatement()
+		stmt = p.parseStatementModifier(p.parseBreakStatement())
 	case token.KEYWORD_NEXT:
-		return p.parseNextStatement()
+		stmt = p.parseStatementModifier(p.parseNextStatement())
 	case token.KEYWORD_REDO:
-		return p.parseRedoStatement()
+		stmt = p.parseRedoStatement()
 	case token.KEYWORD_RETRY:
-		return p.parseRetryStatement()
+		stmt = p.parseRetryStatement()
 	case token.KEYWORD_ALIAS:
-		return p.parseAliasStatement()
+		stmt = p.parseAliasStatement()
 	case token.KEYWORD_UNDEF:
-		return p.parseUndefStatement()
+		stmt = p.parseUndefStatement()
 	default:
-		return p.parseExpressionStatement()
+		stmt = p.parseExpressionStatement()
 	}
+	p.setSpan(stmt, start)
+	return stmt
+}
+
+// parseStatementModifier wraps stmt in a ModifierStatement when it is
+// followed by a modifier, as in `return x if done`.
+func (p *Parser) parseStatementModifier(stmt ast.Statement) ast.Statement {
+	if !p.peekIsModifier() {
+		return stmt
+	}
+	p.nextToken()
+	modified := &ast.ModifierStatement{
+		Token:    p.curToken,
+		Body:     stmt,
+		Modifier: p.curToken.Literal,
+	}
+	p.nextToken()
+	modified.Condition = p.parseBlockContextExpression(LOWEST)
+	return modified
 }
 
 func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
 	stmt.Expression = p.parseExpression(LOWEST)
+	if p.peekTokenIs(token.COMMA) && !p.sawNewline {
+		stmt.Expression = p.parseMultipleAssignment(stmt.Expression)
+	}
 	return stmt
 }
 
+// parseMultipleAssignment continues a statement whose first expression is
+// followed by a comma: either further targets of a multiple assignment
+// (a, *rest = list) or further values of a plain one (x = 1, 2), which are
+// collected into an array.
+func (p *Parser) parseMultipleAssignment(first ast.Expression) ast.Expression {
+	if assign, ok := first.(*ast.AssignmentExpression); ok {
+		values := []ast.Expression{assign.Value}
+		values = append(values, p.parseAssignmentValues()...)
+		assign.Value = &ast.ArrayLiteral{Token: assign.Token, Elements: values}
+		return assign
+	}
+
+	ma := &ast.MultipleAssignment{Left: []ast.Expression{first}}
+	for p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		// A trailing comma, as in a, = list, only marks the assignment
+		// as multiple
+		if p.peekTokenIs(token.EQUAL) {
+			break
+		}
+		p.nextToken()
+		ma.Left = append(ma.Left, p.parseExpression(ASSIGNMENT))
+	}
+	if !p.expectPeek(token.EQUAL) {
+		return nil
+	}
+	return p.parseMultipleAssignmentValues(ma)
+}
+
+// parseMultipleAssignmentValues parses the right side of a multiple
+// assignment, with the current token on the =.
+func (p *Parser) parseMultipleAssignmentValues(ma *ast.MultipleAssignment) *ast.MultipleAssignment {
+	ma.Token = p.curToken
+	p.nextToken()
+	ma.Right = []ast.Expression{p.parseExpression(ASSIGNMENT - 1)}
+	ma.Right = append(ma.Right, p.parseAssignmentValues()...)
+	return ma
+}
+
+// parseAssignmentValues parses the comma-separated values that follow the
+// first one on the right of an assignment.
+func (p *Parser) parseAssignmentValues() []ast.Expression {
+	var values []ast.Expression
+	for p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		p.nextToken()
+		values = append(values, p.parseExpression(ASSIGNMENT-1))
+	}
+	return values
+}
+
 func (p *Parser) parseExpression(precedence int) ast.Expression {
 	prefix := p.prefixParseFns[p.curToken.Type]
 	if prefix == nil {
 		p.noPrefixParseFnError(p.curToken.Type)
 		return nil
 	}
+	start := p.curToken.Pos()
 	leftExp := prefix()
+	p.setSpan(leftExp, start)
 
 	for !p.peekTokenIs(token.EOF) && precedence < p.peekPrecedence() {
 		infix := p.infixParseFns[p.peekToken.Type]
@@ -396,6 +609,7 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 		}
 		p.nextToken()
 		leftExp = infix(leftExp)
+		p.setSpan(leftExp, start)
 	}
 
 	return leftExp
@@ -424,7 +638,7 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 
 	if err != nil {
 		msg := fmt.Sprintf("could not parse %q as integer", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.addError(p.curToken.Pos(), msg)
 		return nil
 	}
 
@@ -439,7 +653,7 @@ func (p *Parser) parseFloatLiteral() ast.Expression {
 	value, err := strconv.ParseFloat(literal, 64)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse %q as float", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.addError(p.curToken.Pos(), msg)
 		return nil
 	}
 
@@ -456,7 +670,7 @@ func (p *Parser) parseStringLiteral() ast.Expression {
 	// Move past STRING_BEGIN
 	p.nextToken()
 
-	for !p.curTokenIs(token.STRING_END) && !p.curTokenIs(token.EOF) {
+	for !p.curTokenIs(token.STRING_END) && !p.curTokenIs(token.HEREDOC_END) && !p.curTokenIs(token.EOF) {
 		switch p.curToken.Type {
 		case token.STRING_CONTENT:
 			currentContent.WriteString(p.curToken.Literal)
@@ -494,7 +708,6 @@ func (p *Parser) parseStringLiteral() ast.Expression {
 			if expr != nil {
 				parts = append(parts, expr)
 			}
-			continue // Don't advance, parseExpression already did
 		default:
 			currentContent.WriteString(p.curToken.Literal)
 		}
@@ -518,9 +731,114 @@ func (p *Parser) parseStringLiteral() ast.Expression {
 
 	// Simple string
 	return &ast.StringLiteral{
-		Token: startToken,
-		Value: currentContent.String(),
+		Token:  startToken,
+		Value:  currentContent.String(),
+		Frozen: startToken.Type != token.XSTRING_BEGIN && p.frozenStringLiterals(),
+	}
+}
+
+// frozenStringLiterals reports whether a frozen_string_literal: true magic
+// comment freezes the string literals of the file.
+func (p *Parser) frozenStringLiterals() bool {
+	return strings.EqualFold(p.l.MagicComments()["frozen_string_literal"], "true")
+}
+
+func (p *Parser) parseXStringLiteral() ast.Expression {
+	tok := p.curToken
+	xstr := &ast.XStringLiteral{Token: tok}
+	switch str := p.parseStringLiteral().(type) {
+	case *ast.InterpolatedString:
+		xstr.Parts = str.Parts
+	case *ast.StringLiteral:
+		xstr.Parts = []ast.Expression{str}
 	}
+	return xstr
+}
+
+// parseWordArray parses a %w, %W, %i or %I literal into an array of the
+// strings or symbols its words make.
+func (p *Parser) parseWordArray() ast.Expression {
+	array := &ast.ArrayLiteral{Token: p.curToken}
+	array.Elements = []ast.Expression{}
+	symbols := p.curTokenIs(token.SYMBOLS_BEGIN)
+
+	p.nextToken()
+	for !p.curTokenIs(token.STRING_END) && !p.curTokenIs(token.EOF) {
+		if !p.curTokenIs(token.WORDS_SEP) {
+			array.Elements = append(array.Elements, p.parseWord(symbols))
+		}
+		p.nextToken()
+	}
+	return array
+}
+
+// parseWord parses the word of a word array starting at the current token,
+// leaving the last token of the word current.
+func (p *Parser) parseWord(symbol bool) ast.Expression {
+	startToken := p.curToken
+	var parts []ast.Expression
+	var currentContent strings.Builder
+	hasInterpolation := false
+
+	for {
+		switch p.curToken.Type {
+		case token.EMBEXPR_BEGIN, token.EMBVAR:
+			if currentContent.Len() > 0 {
+				parts = append(parts, &ast.StringLiteral{
+					Token: p.curToken,
+					Value: currentContent.String(),
+				})
+				currentContent.Reset()
+			}
+			hasInterpolation = true
+			embexpr := p.curTokenIs(token.EMBEXPR_BEGIN)
+			p.nextToken()
+			expr := p.parseExpression(LOWEST)
+			if expr != nil {
+				parts = append(parts, expr)
+			}
+			if embexpr {
+				p.expectPeek(token.EMBEXPR_END)
+			}
+		default:
+			currentContent.WriteString(p.curToken.Literal)
+		}
+		if p.peekTokenIs(token.WORDS_SEP) || p.peekTokenIs(token.STRING_END) || p.peekTokenIs(token.EOF) {
+			break
+		}
+		p.nextToken()
+	}
+
+	if !hasInterpolation {
+		if symbol {
+			return &ast.SymbolLiteral{Token: startToken, Value: currentContent.String()}
+		}
+		return &ast.StringLiteral{
+			Token:  startToken,
+			Value:  currentContent.String(),
+			Frozen: p.frozenStringLiterals(),
+		}
+	}
+	if currentContent.Len() > 0 {
+		parts = append(parts, &ast.StringLiteral{
+			Token: startToken,
+			Value: currentContent.String(),
+		})
+	}
+	if symbol {
+		return &ast.InterpolatedSymbol{Token: startToken, Parts: parts}
+	}
+	return &ast.InterpolatedString{Token: startToken, Parts: parts}
+}
+
+// parseEncodingKeyword parses __ENCODING__, which names the encoding given
+// by the file's magic comment, or UTF-8 without one.
+func (p *Parser) parseEncodingKeyword() ast.Expression {
+	encoding := p.l.MagicComments()["encoding"]
+	if encoding == "" {
+		encoding = "UTF-8"
+	}
+	return &ast.MagicComment{Token: p.curToken, Kind: "ENCODING", Encoding: encoding}
 }
 
 func (p *Parser) parseSimpleStringLiteral() ast.Expression {
@@ -533,6 +851,16 @@ func (p *Parser) parseSimpleStringLiteral() ast.Expression {
 func (p *Parser) parseSymbolLiteral() ast.Expression {
 	tok := p.curToken
 
+	// A quoted symbol is read as a string, interpolation and all
+	if p.curTokenIs(token.SYMBOL_BEGIN) && len(tok.Literal) > 1 {
+		switch str := p.parseStringLiteral().(type) {
+		case *ast.InterpolatedString:
+			return &ast.InterpolatedSymbol{Token: tok, Parts: str.Parts}
+		case *ast.StringLiteral:
+			return &ast.SymbolLiteral{Token: tok, Value: str.Value}
+		}
+	}
+
 	// Handle :symbol or :"string" syntax
 	if p.curTokenIs(token.COLON) || p.curTokenIs(token.SYMBOL_BEGIN) {
 		p.nextToken()
@@ -602,16 +930,18 @@ func (p *Parser) parseIdentifier() ast.Expression {
 		p.peekTokenIs(token.FLOAT) || p.peekTokenIs(token.STRING_BEGIN) ||
 		p.peekTokenIs(token.COLON) || p.peekTokenIs(token.SYMBOL_BEGIN) ||
 		p.peekTokenIs(token.KEYWORD_TRUE) || p.peekTokenIs(token.KEYWORD_FALSE) ||
-		p.peekTokenIs(token.KEYWORD_NIL) ||
-		p.peekTokenIs(token.LBRACE) || p.peekTokenIs(token.IVAR) ||
+		p.peekTokenIs(token.KEYWORD_NIL) || p.peekTokenIs(token.IVAR) ||
 		p.peekTokenIs(token.CVAR) || p.peekTokenIs(token.GVAR) ||
-		p.peekTokenIs(token.CONSTANT) ||
-		p.peekTokenIs(token.AMPERSAND)) {
+		p.peekTokenIs(token.CONSTANT) || p.peekTokenIs(token.KEYWORD___ENCODING__) ||
+		p.peekTokenIs(token.WORDS_BEGIN) || p.peekTokenIs(token.SYMBOLS_BEGIN) ||
+		p.peekTokenIs(token.XSTRING_BEGIN) || p.peekTokenIs(token.HEREDOC_BEGIN) ||
+		(p.peekTokenIs(token.AMPERSAND) && !p.l.SpaceFollows())) {
 		return p.parseMethodCallWithoutParens(ident)
 	}
 
-	// Check for method call with parentheses
-	if p.peekTokenIs(token.LPAREN) || p.peekTokenIs(token.LPAREN_ARG) {
+	// Check for method call with parentheses; a parenthesis starting the
+	// next line begins a new statement
+	if !p.sawNewline && (p.peekTokenIs(token.LPAREN) || p.peekTokenIs(token.LPAREN_ARG)) {
 		return p.parseMethodCallWithParens(ident)
 	}
 
@@ -625,6 +955,10 @@ func (p *Parser) parseIdentifier() ast.Expression {
 }
 
 func (p *Parser) parseConstant() ast.Expression {
+	// Capitalized method calls such as Array(x) or Integer("1")
+	if p.peekTokenIs(token.LPAREN) && !p.sawNewline {
+		return p.parseMethodCallWithParens(&ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+	}
 	return &ast.Constant{Token: p.curToken, Value: p.curToken.Literal}
 }
 
@@ -679,10 +1013,26 @@ func (p *Parser) parsePrefixExpression() ast.Expression {
 }
 
 func (p *Parser) parseGroupedExpression() ast.Expression {
+	tok := p.curToken
 	p.nextToken()
 
 	exp := p.parseExpression(LOWEST)
 
+	// (a, b) is a nested target of a multiple assignment
+	if p.peekTokenIs(token.COMMA) {
+		group := &ast.MultipleTarget{Token: tok, Targets: []ast.Expression{exp}}
+		for p.peekTokenIs(token.COMMA) {
+			p.nextToken()
+			p.nextToken()
+			group.Targets = append(group.Targets, p.parseExpression(ASSIGNMENT))
+		}
+		exp = group
+		if p.peekTokenIs(token.EQUAL) {
+			p.nextToken()
+			exp = p.parseMultipleAssignmentValues(&ast.MultipleAssignment{Left: group.Targets})
+		}
+	}
+
 	if !p.expectPeek(token.RPAREN) {
 		return nil
 	}
@@ -709,13 +1059,31 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 	p.nextToken()
 
 	for {
-		key := p.parseExpression(LOWEST)
+		var key ast.Expression
+		if p.curTokenIs(token.LABEL) {
+			// A label is a complete key; don't let the value's
+			// leading token (e.g. `[`) parse as an operator on it
+			key = p.parseLabelAsSymbol()
+		} else {
+			key = p.parseExpression(LOWEST)
+		}
 		if key == nil {
 			return nil
 		}
 
 		// Check for label syntax (foo: value)
 		if p.curTokenIs(token.LABEL) {
+			if p.peekTokenIs(token.COMMA) || p.peekTokenIs(token.RBRACE) {
+				// Value omitted ({x:, y:})
+				hash.Pairs[key] = p.omittedHashValue(strings.TrimSuffix(p.curToken.Literal, ":"))
+				hash.Order = append(hash.Order, key)
+				if p.peekTokenIs(token.RBRACE) {
+					break
+				}
+				p.nextToken()
+				p.nextToken()
+				continue
+			}
 			// The key is already parsed as a symbol from the label
 			// Move to the value
 			p.nextToken()
@@ -775,27 +1143,28 @@ func (p *Parser) parseExpressionList(end token.Type) []ast.Expression {
 	// Check for keyword argument pattern (LABEL token like "name:")
 	if p.curTokenIs(token.LABEL) {
 		// Start collecting keyword arguments as a hash
-		hash := p.parseImplicitHash(end)
-		list = append(list, hash)
+		hash, blockArg := p.parseImplicitHash(end)
+		list = appendBlockArg(append(list, hash), blockArg)
 	} else if p.curTokenIs(token.IDENT) && p.peekTokenIs(token.COLON) {
 		// Also handle ident: pattern
-		hash := p.parseImplicitHash(end)
-		list = append(list, hash)
+		hash, blockArg := p.parseImplicitHash(end)
+		list = appendBlockArg(append(list, hash), blockArg)
 	} else {
-		list = append(list, p.parseExpression(LOWEST))
+		elem, blockArg := p.parseListElement()
+		list = appendBlockArg(append(list, elem), blockArg)
 
-		for p.peekTokenIs(token.COMMA) {
+		for blockArg == nil && p.peekTokenIs(token.COMMA) {
 			p.nextToken() // move to comma
 			p.nextToken() // move to next expression
 
 			// Check if remaining arguments are keyword args
 			if p.curTokenIs(token.LABEL) || (p.curTokenIs(token.IDENT) && p.peekTokenIs(token.COLON)) {
-				hash := p.parseImplicitHash(end)
-				list = append(list, hash)
-				return list // hash consumes rest of arguments
+				hash, blockArg := p.parseImplicitHash(end)
+				return appendBlockArg(append(list, hash), blockArg) // hash consumes rest of arguments
 			}
 
-			list = append(list, p.parseExpression(LOWEST))
+			elem, blockArg = p.parseListElement()
+			list = appendBlockArg(append(list, elem), blockArg)
 		}
 
 		if !p.expectPeek(end) {
@@ -806,32 +1175,86 @@ func (p *Parser) parseExpressionList(end token.Type) []ast.Expression {
 	return list
 }
 
-// parseImplicitHash parses keyword arguments as an implicit hash (without braces)
-func (p *Parser) parseImplicitHash(end token.Type) *ast.HashLiteral {
+// appendBlockArg appends the &expr argument that ended a list, if any.
+func appendBlockArg(list []ast.Expression, blockArg ast.Expression) []ast.Expression {
+	if blockArg == nil {
+		return list
+	}
+	return append(list, blockArg)
+}
+
+// parseListElement parses one element of an expression list. An element
+// followed by => starts a braceless hash, as in `foo(:a => 1, "b" => 2)`,
+// which takes the remaining elements as its pairs up to a block argument,
+// returned separately.
+func (p *Parser) parseListElement() (ast.Expression, ast.Expression) {
+	first := p.parseExpression(LOWEST)
+	if !p.peekTokenIs(token.EQUAL_GREATER) {
+		return first, nil
+	}
+
+	hash := &ast.HashLiteral{
+		Token: p.curToken,
+		Pairs: make(map[ast.Expression]ast.Expression),
+		Order: []ast.Expression{},
+	}
+	key := first
+	for {
+		if !p.expectPeek(token.EQUAL_GREATER) {
+			return nil, nil
+		}
+		p.nextToken() // move to value
+		value := p.parseExpression(LOWEST)
+		if key == nil || value == nil {
+			return nil, nil
+		}
+		hash.Pairs[key] = value
+		hash.Order = append(hash.Order, key)
+
+		if !p.peekTokenIs(token.COMMA) {
+			return hash, nil
+		}
+		p.nextToken() // consume comma
+		p.nextToken() // move to next key
+		if p.curTokenIs(token.AMPERSAND) {
+			return hash, p.parseBlockArgExpression()
+		}
+		key = p.parseExpression(LOWEST)
+	}
+}
+
+// parseImplicitHash parses keyword arguments as an implicit hash (without
+// braces), along with a block argument following them
+func (p *Parser) parseImplicitHash(end token.Type) (*ast.HashLiteral, ast.Expression) {
 	hash := &ast.HashLiteral{
 		Token:         p.curToken,
 		Pairs:         make(map[ast.Expression]ast.Expression),
 		Order:         []ast.Expression{},
 		IsKeywordArgs: true,
 	}
+	var blockArg ast.Expression
 
 	for !p.curTokenIs(end) && !p.curTokenIs(token.EOF) {
+		// A block argument ends the keyword arguments: foo(a: 1, &blk)
+		if p.curTokenIs(token.AMPERSAND) {
+			blockArg = p.parseBlockArgExpression()
+			break
+		}
+
 		var keyName string
 
 		// Parse key - handle both LABEL ("name:") and IDENT + COLON patterns
 		if p.curTokenIs(token.LABEL) {
 			// LABEL is "name:" - strip the colon
 			keyName = strings.TrimSuffix(p.curToken.Literal, ":")
-			p.nextToken() // move to value
 		} else if p.curTokenIs(token.IDENT) {
 			keyName = p.curToken.Literal
 			if !p.expectPeek(token.COLON) {
-				return hash
+				return hash, nil
 			}
-			p.nextToken() // move to value
 		} else {
-			p.errors = append(p.errors, fmt.Sprintf("expected keyword argument, got %s", p.curToken.Type))
-			return hash
+			p.addError(p.curToken.Pos(), fmt.Sprintf("expected keyword argument, got %s", p.curToken.Type))
+			return hash, nil
 		}
 
 		// Create symbol key
@@ -840,7 +1263,14 @@ func (p *Parser) parseImplicitHash(end token.Type) *ast.HashLiteral {
 			Value: keyName,
 		}
 
-		value := p.parseExpression(LOWEST)
+		var value ast.Expression
+		if p.peekTokenIs(token.COMMA) || p.peekTokenIs(end) {
+			// Value omitted (foo(x:, y:))
+			value = p.omittedHashValue(keyName)
+		} else {
+			p.nextToken() // move to value
+			value = p.parseExpression(LOWEST)
+		}
 
 		hash.Pairs[key] = value
 		hash.Order = append(hash.Order, key)
@@ -854,10 +1284,23 @@ func (p *Parser) parseImplicitHash(end token.Type) *ast.HashLiteral {
 	}
 
 	if !p.expectPeek(end) {
-		return nil
+		return nil, nil
 	}
 
-	return hash
+	return hash, blockArg
+}
+
+// omittedHashValue is the value of a key written without one, as in
+// {x:, y:}: the local variable, method or constant of the same name.
+func (p *Parser) omittedHashValue(name string) ast.Expression {
+	tok := p.curToken
+	tok.Literal = name
+	if token.IsConstant(name) {
+		tok.Type = token.CONSTANT
+		return &ast.Constant{Token: tok, Value: name}
+	}
+	tok.Type = token.IDENT
+	return &ast.Identifier{Token: tok, Value: name}
 }
 
 // Infix expressions
@@ -889,6 +1332,11 @@ func (p *Parser) parseRangeExpression(left ast.Expression) ast.Expression {
 		Exclusive: p.curTokenIs(token.DOT_DOT_DOT),
 	}
 
+	// Endless range such as arr[1..] or (1..)
+	if p.peekIsStatementEnd() || p.peekTokenIs(token.COMMA) {
+		return expression
+	}
+
 	precedence := p.curPrecedence()
 	p.nextToken()
 	expression.End = p.parseExpression(precedence)
@@ -923,14 +1371,10 @@ func (p *Parser) parseOpAssignment(left ast.Expression) ast.Expression {
 
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
-
-	p.nextToken()
-	exp.Index = p.parseExpression(LOWEST)
-
-	if !p.expectPeek(token.RBRACKET) {
+	exp.Arguments = p.parseExpressionList(token.RBRACKET)
+	if exp.Arguments == nil {
 		return nil
 	}
-
 	return exp
 }
 
@@ -938,6 +1382,16 @@ func (p *Parser) parseMethodCall(left ast.Expression) ast.Expression {
 	tok := p.curToken
 	p.nextToken() // move past .
 
+	// recv.(args) is shorthand for recv.call(args)
+	if p.curTokenIs(token.LPAREN) || p.curTokenIs(token.LPAREN_ARG) || p.curTokenIs(token.LPAREN_BEG) {
+		return &ast.MethodCall{
+			Token:     tok,
+			Receiver:  left,
+			Method:    "call",
+			Arguments: p.parseExpressionList(token.RPAREN),
+		}
+	}
+
 	methodName := p.curToken.Literal
 
 	call := &ast.MethodCall{
@@ -946,10 +1400,12 @@ func (p *Parser) parseMethodCall(left ast.Expression) ast.Expression {
 		Method:   methodName,
 	}
 
-	// Check for arguments
+	// Check for arguments, with or without parentheses
 	if p.peekTokenIs(token.LPAREN) || p.peekTokenIs(token.LPAREN_ARG) {
 		p.nextToken()
 		call.Arguments = p.parseExpressionList(token.RPAREN)
+	} else if !p.sawNewline && p.peekStartsCommandArg() {
+		call.Arguments = p.parseArgumentsWithoutParens()
 	}
 
 	// Check for block
@@ -962,6 +1418,21 @@ func (p *Parser) parseMethodCall(left ast.Expression) ast.Expression {
 	return call
 }
 
+// peekStartsCommandArg reports whether the peek token can begin the first
+// argument of a call written without parentheses, as in recv.puts "hi".
+// Operators are left out so that recv.size - 1 and recv.list [0] keep
+// their binary and index meanings.
+func (p *Parser) peekStartsCommandArg() bool {
+	switch p.peekToken.Type {
+	case token.IDENT, token.INTEGER, token.FLOAT, token.STRING_BEGIN,
+		token.SYMBOL_BEGIN, token.KEYWORD_TRUE, token.KEYWORD_FALSE,
+		token.KEYWORD_NIL, token.IVAR, token.CVAR, token.GVAR, token.CONSTANT,
+		token.WORDS_BEGIN, token.SYMBOLS_BEGIN, token.XSTRING_BEGIN, token.HEREDOC_BEGIN:
+		return true
+	}
+	return false
+}
+
 func (p *Parser) parseSafeNavigation(left ast.Expression) ast.Expression {
 	tok := p.curToken
 	p.nextToken() // move past &.
@@ -1186,20 +1657,30 @@ func (p *Parser) parseBlock() *ast.Block {
 	isBrace := p.curTokenIs(token.LBRACE) || p.curTokenIs(token.LBRACE_BLOCK)
 
 	// Parse parameters if present
+	var locals []string
 	if p.peekTokenIs(token.PIPE) {
 		p.nextToken() // move to |
-		block.Parameters = p.parseBlockParameters()
+		block.Parameters, locals = p.parseBlockParameters()
 	}
 
 	block.Body = p.parseBlockBody(isBrace)
+	block.Body.Locals = locals
 
+	p.setSpan(block, block.Token.Pos())
 	return block
 }
 
-func (p *Parser) parseBlockParameters() []*ast.BlockParameter {
+// parseBlockParameters parses the parameters between pipes, along with
+// the block-local variables declared after a semicolon (|x; tmp|).
+func (p *Parser) parseBlockParameters() ([]*ast.BlockParameter, []string) {
 	params := []*ast.BlockParameter{}
+	var locals []string
 
+	onlyLocals := p.sawSemicolon // |;tmp|
 	p.nextToken() // move past opening |
+	if onlyLocals {
+		return params, p.parseBlockLocals()
+	}
 
 	for !p.curTokenIs(token.PIPE) && !p.curTokenIs(token.EOF) {
 		param := &ast.BlockParameter{Token: p.curToken}
@@ -1221,7 +1702,8 @@ func (p *Parser) parseBlockParameters() []*ast.BlockParameter {
 		if p.peekTokenIs(token.EQUAL) {
 			p.nextToken() // move to =
 			p.nextToken() // move to default value
-			param.Default = p.parseExpression(LOWEST)
+			// Stop before | so the closing pipe is not read as bitwise or
+			param.Default = p.parseExpression(BITOR)
 		}
 
 		params = append(params, param)
@@ -1229,14 +1711,36 @@ func (p *Parser) parseBlockParameters() []*ast.BlockParameter {
 		if p.peekTokenIs(token.COMMA) {
 			p.nextToken() // move to comma
 			p.nextToken() // move to next param
+		} else if p.sawSemicolon {
+			p.nextToken() // move to first block-local
+			locals = p.parseBlockLocals()
+			break
 		} else {
 			p.nextToken() // move to closing |
 		}
 	}
 
-	return params
+	return params, locals
 }
 
+// parseBlockLocals parses the block-local variable names after the
+// semicolon in block parameters, starting on the first and ending on the
+// closing |.
+func (p *Parser) parseBlockLocals() []string {
+	locals := []string{p.curToken.Literal}
+	for p.peekTokenIs(token.COMMA) {
+		p.nextToken() // move to comma
+		if !p.expectPeek(token.IDENT) {
+			return locals
+		}
+		locals = append(locals, p.curToken.Literal)
+	}
+	p.expectPeek(token.PIPE)
+	return locals
+}
+
+
+
 func (p *Parser) parseBlockBody(isBrace bool) *ast.BlockBody {
 	body := &ast.BlockBody{}
 	body.Statements = []ast.Statement{}
@@ -1376,6 +1880,10 @@ func (p *Parser) parseCaseExpression() ast.Expression {
 		p.nextToken()
 	}
 
+	if p.curTokenIs(token.KEYWORD_IN) {
+		return p.parseCaseInExpression(expression.Token, expression.Subject)
+	}
+
 	// Parse when clauses
 	for p.curTokenIs(token.KEYWORD_WHEN) {
 		when := p.parseWhenClause()
@@ -1429,6 +1937,369 @@ func (p *Parser) parseWhenClause() *ast.WhenClause {
 	return when
 }
 
+// parseCaseInExpression parses the in clauses of a pattern-matching case,
+// starting on the first in.
+func (p *Parser) parseCaseInExpression(tok token.Token, subject ast.Expression) ast.Expression {
+	expression := &ast.CaseInExpression{Token: tok, Subject: subject}
+
+	for p.curTokenIs(token.KEYWORD_IN) {
+		expression.Clauses = append(expression.Clauses, p.parseInClause())
+	}
+
+	if p.curTokenIs(token.KEYWORD_ELSE) {
+		p.nextToken()
+		expression.Else = p.parseBlockBodyUntilEnd()
+	}
+
+	return expression
+}
+
+func (p *Parser) parseInClause() *ast.InClause {
+	clause := &ast.InClause{Token: p.curToken}
+
+	p.nextToken()
+	clause.Pattern = p.parseTopPattern()
+
+	// Optional guard
+	if !p.sawNewline {
+		switch p.peekToken.Type {
+		case token.KEYWORD_IF, token.KEYWORD_IF_MODIFIER:
+			p.nextToken()
+			p.nextToken()
+			clause.Guard = p.parseExpression(MODIFIER)
+		case token.KEYWORD_UNLESS, token.KEYWORD_UNLESS_MODIFIER:
+			p.nextToken()
+			p.nextToken()
+			clause.Guard = p.parseExpression(MODIFIER)
+			clause.Unless = true
+		}
+	}
+
+	// Skip optional 'then'
+	if p.peekTokenIs(token.KEYWORD_THEN) {
+		p.nextToken()
+	}
+
+	clause.Body = &ast.BlockBody{}
+	clause.Body.Statements = []ast.Statement{}
+
+	p.nextToken()
+
+	for !p.curTokenIs(token.KEYWORD_IN) &&
+		!p.curTokenIs(token.KEYWORD_ELSE) &&
+		!p.curTokenIs(token.KEYWORD_END) &&
+		!p.curTokenIs(token.EOF) {
+		stmt := p.parseStatement()
+		if stmt != nil {
+			clause.Body.Statements = append(clause.Body.Statements, stmt)
+		}
+		p.nextToken()
+	}
+
+	return clause
+}
+
+// parseTopPattern parses the pattern of an in clause, where the brackets
+// of an array pattern (in a, *rest) and the braces of a hash pattern
+// (in name:, age:) may be left out.
+func (p *Parser) parseTopPattern() ast.Pattern {
+	if p.curTokenIs(token.LABEL) || p.curTokenIs(token.STAR_STAR) {
+		return p.parseHashPatternBody(p.curToken, nil, token.EOF)
+	}
+	tok := p.curToken
+	first := p.parsePatternElement()
+	if _, ok := first.(*ast.RestPattern); ok || p.peekTokenIs(token.COMMA) && !p.sawNewline {
+		return p.finishArrayPattern(tok, nil, token.EOF, first)
+	}
+	return first
+}
+
+// parsePattern parses alternatives and a trailing => binding.
+func (p *Parser) parsePattern() ast.Pattern {
+	tok := p.curToken
+	pattern := p.parsePrimaryPattern()
+
+	if p.peekTokenIs(token.PIPE) {
+		alt := &ast.AlternativePattern{Token: tok, Alternatives: []ast.Pattern{pattern}}
+		for p.peekTokenIs(token.PIPE) {
+			p.nextToken()
+			p.nextToken()
+			alt.Alternatives = append(alt.Alternatives, p.parsePrimaryPattern())
+		}
+		pattern = alt
+	}
+
+	for p.peekTokenIs(token.EQUAL_GREATER) {
+		p.nextToken()
+		arrow := p.curToken
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		pattern = &ast.CapturePattern{Token: arrow, Pattern: pattern, Name: p.curToken.Literal}
+	}
+
+	p.setSpan(pattern, tok.Pos())
+	return pattern
+}
+
+func (p *Parser) parsePrimaryPattern() ast.Pattern {
+	tok := p.curToken
+	switch p.curToken.Type {
+	case token.LBRACKET, token.LBRACKET_ARRAY:
+		p.nextToken()
+		return p.parseArrayPatternBody(tok, nil, token.RBRACKET)
+	case token.LBRACE:
+		p.nextToken()
+		return p.parseHashPatternBody(tok, nil, token.RBRACE)
+	case token.LPAREN, token.LPAREN_BEG:
+		p.nextToken()
+		pattern := p.parsePattern()
+		if !p.expectPeek(token.RPAREN) {
+			return nil
+		}
+		return pattern
+	case token.CARET:
+		return p.parsePinPattern()
+	case token.IDENT:
+		return &ast.BindingPattern{Token: tok, Name: tok.Literal}
+	case token.CONSTANT, token.UCOLON_COLON:
+		return p.parseConstantPattern()
+	case token.DOT_DOT, token.DOT_DOT_DOT:
+		// Beginless range
+		rangeExp := &ast.RangeLiteral{Token: tok, Exclusive: tok.Type == token.DOT_DOT_DOT}
+		p.nextToken()
+		rangeExp.End = p.parseExpression(RANGE)
+		return &ast.ValuePattern{Token: tok, Value: rangeExp}
+	}
+	return p.parseValuePattern()
+}
+
+// parseValuePattern parses a literal or other expression, stopping before
+// | so that it separates alternatives.
+func (p *Parser) parseValuePattern() ast.Pattern {
+	tok := p.curToken
+	value := p.parseExpression(BITOR)
+	if p.peekTokenIs(token.DOT_DOT) || p.peekTokenIs(token.DOT_DOT_DOT) {
+		p.nextToken()
+		rangeExp := &ast.RangeLiteral{Token: p.curToken, Start: value, Exclusive: p.curTokenIs(token.DOT_DOT_DOT)}
+		// An endless range ends the pattern
+		if !p.sawNewline && !p.peekPatternEnd() {
+			p.nextToken()
+			rangeExp.End = p.parseExpression(BITOR)
+		}
+		value = rangeExp
+	}
+	return &ast.ValuePattern{Token: tok, Value: value}
+}
+
+// peekPatternEnd reports whether the next token closes the current
+// pattern.
+func (p *Parser) peekPatternEnd() bool {
+	switch p.peekToken.Type {
+	case token.COMMA, token.RBRACKET, token.RBRACE, token.RPAREN, token.PIPE,
+		token.EQUAL_GREATER, token.KEYWORD_THEN, token.KEYWORD_IF, token.KEYWORD_IF_MODIFIER,
+		token.KEYWORD_UNLESS, token.KEYWORD_UNLESS_MODIFIER, token.EOF:
+		return true
+	}
+	return false
+}
+
+// parsePinPattern parses ^name, ^@ivar or ^(expression).
+func (p *Parser) parsePinPattern() ast.Pattern {
+	pin := &ast.PinPattern{Token: p.curToken}
+	p.nextToken()
+	switch p.curToken.Type {
+	case token.LPAREN, token.LPAREN_BEG:
+		p.nextToken()
+		pin.Value = p.parseExpression(LOWEST)
+		if !p.expectPeek(token.RPAREN) {
+			return nil
+		}
+	case token.IDENT:
+		pin.Value = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	case token.IVAR:
+		pin.Value = &ast.InstanceVariable{Token: p.curToken, Name: p.curToken.Literal}
+	case token.CVAR:
+		pin.Value = &ast.ClassVariable{Token: p.curToken, Name: p.curToken.Literal}
+	case token.GVAR:
+		pin.Value = &ast.GlobalVariable{Token: p.curToken, Name: p.curToken.Literal}
+	default:
+		p.addError(p.curToken.Pos(), fmt.Sprintf("unexpected %s after ^ in pattern", p.curToken.Type.String()))
+		return nil
+	}
+	return pin
+}
+
+// parseConstantPattern parses a constant path, which matches with === on
+// its own, or checks the subject before destructuring it when followed by
+// Const(...) or Const[...].
+func (p *Parser) parseConstantPattern() ast.Pattern {
+	tok := p.curToken
+	var constant ast.Expression
+	if p.curTokenIs(token.UCOLON_COLON) {
+		if !p.expectPeek(token.CONSTANT) {
+			return nil
+		}
+		constant = &ast.ScopedConstant{Token: tok, Name: p.curToken.Literal}
+	} else {
+		constant = &ast.Constant{Token: tok, Value: tok.Literal}
+	}
+	for p.peekTokenIs(token.COLON_COLON) {
+		p.nextToken()
+		scope := p.curToken
+		if !p.expectPeek(token.CONSTANT) {
+			return nil
+		}
+		constant = &ast.ScopedConstant{Token: scope, Left: constant, Name: p.curToken.Literal}
+	}
+
+	var end token.Type
+	switch p.peekToken.Type {
+	case token.LPAREN:
+		end = token.RPAREN
+	case token.LBRACKET:
+		end = token.RBRACKET
+	default:
+		if p.peekTokenIs(token.DOT_DOT) || p.peekTokenIs(token.DOT_DOT_DOT) {
+			p.nextToken()
+			rangeExp := &ast.RangeLiteral{Token: p.curToken, Start: constant, Exclusive: p.curTokenIs(token.DOT_DOT_DOT)}
+			p.nextToken()
+			rangeExp.End = p.parseExpression(BITOR)
+			return &ast.ValuePattern{Token: tok, Value: rangeExp}
+		}
+		return &ast.ValuePattern{Token: tok, Value: constant}
+	}
+
+	p.nextToken()
+	open := p.curToken
+	if p.peekTokenIs(end) {
+		p.nextToken()
+		return &ast.ArrayPattern{Token: open, Constant: constant}
+	}
+	p.nextToken()
+	if p.curTokenIs(token.LABEL) || p.curTokenIs(token.STAR_STAR) {
+		return p.parseHashPatternBody(open, constant, end)
+	}
+	return p.parseArrayPatternBody(open, constant, end)
+}
+
+// parseArrayPatternBody parses comma-separated element patterns up to end,
+// starting on the first element.
+func (p *Parser) parseArrayPatternBody(tok token.Token, constant ast.Expression, end token.Type) ast.Pattern {
+	if p.curTokenIs(end) {
+		return &ast.ArrayPattern{Token: tok, Constant: constant}
+	}
+	return p.finishArrayPattern(tok, constant, end, p.parsePatternElement())
+}
+
+// parsePatternElement parses an element of an array pattern, which may be
+// a *rest.
+func (p *Parser) parsePatternElement() ast.Pattern {
+	if !p.curTokenIs(token.STAR) {
+		return p.parsePattern()
+	}
+	rest := &ast.RestPattern{Token: p.curToken}
+	if p.peekTokenIs(token.IDENT) {
+		p.nextToken()
+		rest.Name = p.curToken.Literal
+	}
+	return rest
+}
+
+// finishArrayPattern parses the elements following first up to end (EOF
+// when the brackets were left out). Splats at both ends make it a find
+// pattern.
+func (p *Parser) finishArrayPattern(tok token.Token, constant ast.Expression, end token.Type, first ast.Pattern) ast.Pattern {
+	elems := []ast.Pattern{first}
+	for p.peekTokenIs(token.COMMA) && !(end == token.EOF && p.sawNewline) {
+		p.nextToken()
+		// A trailing comma, as in in a, leaves an anonymous rest
+		if end == token.EOF && (p.sawNewline || p.peekPatternEnd()) || p.peekTokenIs(end) {
+			star := p.curToken
+			star.Type, star.Literal = token.STAR, "*"
+			elems = append(elems, &ast.RestPattern{Token: star})
+			break
+		}
+		p.nextToken()
+		elems = append(elems, p.parsePatternElement())
+	}
+	if end != token.EOF && !p.expectPeek(end) {
+		return nil
+	}
+
+	var rests []int
+	for i, elem := range elems {
+		if _, ok := elem.(*ast.RestPattern); ok {
+			rests = append(rests, i)
+		}
+	}
+	switch len(rests) {
+	case 0:
+		return &ast.ArrayPattern{Token: tok, Constant: constant, Pre: elems}
+	case 1:
+		i := rests[0]
+		return &ast.ArrayPattern{Token: tok, Constant: constant, Pre: elems[:i], Rest: elems[i].(*ast.RestPattern), Post: elems[i+1:]}
+	case 2:
+		if rests[0] == 0 && rests[1] == len(elems)-1 {
+			return &ast.FindPattern{
+				Token:    tok,
+				Constant: constant,
+				Pre:      elems[0].(*ast.RestPattern),
+				Middle:   elems[1 : len(elems)-1],
+				Post:     elems[len(elems)-1].(*ast.RestPattern),
+			}
+		}
+	}
+	p.addError(p.curToken.Pos(), "multiple rest patterns in array pattern")
+	return nil
+}
+
+// parseHashPatternBody parses key: pattern pairs up to end (EOF when the
+// braces were left out), starting on the first key.
+func (p *Parser) parseHashPatternBody(tok token.Token, constant ast.Expression, end token.Type) ast.Pattern {
+	hash := &ast.HashPattern{Token: tok, Constant: constant}
+	if p.curTokenIs(end) {
+		return hash
+	}
+	for {
+		switch p.curToken.Type {
+		case token.LABEL:
+			hash.Keys = append(hash.Keys, strings.TrimSuffix(p.curToken.Literal, ":"))
+			var value ast.Pattern
+			if !p.sawNewline && !p.peekPatternEnd() && !p.peekTokenIs(end) {
+				p.nextToken()
+				value = p.parsePattern()
+			}
+			hash.Values = append(hash.Values, value)
+		case token.STAR_STAR:
+			switch {
+			case p.peekTokenIs(token.KEYWORD_NIL):
+				p.nextToken()
+				hash.NilRest = true
+			case p.peekTokenIs(token.IDENT):
+				rest := &ast.RestPattern{Token: p.curToken}
+				p.nextToken()
+				rest.Name = p.curToken.Literal
+				hash.Rest = rest
+			default:
+				hash.Rest = &ast.RestPattern{Token: p.curToken}
+			}
+		default:
+			p.addError(p.curToken.Pos(), fmt.Sprintf("expected a key in hash pattern, got %s", p.curToken.Type.String()))
+			return nil
+		}
+		if !p.peekTokenIs(token.COMMA) || (end == token.EOF && p.sawNewline) {
+			break
+		}
+		p.nextToken()
+		p.nextToken()
+	}
+	if end != token.EOF && !p.expectPeek(end) {
+		return nil
+	}
+	return hash
+}
+
 func (p *Parser) parseWhileExpression() ast.Expression {
 	expression := &ast.WhileExpression{Token: p.curToken}
 
@@ -1520,6 +2391,14 @@ func (p *Parser) parseBeginExpression() ast.Expression {
 		p.nextToken()
 	}
 
+	p.parseBeginClauses(expression)
+
+	return expression
+}
+
+// parseBeginClauses parses the rescue, else and ensure clauses that close
+// a begin expression or a method body, starting on the first of them.
+func (p *Parser) parseBeginClauses(expression *ast.BeginExpression) {
 	// Parse rescue clauses
 	for p.curTokenIs(token.KEYWORD_RESCUE) {
 		rescue := p.parseRescueClause()
@@ -1557,21 +2436,21 @@ func (p *Parser) parseBeginExpression() ast.Expression {
 			p.nextToken()
 		}
 	}
-
-	return expression
 }
 
 func (p *Parser) parseRescueClause() *ast.RescueClause {
 	rescue := &ast.RescueClause{Token: p.curToken}
 
 	// Check if there's content on the same line (before consuming newline)
-	hasExceptionOnSameLine := !p.peekTokenIs(token.NEWLINE) && !p.peekTokenIs(token.KEYWORD_END)
+	hasExceptionOnSameLine := !p.sawNewline && !p.peekTokenIs(token.KEYWORD_END)
 
 	p.nextToken() // move past 'rescue'
 
-	// Parse exception types if present (only if on same line or is a constant)
+	// Parse exception class expressions if present, which are evaluated
+	// when an error is rescued
 	// rescue StandardError => e
-	// rescue SyntaxError, RuntimeError => e
+	// rescue SyntaxError, Net::ReadTimeout => e
+	// rescue *ERRORS
 	// rescue => e (no exception type)
 	// rescue (bare)
 	if hasExceptionOnSameLine &&
@@ -1581,23 +2460,15 @@ func (p *Parser) parseRescueClause() *ast.RescueClause {
 		!p.curTokenIs(token.KEYWORD_ELSE) &&
 		!p.curTokenIs(token.KEYWORD_ENSURE) &&
 		!p.curTokenIs(token.KEYWORD_END) &&
-		!p.curTokenIs(token.EOF) &&
-		p.curTokenIs(token.CONSTANT) {
+		!p.curTokenIs(token.EOF) {
 
-		// Parse first exception type
-		rescue.Exceptions = append(rescue.Exceptions, &ast.Constant{
-			Token: p.curToken,
-			Value: p.curToken.Literal,
-		})
+		rescue.Exceptions = append(rescue.Exceptions, p.parseExpression(LOWEST))
 
 		// Parse additional exception types separated by comma
 		for p.peekTokenIs(token.COMMA) {
 			p.nextToken() // move to comma
 			p.nextToken() // move to next exception type
-			rescue.Exceptions = append(rescue.Exceptions, &ast.Constant{
-				Token: p.curToken,
-				Value: p.curToken.Literal,
-			})
+			rescue.Exceptions = append(rescue.Exceptions, p.parseExpression(LOWEST))
 		}
 
 		p.nextToken() // move past last exception type
@@ -1675,27 +2546,6 @@ func (p *Parser) parseNotExpression() ast.Expression {
 	return expression
 }
 
-func (p *Parser) parseHeredoc() ast.Expression {
-	// Current token is HEREDOC_BEGIN
-	p.nextToken() // Move to STRING_CONTENT
-
-	var content string
-	if p.curTokenIs(token.STRING_CONTENT) {
-		content = p.curToken.Literal
-		p.nextToken() // Move to HEREDOC_END
-	}
-
-	// Skip HEREDOC_END token
-	if p.curTokenIs(token.HEREDOC_END) {
-		// We're done
-	}
-
-	return &ast.StringLiteral{
-		Token: p.curToken,
-		Value: content,
-	}
-}
-
 func (p *Parser) parseDefinedExpression() ast.Expression {
 	expression := &ast.DefinedExpression{Token: p.curToken}
 
@@ -1794,6 +2644,11 @@ func (p *Parser) parseTopLevelConstant() ast.Expression {
 func (p *Parser) parseSplatExpression() ast.Expression {
 	expression := &ast.SplatExpression{Token: p.curToken}
 
+	// A bare * among assignment targets discards the values it collects
+	if p.peekTokenIs(token.COMMA) || p.peekTokenIs(token.EQUAL) || p.peekTokenIs(token.RPAREN) {
+		return expression
+	}
+
 	p.nextToken()
 	expression.Expression = p.parseExpression(UNARY)
 
@@ -1809,6 +2664,16 @@ func (p *Parser) parseDoubleSplatExpression() ast.Expression {
 	return expression
 }
 
+// parseBlockArgExpression parses a block argument such as &:to_s or &blk.
+func (p *Parser) parseBlockArgExpression() ast.Expression {
+	expression := &ast.BlockArgExpression{Token: p.curToken}
+
+	p.nextToken()
+	expression.Expression = p.parseExpression(UNARY)
+
+	return expression
+}
+
 // Statements
 
 func (p *Parser) parseMethodDefinition() *ast.MethodDefinition {
@@ -1817,11 +2682,7 @@ func (p *Parser) parseMethodDefinition() *ast.MethodDefinition {
 	p.nextToken()
 
 	// Check for singleton method (def self.foo or def obj.foo)
-	if p.peekTokenIs(token.DOT) {
-		method.Receiver = p.parseExpression(LOWEST)
-		p.nextToken() // move past .
-		p.nextToken() // move to method name
-	}
+	method.Receiver = p.parseMethodReceiver()
 
 	method.Name = p.curToken.Literal
 
@@ -1829,16 +2690,77 @@ func (p *Parser) parseMethodDefinition() *ast.MethodDefinition {
 	if p.peekTokenIs(token.LPAREN) {
 		p.nextToken()
 		method.Parameters = p.parseMethodParameters()
-	} else if p.peekTokenIs(token.IDENT) {
+	} else if p.peekTokenIs(token.IDENT) && !p.sawNewline {
 		// Parameters without parentheses
 		method.Parameters = p.parseMethodParametersWithoutParens()
 	}
 
+	// Endless method: def square(x) = x * x
+	if p.peekTokenIs(token.EQUAL) {
+		p.nextToken()
+		if strings.HasSuffix(method.Name, "=") && !strings.ContainsAny(method.Name[:1], "=<>!") {
+			p.addError(method.Token.Pos(), "setter method cannot be defined in an endless method definition")
+		}
+		p.nextToken()
+		method.Body = &ast.BlockBody{Statements: []ast.Statement{
+			&ast.ExpressionStatement{Token: p.curToken, Expression: p.parseExpression(LOWEST)},
+		}}
+		return method
+	}
+
 	method.Body = p.parseMethodBody()
 
 	return method
 }
 
+// parseMethodReceiver parses the receiver of a singleton method definition
+// such as def self.foo, def Foo::Bar.foo, def obj.foo or def (expr).foo,
+// ending on the method name. For an ordinary method it returns nil and
+// stays on the name.
+func (p *Parser) parseMethodReceiver() ast.Expression {
+	start := p.curToken.Pos()
+	var receiver ast.Expression
+	switch {
+	case p.curTokenIs(token.LPAREN) || p.curTokenIs(token.LPAREN_BEG) || p.curTokenIs(token.LPAREN_ARG):
+		p.nextToken()
+		receiver = p.parseExpression(LOWEST)
+		if !p.expectPeek(token.RPAREN) {
+			return nil
+		}
+	case !p.peekTokenIs(token.DOT) && !(p.curTokenIs(token.CONSTANT) && p.peekTokenIs(token.COLON_COLON)):
+		return nil
+	case p.curTokenIs(token.KEYWORD_SELF):
+		receiver = &ast.SelfExpression{Token: p.curToken}
+	case p.curTokenIs(token.IDENT):
+		receiver = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	case p.curTokenIs(token.CONSTANT):
+		receiver = &ast.Constant{Token: p.curToken, Value: p.curToken.Literal}
+		for p.peekTokenIs(token.COLON_COLON) {
+			p.nextToken() // move to ::
+			scope := p.curToken
+			p.nextToken() // move to the constant or method name
+			// def Foo::bar names the method with ::
+			if !p.curTokenIs(token.CONSTANT) || !p.peekTokenIs(token.DOT) && !p.peekTokenIs(token.COLON_COLON) {
+				p.setSpan(receiver, start)
+				return receiver
+			}
+			receiver = &ast.ScopedConstant{Token: scope, Left: receiver, Name: p.curToken.Literal}
+		}
+	case p.curTokenIs(token.IVAR), p.curTokenIs(token.CVAR), p.curTokenIs(token.GVAR):
+		receiver = p.prefixParseFns[p.curToken.Type]()
+	default:
+		p.addError(p.curToken.Pos(), fmt.Sprintf("unexpected %s before . in method definition", p.curToken.Literal))
+		return nil
+	}
+	p.setSpan(receiver, start)
+
+	if !p.expectPeek(token.DOT) {
+		return nil
+	}
+	p.nextToken() // move to method name
+	return receiver
+}
+
 func (p *Parser) parseMethodParameters() []*ast.MethodParameter {
 	params := []*ast.MethodParameter{}
 
@@ -1953,6 +2875,7 @@ func (p *Parser) parseMethodBody() *ast.BlockBody {
 
 	for !p.curTokenIs(token.KEYWORD_END) &&
 		!p.curTokenIs(token.KEYWORD_RESCUE) &&
+		!p.curTokenIs(token.KEYWORD_ELSE) &&
 		!p.curTokenIs(token.KEYWORD_ENSURE) &&
 		!p.curTokenIs(token.EOF) {
 		stmt := p.parseStatement()
@@ -1962,13 +2885,14 @@ func (p *Parser) parseMethodBody() *ast.BlockBody {
 		p.nextToken()
 	}
 
-	// Handle rescue in method body
-	if p.curTokenIs(token.KEYWORD_RESCUE) {
-		// Wrap in begin expression
-		// For simplicity, just skip to end
-		for !p.curTokenIs(token.KEYWORD_END) && !p.curTokenIs(token.EOF) {
-			p.nextToken()
-		}
+	// A method body with rescue, else or ensure clauses is wrapped in a
+	// begin expression
+	if p.curTokenIs(token.KEYWORD_RESCUE) || p.curTokenIs(token.KEYWORD_ELSE) || p.curTokenIs(token.KEYWORD_ENSURE) {
+		begin := &ast.BeginExpression{Token: p.curToken, Body: body}
+		p.parseBeginClauses(begin)
+		return &ast.BlockBody{Statements: []ast.Statement{
+			&ast.ExpressionStatement{Token: begin.Token, Expression: begin},
+		}}
 	}
 
 	return body
@@ -2043,7 +2967,7 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 
 	if !p.peekIsStatementEnd() {
 		p.nextToken()
-		stmt.Value = p.parseExpression(LOWEST)
+		stmt.Value = p.parseExpression(MODIFIER)
 	}
 
 	return stmt
@@ -2054,7 +2978,7 @@ func (p *Parser) parseBreakStatement() *ast.BreakStatement {
 
 	if !p.peekIsStatementEnd() {
 		p.nextToken()
-		stmt.Value = p.parseExpression(LOWEST)
+		stmt.Value = p.parseExpression(MODIFIER)
 	}
 
 	return stmt
@@ -2065,7 +2989,7 @@ func (p *Parser) parseNextStatement() *ast.NextStatement {
 
 	if !p.peekIsStatementEnd() {
 		p.nextToken()
-		stmt.Value = p.parseExpression(LOWEST)
+		stmt.Value = p.parseExpression(MODIFIER)
 	}
 
 	return stmt
@@ -2124,7 +3048,17 @@ func (p *Parser) peekIsStatementEnd() bool {
 		p.peekTokenIs(token.KEYWORD_ENSURE) ||
 		p.peekTokenIs(token.RBRACE) ||
 		p.peekTokenIs(token.RPAREN) ||
-		p.peekTokenIs(token.RBRACKET)
+		p.peekTokenIs(token.RBRACKET) ||
+		p.peekIsModifier()
+}
+
+// peekIsModifier reports whether the next token is a statement modifier,
+// as in `break if done` or `return unless ok`.
+func (p *Parser) peekIsModifier() bool {
+	return p.peekTokenIs(token.KEYWORD_IF) ||
+		p.peekTokenIs(token.KEYWORD_UNLESS) ||
+		p.peekTokenIs(token.KEYWORD_WHILE) ||
+		p.peekTokenIs(token.KEYWORD_UNTIL)
 }
 
 // parseBlockContextStatement parses a statement in a block context where
@@ -2139,11 +3073,11 @@ func (p *Parser) parseBlockContextStatement() ast.Statement {
 	case token.KEYWORD_MODULE:
 		return p.parseModuleDefinition()
 	case token.KEYWORD_RETURN:
-		return p.parseReturnStatement()
+		return p.parseStatementModifier(p.parseReturnStatement())
 	case token.KEYWORD_BREAK:
-		return p.parseBreakStatement()
+		return p.parseStatementModifier(p.parseBreakStatement())
 	case token.KEYWORD_NEXT:
-		return p.parseNextStatement()
+		return p.parseStatementModifier(p.parseNextStatement())
 	case token.KEYWORD_REDO:
 		return p.parseRedoStatement()
 	case token.KEYWORD_RETRY:
@@ -2161,6 +3095,9 @@ func (p *Parser) parseBlockContextExpressionStatement() *ast.ExpressionStatement
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
 	// Parse expression but stop before rescue/else/ensure/end modifiers
 	stmt.Expression = p.parseBlockContextExpression(LOWEST)
+	if p.peekTokenIs(token.COMMA) && !p.sawNewline {
+		stmt.Expression = p.parseMultipleAssignment(stmt.Expression)
+	}
 	return stmt
 }
 
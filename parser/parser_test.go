@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/alexisbouchez/rubylexer/ast"
@@ -81,7 +82,12 @@ func TestStringLiteral(t *testing.T) {
 	}{
 		{`"hello"`, "hello"},
 		{`'world'`, "world"},
-		{`"hello\nworld"`, "hello\\nworld"},
+		{`"hello\nworld"`, "hello\nworld"},
+		{`'hello\nworld'`, "hello\\nworld"},
+		{`'it\'s \\ here'`, "it's \\ here"},
+		{`%q(a\)b\n)`, "a)b\\n"},
+		{`%Q(a\)b\n)`, "a)b\n"},
+		{`"\x41\101\u00e9\u{1F600 41}\e\s\#{x}"`, "AAé\U0001F600A\x1b #{x}"},
 	}
 
 	for _, tt := range tests {
@@ -1162,6 +1168,1669 @@ func TestInterpolatedString(t *testing.T) {
 	}
 }
 
+func TestHeredocInterpolation(t *testing.T) {
+	input := "text = <<~EOS\n  Hello, #{name}!\n    indented\nEOS\n"
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	assign, ok := stmt.Expression.(*ast.AssignmentExpression)
+	if !ok {
+		t.Fatalf("expected AssignmentExpression, got %T", stmt.Expression)
+	}
+
+	str, ok := assign.Value.(*ast.InterpolatedString)
+	if !ok {
+		t.Fatalf("expected InterpolatedString, got %T", assign.Value)
+	}
+
+	if len(str.Parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(str.Parts))
+	}
+
+	first := str.Parts[0].(*ast.StringLiteral)
+	if first.Value != "Hello, " {
+		t.Errorf("expected %q, got %q", "Hello, ", first.Value)
+	}
+
+	last := str.Parts[2].(*ast.StringLiteral)
+	if last.Value != "!\n  indented\n" {
+		t.Errorf("expected %q, got %q", "!\n  indented\n", last.Value)
+	}
+}
+
+func TestHeredocQuotedNoInterpolation(t *testing.T) {
+	input := "text = <<~'EOS'\n  keep #{name}\nEOS\n"
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	assign := stmt.Expression.(*ast.AssignmentExpression)
+	str, ok := assign.Value.(*ast.StringLiteral)
+	if !ok {
+		t.Fatalf("expected StringLiteral, got %T", assign.Value)
+	}
+
+	if str.Value != "keep #{name}\n" {
+		t.Errorf("expected %q, got %q", "keep #{name}\n", str.Value)
+	}
+}
+
+func TestHeredocCommandArgument(t *testing.T) {
+	tests := []struct {
+		input  string
+		method string
+		first  string
+		args   int
+	}{
+		{"puts <<~EOS\n  hello\nEOS\n", "puts", "hello\n", 1},
+		{"foo <<-X, 1\n  b\n  X\n", "foo", "  b\n", 2},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		call, ok := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.MethodCall)
+		if !ok || call.Method != tt.method || len(call.Arguments) != tt.args {
+			t.Fatalf("%q: expected %s with %d arguments, got %s", tt.input, tt.method, tt.args, ast.Dump(program))
+		}
+		str, ok := call.Arguments[0].(*ast.StringLiteral)
+		if !ok || str.Value != tt.first {
+			t.Errorf("%q: expected the heredoc %q as the first argument, got %s", tt.input, tt.first, ast.Dump(call.Arguments[0]))
+		}
+	}
+}
+
+func TestModifierStatement(t *testing.T) {
+	tests := []struct {
+		input    string
+		modifier string
+	}{
+		{"break if done", "if"},
+		{"next unless x > 1", "unless"},
+		{"return 5 if ok", "if"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("expected 1 statement for %q, got %d", tt.input, len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.ModifierStatement)
+		if !ok {
+			t.Fatalf("expected ModifierStatement for %q, got %T", tt.input, program.Statements[0])
+		}
+
+		if stmt.Modifier != tt.modifier {
+			t.Errorf("expected modifier %q, got %q", tt.modifier, stmt.Modifier)
+		}
+	}
+}
+
+func TestModifierKeywordOnNewLine(t *testing.T) {
+	input := `x = 1
+if x > 0
+  x
+end`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[1].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("expected ExpressionStatement, got %T", program.Statements[1])
+	}
+
+	if _, ok := stmt.Expression.(*ast.IfExpression); !ok {
+		t.Errorf("expected IfExpression, got %T", stmt.Expression)
+	}
+}
+
+func TestHashLiteralLabelWithArrayValue(t *testing.T) {
+	input := `{a: [1, 2], b: 3}`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	hash, ok := stmt.Expression.(*ast.HashLiteral)
+	if !ok {
+		t.Fatalf("expected HashLiteral, got %T", stmt.Expression)
+	}
+
+	if len(hash.Pairs) != 2 {
+		t.Fatalf("expected 2 pairs, got %d", len(hash.Pairs))
+	}
+
+	if _, ok := hash.Pairs[hash.Order[0]].(*ast.ArrayLiteral); !ok {
+		t.Errorf("expected ArrayLiteral value, got %T", hash.Pairs[hash.Order[0]])
+	}
+}
+
+func TestConstantMethodCall(t *testing.T) {
+	input := `Array(x)`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	call, ok := stmt.Expression.(*ast.MethodCall)
+	if !ok {
+		t.Fatalf("expected MethodCall, got %T", stmt.Expression)
+	}
+
+	if call.Method != "Array" {
+		t.Errorf("expected method Array, got %s", call.Method)
+	}
+
+	if len(call.Arguments) != 1 {
+		t.Errorf("expected 1 argument, got %d", len(call.Arguments))
+	}
+}
+
+func TestBinaryAmpersandAfterIdentifier(t *testing.T) {
+	input := `a & b`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	infix, ok := stmt.Expression.(*ast.InfixExpression)
+	if !ok {
+		t.Fatalf("expected InfixExpression, got %T", stmt.Expression)
+	}
+
+	if infix.Operator != "&" {
+		t.Errorf("expected operator &, got %s", infix.Operator)
+	}
+}
+
+func TestIndexExpressionArguments(t *testing.T) {
+	tests := []struct {
+		input string
+		args  int
+	}{
+		{"arr[1, 2]", 2},
+		{"pr[1, 2, 3]", 3},
+		{"Hash[:a, 1, :b, 2]", 4},
+		{"m[]", 0},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		index, ok := stmt.Expression.(*ast.IndexExpression)
+		if !ok {
+			t.Fatalf("expected IndexExpression, got %T", stmt.Expression)
+		}
+
+		if len(index.Arguments) != tt.args {
+			t.Errorf("%s: expected %d arguments, got %d", tt.input, tt.args, len(index.Arguments))
+		}
+		if index.String() != tt.input {
+			t.Errorf("expected %s, got %s", tt.input, index.String())
+		}
+	}
+}
+
+func TestEndlessRangeIndex(t *testing.T) {
+	input := `arr[-2..]`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	index, ok := stmt.Expression.(*ast.IndexExpression)
+	if !ok {
+		t.Fatalf("expected IndexExpression, got %T", stmt.Expression)
+	}
+
+	rng, ok := index.Arguments[0].(*ast.RangeLiteral)
+	if !ok {
+		t.Fatalf("expected RangeLiteral, got %T", index.Arguments[0])
+	}
+
+	if rng.End != nil {
+		t.Errorf("expected endless range, got end %s", rng.End.String())
+	}
+}
+
+func TestBracelessHashRocketArguments(t *testing.T) {
+	input := `h.transform_keys(x, :a => :b, "c" => :d)`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	call, ok := stmt.Expression.(*ast.MethodCall)
+	if !ok {
+		t.Fatalf("expected MethodCall, got %T", stmt.Expression)
+	}
+
+	if len(call.Arguments) != 2 {
+		t.Fatalf("expected 2 arguments, got %d", len(call.Arguments))
+	}
+
+	hash, ok := call.Arguments[1].(*ast.HashLiteral)
+	if !ok {
+		t.Fatalf("expected HashLiteral, got %T", call.Arguments[1])
+	}
+
+	if len(hash.Order) != 2 {
+		t.Errorf("expected 2 pairs, got %d", len(hash.Order))
+	}
+}
+
+func TestBlockArgument(t *testing.T) {
+	input := `[1, 2].map(&:to_s)`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	call, ok := stmt.Expression.(*ast.MethodCall)
+	if !ok {
+		t.Fatalf("expected MethodCall, got %T", stmt.Expression)
+	}
+
+	if len(call.Arguments) != 1 {
+		t.Fatalf("expected 1 argument, got %d", len(call.Arguments))
+	}
+
+	arg, ok := call.Arguments[0].(*ast.BlockArgExpression)
+	if !ok {
+		t.Fatalf("expected BlockArgExpression, got %T", call.Arguments[0])
+	}
+
+	if arg.String() != "&:to_s" {
+		t.Errorf("expected &:to_s, got %s", arg.String())
+	}
+}
+
+func TestMethodBodyStartingWithIdentifier(t *testing.T) {
+	input := `
+def greet
+  hello
+end
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	def, ok := program.Statements[0].(*ast.MethodDefinition)
+	if !ok {
+		t.Fatalf("expected MethodDefinition, got %T", program.Statements[0])
+	}
+
+	if len(def.Parameters) != 0 {
+		t.Errorf("expected no parameters, got %d", len(def.Parameters))
+	}
+}
+
+func TestBlockParameterDefault(t *testing.T) {
+	input := `proc { |a, b = 5| a + b }`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("expected 1 statement, got %d", len(program.Statements))
+	}
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	call, ok := stmt.Expression.(*ast.MethodCall)
+	if !ok {
+		t.Fatalf("expected MethodCall, got %T", stmt.Expression)
+	}
+
+	if call.Block == nil || len(call.Block.Parameters) != 2 {
+		t.Fatalf("expected block with 2 parameters, got %v", call.Block)
+	}
+
+	def := call.Block.Parameters[1].Default
+	if def == nil || def.String() != "5" {
+		t.Errorf("expected default 5, got %v", def)
+	}
+}
+
+func TestPredicateMethodWithoutReceiver(t *testing.T) {
+	input := `x = block_given?`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("expected 1 statement, got %d", len(program.Statements))
+	}
+
+	if program.Statements[0].String() != "x = block_given?" {
+		t.Errorf("unexpected program: %s", program.Statements[0].String())
+	}
+}
+
+func TestCallShorthand(t *testing.T) {
+	input := `add.(1, 2)`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	call, ok := stmt.Expression.(*ast.MethodCall)
+	if !ok {
+		t.Fatalf("expected MethodCall, got %T", stmt.Expression)
+	}
+
+	if call.Method != "call" {
+		t.Errorf("expected method call, got %s", call.Method)
+	}
+
+	if len(call.Arguments) != 2 {
+		t.Errorf("expected 2 arguments, got %d", len(call.Arguments))
+	}
+}
+
+func TestXStringLiteral(t *testing.T) {
+	tests := []struct {
+		input string
+		parts int
+	}{
+		{"`ls -l`", 1},
+		{"`echo #{name}`", 2},
+		{"%x(echo hi)", 1},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		xstr, ok := stmt.Expression.(*ast.XStringLiteral)
+		if !ok {
+			t.Fatalf("%q: expected XStringLiteral, got %T", tt.input, stmt.Expression)
+		}
+
+		if len(xstr.Parts) != tt.parts {
+			t.Errorf("%q: expected %d parts, got %d", tt.input, tt.parts, len(xstr.Parts))
+		}
+	}
+}
+
+func TestXStringCommandArgument(t *testing.T) {
+	for _, input := range []string{"puts `echo hi`", "puts %x(echo hi)"} {
+		l := lexer.New(input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", input, len(program.Statements))
+		}
+		call, ok := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.MethodCall)
+		if !ok || call.Method != "puts" || len(call.Arguments) != 1 {
+			t.Fatalf("%q: expected puts with one argument, got %s", input, ast.Dump(program))
+		}
+		if _, ok := call.Arguments[0].(*ast.XStringLiteral); !ok {
+			t.Errorf("%q: expected an XStringLiteral argument, got %T", input, call.Arguments[0])
+		}
+	}
+}
+
+func TestMethodCallWithoutParens(t *testing.T) {
+	tests := []struct {
+		input  string
+		method string
+		args   int
+	}{
+		{`$stderr.puts "oops"`, "puts", 1},
+		{`io.write name, "\n"`, "write", 2},
+		{`list.push 1`, "push", 1},
+		{`list.size - 1`, "-", 0},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		if tt.method == "-" {
+			if _, ok := stmt.Expression.(*ast.InfixExpression); !ok {
+				t.Errorf("%q: expected InfixExpression, got %T", tt.input, stmt.Expression)
+			}
+			continue
+		}
+		call, ok := stmt.Expression.(*ast.MethodCall)
+		if !ok {
+			t.Fatalf("%q: expected MethodCall, got %T", tt.input, stmt.Expression)
+		}
+		if call.Method != tt.method {
+			t.Errorf("%q: expected method %q, got %q", tt.input, tt.method, call.Method)
+		}
+		if len(call.Arguments) != tt.args {
+			t.Errorf("%q: expected %d arguments, got %d", tt.input, tt.args, len(call.Arguments))
+		}
+	}
+}
+
+func TestMultipleAssignment(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a, b = 1, 2", "a, b = 1, 2"},
+		{"a, *rest = list", "a, *rest = list"},
+		{"*init, last = list", "*init, last = list"},
+		{"(a, b), c = pair, 3", "(a, b), c = pair, 3"},
+		{"a, b = *list, 3", "a, b = *list, 3"},
+		{"a, * = list", "a, * = list"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		ma, ok := stmt.Expression.(*ast.MultipleAssignment)
+		if !ok {
+			t.Fatalf("%q: expected MultipleAssignment, got %T", tt.input, stmt.Expression)
+		}
+		if ma.String() != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.expected, ma.String())
+		}
+	}
+}
+
+func TestAssignmentOfValueList(t *testing.T) {
+	l := lexer.New("x = 1, 2")
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	assign, ok := stmt.Expression.(*ast.AssignmentExpression)
+	if !ok {
+		t.Fatalf("expected AssignmentExpression, got %T", stmt.Expression)
+	}
+	array, ok := assign.Value.(*ast.ArrayLiteral)
+	if !ok {
+		t.Fatalf("expected ArrayLiteral value, got %T", assign.Value)
+	}
+	if len(array.Elements) != 2 {
+		t.Errorf("expected 2 elements, got %d", len(array.Elements))
+	}
+}
+
+func TestSplatAfterNewline(t *testing.T) {
+	l := lexer.New("p(x)\n*init, last = list")
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(program.Statements))
+	}
+	stmt := program.Statements[1].(*ast.ExpressionStatement)
+	if _, ok := stmt.Expression.(*ast.MultipleAssignment); !ok {
+		t.Errorf("expected MultipleAssignment, got %T", stmt.Expression)
+	}
+}
+
+func TestCaseInPatterns(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[a, b, *rest]", "[a, b, *rest]"},
+		{"a, *", "[a, *]"},
+		{"a,", "[a, *]"},
+		{"[*, 42 => x, *post]", "[*, 42 => x, *post]"},
+		{"{name:, age: Integer => age}", "{name:, age: Integer => age}"},
+		{"name:, **rest", "{name:, **rest}"},
+		{"{x: 1, **nil}", "{x: 1, **nil}"},
+		{"Integer | Float | nil", "Integer | Float | nil"},
+		{"^expected", "^expected"},
+		{"^(a + 1)", "^(a + 1)"},
+		{"Point[x, y]", "Point[x, y]"},
+		{"Point(x:, y: 0)", "Point{x:, y: 0}"},
+		{"Geo::Point()", "Geo::Point[]"},
+		{"1..5 | 10..", "1..5 | 10.."},
+		{"[[a, b], c]", "[[a, b], c]"},
+	}
+
+	for _, tt := range tests {
+		input := "case value\nin " + tt.input + "\n  1\nend"
+		l := lexer.New(input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		ci, ok := stmt.Expression.(*ast.CaseInExpression)
+		if !ok {
+			t.Fatalf("%q: expected CaseInExpression, got %T", tt.input, stmt.Expression)
+		}
+		if len(ci.Clauses) != 1 {
+			t.Fatalf("%q: expected 1 in clause, got %d", tt.input, len(ci.Clauses))
+		}
+		if got := ci.Clauses[0].Pattern.String(); got != tt.expected {
+			t.Errorf("%q: expected pattern %q, got %q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestCaseInGuardAndElse(t *testing.T) {
+	input := `case person
+in {name:, age:} if age > 18
+  name
+in [x, *] unless x
+  x
+else
+  nil
+end`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	ci, ok := stmt.Expression.(*ast.CaseInExpression)
+	if !ok {
+		t.Fatalf("expected CaseInExpression, got %T", stmt.Expression)
+	}
+	if len(ci.Clauses) != 2 {
+		t.Fatalf("expected 2 in clauses, got %d", len(ci.Clauses))
+	}
+	first := ci.Clauses[0]
+	if _, ok := first.Pattern.(*ast.HashPattern); !ok {
+		t.Errorf("expected HashPattern, got %T", first.Pattern)
+	}
+	if first.Guard == nil || first.Guard.String() != "(age > 18)" || first.Unless {
+		t.Errorf("expected if guard (age > 18), got %v", first.Guard)
+	}
+	second := ci.Clauses[1]
+	if _, ok := second.Pattern.(*ast.ArrayPattern); !ok {
+		t.Errorf("expected ArrayPattern, got %T", second.Pattern)
+	}
+	if second.Guard == nil || !second.Unless {
+		t.Errorf("expected unless guard, got %v", second.Guard)
+	}
+	if ci.Else == nil {
+		t.Errorf("expected else body")
+	}
+}
+
+func TestCaseWhenIsNotPatternMatching(t *testing.T) {
+	l := lexer.New("case x\nwhen 1 then :one\nend")
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	if _, ok := stmt.Expression.(*ast.CaseExpression); !ok {
+		t.Fatalf("expected CaseExpression, got %T", stmt.Expression)
+	}
+}
+
+func TestEndlessMethodDefinition(t *testing.T) {
+	tests := []struct {
+		input      string
+		name       string
+		receiver   bool
+		paramCount int
+		body       string
+	}{
+		{"def square(x) = x * x", "square", false, 1, "(x * x)"},
+		{"def answer = 42", "answer", false, 0, "42"},
+		{"def self.name = @name", "name", true, 0, "@name"},
+		{"def add(a, b = 1) = a + b", "add", false, 2, "(a + b)"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		method, ok := program.Statements[0].(*ast.MethodDefinition)
+		if !ok {
+			t.Fatalf("%q: expected MethodDefinition, got %T", tt.input, program.Statements[0])
+		}
+		if method.Name != tt.name {
+			t.Errorf("%q: expected name %q, got %q", tt.input, tt.name, method.Name)
+		}
+		if (method.Receiver != nil) != tt.receiver {
+			t.Errorf("%q: expected receiver %v, got %v", tt.input, tt.receiver, method.Receiver)
+		}
+		if len(method.Parameters) != tt.paramCount {
+			t.Errorf("%q: expected %d parameters, got %d", tt.input, tt.paramCount, len(method.Parameters))
+		}
+		if len(method.Body.Statements) != 1 {
+			t.Fatalf("%q: expected a single body statement, got %d", tt.input, len(method.Body.Statements))
+		}
+		if got := method.Body.Statements[0].String(); got != tt.body {
+			t.Errorf("%q: expected body %q, got %q", tt.input, tt.body, got)
+		}
+	}
+}
+
+func TestHashValueOmission(t *testing.T) {
+	input := `{x:, y:, Limit:}`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	hash, ok := stmt.Expression.(*ast.HashLiteral)
+	if !ok {
+		t.Fatalf("expected HashLiteral, got %T", stmt.Expression)
+	}
+	if len(hash.Order) != 3 {
+		t.Fatalf("expected 3 pairs, got %d", len(hash.Order))
+	}
+	if _, ok := hash.Pairs[hash.Order[0]].(*ast.Identifier); !ok {
+		t.Errorf("expected Identifier value for x:, got %T", hash.Pairs[hash.Order[0]])
+	}
+	if _, ok := hash.Pairs[hash.Order[2]].(*ast.Constant); !ok {
+		t.Errorf("expected Constant value for Limit:, got %T", hash.Pairs[hash.Order[2]])
+	}
+}
+
+func TestKeywordArgumentValueOmission(t *testing.T) {
+	input := `point(x:, y: 2, z:)`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	call, ok := stmt.Expression.(*ast.MethodCall)
+	if !ok {
+		t.Fatalf("expected MethodCall, got %T", stmt.Expression)
+	}
+	if len(call.Arguments) != 1 {
+		t.Fatalf("expected 1 argument, got %d", len(call.Arguments))
+	}
+	hash, ok := call.Arguments[0].(*ast.HashLiteral)
+	if !ok || !hash.IsKeywordArgs {
+		t.Fatalf("expected keyword argument hash, got %T", call.Arguments[0])
+	}
+	expected := []string{"x", "2", "z"}
+	for i, key := range hash.Order {
+		if got := hash.Pairs[key].String(); got != expected[i] {
+			t.Errorf("pair %d: expected value %q, got %q", i, expected[i], got)
+		}
+	}
+}
+
+func TestOperatorMethodDefinitions(t *testing.T) {
+	tests := []struct {
+		input      string
+		name       string
+		paramCount int
+	}{
+		{"def +(other)\nend", "+", 1},
+		{"def ==(other)\nend", "==", 1},
+		{"def <=>(other)\nend", "<=>", 1},
+		{"def [](index)\nend", "[]", 1},
+		{"def []=(index, value)\nend", "[]=", 2},
+		{"def <<(item)\nend", "<<", 1},
+		{"def -@\nend", "-@", 0},
+		{"def +@\nend", "+@", 0},
+		{"def !\nend", "!", 0},
+		{"def /(other)\nend", "/", 1},
+		{"def %(other)\nend", "%", 1},
+		{"def self.+(other)\nend", "+", 1},
+		{"def *(n) = n", "*", 1},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		method, ok := program.Statements[0].(*ast.MethodDefinition)
+		if !ok {
+			t.Fatalf("%q: expected MethodDefinition, got %T", tt.input, program.Statements[0])
+		}
+		if method.Name != tt.name {
+			t.Errorf("%q: expected name %q, got %q", tt.input, tt.name, method.Name)
+		}
+		if len(method.Parameters) != tt.paramCount {
+			t.Errorf("%q: expected %d parameters, got %d", tt.input, tt.paramCount, len(method.Parameters))
+		}
+	}
+}
+
+func TestMethodBodyRescueClauses(t *testing.T) {
+	input := `def fetch
+  load
+rescue IOError => e
+  retry_later(e)
+else
+  done
+ensure
+  close
+end`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("expected 1 statement, got %d", len(program.Statements))
+	}
+	method, ok := program.Statements[0].(*ast.MethodDefinition)
+	if !ok {
+		t.Fatalf("expected MethodDefinition, got %T", program.Statements[0])
+	}
+	if len(method.Body.Statements) != 1 {
+		t.Fatalf("expected body wrapped in one statement, got %d", len(method.Body.Statements))
+	}
+	stmt := method.Body.Statements[0].(*ast.ExpressionStatement)
+	begin, ok := stmt.Expression.(*ast.BeginExpression)
+	if !ok {
+		t.Fatalf("expected BeginExpression, got %T", stmt.Expression)
+	}
+	if len(begin.Body.Statements) != 1 {
+		t.Errorf("expected 1 body statement, got %d", len(begin.Body.Statements))
+	}
+	if len(begin.Rescues) != 1 {
+		t.Fatalf("expected 1 rescue clause, got %d", len(begin.Rescues))
+	}
+	if begin.Rescues[0].Variable == nil || begin.Rescues[0].Variable.Value != "e" {
+		t.Errorf("expected rescue variable e")
+	}
+	if begin.Else == nil || len(begin.Else.Statements) != 1 {
+		t.Errorf("expected else clause with 1 statement")
+	}
+	if begin.Ensure == nil || len(begin.Ensure.Statements) != 1 {
+		t.Errorf("expected ensure clause with 1 statement")
+	}
+}
+
+func TestMethodBodyEnsureOnly(t *testing.T) {
+	input := "def run\n  work\nensure\n  cleanup\nend\nafter"
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(program.Statements))
+	}
+	method := program.Statements[0].(*ast.MethodDefinition)
+	begin, ok := method.Body.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.BeginExpression)
+	if !ok {
+		t.Fatalf("expected BeginExpression body")
+	}
+	if len(begin.Rescues) != 0 || begin.Ensure == nil {
+		t.Errorf("expected only an ensure clause")
+	}
+}
+
+func TestBlockLocalVariables(t *testing.T) {
+	tests := []struct {
+		input    string
+		params   []string
+		locals   []string
+		expected string
+	}{
+		{"each { |x; tmp| tmp = x }", []string{"x"}, []string{"tmp"}, "{ |x; tmp| tmp = x }"},
+		{"each { |a, b; c, d| a }", []string{"a", "b"}, []string{"c", "d"}, "{ |a, b; c, d| a }"},
+		{"each { |;tmp| tmp }", nil, []string{"tmp"}, "{ |; tmp| tmp }"},
+		{"each { |x| x }", []string{"x"}, nil, "{ |x| x }"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		call, ok := stmt.Expression.(*ast.MethodCall)
+		if !ok || call.Block == nil {
+			t.Fatalf("%q: expected a method call with a block, got %T", tt.input, stmt.Expression)
+		}
+		if len(call.Block.Parameters) != len(tt.params) {
+			t.Fatalf("%q: expected %d parameters, got %d", tt.input, len(tt.params), len(call.Block.Parameters))
+		}
+		for i, name := range tt.params {
+			if call.Block.Parameters[i].Name != name {
+				t.Errorf("%q: expected parameter %q, got %q", tt.input, name, call.Block.Parameters[i].Name)
+			}
+		}
+		if len(call.Block.Body.Locals) != len(tt.locals) {
+			t.Fatalf("%q: expected locals %v, got %v", tt.input, tt.locals, call.Block.Body.Locals)
+		}
+		for i, name := range tt.locals {
+			if call.Block.Body.Locals[i] != name {
+				t.Errorf("%q: expected local %q, got %q", tt.input, name, call.Block.Body.Locals[i])
+			}
+		}
+		if got := call.Block.String(); got != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestBlockArgumentAfterOtherArguments(t *testing.T) {
+	tests := []struct {
+		input    string
+		argCount int
+		blockArg string
+	}{
+		{"run(&blk)", 1, "&blk"},
+		{"run(1, &:to_s)", 2, "&:to_s"},
+		{"run(a: 1, &blk)", 2, "&blk"},
+		{"run(:k => 1, &blk)", 2, "&blk"},
+		{"run(1, b: 2, &handler)", 3, "&handler"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		call, ok := stmt.Expression.(*ast.MethodCall)
+		if !ok {
+			t.Fatalf("%q: expected MethodCall, got %T", tt.input, stmt.Expression)
+		}
+		if len(call.Arguments) != tt.argCount {
+			t.Fatalf("%q: expected %d arguments, got %d", tt.input, tt.argCount, len(call.Arguments))
+		}
+		last, ok := call.Arguments[len(call.Arguments)-1].(*ast.BlockArgExpression)
+		if !ok {
+			t.Fatalf("%q: expected trailing BlockArgExpression, got %T", tt.input, call.Arguments[len(call.Arguments)-1])
+		}
+		if last.String() != tt.blockArg {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.blockArg, last.String())
+		}
+	}
+}
+
+func TestSemicolonSeparatedStatements(t *testing.T) {
+	input := `a = 1; b = 2; puts a + b
+def foo; 42; end
+[1].each { |x; tmp| tmp = x };`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 5 {
+		t.Fatalf("program.Statements does not contain 5 statements. got=%d", len(program.Statements))
+	}
+
+	def, ok := program.Statements[3].(*ast.MethodDefinition)
+	if !ok {
+		t.Fatalf("statement 3 is not *ast.MethodDefinition. got=%T", program.Statements[3])
+	}
+	if len(def.Body.Statements) != 1 {
+		t.Errorf("method body has %d statements, want 1", len(def.Body.Statements))
+	}
+
+	call, ok := program.Statements[4].(*ast.ExpressionStatement).Expression.(*ast.MethodCall)
+	if !ok {
+		t.Fatalf("statement 4 is not *ast.MethodCall. got=%T", program.Statements[4].(*ast.ExpressionStatement).Expression)
+	}
+	if call.Block == nil || len(call.Block.Parameters) != 1 || len(call.Block.Body.Locals) != 1 {
+		t.Fatalf("block parameters not parsed: %s", call.String())
+	}
+}
+
+func TestNodePositions(t *testing.T) {
+	input := `x = 1 + 2
+  foo(bar) do |y|
+    y
+  end`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	assign := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.AssignmentExpression)
+	call := program.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.MethodCall)
+
+	tests := []struct {
+		node  ast.Node
+		start string
+		end   string
+	}{
+		{program.Statements[0], "1:1", "1:10"},
+		{assign, "1:1", "1:10"},
+		{assign.Value, "1:5", "1:10"},
+		{program.Statements[1], "2:3", "4:6"},
+		{call.Arguments[0], "2:7", "2:10"},
+		{call.Block, "2:12", "4:6"},
+		{program, "1:1", "4:6"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.node.Pos().String(); got != tt.start {
+			t.Errorf("%q starts at %s, want %s", tt.node.String(), got, tt.start)
+		}
+		if got := tt.node.EndPos().String(); got != tt.end {
+			t.Errorf("%q ends at %s, want %s", tt.node.String(), got, tt.end)
+		}
+	}
+}
+
+func TestSyntaxErrorPositions(t *testing.T) {
+	input := "x = 1\nputs(x +)"
+
+	l := lexer.New(input)
+	p := New(l)
+	p.ParseProgram()
+
+	errs := p.SyntaxErrors()
+	if len(errs) == 0 {
+		t.Fatalf("expected a syntax error")
+	}
+	if errs[0].Pos.String() != "2:9" {
+		t.Errorf("error at %s, want 2:9", errs[0].Pos)
+	}
+
+	expected := "test.rb:2:9: " + errs[0].Msg + "\nputs(x +)\n        ^"
+	if got := FormatError("test.rb", input, errs[0].Pos, errs[0].Msg); got != expected {
+		t.Errorf("FormatError() = %q, want %q", got, expected)
+	}
+}
+
+func TestUnterminatedLiteralErrors(t *testing.T) {
+	input := "x = [1,\n  \"abc, 2]\nputs x"
+
+	l := lexer.New(input)
+	p := New(l)
+	p.ParseProgram()
+
+	errs := p.SyntaxErrors()
+	if len(errs) == 0 {
+		t.Fatalf("expected a syntax error")
+	}
+	if errs[0].Msg != "unterminated string meets end of file" {
+		t.Errorf("expected the unterminated string first, got %q", errs[0].Msg)
+	}
+	if errs[0].Pos.String() != "2:3" {
+		t.Errorf("error at %s, want 2:3", errs[0].Pos)
+	}
+}
+
+func TestDump(t *testing.T) {
+	input := `x = [1, "a"]
+puts x if x`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	expected := `(Program
+  :Statements [
+    (ExpressionStatement
+      :Expression (AssignmentExpression
+        :Left (Identifier :Value "x")
+        :Value (ArrayLiteral
+          :Elements [
+            (IntegerLiteral :Value 1)
+            (StringLiteral :Value "a")])))
+    (ExpressionStatement
+      :Expression (ModifierExpression :Modifier "if"
+        :Body (MethodCall :Method "puts"
+          :Arguments [
+            (Identifier :Value "x")])
+        :Condition (Identifier :Value "x")))])`
+	if got := ast.Dump(program); got != expected {
+		t.Errorf("ast.Dump() =\n%s\nwant\n%s", got, expected)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	l := lexer.New(`{a: 1}`)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	data, err := ast.MarshalJSON(program.Statements[0].(*ast.ExpressionStatement).Expression)
+	if err != nil {
+		t.Fatalf("ast.MarshalJSON() error: %v", err)
+	}
+	expected := `{"type":"HashLiteral","pos":"1:1","end":"1:7","Pairs":[{"type":"Pair","Key":{"type":"SymbolLiteral","pos":"1:2","Value":"a"},"Value":{"type":"IntegerLiteral","pos":"1:5","end":"1:6","Value":1}}]}`
+	if string(data) != expected {
+		t.Errorf("ast.MarshalJSON() =\n%s\nwant\n%s", data, expected)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	input := `def add(a, b = c)
+  a + b
+end
+[x].each { |y| puts y if y }
+case z
+when 1 then w
+end`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	var names []string
+	depth, maxDepth := 0, 0
+	ast.Inspect(program, func(node ast.Node) bool {
+		if node == nil {
+			depth--
+			return false
+		}
+		depth++
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		if ident, ok := node.(*ast.Identifier); ok {
+			names = append(names, ident.Value)
+		}
+		return true
+	})
+
+	expected := []string{"c", "a", "b", "x", "y", "y", "z", "w"}
+	if len(names) != len(expected) {
+		t.Fatalf("visited identifiers %v, want %v", names, expected)
+	}
+	for i, name := range expected {
+		if names[i] != name {
+			t.Errorf("visited identifiers %v, want %v", names, expected)
+			break
+		}
+	}
+	if depth != 0 {
+		t.Errorf("Inspect left depth %d, want every node closed with nil", depth)
+	}
+
+	// Returning false skips a node's children
+	var visited int
+	ast.Inspect(program, func(node ast.Node) bool {
+		if node != nil {
+			visited++
+		}
+		_, isDef := node.(*ast.MethodDefinition)
+		return !isDef
+	})
+	var all int
+	ast.Inspect(program, func(node ast.Node) bool {
+		if node != nil {
+			all++
+		}
+		return true
+	})
+	if visited != all-5 {
+		t.Errorf("visited %d nodes skipping the method body, want %d", visited, all-5)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	input := `class Greeter < Base
+  def greet(name, punct = "!", *rest, loud: false, &blk)
+    msg = "Hi, #{name}" + punct; msg = msg.upcase if loud
+    [1, 2].each { |x| puts x * 2 }
+  rescue ArgumentError => e
+    puts e.message
+  end
+end
+x = (a + b) * c ** -d
+y = (a or b) && !c`
+
+	expected := `class Greeter < Base
+  def greet(name, punct = "!", *rest, loud: false, &blk)
+    msg = "Hi, #{name}" + punct
+    msg = msg.upcase if loud
+    [1, 2].each { |x| puts(x * 2) }
+  rescue ArgumentError => e
+    puts(e.message)
+  end
+end
+x = (a + b) * c ** (-d)
+y = (a or b) && !c`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if got := ast.Format(program); got != expected {
+		t.Errorf("ast.Format() =\n%s\nwant\n%s", got, expected)
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	tests := []string{
+		`a - (b - c) - d`,
+		`a || b || c && d`,
+		`x = y = 3 rescue nil`,
+		`(a, b = 1, 2)`,
+		`foo(a, *b, **opts)`,
+		`foo(a, k: 1, &blk)`,
+		`obj&.attr = -> { 42 }`,
+		`h = { a: 1, "b" => [2, 3], 4 => nil }`,
+		`r = (1..) if (1...x).include?(2)`,
+		`puts(-2 ** 2, (-2) ** 2, 2 ** 3 ** 2, (2 ** 3) ** 2)`,
+		`not a and b or c`,
+		`t = a ? b ? 1 : 2 : (c = 3)`,
+		"if a\n  1\nelsif b\n  2\nelse\n  3\nend",
+		"case x\nwhen 1, 2 then :low\nelse :high\nend",
+		"case v\nin [Integer => a, *rest] if a > 0 then a\nin {name: String => n, **nil} then n\nin ^pinned | nil then 0\nend",
+		"while x < 10 do x += 1 end\nuntil done do work end",
+		"for i in 1..3 do p i end",
+		"begin\n  risky\nrescue A, B => e\n  retry\nelse\n  ok\nensure\n  done\nend",
+		"module M\n  class << self\n    def self.x; end\n  end\nend",
+		"items.map do |item; tmp|\n  tmp = item\n  tmp * 2\nend.sum",
+		"s = <<~EOS\n  one #{x}\n    two\nEOS\nputs s",
+		"def m\n  [1].each do |x|\n    y = <<-EOS\n  text\n    EOS\n  end\nend",
+		"`echo #{x}` + %q(a) + %Q[#{b}] + 'c'",
+		"x[1, 2] ||= Foo::Bar.new(1)\nre = /re+/i",
+		"yield 1, 2\nsuper\nsuper()\nreturn x if y",
+		`puts "a\tb\n\e\#{c}\\", 'it\'s \n', %q(\)), :"x\ty", %Q(\(\))`,
+		"s = <<~EOS\n  \\t \\#{x} #{y}\n  \\\\\nEOS\nt = <<~'EOS'\n  raw \\t\nEOS",
+		"puts DATA.read\n__END__\nsome data\n__END__\n",
+		"größe = { ключ: :ñ, Λ => @ß }\ndef grüß?(wört) = 日本語",
+		"%w[a b\\ c] + %W[x#{y} #@z]\nputs %i[c d], %I[e#{f}]",
+	}
+
+	for _, input := range tests {
+		l := lexer.New(input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		formatted := ast.Format(program)
+		l = lexer.New(formatted)
+		p = New(l)
+		reparsed := p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			t.Errorf("formatting %q gave %q, which does not parse: %v", input, formatted, p.Errors())
+			continue
+		}
+		if got, want := ast.Dump(reparsed), ast.Dump(program); got != want {
+			t.Errorf("formatting %q gave %q, which parses to\n%s\nwant\n%s", input, formatted, got, want)
+		}
+	}
+}
+
+func TestFormatSourceKeepsComments(t *testing.T) {
+	tests := []string{
+		"# frozen_string_literal: true\n# Greets.\n\nrequire(\"set\") # for Set\n",
+		"# A class\nclass Greeter\n  # Make one.\n  def initialize(name)\n    @name = name # keep it\n  end\n\n  def greet\n    if @name\n      # named\n      puts(@name)\n    else\n      puts(\"hi\")\n      # unnamed\n    end\n    # done\n  end\n\n  def empty\n    # nothing yet\n  end\nend\n",
+		"x = 1\n=begin\nblock\n  comment\n=end\ny = 2\n# last\n",
+		"a = 1\n\nb = 2\n",
+		"foo(1) do |v|\n  # c\n  v\nend\n",
+		"[1, 2].each do |v|\n  puts(v) # in block\nend\n",
+		"[1, 2].each do |v| # each one\n  puts(v)\nend\n",
+		"[1, 2].map { |v|\n  # doubled\n  v * 2\n}\n",
+		"items.each do |item|\n  item\nend\n",
+		"class Foo # x\n  def bar # y\n    1\n  end\nend\n",
+		"module Util # helpers\nend\n",
+		"class Empty\nend # done\n",
+	}
+
+	for _, input := range tests {
+		l := lexer.New(input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		formatted := ast.FormatSource(program, input, p.Comments())
+		if formatted != strings.TrimSuffix(input, "\n") {
+			t.Errorf("formatting %q gave %q", input, formatted)
+		}
+	}
+}
+
+func TestRescueClassExpressions(t *testing.T) {
+	input := `begin
+  fetch
+rescue MyGem::Errors::Timeout, *NETWORK_ERRORS => e
+  retry
+rescue IOError
+  log
+end`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	begin, ok := stmt.Expression.(*ast.BeginExpression)
+	if !ok {
+		t.Fatalf("expected BeginExpression, got %T", stmt.Expression)
+	}
+	if len(begin.Rescues) != 2 {
+		t.Fatalf("expected 2 rescue clauses, got %d", len(begin.Rescues))
+	}
+
+	rescue := begin.Rescues[0]
+	if len(rescue.Exceptions) != 2 {
+		t.Fatalf("expected 2 exception classes, got %d", len(rescue.Exceptions))
+	}
+	scoped, ok := rescue.Exceptions[0].(*ast.ScopedConstant)
+	if !ok || scoped.String() != "MyGem::Errors::Timeout" {
+		t.Errorf("expected MyGem::Errors::Timeout, got %s", rescue.Exceptions[0])
+	}
+	if _, ok := rescue.Exceptions[1].(*ast.SplatExpression); !ok {
+		t.Errorf("expected SplatExpression, got %T", rescue.Exceptions[1])
+	}
+	if rescue.Variable == nil || rescue.Variable.Value != "e" {
+		t.Errorf("expected rescue variable e, got %v", rescue.Variable)
+	}
+
+	if len(begin.Rescues[1].Exceptions) != 1 {
+		t.Fatalf("expected 1 exception class, got %d", len(begin.Rescues[1].Exceptions))
+	}
+	if _, ok := begin.Rescues[1].Exceptions[0].(*ast.Constant); !ok {
+		t.Errorf("expected Constant, got %T", begin.Rescues[1].Exceptions[0])
+	}
+	if len(begin.Rescues[1].Body.Statements) != 1 {
+		t.Errorf("expected 1 statement in second rescue, got %d", len(begin.Rescues[1].Body.Statements))
+	}
+}
+
+func TestSingletonMethodReceivers(t *testing.T) {
+	tests := []struct {
+		input    string
+		receiver string
+		name     string
+	}{
+		{"def self.foo; end", "self", "foo"},
+		{"def Foo.bar(x); x; end", "Foo", "bar"},
+		{"def Foo::Bar.baz; end", "Foo::Bar", "baz"},
+		{"def obj.greet; 'hi'; end", "obj", "greet"},
+		{"def @conn.close; end", "@conn", "close"},
+		{"def (a.b).c; end", "a.b()", "c"},
+		{"def Foo::bar; end", "Foo", "bar"},
+		{"def foo.bar = 1", "foo", "bar"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		method, ok := program.Statements[0].(*ast.MethodDefinition)
+		if !ok {
+			t.Fatalf("%q: expected MethodDefinition, got %T", tt.input, program.Statements[0])
+		}
+		if method.Receiver == nil {
+			t.Fatalf("%q: expected receiver", tt.input)
+		}
+		if got := method.Receiver.String(); got != tt.receiver {
+			t.Errorf("%q: expected receiver %q, got %q", tt.input, tt.receiver, got)
+		}
+		if method.Name != tt.name {
+			t.Errorf("%q: expected name %q, got %q", tt.input, tt.name, method.Name)
+		}
+	}
+}
+
+func TestConstantAssignmentTargets(t *testing.T) {
+	tests := []struct {
+		input    string
+		operator string
+		left     string
+	}{
+		{"LIMIT ||= compute", "||=", "LIMIT"},
+		{"Config::TIMEOUT += 1", "+=", "Config::TIMEOUT"},
+		{"::TOP = 1", "=", "::TOP"},
+		{"$count -= 1", "-=", "$count"},
+		{"a = b = c = 0", "=", "a"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		var left ast.Expression
+		switch exp := stmt.Expression.(type) {
+		case *ast.AssignmentExpression:
+			if tt.operator != "=" {
+				t.Errorf("%q: expected %s, got an assignment", tt.input, tt.operator)
+			}
+			left = exp.Left
+		case *ast.OpAssignmentExpression:
+			if exp.Operator != tt.operator {
+				t.Errorf("%q: expected operator %s, got %s", tt.input, tt.operator, exp.Operator)
+			}
+			left = exp.Left
+		default:
+			t.Fatalf("%q: expected an assignment, got %T", tt.input, stmt.Expression)
+		}
+		if left.String() != tt.left {
+			t.Errorf("%q: expected target %s, got %s", tt.input, tt.left, left.String())
+		}
+	}
+
+	// Chained assignments nest to the right
+	l := lexer.New("a = b = c = 0")
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	exp := program.Statements[0].(*ast.ExpressionStatement).Expression
+	for _, name := range []string{"a", "b", "c"} {
+		assign, ok := exp.(*ast.AssignmentExpression)
+		if !ok {
+			t.Fatalf("expected assignment to %s, got %T", name, exp)
+		}
+		if assign.Left.String() != name {
+			t.Errorf("expected assignment to %s, got %s", name, assign.Left.String())
+		}
+		exp = assign.Value
+	}
+	if lit, ok := exp.(*ast.IntegerLiteral); !ok || lit.Value != 0 {
+		t.Errorf("expected innermost value 0, got %s", exp)
+	}
+}
+
+func TestHeredocEscapes(t *testing.T) {
+	input := "a = <<~EOS\n  one\\ttwo \\#{x} #{y}\n  \\u00e9\\\\n\nEOS\nb = <<~'EOS'\n  raw\\t\nEOS"
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	interpolated, ok := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.AssignmentExpression).Value.(*ast.InterpolatedString)
+	if !ok {
+		t.Fatalf("expected InterpolatedString, got %T", program.Statements[0])
+	}
+	if first := interpolated.Parts[0].(*ast.StringLiteral).Value; first != "one\ttwo #{x} " {
+		t.Errorf("expected decoded text before the interpolation, got %q", first)
+	}
+	if last := interpolated.Parts[2].(*ast.StringLiteral).Value; last != "\né\\n\n" {
+		t.Errorf("expected decoded text after the interpolation, got %q", last)
+	}
+
+	raw := program.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.AssignmentExpression).Value.(*ast.StringLiteral)
+	if raw.Value != "raw\\t\n" {
+		t.Errorf("expected single-quoted heredoc to stay raw, got %q", raw.Value)
+	}
+}
+
+func TestFrozenStringLiterals(t *testing.T) {
+	input := "# frozen_string_literal: true\na = 'x'\nb = \"y#{a}\"\nc = <<~EOS\n  z\nEOS\nd = __ENCODING__"
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if program.MagicComments["frozen_string_literal"] != "true" {
+		t.Fatalf("expected the magic comment on the program, got %v", program.MagicComments)
+	}
+	value := func(i int) ast.Expression {
+		return program.Statements[i].(*ast.ExpressionStatement).Expression.(*ast.AssignmentExpression).Value
+	}
+	if str, ok := value(0).(*ast.StringLiteral); !ok || !str.Frozen {
+		t.Errorf("expected a frozen string literal, got %s", ast.Dump(value(0)))
+	}
+	if _, ok := value(1).(*ast.InterpolatedString); !ok {
+		t.Errorf("expected an interpolated string, got %T", value(1))
+	}
+	if str, ok := value(2).(*ast.StringLiteral); !ok || !str.Frozen {
+		t.Errorf("expected a frozen heredoc, got %s", ast.Dump(value(2)))
+	}
+	if enc, ok := value(3).(*ast.MagicComment); !ok || enc.Encoding != "UTF-8" {
+		t.Errorf("expected __ENCODING__ to default to UTF-8, got %s", ast.Dump(value(3)))
+	}
+
+	l = lexer.New(`a = "x"`)
+	p = New(l)
+	program = p.ParseProgram()
+	if value(0).(*ast.StringLiteral).Frozen {
+		t.Errorf("expected string literals to be unfrozen without the magic comment")
+	}
+}
+
+func TestHeredocInterpolationTokens(t *testing.T) {
+	input := "msg = <<~MSG\n  Hi #{names.map { |n| n }.join}\n    from #@sender\nMSG"
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	value := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.AssignmentExpression).Value
+	str, ok := value.(*ast.InterpolatedString)
+	if !ok {
+		t.Fatalf("expected InterpolatedString, got %T", value)
+	}
+	if len(str.Parts) != 5 {
+		t.Fatalf("expected 5 parts, got %d: %s", len(str.Parts), ast.Dump(str))
+	}
+	if call, ok := str.Parts[1].(*ast.MethodCall); !ok || call.Method != "join" {
+		t.Errorf("expected the join call, got %s", ast.Dump(str.Parts[1]))
+	}
+	if text := str.Parts[2].(*ast.StringLiteral).Value; text != "\n  from " {
+		t.Errorf("expected the text between the interpolations, got %q", text)
+	}
+	if ivar, ok := str.Parts[3].(*ast.InstanceVariable); !ok || ivar.Name != "@sender" {
+		t.Errorf("expected @sender, got %s", ast.Dump(str.Parts[3]))
+	}
+}
+
+func TestEndMarkerData(t *testing.T) {
+	input := "puts DATA.read\n__END__\nline one\n__END__ again\n"
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("expected 1 statement, got %d", len(program.Statements))
+	}
+	if !program.HasData || program.Data != "line one\n__END__ again\n" {
+		t.Errorf("expected the text after __END__ as data, got %v %q", program.HasData, program.Data)
+	}
+
+	// __END__ only ends the program on a line of its own
+	l = lexer.New("x = 1\n__END__ = 2\n")
+	p = New(l)
+	program = p.ParseProgram()
+	if program.HasData {
+		t.Errorf("expected no data, got %q", program.Data)
+	}
+}
+
+func TestReparse(t *testing.T) {
+	input := `# frozen_string_literal: true
+class Greeter
+  def greet(name)
+    "Hi #{name}"
+  end
+end
+x = 1
+y = [x,
+  2]
+puts x + y.size
+__END__
+data
+`
+	tests := []struct {
+		name string
+		edit lexer.Edit
+	}{
+		{"change a line", lexer.Edit{Start: strings.Index(input, "1\n"), End: strings.Index(input, "1\n") + 1, Text: "42"}},
+		{"insert a statement", lexer.Edit{Start: strings.Index(input, "x ="), End: strings.Index(input, "x ="), Text: "z = 3\n"}},
+		{"continue a statement", lexer.Edit{Start: strings.Index(input, "y ="), End: strings.Index(input, "y ="), Text: ".to_s\n"}},
+		{"edit inside brackets", lexer.Edit{Start: strings.Index(input, "2]"), End: strings.Index(input, "2]") + 1, Text: "3, 4"}},
+		{"edit a method", lexer.Edit{Start: strings.Index(input, "Hi"), End: strings.Index(input, "Hi") + 2, Text: "Hello"}},
+		{"edit the data", lexer.Edit{Start: strings.Index(input, "data"), End: len(input), Text: "more"}},
+	}
+
+	for _, tt := range tests {
+		old := New(lexer.New(input)).ParseProgram()
+		edited := tt.edit.Apply(input)
+		p := New(lexer.New(edited))
+		got := p.Reparse(old, tt.edit)
+		checkParserErrors(t, p)
+
+		want := New(lexer.New(edited)).ParseProgram()
+		gotJSON, _ := ast.MarshalJSON(got)
+		wantJSON, _ := ast.MarshalJSON(want)
+		if string(gotJSON) != string(wantJSON) {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tt.name, wantJSON, gotJSON)
+		}
+		if got.Data != want.Data || got.MagicComments["frozen_string_literal"] != "true" {
+			t.Errorf("%s: expected data %q and magic comments, got %q %v", tt.name, want.Data, got.Data, got.MagicComments)
+		}
+	}
+
+	// The statements the edit leaves alone are reused, moved if need be
+	old := New(lexer.New(input)).ParseProgram()
+	edit := lexer.Edit{Start: strings.Index(input, "1\n"), End: strings.Index(input, "1\n") + 1, Text: "1\nz = 2"}
+	program := New(lexer.New(edit.Apply(input))).Reparse(old, edit)
+	if len(program.Statements) != 5 {
+		t.Fatalf("expected 5 statements, got %d", len(program.Statements))
+	}
+	if program.Statements[0] != old.Statements[0] {
+		t.Errorf("expected the statement before the edit to be reused")
+	}
+	if program.Statements[3] != old.Statements[2] || program.Statements[4] != old.Statements[3] {
+		t.Errorf("expected the statements after the edit to be reused")
+	}
+	if pos := program.Statements[4].Pos(); pos.Line != 11 || pos.Offset != strings.Index(edit.Apply(input), "puts") {
+		t.Errorf("expected the reused statement to move, got %v", pos)
+	}
+}
+
+func TestUnicodeIdentifiers(t *testing.T) {
+	input := `日本語 = Ünïcode::Λ
+h = {größe:, Λ:}`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(program.Statements))
+	}
+	assign := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.AssignmentExpression)
+	if name, ok := assign.Left.(*ast.Identifier); !ok || name.Value != "日本語" {
+		t.Errorf("expected an assignment to 日本語, got %s", assign.Left)
+	}
+	if constant, ok := assign.Value.(*ast.ScopedConstant); !ok || constant.Name != "Λ" {
+		t.Errorf("expected the constant Ünïcode::Λ, got %s", assign.Value)
+	}
+
+	hash := program.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.AssignmentExpression).Value.(*ast.HashLiteral)
+	if len(hash.Order) != 2 {
+		t.Fatalf("expected 2 pairs, got %d", len(hash.Order))
+	}
+	if _, ok := hash.Pairs[hash.Order[0]].(*ast.Identifier); !ok {
+		t.Errorf("expected größe: to be a variable, got %T", hash.Pairs[hash.Order[0]])
+	}
+	if _, ok := hash.Pairs[hash.Order[1]].(*ast.Constant); !ok {
+		t.Errorf("expected Λ: to be a constant, got %T", hash.Pairs[hash.Order[1]])
+	}
+}
+
+func TestWordArrays(t *testing.T) {
+	input := `%w[a b] %W[x#{y} z] %i[c] %I[d#{e}]`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 4 {
+		t.Fatalf("expected 4 statements, got %d", len(program.Statements))
+	}
+	tests := []string{
+		`["a", "b"]`,
+		`["x#{y}", "z"]`,
+		`[:c]`,
+		`[:"d#{e}"]`,
+	}
+	for i, want := range tests {
+		stmt := program.Statements[i].(*ast.ExpressionStatement)
+		array, ok := stmt.Expression.(*ast.ArrayLiteral)
+		if !ok {
+			t.Fatalf("statement %d: expected *ast.ArrayLiteral, got %T", i, stmt.Expression)
+		}
+		if got := array.String(); got != want {
+			t.Errorf("statement %d: expected %s, got %s", i, want, got)
+		}
+	}
+
+	stmt := program.Statements[3].(*ast.ExpressionStatement)
+	sym, ok := stmt.Expression.(*ast.ArrayLiteral).Elements[0].(*ast.InterpolatedSymbol)
+	if !ok {
+		t.Fatalf("expected *ast.InterpolatedSymbol, got %T", stmt.Expression.(*ast.ArrayLiteral).Elements[0])
+	}
+	if len(sym.Parts) != 2 {
+		t.Fatalf("expected 2 parts, got %d", len(sym.Parts))
+	}
+}
+
 func checkParserErrors(t *testing.T, p *Parser) {
 	errors := p.Errors()
 	if len(errors) == 0 {
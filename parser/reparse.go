@@ -0,0 +1,83 @@
+package parser
+
+import (
+	"github.com/alexisbouchez/rubylexer/ast"
+	"github.com/alexisbouchez/rubylexer/lexer"
+	"github.com/alexisbouchez/rubylexer/token"
+)
+
+// Reparse parses the input of the parser's lexer, which is the source of
+// old with edit made to it, reusing the top-level statements of old that
+// the edit leaves alone. Those before the line the edit starts on are kept
+// as they are; once parsing is back in step after the edit, the rest are
+// moved to their new positions and kept too. Errors are only reported for
+// the statements parsed again. The statements of old are taken over, so
+// old must not be used afterwards.
+func (p *Parser) Reparse(old *ast.Program, edit lexer.Edit) *ast.Program {
+	program := &ast.Program{}
+	program.Statements = []ast.Statement{}
+	stmts := old.Statements
+
+	// Resume at the last statement starting a line before the edit. One
+	// the edit starts at is parsed again, since the edit could make it
+	// part of the statement before, as a leading .method call does.
+	resume := 0
+	for i := 1; i < len(stmts) && stmts[i].Pos().Offset < edit.Start; i++ {
+		if startsLine(stmts, i) {
+			resume = i
+		}
+	}
+	if resume > 0 {
+		program.Statements = append(program.Statements, stmts[:resume]...)
+		start := stmts[resume].Pos()
+		p.l.ResumeAt(token.Pos{Line: start.Line, Column: 1, Offset: lineStart(start)})
+		p.nextToken()
+		p.nextToken()
+	}
+
+	// The statements starting lines after the edit, by where they started
+	after := make(map[int]int)
+	for i := resume + 1; i < len(stmts); i++ {
+		if start := stmts[i].Pos(); lineStart(start) >= edit.End && startsLine(stmts, i) {
+			after[start.Offset] = i
+		}
+	}
+	delta := len(edit.Text) - (edit.End - edit.Start)
+
+	for !p.curTokenIs(token.EOF) && !p.curTokenIs(token.END_MARKER) {
+		if n := len(program.Statements); n > 0 && lineStart(p.curToken.Pos()) >= edit.Start+len(edit.Text) &&
+			program.Statements[n-1].EndPos().Line < p.curToken.Line {
+			if i, ok := after[p.curToken.Offset-delta]; ok {
+				lines := p.curToken.Line - stmts[i].Pos().Line
+				for _, stmt := range stmts[i:] {
+					ast.Shift(stmt, lines, delta)
+				}
+				program.Statements = append(program.Statements, stmts[i:]...)
+				program.MagicComments = p.l.MagicComments()
+				program.Data, program.HasData = old.Data, old.HasData
+				return program
+			}
+		}
+		stmt := p.parseStatement()
+		if stmt != nil {
+			program.Statements = append(program.Statements, stmt)
+		}
+		p.nextToken()
+	}
+	program.MagicComments = p.l.MagicComments()
+	program.Data, program.HasData = p.l.Data()
+
+	return program
+}
+
+// startsLine reports whether statement i starts on a later line than the
+// one before it ends on, so that parsing can start again from that line.
+func startsLine(stmts []ast.Statement, i int) bool {
+	start, end := stmts[i].Pos(), stmts[i-1].EndPos()
+	return start.IsValid() && end.IsValid() && end.Line < start.Line
+}
+
+// lineStart returns the offset of the start of the line pos is on.
+func lineStart(pos token.Pos) int {
+	return pos.Offset - pos.Column + 1
+}
@@ -74,11 +74,16 @@ func Start(in io.Reader, out io.Writer) {
 
 		program := p.ParseProgram()
 		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
+			printParserErrors(out, line, p.SyntaxErrors())
 			continue
 		}
 
 		evaluated := evaluator.Eval(program, env)
+		if err, ok := evaluated.(*object.Error); ok {
+			if _, isExit := evaluator.ExitStatus(err); isExit {
+				return
+			}
+		}
 		if evaluated != nil {
 			if evaluated.Type() != object.NIL_OBJ {
 				fmt.Fprintln(out, "=> "+evaluated.Inspect())
@@ -89,9 +94,9 @@ func Start(in io.Reader, out io.Writer) {
 	}
 }
 
-func printParserErrors(out io.Writer, errors []string) {
-	for _, msg := range errors {
-		fmt.Fprintln(out, "SyntaxError: "+msg)
+func printParserErrors(out io.Writer, input string, errors []parser.Error) {
+	for _, err := range errors {
+		fmt.Fprintln(out, parser.FormatError("(irb)", input, err.Pos, "SyntaxError: "+err.Msg))
 	}
 }
 
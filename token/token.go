@@ -1,6 +1,12 @@
 // Package token defines Ruby lexer token types and utilities.
 package token
 
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
 // Type represents the type of a token.
 type Type int
 
@@ -199,11 +205,47 @@ type Token struct {
 	Line    int
 	Column  int
 	Offset  int
+
+	// Where the token ends, just past its last character
+	EndLine   int
+	EndColumn int
+	EndOffset int
+
+	// Whitespace and comments before the token, set only when the lexer
+	// preserves trivia
+	Trivia string
 }
 
 // Position returns a human-readable position string.
 func (t Token) Position() string {
-	return ""
+	return t.Pos().String()
+}
+
+// Pos returns where the token starts.
+func (t Token) Pos() Pos {
+	return Pos{Line: t.Line, Column: t.Column, Offset: t.Offset}
+}
+
+// End returns where the token ends, just past its last character.
+func (t Token) End() Pos {
+	return Pos{Line: t.EndLine, Column: t.EndColumn, Offset: t.EndOffset}
+}
+
+// Pos is a location in the source. Line and Column count from 1; the zero
+// Pos means the location is unknown.
+type Pos struct {
+	Line   int
+	Column int
+	Offset int
+}
+
+// IsValid reports whether the position is known.
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
 }
 
 var tokenNames = map[Type]string{
@@ -439,13 +481,19 @@ func LookupIdent(ident string) Type {
 	if tok, ok := Keywords[ident]; ok {
 		return tok
 	}
-	// Check if it's a constant (starts with uppercase)
-	if len(ident) > 0 && ident[0] >= 'A' && ident[0] <= 'Z' {
+	if IsConstant(ident) {
 		return CONSTANT
 	}
 	return IDENT
 }
 
+// IsConstant reports whether name is the name of a constant, which starts
+// with an uppercase letter in any script.
+func IsConstant(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(r) || unicode.IsTitle(r)
+}
+
 // IsKeyword returns true if the token type is a keyword.
 func (t Type) IsKeyword() bool {
 	return t > keyword_beg && t < keyword_end